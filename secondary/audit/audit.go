@@ -10,7 +10,12 @@ package audit
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	cbaudit "github.com/couchbase/goutils/go-cbaudit"
 	"github.com/couchbase/indexing/secondary/logging"
@@ -42,8 +47,67 @@ type AuditEvent struct {
 	Method  string                    `json:"method"`            // "Class::Method"
 	Url     string                    `json:"url"`               // string version of URL from request
 	Message string                    `json:"message,omitempty"` // optional additional message
+
+	// Optional fields of DDL, settings and data access events
+	Bucket     string                 `json:"bucket,omitempty"`
+	Scope      string                 `json:"scope,omitempty"`
+	Collection string                 `json:"collection,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Settings   map[string]interface{} `json:"settings,omitempty"`
+}
+
+// AuditFields holds the optional fields of an audit event. Events for DDL and data access carry
+// the keyspace and index they apply to; settings change events carry the changed settings.
+type AuditFields struct {
+	User       string // user the event is filtered by; taken from the request if not set
+	Message    string
+	Bucket     string
+	Scope      string
+	Collection string
+	Index      string
+	Settings   map[string]interface{}
+}
+
+// nonHttpAuditEvent is the audit event for requests that do not come in over HTTP, e.g. scans
+// on the queryport and DDL over the metadata channel. Its common fields are filled in here as
+// there is no http.Request for go-cbaudit to take them from.
+type nonHttpAuditEvent struct {
+	Common     nonHttpCommonFields `json:"common"`
+	Service    string              `json:"service"`
+	Method     string              `json:"method"`
+	Message    string              `json:"message,omitempty"`
+	Bucket     string              `json:"bucket,omitempty"`
+	Scope      string              `json:"scope,omitempty"`
+	Collection string              `json:"collection,omitempty"`
+	Index      string              `json:"index,omitempty"`
+}
+
+type nonHttpCommonFields struct {
+	Timestamp  string        `json:"timestamp"`
+	RealUserid auditUser     `json:"real_userid"`
+	Remote     *auditAddress `json:"remote,omitempty"`
+	Local      *auditAddress `json:"local,omitempty"`
+}
+
+type auditUser struct {
+	Domain string `json:"domain"`
+	User   string `json:"user"`
+}
+
+type auditAddress struct {
+	Ip   string `json:"ip"`
+	Port int    `json:"port"`
 }
 
+// auditFilter holds the event ids and users that are not audited.
+type auditFilter struct {
+	disabledEvents map[uint32]bool
+	disabledUsers  map[string]bool
+}
+
+// filterPtr is really a *auditFilter, nil if nothing is filtered.
+var filterPtr unsafe.Pointer
+
 // InitAuditService initializes the singleton auditService.
 func InitAuditService(address string) error {
 
@@ -71,15 +135,111 @@ func InitAuditService(address string) error {
 // should be passed as the class name, e.g. "request_handler" for funcs in request_handler.go.)
 // msg is an optional additional message to log with the audit info.
 func Audit(eventId uint32, req *http.Request, method string, msg string) error {
+	return AuditWithFields(eventId, req, method, &AuditFields{Message: msg})
+}
+
+// AuditWithFields is Audit for events with optional fields beyond the message, e.g. the index a
+// DDL request applies to. fields may be nil.
+func AuditWithFields(eventId uint32, req *http.Request, method string, fields *AuditFields) error {
+	if fields == nil {
+		fields = &AuditFields{}
+	}
+
+	user := fields.User
+	if len(user) == 0 {
+		user, _, _ = req.BasicAuth()
+	}
+	if IsFiltered(eventId, user) {
+		return nil
+	}
+
 	// event is the full audit event to log
 	event := AuditEvent{
-		Service: "Index",
-		Method:  method,
-		Url:     fmt.Sprintf("%v", req.URL),
-		Message: msg} // optional
+		Service:    "Index",
+		Method:     method,
+		Url:        fmt.Sprintf("%v", req.URL),
+		Message:    fields.Message, // optional
+		Bucket:     fields.Bucket,
+		Scope:      fields.Scope,
+		Collection: fields.Collection,
+		Index:      fields.Index,
+		Settings:   fields.Settings}
 	event.Common = cbaudit.GetCommonAuditFields(req)
 
-	// Write the event to audit.log if auditing is enabled (else this is a no-op)
+	return write(eventId, event)
+}
+
+// AuditNonHttp writes an entry in the audit.log for an event of a request that did not come in
+// over HTTP. remote and local are the addresses of the connection the request came in on, and
+// are nil if not known. Settings are not logged for these events.
+func AuditNonHttp(eventId uint32, remote, local net.Addr, method string, fields *AuditFields) error {
+	if fields == nil {
+		fields = &AuditFields{}
+	}
+
+	if IsFiltered(eventId, fields.User) {
+		return nil
+	}
+
+	event := nonHttpAuditEvent{
+		Service:    "Index",
+		Method:     method,
+		Message:    fields.Message,
+		Bucket:     fields.Bucket,
+		Scope:      fields.Scope,
+		Collection: fields.Collection,
+		Index:      fields.Index}
+	event.Common.Timestamp = time.Now().Format("2006-01-02T15:04:05.000Z07:00")
+	event.Common.RealUserid.User = fields.User
+	event.Common.Remote = toAuditAddress(remote)
+	event.Common.Local = toAuditAddress(local)
+
+	return write(eventId, event)
+}
+
+// SetFilter sets the event ids and users that are not audited, replacing the previous ones.
+// Thread-safe.
+func SetFilter(disabledEvents []uint32, disabledUsers []string) {
+	var filter *auditFilter
+	if len(disabledEvents) != 0 || len(disabledUsers) != 0 {
+		filter = &auditFilter{
+			disabledEvents: make(map[uint32]bool),
+			disabledUsers:  make(map[string]bool),
+		}
+		for _, eventId := range disabledEvents {
+			filter.disabledEvents[eventId] = true
+		}
+		for _, user := range disabledUsers {
+			filter.disabledUsers[user] = true
+		}
+	}
+	atomic.StorePointer(&filterPtr, unsafe.Pointer(filter))
+}
+
+// IsFiltered returns whether events with eventId, or of user, are not audited.
+// Callers on hot paths check it before building the fields of an event.
+func IsFiltered(eventId uint32, user string) bool {
+	filter := (*auditFilter)(atomic.LoadPointer(&filterPtr))
+	if filter == nil {
+		return false
+	}
+	return filter.disabledEvents[eventId] || (len(user) != 0 && filter.disabledUsers[user])
+}
+
+func toAuditAddress(addr net.Addr) *auditAddress {
+	if addr == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	portNum, _ := strconv.Atoi(port)
+	return &auditAddress{Ip: host, Port: portNum}
+}
+
+// write writes the event to audit.log if auditing is enabled (else this is a no-op)
+func write(eventId uint32, event interface{}) error {
 	err := auditService.Write(eventId, event)
 	if err != nil {
 		err2 := fmt.Errorf("audit::AuditEvent: Write failed with error %v", err)
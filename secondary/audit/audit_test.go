@@ -0,0 +1,64 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package audit
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSetFilter(t *testing.T) {
+	defer SetFilter(nil, nil)
+
+	SetFilter(nil, nil)
+	if IsFiltered(1, "") || IsFiltered(1, "user1") {
+		t.Errorf("expected nothing to be filtered without a filter")
+	}
+
+	SetFilter([]uint32{1, 2}, []string{"user1"})
+	tests := []struct {
+		eventId  uint32
+		user     string
+		filtered bool
+	}{
+		{1, "", true},
+		{2, "user2", true},
+		{3, "", false},
+		{3, "user1", true},
+		{3, "user2", false},
+		{3, "USER1", false}, // users are case-sensitive
+	}
+	for _, test := range tests {
+		if got := IsFiltered(test.eventId, test.user); got != test.filtered {
+			t.Errorf("IsFiltered(%v, %q) = %v, expected %v",
+				test.eventId, test.user, got, test.filtered)
+		}
+	}
+
+	// a new filter replaces the previous one
+	SetFilter(nil, []string{"user2"})
+	if IsFiltered(1, "user1") || !IsFiltered(1, "user2") {
+		t.Errorf("expected only user2 to be filtered")
+	}
+
+	SetFilter([]uint32{}, []string{})
+	if IsFiltered(1, "user2") {
+		t.Errorf("expected empty filter lists to filter nothing")
+	}
+}
+
+func TestToAuditAddress(t *testing.T) {
+	if addr := toAuditAddress(nil); addr != nil {
+		t.Errorf("expected no address, got %+v", addr)
+	}
+	addr := toAuditAddress(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 9101})
+	if addr == nil || addr.Ip != "127.0.0.1" || addr.Port != 9101 {
+		t.Errorf("unexpected address %+v", addr)
+	}
+}
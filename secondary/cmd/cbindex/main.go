@@ -52,6 +52,13 @@ func usage(fset *flag.FlagSet) {
 	cbindex -auth user:pass -type alter -bucket default -index index1 -with '{"action":"replica_count","num_replica":2}'
 	cbindex -auth user:pass -type alter -bucket default -index index1 -with '{"action":"drop_replica","replicaId":1}'
 	(Alter Index supports changing only 1 index (and its replicas) at a time)
+
+- Projector
+	cbindex -auth user:pass -type projector -projector 127.0.0.1:9999
+	cbindex -auth user:pass -type projector -projector 127.0.0.1:9999 -topic MAINT_STREAM_TOPIC_xxx
+	cbindex -auth user:pass -type projector -projector 127.0.0.1:9999 -topic MAINT_STREAM_TOPIC_xxx -repair repairEndpoints -with '{"endpoints":["127.0.0.1:9105"]}'
+	cbindex -auth user:pass -type projector -projector 127.0.0.1:9999 -topic MAINT_STREAM_TOPIC_xxx -repair restartVbuckets -with '{"opaque2":1234,"keyspaceIds":["default"],"restartTimestamps":[{"bucket":"default","vbnos":[7],"seqnos":[100],"vbuuids":[5678],"snapshots":[{"start":100,"end":100}]}]}'
+	(restart seqnos, vbuuids and opaque2 are from the topic's state, vbuckets that are active are not restarted)
 	`)
 }
 
@@ -0,0 +1,270 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/manager"
+	"github.com/couchbase/indexing/secondary/planner"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Usage: cbindexmeta [options]")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, `Examples:
+- Validate
+    cbindexmeta -command=validate -image="backup.json"
+- Dry-run
+    cbindexmeta -command=dryrun -image="backup.json" -plan="saved-plan.json"
+    cbindexmeta -command=dryrun -image="backup.json" -plan="saved-plan.json" -bucket="bucket2" -include="scope1,scope2.coll1"
+    cbindexmeta -command=dryrun -image="backup.json" -plan="saved-plan.json" -bucket="bucket2" -remap="scope1:scope2" -output="report.json"
+- Diff
+    cbindexmeta -command=diff -image="backup.json" -target="newbackup.json"
+- DDL
+    cbindexmeta -command=ddl -image="backup.json" -output="ddl.txt"
+    `)
+	fmt.Fprintln(os.Stderr, `Usage Note:
+1) cbindexmeta works on index metadata backup images without a live cluster.  A backup image is the output of the
+   /getIndexMetadata REST endpoint of the indexer, or the "result" object of it.
+2) The validate command reports definitions that are incomplete or conflicting, and indexes that would not be restored.
+3) The dryrun command reports which indexes would be created (and on which node), skipped or renamed if the image were
+   restored onto the index layout of a plan file, such as one saved by cbindexplan.  Filters (-include/-exclude) and
+   remaps (-remap) are applied as by the restore REST endpoint, and require -bucket.  Planning uses the default indexer
+   settings.
+4) The diff command reports indexes added, dropped or changed in the target image compared to the image.
+5) The ddl command generates the create index statements for all indexes in the image.
+    `)
+}
+
+//////////////////////////////////////////////////////////////
+// Global Variable
+/////////////////////////////////////////////////////////////
+
+var gHelp bool
+var gCommand string
+var gImage string
+var gTarget string
+var gPlan string
+var gBucket string
+var gInclude string
+var gExclude string
+var gRemap string
+var gOutput string
+var gLogLevel string
+
+//////////////////////////////////////////////////////////////
+// Initialization
+/////////////////////////////////////////////////////////////
+
+func init() {
+	flag.BoolVar(&gHelp, "help", false, "print usage")
+	flag.StringVar(&gLogLevel, "logLevel", "WARN", "log level")
+	flag.StringVar(&gOutput, "output", "", "save the result to a file instead of printing to console")
+
+	flag.StringVar(&gCommand, "command", "", "command = {validate | dryrun | diff | ddl}")
+	flag.StringVar(&gImage, "image", "", "index metadata backup image file")
+
+	// diff
+	flag.StringVar(&gTarget, "target", "", "backup image file to compare against (used with diff command)")
+
+	// dryrun
+	flag.StringVar(&gPlan, "plan", "", "index layout plan file of the cluster to restore to (used with dryrun command)")
+	flag.StringVar(&gBucket, "bucket", "", "bucket to restore to (used with dryrun command)")
+	flag.StringVar(&gInclude, "include", "", "comma separated scopes or scope.collections to restore (used with dryrun command)")
+	flag.StringVar(&gExclude, "exclude", "", "comma separated scopes or scope.collections not to restore (used with dryrun command)")
+	flag.StringVar(&gRemap, "remap", "", "comma separated source:target scopes or scope.collections to remap (used with dryrun command)")
+}
+
+func main() {
+	flag.Parse()
+	logging.SetLogLevel(logging.Level(strings.ToUpper(gLogLevel)))
+
+	if gHelp {
+		usage()
+		return
+	}
+
+	if gImage == "" {
+		logging.Fatalf("Invalid argument: argument 'image' is required to specify the backup image.")
+		usage()
+		os.Exit(1)
+	}
+
+	image, err := manager.ReadClusterIndexMetadata(gImage)
+	if err != nil {
+		logging.Fatalf("%v", err)
+		os.Exit(1)
+	}
+
+	switch gCommand {
+	case "validate":
+		validate(image)
+	case "dryrun":
+		dryRun(image)
+	case "diff":
+		diff(image)
+	case "ddl":
+		ddl(image)
+	default:
+		logging.Fatalf("Invalid argument: Invalid value for 'command' : %v", gCommand)
+		usage()
+		os.Exit(1)
+	}
+}
+
+func validate(image *manager.ClusterIndexMetadata) {
+
+	errs := manager.ValidateImage(image)
+
+	var sb strings.Builder
+	for _, err := range errs {
+		fmt.Fprintf(&sb, "%v\n", err)
+	}
+	if len(errs) == 0 {
+		fmt.Fprintf(&sb, "Backup image %v is valid\n", gImage)
+	}
+	output([]byte(sb.String()))
+
+	if len(errs) != 0 {
+		os.Exit(1)
+	}
+}
+
+func dryRun(image *manager.ClusterIndexMetadata) {
+
+	plan, err := planner.ReadPlan(gPlan)
+	if err != nil {
+		logging.Fatalf("Error in reading plan: %v", err)
+		os.Exit(1)
+	}
+
+	if plan == nil {
+		logging.Fatalf("Invalid argument: argument 'plan' is required to specify the index layout to restore to.")
+		usage()
+		os.Exit(1)
+	}
+
+	filters, filterType, err := manager.ParseFilters(gBucket, gInclude, gExclude)
+	if err != nil {
+		logging.Fatalf("%v", err)
+		os.Exit(1)
+	}
+
+	remap, err := manager.ParseRemap(gRemap)
+	if err != nil {
+		logging.Fatalf("%v", err)
+		os.Exit(1)
+	}
+
+	context := manager.CreateOfflineRestoreContext(image, plan, gBucket, filters, filterType, remap)
+	report, err := context.DryRun()
+	if err != nil {
+		logging.Fatalf("Restore dry-run error: %v", err)
+		os.Exit(1)
+	}
+
+	if gOutput != "" {
+		outputJson(report)
+		return
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Create (%v):\n", len(report.Create))
+	for _, action := range report.Create {
+		fmt.Fprintf(&sb, "\t%v.%v.%v.%v replica %v partitions %v on %v\n", action.Bucket, action.Scope,
+			action.Collection, action.Name, action.ReplicaId, action.Partitions, action.Host)
+	}
+	fmt.Fprintf(&sb, "Skip (%v):\n", len(report.Skip))
+	for _, action := range report.Skip {
+		fmt.Fprintf(&sb, "\t%v.%v.%v.%v: %v\n", action.Bucket, action.Scope, action.Collection,
+			action.Name, action.Reason)
+	}
+	fmt.Fprintf(&sb, "Rename (%v):\n", len(report.Rename))
+	for _, action := range report.Rename {
+		fmt.Fprintf(&sb, "\t%v.%v.%v.%v to %v: %v\n", action.Bucket, action.Scope, action.Collection,
+			action.Name, action.NewName, action.Reason)
+	}
+	output([]byte(sb.String()))
+}
+
+func diff(image *manager.ClusterIndexMetadata) {
+
+	if gTarget == "" {
+		logging.Fatalf("Invalid argument: argument 'target' is required to specify the backup image to compare against.")
+		usage()
+		os.Exit(1)
+	}
+
+	target, err := manager.ReadClusterIndexMetadata(gTarget)
+	if err != nil {
+		logging.Fatalf("%v", err)
+		os.Exit(1)
+	}
+
+	result := manager.DiffImages(image, target)
+
+	if gOutput != "" {
+		outputJson(result)
+		return
+	}
+
+	stmt := func(defn *common.IndexDefn) string {
+		return common.IndexStatement(*defn, int(defn.NumPartitions), -1, false)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Added (%v):\n", len(result.Added))
+	for _, defn := range result.Added {
+		fmt.Fprintf(&sb, "\t+ %v\n", stmt(defn))
+	}
+	fmt.Fprintf(&sb, "Dropped (%v):\n", len(result.Dropped))
+	for _, defn := range result.Dropped {
+		fmt.Fprintf(&sb, "\t- %v\n", stmt(defn))
+	}
+	fmt.Fprintf(&sb, "Changed (%v):\n", len(result.Changed))
+	for _, change := range result.Changed {
+		fmt.Fprintf(&sb, "\t- %v\n\t+ %v\n", stmt(change.Source), stmt(change.Target))
+	}
+	output([]byte(sb.String()))
+}
+
+func ddl(image *manager.ClusterIndexMetadata) {
+	output([]byte(strings.Join(manager.GenerateImageDDL(image), "\n") + "\n"))
+}
+
+func outputJson(result interface{}) {
+	buf, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		logging.Fatalf("Unable to marshal result. err = %v", err)
+		os.Exit(1)
+	}
+	output(buf)
+}
+
+func output(buf []byte) {
+	if gOutput == "" {
+		os.Stdout.Write(buf)
+		return
+	}
+
+	if err := iowrap.Ioutil_WriteFile(gOutput, buf, 0644); err != nil {
+		logging.Fatalf("Unable to write to %v. err = %v", gOutput, err)
+		os.Exit(1)
+	}
+}
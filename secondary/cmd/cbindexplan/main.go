@@ -49,6 +49,14 @@ func advanced_usage() {
     cbindexplan -command=rebalance -plan="saved-plan.json"
     cbindexplan -command=rebalance -plan="saved-plan.json" -output="newplan.json"
     cbindexplan -command=rebalance -plan="saved-plan.json" -addNode=1
+- Diff
+    cbindexplan -command=diff -plan="saved-plan.json" -target="newplan.json"
+    cbindexplan -command=diff -cluster="127.0.0.1:8091" -username="<user>" -password="<pwd>" -target="newplan.json" -output="diff.json"
+    cbindexplan -command=diff -plan="saved-plan.json" -target="newplan.json" -transferRate="100M"
+- Forecast
+    cbindexplan -command=forecast -plan="saved-plan.json" -stats="stats-dir"
+    cbindexplan -command=forecast -cluster="127.0.0.1:8091" -username="<user>" -password="<pwd>" -stats="stats-dir" -days=180
+    cbindexplan -command=forecast -plan="saved-plan.json" -stats="stats-dir" -memQuota="10G" -diskQuota="500G" -output="forecast.json"
     `)
 	fmt.Fprintln(os.Stderr, `Usage Note:
 1) cbindexplan should only be used with MOI clsuter.
@@ -76,6 +84,24 @@ func advanced_usage() {
    will estimate index size from indexer stats.  The estimate live index size will be used for rebalancing algorithm.
 2) For rebalancing, if an index is pinned to a node (when index is created with with-nodes option), rebalancing algorithm will not move
    those index.  Use 'unpin' option to instruct the rebalance algorithm to rebalance pinned indexes.
+    `)
+	fmt.Fprintln(os.Stderr, `Diff Note:
+1) cbindexplan can report what would change between the current index layout (using -plan or -cluster option) and a
+   proposed index layout (using -target option), such as a plan file saved by the plan or rebalance command.
+2) The report lists every index partition/replica to be moved, created or dropped, the amount of data to move, the
+   estimated rebalance duration and the resource change on each indexer node.  The report is printed to the console, and
+   can optionally be saved in JSON form (when specifying -output option).
+3) The rebalance duration is estimated based on the transfer rate per destination node (using -transferRate option).
+    `)
+	fmt.Fprintln(os.Stderr, `Forecast Note:
+1) cbindexplan can forecast when indexer nodes would run out of memory or disk quota, given the current index layout (using -plan
+   or -cluster option) and a directory of periodic indexer stats dumps (using -stats option).
+2) Each file in the stats directory is a json object of indexer node id to the output of the indexer /stats endpoint on that node.
+   The time of each dump is taken from the "timestamp" stat, or from the file modification time.
+3) cbindexplan fits a linear growth trend of items count, data size, disk size and mutation rate for each index, and projects them
+   over the number of days given by -days option.  Memory usage is recalculated using the MOI/plasma sizing equation.
+4) If a node is projected to exceed its quota, cbindexplan reports when and how many indexer nodes are needed for rebalancing.
+   Use -memQuota and -diskQuota to override the quota used for forecasting.
     `)
 }
 
@@ -173,6 +199,11 @@ var gCpuQuota int
 var gEjectedNode string
 var gGetUsage bool
 var gNumNewReplica int
+var gTargetPlan string
+var gTransferRate string
+var gStatsDir string
+var gDays int
+var gDiskQuota string
 
 //////////////////////////////////////////////////////////////
 // Initialization
@@ -186,7 +217,7 @@ func init() {
 	flag.StringVar(&gGenStmt, "ddl", "", "generate DDL statement after planning for new/moved indexes")
 
 	// command + index specification
-	flag.StringVar(&gCommand, "command", "", "command = {plan | rebalance | retrieve | swap}")
+	flag.StringVar(&gCommand, "command", "", "command = {plan | rebalance | retrieve | swap | diff | forecast}")
 	flag.StringVar(&gClusterUrl, "cluster", "", "fetch existing index layout plan from cluster url")
 	flag.StringVar(&gUsername, "username", "", "admin user for the cluster")
 	flag.StringVar(&gPassword, "password", "", "admin password for the cluster")
@@ -203,6 +234,15 @@ func init() {
 	// placement
 	flag.BoolVar(&gAllowUnpin, "allowUnpin", false, "flag to tell if planner should allow existing index to move during placement.")
 
+	// diff
+	flag.StringVar(&gTargetPlan, "target", "", "proposed index layout plan file to compare against (used with diff command)")
+	flag.StringVar(&gTransferRate, "transferRate", "", "data transfer rate per indexer node for estimating rebalance duration (e.g. 50M, 1G)")
+
+	// forecast
+	flag.StringVar(&gStatsDir, "stats", "", "directory of periodic indexer stats dumps (used with forecast command)")
+	flag.IntVar(&gDays, "days", planner.DefaultForecastDays, "number of days to forecast (used with forecast command)")
+	flag.StringVar(&gDiskQuota, "diskQuota", "", "disk quota per indexer node (e.g. 100G) (used with forecast command)")
+
 	// swap
 	flag.StringVar(&gEjectedNode, "ejectNode", "", "node to be ejected from cluster")
 
@@ -266,7 +306,7 @@ func main() {
 		}
 	}
 
-	if gCommand == planner.CommandRebalance && plan == nil {
+	if (gCommand == planner.CommandRebalance || gCommand == planner.CommandDiff || gCommand == planner.CommandForecast) && plan == nil {
 		logging.Fatalf("Unable to get index layout from either argument 'plan' or 'cluster'.")
 		usage()
 		return
@@ -392,6 +432,56 @@ func main() {
 			return
 		}
 
+	} else if gCommand == string(planner.CommandDiff) {
+
+		target, err := planner.ReadPlan(gTargetPlan)
+		if err != nil {
+			logging.Fatalf("Error in reading target plan: %v", err)
+			return
+		}
+
+		if target == nil {
+			logging.Fatalf("Invalid argument: argument 'target' is required to specify the proposed index layout.")
+			usage()
+			return
+		}
+
+		transferRate, err := planner.ParseMemoryStr(gTransferRate)
+		if err != nil {
+			logging.Fatalf("%v", err)
+			return
+		}
+
+		if transferRate < 0 {
+			transferRate = 0
+		}
+
+		_, err = planner.ExecuteDiffWithOptions(plan, target, true, gOutput, uint64(transferRate))
+		if err != nil {
+			logging.Fatalf("Planner error: %v.", err)
+			return
+		}
+
+	} else if gCommand == string(planner.CommandForecast) {
+
+		if gStatsDir == "" {
+			logging.Fatalf("Invalid argument: argument 'stats' is required to specify the stats directory.")
+			usage()
+			return
+		}
+
+		diskQuota, err := planner.ParseMemoryStr(gDiskQuota)
+		if err != nil {
+			logging.Fatalf("%v", err)
+			return
+		}
+
+		_, err = planner.ExecuteForecastWithOptions(plan, gStatsDir, memQuota, diskQuota, gDays, true, gOutput)
+		if err != nil {
+			logging.Fatalf("Planner error: %v.", err)
+			return
+		}
+
 	} else {
 		logging.Fatalf("Invalid argument: Invalid value for 'command' : %v", gCommand)
 		usage()
@@ -175,6 +175,14 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.sharedExprs": ConfigValue{
+		true,
+		"evaluate expressions that are identical across the indexes " +
+			"of a collection once per document",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"projector.feedChanSize": ConfigValue{
 		100,
 		"channel size for feed's control path, " +
@@ -290,6 +298,124 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.dcp.snappy": ConfigValue{
+		true,
+		"negotiate snappy compressed document values on dcp feeds, " +
+			"values are decompressed before evaluation",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.forceValueCompression": ConfigValue{
+		false,
+		"request dcp producer to snappy compress all document values, " +
+			"applies only if snappy is negotiated",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.streamId": ConfigValue{
+		false,
+		"share one dcp connection per bucket between the feeds of all " +
+			"topics, using dcp stream ids, applies only to collection " +
+			"aware feeds without oso snapshots. Events queued for a " +
+			"topic on shared connections count towards its memory " +
+			"budget, and their maintenance mutations count for " +
+			"projector.backfill.maintPriority, but shared connections " +
+			"are not shaped by projector.backfill.rateLimit",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.feederQueueBytes": ConfigValue{
+		64 * 1024 * 1024,
+		"bytes of events a topic can queue on a shared dcp connection, " +
+			"with projector.dcp.streamId, before its streams on the " +
+			"connection are ended and restarted, 0 for no limit. " +
+			"Changing this value does not affect existing feeds.",
+		64 * 1024 * 1024,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.collectionFilter": ConfigValue{
+		true,
+		"request the dcp streams of bucket level keyspaces with a filter " +
+			"for the collections of their index instances, applies only " +
+			"to collection aware feeds",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.record.dir": ConfigValue{
+		"",
+		"directory to record the dcp events of feeds in, for replaying " +
+			"them offline with tools/dcpreplay, empty disables recording. " +
+			"Recordings hold the raw document keys, values and xattrs " +
+			"in plaintext, even if index storage is encrypted",
+		"",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.record.keyspaces": ConfigValue{
+		"",
+		"comma separated keyspace ids to record dcp events for, " +
+			"empty records all keyspaces",
+		"",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.record.maxFileSize": ConfigValue{
+		64 * 1024 * 1024,
+		"size in bytes after which a recording moves to its next file",
+		64 * 1024 * 1024,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dcp.record.maxFiles": ConfigValue{
+		8,
+		"number of files to keep per recording, older files are removed",
+		8,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.sample.defaultSize": ConfigValue{
+		1000,
+		"number of documents to sample for a /sampleIndex request, " +
+			"that does not specify its sampleSize",
+		1000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.sample.maxSize": ConfigValue{
+		100000,
+		"maximum number of documents sampled by a /sampleIndex request",
+		100000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.sample.maxKeys": ConfigValue{
+		100,
+		"maximum number of evaluated keys returned by a /sampleIndex request",
+		100,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.sample.maxConcurrent": ConfigValue{
+		2,
+		"maximum number of /sampleIndex requests sampling at the same time, " +
+			"further requests are rejected",
+		2,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.sample.timeout": ConfigValue{
+		30 * 1000, // 30 seconds
+		"in milliseconds, time after which a /sampleIndex request " +
+			"returns with the documents sampled so far",
+		30 * 1000, // 30 seconds
+		false,     // mutable
+		false,     // case-insensitive
+	},
 	// projector adminport parameters
 	"projector.adminport.name": ConfigValue{
 		"projector.adminport",
@@ -417,6 +543,42 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.jsEvaluator.timeout": ConfigValue{
+		10, // 10 milliseconds
+		"Maximum time allowed for evaluating a JavaScript index expression " +
+			"on a single document (In milliseconds). Documents that exceed this " +
+			"limit are skipped and counted as error skip",
+		10,    // 10 milliseconds
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.jsEvaluator.maxStackSize": ConfigValue{
+		256,
+		"Maximum call stack depth allowed for a JavaScript index expression",
+		256,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.jsEvaluator.maxValueSize": ConfigValue{
+		20 * 1024 * 1024, // 20 MB
+		"Maximum size of the document handed to a JavaScript index expression " +
+			"and of the value it evaluates to (In bytes). Documents that exceed " +
+			"this limit are skipped and counted as error skip",
+		20 * 1024 * 1024, // 20 MB
+		false,            // mutable
+		false,            // case-insensitive
+	},
+	"projector.jsEvaluator.maxMemory": ConfigValue{
+		64 * 1024 * 1024, // 64 MB
+		"Maximum memory allowed to be allocated while evaluating a JavaScript " +
+			"index expression on a single document (In bytes). Allocations are " +
+			"sampled for the whole projector process every millisecond. " +
+			"Documents that exceed this limit are skipped and counted as " +
+			"error skip",
+		64 * 1024 * 1024, // 64 MB
+		false,            // mutable
+		false,            // case-insensitive
+	},
 	"projector.systemStatsCollectionInterval": ConfigValue{
 		5, // 5 seconds
 		"The period with which projector updates the system level stats",
@@ -493,6 +655,56 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.memBudget.feedBytes": ConfigValue{
+		256 * 1024 * 1024,
+		"Memory budget, in bytes, for each feed on projector, counting " +
+			"key-versions queued for its endpoints, encode buffers of its " +
+			"workers and unacknowledged DCP buffers. A feed over its budget " +
+			"is throttled in proportion to the overage, and while any feed " +
+			"is over budget only such feeds are throttled on projector RSS, " +
+			"unless RSS reaches the critical throttle level 5. " +
+			"Set to 0 to disable",
+		256 * 1024 * 1024,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.memBudget.checkInterval": ConfigValue{
+		1000,
+		"Interval, in milliseconds, at which projector checks the " +
+			"memory usage of its feeds against their budget",
+		1000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.backfill.rateLimit": ConfigValue{
+		0,
+		"Rate, in bytes per second, at which projector acknowledges DCP " +
+			"buffers of INIT_STREAM feeds, shared by the buckets that are " +
+			"backfilling index builds, so that builds do not starve " +
+			"MAINT_STREAM feeds. Does not apply to dcp connections shared " +
+			"by topics with projector.dcp.streamId, projector warns when " +
+			"both are set. Set to 0 to disable",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.backfill.maintPriority": ConfigValue{
+		true,
+		"When true, projector.backfill.rateLimit applies only while " +
+			"MAINT_STREAM or CATCHUP_STREAM feeds are streaming mutations",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.backfill.bucketWeights": ConfigValue{
+		"",
+		"Comma separated list of bucket:weight, buckets share " +
+			"projector.backfill.rateLimit in proportion to their weight. " +
+			"Buckets not in the list weigh 1",
+		"",
+		false, // mutable
+		false, // case-insensitive
+	},
 	"projector.gogc": ConfigValue{
 		100, // 100 percent
 		"set GOGC percent",
@@ -1008,6 +1220,24 @@ var SystemConfig = Config{
 		true, // immutable
 		true, // case-sensitive
 	},
+	"indexer.encryption.keyProvider": ConfigValue{
+		"",
+		"Key provider supplying the keys index storage is encrypted with. " +
+			"Encryption at rest is disabled if empty, and is not supported " +
+			"with the plasma storage mode, the indexer fails to start plasma " +
+			"indexes with a key provider. Valid values are file",
+		"",
+		true, // immutable
+		true, // case-sensitive
+	},
+	"indexer.encryption.keyProviderConfig": ConfigValue{
+		"",
+		"Configuration of the encryption key provider, e.g. the path of " +
+			"the keystore for the file key provider",
+		"",
+		true, // immutable
+		true, // case-sensitive
+	},
 	"indexer.log_dir": ConfigValue{
 		"",
 		"Index log directory",
@@ -2255,6 +2485,23 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.mutation_queue.spill.enabled": ConfigValue{
+		false,
+		"spill mutations to disk, instead of blocking, when the memory " +
+			"used by mutation queues is above the spill watermark. Applies " +
+			"to mutation queues created after the change.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.mutation_queue.spill.watermark": ConfigValue{
+		uint64(80),
+		"percentage of the mutation queue memory quota above which " +
+			"mutations are spilled to disk, if spill is enabled.",
+		uint64(80),
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.memstatTick": ConfigValue{
 		60, // in second
 		"in second, periodically log runtime memory-stats.",
@@ -2470,6 +2717,49 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.compaction.policies": ConfigValue{
+		"",
+		"JSON array of per-bucket, per-collection or per-index compaction policies " +
+			"overriding min_frag, min_size, compaction_mode, interval, days_of_week " +
+			"and abort_exceed_interval, with an optional priority",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
+	"indexer.settings.scan.rate_limits": ConfigValue{
+		"",
+		"JSON array of per-user, per-bucket or per-scope scan rate limits, " +
+			"in scans per second with an optional burst. Limits are enforced " +
+			"by each indexer node, a partitioned scan counts once on every node it runs on",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
+	"indexer.settings.flush.priority_rules": ConfigValue{
+		"",
+		"JSON array of per-bucket, per-collection or per-index rules setting " +
+			"the flush priority of indexes to latency_critical or best_effort",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
+	"indexer.settings.flush.best_effort_snapshot_interval": ConfigValue{
+		uint64(5000),
+		"Minimum interval in milliseconds between in-memory snapshots of " +
+			"best-effort indexes",
+		uint64(5000),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.compaction.admission_rate": ConfigValue{
+		0,
+		"Rate in MB of index disk size per second at which compactions are started, " +
+			"0 for unlimited. This is an admission limit, the I/O of a running compaction " +
+			"is not throttled",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.compaction.plasma.manual": ConfigValue{
 		false,
 		"Enable plasma manual compaction",
@@ -3078,6 +3368,62 @@ var SystemConfig = Config{
 		false, // mutabale
 		false, // case-insensitive
 	},
+	"indexer.iowrap.fault_injection.path_filter": ConfigValue{
+		"",
+		"Inject disk faults only into files whose path contains this string. " +
+			"Used only for CI testing. Not a production setting",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
+	"indexer.iowrap.fault_injection.fail_nth_write": ConfigValue{
+		0,
+		"Fail the Nth disk write with EIO, 0 to disable. " +
+			"Used only for CI testing. Not a production setting",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.iowrap.fault_injection.enospc_after_bytes": ConfigValue{
+		0,
+		"Fail disk writes with ENOSPC once this many bytes are written, 0 to disable. " +
+			"Used only for CI testing. Not a production setting",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.iowrap.fault_injection.fsync_delay_ms": ConfigValue{
+		0,
+		"Delay each fsync by this many milliseconds, 0 to disable. " +
+			"Used only for CI testing. Not a production setting",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.iowrap.fault_injection.corrupt_nth_read": ConfigValue{
+		0,
+		"Corrupt the data returned by the Nth disk read, 0 to disable. " +
+			"Used only for CI testing. Not a production setting",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.audit.disabled_events": ConfigValue{
+		"49162", // index scans, audited on every scan request
+		"Comma separated list of audit event ids that are not audited by the indexer. " +
+			"Index scan events (49162) are disabled by default, as they are " +
+			"audited on every scan request",
+		"49162",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.audit.disabled_users": ConfigValue{
+		"",
+		"Comma separated list of users whose requests are not audited by the indexer",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
 	"indexer.settings.rebalance.redistribute_indexes": ConfigValue{
 		false, // keep in sync with index_settings_manager.erl
 		"redistribute indexes for optimal placement during rebalance." +
@@ -3159,6 +3505,29 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.scan.admission.memory_budget": ConfigValue{
+		0,
+		"Memory budget in MB for the estimated memory of scans in flight. " +
+			"Scans above the budget are queued or rejected. 0 disables scan admission control.",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.admission.max_queue": ConfigValue{
+		1000,
+		"Maximum number of scans waiting for admission. Scans beyond it are rejected.",
+		1000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.scan.admission.queue_timeout": ConfigValue{
+		5000,
+		"Time in milliseconds a scan waits for admission before it is rejected. " +
+			"0 rejects scans that cannot be admitted immediately.",
+		5000,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.scan.enable_fast_count": ConfigValue{
 		true,
 		"enable fast count optimization for aggregate pushdown",
@@ -3273,6 +3642,20 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.ddl.tokenAudit.interval": ConfigValue{
+		3600, // In Seconds
+		"Interval to audit DDL tokens in metakv for orphaned or contradictory tokens (In Seconds). Only the indexer with the smallest node UUID runs it. 0 disables the periodic audit",
+		3600,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.ddl.tokenAudit.repair": ConfigValue{
+		false,
+		"Repair the orphaned or contradictory DDL tokens found by the periodic audit",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.allowScheduleCreate": ConfigValue{
 		true,
 		"Allow scheduling index creation in the background",
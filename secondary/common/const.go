@@ -53,6 +53,16 @@ var ErrIndexNotReady = errors.New("Index not ready for serving queries")
 // ErrClientCancel when query client cancels an ongoing scan request.
 var ErrClientCancel = errors.New("Client requested cancel")
 
+// ErrScanMemoryBudgetExceeded when scan admission control rejects a scan request.
+var ErrScanMemoryBudgetExceeded = errors.New("Index scan rejected as the scan memory budget is exceeded. Please retry the request later.")
+
+// ScanThrottledCode starts the message of ErrScanThrottled, for clients to
+// detect throttled scans in the error strings returned by the indexer.
+const ScanThrottledCode = "indexer.scanThrottled"
+
+// ErrScanThrottled when a scan request exceeds a scan rate limit.
+var ErrScanThrottled = errors.New(ScanThrottledCode + ": Index scan throttled as the scan rate limit is exceeded. Please retry the request later.")
+
 var ErrIndexerInBootstrap = errors.New("Indexer In Warmup State. Please retry the request later.")
 
 var ErrMarshalFailed = errors.New("json.Marshal failed")
@@ -169,6 +179,15 @@ func init() {
 // Audit event IDs
 const AUDIT_UNAUTHORIZED = uint32(49152) // HTTP_STATUS_UNAUTHORIZED
 const AUDIT_FORBIDDEN = uint32(49153)    // HTTP_STATUS_FORBIDDEN
+const AUDIT_CREATE_INDEX = uint32(49154)
+const AUDIT_DROP_INDEX = uint32(49155)
+const AUDIT_BUILD_INDEX = uint32(49156)
+const AUDIT_ALTER_INDEX = uint32(49157)
+const AUDIT_MOVE_INDEX = uint32(49158)
+const AUDIT_SETTINGS_CHANGE = uint32(49159)
+const AUDIT_STATS_RESET = uint32(49160)
+const AUDIT_TRIGGER_COMPACTION = uint32(49161)
+const AUDIT_INDEX_SCAN = uint32(49162)
 
 // Ingress lockdown error
 var ErrNoIngress = errors.New("AccessNoIngress")
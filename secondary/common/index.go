@@ -242,6 +242,10 @@ type IndexDefn struct {
 	IndexMissingLeadingKey bool       `json:"indexMissingLeadingKey,omitempty"`
 	IsPartnKeyDocId        bool       `json:"isPartnKeyDocId,omitempty"`
 
+	// Token index: leading key is tokenized by projector and indexed
+	// as a distinct array of tokens.
+	TokenAnalyzer *TokenAnalyzer `json:"tokenAnalyzer,omitempty"`
+
 	// Sizing info
 	NumDoc        uint64  `json:"numDoc,omitempty"`
 	SecKeySize    uint64  `json:"secKeySize,omitempty"`
@@ -363,6 +367,7 @@ func (idx IndexDefn) Clone() *IndexDefn {
 		HasArrItemsCount:       idx.HasArrItemsCount,
 		IndexMissingLeadingKey: idx.IndexMissingLeadingKey,
 		IsPartnKeyDocId:        idx.IsPartnKeyDocId,
+		TokenAnalyzer:          idx.TokenAnalyzer.Clone(),
 	}
 }
 
@@ -764,7 +769,8 @@ func IsEquivalentIndex(d1, d2 *IndexDefn) bool {
 		d1.PartitionScheme != d2.PartitionScheme ||
 		d1.HashScheme != d2.HashScheme ||
 		d1.WhereExpr != d2.WhereExpr ||
-		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR {
+		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR ||
+		d1.TokenAnalyzer.String() != d2.TokenAnalyzer.String() {
 
 		return false
 	}
@@ -288,6 +288,17 @@ func (kv *KeyVersions) Length() int {
 	return len(kv.Uuids)
 }
 
+// Size approximate number of bytes held by this KeyVersions, used for
+// accounting memory queued up in projector.
+func (kv *KeyVersions) Size() int {
+	size := 8 + 8 + len(kv.Docid) // seqno, ctime and docid
+	size += 9 * len(kv.Uuids)     // uuid and command for each index
+	for i := range kv.Keys {
+		size += len(kv.Keys[i]) + len(kv.Oldkeys[i]) + len(kv.Partnkeys[i])
+	}
+	return size
+}
+
 // AddUpsert add a new keyversion for same OpMutation.
 func (kv *KeyVersions) AddUpsert(uuid uint64, key, oldkey, pkey []byte) {
 	kv.addKey(uuid, Upsert, key, oldkey, pkey)
@@ -41,6 +41,18 @@ func TestKVEqual(t *testing.T) {
 	}
 }
 
+func TestKVSize(t *testing.T) {
+	kv := NewKeyVersions(10, []byte("document-name"), 2, 0)
+	if size := kv.Size(); size != 16+13 {
+		t.Fatalf("expected %v, got %v", 16+13, size)
+	}
+	kv.AddUpsert(1, []byte("newkey"), []byte("oldkey"), nil)
+	kv.AddDeletion(2, []byte("oldkey"), []byte("pkey"))
+	if size := kv.Size(); size != 16+13+21+19 {
+		t.Fatalf("expected %v, got %v", 16+13+21+19, size)
+	}
+}
+
 func TestPayloadKeyVersions(t *testing.T) {
 	nVb := 3
 	p := NewStreamPayload(PayloadKeyVersions, nVb)
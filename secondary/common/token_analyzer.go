@@ -0,0 +1,253 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+type AnalyzerType string
+
+const (
+	// split text on whitespace, tokens are indexed as-is
+	AnalyzerWhitespace AnalyzerType = "whitespace"
+	// split text on non alpha-numeric characters and lowercase tokens
+	AnalyzerLowercase = "lowercase"
+	// lowercase tokens and index all n-grams of each token
+	AnalyzerNgram = "ngram"
+	// lowercase tokens and reduce them to their stem
+	AnalyzerStem = "stem"
+)
+
+const (
+	DEFAULT_MIN_GRAM = 2
+	DEFAULT_MAX_GRAM = 3
+	MAX_GRAM         = 16
+)
+
+// TokenAnalyzer specifies how a string field of a token index is split
+// into tokens. Each token becomes one entry of an array index.
+type TokenAnalyzer struct {
+	Type    AnalyzerType `json:"type,omitempty"`
+	MinGram int          `json:"minGram,omitempty"`
+	MaxGram int          `json:"maxGram,omitempty"`
+}
+
+// NewTokenAnalyzer returns a token analyzer from the `tokenize` parameter
+// of the with-clause. The parameter is either the name of the analyzer,
+// like "lowercase", or an object like
+// {"analyzer": "ngram", "min_gram": 2, "max_gram": 3}.
+func NewTokenAnalyzer(param interface{}) (*TokenAnalyzer, error) {
+
+	analyzer := &TokenAnalyzer{}
+
+	switch p := param.(type) {
+	case string:
+		analyzer.Type = AnalyzerType(strings.ToLower(p))
+
+	case map[string]interface{}:
+		for key, val := range p {
+			switch key {
+			case "analyzer":
+				name, ok := val.(string)
+				if !ok {
+					return nil, fmt.Errorf("Parameter analyzer must be a string value.")
+				}
+				analyzer.Type = AnalyzerType(strings.ToLower(name))
+
+			case "min_gram", "max_gram":
+				num, ok := val.(float64)
+				if !ok || num != float64(int(num)) {
+					return nil, fmt.Errorf("Parameter %v must be a integer value.", key)
+				}
+				if key == "min_gram" {
+					analyzer.MinGram = int(num)
+				} else {
+					analyzer.MaxGram = int(num)
+				}
+
+			default:
+				return nil, fmt.Errorf("Invalid tokenize parameter '%v'. Valid parameters are 'analyzer', 'min_gram', 'max_gram'.", key)
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("Parameter tokenize must be a string or an object.")
+	}
+
+	if analyzer.Type == AnalyzerNgram {
+		if analyzer.MinGram == 0 {
+			analyzer.MinGram = DEFAULT_MIN_GRAM
+		}
+		if analyzer.MaxGram == 0 {
+			analyzer.MaxGram = DEFAULT_MAX_GRAM
+		}
+	}
+
+	if err := analyzer.Validate(); err != nil {
+		return nil, err
+	}
+
+	return analyzer, nil
+}
+
+// ParseTokenAnalyzer decodes a token analyzer encoded with String().
+// It returns nil if the index is not a token index.
+func ParseTokenAnalyzer(s string) (*TokenAnalyzer, error) {
+
+	if len(s) == 0 {
+		return nil, nil
+	}
+
+	analyzer := &TokenAnalyzer{}
+	if err := json.Unmarshal([]byte(s), analyzer); err != nil {
+		return nil, err
+	}
+
+	if err := analyzer.Validate(); err != nil {
+		return nil, err
+	}
+
+	return analyzer, nil
+}
+
+func (a *TokenAnalyzer) Validate() error {
+
+	switch a.Type {
+	case AnalyzerWhitespace, AnalyzerLowercase, AnalyzerStem:
+		if a.MinGram != 0 || a.MaxGram != 0 {
+			return fmt.Errorf("Parameters min_gram and max_gram are only supported by ngram analyzer.")
+		}
+
+	case AnalyzerNgram:
+		if a.MinGram < 1 || a.MaxGram < a.MinGram || a.MaxGram > MAX_GRAM {
+			return fmt.Errorf("Invalid n-gram size (%v, %v). Parameter min_gram must be at least 1 "+
+				"and max_gram must be between min_gram and %v.", a.MinGram, a.MaxGram, MAX_GRAM)
+		}
+
+	default:
+		return fmt.Errorf("Invalid analyzer '%v'. Valid analyzers are '%v', '%v', '%v', '%v'.", a.Type,
+			AnalyzerWhitespace, AnalyzerLowercase, AnalyzerNgram, AnalyzerStem)
+	}
+
+	return nil
+}
+
+// String returns the token analyzer encoded as JSON.
+func (a *TokenAnalyzer) String() string {
+	if a == nil {
+		return ""
+	}
+
+	data, _ := json.Marshal(a)
+	return string(data)
+}
+
+func (a *TokenAnalyzer) Clone() *TokenAnalyzer {
+	if a == nil {
+		return nil
+	}
+
+	clone := *a
+	return &clone
+}
+
+// Analyze splits text into distinct tokens, in the order of their
+// first occurrence.
+func (a *TokenAnalyzer) Analyze(text string) []string {
+
+	var words []string
+	if a.Type == AnalyzerWhitespace {
+		words = strings.Fields(text)
+	} else {
+		words = strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+		})
+	}
+
+	tokens := make([]string, 0, len(words))
+	seen := make(map[string]bool, len(words))
+	add := func(token string) {
+		if len(token) != 0 && !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	for _, word := range words {
+		switch a.Type {
+		case AnalyzerNgram:
+			runes := []rune(word)
+			for n := a.MinGram; n <= a.MaxGram && n <= len(runes); n++ {
+				for i := 0; i+n <= len(runes); i++ {
+					add(string(runes[i : i+n]))
+				}
+			}
+			// words shorter than min_gram are indexed as-is
+			if len(runes) < a.MinGram {
+				add(word)
+			}
+
+		case AnalyzerStem:
+			add(stem(word))
+
+		default:
+			add(word)
+		}
+	}
+
+	return tokens
+}
+
+// AnalyzeTerm normalizes a single search term, such as the prefix of a
+// prefix query, the same way tokens are normalized at index time, but
+// without splitting it into n-grams or stemming it.
+func (a *TokenAnalyzer) AnalyzeTerm(term string) string {
+
+	if a.Type == AnalyzerWhitespace {
+		return strings.TrimSpace(term)
+	}
+	return strings.ToLower(strings.TrimSpace(term))
+}
+
+// stem strips common english inflectional suffixes from a lowercase word.
+func stem(word string) string {
+
+	n := len(word)
+	switch {
+	case n > 4 && (strings.HasSuffix(word, "sses") || strings.HasSuffix(word, "xes") ||
+		strings.HasSuffix(word, "ches") || strings.HasSuffix(word, "shes")):
+		return word[:n-2]
+	case n > 4 && strings.HasSuffix(word, "ies"):
+		return word[:n-3] + "y"
+	case n > 5 && strings.HasSuffix(word, "ing"):
+		return undouble(word[:n-3])
+	case n > 4 && strings.HasSuffix(word, "ed"):
+		return undouble(word[:n-2])
+	case n > 4 && strings.HasSuffix(word, "ly"):
+		return word[:n-2]
+	case n > 3 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss"):
+		return word[:n-1]
+	}
+	return word
+}
+
+// undouble removes the trailing double consonant left by stripping a
+// suffix, e.g. "running" -> "runn" -> "run".
+func undouble(word string) string {
+
+	n := len(word)
+	if n > 2 && word[n-1] == word[n-2] && !strings.ContainsRune("aeioulsz", rune(word[n-1])) {
+		return word[:n-1]
+	}
+	return word
+}
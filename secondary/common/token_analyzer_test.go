@@ -0,0 +1,50 @@
+package common
+
+import "testing"
+import "reflect"
+
+func TestTokenAnalyzer(t *testing.T) {
+	text := "The quick-brown Foxes were running, Quickly!"
+
+	testcases := []struct {
+		param  interface{}
+		tokens []string
+	}{
+		{"whitespace", []string{"The", "quick-brown", "Foxes", "were", "running,", "Quickly!"}},
+		{"lowercase", []string{"the", "quick", "brown", "foxes", "were", "running", "quickly"}},
+		{"stem", []string{"the", "quick", "brown", "fox", "were", "run"}},
+		{map[string]interface{}{"analyzer": "ngram", "min_gram": 3.0, "max_gram": 3.0},
+			[]string{"the", "qui", "uic", "ick", "bro", "row", "own", "fox", "oxe", "xes",
+				"wer", "ere", "run", "unn", "nni", "nin", "ing", "ckl", "kly"}},
+	}
+
+	for _, tc := range testcases {
+		analyzer, err := NewTokenAnalyzer(tc.param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokens := analyzer.Analyze(text); !reflect.DeepEqual(tokens, tc.tokens) {
+			t.Fatalf("%v: expected %v, got %v", analyzer, tc.tokens, tokens)
+		}
+
+		clone, err := ParseTokenAnalyzer(analyzer.String())
+		if err != nil {
+			t.Fatal(err)
+		} else if !reflect.DeepEqual(clone, analyzer) {
+			t.Fatalf("expected %v, got %v", analyzer, clone)
+		}
+	}
+
+	invalid := []interface{}{
+		"soundex",
+		10.0,
+		map[string]interface{}{"analyzer": "stem", "min_gram": 2.0},
+		map[string]interface{}{"analyzer": "ngram", "min_gram": 3.0, "max_gram": 2.0},
+		map[string]interface{}{"analyzer": "ngram", "size": 2.0},
+	}
+	for _, param := range invalid {
+		if _, err := NewTokenAnalyzer(param); err == nil {
+			t.Fatalf("expected error for tokenize parameter %v", param)
+		}
+	}
+}
@@ -104,6 +104,9 @@ type EndpointStats struct {
 	osoSnapshotStart  stats.Uint64Val
 	osoSnapshotEnd    stats.Uint64Val
 
+	// Bytes of key-versions sent to this endpoint and not yet flushed
+	queuedBytes stats.Int64Val
+
 	cmdStats map[byte]*stats.Uint64Val
 }
 
@@ -130,14 +133,21 @@ func (stats *EndpointStats) Init() {
 	stats.seqnoAdvanced.Init()
 	stats.osoSnapshotStart.Init()
 	stats.osoSnapshotEnd.Init()
+	stats.queuedBytes.Init()
 }
 
 func (stats *EndpointStats) IsClosed() bool {
 	return stats.closed.Value()
 }
 
+// QueuedBytes return the bytes of key-versions waiting in the endpoint's
+// channel and buffers.
+func (stats *EndpointStats) QueuedBytes() int64 {
+	return stats.queuedBytes.Value()
+}
+
 func (stats *EndpointStats) String() string {
-	var stitems [24]string
+	var stitems [25]string
 	stitems[0] = `"mutCount":` + strconv.FormatUint(stats.mutCount.Value(), 10)
 	stitems[1] = `"upsertCount":` + strconv.FormatUint(stats.upsertCount.Value(), 10)
 	stitems[2] = `"deleteCount":` + strconv.FormatUint(stats.deleteCount.Value(), 10)
@@ -164,6 +174,7 @@ func (stats *EndpointStats) String() string {
 	stitems[21] = `"latency.avg":` + strconv.FormatInt(stats.prjLatency.Mean(), 10)
 	stitems[22] = `"latency.movingAvg":` + strconv.FormatInt(stats.prjLatency.MovingAvg(), 10)
 	stitems[23] = `"endpChLen":` + strconv.FormatUint((uint64)(len(stats.endpCh)), 10)
+	stitems[24] = `"queuedBytes":` + strconv.FormatInt(stats.queuedBytes.Value(), 10)
 	statjson := strings.Join(stitems[:], ",")
 	return fmt.Sprintf("{%v}", statjson)
 }
@@ -355,23 +366,46 @@ func (endpoint *RouterEndpoint) ResetConfig(config c.Config) error {
 
 // Send KeyVersions to other end, asynchronous call.
 // Asynchronous call. Return ErrorChannelFull that can be used by caller.
-func (endpoint *RouterEndpoint) Send(data interface{}) error {
-	cmd := []interface{}{endpCmdSend, data}
+func (endpoint *RouterEndpoint) Send(data interface{}) (err error) {
+	size := queuedSize(data)
+	cmd := []interface{}{endpCmdSend, data, size}
+	endpoint.stats.queuedBytes.Add(size)
 	if endpoint.block {
-		return c.FailsafeOpAsync(endpoint.ch, cmd, endpoint.finch)
+		err = c.FailsafeOpAsync(endpoint.ch, cmd, endpoint.finch)
+	} else {
+		err = c.FailsafeOpNoblock(endpoint.ch, cmd, endpoint.finch)
 	}
-	return c.FailsafeOpNoblock(endpoint.ch, cmd, endpoint.finch)
+	if err != nil {
+		endpoint.stats.queuedBytes.Add(-size)
+	}
+	return err
 }
 
 // Send KeyVersions to other end, asynchronous call.
 // Asynchronous call. Return ErrorChannelFull that can be used by caller.
 // Returns ErrorAbort if abortCh is closed on callers side
-func (endpoint *RouterEndpoint) Send2(data interface{}, abortCh chan bool) error {
-	cmd := []interface{}{endpCmdSend, data}
+func (endpoint *RouterEndpoint) Send2(data interface{}, abortCh chan bool) (err error) {
+	size := queuedSize(data)
+	cmd := []interface{}{endpCmdSend, data, size}
+	endpoint.stats.queuedBytes.Add(size)
 	if endpoint.block {
-		return c.FailsafeOpAsync2(endpoint.ch, cmd, endpoint.finch, abortCh)
+		err = c.FailsafeOpAsync2(endpoint.ch, cmd, endpoint.finch, abortCh)
+	} else {
+		err = c.FailsafeOpNoblock(endpoint.ch, cmd, endpoint.finch)
+	}
+	if err != nil {
+		endpoint.stats.queuedBytes.Add(-size)
+	}
+	return err
+}
+
+// queuedSize of data sent to endpoint, accounted in queuedBytes till the
+// endpoint flushes it downstream.
+func queuedSize(data interface{}) int64 {
+	if data, ok := data.(*c.DataportKeyVersions); ok && data.Kv != nil {
+		return int64(data.Kv.Size())
 	}
-	return c.FailsafeOpNoblock(endpoint.ch, cmd, endpoint.finch)
+	return 0
 }
 
 // GetStatistics for this endpoint, synchronous call.
@@ -450,6 +484,7 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 	buffers := newEndpointBuffers(raddr)
 
 	messageCount := 0
+	queuedBytes := int64(0) // bytes accounted by Send() that are buffered
 	flushBuffers := func() (err error) {
 
 		logging.LazyTrace(func() string {
@@ -465,6 +500,8 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 			endpoint.stats.flushCount.Add(1)
 		}
 		messageCount = 0
+		endpoint.stats.queuedBytes.Add(-queuedBytes)
+		queuedBytes = 0
 		return
 	}
 
@@ -484,6 +521,7 @@ loop:
 				}
 
 				kv := data.Kv
+				queuedBytes += msg[2].(int64)
 				buffers.addKeyVersions(
 					data.KeyspaceId, data.Vbno, data.Vbuuid,
 					data.Opaque2, data.OSO, kv, endpoint)
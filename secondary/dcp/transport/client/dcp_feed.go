@@ -20,6 +20,7 @@ import (
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/projector/memThrottler"
 	"github.com/couchbase/indexing/secondary/stats"
+	"github.com/golang/snappy"
 )
 
 const dcpMutationExtraLen = 16
@@ -30,9 +31,13 @@ const opaqueGetseqno = 0xDEADBEEF
 const openConnFlag = uint32(0x1)
 const includeXATTR = uint32(0x4)
 const dcpJSON = uint8(0x1)
+const dcpSnappy = uint8(0x2)
 const dcpXATTR = uint8(0x4)
 const bufferAckPeriod = 20
 
+// interval to retry buffer acks deferred to shape backfill.
+const backfillAckTick = 100 * time.Millisecond
+
 // Length of extras when DCP seqno message is received
 const dcpSeqnoAdvExtrasLen = 8
 
@@ -51,6 +56,7 @@ var ErrorInvalidFeed = errors.New("dcp.invalidFeed")
 // ErrorEnableCollections
 var ErrorEnableCollections = errors.New("dcp.EnableCollections")
 var ErrorCollectionsNotEnabled = errors.New("dcp.ErrorCollectionsNotEnabled")
+var ErrorStreamIdsNotEnabled = errors.New("dcp.ErrorStreamIdsNotEnabled")
 
 var DcpFeedNamePrefix = "secidx:"
 var DcpFeedNameCompPrefix = "proj-"
@@ -63,7 +69,7 @@ type DcpFeed struct {
 	name      string
 	opaque    uint16
 	outch     chan<- *DcpEvent      // Exported channel for receiving DCP events
-	vbstreams map[uint16]*DcpStream // vb->stream mapping
+	vbstreams map[uint32]*DcpStream // (vb, stream id)->stream mapping
 	// genserver
 	reqch     chan []interface{}
 	supvch    chan []interface{}
@@ -72,7 +78,21 @@ type DcpFeed struct {
 	// Collections
 	collectionsAware bool
 	osoSnapshot      bool
-	isIncrBuild      bool // Set to true for Incremental builds (only from 7.0 cluster version)
+	isIncrBuild      bool   // Set to true for Incremental builds (only from 7.0 cluster version)
+	budgetKey        string // projector feed whose memory budget applies to this feed
+	bucket           string
+	// Buffer acks of backfill feeds are shaped by projector.backfill settings
+	backfill    bool
+	ackDeferred bool      // buffer ack held back to shape backfill
+	ackRetryAt  time.Time // not to retry a deferred buffer ack before this
+	maintNoted  time.Time // last mutation noted to shape backfill
+	// Stream ids, to run several streams of a vbucket on this connection
+	streamIds     bool
+	pendingReqs   map[uint16][]uint16 // vb -> stream ids of outstanding stream requests
+	pendingCloses map[uint16][]uint16 // vb -> stream ids of outstanding close streams
+	// Snappy compressed document values
+	snappy                bool // request snappy datatype on DCP open
+	forceValueCompression bool // request producer to compress all values
 	// stats
 	toAckBytes         uint32    // bytes client has read
 	maxAckBytes        uint32    // Max buffer control ack bytes
@@ -83,7 +103,7 @@ type DcpFeed struct {
 
 	// Book-keeping for verifying sequence order.
 	// TODO: This introduces a map lookup in mutation path. Need to anlayse perf implication.
-	seqOrders map[uint16]transport.SeqOrderState // vb ==> state maintained for checking seq order
+	seqOrders map[uint32]transport.SeqOrderState // (vb, stream id) ==> state maintained for checking seq order
 
 	truncName string
 }
@@ -101,14 +121,17 @@ func NewDcpFeed(
 		name:      name,
 		outch:     outch,
 		opaque:    opaque,
-		vbstreams: make(map[uint16]*DcpStream),
+		vbstreams: make(map[uint32]*DcpStream),
 		reqch:     make(chan []interface{}, genChanSize),
 		supvch:    supvch,
 		finch:     make(chan bool),
 		// TODO: would be nice to add host-addr as part of prefix.
 		logPrefix: fmt.Sprintf("DCPT[%s]", name),
 		stats:     &DcpStats{},
-		seqOrders: make(map[uint16]transport.SeqOrderState),
+		seqOrders: make(map[uint32]transport.SeqOrderState),
+
+		pendingReqs:   make(map[uint16][]uint16),
+		pendingCloses: make(map[uint16][]uint16),
 	}
 
 	feed.truncName = name
@@ -140,6 +163,29 @@ func NewDcpFeed(
 		feed.osoSnapshot = config["osoSnapshot"].(bool)
 	}
 
+	if val, ok := config["memBudgetKey"]; ok && val != nil {
+		feed.budgetKey = val.(string)
+		feed.stats.budgetKey = feed.budgetKey
+		feed.backfill = memThrottler.IsBackfillTopic(feed.budgetKey)
+	}
+
+	if val, ok := config["bucket"]; ok && val != nil {
+		feed.bucket = val.(string)
+	}
+
+	// stream ids need collections, as every stream has its own filter
+	if val, ok := config["streamId"]; ok && val != nil {
+		feed.streamIds = val.(bool) && feed.collectionsAware
+	}
+
+	if val, ok := config["snappy"]; ok && val != nil {
+		feed.snappy = val.(bool)
+	}
+
+	if val, ok := config["forceValueCompression"]; ok && val != nil {
+		feed.forceValueCompression = val.(bool)
+	}
+
 	go feed.genServer(opaque, feed.reqch, feed.finch, rcvch, config)
 	go feed.doReceive(rcvch, feed.finch, mc)
 	logging.Infof("%v ##%x feed started ...", feed.logPrefix, opaque)
@@ -205,11 +251,22 @@ func (feed *DcpFeed) DcpRequestStream(vbno, opaqueMSB uint16, flags uint32,
 	vuuid, startSequence, endSequence, snapStart, snapEnd uint64,
 	manifestUID, scopeId string, collectionIds []string) error {
 
+	return feed.DcpRequestStreamWithID(vbno, opaqueMSB, 0, flags,
+		vuuid, startSequence, endSequence, snapStart, snapEnd,
+		manifestUID, scopeId, collectionIds)
+}
+
+// DcpRequestStreamWithID for a single vbucket, on a feed with stream ids.
+// Events of the stream carry its stream id, which must not be 0.
+func (feed *DcpFeed) DcpRequestStreamWithID(vbno, opaqueMSB, streamId uint16,
+	flags uint32, vuuid, startSequence, endSequence, snapStart, snapEnd uint64,
+	manifestUID, scopeId string, collectionIds []string) error {
+
 	respch := make(chan []interface{}, 1)
 	cmd := []interface{}{
 		dfCmdRequestStream, vbno, opaqueMSB, flags, vuuid,
 		startSequence, endSequence, snapStart, snapEnd,
-		manifestUID, scopeId, collectionIds,
+		manifestUID, scopeId, collectionIds, streamId,
 		respch}
 	resp, err := failsafeOp(feed.reqch, respch, cmd, feed.finch)
 	return opError(err, resp, 0)
@@ -217,12 +274,22 @@ func (feed *DcpFeed) DcpRequestStream(vbno, opaqueMSB uint16, flags uint32,
 
 // CloseStream for specified vbucket.
 func (feed *DcpFeed) CloseStream(vbno, opaqueMSB uint16) error {
+	return feed.CloseStreamWithID(vbno, opaqueMSB, 0)
+}
+
+// CloseStreamWithID for specified vbucket and stream id.
+func (feed *DcpFeed) CloseStreamWithID(vbno, opaqueMSB, streamId uint16) error {
 	respch := make(chan []interface{}, 1)
-	cmd := []interface{}{dfCmdCloseStream, vbno, opaqueMSB, respch}
+	cmd := []interface{}{dfCmdCloseStream, vbno, opaqueMSB, streamId, respch}
 	resp, err := failsafeOp(feed.reqch, respch, cmd, feed.finch)
 	return opError(err, resp, 0)
 }
 
+// StreamIds returns whether the feed runs streams with stream ids.
+func (feed *DcpFeed) StreamIds() bool {
+	return feed.streamIds
+}
+
 // Close this DcpFeed.
 func (feed *DcpFeed) Close() error {
 	respch := make(chan []interface{}, 1)
@@ -271,6 +338,14 @@ func (feed *DcpFeed) genServer(
 		latencyTm.Stop()
 	}()
 
+	// retry deferred buffer acks, producer stops sending once they are due.
+	var ackch <-chan time.Time
+	if feed.backfill {
+		ackTm := time.NewTicker(backfillAckTick)
+		defer ackTm.Stop()
+		ackch = ackTm.C
+	}
+
 loop:
 	for {
 		select {
@@ -280,6 +355,14 @@ loop:
 				logging.Fatalf(fmsg, feed.logPrefix)
 			}
 
+		case <-ackch:
+			if feed.ackDeferred {
+				if err := feed.sendBufferAck(true, 0); err != nil {
+					feed.sendStreamEnd(feed.outch)
+					break loop
+				}
+			}
+
 		case msg := <-reqch:
 			cmd := msg[0].(byte)
 			switch cmd {
@@ -317,19 +400,21 @@ loop:
 				manifestUID := msg[9].(string)
 				scopeId := msg[10].(string)
 				collectionIds := msg[11].([]string)
+				streamId := msg[12].(uint16)
 
 				err := feed.doDcpRequestStream(
-					vbno, opaqueMSB, flags, vuuid,
+					vbno, opaqueMSB, streamId, flags, vuuid,
 					startSequence, endSequence, snapStart, snapEnd,
 					manifestUID, scopeId, collectionIds)
 
-				respch := msg[12].(chan []interface{})
+				respch := msg[13].(chan []interface{})
 				respch <- []interface{}{err}
 
 			case dfCmdCloseStream:
 				vbno, opaqueMSB := msg[1].(uint16), msg[2].(uint16)
-				respch := msg[3].(chan []interface{})
-				err := feed.doDcpCloseStream(vbno, opaqueMSB)
+				streamId := msg[3].(uint16)
+				respch := msg[4].(chan []interface{})
+				err := feed.doDcpCloseStream(vbno, opaqueMSB, streamId)
 				respch <- []interface{}{err}
 
 			case dfCmdClose:
@@ -378,10 +463,11 @@ func (feed *DcpFeed) handlePacket(
 		Body:   pkt.Body,
 	}
 	vb := vbOpaque(pkt.Opaque)
+	key := streamKey(vb, feed.packetStreamId(pkt, vb))
 
 	sendAck := false
 	prefix := feed.logPrefix
-	stream := feed.vbstreams[vb]
+	stream := feed.vbstreams[key]
 	if stream == nil {
 		feed.stats.TotalSpurious.Add(1)
 		// log first 10000 spurious messages
@@ -399,6 +485,12 @@ func (feed *DcpFeed) handlePacket(
 	defer func() { feed.stats.Dcplatency.Add(computeLatency(stream)) }()
 
 	stream.LastSeen = time.Now().UnixNano()
+	if stream.failed && pkt.Opcode != transport.DCP_CLOSESTREAM &&
+		pkt.Opcode != transport.DCP_STREAMEND {
+		// events of a failed stream are dropped until it is closed
+		return feed.dropPacket(pkt, bytes)
+	}
+
 	switch pkt.Opcode {
 	case transport.DCP_STREAMREQ:
 		event = newDcpEvent(pkt, stream)
@@ -406,11 +498,19 @@ func (feed *DcpFeed) handlePacket(
 		feed.stats.TotalStreamReq.Add(1)
 
 		if !feed.osoSnapshot {
-			feed.seqOrders[vb] = transport.NewSeqOrderState()
+			feed.seqOrders[key] = transport.NewSeqOrderState()
 		}
 
 	case transport.DCP_MUTATION, transport.DCP_DELETION,
 		transport.DCP_EXPIRATION:
+		if pkt.Datatype&dcpSnappy != 0 {
+			if err := feed.decompressValue(pkt); err != nil {
+				if err := feed.failStream(stream, vb); err != nil {
+					return "exit"
+				}
+				return feed.dropPacket(pkt, bytes)
+			}
+		}
 		event = newDcpEvent(pkt, stream)
 		stream.Seqno = event.Seqno
 		feed.stats.TotalMutation.Add(1)
@@ -421,17 +521,17 @@ func (feed *DcpFeed) handlePacket(
 	case transport.DCP_STREAMEND:
 		event = newDcpEvent(pkt, stream)
 		sendAck = true
-		delete(feed.vbstreams, vb)
-		feed.supvch <- []interface{}{transport.DCP_STREAMEND, feed, vb}
+		delete(feed.vbstreams, key)
+		feed.supvch <- []interface{}{transport.DCP_STREAMEND, feed, vb, stream.StreamId}
 		fmsg := "%v ##%x DCP_STREAMEND for vb %d\n"
 		logging.Debugf(fmsg, prefix, stream.AppOpaque, vb)
 		feed.stats.TotalStreamEnd.Add(1)
 
 		if !feed.osoSnapshot {
-			if s, ok := feed.seqOrders[vb]; ok && s != nil && s.GetErrCount() != 0 {
+			if s, ok := feed.seqOrders[key]; ok && s != nil && s.GetErrCount() != 0 {
 				logging.Fatalf("%v error count for sequence number ordering is %v", prefix, s.GetErrCount())
 			}
-			feed.seqOrders[vb] = nil
+			feed.seqOrders[key] = nil
 		}
 
 	case transport.DCP_SNAPSHOT:
@@ -464,12 +564,12 @@ func (feed *DcpFeed) handlePacket(
 		}
 		event.Opcode = transport.DCP_STREAMEND // opcode re-write !!
 		event.Opaque = stream.AppOpaque        // opaque re-write !!
-		delete(feed.vbstreams, vb)
+		delete(feed.vbstreams, key)
 		fmsg := "%v ##%x DCP_CLOSESTREAM for vb %d\n"
 		logging.Debugf(fmsg, prefix, stream.AppOpaque, vb)
 		feed.stats.TotalCloseStream.Add(1)
 		if !feed.osoSnapshot {
-			feed.seqOrders[vb] = nil
+			feed.seqOrders[key] = nil
 		}
 
 	case transport.DCP_CONTROL, transport.DCP_BUFFERACK:
@@ -543,7 +643,7 @@ func (feed *DcpFeed) handlePacket(
 
 func (feed *DcpFeed) checkSeqOrder(event *DcpEvent, vb uint16, opcode transport.CommandCode) {
 	if !feed.osoSnapshot {
-		if s, ok := feed.seqOrders[vb]; ok && s != nil {
+		if s, ok := feed.seqOrders[streamKey(vb, event.StreamID)]; ok && s != nil {
 			if !s.ProcessSeqno(event.Seqno) {
 				logging.Fatalf("%v seq order violation for vb = %v, seq = %v, opcode = %v, "+
 					"orderState = %v, event = %v", feed.logPrefix, vb, event.Seqno, opcode,
@@ -555,7 +655,7 @@ func (feed *DcpFeed) checkSeqOrder(event *DcpEvent, vb uint16, opcode transport.
 
 func (feed *DcpFeed) checkSnapOrder(event *DcpEvent, vb uint16, opcode transport.CommandCode) {
 	if !feed.osoSnapshot {
-		if s, ok := feed.seqOrders[vb]; ok && s != nil {
+		if s, ok := feed.seqOrders[streamKey(vb, event.StreamID)]; ok && s != nil {
 			if snapInfo, correctSnapOrder := s.ProcessSnapshot(event.SnapstartSeq, event.SnapendSeq); !correctSnapOrder {
 				logging.Fatalf("%v ##%x seq order violation for snapshot message for vb = %v, opcode = %v, "+
 					"orderState = %v, event = %v", feed.logPrefix, feed.opaque, vb, opcode,
@@ -782,8 +882,8 @@ func (feed *DcpFeed) doDcpOpen(
 	feed.conn.SetMcdConnectionDeadline()
 	defer feed.conn.ResetMcdConnectionDeadline()
 
-	if feed.collectionsAware {
-		if err := feed.enableCollections(rcvch); err != nil {
+	if feed.collectionsAware || feed.snappy {
+		if err := feed.doHelo(rcvch); err != nil {
 			return err
 		}
 	}
@@ -947,14 +1047,32 @@ func (feed *DcpFeed) doDcpOpen(
 		}
 	}
 
+	if feed.stats.Snappy.Value() && feed.forceValueCompression {
+		if err := feed.enableForceValueCompression(rcvch); err != nil {
+			return err
+		}
+	}
+
+	if feed.streamIds {
+		if err := feed.enableStreamIds(rcvch); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (feed *DcpFeed) doDcpRequestStream(
-	vbno, opaqueMSB uint16, flags uint32,
+	vbno, opaqueMSB, streamId uint16, flags uint32,
 	vuuid, startSequence, endSequence, snapStart, snapEnd uint64,
 	manifestUID, scopeId string, collectionIds []string) error {
 
+	if feed.streamIds != (streamId != 0) {
+		fmsg := "%v ##%x stream id %v for vb %d on a feed with stream ids %v"
+		logging.Errorf(fmsg, feed.logPrefix, opaqueMSB, streamId, vbno, feed.streamIds)
+		return ErrorStreamIdsNotEnabled
+	}
+
 	rq := &transport.MCRequest{
 		Opcode:  transport.DCP_STREAMREQ,
 		VBucket: vbno,
@@ -987,6 +1105,7 @@ func (feed *DcpFeed) doDcpRequestStream(
 			feed.isIncrBuild = feed.isIncrBuild && true
 			requestValue.ManifestUID = manifestUID
 		}
+		requestValue.StreamID = streamId
 		body, _ := json.Marshal(requestValue)
 		rq.Body = body
 	}
@@ -1004,8 +1123,12 @@ func (feed *DcpFeed) doDcpRequestStream(
 		return err
 	}
 	feed.stats.LastMsgSend.Set(time.Now().UnixNano())
+	if feed.streamIds {
+		feed.pendingReqs[vbno] = append(feed.pendingReqs[vbno], streamId)
+	}
 	stream := &DcpStream{
 		AppOpaque:        opaqueMSB,
+		StreamId:         streamId,
 		Vbucket:          vbno,
 		Vbuuid:           vuuid,
 		StartSeq:         startSequence,
@@ -1013,16 +1136,16 @@ func (feed *DcpFeed) doDcpRequestStream(
 		CollectionsAware: feed.collectionsAware,
 		RequestValue:     requestValue,
 	}
-	feed.vbstreams[vbno] = stream
+	feed.vbstreams[streamKey(vbno, streamId)] = stream
 	return nil
 }
 
-func (feed *DcpFeed) doDcpCloseStream(vbno, opaqueMSB uint16) error {
+func (feed *DcpFeed) doDcpCloseStream(vbno, opaqueMSB, streamId uint16) error {
 	prefix := feed.logPrefix
-	stream, ok := feed.vbstreams[vbno]
+	stream, ok := feed.vbstreams[streamKey(vbno, streamId)]
 	if !ok || stream == nil {
-		fmsg := "%v ##%x stream for vb %d is not active"
-		logging.Warnf(fmsg, prefix, opaqueMSB, vbno)
+		fmsg := "%v ##%x stream %v for vb %d is not active"
+		logging.Warnf(fmsg, prefix, opaqueMSB, streamId, vbno)
 		return nil // TODO: should we return error here ?
 	}
 	stream.CloseOpaque = opaqueMSB
@@ -1031,6 +1154,9 @@ func (feed *DcpFeed) doDcpCloseStream(vbno, opaqueMSB uint16) error {
 		VBucket: vbno,
 		Opaque:  composeOpaque(vbno, opaqueMSB),
 	}
+	if feed.streamIds {
+		rq.FramingExtras = transport.StreamIDFrame(streamId)
+	}
 
 	// In case of DCP_CLOSESTREAM, feed.conn.Transmit won't have any
 	// network timeout. This is called in restartVBuckets workflow
@@ -1043,29 +1169,43 @@ func (feed *DcpFeed) doDcpCloseStream(vbno, opaqueMSB uint16) error {
 	}
 
 	feed.stats.LastMsgSend.Set(time.Now().UnixNano())
+	if feed.streamIds {
+		feed.pendingCloses[vbno] = append(feed.pendingCloses[vbno], streamId)
+	}
 	return nil
 }
 
-func (feed *DcpFeed) enableCollections(rcvch chan []interface{}) error {
+// doHelo negotiates the collections and snappy features with the producer.
+// Collections are required if the feed is collections aware, snappy is used
+// only if the producer supports it.
+func (feed *DcpFeed) doHelo(rcvch chan []interface{}) error {
 	prefix := feed.logPrefix
 	opaque := feed.opaque
 
+	features := make([]byte, 0, 4)
+	if feed.collectionsAware {
+		features = append(features, 0x00, transport.FEATURE_COLLECTIONS)
+	}
+	if feed.snappy {
+		features = append(features, 0x00, transport.FEATURE_SNAPPY)
+	}
+
 	rq := &transport.MCRequest{
 		Opcode: transport.HELO,
 		Key:    []byte(feed.truncName),
-		Body:   []byte{0x00, transport.FEATURE_COLLECTIONS},
+		Body:   features,
 	}
 
 	if err := feed.conn.Transmit(rq); err != nil {
-		fmsg := "%v ##%x doDcpOpen.Transmit DCP_HELO (feature_collections): %v"
-		logging.Errorf(fmsg, prefix, opaque, err)
+		fmsg := "%v ##%x doDcpOpen.Transmit DCP_HELO (features %v): %v"
+		logging.Errorf(fmsg, prefix, opaque, features, err)
 		return err
 	}
 	feed.stats.LastMsgSend.Set(time.Now().UnixNano())
-	logging.Infof("%v ##%x sending DCP_HELO (feature_collections)", prefix, opaque)
+	logging.Infof("%v ##%x sending DCP_HELO (features %v)", prefix, opaque, features)
 	msg, ok := <-rcvch
 	if !ok {
-		fmsg := "%v ##%x doDcpOpen.rcvch (feature_collections) closed"
+		fmsg := "%v ##%x doDcpOpen.rcvch (DCP_HELO) closed"
 		logging.Errorf(fmsg, prefix, opaque)
 		return ErrorConnection
 	}
@@ -1074,17 +1214,38 @@ func (feed *DcpFeed) enableCollections(rcvch chan []interface{}) error {
 	pkt := msg[0].(*transport.MCRequest)
 	opcode, body := pkt.Opcode, pkt.Body
 	if opcode != transport.HELO {
-		fmsg := "%v ##%x DCP_HELO (feature_collections) opcode = %v. Expecting opcode = 0x1f"
+		fmsg := "%v ##%x DCP_HELO opcode = %v. Expecting opcode = 0x1f"
 		logging.Errorf(fmsg, prefix, opaque, opcode)
-		return ErrorEnableCollections
-	} else if (len(body) != 2) || (body[0] != 0x00 && body[1] != transport.FEATURE_COLLECTIONS) {
-		fmsg := "%v ##%x DCP_HELO (feature_collections) body = %v. Expecting body = 0x0012"
+		if feed.collectionsAware {
+			return ErrorEnableCollections
+		}
+		return ErrorConnection
+	}
+
+	// response body is the list of features enabled by the producer
+	enabled := make(map[byte]bool)
+	for i := 0; i+1 < len(body); i += 2 {
+		if body[i] == 0x00 {
+			enabled[body[i+1]] = true
+		}
+	}
+
+	if feed.collectionsAware && !enabled[transport.FEATURE_COLLECTIONS] {
+		fmsg := "%v ##%x DCP_HELO (feature_collections) body = %v. Expecting body with 0x0012"
 		logging.Errorf(fmsg, prefix, opaque, body)
 		return ErrorCollectionsNotEnabled
 	}
 
-	fmsg := "%v ##%x received response for DCP_HELO (feature_collections)"
-	logging.Infof(fmsg, prefix, opaque)
+	if feed.snappy {
+		feed.stats.Snappy.Set(enabled[transport.FEATURE_SNAPPY])
+		if !enabled[transport.FEATURE_SNAPPY] {
+			fmsg := "%v ##%x DCP_HELO (feature_snappy) not enabled by producer, body = %v"
+			logging.Warnf(fmsg, prefix, opaque, body)
+		}
+	}
+
+	fmsg := "%v ##%x received response for DCP_HELO (features %v)"
+	logging.Infof(fmsg, prefix, opaque, body)
 	return nil
 }
 
@@ -1129,17 +1290,154 @@ func (feed *DcpFeed) enableOSOSnapshot(rcvch chan []interface{}) error {
 	return nil
 }
 
+// enableStreamIds lets the connection run several streams of a vbucket,
+// each with its own stream id, filter and start seqno.
+func (feed *DcpFeed) enableStreamIds(rcvch chan []interface{}) error {
+	prefix := feed.logPrefix
+	opaque := feed.opaque
+
+	rq := &transport.MCRequest{
+		Opcode: transport.DCP_CONTROL,
+		Key:    []byte("enable_stream_id"),
+		Body:   []byte("true"),
+	}
+	if err := feed.conn.Transmit(rq); err != nil {
+		fmsg := "%v ##%x doDcpOpen.Transmit DCP_CONTROL (enable_stream_id): %v"
+		logging.Errorf(fmsg, prefix, opaque, err)
+		return err
+	}
+	feed.stats.LastMsgSend.Set(time.Now().UnixNano())
+	logging.Infof("%v ##%x sending DCP_CONTROL (enable_stream_id)", prefix, opaque)
+	msg, ok := <-rcvch
+	if !ok {
+		fmsg := "%v ##%x doDcpOpen.rcvch (enable_stream_id) closed"
+		logging.Errorf(fmsg, prefix, opaque)
+		return ErrorConnection
+	}
+	feed.stats.LastMsgRecv.Set(time.Now().UnixNano())
+
+	pkt := msg[0].(*transport.MCRequest)
+	opcode, status := pkt.Opcode, transport.Status(pkt.VBucket)
+	if opcode != transport.DCP_CONTROL {
+		fmsg := "%v ##%x DCP_CONTROL (enable_stream_id) != #%v"
+		logging.Errorf(fmsg, prefix, opaque, opcode)
+		return ErrorConnection
+	} else if status != transport.SUCCESS {
+		fmsg := "%v ##%x doDcpOpen (enable_stream_id) response status %v"
+		logging.Errorf(fmsg, prefix, opaque, status)
+		return ErrorStreamIdsNotEnabled
+	}
+
+	fmsg := "%v ##%x received response for DCP_CONTROL (enable_stream_id)"
+	logging.Infof(fmsg, prefix, opaque)
+	return nil
+}
+
+// enableForceValueCompression requests the producer to compress all document
+// values, including the ones it does not hold compressed. A producer that
+// does not support it only sends values it holds compressed, so a failure
+// is not fatal to the feed.
+func (feed *DcpFeed) enableForceValueCompression(rcvch chan []interface{}) error {
+	prefix := feed.logPrefix
+	opaque := feed.opaque
+
+	rq := &transport.MCRequest{
+		Opcode: transport.DCP_CONTROL,
+		Key:    []byte("force_value_compression"),
+		Body:   []byte("true"),
+	}
+	if err := feed.conn.Transmit(rq); err != nil {
+		fmsg := "%v ##%x doDcpOpen.Transmit DCP_CONTROL (force_value_compression): %v"
+		logging.Errorf(fmsg, prefix, opaque, err)
+		return err
+	}
+	feed.stats.LastMsgSend.Set(time.Now().UnixNano())
+	logging.Infof("%v ##%x sending DCP_CONTROL (force_value_compression)", prefix, opaque)
+	msg, ok := <-rcvch
+	if !ok {
+		fmsg := "%v ##%x doDcpOpen.rcvch (force_value_compression) closed"
+		logging.Errorf(fmsg, prefix, opaque)
+		return ErrorConnection
+	}
+	feed.stats.LastMsgRecv.Set(time.Now().UnixNano())
+
+	pkt := msg[0].(*transport.MCRequest)
+	opcode, status := pkt.Opcode, transport.Status(pkt.VBucket)
+	if opcode != transport.DCP_CONTROL {
+		fmsg := "%v ##%x DCP_CONTROL (force_value_compression) != #%v"
+		logging.Errorf(fmsg, prefix, opaque, opcode)
+		return ErrorConnection
+	} else if status != transport.SUCCESS {
+		fmsg := "%v ##%x doDcpOpen (force_value_compression) response status %v, continuing without it"
+		logging.Warnf(fmsg, prefix, opaque, status)
+		return nil
+	}
+
+	fmsg := "%v ##%x received response for DCP_CONTROL (force_value_compression)"
+	logging.Infof(fmsg, prefix, opaque)
+	return nil
+}
+
+// decompressValue replaces the snappy compressed value of a mutation, deletion
+// or expiration with its decompressed value. The packet is left as is if its
+// value cannot be decompressed.
+func (feed *DcpFeed) decompressValue(pkt *transport.MCRequest) error {
+	value, err := snappy.Decode(nil, pkt.Body)
+	if err != nil {
+		arg1 := logging.TagStrUD(pkt.Key)
+		logging.Errorf("%v error decompressing snappy value for %s: %v", feed.logPrefix, arg1, err)
+		feed.stats.SnappyErrors.Add(1)
+		return err
+	}
+
+	feed.stats.CompressedBytes.Add(uint64(len(pkt.Body)))
+	feed.stats.DecompressedBytes.Add(uint64(len(value)))
+	pkt.Body = value
+	pkt.Datatype &= ^dcpSnappy
+	return nil
+}
+
+// failStream closes a stream with an event that cannot be delivered, rather
+// than deliver the event without its value and lose its index keys. Events
+// of the stream are dropped until the close completes and ends the stream,
+// so that its vbucket is restarted from the last delivered seqno.
+func (feed *DcpFeed) failStream(stream *DcpStream, vb uint16) error {
+	fmsg := "%v ##%x failing stream %v for vb %d at seqno %v"
+	logging.Errorf(fmsg, feed.logPrefix, stream.AppOpaque, stream.StreamId, vb, stream.Seqno)
+
+	stream.failed = true
+	return feed.doDcpCloseStream(vb, stream.AppOpaque, stream.StreamId)
+}
+
+// dropPacket drops a packet without an event, acknowledging its bytes if
+// they are flow controlled.
+func (feed *DcpFeed) dropPacket(pkt *transport.MCRequest, bytes int) string {
+	sendAck := false
+	switch pkt.Opcode {
+	case transport.DCP_MUTATION, transport.DCP_DELETION, transport.DCP_EXPIRATION,
+		transport.DCP_SNAPSHOT, transport.DCP_SYSTEM_EVENT,
+		transport.DCP_SEQNO_ADVANCED, transport.DCP_OSO_SNAPSHOT:
+		sendAck = true
+	}
+	if err := feed.sendBufferAck(sendAck, uint32(bytes)); err != nil {
+		return "exit"
+	}
+	return "ok"
+}
+
 // generate stream end responses for all active vb streams
 func (feed *DcpFeed) sendStreamEnd(outch chan<- *DcpEvent) {
 	if feed.vbstreams != nil {
-		for vb, stream := range feed.vbstreams {
-			feed.supvch <- []interface{}{transport.DCP_STREAMEND, feed, vb}
+		for _, stream := range feed.vbstreams {
+			vb := stream.Vbucket
+			feed.supvch <- []interface{}{transport.DCP_STREAMEND, feed, vb, stream.StreamId}
 			dcpEvent := &DcpEvent{
-				VBucket: vb,
-				VBuuid:  stream.Vbuuid,
-				Opcode:  transport.DCP_STREAMEND,
-				Opaque:  stream.AppOpaque,
-				Ctime:   time.Now().UnixNano(),
+				VBucket:  vb,
+				StreamID: stream.StreamId,
+				VBuuid:   stream.Vbuuid,
+				Opcode:   transport.DCP_STREAMEND,
+				Opaque:   stream.AppOpaque,
+				Ctime:    time.Now().UnixNano(),
 			}
 			outch <- dcpEvent
 		}
@@ -1157,14 +1455,14 @@ func (feed *DcpFeed) handleStreamRequest(
 		fmsg := "%v ##%x STREAMREQ(%v) invalid rollback: %v\n"
 		arg1 := logging.TagUD(res.Body)
 		logging.Errorf(fmsg, prefix, stream.AppOpaque, vb, arg1)
-		delete(feed.vbstreams, vb)
+		delete(feed.vbstreams, streamKey(vb, stream.StreamId))
 
 	case res.Status == transport.ROLLBACK:
 		rollback := binary.BigEndian.Uint64(res.Body)
 		event.Status, event.Seqno = res.Status, rollback
 		fmsg := "%v ##%x STREAMREQ(%v) with rollback %d\n"
 		logging.Warnf(fmsg, prefix, stream.AppOpaque, vb, rollback)
-		delete(feed.vbstreams, vb)
+		delete(feed.vbstreams, streamKey(vb, stream.StreamId))
 
 	case res.Status == transport.SUCCESS:
 		event.Status, event.Seqno = res.Status, stream.StartSeq
@@ -1185,13 +1483,13 @@ func (feed *DcpFeed) handleStreamRequest(
 		event.VBucket = vb
 		fmsg := "%v ##%x STREAMREQ(%v) with status: %v, stream request value: %+v\n"
 		logging.Errorf(fmsg, prefix, stream.AppOpaque, vb, res.Status, stream.RequestValue)
-		delete(feed.vbstreams, vb)
+		delete(feed.vbstreams, streamKey(vb, stream.StreamId))
 	default:
 		event.Status = res.Status
 		event.VBucket = vb
 		fmsg := "%v ##%x STREAMREQ(%v) unexpected status: %v\n"
 		logging.Errorf(fmsg, prefix, stream.AppOpaque, vb, res.Status)
-		delete(feed.vbstreams, vb)
+		delete(feed.vbstreams, streamKey(vb, stream.StreamId))
 	}
 	return
 }
@@ -1202,7 +1500,18 @@ func (feed *DcpFeed) sendBufferAck(sendAck bool, bytes uint32) error {
 	if sendAck {
 		var err1 error
 		totalBytes := feed.toAckBytes + bytes
-		if totalBytes > feed.maxAckBytes || time.Since(feed.lastAckTime).Seconds() > bufferAckPeriod {
+		now := time.Now()
+		if bytes > 0 && !feed.backfill && feed.budgetKey != "" &&
+			now.Sub(feed.maintNoted) >= memThrottler.MaintNoteInterval {
+			memThrottler.NoteMaintMutation(now)
+			feed.maintNoted = now
+		}
+		if totalBytes > feed.maxAckBytes || now.Sub(feed.lastAckTime).Seconds() > bufferAckPeriod {
+			if feed.deferBufferAck(totalBytes) {
+				feed.toAckBytes = totalBytes
+				feed.stats.ToAckBytes.Set(uint64(feed.toAckBytes))
+				return nil
+			}
 			bufferAck := &transport.MCRequest{
 				Opcode: transport.DCP_BUFFERACK,
 			}
@@ -1221,6 +1530,7 @@ func (feed *DcpFeed) sendBufferAck(sendAck bool, bytes uint32) error {
 				} else {
 					// Reset the counters only on a successful BufferAck
 					feed.toAckBytes = 0
+					feed.ackDeferred = false
 					feed.stats.ToAckBytes.Set(0)
 					feed.lastAckTime = time.Now()
 					feed.stats.LastMsgSend.Set(feed.lastAckTime.UnixNano())
@@ -1238,6 +1548,26 @@ func (feed *DcpFeed) sendBufferAck(sendAck bool, bytes uint32) error {
 	return nil
 }
 
+// deferBufferAck of `bytes` if this is a backfill feed over its share of
+// projector.backfill.rateLimit.
+func (feed *DcpFeed) deferBufferAck(bytes uint32) bool {
+	if !feed.backfill {
+		return false
+	}
+	now := time.Now()
+	if feed.ackDeferred && now.Before(feed.ackRetryAt) {
+		return true
+	}
+	if wait := memThrottler.ReserveBufferAck(feed.bucket, bytes); wait > 0 {
+		if !feed.ackDeferred {
+			feed.stats.DeferredBufferAck.Add(1)
+		}
+		feed.ackDeferred, feed.ackRetryAt = true, now.Add(wait)
+		return true
+	}
+	return false
+}
+
 func composeOpaque(vbno, opaqueMSB uint16) uint32 {
 	return (uint32(opaqueMSB) << 16) | uint32(vbno)
 }
@@ -1250,17 +1580,55 @@ func vbOpaque(opq32 uint32) uint16 {
 	return uint16(opq32 & 0xFFFF)
 }
 
+// streamKey is the key of a stream in vbstreams, the vbucket for feeds
+// without stream ids.
+func streamKey(vbno, streamId uint16) uint32 {
+	return (uint32(streamId) << 16) | uint32(vbno)
+}
+
+// packetStreamId returns the stream id of a packet received on the feed.
+// Responses to stream requests and close streams do not carry the stream
+// id, but come in the order of the requests.
+func (feed *DcpFeed) packetStreamId(pkt *transport.MCRequest, vb uint16) uint16 {
+	if !feed.streamIds {
+		return 0
+	}
+
+	var pending map[uint16][]uint16
+	switch pkt.Opcode {
+	case transport.DCP_STREAMREQ:
+		pending = feed.pendingReqs
+	case transport.DCP_CLOSESTREAM:
+		pending = feed.pendingCloses
+	default:
+		streamId, _ := pkt.StreamID()
+		return streamId
+	}
+
+	streamIds := pending[vb]
+	if len(streamIds) == 0 {
+		return 0
+	}
+	if len(streamIds) == 1 {
+		delete(pending, vb)
+	} else {
+		pending[vb] = streamIds[1:]
+	}
+	return streamIds[0]
+}
+
 type StreamRequestValue struct {
 	ManifestUID   string   `json:"uid,omitempty"`
 	CollectionIDs []string `json:"collections,omitempty"`
 	ScopeID       string   `json:"scope,omitempty"`
-	StreamID      string   `json:"sid,omitempty"`
+	StreamID      uint16   `json:"sid,omitempty"`
 }
 
 // DcpStream is per stream data structure over an DCP Connection.
 type DcpStream struct {
 	AppOpaque        uint16
 	CloseOpaque      uint16
+	StreamId         uint16 // DCP stream id, 0 without stream ids
 	Vbucket          uint16 // Vbucket id
 	Vbuuid           uint64 // vbucket uuid
 	Seqno            uint64
@@ -1270,6 +1638,7 @@ type DcpStream struct {
 	Snapend          uint64
 	LastSeen         int64 // UnixNano value of last seen
 	connected        bool
+	failed           bool // closing on an event that cannot be delivered
 	CollectionsAware bool
 	RequestValue     *StreamRequestValue
 }
@@ -1281,6 +1650,7 @@ type DcpEvent struct {
 	Datatype   uint8                 // Datatype per binary protocol
 	VBucket    uint16                // VBucket this event applies to
 	Opaque     uint16                // 16 MSB of opaque
+	StreamID   uint16                // DCP stream id, 0 without stream ids
 	VBuuid     uint64                // This field is set by downstream
 	Key, Value []byte                // Item key/value
 	OldValue   []byte                // TODO: TBD: old document value
@@ -1333,6 +1703,7 @@ func newDcpEvent(rq *transport.MCRequest, stream *DcpStream) (event *DcpEvent) {
 		Opcode:   rq.Opcode,
 		VBucket:  stream.Vbucket,
 		VBuuid:   stream.Vbuuid,
+		StreamID: stream.StreamId,
 		Ctime:    time.Now().UnixNano(),
 	}
 
@@ -1448,6 +1819,7 @@ type DcpStats struct {
 	TotalStreamEnd     stats.Uint64Val
 	TotalSpurious      stats.Uint64Val
 	ToAckBytes         stats.Uint64Val
+	DeferredBufferAck  stats.Uint64Val // buffer acks held back to shape backfill
 
 	// Last memcached communication times
 	LastAckTime  stats.Int64Val
@@ -1467,7 +1839,14 @@ type DcpStats struct {
 	OsoSnapshotStart  stats.Uint64Val
 	OsoSnapshotEnd    stats.Uint64Val
 
+	// Snappy related
+	Snappy            stats.BoolVal   // snappy datatype enabled by producer
+	CompressedBytes   stats.Uint64Val // snappy compressed bytes received
+	DecompressedBytes stats.Uint64Val // bytes after decompression
+	SnappyErrors      stats.Uint64Val
+
 	rcvch      chan []interface{}
+	budgetKey  string
 	Dcplatency stats.Average
 	// This stat help to determine the drain rate of dcp feed
 	IncomingMsg stats.Uint64Val
@@ -1484,6 +1863,7 @@ func (dcpStats *DcpStats) Init() {
 	dcpStats.TotalStreamEnd.Init()
 	dcpStats.TotalSpurious.Init()
 	dcpStats.ToAckBytes.Init()
+	dcpStats.DeferredBufferAck.Init()
 	dcpStats.LastAckTime.Init()
 	dcpStats.LastNoopSend.Init()
 	dcpStats.LastNoopRecv.Init()
@@ -1502,12 +1882,23 @@ func (dcpStats *DcpStats) Init() {
 	dcpStats.SeqnoAdvanced.Init()
 	dcpStats.OsoSnapshotStart.Init()
 	dcpStats.OsoSnapshotEnd.Init()
+
+	dcpStats.Snappy.Init()
+	dcpStats.CompressedBytes.Init()
+	dcpStats.DecompressedBytes.Init()
+	dcpStats.SnappyErrors.Init()
 }
 
 func (stats *DcpStats) IsClosed() bool {
 	return stats.Closed.Value()
 }
 
+// BudgetKey return the projector feed whose memory budget applies to this
+// feed, empty if the feed is shared by several of them.
+func (stats *DcpStats) BudgetKey() string {
+	return stats.budgetKey
+}
+
 func (stats *DcpStats) String() (string, string) {
 	now := time.Now()
 	getTimeDur := func(t int64) time.Duration {
@@ -1517,7 +1908,7 @@ func (stats *DcpStats) String() (string, string) {
 		return now.Sub(time.Unix(0, t))
 	}
 
-	var stitems [24]string
+	var stitems [29]string
 	stitems[0] = `"bytes":` + strconv.FormatUint(stats.TotalBytes.Value(), 10)
 	stitems[1] = `"bufferacks":` + strconv.FormatUint(stats.TotalBufferAckSent.Value(), 10)
 	stitems[2] = `"toAckBytes":` + strconv.FormatUint(stats.ToAckBytes.Value(), 10)
@@ -1544,6 +1935,11 @@ func (stats *DcpStats) String() (string, string) {
 	stitems[21] = `"lastMsgRecv":` + getTimeDur(stats.LastMsgRecv.Value()).String()
 	stitems[22] = `"rcvchLen":` + strconv.FormatUint((uint64)(len(stats.rcvch)), 10)
 	stitems[23] = `"incomingMsg":` + strconv.FormatUint(stats.IncomingMsg.Value(), 10)
+	stitems[24] = `"snappy":` + strconv.FormatBool(stats.Snappy.Value())
+	stitems[25] = `"compressedBytes":` + strconv.FormatUint(stats.CompressedBytes.Value(), 10)
+	stitems[26] = `"decompressedBytes":` + strconv.FormatUint(stats.DecompressedBytes.Value(), 10)
+	stitems[27] = `"snappyErrors":` + strconv.FormatUint(stats.SnappyErrors.Value(), 10)
+	stitems[28] = `"deferredBufferAcks":` + strconv.FormatUint(stats.DeferredBufferAck.Value(), 10)
 	statjson := strings.Join(stitems[:], ",")
 
 	statsStr := fmt.Sprintf("{%v}", statjson)
@@ -1750,8 +2146,11 @@ loop:
 		// This is done to make sure that the downstream would eventually consume all the
 		// mutations and the projector process RSS will eventually come down. Once the RSS
 		// comes below 10% of total system memory, then the feed would not throttle.
+		//
+		// Feeds over their memory budget are throttled further, and when
+		// there are any, only they are throttled for projector RSS.
 		if feed.collectionsAware {
-			memThrottler.DoThrottle(feed.isIncrBuild)
+			memThrottler.DoThrottleFeed(feed.budgetKey, feed.isIncrBuild)
 		}
 
 		if len(rcvch) == cap(rcvch) {
@@ -8,8 +8,16 @@ import (
 const (
 	REQ_MAGIC = 0x80
 	RES_MAGIC = 0x81
+
+	// Requests and responses with flexible framing extras
+	ALT_REQ_MAGIC = 0x08
+	ALT_RES_MAGIC = 0x18
 )
 
+// FRAME_INFO_STREAM_ID is the frame info carrying the DCP stream id of a
+// message, on connections with enable_stream_id.
+const FRAME_INFO_STREAM_ID byte = 0x02
+
 // CommandCode for memcached packets.
 type CommandCode uint8
 
@@ -93,6 +101,7 @@ const (
 	OBSERVE = CommandCode(0x92)
 )
 
+const FEATURE_SNAPPY byte = 0x0a
 const FEATURE_COLLECTIONS byte = 0x12
 
 type CollectionEvent uint32
@@ -2,12 +2,17 @@ package transport
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/couchbase/indexing/secondary/logging"
 )
 
+// ErrAltRequestTooLong is returned for a request with framing extras whose
+// framing extras or key do not fit the one byte lengths of ALT_REQ_MAGIC.
+var ErrAltRequestTooLong = errors.New("framing extras or key too long for alt request")
+
 // MCRequest is memcached Request
 type MCRequest struct {
 	// The command being issued
@@ -22,11 +27,13 @@ type MCRequest struct {
 	VBucket uint16
 	// Command extras, key, and body
 	Extras, Key, Body []byte
+	// Flexible framing extras, sent with ALT_REQ_MAGIC if set
+	FramingExtras []byte
 }
 
 // Size gives the number of bytes this request requires.
 func (req *MCRequest) Size() int {
-	return HDR_LEN + len(req.Extras) + len(req.Key) + len(req.Body)
+	return HDR_LEN + len(req.FramingExtras) + len(req.Extras) + len(req.Key) + len(req.Body)
 }
 
 // A debugging string representation of this request
@@ -35,28 +42,55 @@ func (req MCRequest) String() string {
 		req.Opcode, len(req.Body), req.Key)
 }
 
+// validate returns an error if the request cannot be encoded
+func (req *MCRequest) validate() error {
+	if len(req.FramingExtras) > 0 &&
+		(len(req.FramingExtras) > 0xFF || len(req.Key) > 0xFF) {
+		return ErrAltRequestTooLong
+	}
+	return nil
+}
+
+// fillHeaderBytes panics if the request cannot be encoded, as a corrupt
+// header would desync the connection. Transmit returns the error instead.
 func (req *MCRequest) fillHeaderBytes(data []byte) int {
 
+	if err := req.validate(); err != nil {
+		panic(fmt.Errorf("%v: framing extras %v bytes, key %v bytes",
+			err, len(req.FramingExtras), len(req.Key)))
+	}
+
 	pos := 0
-	data[pos] = REQ_MAGIC
-	pos++
-	data[pos] = byte(req.Opcode)
-	pos++
-	binary.BigEndian.PutUint16(data[pos:pos+2],
-		uint16(len(req.Key)))
-	pos += 2
+	if len(req.FramingExtras) > 0 {
+		data[pos] = ALT_REQ_MAGIC
+		pos++
+		data[pos] = byte(req.Opcode)
+		pos++
+		data[pos] = byte(len(req.FramingExtras))
+		pos++
+		data[pos] = byte(len(req.Key))
+		pos++
+	} else {
+		data[pos] = REQ_MAGIC
+		pos++
+		data[pos] = byte(req.Opcode)
+		pos++
+		binary.BigEndian.PutUint16(data[pos:pos+2],
+			uint16(len(req.Key)))
+		pos += 2
+	}
 
 	// 4
 	data[pos] = byte(len(req.Extras))
 	pos++
-	// data[pos] = 0
+	data[pos] = req.Datatype
 	pos++
 	binary.BigEndian.PutUint16(data[pos:pos+2], req.VBucket)
 	pos += 2
 
 	// 8
 	binary.BigEndian.PutUint32(data[pos:pos+4],
-		uint32(len(req.Body)+len(req.Key)+len(req.Extras)))
+		uint32(len(req.Body)+len(req.Key)+len(req.Extras)+len(req.FramingExtras)))
 	pos += 4
 
 	// 12
@@ -69,6 +103,11 @@ func (req *MCRequest) fillHeaderBytes(data []byte) int {
 	}
 	pos += 8
 
+	if len(req.FramingExtras) > 0 {
+		copy(data[pos:pos+len(req.FramingExtras)], req.FramingExtras)
+		pos += len(req.FramingExtras)
+	}
+
 	if len(req.Extras) > 0 {
 		copy(data[pos:pos+len(req.Extras)], req.Extras)
 		pos += len(req.Extras)
@@ -84,7 +123,7 @@ func (req *MCRequest) fillHeaderBytes(data []byte) int {
 // HeaderBytes will return the wire representation of the request header
 // (with the extras and key).
 func (req *MCRequest) HeaderBytes() []byte {
-	data := make([]byte, HDR_LEN+len(req.Extras)+len(req.Key))
+	data := make([]byte, HDR_LEN+len(req.FramingExtras)+len(req.Extras)+len(req.Key))
 
 	req.fillHeaderBytes(data)
 
@@ -106,6 +145,9 @@ func (req *MCRequest) Bytes() []byte {
 
 // Transmit will send this request message across a writer.
 func (req *MCRequest) Transmit(w io.Writer) (n int, err error) {
+	if err = req.validate(); err != nil {
+		return 0, err
+	}
 	if len(req.Body) < 128 {
 		n, err = w.Write(req.Bytes())
 	} else {
@@ -119,6 +161,28 @@ func (req *MCRequest) Transmit(w io.Writer) (n int, err error) {
 	return
 }
 
+// StreamID returns the DCP stream id in the framing extras of the request,
+// if it has one.
+func (req *MCRequest) StreamID() (uint16, bool) {
+	for fe := req.FramingExtras; len(fe) > 0; {
+		id, flen := fe[0]>>4, int(fe[0]&0xF)
+		if id == 0xF || flen == 0xF || len(fe) < 1+flen {
+			// escaped ids and lengths are not used by DCP
+			return 0, false
+		}
+		if id == FRAME_INFO_STREAM_ID && flen == 2 {
+			return binary.BigEndian.Uint16(fe[1:]), true
+		}
+		fe = fe[1+flen:]
+	}
+	return 0, false
+}
+
+// StreamIDFrame returns the framing extras carrying a DCP stream id.
+func StreamIDFrame(sid uint16) []byte {
+	return []byte{FRAME_INFO_STREAM_ID<<4 | 2, byte(sid >> 8), byte(sid)}
+}
+
 // Receive will fill this MCRequest with the data from a reader.
 func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 	if len(hdrBytes) < HDR_LEN {
@@ -132,11 +196,15 @@ func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 		return n, err
 	}
 
-	if hdrBytes[0] != RES_MAGIC && hdrBytes[0] != REQ_MAGIC {
+	var flen, klen int
+	switch hdrBytes[0] {
+	case RES_MAGIC, REQ_MAGIC:
+		klen = int(binary.BigEndian.Uint16(hdrBytes[2:]))
+	case ALT_RES_MAGIC, ALT_REQ_MAGIC:
+		flen, klen = int(hdrBytes[2]), int(hdrBytes[3])
+	default:
 		return n, fmt.Errorf("bad magic: 0x%02x", hdrBytes[0])
 	}
-
-	klen := int(binary.BigEndian.Uint16(hdrBytes[2:]))
 	elen := int(hdrBytes[4])
 
 	req.Datatype = uint8(hdrBytes[5])
@@ -144,14 +212,18 @@ func (req *MCRequest) Receive(r io.Reader, hdrBytes []byte) (int, error) {
 	// Vbucket at 6:7
 	req.VBucket = binary.BigEndian.Uint16(hdrBytes[6:])
 	bodyLen := int(binary.BigEndian.Uint32(hdrBytes[8:]) -
-		uint32(klen) - uint32(elen))
+		uint32(flen) - uint32(klen) - uint32(elen))
 	req.Opaque = binary.BigEndian.Uint32(hdrBytes[12:])
 	req.Cas = binary.BigEndian.Uint64(hdrBytes[16:])
 
-	buf := make([]byte, klen+elen+bodyLen)
+	buf := make([]byte, flen+klen+elen+bodyLen)
 	m, err := io.ReadFull(r, buf)
 	n += m
 	if err == nil {
+		req.FramingExtras = nil
+		if flen > 0 {
+			req.FramingExtras, buf = buf[:flen], buf[flen:]
+		}
 		if req.Opcode >= TAP_MUTATION &&
 			req.Opcode <= TAP_CHECKPOINT_END &&
 			len(buf) > 1 {
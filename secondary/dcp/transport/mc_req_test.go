@@ -247,6 +247,62 @@ func TestReceiveRequestNoContent(t *testing.T) {
 	}
 }
 
+func TestReceiveRequestWithStreamID(t *testing.T) {
+	req := MCRequest{
+		Opcode:        DCP_MUTATION,
+		Opaque:        7242,
+		VBucket:       824,
+		Extras:        []byte{1},
+		Key:           []byte("somekey"),
+		Body:          []byte("somevalue"),
+		FramingExtras: StreamIDFrame(0x1234),
+	}
+
+	data := req.Bytes()
+	if data[0] != ALT_REQ_MAGIC || data[2] != 3 || data[3] != 7 {
+		t.Fatalf("Unexpected header %v", data[:HDR_LEN])
+	}
+
+	req2 := MCRequest{}
+	n, err := req2.Receive(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatalf("Error receiving: %v", err)
+	}
+	if len(data) != n {
+		t.Errorf("Expected to read %v bytes, read %v", len(data), n)
+	}
+
+	if !reflect.DeepEqual(req, req2) {
+		t.Fatalf("Expected %#v == %#v", req, req2)
+	}
+	if sid, ok := req2.StreamID(); !ok || sid != 0x1234 {
+		t.Fatalf("Expected stream id 0x1234, got %v %v", sid, ok)
+	}
+}
+
+func TestTransmitAltRequestTooLong(t *testing.T) {
+	req := MCRequest{
+		Opcode:        DCP_STREAMREQ,
+		Key:           bytes.Repeat([]byte("k"), 256),
+		FramingExtras: StreamIDFrame(0x1234),
+	}
+
+	buf := &bytes.Buffer{}
+	if n, err := req.Transmit(buf); err != ErrAltRequestTooLong || n != 0 {
+		t.Fatalf("Expected %v, got %v after %v bytes", ErrAltRequestTooLong, err, n)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Expected nothing transmitted, got %v bytes", buf.Len())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected panic encoding alt request with a long key")
+		}
+	}()
+	req.Bytes()
+}
+
 func TestReceiveRequestShortHdr(t *testing.T) {
 	req := MCRequest{}
 	n, err := req.Receive(bytes.NewReader([]byte{1, 2, 3}), nil)
@@ -0,0 +1,514 @@
+package memcached
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/dcp/transport"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// DcpProducer emulates the DCP producer of a memcached bucket, for testing
+// the dcp client, kvdata and projector end to end without a Couchbase server.
+// It speaks the binary protocol to any number of connections: HELO, DCP_OPEN,
+// DCP_CONTROL, failover logs, seqnos, stream requests with rollbacks,
+// snapshot markers, mutations, deletions, expirations, collection system
+// events, OSO snapshots, seqno advanced, noops, buffer acks and stream ids.
+//
+// Each vbucket holds a failover log and a history of events. The history is
+// loaded from a JSON fixture, see DcpProducerFixture, or appended to while
+// the producer is running, and is streamed to every stream requested on the
+// vbucket, from its start seqno.
+type DcpProducer struct {
+	// NoopInterval, if set, overrides the noop interval set by consumers.
+	NoopInterval time.Duration
+
+	mutex    sync.Mutex
+	cond     *sync.Cond // signalled on new events, buffer acks and closes
+	snappy   bool
+	vbuckets map[uint16]*dcpProducerVbucket
+	scopes   map[uint32]uint32 // collection id -> scope id
+	listener net.Listener
+	conns    map[*dcpProducerConn]bool
+	stats    DcpProducerStats
+	closed   bool
+}
+
+// DcpProducerStats counts the protocol messages of a DcpProducer.
+type DcpProducerStats struct {
+	Connections    uint64
+	StreamRequests uint64
+	Rollbacks      uint64
+	StreamEnds     uint64
+	EventsSent     uint64
+	BufferAcks     uint64
+	AckedBytes     uint64
+	NoopsSent      uint64
+	NoopResponses  uint64
+}
+
+// DcpProducerFixture is the JSON fixture of a DcpProducer, e.g.
+//
+//	{"snappy": true,
+//	 "collections": [{"scope_id": 8, "collection_id": 9}],
+//	 "vbuckets": [
+//	   {"vbno": 0, "failover_log": [[1234, 0]],
+//	    "events": [
+//	      {"type": "mutation", "key": "doc1", "value": {"age": 10}},
+//	      {"type": "deletion", "key": "doc1"},
+//	      {"type": "snapshot", "snap_type": 2},
+//	      {"type": "mutation", "key": "doc2", "collection_id": 9, "value": "v"}]}]}
+//
+// Failover logs are newest first, as on the wire, and default to a single
+// entry. The default collection, in the default scope, always exists.
+type DcpProducerFixture struct {
+	Snappy      bool                    `json:"snappy,omitempty"`
+	Collections []DcpProducerCollection `json:"collections,omitempty"`
+	Vbuckets    []DcpProducerVbucket    `json:"vbuckets"`
+}
+
+// DcpProducerCollection places a collection in a scope.
+type DcpProducerCollection struct {
+	ScopeID      uint32 `json:"scope_id"`
+	CollectionID uint32 `json:"collection_id"`
+}
+
+// DcpProducerVbucket is the failover log and history of a vbucket.
+type DcpProducerVbucket struct {
+	Vbno        uint16              `json:"vbno"`
+	FailoverLog [][2]uint64         `json:"failover_log,omitempty"`
+	Events      []*DcpProducerEvent `json:"events,omitempty"`
+}
+
+// Event types of a DcpProducerEvent.
+const (
+	DcpEventMutation      = "mutation"
+	DcpEventDeletion      = "deletion"
+	DcpEventExpiration    = "expiration"
+	DcpEventSnapshot      = "snapshot"
+	DcpEventSystem        = "system_event"
+	DcpEventSeqnoAdvanced = "seqno_advanced"
+	DcpEventOsoStart      = "oso_start"
+	DcpEventOsoEnd        = "oso_end"
+)
+
+var dcpSystemEvents = map[string]transport.CollectionEvent{
+	"collection_create":  transport.COLLECTION_CREATE,
+	"collection_drop":    transport.COLLECTION_DROP,
+	"collection_flush":   transport.COLLECTION_FLUSH,
+	"scope_create":       transport.SCOPE_CREATE,
+	"scope_drop":         transport.SCOPE_DROP,
+	"collection_changed": transport.COLLECTION_CHANGED,
+}
+
+const dcpSnapshotMemory = uint32(0x1)
+
+// DcpProducerEvent is an event in the history of a vbucket.
+//
+// Mutations, deletions, expirations and system events take the seqno after
+// the last one of the vbucket if Seqno is not set. A batch of events that
+// does not start with a snapshot marker gets one for all its events, and
+// markers without a start or end cover the events up to the next marker.
+// Snapshot markers default to memory snapshots.
+type DcpProducerEvent struct {
+	Type  string `json:"type"`
+	Seqno uint64 `json:"seqno,omitempty"`
+
+	// mutation, deletion and expiration
+	Key          string                     `json:"key,omitempty"`
+	Value        json.RawMessage            `json:"value,omitempty"`
+	Binary       []byte                     `json:"binary,omitempty"` // non JSON value
+	Xattrs       map[string]json.RawMessage `json:"xattrs,omitempty"`
+	CollectionID uint32                     `json:"collection_id,omitempty"`
+	Cas          uint64                     `json:"cas,omitempty"`
+	RevSeqno     uint64                     `json:"rev_seqno,omitempty"`
+	Flags        uint32                     `json:"flags,omitempty"`
+	Expiry       uint32                     `json:"expiry,omitempty"`
+
+	// snapshot
+	SnapStart uint64 `json:"snap_start,omitempty"`
+	SnapEnd   uint64 `json:"snap_end,omitempty"`
+	SnapType  uint32 `json:"snap_type,omitempty"`
+
+	// system_event, with the scope and collection above
+	Event       string `json:"event,omitempty"`
+	ManifestUID uint64 `json:"manifest_uid,omitempty"`
+	ScopeID     uint32 `json:"scope_id,omitempty"`
+	MaxTTL      uint32 `json:"max_ttl,omitempty"`
+}
+
+func (ev *DcpProducerEvent) hasSeqno() bool {
+	switch ev.Type {
+	case DcpEventMutation, DcpEventDeletion, DcpEventExpiration, DcpEventSystem:
+		return true
+	}
+	return false
+}
+
+func (ev *DcpProducerEvent) validate() error {
+	switch ev.Type {
+	case DcpEventMutation, DcpEventDeletion, DcpEventExpiration:
+		if ev.Key == "" {
+			return fmt.Errorf("%v without a key", ev.Type)
+		}
+		if len(ev.Value) != 0 && !json.Valid(ev.Value) {
+			return fmt.Errorf("%v %v has an invalid JSON value", ev.Type, ev.Key)
+		}
+	case DcpEventSystem:
+		if _, ok := dcpSystemEvents[ev.Event]; !ok {
+			return fmt.Errorf("unknown system event %q", ev.Event)
+		}
+	case DcpEventSnapshot, DcpEventSeqnoAdvanced, DcpEventOsoStart, DcpEventOsoEnd:
+	default:
+		return fmt.Errorf("unknown event type %q", ev.Type)
+	}
+	return nil
+}
+
+type dcpProducerVbucket struct {
+	vbno        uint16
+	failoverLog [][2]uint64 // newest first
+	events      []*DcpProducerEvent
+	highSeqno   uint64
+	rollback    *uint64 // forced rollback of the next stream request
+}
+
+// NewDcpProducer returns a producer without vbuckets.
+func NewDcpProducer() *DcpProducer {
+	p := &DcpProducer{
+		vbuckets: make(map[uint16]*dcpProducerVbucket),
+		scopes:   map[uint32]uint32{0: 0},
+		conns:    make(map[*dcpProducerConn]bool),
+	}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// NewDcpProducerFromFixture returns a producer loaded from a JSON fixture.
+func NewDcpProducerFromFixture(r io.Reader) (*DcpProducer, error) {
+	var fixture DcpProducerFixture
+	if err := json.NewDecoder(r).Decode(&fixture); err != nil {
+		return nil, err
+	}
+
+	p := NewDcpProducer()
+	p.snappy = fixture.Snappy
+	for _, c := range fixture.Collections {
+		p.AddCollection(c.ScopeID, c.CollectionID)
+	}
+	for _, vb := range fixture.Vbuckets {
+		if err := p.AddVbucket(vb.Vbno, vb.FailoverLog); err != nil {
+			return nil, err
+		}
+		if err := p.Append(vb.Vbno, vb.Events...); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// NewDcpProducerFromFile returns a producer loaded from a JSON fixture file.
+func NewDcpProducerFromFile(path string) (*DcpProducer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewDcpProducerFromFixture(f)
+}
+
+// SetSnappy sets whether the producer supports snappy compressed values.
+func (p *DcpProducer) SetSnappy(snappy bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.snappy = snappy
+}
+
+// AddCollection places a collection in a scope, for streams filtered by scope.
+// Collections created by system events are added when they are appended.
+func (p *DcpProducer) AddCollection(scopeID, collectionID uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.scopes[collectionID] = scopeID
+}
+
+// AddVbucket adds a vbucket with a failover log, newest entry first. A nil
+// failover log gets a single entry.
+func (p *DcpProducer) AddVbucket(vbno uint16, failoverLog [][2]uint64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.vbuckets[vbno]; ok {
+		return fmt.Errorf("vbucket %v already exists", vbno)
+	}
+	if len(failoverLog) == 0 {
+		failoverLog = [][2]uint64{{0xABCD0000 + uint64(vbno), 0}}
+	}
+	p.vbuckets[vbno] = &dcpProducerVbucket{
+		vbno:        vbno,
+		failoverLog: append([][2]uint64(nil), failoverLog...),
+		highSeqno:   failoverLog[0][1],
+	}
+	return nil
+}
+
+// Append adds events to the history of a vbucket, and streams them to the
+// streams open on it.
+func (p *DcpProducer) Append(vbno uint16, events ...*DcpProducerEvent) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	vb, ok := p.vbuckets[vbno]
+	if !ok {
+		return fmt.Errorf("vbucket %v does not exist", vbno)
+	}
+
+	batch := make([]*DcpProducerEvent, 0, len(events)+1)
+	high, items := vb.highSeqno, 0
+	for _, ev := range events {
+		ev1 := *ev
+		if err := ev1.validate(); err != nil {
+			return fmt.Errorf("vbucket %v: %v", vbno, err)
+		}
+		if ev1.hasSeqno() {
+			if ev1.Seqno == 0 {
+				ev1.Seqno = high + 1
+			} else if ev1.Seqno <= high {
+				return fmt.Errorf("vbucket %v: seqno %v is not above %v", vbno, ev1.Seqno, high)
+			}
+			high = ev1.Seqno
+			items++
+		} else if ev1.Type == DcpEventSeqnoAdvanced && ev1.Seqno == 0 {
+			ev1.Seqno = high
+		}
+		batch = append(batch, &ev1)
+	}
+
+	if items > 0 && batch[0].Type != DcpEventSnapshot {
+		batch = append([]*DcpProducerEvent{{Type: DcpEventSnapshot}}, batch...)
+	}
+	for i, ev := range batch {
+		if ev.Type != DcpEventSnapshot {
+			continue
+		}
+		start, end := uint64(0), uint64(0)
+		for _, ev1 := range batch[i+1:] {
+			if ev1.Type == DcpEventSnapshot {
+				break
+			} else if ev1.hasSeqno() {
+				if start == 0 {
+					start = ev1.Seqno
+				}
+				end = ev1.Seqno
+			}
+		}
+		if ev.SnapStart == 0 {
+			ev.SnapStart = start
+		}
+		if ev.SnapEnd == 0 {
+			ev.SnapEnd = end
+		}
+		if ev.SnapType == 0 {
+			ev.SnapType = dcpSnapshotMemory
+		}
+		if ev.SnapStart == 0 || ev.SnapEnd < ev.SnapStart {
+			return fmt.Errorf("vbucket %v: invalid snapshot marker %v-%v", vbno, ev.SnapStart, ev.SnapEnd)
+		}
+	}
+
+	for _, ev := range batch {
+		if ev.Type == DcpEventSystem && dcpSystemEvents[ev.Event] == transport.COLLECTION_CREATE {
+			p.scopes[ev.CollectionID] = ev.ScopeID
+		}
+	}
+	vb.events = append(vb.events, batch...)
+	vb.highSeqno = high
+	p.cond.Broadcast()
+	return nil
+}
+
+// HighSeqno returns the high seqno of a vbucket.
+func (p *DcpProducer) HighSeqno(vbno uint16) uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if vb, ok := p.vbuckets[vbno]; ok {
+		return vb.highSeqno
+	}
+	return 0
+}
+
+// Failover starts a new branch of the history of a vbucket at its high seqno,
+// as a failover of the vbucket to a replica would.
+func (p *DcpProducer) Failover(vbno uint16, vbuuid uint64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	vb, ok := p.vbuckets[vbno]
+	if !ok {
+		return fmt.Errorf("vbucket %v does not exist", vbno)
+	}
+	entry := [2]uint64{vbuuid, vb.highSeqno}
+	vb.failoverLog = append([][2]uint64{entry}, vb.failoverLog...)
+	return nil
+}
+
+// ForceRollback makes the next stream request on a vbucket that starts
+// above seqno roll back to seqno.
+func (p *DcpProducer) ForceRollback(vbno uint16, seqno uint64) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	vb, ok := p.vbuckets[vbno]
+	if !ok {
+		return fmt.Errorf("vbucket %v does not exist", vbno)
+	}
+	vb.rollback = &seqno
+	return nil
+}
+
+// EndStreams ends the streams open on a vbucket with a STREAMEND carrying
+// flags, as a vbucket state change or a slow consumer would.
+func (p *DcpProducer) EndStreams(vbno uint16, flags uint32) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for conn := range p.conns {
+		for _, s := range conn.streams {
+			if s.vb.vbno == vbno && s.endFlags == nil {
+				s.endFlags = &flags
+			}
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// Stats returns the message counts of the producer.
+func (p *DcpProducer) Stats() DcpProducerStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.stats
+}
+
+// Listen accepts connections on a TCP address, e.g. "127.0.0.1:0", and
+// returns the address listened on.
+func (p *DcpProducer) Listen(addr string) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+
+	p.mutex.Lock()
+	if p.closed || p.listener != nil {
+		p.mutex.Unlock()
+		listener.Close()
+		return "", fmt.Errorf("producer is closed or already listening")
+	}
+	p.listener = listener
+	p.mutex.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.Serve(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// Serve serves a connection until it fails or the producer is closed.
+func (p *DcpProducer) Serve(rwc io.ReadWriteCloser) error {
+	conn := newDcpProducerConn(p, rwc)
+
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		rwc.Close()
+		return io.EOF
+	}
+	p.conns[conn] = true
+	p.stats.Connections++
+	p.mutex.Unlock()
+
+	err := conn.run()
+	if err != nil && err != io.EOF {
+		logging.Debugf("DcpProducer connection %q closed: %v", conn.name, err)
+	}
+	return err
+}
+
+// DropConnections closes all connections, as a memcached restart would.
+func (p *DcpProducer) DropConnections() {
+	p.mutex.Lock()
+	conns := make([]*dcpProducerConn, 0, len(p.conns))
+	for conn := range p.conns {
+		conns = append(conns, conn)
+	}
+	p.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.close()
+	}
+}
+
+// Close stops listening and closes all connections.
+func (p *DcpProducer) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	if p.listener != nil {
+		p.listener.Close()
+	}
+	p.mutex.Unlock()
+
+	p.DropConnections()
+}
+
+// rollbackSeqno returns whether a stream request must roll back, and to which
+// seqno. Called with the mutex held.
+func (vb *dcpProducerVbucket) rollbackSeqno(vbuuid, start, snapStart, snapEnd uint64) (bool, uint64) {
+	if vb.rollback != nil && start > *vb.rollback {
+		seqno := *vb.rollback
+		vb.rollback = nil
+		return true, seqno
+	}
+	if start == 0 {
+		return false, 0
+	}
+
+	// the branch of vbuuid ends where the next branch starts
+	for i, entry := range vb.failoverLog {
+		if entry[0] != vbuuid {
+			continue
+		}
+		upper := vb.highSeqno
+		if i > 0 {
+			upper = vb.failoverLog[i-1][1]
+		}
+		if start <= upper && snapEnd <= upper {
+			return false, 0
+		}
+		if snapStart < upper {
+			upper = snapStart
+		}
+		return true, upper
+	}
+	return true, 0
+}
+
+// sortedVbuckets is called with the mutex held.
+func (p *DcpProducer) sortedVbuckets() []*dcpProducerVbucket {
+	vbs := make([]*dcpProducerVbucket, 0, len(p.vbuckets))
+	for _, vb := range p.vbuckets {
+		vbs = append(vbs, vb)
+	}
+	sort.Slice(vbs, func(i, j int) bool { return vbs[i].vbno < vbs[j].vbno })
+	return vbs
+}
@@ -0,0 +1,760 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common/collections"
+	"github.com/couchbase/indexing/secondary/dcp/transport"
+	"github.com/golang/snappy"
+)
+
+const dcpOpenProducer = uint32(0x1)
+const dcpOpenIncludeXattrs = uint32(0x4)
+
+const (
+	dcpDatatypeJSON   = uint8(0x1)
+	dcpDatatypeSnappy = uint8(0x2)
+	dcpDatatypeXattr  = uint8(0x4)
+)
+
+const dcpOsoStart = uint32(0x1)
+const dcpOsoEnd = uint32(0x2)
+
+const dcpNoopOpaque = uint32(0xF00D0000)
+
+// dcpProducerConn is a connection to a DcpProducer. All fields but rwc and
+// wmutex are protected by the producer mutex.
+type dcpProducerConn struct {
+	p      *DcpProducer
+	rwc    io.ReadWriteCloser
+	wmutex sync.Mutex
+
+	name             string
+	collections      bool
+	snappy           bool
+	xattrs           bool
+	oso              bool
+	forceCompression bool
+	streamIds        bool
+	noop             bool
+	noopInterval     time.Duration
+	noopStarted      bool
+	bufferSize       uint32
+	unacked          uint32
+	streams          map[uint32]*dcpProducerStream // by (vb, stream id)
+	closed           bool
+	donech           chan bool
+}
+
+type dcpProducerStream struct {
+	vb          *dcpProducerVbucket
+	opaque      uint32
+	sid         uint16 // stream id, 0 without stream ids
+	start, end  uint64
+	scopeID     *uint32
+	collections map[uint32]bool
+	failoverLog [][2]uint64
+	endFlags    *uint32 // set to end the stream
+	closed      bool    // closed by the consumer
+}
+
+func (s *dcpProducerStream) filtered() bool {
+	return s.scopeID != nil || s.collections != nil
+}
+
+func (s *dcpProducerStream) key() uint32 {
+	return dcpStreamKey(s.vb.vbno, s.sid)
+}
+
+func dcpStreamKey(vbno, sid uint16) uint32 {
+	return uint32(sid)<<16 | uint32(vbno)
+}
+
+func newDcpProducerConn(p *DcpProducer, rwc io.ReadWriteCloser) *dcpProducerConn {
+	return &dcpProducerConn{
+		p:       p,
+		rwc:     rwc,
+		streams: make(map[uint32]*dcpProducerStream),
+		donech:  make(chan bool),
+	}
+}
+
+func (c *dcpProducerConn) run() error {
+	defer c.close()
+
+	for {
+		pkt, err := ReadPacket(c.rwc)
+		if err != nil {
+			return err
+		}
+		if res := c.handle(&pkt); res != nil {
+			res.Opcode, res.Opaque = pkt.Opcode, pkt.Opaque
+			if err := c.transmitResponse(res); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *dcpProducerConn) close() {
+	p := c.p
+	p.mutex.Lock()
+	if c.closed {
+		p.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	close(c.donech)
+	delete(p.conns, c)
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+
+	c.rwc.Close()
+}
+
+func (c *dcpProducerConn) transmitResponse(res *transport.MCResponse) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	_, err := res.Transmit(c.rwc)
+	return err
+}
+
+func (c *dcpProducerConn) transmit(req *transport.MCRequest) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	_, err := req.Transmit(c.rwc)
+	return err
+}
+
+// handle returns the response to a packet, or nil if it has none or the
+// response has been sent.
+func (c *dcpProducerConn) handle(pkt *transport.MCRequest) *transport.MCResponse {
+	p := c.p
+
+	switch pkt.Opcode {
+	case transport.SASL_LIST_MECHS:
+		return &transport.MCResponse{Body: []byte("PLAIN")}
+
+	case transport.SASL_AUTH, transport.SELECT_BUCKET:
+		return &transport.MCResponse{}
+
+	case transport.HELO:
+		return c.handleHelo(pkt)
+
+	case transport.DCP_OPEN:
+		if len(pkt.Extras) != 8 {
+			return &transport.MCResponse{Status: transport.EINVAL}
+		}
+		flags := binary.BigEndian.Uint32(pkt.Extras[4:])
+		p.mutex.Lock()
+		c.name = string(pkt.Key)
+		c.xattrs = flags&dcpOpenIncludeXattrs != 0
+		p.mutex.Unlock()
+		if flags&dcpOpenProducer == 0 {
+			// only producer connections are emulated
+			return &transport.MCResponse{Status: transport.EINVAL}
+		}
+		return &transport.MCResponse{}
+
+	case transport.DCP_CONTROL:
+		return c.handleControl(string(pkt.Key), string(pkt.Body))
+
+	case transport.DCP_FAILOVERLOG:
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		vb, ok := p.vbuckets[pkt.VBucket]
+		if !ok {
+			return &transport.MCResponse{Status: transport.NOT_MY_VBUCKET}
+		}
+		return &transport.MCResponse{Body: encodeFailoverLog(vb.failoverLog)}
+
+	case transport.DCP_GET_SEQNO:
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		body := make([]byte, 0, len(p.vbuckets)*10)
+		for _, vb := range p.sortedVbuckets() {
+			body = binary.BigEndian.AppendUint16(body, vb.vbno)
+			body = binary.BigEndian.AppendUint64(body, vb.highSeqno)
+		}
+		return &transport.MCResponse{Body: body}
+
+	case transport.DCP_STREAMREQ:
+		return c.handleStreamRequest(pkt)
+
+	case transport.DCP_CLOSESTREAM:
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		sid, ok := pkt.StreamID()
+		if ok != c.streamIds {
+			return &transport.MCResponse{Status: transport.EINVAL}
+		}
+		s, ok := c.streams[dcpStreamKey(pkt.VBucket, sid)]
+		if !ok {
+			return &transport.MCResponse{Status: transport.KEY_ENOENT}
+		}
+		s.closed = true
+		delete(c.streams, s.key())
+		p.cond.Broadcast()
+		return &transport.MCResponse{}
+
+	case transport.DCP_BUFFERACK:
+		if len(pkt.Extras) == 4 {
+			acked := binary.BigEndian.Uint32(pkt.Extras)
+			p.mutex.Lock()
+			if acked > c.unacked {
+				acked = c.unacked
+			}
+			c.unacked -= acked
+			p.stats.BufferAcks++
+			p.stats.AckedBytes += uint64(acked)
+			p.cond.Broadcast()
+			p.mutex.Unlock()
+		}
+		return nil
+
+	case transport.DCP_NOOP:
+		// response to a noop of the producer
+		p.mutex.Lock()
+		p.stats.NoopResponses++
+		p.mutex.Unlock()
+		return nil
+	}
+
+	return &transport.MCResponse{Status: transport.UNKNOWN_COMMAND}
+}
+
+func (c *dcpProducerConn) handleHelo(pkt *transport.MCRequest) *transport.MCResponse {
+	p := c.p
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var body []byte
+	for i := 0; i+1 < len(pkt.Body); i += 2 {
+		feature := binary.BigEndian.Uint16(pkt.Body[i:])
+		switch {
+		case feature == uint16(transport.FEATURE_COLLECTIONS):
+			c.collections = true
+		case feature == uint16(transport.FEATURE_SNAPPY) && p.snappy:
+			c.snappy = true
+		default:
+			continue
+		}
+		body = binary.BigEndian.AppendUint16(body, feature)
+	}
+	return &transport.MCResponse{Body: body}
+}
+
+func (c *dcpProducerConn) handleControl(key, value string) *transport.MCResponse {
+	p := c.p
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch key {
+	case "connection_buffer_size":
+		size, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return &transport.MCResponse{Status: transport.EINVAL}
+		}
+		c.bufferSize = uint32(size)
+		p.cond.Broadcast()
+
+	case "enable_noop":
+		c.noop = value == "true"
+
+	case "set_noop_interval":
+		secs, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || secs == 0 {
+			return &transport.MCResponse{Status: transport.EINVAL}
+		}
+		c.noopInterval = time.Duration(secs) * time.Second
+
+	case "enable_out_of_order_snapshots":
+		c.oso = value == "true" || value == "true_with_seqno_advanced"
+
+	case "enable_stream_id":
+		if !c.collections {
+			return &transport.MCResponse{Status: transport.EINVAL}
+		}
+		c.streamIds = value == "true"
+
+	case "force_value_compression":
+		if !c.snappy {
+			return &transport.MCResponse{Status: transport.EINVAL}
+		}
+		c.forceCompression = value == "true"
+
+	default:
+		return &transport.MCResponse{Status: transport.EINVAL}
+	}
+
+	if c.noop && c.noopInterval > 0 && !c.noopStarted {
+		c.noopStarted = true
+		interval := c.noopInterval
+		if p.NoopInterval > 0 {
+			interval = p.NoopInterval
+		}
+		go c.sendNoops(interval)
+	}
+	return &transport.MCResponse{}
+}
+
+func (c *dcpProducerConn) sendNoops(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.donech:
+			return
+		}
+		noop := &transport.MCRequest{Opcode: transport.DCP_NOOP, Opaque: dcpNoopOpaque}
+		if err := c.transmit(noop); err != nil {
+			c.close()
+			return
+		}
+		c.p.mutex.Lock()
+		c.p.stats.NoopsSent++
+		c.p.mutex.Unlock()
+	}
+}
+
+func (c *dcpProducerConn) handleStreamRequest(pkt *transport.MCRequest) *transport.MCResponse {
+	if len(pkt.Extras) != 48 {
+		return &transport.MCResponse{Status: transport.EINVAL}
+	}
+	start := binary.BigEndian.Uint64(pkt.Extras[8:])
+	end := binary.BigEndian.Uint64(pkt.Extras[16:])
+	vbuuid := binary.BigEndian.Uint64(pkt.Extras[24:])
+	snapStart := binary.BigEndian.Uint64(pkt.Extras[32:])
+	snapEnd := binary.BigEndian.Uint64(pkt.Extras[40:])
+
+	p := c.p
+	p.mutex.Lock()
+	s, res := c.newStream(pkt, start, end, vbuuid, snapStart, snapEnd)
+	p.mutex.Unlock()
+	if res != nil {
+		return res
+	}
+
+	// the response goes out before the first message of the stream
+	res = &transport.MCResponse{
+		Opcode: pkt.Opcode,
+		Opaque: pkt.Opaque,
+		Body:   encodeFailoverLog(s.failoverLog),
+	}
+	if err := c.transmitResponse(res); err != nil {
+		c.close()
+		return nil
+	}
+	go c.runStream(s)
+	return nil
+}
+
+// newStream opens a stream, or returns the response of a stream request
+// that fails. Called with the producer mutex held.
+func (c *dcpProducerConn) newStream(pkt *transport.MCRequest,
+	start, end, vbuuid, snapStart, snapEnd uint64) (*dcpProducerStream, *transport.MCResponse) {
+
+	p := c.p
+	p.stats.StreamRequests++
+
+	vb, ok := p.vbuckets[pkt.VBucket]
+	if !ok {
+		return nil, &transport.MCResponse{Status: transport.NOT_MY_VBUCKET}
+	}
+	if start > end || snapStart > start || start > snapEnd {
+		return nil, &transport.MCResponse{Status: transport.ERANGE}
+	}
+
+	s := &dcpProducerStream{vb: vb, opaque: pkt.Opaque, start: start, end: end}
+	if status := c.parseStreamFilter(s, pkt.Body); status != transport.SUCCESS {
+		return nil, &transport.MCResponse{Status: status}
+	}
+	if _, ok := c.streams[s.key()]; ok {
+		return nil, &transport.MCResponse{Status: transport.KEY_EEXISTS}
+	}
+
+	if rollback, seqno := vb.rollbackSeqno(vbuuid, start, snapStart, snapEnd); rollback {
+		p.stats.Rollbacks++
+		body := binary.BigEndian.AppendUint64(nil, seqno)
+		return nil, &transport.MCResponse{Status: transport.ROLLBACK, Body: body}
+	}
+
+	s.failoverLog = append([][2]uint64(nil), vb.failoverLog...)
+	c.streams[s.key()] = s
+	return s, nil
+}
+
+// parseStreamFilter is called with the producer mutex held.
+func (c *dcpProducerConn) parseStreamFilter(s *dcpProducerStream, body []byte) transport.Status {
+	if len(body) == 0 {
+		// streams must have an id on connections with stream ids
+		if c.streamIds {
+			return transport.EINVAL
+		}
+		return transport.SUCCESS
+	}
+	if !c.collections {
+		return transport.EINVAL
+	}
+
+	var filter struct {
+		ManifestUID   string   `json:"uid,omitempty"`
+		CollectionIDs []string `json:"collections,omitempty"`
+		ScopeID       string   `json:"scope,omitempty"`
+		StreamID      uint16   `json:"sid,omitempty"`
+	}
+	if err := json.Unmarshal(body, &filter); err != nil {
+		return transport.EINVAL
+	}
+	if c.streamIds != (filter.StreamID != 0) {
+		return transport.EINVAL
+	}
+	s.sid = filter.StreamID
+	if filter.ScopeID != "" && len(filter.CollectionIDs) > 0 {
+		return transport.EINVAL
+	}
+
+	if filter.ScopeID != "" {
+		sid, err := strconv.ParseUint(filter.ScopeID, 16, 32)
+		if err != nil {
+			return transport.EINVAL
+		}
+		found := false
+		for _, sid1 := range c.p.scopes {
+			found = found || sid1 == uint32(sid)
+		}
+		if !found {
+			return transport.UNKNOWN_SCOPE
+		}
+		scopeID := uint32(sid)
+		s.scopeID = &scopeID
+	}
+
+	if len(filter.CollectionIDs) > 0 {
+		s.collections = make(map[uint32]bool)
+		for _, cidStr := range filter.CollectionIDs {
+			cid, err := strconv.ParseUint(cidStr, 16, 32)
+			if err != nil {
+				return transport.EINVAL
+			}
+			if _, ok := c.p.scopes[uint32(cid)]; !ok {
+				return transport.UNKNOWN_COLLECTION
+			}
+			s.collections[uint32(cid)] = true
+		}
+	}
+	return transport.SUCCESS
+}
+
+// runStream streams the history of a vbucket from the start seqno of the
+// stream, waiting for new events once it is caught up, until the end seqno
+// is reached or the stream is closed.
+func (c *dcpProducerConn) runStream(s *dcpProducerStream) {
+	p := c.p
+	vbno := s.vb.vbno
+	next := 0
+	snapEnd := uint64(0)
+
+	for {
+		p.mutex.Lock()
+		for !c.closed && !s.closed && s.endFlags == nil && next >= len(s.vb.events) {
+			p.cond.Wait()
+		}
+		if c.closed || s.closed {
+			p.mutex.Unlock()
+			return
+		}
+		if s.endFlags != nil {
+			flags := *s.endFlags
+			p.mutex.Unlock()
+			c.endStream(s, flags)
+			return
+		}
+		ev := s.vb.events[next]
+		next++
+		if ev.Type == DcpEventSnapshot {
+			snapEnd = ev.SnapEnd
+		}
+		if ev.hasSeqno() && ev.Seqno > s.end {
+			p.mutex.Unlock()
+			c.endStream(s, 0)
+			return
+		}
+		pkt := c.eventPacket(s, ev, snapEnd)
+		p.mutex.Unlock()
+
+		if pkt != nil {
+			pkt.VBucket, pkt.Opaque = vbno, s.opaque
+			if s.sid != 0 {
+				pkt.FramingExtras = transport.StreamIDFrame(s.sid)
+			}
+			if !c.sendStreamPacket(pkt) {
+				return
+			}
+		}
+
+		if ev.hasSeqno() && ev.Seqno == s.end {
+			c.endStream(s, 0)
+			return
+		}
+	}
+}
+
+// sendStreamPacket sends a stream message within the flow control buffer
+// of the connection.
+func (c *dcpProducerConn) sendStreamPacket(pkt *transport.MCRequest) bool {
+	p := c.p
+	size := uint32(pkt.Size())
+
+	p.mutex.Lock()
+	for !c.closed && c.bufferSize > 0 && c.unacked > 0 && c.unacked+size > c.bufferSize {
+		p.cond.Wait()
+	}
+	if c.closed {
+		p.mutex.Unlock()
+		return false
+	}
+	c.unacked += size
+	p.stats.EventsSent++
+	p.mutex.Unlock()
+
+	if err := c.transmit(pkt); err != nil {
+		c.close()
+		return false
+	}
+	return true
+}
+
+func (c *dcpProducerConn) endStream(s *dcpProducerStream, flags uint32) {
+	p := c.p
+	p.mutex.Lock()
+	if s.closed || c.streams[s.key()] != s {
+		p.mutex.Unlock()
+		return
+	}
+	delete(c.streams, s.key())
+	p.stats.StreamEnds++
+	p.mutex.Unlock()
+
+	pkt := &transport.MCRequest{
+		Opcode:  transport.DCP_STREAMEND,
+		VBucket: s.vb.vbno,
+		Opaque:  s.opaque,
+		Extras:  binary.BigEndian.AppendUint32(nil, flags),
+	}
+	if s.sid != 0 {
+		pkt.FramingExtras = transport.StreamIDFrame(s.sid)
+	}
+	c.sendStreamPacket(pkt)
+}
+
+// eventPacket returns the stream message of an event, or nil if the event
+// is not sent on the stream. Called with the producer mutex held.
+func (c *dcpProducerConn) eventPacket(s *dcpProducerStream, ev *DcpProducerEvent, snapEnd uint64) *transport.MCRequest {
+	switch ev.Type {
+	case DcpEventSnapshot:
+		if ev.SnapEnd <= s.start {
+			return nil
+		}
+		start := ev.SnapStart
+		if start < s.start {
+			start = s.start
+		}
+		extras := binary.BigEndian.AppendUint64(nil, start)
+		extras = binary.BigEndian.AppendUint64(extras, ev.SnapEnd)
+		extras = binary.BigEndian.AppendUint32(extras, ev.SnapType)
+		return &transport.MCRequest{Opcode: transport.DCP_SNAPSHOT, Extras: extras}
+
+	case DcpEventOsoStart, DcpEventOsoEnd:
+		if !c.oso {
+			return nil
+		}
+		flags := dcpOsoStart
+		if ev.Type == DcpEventOsoEnd {
+			flags = dcpOsoEnd
+		}
+		extras := binary.BigEndian.AppendUint32(nil, flags)
+		return &transport.MCRequest{Opcode: transport.DCP_OSO_SNAPSHOT, Extras: extras}
+
+	case DcpEventSeqnoAdvanced:
+		if ev.Seqno <= s.start || !(s.filtered() || c.oso) {
+			return nil
+		}
+		return seqnoAdvancedPacket(ev.Seqno)
+	}
+
+	if ev.Seqno <= s.start {
+		return nil
+	}
+	if !c.sendsEvent(s, ev) {
+		// filtered streams learn of the end of a snapshot
+		if s.filtered() && ev.Seqno == snapEnd {
+			return seqnoAdvancedPacket(ev.Seqno)
+		}
+		return nil
+	}
+
+	if ev.Type == DcpEventSystem {
+		return systemEventPacket(ev, c.p.scopes)
+	}
+	return c.documentPacket(ev)
+}
+
+// sendsEvent returns whether a document or system event passes the filter
+// of a stream. Called with the producer mutex held.
+func (c *dcpProducerConn) sendsEvent(s *dcpProducerStream, ev *DcpProducerEvent) bool {
+	scopeEvent := false
+	if ev.Type == DcpEventSystem {
+		if !c.collections {
+			return false
+		}
+		event := dcpSystemEvents[ev.Event]
+		scopeEvent = event == transport.SCOPE_CREATE || event == transport.SCOPE_DROP
+	} else if !c.collections && ev.CollectionID != 0 {
+		return false
+	}
+
+	switch {
+	case s.collections != nil:
+		return !scopeEvent && s.collections[ev.CollectionID]
+	case s.scopeID != nil && scopeEvent:
+		return ev.ScopeID == *s.scopeID
+	case s.scopeID != nil:
+		sid, ok := c.p.scopes[ev.CollectionID]
+		return ok && sid == *s.scopeID
+	}
+	return true
+}
+
+func (c *dcpProducerConn) documentPacket(ev *DcpProducerEvent) *transport.MCRequest {
+	pkt := &transport.MCRequest{Cas: ev.Cas, Key: []byte(ev.Key)}
+	if pkt.Cas == 0 {
+		pkt.Cas = ev.Seqno
+	}
+	if c.collections {
+		pkt.Key = collections.PrependLEB128EncKey(pkt.Key, ev.CollectionID)
+	}
+
+	extras := binary.BigEndian.AppendUint64(nil, ev.Seqno)
+	extras = binary.BigEndian.AppendUint64(extras, ev.RevSeqno)
+
+	var value []byte
+	switch ev.Type {
+	case DcpEventMutation:
+		pkt.Opcode = transport.DCP_MUTATION
+		extras = binary.BigEndian.AppendUint32(extras, ev.Flags)
+		extras = binary.BigEndian.AppendUint32(extras, ev.Expiry)
+		extras = binary.BigEndian.AppendUint32(extras, 0) // lock time
+		extras = binary.BigEndian.AppendUint16(extras, 0) // nmeta
+		extras = append(extras, 0)                        // nru
+		if len(ev.Value) != 0 {
+			value = []byte(ev.Value)
+			pkt.Datatype |= dcpDatatypeJSON
+		} else {
+			value = ev.Binary
+		}
+
+	case DcpEventDeletion:
+		pkt.Opcode = transport.DCP_DELETION
+		extras = binary.BigEndian.AppendUint16(extras, 0) // nmeta
+
+	case DcpEventExpiration:
+		pkt.Opcode = transport.DCP_EXPIRATION
+		extras = binary.BigEndian.AppendUint32(extras, 0) // delete time
+	}
+	pkt.Extras = extras
+
+	if c.xattrs && len(ev.Xattrs) > 0 {
+		value = append(encodeXattrs(ev.Xattrs), value...)
+		pkt.Datatype |= dcpDatatypeXattr
+	}
+	if c.forceCompression && len(value) > 0 {
+		value = snappy.Encode(nil, value)
+		pkt.Datatype |= dcpDatatypeSnappy
+	}
+	pkt.Body = value
+	return pkt
+}
+
+func systemEventPacket(ev *DcpProducerEvent, scopes map[uint32]uint32) *transport.MCRequest {
+	event := dcpSystemEvents[ev.Event]
+	version := uint8(0)
+
+	body := binary.BigEndian.AppendUint64(nil, ev.ManifestUID)
+	switch event {
+	case transport.COLLECTION_CREATE:
+		body = binary.BigEndian.AppendUint32(body, ev.ScopeID)
+		body = binary.BigEndian.AppendUint32(body, ev.CollectionID)
+		if ev.MaxTTL != 0 {
+			body = binary.BigEndian.AppendUint32(body, ev.MaxTTL)
+			version = 1
+		}
+	case transport.COLLECTION_DROP, transport.COLLECTION_FLUSH:
+		scopeID, ok := scopes[ev.CollectionID]
+		if !ok {
+			scopeID = ev.ScopeID
+		}
+		body = binary.BigEndian.AppendUint32(body, scopeID)
+		body = binary.BigEndian.AppendUint32(body, ev.CollectionID)
+	case transport.SCOPE_CREATE, transport.SCOPE_DROP:
+		body = binary.BigEndian.AppendUint32(body, ev.ScopeID)
+	case transport.COLLECTION_CHANGED:
+		body = binary.BigEndian.AppendUint32(body, ev.CollectionID)
+		body = binary.BigEndian.AppendUint32(body, ev.MaxTTL)
+	}
+
+	extras := binary.BigEndian.AppendUint64(nil, ev.Seqno)
+	extras = binary.BigEndian.AppendUint32(extras, uint32(event))
+	extras = append(extras, version)
+	return &transport.MCRequest{
+		Opcode: transport.DCP_SYSTEM_EVENT,
+		Key:    []byte(ev.Key),
+		Extras: extras,
+		Body:   body,
+	}
+}
+
+func seqnoAdvancedPacket(seqno uint64) *transport.MCRequest {
+	return &transport.MCRequest{
+		Opcode: transport.DCP_SEQNO_ADVANCED,
+		Extras: binary.BigEndian.AppendUint64(nil, seqno),
+	}
+}
+
+// encodeXattrs encodes xattrs as on the wire, sorted by key.
+func encodeXattrs(xattrs map[string]json.RawMessage) []byte {
+	keys := make([]string, 0, len(xattrs))
+	for key := range xattrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	body := []byte{0, 0, 0, 0}
+	for _, key := range keys {
+		pairLen := len(key) + len(xattrs[key]) + 2
+		body = binary.BigEndian.AppendUint32(body, uint32(pairLen))
+		body = append(body, key...)
+		body = append(body, 0)
+		body = append(body, xattrs[key]...)
+		body = append(body, 0)
+	}
+	binary.BigEndian.PutUint32(body, uint32(len(body)-4))
+	return body
+}
+
+func encodeFailoverLog(failoverLog [][2]uint64) []byte {
+	body := make([]byte, 0, len(failoverLog)*16)
+	for _, entry := range failoverLog {
+		body = binary.BigEndian.AppendUint64(body, entry[0])
+		body = binary.BigEndian.AppendUint64(body, entry[1])
+	}
+	return body
+}
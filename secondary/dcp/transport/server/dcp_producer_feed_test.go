@@ -0,0 +1,145 @@
+package memcached
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+)
+
+func expectFeedEvent(t *testing.T, outch chan *mc.DcpEvent, opcode transport.CommandCode) *mc.DcpEvent {
+	select {
+	case m := <-outch:
+		if m.Opcode != opcode {
+			t.Fatalf("Expected %v, got %v", opcode, m.Opcode)
+		}
+		return m
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timeout waiting for %v", opcode)
+	}
+	return nil
+}
+
+// TestDcpProducerFeed runs the dcp client feed against the producer, with
+// collections, snappy compressed values, stream ids and a flow control
+// buffer small enough to stall the stream without buffer acks.
+func TestDcpProducerFeed(t *testing.T) {
+	p := NewDcpProducer()
+	defer p.Close()
+	p.SetSnappy(true)
+	p.AddCollection(8, 9)
+	if err := p.AddVbucket(0, [][2]uint64{{1234, 0}}); err != nil {
+		t.Fatalf("AddVbucket(): %v", err)
+	}
+
+	const n = 50
+	values := make(map[string]string)
+	var events []*DcpProducerEvent
+	for i := 1; i <= n; i++ {
+		key := fmt.Sprintf("doc%v", i)
+		values[key] = fmt.Sprintf(`{"n":%v,"pad":"%v"}`, i, strings.Repeat("x", 64))
+		events = append(events, &DcpProducerEvent{
+			Type:         DcpEventMutation,
+			Key:          key,
+			Value:        json.RawMessage(values[key]),
+			CollectionID: 9,
+		})
+	}
+	if err := p.Append(0, events...); err != nil {
+		t.Fatalf("Append(): %v", err)
+	}
+
+	addr, err := p.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	conn, err := mc.Connect("tcp", addr)
+	if err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+
+	outch := make(chan *mc.DcpEvent, 10)
+	supvch := make(chan []interface{}, 10)
+	config := map[string]interface{}{
+		"genChanSize":           16,
+		"dataChanSize":          16,
+		"collectionsAware":      true,
+		"streamId":              true,
+		"snappy":                true,
+		"forceValueCompression": true,
+	}
+	feed, err := mc.NewDcpFeed(conn, "test", outch, 0xab, supvch, config)
+	if err != nil {
+		t.Fatalf("NewDcpFeed(): %v", err)
+	}
+	defer feed.Close()
+
+	if err := feed.DcpOpen("test", 0, 0, 512, 0xab); err != nil {
+		t.Fatalf("DcpOpen(): %v", err)
+	}
+	stats := feed.GetStats().(*mc.DcpStats)
+	if !stats.Snappy.Value() {
+		t.Fatalf("Expected snappy to be enabled by HELO")
+	}
+	if !feed.StreamIds() {
+		t.Fatalf("Expected stream ids to be enabled")
+	}
+
+	flogs, err := feed.DcpGetFailoverLog(0xab, []uint16{0})
+	if err != nil {
+		t.Fatalf("DcpGetFailoverLog(): %v", err)
+	} else if vbuuid, seqno, err := flogs[0].Latest(); err != nil || vbuuid != 1234 || seqno != 0 {
+		t.Fatalf("Unexpected failover log %v, %v", flogs[0], err)
+	}
+
+	// a stream without an id is refused by the feed
+	err = feed.DcpRequestStream(0, 0xab, 0, 1234, 0, n, 0, 0, "", "", []string{"9"})
+	if err == nil {
+		t.Fatalf("Expected DcpRequestStream() without a stream id to fail")
+	}
+
+	err = feed.DcpRequestStreamWithID(0, 0xab, 1, 0, 1234, 0, n, 0, 0, "", "", []string{"9"})
+	if err != nil {
+		t.Fatalf("DcpRequestStreamWithID(): %v", err)
+	}
+	m := expectFeedEvent(t, outch, transport.DCP_STREAMREQ)
+	if m.Status != transport.SUCCESS || m.StreamID != 1 || m.Opaque != 0xab {
+		t.Fatalf("Unexpected stream request %v", m)
+	}
+	expectFeedEvent(t, outch, transport.DCP_SNAPSHOT)
+	for i := 1; i <= n; i++ {
+		m := expectFeedEvent(t, outch, transport.DCP_MUTATION)
+		key := fmt.Sprintf("doc%v", i)
+		if m.Seqno != uint64(i) || string(m.Key) != key || m.CollectionID != 9 || m.StreamID != 1 {
+			t.Fatalf("Unexpected mutation %v", m)
+		}
+		if m.Datatype&dcpDatatypeSnappy != 0 || string(m.Value) != values[key] {
+			t.Fatalf("Expected decompressed value %v, got %s datatype %v",
+				values[key], m.Value, m.Datatype)
+		}
+	}
+	m = expectFeedEvent(t, outch, transport.DCP_STREAMEND)
+	if m.StreamID != 1 {
+		t.Fatalf("Unexpected stream end %v", m)
+	}
+
+	if stats.CompressedBytes.Value() == 0 ||
+		stats.CompressedBytes.Value() >= stats.DecompressedBytes.Value() {
+		t.Fatalf("Expected compressed values, got %v compressed and %v decompressed bytes",
+			stats.CompressedBytes.Value(), stats.DecompressedBytes.Value())
+	}
+
+	// the stream is larger than the buffer, so it completes only if the
+	// feed acknowledges what it received.
+	pstats := p.Stats()
+	if pstats.BufferAcks == 0 || pstats.AckedBytes == 0 {
+		t.Fatalf("Expected buffer acks, got %+v", pstats)
+	}
+	if pstats.StreamRequests != 1 || pstats.EventsSent < n {
+		t.Fatalf("Unexpected producer stats %+v", pstats)
+	}
+}
@@ -0,0 +1,235 @@
+package memcached
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common/collections"
+	"github.com/couchbase/indexing/secondary/dcp/transport"
+)
+
+const testProducerFixture = `
+{"collections": [{"scope_id": 8, "collection_id": 9}],
+ "vbuckets": [
+   {"vbno": 0, "failover_log": [[1234, 0]],
+    "events": [
+      {"type": "mutation", "key": "doc1", "value": {"age": 10}},
+      {"type": "mutation", "key": "doc2", "collection_id": 9, "value": "v"},
+      {"type": "deletion", "key": "doc1"}]},
+   {"vbno": 1}]}`
+
+type testDcpConsumer struct {
+	t    *testing.T
+	conn net.Conn
+}
+
+func newTestDcpConsumer(t *testing.T, p *DcpProducer, features ...byte) *testDcpConsumer {
+	server, client := net.Pipe()
+	go p.Serve(server)
+
+	c := &testDcpConsumer{t: t, conn: client}
+	c.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	var body []byte
+	for _, feature := range features {
+		body = binary.BigEndian.AppendUint16(body, uint16(feature))
+	}
+	c.request(&transport.MCRequest{Opcode: transport.HELO, Body: body}, transport.SUCCESS)
+
+	extras := binary.BigEndian.AppendUint32(nil, 0)
+	extras = binary.BigEndian.AppendUint32(extras, dcpOpenProducer)
+	open := &transport.MCRequest{Opcode: transport.DCP_OPEN, Key: []byte("test"), Extras: extras}
+	c.request(open, transport.SUCCESS)
+	return c
+}
+
+func (c *testDcpConsumer) send(req *transport.MCRequest) {
+	if _, err := req.Transmit(c.conn); err != nil {
+		c.t.Fatalf("Transmit(): %v", err)
+	}
+}
+
+func (c *testDcpConsumer) receive() *transport.MCRequest {
+	pkt, err := ReadPacket(c.conn)
+	if err != nil {
+		c.t.Fatalf("ReadPacket(): %v", err)
+	}
+	return &pkt
+}
+
+// request returns the response to a request, with its status checked
+func (c *testDcpConsumer) request(req *transport.MCRequest, status transport.Status) *transport.MCRequest {
+	c.send(req)
+	res := c.receive()
+	if res.Opcode != req.Opcode || transport.Status(res.VBucket) != status {
+		c.t.Fatalf("Expected %v response with status %v, got %v status %v",
+			req.Opcode, status, res.Opcode, transport.Status(res.VBucket))
+	}
+	return res
+}
+
+func (c *testDcpConsumer) streamRequest(vbno uint16, vbuuid, start, end uint64,
+	filter string, status transport.Status) *transport.MCRequest {
+
+	extras := make([]byte, 48)
+	binary.BigEndian.PutUint64(extras[8:], start)
+	binary.BigEndian.PutUint64(extras[16:], end)
+	binary.BigEndian.PutUint64(extras[24:], vbuuid)
+	binary.BigEndian.PutUint64(extras[32:], start)
+	binary.BigEndian.PutUint64(extras[40:], start)
+	req := &transport.MCRequest{
+		Opcode:  transport.DCP_STREAMREQ,
+		VBucket: vbno,
+		Opaque:  uint32(vbno),
+		Extras:  extras,
+		Body:    []byte(filter),
+	}
+	return c.request(req, status)
+}
+
+func (c *testDcpConsumer) expect(opcode transport.CommandCode, seqno uint64) *transport.MCRequest {
+	pkt := c.receive()
+	if pkt.Opcode != opcode {
+		c.t.Fatalf("Expected %v, got %v", opcode, pkt.Opcode)
+	}
+	if seqno != 0 && binary.BigEndian.Uint64(pkt.Extras) != seqno {
+		c.t.Fatalf("Expected %v at seqno %v, got %v", opcode, seqno, binary.BigEndian.Uint64(pkt.Extras))
+	}
+	return pkt
+}
+
+func TestDcpProducerStream(t *testing.T) {
+	p, err := NewDcpProducerFromFixture(strings.NewReader(testProducerFixture))
+	if err != nil {
+		t.Fatalf("NewDcpProducerFromFixture(): %v", err)
+	}
+	defer p.Close()
+
+	c := newTestDcpConsumer(t, p, transport.FEATURE_COLLECTIONS)
+
+	res := c.streamRequest(0, 1234, 0, 4, "", transport.SUCCESS)
+	if len(res.Body) != 16 || binary.BigEndian.Uint64(res.Body) != 1234 {
+		t.Fatalf("Unexpected failover log %v", res.Body)
+	}
+
+	snap := c.expect(transport.DCP_SNAPSHOT, 1)
+	if end := binary.BigEndian.Uint64(snap.Extras[8:]); end != 3 {
+		t.Fatalf("Expected snapshot end 3, got %v", end)
+	}
+	mut := c.expect(transport.DCP_MUTATION, 1)
+	if string(mut.Body) != `{"age": 10}` || mut.Datatype != dcpDatatypeJSON {
+		t.Fatalf("Unexpected mutation value %s datatype %v", mut.Body, mut.Datatype)
+	}
+	mut = c.expect(transport.DCP_MUTATION, 2)
+	if key, cid := collections.LEB128Dec(mut.Key); string(key) != "doc2" || cid != 9 {
+		t.Fatalf("Unexpected key %s collection %v", key, cid)
+	}
+	c.expect(transport.DCP_DELETION, 3)
+
+	// streams wait for new events
+	if err := p.Append(0, &DcpProducerEvent{Type: DcpEventExpiration, Key: "doc2"}); err != nil {
+		t.Fatalf("Append(): %v", err)
+	}
+	c.expect(transport.DCP_SNAPSHOT, 4)
+	c.expect(transport.DCP_EXPIRATION, 4)
+	c.expect(transport.DCP_STREAMEND, 0)
+
+	if stats := p.Stats(); stats.StreamRequests != 1 || stats.StreamEnds != 1 || stats.EventsSent != 7 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestDcpProducerRollback(t *testing.T) {
+	p, err := NewDcpProducerFromFixture(strings.NewReader(testProducerFixture))
+	if err != nil {
+		t.Fatalf("NewDcpProducerFromFixture(): %v", err)
+	}
+	defer p.Close()
+
+	c := newTestDcpConsumer(t, p, transport.FEATURE_COLLECTIONS)
+
+	res := c.streamRequest(0, 4321, 2, math.MaxUint64, "", transport.ROLLBACK)
+	if seqno := binary.BigEndian.Uint64(res.Body); seqno != 0 {
+		t.Fatalf("Expected rollback to 0, got %v", seqno)
+	}
+
+	// a failover at seqno 3 makes streams of the old branch beyond it roll back
+	p.Failover(0, 5678)
+	p.Append(0, &DcpProducerEvent{Type: DcpEventMutation, Key: "doc3"})
+	res = c.streamRequest(0, 1234, 4, math.MaxUint64, "", transport.ROLLBACK)
+	if seqno := binary.BigEndian.Uint64(res.Body); seqno != 3 {
+		t.Fatalf("Expected rollback to 3, got %v", seqno)
+	}
+
+	res = c.streamRequest(0, 5678, 3, math.MaxUint64, "", transport.SUCCESS)
+	if len(res.Body) != 32 {
+		t.Fatalf("Expected 2 failover log entries, got %v", res.Body)
+	}
+	c.expect(transport.DCP_SNAPSHOT, 4)
+	c.expect(transport.DCP_MUTATION, 4)
+}
+
+func TestDcpProducerFilter(t *testing.T) {
+	p, err := NewDcpProducerFromFixture(strings.NewReader(testProducerFixture))
+	if err != nil {
+		t.Fatalf("NewDcpProducerFromFixture(): %v", err)
+	}
+	defer p.Close()
+
+	c := newTestDcpConsumer(t, p, transport.FEATURE_COLLECTIONS)
+
+	c.streamRequest(0, 1234, 0, math.MaxUint64, `{"collections": ["a"]}`, transport.UNKNOWN_COLLECTION)
+
+	c.streamRequest(0, 1234, 0, math.MaxUint64, `{"collections": ["9"]}`, transport.SUCCESS)
+	c.expect(transport.DCP_SNAPSHOT, 1)
+	c.expect(transport.DCP_MUTATION, 2)
+	c.expect(transport.DCP_SEQNO_ADVANCED, 3)
+
+	close := &transport.MCRequest{Opcode: transport.DCP_CLOSESTREAM, VBucket: 0}
+	c.request(close, transport.SUCCESS)
+	c.request(close, transport.KEY_ENOENT)
+}
+
+func TestDcpProducerStreamIds(t *testing.T) {
+	p, err := NewDcpProducerFromFixture(strings.NewReader(testProducerFixture))
+	if err != nil {
+		t.Fatalf("NewDcpProducerFromFixture(): %v", err)
+	}
+	defer p.Close()
+
+	c := newTestDcpConsumer(t, p, transport.FEATURE_COLLECTIONS)
+	control := &transport.MCRequest{
+		Opcode: transport.DCP_CONTROL, Key: []byte("enable_stream_id"), Body: []byte("true"),
+	}
+	c.request(control, transport.SUCCESS)
+
+	// streams must have an id, and may share a vbucket with other ids
+	c.streamRequest(0, 1234, 0, 3, "", transport.EINVAL)
+	c.streamRequest(0, 1234, 0, 3, `{"collections": ["9"], "sid": 1}`, transport.SUCCESS)
+	for _, opcode := range []transport.CommandCode{
+		transport.DCP_SNAPSHOT, transport.DCP_MUTATION, transport.DCP_SEQNO_ADVANCED,
+		transport.DCP_STREAMEND} {
+
+		if sid, ok := c.expect(opcode, 0).StreamID(); !ok || sid != 1 {
+			t.Fatalf("Expected %v of stream 1, got %v %v", opcode, sid, ok)
+		}
+	}
+
+	c.streamRequest(0, 1234, 0, math.MaxUint64, `{"collections": ["0"], "sid": 2}`, transport.SUCCESS)
+	c.expect(transport.DCP_SNAPSHOT, 1)
+	c.expect(transport.DCP_MUTATION, 1)
+	c.expect(transport.DCP_DELETION, 3)
+	c.streamRequest(0, 1234, 0, math.MaxUint64, `{"collections": ["0"], "sid": 2}`, transport.KEY_EEXISTS)
+
+	close := &transport.MCRequest{
+		Opcode:        transport.DCP_CLOSESTREAM,
+		VBucket:       0,
+		FramingExtras: transport.StreamIDFrame(2),
+	}
+	c.request(close, transport.SUCCESS)
+	c.request(close, transport.KEY_ENOENT)
+}
@@ -202,6 +202,19 @@ func (feed *DcpFeed) DcpRequestStream(
 	vbuuid, startSequence, endSequence, snapStart, snapEnd uint64,
 	manifestUID, scopeId string, collectionIds []string) error {
 
+	return feed.DcpRequestStreamWithID(
+		vb, opaque, 0, flags, vbuuid, startSequence, endSequence,
+		snapStart, snapEnd, manifestUID, scopeId, collectionIds)
+}
+
+// DcpRequestStreamWithID requests a stream for a vb with a stream id, on a
+// feed started with "streamId" config. Several streams, each with its own
+// id and collection filter, can then be open for the same vb.
+func (feed *DcpFeed) DcpRequestStreamWithID(
+	vb uint16, opaque, streamId uint16, flags uint32,
+	vbuuid, startSequence, endSequence, snapStart, snapEnd uint64,
+	manifestUID, scopeId string, collectionIds []string) error {
+
 	// only request active vbucket
 	if feed.activeVbOnly {
 		flags = flags | DCP_ADD_STREAM_ACTIVE_VB_ONLY
@@ -212,7 +225,7 @@ func (feed *DcpFeed) DcpRequestStream(
 		ufCmdRequestStream, vb, opaque, flags, vbuuid, startSequence,
 		endSequence, snapStart, snapEnd,
 		manifestUID, scopeId, collectionIds,
-		respch}
+		streamId, respch}
 	resp, err := failsafeOp(feed.reqch, respch, cmd, feed.finch)
 	return opError(err, resp, 0)
 }
@@ -221,8 +234,13 @@ func (feed *DcpFeed) DcpRequestStream(
 // and immediately returns, it is upto the channel listener
 // to detect StreamEnd.
 func (feed *DcpFeed) DcpCloseStream(vb, opaqueMSB uint16) error {
+	return feed.DcpCloseStreamWithID(vb, opaqueMSB, 0)
+}
+
+// DcpCloseStreamWithID closes the stream of a vb with a stream id.
+func (feed *DcpFeed) DcpCloseStreamWithID(vb, opaqueMSB, streamId uint16) error {
 	respch := make(chan []interface{}, 1)
-	cmd := []interface{}{ufCmdCloseStream, vb, opaqueMSB, respch}
+	cmd := []interface{}{ufCmdCloseStream, vb, opaqueMSB, streamId, respch}
 	resp, err := failsafeOp(feed.reqch, respch, cmd, feed.finch)
 	return opError(err, resp, 0)
 }
@@ -301,18 +319,20 @@ loop:
 					manifestUID := msg[9].(string)
 					scopeId := msg[10].(string)
 					collectionIds := msg[11].([]string)
+					streamId := msg[12].(uint16)
 
 					err := feed.dcpRequestStream(
-						vb, opaque, flags, vbuuid, startSeq, endSeq,
+						vb, opaque, streamId, flags, vbuuid, startSeq, endSeq,
 						snapStart, snapEnd,
 						manifestUID, scopeId, collectionIds)
-					respch := msg[12].(chan []interface{})
+					respch := msg[13].(chan []interface{})
 					respch <- []interface{}{err}
 
 				case ufCmdCloseStream:
 					vb, opaqueMSB := msg[1].(uint16), msg[2].(uint16)
-					err := feed.dcpCloseStream(vb, opaqueMSB)
-					respch := msg[3].(chan []interface{})
+					streamId := msg[3].(uint16)
+					err := feed.dcpCloseStream(vb, opaqueMSB, streamId)
+					respch := msg[4].(chan []interface{})
 					respch <- []interface{}{err}
 
 				case ufCmdGetSeqnos:
@@ -392,7 +412,7 @@ func (feed *DcpFeed) connectToNodes(
 			}
 			// add the node to the connection map
 			feedInfo := &FeedInfo{
-				vbnos:   make([]uint16, 0),
+				streams: make([]uint32, 0),
 				dcpFeed: singleFeed,
 				host:    serverConn.host,
 			}
@@ -433,7 +453,7 @@ func (feed *DcpFeed) reConnectToNodes(
 			}
 			// add the node to the connection map
 			feedInfo := &FeedInfo{
-				vbnos:   make([]uint16, 0),
+				streams: make([]uint32, 0),
 				dcpFeed: singleFeed,
 				host:    serverConn.host,
 			}
@@ -443,7 +463,7 @@ func (feed *DcpFeed) reConnectToNodes(
 }
 
 func (feed *DcpFeed) dcpRequestStream(
-	vb uint16, opaque uint16, flags uint32,
+	vb uint16, opaque, streamId uint16, flags uint32,
 	vbuuid, startSequence, endSequence, snapStart, snapEnd uint64,
 	manifestUID, scopeId string, collectionIds []string) error {
 
@@ -479,8 +499,8 @@ func (feed *DcpFeed) dcpRequestStream(
 			logging.Errorf(fmsg, prefix, opaque, master, vb)
 			return memcached.ErrorInvalidFeed
 		}
-		err = singleFeed.dcpFeed.DcpRequestStream(
-			vb, opaque, flags, vbuuid, startSequence, endSequence,
+		err = singleFeed.dcpFeed.DcpRequestStreamWithID(
+			vb, opaque, streamId, flags, vbuuid, startSequence, endSequence,
 			snapStart, snapEnd,
 			manifestUID, scopeId, collectionIds)
 		if err != nil {
@@ -489,13 +509,13 @@ func (feed *DcpFeed) dcpRequestStream(
 			feed.nodeFeeds[master] = purgeFeed(feed.nodeFeeds[master], singleFeed)
 			continue
 		}
-		singleFeed.vbnos = append(singleFeed.vbnos, vb)
+		singleFeed.streams = append(singleFeed.streams, streamKey(vb, streamId))
 		break
 	}
 	return err
 }
 
-func (feed *DcpFeed) dcpCloseStream(vb, opaqueMSB uint16) error {
+func (feed *DcpFeed) dcpCloseStream(vb, opaqueMSB, streamId uint16) error {
 	prefix := feed.logPrefix
 	vbm := feed.bucket.VBServerMap()
 	if l := len(vbm.VBucketMap); int(vb) >= l {
@@ -511,18 +531,18 @@ func (feed *DcpFeed) dcpCloseStream(vb, opaqueMSB uint16) error {
 		logging.Errorf(fmsg, prefix, opaqueMSB, vb)
 		return ErrorInvalidVbucket
 	}
-	singleFeed, err := feed.getSingleFeed(master, vb, prefix, opaqueMSB)
+	singleFeed, err := feed.getSingleFeed(master, vb, streamId, prefix, opaqueMSB)
 	if err != nil {
 		return err
 	}
-	if err := singleFeed.dcpFeed.CloseStream(vb, opaqueMSB); err != nil {
+	if err := singleFeed.dcpFeed.CloseStreamWithID(vb, opaqueMSB, streamId); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (feed *DcpFeed) getSingleFeed(master string, vb uint16, prefix string, opaqueMSB uint16) (*FeedInfo, error) {
-	singleFeed, ok := removefromfeed(feed.nodeFeeds[master], vb)
+func (feed *DcpFeed) getSingleFeed(master string, vb, streamId uint16, prefix string, opaqueMSB uint16) (*FeedInfo, error) {
+	singleFeed, ok := removefromfeed(feed.nodeFeeds[master], vb, streamId)
 
 	if !ok {
 		// In case where a node gets added with localhost address first
@@ -549,7 +569,7 @@ func (feed *DcpFeed) getSingleFeed(master string, vb uint16, prefix string, opaq
 			fmsg := "%v ##%x notFound DcpFeed host: %q vb:%d, trying with kvaddrs: %v"
 			logging.Warnf(fmsg, prefix, opaqueMSB, master, vb, feed.kvaddrs[0])
 			// Trying with local address. kvaddrs[0] is the local kv address
-			singleFeed, ok = removefromfeed(feed.nodeFeeds[feed.kvaddrs[0]], vb)
+			singleFeed, ok = removefromfeed(feed.nodeFeeds[feed.kvaddrs[0]], vb, streamId)
 			if !ok {
 				fmsg := "%v ##%x notFound DcpFeed host: %q vb:%d with kvaddrs: %v"
 				logging.Errorf(fmsg, prefix, opaqueMSB, master, vb, feed.kvaddrs[0])
@@ -695,7 +715,7 @@ func addtofeed(nodeFeeds []*FeedInfo) (*FeedInfo, bool) {
 			continue
 		} else if feedinfo == nil {
 			feedinfo = fi
-		} else if len(fi.vbnos) < len(feedinfo.vbnos) {
+		} else if len(fi.streams) < len(feedinfo.streams) {
 			feedinfo = fi
 		}
 	}
@@ -704,19 +724,20 @@ func addtofeed(nodeFeeds []*FeedInfo) (*FeedInfo, bool) {
 	return feedinfo, (feedinfo != nil)
 }
 
-func removefromfeed(nodeFeeds []*FeedInfo, forvb uint16) (*FeedInfo, bool) {
+func removefromfeed(nodeFeeds []*FeedInfo, forvb, streamId uint16) (*FeedInfo, bool) {
 	if len(nodeFeeds) == 0 {
 		return nil, false
 	}
+	key := streamKey(forvb, streamId)
 	for _, singleFeed := range nodeFeeds {
 		if singleFeed == nil {
 			continue
 		}
-		for i, vbno := range singleFeed.vbnos {
-			if vbno == forvb {
-				copy(singleFeed.vbnos[i:], singleFeed.vbnos[i+1:])
-				n := len(singleFeed.vbnos) - 1
-				singleFeed.vbnos = singleFeed.vbnos[:n]
+		for i, stream := range singleFeed.streams {
+			if stream == key {
+				copy(singleFeed.streams[i:], singleFeed.streams[i+1:])
+				n := len(singleFeed.streams) - 1
+				singleFeed.streams = singleFeed.streams[:n]
 				return singleFeed, true
 			}
 		}
@@ -738,14 +759,14 @@ func purgeFeed(nodeFeeds []*FeedInfo, singleFeed *FeedInfo) []*FeedInfo {
 
 func (feed *DcpFeed) cleanupVb(msg []interface{}) {
 	dcpFeed := msg[1].(*memcached.DcpFeed)
-	forvb := msg[2].(uint16)
+	forvb, streamId := msg[2].(uint16), msg[3].(uint16)
 	// Delete the vb corresponding to the node feed
 	found := false
 outerloop:
 	for _, nodeFeeds := range feed.nodeFeeds {
 		for _, singleFeed := range nodeFeeds {
 			if singleFeed != nil && singleFeed.dcpFeed.Name() == dcpFeed.Name() {
-				_, found = removefromfeed(nodeFeeds, forvb)
+				_, found = removefromfeed(nodeFeeds, forvb, streamId)
 				break outerloop
 			}
 		}
@@ -790,12 +811,16 @@ func opError(err error, vals []interface{}, idx int) error {
 
 // FeedInfo is dcp-feed from a single connection.
 type FeedInfo struct {
-	vbnos   []uint16
+	streams []uint32           // vbno, with the stream id if any in the upper half
 	dcpFeed *memcached.DcpFeed // DCP feed handle
 	host    string             // hostname
 	mu      sync.Mutex         // protects the following field.
 }
 
+func streamKey(vbno, streamId uint16) uint32 {
+	return (uint32(streamId) << 16) | uint32(vbno)
+}
+
 func copyconfig(config map[string]interface{}) map[string]interface{} {
 	nconfig := make(map[string]interface{})
 	for k, v := range config {
@@ -9,6 +9,7 @@ package forestdb
 //  the file licenses/APL2.txt.
 
 //#cgo CFLAGS: -O0
+//#include <string.h>
 //#include <libforestdb/forestdb.h>
 import "C"
 
@@ -206,6 +207,17 @@ func (c *Config) SetBlockReuseThreshold(s uint8) {
 	c.config.block_reusing_threshold = C.size_t(s)
 }
 
+// SetEncryptionKey sets the AES-256 key the database file is encrypted
+// with. A nil key disables encryption.
+func (c *Config) SetEncryptionKey(key []byte) {
+	if key == nil {
+		c.config.encryption_key.algorithm = C.FDB_ENCRYPTION_NONE
+		return
+	}
+	c.config.encryption_key.algorithm = C.FDB_ENCRYPTION_AES256
+	C.memcpy(unsafe.Pointer(&c.config.encryption_key.bytes[0]), unsafe.Pointer(&key[0]), C.size_t(len(c.config.encryption_key.bytes)))
+}
+
 // DefaultConfig gets the default ForestDB config
 func DefaultConfig() *Config {
 	Log.Tracef("fdb_get_default_config call")
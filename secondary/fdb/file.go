@@ -11,6 +11,7 @@ package forestdb
 //#cgo LDFLAGS: -lforestdb
 //#cgo CFLAGS: -O0
 //#include <stdlib.h>
+//#include <string.h>
 //#include <libforestdb/forestdb.h>
 import "C"
 
@@ -122,6 +123,24 @@ func (f *File) CompactUpto(newfilename string, sm *SnapMarker) error {
 	return nil
 }
 
+// Rekey re-encrypts the database file with a new AES-256 key
+func (f *File) Rekey(key []byte) error {
+	f.Lock()
+	defer f.Unlock()
+
+	var newKey C.fdb_encryption_key
+	newKey.algorithm = C.FDB_ENCRYPTION_AES256
+	C.memcpy(unsafe.Pointer(&newKey.bytes[0]), unsafe.Pointer(&key[0]), C.size_t(len(newKey.bytes)))
+
+	Log.Tracef("fdb_rekey call f:%p dbfile:%v", f, f.dbfile)
+	errNo := C.fdb_rekey(f.dbfile, newKey)
+	Log.Tracef("fdb_rekey retn f:%p errNo:%v", f, errNo)
+	if errNo != RESULT_SUCCESS {
+		return Error(errNo)
+	}
+	return nil
+}
+
 //CancelCompact cancels in-progress compaction
 func (f *File) CancelCompact() error {
 	f.Lock()
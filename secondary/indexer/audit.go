@@ -0,0 +1,81 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/cbauth"
+	"github.com/couchbase/indexing/secondary/audit"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// updateAuditFilter sets the audit event ids and users that are not
+// audited if they changed in newConfig. oldConfig is nil on startup.
+func updateAuditFilter(oldConfig, newConfig common.Config) {
+
+	events := newConfig["settings.audit.disabled_events"].String()
+	users := newConfig["settings.audit.disabled_users"].String()
+	if oldConfig != nil &&
+		events == oldConfig["settings.audit.disabled_events"].String() &&
+		users == oldConfig["settings.audit.disabled_users"].String() {
+		return
+	}
+
+	var disabledEvents []uint32
+	for _, event := range splitAuditList(events) {
+		eventId, err := strconv.ParseUint(event, 10, 32)
+		if err != nil {
+			logging.Errorf("Indexer::updateAuditFilter invalid audit event id %v in "+
+				"indexer.settings.audit.disabled_events, ignored", event)
+			continue
+		}
+		disabledEvents = append(disabledEvents, uint32(eventId))
+	}
+	disabledUsers := splitAuditList(users)
+
+	if oldConfig != nil || len(disabledEvents) != 0 || len(disabledUsers) != 0 {
+		logging.Infof("Indexer::updateAuditFilter disabled audit events %v, disabled audit users %v",
+			disabledEvents, logging.TagUD(disabledUsers))
+	}
+	audit.SetFilter(disabledEvents, disabledUsers)
+}
+
+func splitAuditList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// auditDDL audits a DDL request r for the index defn made by the user of
+// creds. err is the outcome of the request, nil if it succeeded.
+func auditDDL(eventId uint32, r *http.Request, method string, creds cbauth.Creds,
+	defn *common.IndexDefn, err error) {
+
+	fields := &audit.AuditFields{
+		Bucket:     defn.Bucket,
+		Scope:      defn.Scope,
+		Collection: defn.Collection,
+		Index:      defn.Name,
+	}
+	if creds != nil {
+		fields.User = creds.Name()
+	}
+	if err != nil {
+		fields.Message = err.Error()
+	}
+	audit.AuditWithFields(eventId, r, method, fields)
+}
@@ -0,0 +1,46 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/audit"
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func TestUpdateAuditFilter(t *testing.T) {
+	defer audit.SetFilter(nil, nil)
+
+	// scans are not audited by default
+	config := common.SystemConfig.SectionConfig("indexer.", true)
+	updateAuditFilter(nil, config)
+	if !audit.IsFiltered(common.AUDIT_INDEX_SCAN, "user1") {
+		t.Errorf("expected scan events to be filtered by default")
+	}
+	if audit.IsFiltered(common.AUDIT_CREATE_INDEX, "user1") {
+		t.Errorf("expected create index events to be audited by default")
+	}
+
+	newConfig := config.Clone()
+	newConfig.SetValue("settings.audit.disabled_events", " 49155, bad,")
+	newConfig.SetValue("settings.audit.disabled_users", "user2 ,")
+	updateAuditFilter(config, newConfig)
+	if audit.IsFiltered(common.AUDIT_INDEX_SCAN, "user1") {
+		t.Errorf("expected scan events to be audited once enabled")
+	}
+	if !audit.IsFiltered(common.AUDIT_DROP_INDEX, "user1") ||
+		!audit.IsFiltered(common.AUDIT_CREATE_INDEX, "user2") {
+		t.Errorf("expected drop index events and user2 to be filtered")
+	}
+
+	if items := splitAuditList(" a,, b ,"); len(items) != 2 || items[0] != "a" || items[1] != "b" {
+		t.Errorf("splitAuditList unexpected result %q", items)
+	}
+}
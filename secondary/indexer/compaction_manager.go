@@ -9,8 +9,10 @@
 package indexer
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"net/http"
 	"sort"
 	"strings"
 	"sync"
@@ -26,6 +28,7 @@ const (
 )
 
 type CompactionManager interface {
+	RegisterRestEndpoints()
 }
 
 type compactionManager struct {
@@ -33,6 +36,7 @@ type compactionManager struct {
 	config    common.Config
 	supvMsgCh MsgChannel
 	supvCmdCh MsgChannel
+	cd        *compactionDaemon
 }
 
 type compactionDaemon struct {
@@ -48,6 +52,14 @@ type compactionDaemon struct {
 	clusterAddr  string
 	lastCheckDay int32
 	mutex        sync.Mutex
+
+	// compaction scheduler
+	policies       []*compactionPolicy
+	admission      compactionAdmission
+	pending        []*compactionTask
+	running        map[string]*compactionTask
+	completed      []*compactionTask
+	compactedToday map[string]bool
 }
 
 type indexCompaction struct {
@@ -83,6 +95,8 @@ func (cd *compactionDaemon) ResetConfig(c common.Config) {
 	last_config := cd.config.Load()
 	cd.config.Store(c)
 
+	cd.resetSchedulerConfig(c)
+
 	// Auto-compaction settings are unnecessary for plasma and memory optimized
 	// indexes. Ignore the auto-compaction settings for these storage modes
 	if common.GetStorageMode() != common.FORESTDB {
@@ -114,8 +128,22 @@ func (cd *compactionDaemon) ResetConfig(c common.Config) {
 	}
 }
 
+func (cd *compactionDaemon) resetSchedulerConfig(c common.Config) {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	policies, err := parseCompactionPolicies(c["policies"].String())
+	if err != nil {
+		logging.Errorf("CompactionDaemon: Ignoring compaction policies. Error=%v", err)
+	}
+	cd.policies = policies
+
+	// allow unused admission to accumulate for at most one check period
+	burst := time.Second * time.Duration(c["check_period"].Int())
+	cd.admission.setRate(c["admission_rate"].Int(), burst)
+}
+
 func (cd *compactionDaemon) loop() {
-	hasStartedToday := false
 
 loop:
 	for {
@@ -125,7 +153,7 @@ loop:
 			if stats := cd.stats.Get(); stats != nil && stats.indexerState.Value() != int64(common.INDEXER_BOOTSTRAP) {
 				if common.GetStorageMode() == common.FORESTDB {
 					if ok {
-						hasStartedToday = cd.compactFDB(hasStartedToday)
+						cd.compactFDB()
 					}
 				} else if common.GetStorageMode() == common.PLASMA {
 					if ok {
@@ -276,12 +304,18 @@ func (cd *compactionDaemon) needsCompaction(is IndexStorageStats, config common.
 	return false
 }
 
-func (cd *compactionDaemon) compactFDB(hasStartedToday bool) bool {
+//
+// Queue forestdb index partitions that need compaction according to the compaction
+// policy of the index, then run queued compactions one at a time, as long as the
+// admission rate allows it.   Compactions that are not admitted remain queued
+// until the next check.
+//
+// In circular mode, each index partition is compacted at most once a day.
+//
+func (cd *compactionDaemon) compactFDB() {
 
 	var stats []IndexStorageStats
 
-	conf := cd.config.Load()
-
 	replych := make(chan []IndexStorageStats)
 	statReq := &MsgIndexStorageStats{respch: replych}
 	cd.msgch <- statReq
@@ -291,53 +325,88 @@ func (cd *compactionDaemon) compactFDB(hasStartedToday bool) bool {
 	abortTime := time.Now().Add(time.Duration(24) * time.Hour)
 	checkTime := time.Now()
 
-	mode := strings.ToLower(conf["compaction_mode"].String())
-	if mode == "circular" {
-		// if circular compaction, run full compaction at most once a day.
-		if atomic.LoadInt32(&cd.lastCheckDay) != int32(checkTime.Weekday()) {
-			hasStartedToday = false
-			atomic.StoreInt32(&cd.lastCheckDay, int32(checkTime.Weekday()))
-		}
+	cd.mutex.Lock()
 
-		if hasStartedToday {
-			return true
-		}
+	if atomic.LoadInt32(&cd.lastCheckDay) != int32(checkTime.Weekday()) {
+		cd.compactedToday = make(map[string]bool)
+		atomic.StoreInt32(&cd.lastCheckDay, int32(checkTime.Weekday()))
 	}
 
 	for _, is := range stats {
-		conf = cd.config.Load() // refresh to get up-to-date settings
+		is := is
+		name := indexCompactionName(is.InstId, is.PartnId)
+		if cd.isIndexCompactingNoLock(is.InstId, is.PartnId) {
+			continue
+		}
+
+		policy := cd.getPolicyNoLock(is.Bucket, is.Scope, is.Collection, is.Name)
 		needUpgrade := is.Stats.NeedUpgrade
+		if !needUpgrade && policy.isDisabled() {
+			continue
+		}
+
+		conf := policy.apply(cd.config.Load())
+		circular := strings.ToLower(conf["compaction_mode"].String()) == "circular"
+		if !needUpgrade && circular && cd.compactedToday[name] {
+			continue
+		}
+
 		if needUpgrade || cd.needsCompaction(is, conf, checkTime, abortTime) {
-			hasStartedToday = true
-
-			errch := make(chan error)
-			compactReq := &MsgIndexCompact{
-				instId:    is.InstId,
-				partnId:   is.PartnId,
-				errch:     errch,
-				abortTime: abortTime,
-			}
-			logging.Infof("CompactionDaemon: Compacting index instance:%v", is.InstId)
+			reason := COMPACTION_MANDATORY
 			if needUpgrade {
-				common.Console(cd.clusterAddr, "Compacting index %v.%v for upgrade", is.Bucket, is.Name)
+				reason = COMPACTION_UPGRADE
+			} else if circular {
+				reason = COMPACTION_SCHEDULED
+				cd.compactedToday[name] = true
 			}
-			cd.msgch <- compactReq
-			err := <-errch
-			if err == nil {
-				logging.Infof("CompactionDaemon: Finished compacting index instance:%v", is.InstId)
-				if needUpgrade {
-					common.Console(cd.clusterAddr, "Finished compacting index %v.%v for upgrade", is.Bucket, is.Name)
-				}
-			} else {
-				logging.Errorf("CompactionDaemon: Index instance:%v Compaction failed with reason - %v", is.InstId, err)
-				if needUpgrade {
-					common.Console(cd.clusterAddr, "Compaction for index %v.%v failed with reason - %v", is.Bucket, is.Name, err)
+
+			task := newCompactionTask(is.InstId, is.PartnId, is.Bucket, is.Scope, is.Collection, is.Name, policy, reason)
+			task.Fragmentation = int64(is.GetFragmentation())
+			task.DiskSizeBefore = is.Stats.DiskSize
+			task.abortTime = abortTime
+			if !needUpgrade {
+				task.recheck = func() bool {
+					return cd.needsCompaction(is, conf, checkTime, abortTime)
 				}
 			}
+
+			cd.addIndexCompactionNoLock(is.InstId, is.PartnId, nil)
+			cd.enqueueNoLock([]*compactionTask{task})
 		}
 	}
 
-	return hasStartedToday
+	cd.mutex.Unlock()
+
+	// forestdb compactions are run sequentially
+	for {
+		cd.mutex.Lock()
+		tasks := cd.dispatchNoLock(1)
+		cd.mutex.Unlock()
+
+		if len(tasks) == 0 {
+			break
+		}
+
+		task := tasks[0]
+		logging.Infof("CompactionDaemon: Compacting index instance:%v", task.InstId)
+		if task.Reason == COMPACTION_UPGRADE {
+			common.Console(cd.clusterAddr, "Compacting index %v.%v for upgrade", task.Bucket, task.Name)
+		}
+
+		err := cd.runCompaction(task)
+
+		if err == nil {
+			logging.Infof("CompactionDaemon: Finished compacting index instance:%v", task.InstId)
+			if task.Reason == COMPACTION_UPGRADE {
+				common.Console(cd.clusterAddr, "Finished compacting index %v.%v for upgrade", task.Bucket, task.Name)
+			}
+		} else {
+			logging.Errorf("CompactionDaemon: Index instance:%v Compaction failed with reason - %v", task.InstId, err)
+			if task.Reason == COMPACTION_UPGRADE {
+				common.Console(cd.clusterAddr, "Compaction for index %v.%v failed with reason - %v", task.Bucket, task.Name, err)
+			}
+		}
+	}
 }
 
 //////////////////////////////////////////////////////////////////
@@ -373,10 +442,10 @@ func (cd *compactionDaemon) compactPlasma() {
 	cd.mutex.Lock()
 	defer cd.mutex.Unlock()
 
-	msgs := cd.addMandatory()
-	msgs = append(msgs, cd.addOptional()...)
-	for _, msg := range msgs {
-		go cd.runCompaction(msg)
+	cd.enqueueNoLock(cd.addMandatory())
+	cd.enqueueNoLock(cd.addOptional())
+	for _, task := range cd.dispatchNoLock(0) {
+		go cd.runCompaction(task)
 	}
 }
 
@@ -392,15 +461,24 @@ func (cd *compactionDaemon) compactPlasma() {
 // partition with high frag ratio.   Since IO bandwdith is fixed, it will take more take
 // to compact the large partition.
 //
-func (cd *compactionDaemon) addMandatory() []*MsgIndexCompact {
+// The fragmentation threshold is taken from the compaction policy of the index,
+// if any.
+//
+func (cd *compactionDaemon) addMandatory() []*compactionTask {
 
-	var compactMsgs []*MsgIndexCompact
+	var tasks []*compactionTask
 
 	config := cd.config.Load()
-	threshold := config["min_frag"].Int()
 	stats := cd.stats.Get()
 
 	for _, inst := range cd.indexInstMap {
+		defn := inst.Defn
+		policy := cd.getPolicyNoLock(defn.Bucket, defn.Scope, defn.Collection, defn.Name)
+		if policy.isDisabled() {
+			continue
+		}
+		threshold := policy.apply(config)["min_frag"].Int()
+
 		for _, partn := range inst.Pc.GetAllPartitions() {
 			partnStats := stats.GetPartitionStats(inst.InstId, partn.GetPartitionId())
 
@@ -414,13 +492,18 @@ func (cd *compactionDaemon) addMandatory() []*MsgIndexCompact {
 				if cd.addIndexCompactionNoLock(inst.InstId, partn.GetPartitionId(), partnStats) {
 					logging.Infof("CompactionDaemon: mandatory compaction: inst %v partition %v fragmentation %v over threshod %v.",
 						inst.InstId, partn.GetPartitionId(), partnStats.fragPercent.Value(), threshold)
-					compactMsgs = append(compactMsgs, newMsgIndexCompact(inst.InstId, partn.GetPartitionId(), threshold))
+					task := newCompactionTask(inst.InstId, partn.GetPartitionId(),
+						defn.Bucket, defn.Scope, defn.Collection, defn.Name, policy, COMPACTION_MANDATORY)
+					task.Fragmentation = partnStats.fragPercent.Value()
+					task.DiskSizeBefore = partnStats.diskSize.Value()
+					task.minFrag = threshold
+					tasks = append(tasks, task)
 				}
 			}
 		}
 	}
 
-	return compactMsgs
+	return tasks
 }
 
 //
@@ -443,9 +526,9 @@ func (cd *compactionDaemon) addMandatory() []*MsgIndexCompact {
 // The partition index may seldom gets compacted under mandatory compaction.   Optional compaction will
 // allow those large partitions to have a chance to clean its garbage more often.
 //
-func (cd *compactionDaemon) addOptional() []*MsgIndexCompact {
+func (cd *compactionDaemon) addOptional() []*compactionTask {
 
-	var compactMsgs []*MsgIndexCompact
+	var tasks []*compactionTask
 
 	// Config paramaters:
 	// 1) Quota - the number of index under compaction.  If the number is under quota,
@@ -454,7 +537,6 @@ func (cd *compactionDaemon) addOptional() []*MsgIndexCompact {
 	// 3) decrement - Percentage of fragementation to be reduced for optional compaction.
 	//
 	config := cd.config.Load()
-	threshold := config["min_frag"].Int()
 	optionalQuota := config["plasma.optional.quota"].Int()
 	optionalThreshold := config["plasma.optional.min_frag"].Int()
 	optionalDecr := config["plasma.optional.decrement"].Int()
@@ -465,7 +547,7 @@ func (cd *compactionDaemon) addOptional() []*MsgIndexCompact {
 	//
 	allowance := int(math.Ceil(float64(cd.numInstancesNoLock())*float64(optionalQuota)/100.0)) - cd.numCompactionsNoLock()
 	if allowance <= 0 {
-		return compactMsgs
+		return tasks
 	}
 
 	//
@@ -476,8 +558,21 @@ func (cd *compactionDaemon) addOptional() []*MsgIndexCompact {
 	// 4) compaction is not currently running for the index
 	//
 	sorted := make(compactionHistory, 0, len(cd.history))
+	policies := make(map[string]*compactionPolicy)
 
 	for _, hist := range cd.history {
+		inst, ok := cd.indexInstMap[hist.instId]
+		if !ok {
+			continue
+		}
+
+		defn := inst.Defn
+		policy := cd.getPolicyNoLock(defn.Bucket, defn.Scope, defn.Collection, defn.Name)
+		if policy.isDisabled() {
+			continue
+		}
+		threshold := policy.apply(config)["min_frag"].Int()
+
 		partnStats := stats.GetPartitionStats(hist.instId, hist.partitionId)
 
 		if partnStats != nil &&
@@ -490,6 +585,7 @@ func (cd *compactionDaemon) addOptional() []*MsgIndexCompact {
 			// if index is not running compaction, add it now.
 			if !cd.isIndexCompactingNoLock(hist.instId, hist.partitionId) {
 				sorted = append(sorted, hist)
+				policies[indexCompactionName(hist.instId, hist.partitionId)] = policy
 			}
 		}
 	}
@@ -519,19 +615,29 @@ func (cd *compactionDaemon) addOptional() []*MsgIndexCompact {
 			logging.Infof("CompactionDaemon: optional compaction: inst %v partition %v fragmentation %v target %v.",
 				hist.instId, hist.partitionId, partnStats.fragPercent.Value(), target)
 
-			compactMsgs = append(compactMsgs, newMsgIndexCompact(hist.instId, hist.partitionId, target))
+			defn := cd.indexInstMap[hist.instId].Defn
+			policy := policies[indexCompactionName(hist.instId, hist.partitionId)]
+			task := newCompactionTask(hist.instId, hist.partitionId,
+				defn.Bucket, defn.Scope, defn.Collection, defn.Name, policy, COMPACTION_OPTIONAL)
+			task.Fragmentation = partnStats.fragPercent.Value()
+			task.DiskSizeBefore = partnStats.diskSize.Value()
+			task.minFrag = target
+			tasks = append(tasks, task)
 		}
 	}
 
-	return compactMsgs
+	return tasks
 }
 
-func (cd *compactionDaemon) runCompaction(compactReq *MsgIndexCompact) {
+func (cd *compactionDaemon) runCompaction(task *compactionTask) error {
 
 	logging.Infof("CompactionDaemon: run compaction for inst %v partition %v.",
-		compactReq.GetInstId(), compactReq.GetPartitionId())
+		task.InstId, task.PartitionId)
+
+	cd.updateCompactionStartTime(task.InstId, task.PartitionId, time.Now().UnixNano())
 
-	cd.updateCompactionStartTime(compactReq.GetInstId(), compactReq.GetPartitionId(), time.Now().UnixNano())
+	compactReq := newMsgIndexCompact(task.InstId, task.PartitionId, task.minFrag)
+	compactReq.abortTime = task.abortTime
 
 	cd.msgch <- compactReq
 	err := <-compactReq.GetErrorChannel()
@@ -541,12 +647,30 @@ func (cd *compactionDaemon) runCompaction(compactReq *MsgIndexCompact) {
 			compactReq.GetInstId(), compactReq.GetPartitionId(), err)
 	}
 
+	diskSize := cd.getDiskSize(task.InstId, task.PartitionId)
+
+	cd.mutex.Lock()
+	if diskSize >= 0 {
+		task.DiskSizeAfter = diskSize
+		if task.DiskSizeBefore > diskSize {
+			task.ReclaimedBytes = task.DiskSizeBefore - diskSize
+		}
+	}
+	if err != nil {
+		cd.finishNoLock(task, COMPACTION_FAILED, err)
+	} else {
+		cd.finishNoLock(task, COMPACTION_DONE, nil)
+	}
+	cd.mutex.Unlock()
+
 	if cd.removeIndexCompaction(compactReq.GetInstId(), compactReq.GetPartitionId()) {
-		logging.Infof("CompactionDaemon: compaction done for inst %v partition %v.",
-			compactReq.GetInstId(), compactReq.GetPartitionId())
+		logging.Infof("CompactionDaemon: compaction done for inst %v partition %v. Reclaimed %v bytes.",
+			compactReq.GetInstId(), compactReq.GetPartitionId(), task.ReclaimedBytes)
 	}
 
 	cd.updateCompactionEndTime(compactReq.GetInstId(), compactReq.GetPartitionId(), time.Now().UnixNano())
+
+	return err
 }
 
 func (cd *compactionDaemon) updateIndexInstMap(indexInstMap common.IndexInstMap) {
@@ -583,6 +707,7 @@ func (cd *compactionDaemon) updateIndexInstMap(indexInstMap common.IndexInstMap)
 	cd.indexInstMap = indexInstMap
 	cd.compactions = compactions
 	cd.history = history
+	cd.prunePendingNoLock(indexInstMap)
 }
 
 func (cd *compactionDaemon) numInstancesNoLock() int {
@@ -691,12 +816,13 @@ func NewCompactionManager(supvCmdCh MsgChannel, supvMsgCh MsgChannel,
 		supvMsgCh: supvMsgCh,
 		logPrefix: "CompactionManager",
 	}
+	cm.cd = cm.newCompactionDaemon()
 	go cm.run()
 	return cm, &MsgSuccess{}
 }
 
 func (cm *compactionManager) run() {
-	cd := cm.newCompactionDaemon()
+	cd := cm.cd
 	cd.Start()
 loop:
 	for {
@@ -750,8 +876,10 @@ func (cm *compactionManager) newCompactionDaemon() *compactionDaemon {
 		lastCheckDay: -1,
 		compactions:  make(map[string]*indexCompaction),
 		history:      make(map[string]*indexCompaction),
+		running:      make(map[string]*compactionTask),
 	}
 	cd.config.Store(cfg)
+	cd.resetSchedulerConfig(cfg)
 
 	return cd
 }
@@ -762,3 +890,60 @@ func (cm *compactionManager) handleIndexMap(stats *IndexerStats, indexInstMap co
 		cd.updateIndexInstMap(indexInstMap)
 	}
 }
+
+// RegisterRestEndpoints registers the compaction queue REST API.
+func (cm *compactionManager) RegisterRestEndpoints() {
+	mux := GetHTTPMux()
+	mux.HandleFunc("/compactionQueue", cm.handleCompactionQueue)
+}
+
+//
+// handleCompactionQueue returns the pending, running and recently finished
+// compactions, along with the reclaimed disk space of finished compactions.
+//
+func (cm *compactionManager) handleCompactionQueue(w http.ResponseWriter, r *http.Request) {
+
+	creds, ok := doAuth(r, w, "CompactionManager::handleCompactionQueue")
+	if !ok {
+		return
+	}
+
+	if !isAllowed(creds, []string{"cluster.admin.internal.index!read"}, r, w,
+		"CompactionManager::handleCompactionQueue") {
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed\n"))
+		return
+	}
+
+	info := cm.cd.getQueueInfo()
+
+	if bucket := r.FormValue("bucket"); bucket != "" {
+		filter := func(tasks []*compactionTask) []*compactionTask {
+			result := make([]*compactionTask, 0, len(tasks))
+			for _, task := range tasks {
+				if task.Bucket == bucket {
+					result = append(result, task)
+				}
+			}
+			return result
+		}
+		info.Pending = filter(info.Pending)
+		info.Running = filter(info.Running)
+		info.History = filter(info.History)
+	}
+
+	buf, err := json.Marshal(info)
+	if err != nil {
+		logging.Errorf("%v: handleCompactionQueue failed to marshal response. Error=%v", cm.logPrefix, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf)
+}
@@ -0,0 +1,567 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+const (
+	// number of finished compactions kept for the compaction queue REST endpoint
+	COMPACTION_HISTORY_SIZE = 100
+)
+
+//////////////////////////////////////////////////////////////////
+// Compaction policy
+//////////////////////////////////////////////////////////////////
+
+//
+// compactionPolicy overrides the global compaction settings for the indexes it
+// matches.  Policies are specified as a JSON array in the setting
+// indexer.settings.compaction.policies, e.g.
+//
+//   [{"name": "hot", "bucket": "orders", "min_frag": 20, "priority": 10},
+//    {"bucket": "archive", "compaction_mode": "circular", "interval": "01:00,05:00",
+//     "days_of_week": "Saturday,Sunday", "abort_exceed_interval": true}]
+//
+// An empty bucket, scope, collection or index name matches any value.  When
+// more than one policy matches an index, the most specific one applies.  Settings
+// that are not specified in the policy are taken from the global settings.
+//
+type compactionPolicy struct {
+	Name string `json:"name,omitempty"`
+	indexMatcher
+
+	CompactionMode      *string `json:"compaction_mode,omitempty"`
+	MinFrag             *int    `json:"min_frag,omitempty"`
+	MinSize             *uint64 `json:"min_size,omitempty"`
+	Interval            *string `json:"interval,omitempty"`
+	DaysOfWeek          *string `json:"days_of_week,omitempty"`
+	AbortExceedInterval *bool   `json:"abort_exceed_interval,omitempty"`
+
+	// Compactions with higher priority are started first
+	Priority int `json:"priority,omitempty"`
+	// Disable auto-compaction of the matching indexes
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+func parseCompactionPolicies(value string) ([]*compactionPolicy, error) {
+
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil, nil
+	}
+
+	var policies []*compactionPolicy
+	if err := json.Unmarshal([]byte(value), &policies); err != nil {
+		return nil, fmt.Errorf("Compaction policies must be a JSON array of policies: %v", err)
+	}
+
+	for i, policy := range policies {
+		if policy == nil {
+			return nil, fmt.Errorf("Compaction policy %v is null", i)
+		}
+		if err := policy.validate(); err != nil {
+			return nil, fmt.Errorf("Compaction policy %v: %v", policy.String(i), err)
+		}
+	}
+
+	return policies, nil
+}
+
+func (p *compactionPolicy) validate() error {
+
+	if err := p.indexMatcher.validate(); err != nil {
+		return err
+	}
+
+	if p.CompactionMode != nil {
+		mode := strings.ToLower(*p.CompactionMode)
+		if mode != "full" && mode != "circular" {
+			return fmt.Errorf("invalid compaction_mode %v, must be one of (full, circular)", *p.CompactionMode)
+		}
+	}
+
+	if p.MinFrag != nil && (*p.MinFrag < 0 || *p.MinFrag > 100) {
+		return fmt.Errorf("invalid min_frag %v, must be between 0 and 100", *p.MinFrag)
+	}
+
+	if p.Interval != nil {
+		var start_hr, start_min, end_hr, end_min int
+		n, err := fmt.Sscanf(*p.Interval, "%d:%d,%d:%d", &start_hr, &start_min, &end_hr, &end_min)
+		if n != 4 || err != nil ||
+			start_hr < 0 || start_hr > 23 || end_hr < 0 || end_hr > 23 ||
+			start_min < 0 || start_min > 59 || end_min < 0 || end_min > 59 {
+			return fmt.Errorf("invalid interval %v, must be of the form hh:mm,hh:mm", *p.Interval)
+		}
+	}
+
+	if p.DaysOfWeek != nil {
+		for _, day := range strings.Split(*p.DaysOfWeek, ",") {
+			if day = strings.TrimSpace(day); day != "" && !isValidDay(day) {
+				return fmt.Errorf("invalid days_of_week %v", *p.DaysOfWeek)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *compactionPolicy) String(i int) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return fmt.Sprintf("#%v", i)
+}
+
+//
+// indexMatcher matches indexes by bucket, scope, collection and index name.
+// An empty value matches any value.
+//
+type indexMatcher struct {
+	Bucket     string `json:"bucket,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+	Collection string `json:"collection,omitempty"`
+	Index      string `json:"index,omitempty"`
+}
+
+func (p *indexMatcher) validate() error {
+
+	if p.Bucket == "" && (p.Scope != "" || p.Collection != "" || p.Index != "") {
+		return fmt.Errorf("bucket must be specified along with scope, collection or index")
+	}
+	return nil
+}
+
+func (p *indexMatcher) matches(bucket, scope, collection, name string) bool {
+
+	return (p.Bucket == "" || p.Bucket == bucket) &&
+		(p.Scope == "" || p.Scope == scope) &&
+		(p.Collection == "" || p.Collection == collection) &&
+		(p.Index == "" || p.Index == name)
+}
+
+//
+// specificity ranks matchers.  A matcher naming an index is more specific
+// than one naming a collection, which is more specific than one naming a
+// scope or only a bucket.
+//
+func (p *indexMatcher) specificity() int {
+
+	specificity := 0
+	if p.Bucket != "" {
+		specificity += 1
+	}
+	if p.Scope != "" {
+		specificity += 2
+	}
+	if p.Collection != "" {
+		specificity += 4
+	}
+	if p.Index != "" {
+		specificity += 8
+	}
+	return specificity
+}
+
+//
+// Returns the policy that applies to the index, or nil if no policy matches.
+// Between policies of the same specificity, the first one listed wins.
+//
+func resolveCompactionPolicy(policies []*compactionPolicy,
+	bucket, scope, collection, name string) *compactionPolicy {
+
+	var result *compactionPolicy
+	for _, policy := range policies {
+		if policy.matches(bucket, scope, collection, name) {
+			if result == nil || policy.specificity() > result.specificity() {
+				result = policy
+			}
+		}
+	}
+	return result
+}
+
+//
+// Returns the compaction config for the indexes matching the policy.  The config
+// is the global compaction config with the settings of the policy applied.
+//
+func (p *compactionPolicy) apply(config common.Config) common.Config {
+
+	if p == nil {
+		return config
+	}
+
+	config = config.Clone()
+	if p.CompactionMode != nil {
+		config.SetValue("compaction_mode", *p.CompactionMode)
+	}
+	if p.MinFrag != nil {
+		config.SetValue("min_frag", *p.MinFrag)
+	}
+	if p.MinSize != nil {
+		config.SetValue("min_size", *p.MinSize)
+	}
+	if p.Interval != nil {
+		config.SetValue("interval", *p.Interval)
+	}
+	if p.DaysOfWeek != nil {
+		config.SetValue("days_of_week", *p.DaysOfWeek)
+	}
+	if p.AbortExceedInterval != nil {
+		config.SetValue("abort_exceed_interval", *p.AbortExceedInterval)
+	}
+	return config
+}
+
+func (p *compactionPolicy) getName() string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+func (p *compactionPolicy) getPriority() int {
+	if p == nil {
+		return 0
+	}
+	return p.Priority
+}
+
+func (p *compactionPolicy) isDisabled() bool {
+	return p != nil && p.Disabled
+}
+
+//////////////////////////////////////////////////////////////////
+// Compaction admission rate
+//////////////////////////////////////////////////////////////////
+
+//
+// compactionAdmission is a token bucket that limits the rate at which
+// compactions are started to indexer.settings.compaction.admission_rate MB of
+// index disk size per second.  It is an admission limit: it decides when a
+// queued compaction may start, and does not throttle the I/O of compactions
+// that are already running.
+//
+// A compaction is charged upfront for the bytes it is expected to scan (the
+// disk size of the index partition).  A compaction is admitted as long as the
+// bucket is not in debt, so that a compaction larger than the bucket can still
+// run.  Compactions that follow will wait until the debt is paid off.  A single
+// large compaction can hence use more disk bandwidth than the admission rate
+// while it runs.
+//
+type compactionAdmission struct {
+	rate   float64 // bytes per second; 0 is unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *compactionAdmission) setRate(mbPerSec int, burst time.Duration) {
+
+	now := time.Now()
+	b.refill(now)
+
+	if mbPerSec <= 0 {
+		b.rate, b.burst, b.tokens = 0, 0, 0
+		return
+	}
+
+	b.rate = float64(mbPerSec) * 1024 * 1024
+	b.burst = b.rate * burst.Seconds()
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *compactionAdmission) refill(now time.Time) {
+
+	if b.rate > 0 && !b.last.IsZero() {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *compactionAdmission) tryAcquire(cost int64, now time.Time) bool {
+
+	if b.rate == 0 {
+		return true
+	}
+
+	b.refill(now)
+	if b.tokens < 0 {
+		return false
+	}
+	b.tokens -= float64(cost)
+	return true
+}
+
+func (b *compactionAdmission) available(now time.Time) int64 {
+
+	if b.rate == 0 {
+		return 0
+	}
+
+	b.refill(now)
+	return int64(b.tokens)
+}
+
+//////////////////////////////////////////////////////////////////
+// Compaction queue
+//////////////////////////////////////////////////////////////////
+
+type compactionState string
+
+const (
+	COMPACTION_PENDING compactionState = "pending"
+	COMPACTION_RUNNING                 = "running"
+	COMPACTION_DONE                    = "done"
+	COMPACTION_FAILED                  = "failed"
+	COMPACTION_SKIPPED                 = "skipped"
+)
+
+// Reason for scheduling a compaction, in the order they are started for the
+// same priority.
+const (
+	COMPACTION_UPGRADE   = "upgrade"
+	COMPACTION_MANDATORY = "mandatory"
+	COMPACTION_SCHEDULED = "scheduled"
+	COMPACTION_OPTIONAL  = "optional"
+)
+
+func compactionReasonRank(reason string) int {
+	switch reason {
+	case COMPACTION_UPGRADE:
+		return 0
+	case COMPACTION_MANDATORY:
+		return 1
+	case COMPACTION_SCHEDULED:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// compactionTask is an index partition compaction in the compaction queue.
+type compactionTask struct {
+	InstId         common.IndexInstId `json:"instId"`
+	PartitionId    common.PartitionId `json:"partitionId"`
+	Bucket         string             `json:"bucket"`
+	Scope          string             `json:"scope"`
+	Collection     string             `json:"collection"`
+	Name           string             `json:"name"`
+	Policy         string             `json:"policy,omitempty"`
+	Priority       int                `json:"priority"`
+	Reason         string             `json:"reason"`
+	State          compactionState    `json:"state"`
+	Fragmentation  int64              `json:"fragmentation"`
+	DiskSizeBefore int64              `json:"diskSizeBefore"`
+	DiskSizeAfter  int64              `json:"diskSizeAfter,omitempty"`
+	ReclaimedBytes int64              `json:"reclaimedBytes"`
+	QueuedTime     int64              `json:"queuedTime"`
+	StartTime      int64              `json:"startTime,omitempty"`
+	EndTime        int64              `json:"endTime,omitempty"`
+	Error          string             `json:"error,omitempty"`
+
+	minFrag   int
+	abortTime time.Time
+	deferred  bool
+	// if set, re-evaluate whether the compaction is still needed when the
+	// compaction had to wait for admission.
+	recheck func() bool
+}
+
+func newCompactionTask(instId common.IndexInstId, partnId common.PartitionId,
+	bucket, scope, collection, name string, policy *compactionPolicy, reason string) *compactionTask {
+
+	return &compactionTask{
+		InstId:      instId,
+		PartitionId: partnId,
+		Bucket:      bucket,
+		Scope:       scope,
+		Collection:  collection,
+		Name:        name,
+		Policy:      policy.getName(),
+		Priority:    policy.getPriority(),
+		Reason:      reason,
+		State:       COMPACTION_PENDING,
+		QueuedTime:  time.Now().UnixNano(),
+	}
+}
+
+func (t *compactionTask) name() string {
+	return indexCompactionName(t.InstId, t.PartitionId)
+}
+
+// compactionQueueInfo is the response of the /compactionQueue endpoint.
+type compactionQueueInfo struct {
+	AdmissionRate      int               `json:"admissionRate"`
+	AvailableAdmission int64             `json:"availableAdmission"`
+	Pending            []*compactionTask `json:"pending"`
+	Running            []*compactionTask `json:"running"`
+	History            []*compactionTask `json:"history"`
+}
+
+type compactionQueue []*compactionTask
+
+func (q compactionQueue) Len() int      { return len(q) }
+func (q compactionQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q compactionQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	if ri, rj := compactionReasonRank(q[i].Reason), compactionReasonRank(q[j].Reason); ri != rj {
+		return ri < rj
+	}
+	if q[i].Fragmentation != q[j].Fragmentation {
+		return q[i].Fragmentation > q[j].Fragmentation
+	}
+	return q[i].QueuedTime < q[j].QueuedTime
+}
+
+func (cd *compactionDaemon) enqueueNoLock(tasks []*compactionTask) {
+	cd.pending = append(cd.pending, tasks...)
+}
+
+//
+// Move pending compactions to running state, in priority order, as long as the
+// admission rate allows it and the number of running compactions is below limit
+// (0 is unlimited).  Return the compactions to be run by the caller.
+//
+func (cd *compactionDaemon) dispatchNoLock(limit int) []*compactionTask {
+
+	sort.Stable(compactionQueue(cd.pending))
+
+	var tasks []*compactionTask
+	now := time.Now()
+
+	i := 0
+	for ; i < len(cd.pending); i++ {
+		task := cd.pending[i]
+
+		if limit > 0 && len(cd.running) >= limit {
+			break
+		}
+
+		// index may no longer need compaction after waiting for admission
+		if task.deferred && task.recheck != nil && !task.recheck() {
+			delete(cd.compactions, task.name())
+			cd.finishNoLock(task, COMPACTION_SKIPPED, nil)
+			continue
+		}
+
+		if !cd.admission.tryAcquire(task.DiskSizeBefore, now) {
+			break
+		}
+
+		task.State = COMPACTION_RUNNING
+		task.StartTime = now.UnixNano()
+		cd.running[task.name()] = task
+		tasks = append(tasks, task)
+	}
+
+	for _, task := range cd.pending[i:] {
+		task.deferred = true
+	}
+	cd.pending = append([]*compactionTask(nil), cd.pending[i:]...)
+
+	return tasks
+}
+
+func (cd *compactionDaemon) finishNoLock(task *compactionTask, state compactionState, err error) {
+
+	task.State = state
+	task.EndTime = time.Now().UnixNano()
+	if err != nil {
+		task.Error = err.Error()
+	}
+	delete(cd.running, task.name())
+
+	cd.completed = append(cd.completed, task)
+	if len(cd.completed) > COMPACTION_HISTORY_SIZE {
+		cd.completed = cd.completed[len(cd.completed)-COMPACTION_HISTORY_SIZE:]
+	}
+}
+
+//
+// Drop pending compactions of indexes that no longer exist.
+//
+func (cd *compactionDaemon) prunePendingNoLock(indexInstMap common.IndexInstMap) {
+
+	pending := make([]*compactionTask, 0, len(cd.pending))
+	for _, task := range cd.pending {
+		if _, ok := indexInstMap[task.InstId]; ok {
+			pending = append(pending, task)
+		}
+	}
+	cd.pending = pending
+}
+
+func (cd *compactionDaemon) getPolicyNoLock(bucket, scope, collection, name string) *compactionPolicy {
+	return resolveCompactionPolicy(cd.policies, bucket, scope, collection, name)
+}
+
+func (cd *compactionDaemon) getQueueInfo() *compactionQueueInfo {
+	cd.mutex.Lock()
+	defer cd.mutex.Unlock()
+
+	info := &compactionQueueInfo{
+		AdmissionRate:      cd.config.Load()["admission_rate"].Int(),
+		AvailableAdmission: cd.admission.available(time.Now()),
+		Pending:            make([]*compactionTask, 0, len(cd.pending)),
+		Running:            make([]*compactionTask, 0, len(cd.running)),
+		History:            make([]*compactionTask, 0, len(cd.completed)),
+	}
+
+	// copy tasks as running tasks are updated on completion
+	for _, task := range cd.pending {
+		clone := *task
+		info.Pending = append(info.Pending, &clone)
+	}
+	for _, task := range cd.running {
+		clone := *task
+		info.Running = append(info.Running, &clone)
+	}
+	for i := len(cd.completed) - 1; i >= 0; i-- {
+		clone := *cd.completed[i]
+		info.History = append(info.History, &clone)
+	}
+
+	sort.Stable(compactionQueue(info.Pending))
+	sort.Slice(info.Running, func(i, j int) bool { return info.Running[i].StartTime < info.Running[j].StartTime })
+
+	return info
+}
+
+//
+// Returns the current disk size of an index partition, or -1 if the index
+// partition is not found.
+//
+func (cd *compactionDaemon) getDiskSize(instId common.IndexInstId, partnId common.PartitionId) int64 {
+
+	spec := NewStatsSpec(false, false, false, false, false,
+		&common.StatsIndexSpec{Instances: []common.IndexInstId{instId}})
+
+	replych := make(chan []IndexStorageStats)
+	cd.msgch <- &MsgIndexStorageStats{respch: replych, spec: spec}
+	for _, is := range <-replych {
+		if is.InstId == instId && is.PartnId == partnId {
+			return is.Stats.DiskSize
+		}
+	}
+	return -1
+}
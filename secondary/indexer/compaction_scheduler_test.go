@@ -0,0 +1,250 @@
+package indexer
+
+import (
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func TestParseCompactionPolicies(t *testing.T) {
+
+	valid := []string{
+		"",
+		"[]",
+		`[{"name": "hot", "bucket": "orders", "min_frag": 20, "priority": 10}]`,
+		`[{"bucket": "archive", "compaction_mode": "circular", "interval": "01:00,05:00",
+		   "days_of_week": "Saturday,Sunday", "abort_exceed_interval": true}]`,
+		`[{"disabled": true}]`,
+	}
+	for _, value := range valid {
+		if _, err := parseCompactionPolicies(value); err != nil {
+			t.Errorf("parseCompactionPolicies(%q) unexpected error %v", value, err)
+		}
+	}
+
+	invalid := []string{
+		"{}",
+		"[null]",
+		`[{"scope": "s1"}]`,
+		`[{"compaction_mode": "partial"}]`,
+		`[{"min_frag": 101}]`,
+		`[{"interval": "25:00,01:00"}]`,
+		`[{"interval": "01:00"}]`,
+		`[{"days_of_week": "Someday"}]`,
+	}
+	for _, value := range invalid {
+		if _, err := parseCompactionPolicies(value); err == nil {
+			t.Errorf("parseCompactionPolicies(%q) expected an error", value)
+		}
+	}
+}
+
+func TestResolveCompactionPolicy(t *testing.T) {
+
+	policies, err := parseCompactionPolicies(`[
+		{"name": "all", "priority": 1},
+		{"name": "b1", "bucket": "b1", "min_frag": 20, "priority": 2},
+		{"name": "b1-first", "bucket": "b1", "min_frag": 50},
+		{"name": "c1", "bucket": "b1", "scope": "s1", "collection": "c1", "compaction_mode": "circular"},
+		{"name": "i1", "bucket": "b1", "index": "i1", "disabled": true}]`)
+	if err != nil {
+		t.Fatalf("parseCompactionPolicies unexpected error %v", err)
+	}
+
+	tests := []struct {
+		bucket, scope, collection, name string
+		policy                          string
+	}{
+		{"b2", "s1", "c1", "i2", "all"},
+		// first of the policies with the same specificity
+		{"b1", "s2", "c1", "i2", "b1"},
+		{"b1", "s1", "c1", "i2", "c1"},
+		// index is more specific than collection
+		{"b1", "s1", "c1", "i1", "i1"},
+	}
+	for _, test := range tests {
+		policy := resolveCompactionPolicy(policies, test.bucket, test.scope, test.collection, test.name)
+		if policy.getName() != test.policy {
+			t.Errorf("resolveCompactionPolicy(%v:%v:%v:%v) = %v, expected %v", test.bucket,
+				test.scope, test.collection, test.name, policy.getName(), test.policy)
+		}
+	}
+	if policy := resolveCompactionPolicy(policies[1:], "b2", "s1", "c1", "i1"); policy != nil {
+		t.Errorf("expected no policy, got %v", policy.getName())
+	}
+
+	var none *compactionPolicy
+	if none.getName() != "" || none.getPriority() != 0 || none.isDisabled() {
+		t.Errorf("expected defaults without a policy")
+	}
+	if !policies[4].isDisabled() || policies[1].getPriority() != 2 {
+		t.Errorf("unexpected policy settings")
+	}
+
+	// settings not in the policy are taken from the global settings
+	config := common.SystemConfig.SectionConfig("indexer.settings.compaction.", true)
+	applied := policies[1].apply(config)
+	if applied["min_frag"].Int() != 20 ||
+		applied["compaction_mode"].String() != config["compaction_mode"].String() {
+		t.Errorf("unexpected config %v, %v", applied["min_frag"], applied["compaction_mode"])
+	}
+	if config["min_frag"].Int() == 20 {
+		t.Errorf("apply changed the global settings")
+	}
+	if applied := policies[3].apply(config); applied["compaction_mode"].String() != "circular" {
+		t.Errorf("expected circular compaction mode, got %v", applied["compaction_mode"])
+	}
+	if none.apply(config)["min_frag"].Int() != config["min_frag"].Int() {
+		t.Errorf("expected global settings without a policy")
+	}
+}
+
+func compactionTaskOf(instId common.IndexInstId, priority int, reason string,
+	frag int64, queued int64) *compactionTask {
+
+	task := newCompactionTask(instId, 0, "b1", "s1", "c1", "i1", nil, reason)
+	task.Priority = priority
+	task.Fragmentation = frag
+	task.QueuedTime = queued
+	return task
+}
+
+func TestCompactionQueueOrder(t *testing.T) {
+
+	queue := compactionQueue{
+		compactionTaskOf(1, 0, COMPACTION_OPTIONAL, 90, 1),
+		compactionTaskOf(2, 0, COMPACTION_SCHEDULED, 30, 2),
+		compactionTaskOf(3, 0, COMPACTION_SCHEDULED, 60, 3),
+		compactionTaskOf(4, 0, COMPACTION_SCHEDULED, 60, 1),
+		compactionTaskOf(5, 0, COMPACTION_MANDATORY, 10, 5),
+		compactionTaskOf(6, 0, COMPACTION_UPGRADE, 0, 6),
+		compactionTaskOf(7, 10, COMPACTION_OPTIONAL, 0, 7),
+	}
+	sort.Stable(queue)
+
+	// priority, then reason, then fragmentation, then queued time
+	expected := []common.IndexInstId{7, 6, 5, 4, 3, 2, 1}
+	for i, task := range queue {
+		if task.InstId != expected[i] {
+			t.Fatalf("expected compaction order %v, got %v at %v", expected, task.InstId, i)
+		}
+	}
+}
+
+func newTestCompactionDaemon() *compactionDaemon {
+	return &compactionDaemon{
+		compactions: make(map[string]*indexCompaction),
+		running:     make(map[string]*compactionTask),
+	}
+}
+
+func TestDispatchCompactions(t *testing.T) {
+
+	cd := newTestCompactionDaemon()
+	cd.enqueueNoLock([]*compactionTask{
+		compactionTaskOf(1, 0, COMPACTION_SCHEDULED, 10, 1),
+		compactionTaskOf(2, 0, COMPACTION_SCHEDULED, 50, 2),
+		compactionTaskOf(3, 5, COMPACTION_SCHEDULED, 10, 3),
+	})
+
+	// limit on running compactions
+	tasks := cd.dispatchNoLock(2)
+	if len(tasks) != 2 || tasks[0].InstId != 3 || tasks[1].InstId != 2 {
+		t.Fatalf("expected compactions 3 and 2 to be dispatched, got %v", tasks)
+	}
+	for _, task := range tasks {
+		if task.State != COMPACTION_RUNNING || task.StartTime == 0 || cd.running[task.name()] != task {
+			t.Errorf("expected compaction %v to be running", task.InstId)
+		}
+	}
+	if len(cd.pending) != 1 || cd.pending[0].InstId != 1 || !cd.pending[0].deferred {
+		t.Fatalf("expected compaction 1 to be deferred, got %v", cd.pending)
+	}
+	if tasks := cd.dispatchNoLock(2); len(tasks) != 0 {
+		t.Fatalf("expected no compaction over the limit, got %v", tasks)
+	}
+
+	cd.finishNoLock(tasks[0], COMPACTION_DONE, nil)
+	if len(cd.running) != 1 || len(cd.completed) != 1 || cd.completed[0].State != COMPACTION_DONE {
+		t.Fatalf("unexpected state after finish, running %v, completed %v", cd.running, cd.completed)
+	}
+
+	// a deferred compaction that is no longer needed is skipped
+	cd.pending[0].recheck = func() bool { return false }
+	if tasks := cd.dispatchNoLock(0); len(tasks) != 0 || len(cd.pending) != 0 {
+		t.Fatalf("expected compaction 1 to be skipped, got %v, pending %v", tasks, cd.pending)
+	}
+	if last := cd.completed[len(cd.completed)-1]; last.InstId != 1 || last.State != COMPACTION_SKIPPED {
+		t.Errorf("expected compaction 1 to be skipped, got %+v", last)
+	}
+}
+
+func TestDispatchCompactionsAdmission(t *testing.T) {
+
+	cd := newTestCompactionDaemon()
+	cd.admission.setRate(1, time.Second)
+
+	const mb = 1024 * 1024
+	first := compactionTaskOf(1, 1, COMPACTION_SCHEDULED, 10, 1)
+	first.DiskSizeBefore = 2 * mb
+	second := compactionTaskOf(2, 0, COMPACTION_SCHEDULED, 10, 2)
+	second.DiskSizeBefore = mb
+	cd.enqueueNoLock([]*compactionTask{first, second})
+
+	// a compaction larger than the burst is admitted, and the next one waits
+	// until its cost is paid off.
+	if tasks := cd.dispatchNoLock(0); len(tasks) != 1 || tasks[0] != first {
+		t.Fatalf("expected only the first compaction to be dispatched, got %v", tasks)
+	}
+	if available := cd.admission.available(time.Now()); available >= 0 {
+		t.Errorf("expected the admission to be in debt, got %v", available)
+	}
+	if !second.deferred || len(cd.pending) != 1 {
+		t.Fatalf("expected the second compaction to be deferred")
+	}
+
+	// the debt is paid off over 2 seconds at 1 MB/s
+	later := time.Now().Add(3 * time.Second)
+	if !cd.admission.tryAcquire(second.DiskSizeBefore, later) {
+		t.Errorf("expected the compaction to be admitted after the debt is paid off")
+	}
+	if available := cd.admission.available(later); available > mb {
+		t.Errorf("expected the admission to be capped by its burst, got %v", available)
+	}
+
+	// no admission rate is unlimited
+	cd.admission.setRate(0, time.Second)
+	if tasks := cd.dispatchNoLock(0); len(tasks) != 1 || tasks[0] != second {
+		t.Fatalf("expected the second compaction to be dispatched, got %v", tasks)
+	}
+}
+
+var errCompactionTest = errors.New("compaction failed")
+
+func TestCompactionHistoryAndPrune(t *testing.T) {
+
+	cd := newTestCompactionDaemon()
+	for i := 0; i < COMPACTION_HISTORY_SIZE+10; i++ {
+		task := compactionTaskOf(common.IndexInstId(i), 0, COMPACTION_SCHEDULED, 0, int64(i))
+		cd.running[task.name()] = task
+		cd.finishNoLock(task, COMPACTION_FAILED, errCompactionTest)
+	}
+	if len(cd.completed) != COMPACTION_HISTORY_SIZE || cd.completed[0].InstId != 10 {
+		t.Fatalf("expected the last %v compactions in history", COMPACTION_HISTORY_SIZE)
+	}
+	if cd.completed[0].Error != errCompactionTest.Error() || len(cd.running) != 0 {
+		t.Errorf("unexpected history %+v", cd.completed[0])
+	}
+
+	cd.enqueueNoLock([]*compactionTask{
+		compactionTaskOf(1, 0, COMPACTION_SCHEDULED, 0, 1),
+		compactionTaskOf(2, 0, COMPACTION_SCHEDULED, 0, 2),
+	})
+	cd.prunePendingNoLock(common.IndexInstMap{2: common.IndexInst{InstId: 2}})
+	if len(cd.pending) != 1 || cd.pending[0].InstId != 2 {
+		t.Errorf("expected only compaction 2 to be pending, got %v", cd.pending)
+	}
+}
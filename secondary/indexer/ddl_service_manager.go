@@ -59,7 +59,8 @@ type DDLServiceMgr struct {
 	commandListener *mc.CommandListener
 	listenerDonech  chan bool
 
-	tokenCleanerStopCh            chan struct{} // close to stop runTokenCleaner goroutine
+	tokenCleanerStopCh            chan struct{} // close to stop runTokenCleaner and runTokenAuditor goroutines
+	tokenAuditMutex               sync.Mutex    // serializes token audits
 	handleClusterStorageModeMutex sync.Mutex    // serializes handleClusterStorageMode calls
 
 	deleteTokenCache map[common.IndexDefnId]int64 // unixnano timestamp
@@ -141,9 +142,11 @@ func NewDDLServiceMgr(indexerId common.IndexerId, supvCmdch MsgChannel, supvMsgc
 	mux.HandleFunc("/listScheduleCreateTokens", mgr.handleListScheduleCreateTokens)
 	mux.HandleFunc("/listStopScheduleCreateTokens", mgr.handleListStopScheduleCreateTokens)
 	mux.HandleFunc("/transferScheduleCreateTokens", mgr.handleTransferScheduleCreateTokens)
+	mux.HandleFunc("/auditMetadataTokens", mgr.handleAuditMetadataTokens)
 
 	go mgr.run()
 	go mgr.runTokenCleaner()
+	go mgr.runTokenAuditor()
 
 	setDDLServiceMgr(mgr)
 
@@ -0,0 +1,545 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/manager/client"
+	mc "github.com/couchbase/indexing/secondary/manager/common"
+)
+
+// The token auditor cross-checks the DDL command tokens in metakv against each other and
+// against the index metadata of the indexers in the cluster. It finds tokens that are
+// orphaned (the index or indexer they refer to no longer exists), contradictory (tokens
+// asking for both the creation and the deletion of an index) or stale (the command has
+// already been carried out), and optionally repairs them by deleting the token. Tokens are
+// only repaired when the metadata of every indexer is known, so a token is never deleted
+// because of an indexer that is temporarily unreachable.
+//
+// The token cleaner (cleanupTokens) already removes some of these tokens after rebalance,
+// and the auditor repairs tokens the same way, but it also reports the tokens that the
+// cleaner would leave behind.
+
+const (
+	TOKEN_ORPHANED      = "orphaned"
+	TOKEN_CONTRADICTORY = "contradictory"
+	TOKEN_STALE         = "stale"
+)
+
+// TokenAuditFinding is a DDL token found to be inconsistent by the token auditor.
+type TokenAuditFinding struct {
+	TokenType   string             `json:"tokenType"`
+	Path        string             `json:"path"`
+	DefnId      common.IndexDefnId `json:"defnId"`
+	InstId      common.IndexInstId `json:"instId,omitempty"`
+	Problem     string             `json:"problem"`
+	Detail      string             `json:"detail"`
+	Repairable  bool               `json:"repairable"`
+	Repaired    bool               `json:"repaired"`
+	RepairError string             `json:"repairError,omitempty"`
+}
+
+// TokenAuditReport is the result of a token audit.
+type TokenAuditReport struct {
+	Time     time.Time            `json:"time"`
+	Repair   bool                 `json:"repair"`
+	Findings []*TokenAuditFinding `json:"findings"`
+	Repaired int                  `json:"repaired"`
+	Errors   []string             `json:"errors,omitempty"`
+}
+
+func (r *TokenAuditReport) addFinding(tokenType, path string, defnId common.IndexDefnId,
+	instId common.IndexInstId, problem string, repairable bool, format string,
+	args ...interface{}) {
+
+	r.Findings = append(r.Findings, &TokenAuditFinding{
+		TokenType:  tokenType,
+		Path:       path,
+		DefnId:     defnId,
+		InstId:     instId,
+		Problem:    problem,
+		Detail:     fmt.Sprintf(format, args...),
+		Repairable: repairable,
+	})
+}
+
+func (r *TokenAuditReport) addError(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// tokenAuditProvider is the index metadata used by an audit. It is implemented by
+// client.MetadataProvider.
+type tokenAuditProvider interface {
+	FindIndexIgnoreStatus(defnId common.IndexDefnId) *client.IndexMetadata
+	FindIndexInstanceIgnoreStatus(defnId common.IndexDefnId, instId common.IndexInstId) *client.IndexMetadata
+	FindServiceForIndexer(indexerId common.IndexerId) (string, string, string, error)
+	BroadcastAlterReplicaCountRequest(defn *common.IndexDefn) error
+}
+
+// tokenAuditState is the snapshot of DDL tokens taken by an audit.
+type tokenAuditState struct {
+	createTokens    map[common.IndexDefnId][]string
+	deleteTokens    map[common.IndexDefnId]*mc.DeleteCommandToken
+	buildTokens     map[common.IndexDefnId]*mc.BuildCommandToken
+	scheduleTokens  map[common.IndexDefnId]*mc.ScheduleCreateToken
+	stopScheduleIds map[common.IndexDefnId]bool
+}
+
+// auditTokens audits the DDL tokens in metakv and, if repair is true, repairs the inconsistent
+// tokens found. Only one audit runs at a time.
+func (m *DDLServiceMgr) auditTokens(repair bool) *TokenAuditReport {
+	const method = "DDLServiceMgr::auditTokens:" // for logging
+
+	m.tokenAuditMutex.Lock()
+	defer m.tokenAuditMutex.Unlock()
+
+	report := &TokenAuditReport{Time: time.Now(), Repair: repair}
+
+	provider, _, failedNodes, err := newMetadataProvider(m.clusterAddr, nil, m.settings, method)
+	if err != nil {
+		report.addError("Fail to get index metadata: %v", err)
+		return report
+	}
+	if provider == nil {
+		report.addError("Fail to get index metadata: nil MetadataProvider")
+		return report
+	}
+	defer provider.Close()
+
+	if failedNodes || !provider.AllWatchersAlive() {
+		report.addError("Cannot get index metadata from all indexer nodes. Skipping audit.")
+		return report
+	}
+
+	state, err := m.snapshotTokens()
+	if err != nil {
+		report.addError("Fail to read DDL tokens from metakv: %v", err)
+		return report
+	}
+
+	m.auditCreateTokens(provider, state, report)
+	m.auditBuildTokens(provider, state, report)
+	m.auditDeleteTokens(provider, state, report)
+	m.auditScheduleTokens(provider, state, report)
+	m.auditDropInstanceTokens(provider, state, report)
+
+	if repair {
+		if !m.canProcessDDL() {
+			report.addError("Rebalance in progress. Skipping repair.")
+		} else {
+			m.repairTokens(provider, report)
+		}
+	}
+
+	for _, finding := range report.Findings {
+		logging.Warnf("%v %v token %v is %v: %v. repaired %v %v", method, finding.TokenType,
+			finding.Path, finding.Problem, finding.Detail, finding.Repaired, finding.RepairError)
+	}
+	logging.Infof("%v found %v inconsistent tokens, repaired %v, errors %v", method,
+		len(report.Findings), report.Repaired, report.Errors)
+
+	return report
+}
+
+func (m *DDLServiceMgr) snapshotTokens() (*tokenAuditState, error) {
+
+	state := &tokenAuditState{
+		createTokens:    make(map[common.IndexDefnId][]string),
+		scheduleTokens:  make(map[common.IndexDefnId]*mc.ScheduleCreateToken),
+		stopScheduleIds: make(map[common.IndexDefnId]bool),
+	}
+
+	createPaths, err := mc.ListCreateCommandToken()
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range createPaths {
+		defnId, _, err := mc.GetDefnIdFromCreateCommandTokenPath(path)
+		if err != nil {
+			return nil, err
+		}
+		state.createTokens[defnId] = append(state.createTokens[defnId], path)
+	}
+
+	if state.deleteTokens, err = mc.FetchIndexDefnToDeleteCommandTokensMap(); err != nil {
+		return nil, err
+	}
+
+	if state.buildTokens, err = mc.FetchIndexDefnToBuildCommandTokensMap(); err != nil {
+		return nil, err
+	}
+
+	scheduleTokens, err := mc.ListAllScheduleCreateTokens()
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range scheduleTokens {
+		if token != nil {
+			state.scheduleTokens[token.Definition.DefnId] = token
+		}
+	}
+
+	stopScheduleTokens, err := mc.ListAllStopScheduleCreateTokens()
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range stopScheduleTokens {
+		if token != nil {
+			state.stopScheduleIds[token.DefnId] = true
+		}
+	}
+
+	return state, nil
+}
+
+// auditCreateTokens finds create tokens of indexes that have been dropped, and create tokens
+// none of whose indexers are in the cluster any more.
+func (m *DDLServiceMgr) auditCreateTokens(provider tokenAuditProvider, state *tokenAuditState,
+	report *TokenAuditReport) {
+
+	for defnId, paths := range state.createTokens {
+		for _, path := range paths {
+			if _, ok := state.deleteTokens[defnId]; ok {
+				report.addFinding("create", path, defnId, 0, TOKEN_CONTRADICTORY, true,
+					"index is also being dropped")
+				continue
+			}
+
+			_, requestId, err := mc.GetDefnIdFromCreateCommandTokenPath(path)
+			if err != nil {
+				report.addError("Fail to parse create token path %v: %v", path, err)
+				continue
+			}
+			token, err := mc.FetchCreateCommandToken(defnId, requestId)
+			if err != nil {
+				report.addError("Fail to fetch create token %v: %v", path, err)
+				continue
+			}
+			if token == nil {
+				// being created or deleted, or malformed; left to the token cleaner
+				continue
+			}
+
+			foundAnyIndexer := false
+			for indexerId := range token.Definitions {
+				if _, _, _, err := provider.FindServiceForIndexer(indexerId); err == nil {
+					foundAnyIndexer = true
+					break
+				}
+			}
+			if !foundAnyIndexer {
+				report.addFinding("create", path, defnId, 0, TOKEN_ORPHANED, true,
+					"none of the indexers the index is created on are in the cluster")
+			}
+		}
+	}
+}
+
+// auditBuildTokens finds build tokens of indexes that no longer exist, and build tokens of
+// indexes all of whose instances have been built.
+func (m *DDLServiceMgr) auditBuildTokens(provider tokenAuditProvider, state *tokenAuditState,
+	report *TokenAuditReport) {
+
+	for defnId, token := range state.buildTokens {
+		path := mc.BuildDDLCommandTokenPath + fmt.Sprintf("%v", defnId)
+
+		index := provider.FindIndexIgnoreStatus(defnId)
+		if index == nil {
+			// the index may not have been created yet
+			if len(state.createTokens[defnId]) != 0 || state.scheduleTokens[defnId] != nil {
+				continue
+			}
+			report.addFinding("build", path, defnId, 0, TOKEN_ORPHANED, true,
+				"index %v does not exist", token.Name)
+			continue
+		}
+
+		built := true
+		for _, insts := range [][]*client.InstanceDefn{index.Instances, index.InstsInRebalance} {
+			for _, inst := range insts {
+				if inst.State == common.INDEX_STATE_READY || inst.State == common.INDEX_STATE_CREATED {
+					built = false
+				}
+			}
+		}
+		if built {
+			report.addFinding("build", path, defnId, 0, TOKEN_STALE, true,
+				"all instances of index %v are built", index.Definition.Name)
+		}
+	}
+}
+
+// auditDeleteTokens finds delete tokens of indexes that no longer exist. They are only
+// reported, as the token cleaner deletes them once they are old enough for every indexer
+// to have seen them.
+func (m *DDLServiceMgr) auditDeleteTokens(provider tokenAuditProvider, state *tokenAuditState,
+	report *TokenAuditReport) {
+
+	for defnId, token := range state.deleteTokens {
+		if len(state.createTokens[defnId]) != 0 {
+			// reported with the create token
+			continue
+		}
+		if provider.FindIndexIgnoreStatus(defnId) == nil {
+			path := mc.DeleteDDLCommandTokenPath + fmt.Sprintf("%v", defnId)
+			report.addFinding("delete", path, defnId, 0, TOKEN_STALE, false,
+				"index %v is dropped, token is removed by the token cleaner", token.Name)
+		}
+	}
+}
+
+// auditScheduleTokens finds schedule create tokens of indexes that have been dropped or
+// already created, or that are scheduled on an indexer that is not in the cluster, and stop
+// schedule create tokens that have no schedule create token.
+func (m *DDLServiceMgr) auditScheduleTokens(provider tokenAuditProvider, state *tokenAuditState,
+	report *TokenAuditReport) {
+
+	for defnId, token := range state.scheduleTokens {
+		path := mc.GetScheduleCreateTokenPathFromDefnId(defnId)
+
+		if _, ok := state.deleteTokens[defnId]; ok {
+			report.addFinding("scheduleCreate", path, defnId, 0, TOKEN_CONTRADICTORY, true,
+				"index %v is also being dropped", token.Definition.Name)
+			continue
+		}
+
+		if provider.FindIndexIgnoreStatus(defnId) != nil {
+			report.addFinding("scheduleCreate", path, defnId, 0, TOKEN_STALE, true,
+				"index %v is already created", token.Definition.Name)
+			continue
+		}
+
+		if _, _, _, err := provider.FindServiceForIndexer(token.IndexerId); err != nil {
+			// The index is still created on another indexer, so only report it.
+			report.addFinding("scheduleCreate", path, defnId, 0, TOKEN_ORPHANED, false,
+				"index %v is scheduled on indexer %v which is not in the cluster",
+				token.Definition.Name, token.IndexerId)
+		}
+	}
+
+	for defnId := range state.stopScheduleIds {
+		if state.scheduleTokens[defnId] == nil {
+			report.addFinding("stopScheduleCreate", mc.GetStopScheduleCreateTokenPathFromDefnId(defnId),
+				defnId, 0, TOKEN_ORPHANED, true, "no index is scheduled for creation")
+		}
+	}
+}
+
+// auditDropInstanceTokens finds drop instance tokens of instances that are already dropped,
+// and drop instance tokens of indexes that are still being created.
+func (m *DDLServiceMgr) auditDropInstanceTokens(provider tokenAuditProvider,
+	state *tokenAuditState, report *TokenAuditReport) {
+
+	paths, err := mc.ListDropInstanceCommandTokenPaths()
+	if err != nil {
+		report.addError("Fail to list drop instance tokens: %v", err)
+		return
+	}
+
+	for _, path := range paths {
+		token := &mc.DropInstanceCommandToken{}
+		exists, err := common.MetakvBigValueGet(path, token)
+		if err != nil {
+			report.addError("Fail to fetch drop instance token %v: %v", path, err)
+			continue
+		}
+		if !exists {
+			continue
+		}
+
+		if len(state.createTokens[token.DefnId]) != 0 {
+			// the token cleaner processes the create token first
+			report.addFinding("dropInstance", path, token.DefnId, token.InstId, TOKEN_CONTRADICTORY, false,
+				"index %v is still being created", token.Defn.Name)
+			continue
+		}
+
+		if provider.FindIndexInstanceIgnoreStatus(token.DefnId, token.InstId) == nil {
+			report.addFinding("dropInstance", path, token.DefnId, token.InstId, TOKEN_STALE, true,
+				"instance of index %v is already dropped", token.Defn.Name)
+		}
+	}
+}
+
+// repairTokens repairs the repairable findings of report by deleting their tokens.
+func (m *DDLServiceMgr) repairTokens(provider tokenAuditProvider, report *TokenAuditReport) {
+
+	for _, finding := range report.Findings {
+		if !finding.Repairable {
+			continue
+		}
+
+		// stop on rebalance
+		if !m.canProcessDDL() {
+			report.addError("Rebalance in progress. Repair stopped.")
+			return
+		}
+
+		var err error
+		switch finding.TokenType {
+		case "create":
+			var requestId uint64
+			if _, requestId, err = mc.GetDefnIdFromCreateCommandTokenPath(finding.Path); err == nil {
+				err = mc.DeleteCreateCommandToken(finding.DefnId, requestId)
+			}
+
+		case "build":
+			err = common.MetakvDel(finding.Path)
+
+		case "scheduleCreate":
+			if err = mc.DeleteScheduleCreateToken(finding.DefnId); err == nil {
+				err = mc.DeleteStopScheduleCreateToken(finding.DefnId)
+			}
+
+		case "stopScheduleCreate":
+			err = mc.DeleteStopScheduleCreateToken(finding.DefnId)
+
+		case "dropInstance":
+			// As the token cleaner, update the replica count before removing the token.
+			token := &mc.DropInstanceCommandToken{}
+			var exists bool
+			if exists, err = common.MetakvBigValueGet(finding.Path, token); err == nil && exists {
+				var defn common.IndexDefn
+				defn.DefnId = token.DefnId
+				defn.NumReplica2 = token.Defn.NumReplica2
+
+				if err = provider.BroadcastAlterReplicaCountRequest(&defn); err == nil {
+					err = common.MetakvBigValueDel(finding.Path)
+				}
+			}
+
+		default:
+			err = fmt.Errorf("Unknown token type %v", finding.TokenType)
+		}
+
+		if err != nil {
+			finding.RepairError = err.Error()
+		} else {
+			finding.Repaired = true
+			report.Repaired++
+		}
+	}
+}
+
+// runTokenAuditor audits the DDL tokens every indexer.ddl.tokenAudit.interval seconds, and
+// repairs them if indexer.ddl.tokenAudit.repair is set. Tokens are shared by the cluster, so
+// only the token audit leader (see isTokenAuditLeader) runs the periodic audit.
+func (m *DDLServiceMgr) runTokenAuditor() {
+	const method = "DDLServiceMgr::runTokenAuditor:" // for logging
+
+	logging.Infof("%v Starting", method)
+	lastAudit := time.Now()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+
+		case <-ticker.C:
+			config := m.config.Load()
+			if config == nil {
+				continue
+			}
+
+			interval := time.Duration(config["ddl.tokenAudit.interval"].Int()) * time.Second
+			if interval <= 0 || time.Now().Sub(lastAudit) < interval {
+				continue
+			}
+
+			lastAudit = time.Now()
+
+			leader, err := m.isTokenAuditLeader()
+			if err != nil {
+				logging.Warnf("%v Fail to find the token audit leader: %v. Skipping audit.", method, err)
+				continue
+			}
+			if !leader {
+				continue
+			}
+
+			m.auditTokens(config["ddl.tokenAudit.repair"].Bool())
+
+		case <-m.tokenCleanerStopCh:
+			logging.Infof("%v Shutting down", method)
+			return
+		}
+	}
+}
+
+// isTokenAuditLeader returns true if this indexer has the smallest node UUID of the indexer
+// nodes in the cluster. Every indexer picks the same leader without coordination, so
+// periodic audits do not repair the same tokens concurrently from different nodes.
+func (m *DDLServiceMgr) isTokenAuditLeader() (bool, error) {
+
+	cinfo, err := common.FetchNewClusterInfoCache(m.clusterAddr, common.DEFAULT_POOL, "tokenAuditor")
+	if err != nil {
+		return false, err
+	}
+
+	var nodeUUIDs []string
+	for _, nid := range cinfo.GetNodeIdsByServiceType(common.INDEX_HTTP_SERVICE) {
+		nodeUUIDs = append(nodeUUIDs, cinfo.GetNodeUUID(nid))
+	}
+
+	return tokenAuditLeader(nodeUUIDs) == string(m.nodeID), nil
+}
+
+// tokenAuditLeader returns the smallest of nodeUUIDs, or "" if there is none.
+func tokenAuditLeader(nodeUUIDs []string) string {
+
+	leader := ""
+	for _, nodeUUID := range nodeUUIDs {
+		if len(nodeUUID) != 0 && (len(leader) == 0 || nodeUUID < leader) {
+			leader = nodeUUID
+		}
+	}
+
+	return leader
+}
+
+// handleAuditMetadataTokens handles REST API "/auditMetadataTokens". GET audits the DDL tokens
+// and returns a TokenAuditReport. POST with repair=true also repairs the inconsistent tokens.
+func (m *DDLServiceMgr) handleAuditMetadataTokens(w http.ResponseWriter, r *http.Request) {
+	const method = "DDLServiceMgr::handleAuditMetadataTokens:" // for logging
+
+	creds, valid := m.validateAuth(w, r)
+	if !valid {
+		logging.Errorf("%v Validation Failure req: %v", method, common.GetHTTPReqInfo(r))
+		return
+	}
+
+	repair := false
+	switch r.Method {
+	case "GET":
+		if !isAllowed(creds, []string{"cluster.admin.internal.index!read"}, r, w, method) {
+			return
+		}
+
+	case "POST":
+		if !isAllowed(creds, []string{"cluster.admin.internal.index!write"}, r, w, method) {
+			return
+		}
+		repair = strings.ToLower(r.FormValue("repair")) == "true"
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed\n"))
+		return
+	}
+
+	logging.Infof("%v Processing Request repair %v req: %v", method, repair, common.GetHTTPReqInfo(r))
+
+	report := m.auditTokens(repair)
+	send(http.StatusOK, w, report)
+}
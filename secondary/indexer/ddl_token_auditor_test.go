@@ -0,0 +1,215 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/manager/client"
+	mc "github.com/couchbase/indexing/secondary/manager/common"
+)
+
+type testAuditProvider struct {
+	indexes  map[common.IndexDefnId]*client.IndexMetadata
+	indexers map[common.IndexerId]bool
+}
+
+func (p *testAuditProvider) FindIndexIgnoreStatus(defnId common.IndexDefnId) *client.IndexMetadata {
+	return p.indexes[defnId]
+}
+
+func (p *testAuditProvider) FindIndexInstanceIgnoreStatus(defnId common.IndexDefnId,
+	instId common.IndexInstId) *client.IndexMetadata {
+
+	if index := p.indexes[defnId]; index != nil {
+		for _, inst := range index.Instances {
+			if inst.InstId == instId {
+				return index
+			}
+		}
+	}
+	return nil
+}
+
+func (p *testAuditProvider) FindServiceForIndexer(indexerId common.IndexerId) (string, string, string, error) {
+	if !p.indexers[indexerId] {
+		return "", "", "", errors.New("indexer not found")
+	}
+	return "adminport", "queryport", "httpport", nil
+}
+
+func (p *testAuditProvider) BroadcastAlterReplicaCountRequest(defn *common.IndexDefn) error {
+	return nil
+}
+
+func testAuditIndex(defnId common.IndexDefnId, states ...common.IndexState) *client.IndexMetadata {
+	index := &client.IndexMetadata{Definition: &common.IndexDefn{DefnId: defnId, Name: "idx"}}
+	for i, state := range states {
+		index.Instances = append(index.Instances, &client.InstanceDefn{
+			DefnId: defnId,
+			InstId: common.IndexInstId(int(defnId)*10 + i),
+			State:  state,
+		})
+	}
+	return index
+}
+
+func newTokenAuditState() *tokenAuditState {
+	return &tokenAuditState{
+		createTokens:    make(map[common.IndexDefnId][]string),
+		deleteTokens:    make(map[common.IndexDefnId]*mc.DeleteCommandToken),
+		buildTokens:     make(map[common.IndexDefnId]*mc.BuildCommandToken),
+		scheduleTokens:  make(map[common.IndexDefnId]*mc.ScheduleCreateToken),
+		stopScheduleIds: make(map[common.IndexDefnId]bool),
+	}
+}
+
+// checkFindings compares the findings of report, ordered by token type and defnId,
+// against the expected token type, defnId, problem and repairable.
+func checkFindings(t *testing.T, report *TokenAuditReport, expected []TokenAuditFinding) {
+	t.Helper()
+
+	findings := report.Findings
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].TokenType != findings[j].TokenType {
+			return findings[i].TokenType < findings[j].TokenType
+		}
+		return findings[i].DefnId < findings[j].DefnId
+	})
+
+	if len(findings) != len(expected) {
+		t.Fatalf("expected %v findings, got %v", len(expected), len(findings))
+	}
+	for i, finding := range findings {
+		if finding.TokenType != expected[i].TokenType || finding.DefnId != expected[i].DefnId ||
+			finding.Problem != expected[i].Problem || finding.Repairable != expected[i].Repairable {
+			t.Errorf("finding %v: expected %+v, got %+v", i, expected[i], *finding)
+		}
+	}
+}
+
+func TestTokenAuditLeader(t *testing.T) {
+	if leader := tokenAuditLeader(nil); leader != "" {
+		t.Errorf("expected no leader, got %v", leader)
+	}
+	if leader := tokenAuditLeader([]string{"c3", "", "a1", "b2"}); leader != "a1" {
+		t.Errorf("expected leader a1, got %v", leader)
+	}
+}
+
+func TestAuditBuildTokens(t *testing.T) {
+	provider := &testAuditProvider{indexes: map[common.IndexDefnId]*client.IndexMetadata{
+		3: testAuditIndex(3, common.INDEX_STATE_ACTIVE, common.INDEX_STATE_INITIAL),
+		4: testAuditIndex(4, common.INDEX_STATE_ACTIVE, common.INDEX_STATE_READY),
+	}}
+
+	state := newTokenAuditState()
+	for defnId := common.IndexDefnId(1); defnId <= 5; defnId++ {
+		state.buildTokens[defnId] = &mc.BuildCommandToken{Name: "idx", DefnId: defnId}
+	}
+	state.createTokens[2] = []string{"create/2"}
+	state.scheduleTokens[5] = &mc.ScheduleCreateToken{}
+
+	report := &TokenAuditReport{}
+	(&DDLServiceMgr{}).auditBuildTokens(provider, state, report)
+
+	// 2 and 5 are not created yet, 4 has an instance left to build
+	checkFindings(t, report, []TokenAuditFinding{
+		{TokenType: "build", DefnId: 1, Problem: TOKEN_ORPHANED, Repairable: true},
+		{TokenType: "build", DefnId: 3, Problem: TOKEN_STALE, Repairable: true},
+	})
+}
+
+func TestAuditDeleteTokens(t *testing.T) {
+	provider := &testAuditProvider{indexes: map[common.IndexDefnId]*client.IndexMetadata{
+		3: testAuditIndex(3, common.INDEX_STATE_ACTIVE),
+	}}
+
+	state := newTokenAuditState()
+	for defnId := common.IndexDefnId(1); defnId <= 3; defnId++ {
+		state.deleteTokens[defnId] = &mc.DeleteCommandToken{Name: "idx", DefnId: defnId}
+	}
+	state.createTokens[1] = []string{"create/1"}
+
+	report := &TokenAuditReport{}
+	(&DDLServiceMgr{}).auditDeleteTokens(provider, state, report)
+
+	// 1 is reported with its create token, 3 is still being dropped
+	checkFindings(t, report, []TokenAuditFinding{
+		{TokenType: "delete", DefnId: 2, Problem: TOKEN_STALE, Repairable: false},
+	})
+}
+
+func TestAuditScheduleTokens(t *testing.T) {
+	provider := &testAuditProvider{
+		indexes: map[common.IndexDefnId]*client.IndexMetadata{
+			2: testAuditIndex(2, common.INDEX_STATE_ACTIVE),
+		},
+		indexers: map[common.IndexerId]bool{"indexer1": true},
+	}
+
+	state := newTokenAuditState()
+	for defnId := common.IndexDefnId(1); defnId <= 4; defnId++ {
+		state.scheduleTokens[defnId] = &mc.ScheduleCreateToken{
+			Definition: common.IndexDefn{DefnId: defnId, Name: "idx"},
+			IndexerId:  "indexer1",
+		}
+	}
+	state.deleteTokens[1] = &mc.DeleteCommandToken{DefnId: 1}
+	state.scheduleTokens[3].IndexerId = "indexer2"
+	state.stopScheduleIds[4] = true
+	state.stopScheduleIds[5] = true
+
+	report := &TokenAuditReport{}
+	(&DDLServiceMgr{}).auditScheduleTokens(provider, state, report)
+
+	checkFindings(t, report, []TokenAuditFinding{
+		{TokenType: "scheduleCreate", DefnId: 1, Problem: TOKEN_CONTRADICTORY, Repairable: true},
+		{TokenType: "scheduleCreate", DefnId: 2, Problem: TOKEN_STALE, Repairable: true},
+		{TokenType: "scheduleCreate", DefnId: 3, Problem: TOKEN_ORPHANED, Repairable: false},
+		{TokenType: "stopScheduleCreate", DefnId: 5, Problem: TOKEN_ORPHANED, Repairable: true},
+	})
+}
+
+func TestRepairTokens(t *testing.T) {
+	provider := &testAuditProvider{}
+
+	newReport := func() *TokenAuditReport {
+		report := &TokenAuditReport{Repair: true}
+		report.addFinding("delete", "delete/1", 1, 0, TOKEN_STALE, false, "not repairable")
+		report.addFinding("unknown", "unknown/2", 2, 0, TOKEN_ORPHANED, true, "unknown token")
+		return report
+	}
+
+	// findings that are not repairable are left alone, and a failed repair is
+	// reported with its finding
+	m := &DDLServiceMgr{allowDDL: true}
+	report := newReport()
+	m.repairTokens(provider, report)
+	if report.Repaired != 0 || len(report.Errors) != 0 {
+		t.Errorf("unexpected repair %v, errors %v", report.Repaired, report.Errors)
+	}
+	if report.Findings[0].Repaired || report.Findings[0].RepairError != "" {
+		t.Errorf("expected finding to be left alone, got %+v", *report.Findings[0])
+	}
+	if report.Findings[1].Repaired || report.Findings[1].RepairError == "" {
+		t.Errorf("expected a repair error, got %+v", *report.Findings[1])
+	}
+
+	// repair stops on rebalance
+	m.stopProcessDDL()
+	report = newReport()
+	m.repairTokens(provider, report)
+	if len(report.Errors) != 1 || report.Findings[1].RepairError != "" {
+		t.Errorf("expected repair to stop, got errors %v, %+v", report.Errors, *report.Findings[1])
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// Disk fault injection for resilience testing. Faults are injected by the
+// iowrap package and are configured either by the
+// indexer.iowrap.fault_injection.* settings, or by the unit test REST API
+// /test/faultInjection. A config update overrides faults set over REST.
+
+// getFaultConfig returns the faults to inject configured in config.
+func getFaultConfig(config common.Config) *iowrap.FaultConfig {
+	return &iowrap.FaultConfig{
+		PathFilter:       config["iowrap.fault_injection.path_filter"].String(),
+		FailNthWrite:     int64(config["iowrap.fault_injection.fail_nth_write"].Int()),
+		EnospcAfterBytes: int64(config["iowrap.fault_injection.enospc_after_bytes"].Int()),
+		SyncDelayMs:      int64(config["iowrap.fault_injection.fsync_delay_ms"].Int()),
+		CorruptNthRead:   int64(config["iowrap.fault_injection.corrupt_nth_read"].Int()),
+	}
+}
+
+// updateFaultInjection sets the faults to inject if they changed in
+// newConfig. oldConfig is nil on startup.
+func updateFaultInjection(oldConfig, newConfig common.Config) {
+
+	newFaults := getFaultConfig(newConfig)
+	if oldConfig != nil && *getFaultConfig(oldConfig) == *newFaults {
+		return
+	}
+	if oldConfig == nil && !newFaults.Enabled() {
+		return
+	}
+
+	if newFaults.Enabled() {
+		logging.Warnf("Indexer::updateFaultInjection injecting disk faults %+v", *newFaults)
+	} else {
+		logging.Infof("Indexer::updateFaultInjection disk fault injection disabled")
+	}
+	iowrap.SetFaultConfig(newFaults)
+}
+
+// FaultInjectionResponse is the response of the /test/faultInjection REST API.
+type FaultInjectionResponse struct {
+	Code         string              `json:"code"`
+	Error        string              `json:"error,omitempty"`
+	Config       *iowrap.FaultConfig `json:"config,omitempty"`
+	Stats        *iowrap.FaultStats  `json:"stats,omitempty"`
+	DiskFailures uint64              `json:"diskFailures"`
+}
+
+// testFaultInjection handles unit test REST API "/test/faultInjection".
+// GET returns the faults being injected along with the stats of injected
+// faults, POST sets the faults to inject from an iowrap.FaultConfig in JSON
+// and DELETE disables fault injection.
+func (idx *indexer) testFaultInjection(w http.ResponseWriter, r *http.Request) {
+	const _testFaultInjection = "Indexer::testFaultInjection:"
+
+	creds, ok := doAuth(r, w, _testFaultInjection)
+	if !ok {
+		return
+	}
+
+	permission := "cluster.admin.internal.index!write"
+	if r.Method == "GET" {
+		permission = "cluster.admin.internal.index!read"
+	}
+	if !isAllowed(creds, []string{permission}, r, w, _testFaultInjection) {
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+
+	case "POST":
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			resp := &FaultInjectionResponse{Code: RESP_ERROR, Error: err.Error()}
+			rhSend(http.StatusBadRequest, w, resp)
+			return
+		}
+
+		var config iowrap.FaultConfig
+		if err := json.Unmarshal(bytes, &config); err != nil {
+			resp := &FaultInjectionResponse{Code: RESP_ERROR, Error: err.Error()}
+			rhSend(http.StatusBadRequest, w, resp)
+			return
+		}
+
+		logging.Warnf("%v injecting disk faults %+v", _testFaultInjection, config)
+		iowrap.SetFaultConfig(&config)
+
+	case "DELETE":
+		logging.Infof("%v disk fault injection disabled", _testFaultInjection)
+		iowrap.SetFaultConfig(nil)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method not allowed\n"))
+		return
+	}
+
+	stats := iowrap.GetFaultStats()
+	resp := &FaultInjectionResponse{
+		Code:         RESP_SUCCESS,
+		Config:       iowrap.GetFaultConfig(),
+		Stats:        &stats,
+		DiskFailures: iowrap.GetDiskFailures(),
+	}
+	rhSend(http.StatusOK, w, resp)
+}
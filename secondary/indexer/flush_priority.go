@@ -0,0 +1,204 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//////////////////////////////////////////////////////////////////
+// Flush priority
+//////////////////////////////////////////////////////////////////
+
+//
+// Indexes are flushed with one of two priority classes.  Latency-critical
+// indexes, the default, get a new in-memory snapshot on every flush of their
+// keyspace stream.  Best-effort indexes get a new in-memory snapshot at most
+// once every indexer.settings.flush.best_effort_snapshot_interval, and only
+// once they have applied all the mutations flushed to them.
+//
+// A best-effort index does not hold back the flush of its keyspace stream.
+// While it is slow to apply its mutations, the flush completes without
+// waiting for it, and the index keeps its last snapshot, along with its
+// timestamp, so that its snapshot timestamp lags behind the one of its
+// keyspace.  A best-effort index still holds back its keyspace when its
+// write queue (indexer.settings.sliceBufSize) is full, and at disk snapshots,
+// which are always taken for all indexes.  A best-effort index is never given
+// a snapshot that is not consistent with its timestamp.  The flush_lag stat
+// is how long the snapshot of a best-effort index has been lagging behind.
+//
+// Priority classes are assigned by rules, a JSON array in the setting
+// indexer.settings.flush.priority_rules, e.g.
+//
+//   [{"bucket": "archive", "priority": "best_effort"},
+//    {"bucket": "archive", "scope": "s1", "index": "idx_recent", "priority": "latency_critical"}]
+//
+// The most specific matching rule applies, as for compaction policies.
+//
+
+const (
+	FLUSH_PRIORITY_LATENCY_CRITICAL = "latency_critical"
+	FLUSH_PRIORITY_BEST_EFFORT      = "best_effort"
+)
+
+type flushPriorityRule struct {
+	indexMatcher
+	Priority string `json:"priority"`
+}
+
+func parseFlushPriorityRules(value string) ([]*flushPriorityRule, error) {
+
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil, nil
+	}
+
+	var rules []*flushPriorityRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("Flush priority rules must be a JSON array of rules: %v", err)
+	}
+
+	for i, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("Flush priority rule #%v is null", i)
+		}
+		if err := rule.indexMatcher.validate(); err != nil {
+			return nil, fmt.Errorf("Flush priority rule #%v: %v", i, err)
+		}
+		if rule.Priority != FLUSH_PRIORITY_LATENCY_CRITICAL && rule.Priority != FLUSH_PRIORITY_BEST_EFFORT {
+			return nil, fmt.Errorf("Flush priority rule #%v: invalid priority %v, must be one of (%v, %v)",
+				i, rule.Priority, FLUSH_PRIORITY_LATENCY_CRITICAL, FLUSH_PRIORITY_BEST_EFFORT)
+		}
+	}
+
+	return rules, nil
+}
+
+//
+// flushPriorities holds the current flush priority settings.
+//
+type flushPriorities struct {
+	rules              []*flushPriorityRule
+	bestEffortInterval time.Duration
+}
+
+// flushPrioritiesPtr is really a *flushPriorities, nil if no rules are set.
+var flushPrioritiesPtr unsafe.Pointer
+
+func getFlushPriorities() *flushPriorities {
+	return (*flushPriorities)(atomic.LoadPointer(&flushPrioritiesPtr))
+}
+
+//
+// updateFlushPriorities sets the flush priority rules if they changed in
+// newConfig. oldConfig is nil on startup.
+//
+func updateFlushPriorities(oldConfig, newConfig common.Config) {
+
+	value := newConfig["settings.flush.priority_rules"].String()
+	interval := newConfig["settings.flush.best_effort_snapshot_interval"].Uint64()
+	if oldConfig != nil &&
+		value == oldConfig["settings.flush.priority_rules"].String() &&
+		interval == oldConfig["settings.flush.best_effort_snapshot_interval"].Uint64() {
+		return
+	}
+
+	rules, err := parseFlushPriorityRules(value)
+	if err != nil {
+		// settings are validated, only an invalid value from an older version can fail
+		logging.Errorf("Indexer::updateFlushPriorities %v. Flush priority rules ignored.", err)
+		rules = nil
+	}
+
+	var fp *flushPriorities
+	if len(rules) != 0 {
+		fp = &flushPriorities{
+			rules:              rules,
+			bestEffortInterval: time.Duration(interval) * time.Millisecond,
+		}
+	}
+
+	if oldConfig != nil || fp != nil {
+		logging.Infof("Indexer::updateFlushPriorities rules %v, best effort snapshot interval %vms",
+			value, interval)
+	}
+	atomic.StorePointer(&flushPrioritiesPtr, unsafe.Pointer(fp))
+}
+
+//
+// isBestEffort returns true if the index instance is flushed best-effort.
+//
+func (fp *flushPriorities) isBestEffort(inst *common.IndexInst) bool {
+
+	if fp == nil {
+		return false
+	}
+
+	var result *flushPriorityRule
+	defn := &inst.Defn
+	for _, rule := range fp.rules {
+		if rule.matches(defn.Bucket, defn.Scope, defn.Collection, defn.Name) {
+			if result == nil || rule.specificity() > result.specificity() {
+				result = rule
+			}
+		}
+	}
+	return result != nil && result.Priority == FLUSH_PRIORITY_BEST_EFFORT
+}
+
+//
+// skipFactor returns the number of in-memory snapshots to skip between
+// in-memory snapshots of a MAINT_STREAM keyspace with only best-effort
+// indexes, taken every snapInterval, so that they are taken about once every
+// best-effort snapshot interval.
+//
+func (fp *flushPriorities) skipFactor(indexInstMap common.IndexInstMap,
+	streamId common.StreamId, keyspaceId string, snapInterval time.Duration) uint64 {
+
+	if streamId != common.MAINT_STREAM || !fp.allBestEffort(indexInstMap, streamId, keyspaceId) {
+		return 0
+	}
+
+	if snapInterval <= 0 || fp.bestEffortInterval <= snapInterval {
+		return 0
+	}
+	return uint64(fp.bestEffortInterval/snapInterval) - 1
+}
+
+//
+// allBestEffort returns true if all the indexes of the keyspace in the stream
+// are best-effort, and so the keyspace stream only needs an in-memory snapshot
+// every best-effort snapshot interval.
+//
+func (fp *flushPriorities) allBestEffort(indexInstMap common.IndexInstMap,
+	streamId common.StreamId, keyspaceId string) bool {
+
+	if fp == nil {
+		return false
+	}
+
+	found := false
+	for _, inst := range indexInstMap {
+		if inst.Stream == streamId && inst.Defn.KeyspaceId(inst.Stream) == keyspaceId &&
+			inst.State != common.INDEX_STATE_DELETED {
+			if !fp.isBestEffort(&inst) {
+				return false
+			}
+			found = true
+		}
+	}
+	return found
+}
@@ -0,0 +1,245 @@
+package indexer
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func flushPriorityInst(bucket, scope, collection, name string) common.IndexInst {
+	return common.IndexInst{
+		Defn: common.IndexDefn{
+			Bucket:     bucket,
+			Scope:      scope,
+			Collection: collection,
+			Name:       name,
+		},
+		Stream: common.MAINT_STREAM,
+		State:  common.INDEX_STATE_ACTIVE,
+	}
+}
+
+func TestParseFlushPriorityRules(t *testing.T) {
+
+	valid := []string{
+		"",
+		"  ",
+		"[]",
+		`[{"bucket": "b1", "priority": "best_effort"}]`,
+		`[{"priority": "latency_critical"}]`,
+		`[{"bucket": "b1", "scope": "s1", "collection": "c1", "index": "i1", "priority": "best_effort"}]`,
+	}
+	for _, value := range valid {
+		if _, err := parseFlushPriorityRules(value); err != nil {
+			t.Errorf("parseFlushPriorityRules(%q) unexpected error %v", value, err)
+		}
+	}
+
+	invalid := []string{
+		"{}",
+		"[null]",
+		`[{"bucket": "b1"}]`,
+		`[{"bucket": "b1", "priority": "fast"}]`,
+		`[{"scope": "s1", "priority": "best_effort"}]`,
+		`[{"index": "i1", "priority": "best_effort"}]`,
+	}
+	for _, value := range invalid {
+		if _, err := parseFlushPriorityRules(value); err == nil {
+			t.Errorf("parseFlushPriorityRules(%q) expected an error", value)
+		}
+	}
+
+	rules, err := parseFlushPriorityRules(
+		`[{"bucket": "b1", "priority": "best_effort"}, {"bucket": "b1", "index": "i1", "priority": "latency_critical"}]`)
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("parseFlushPriorityRules unexpected result %v, %v", rules, err)
+	}
+	if rules[0].Bucket != "b1" || rules[0].Priority != FLUSH_PRIORITY_BEST_EFFORT ||
+		rules[1].Index != "i1" || rules[1].Priority != FLUSH_PRIORITY_LATENCY_CRITICAL {
+		t.Errorf("parseFlushPriorityRules unexpected rules %+v, %+v", rules[0], rules[1])
+	}
+}
+
+func TestIsBestEffort(t *testing.T) {
+
+	var none *flushPriorities
+	inst := flushPriorityInst("b1", "s1", "c1", "i1")
+	if none.isBestEffort(&inst) {
+		t.Errorf("isBestEffort expected false without rules")
+	}
+
+	rules, err := parseFlushPriorityRules(`[
+		{"bucket": "b1", "priority": "best_effort"},
+		{"bucket": "b1", "scope": "s1", "collection": "c1", "priority": "latency_critical"},
+		{"bucket": "b1", "scope": "s1", "collection": "c1", "index": "i2", "priority": "best_effort"},
+		{"bucket": "b2", "index": "i1", "priority": "best_effort"}]`)
+	if err != nil {
+		t.Fatalf("parseFlushPriorityRules unexpected error %v", err)
+	}
+	fp := &flushPriorities{rules: rules, bestEffortInterval: 5 * time.Second}
+
+	tests := []struct {
+		inst       common.IndexInst
+		bestEffort bool
+	}{
+		// bucket rule
+		{flushPriorityInst("b1", "s2", "c1", "i1"), true},
+		// collection rule is more specific than the bucket rule
+		{flushPriorityInst("b1", "s1", "c1", "i1"), false},
+		// index rule is more specific than the collection rule
+		{flushPriorityInst("b1", "s1", "c1", "i2"), true},
+		// index name rule in any collection of the bucket
+		{flushPriorityInst("b2", "s1", "c1", "i1"), true},
+		{flushPriorityInst("b2", "s1", "c1", "i2"), false},
+		// no matching rule
+		{flushPriorityInst("b3", "s1", "c1", "i1"), false},
+	}
+	for _, test := range tests {
+		if got := fp.isBestEffort(&test.inst); got != test.bestEffort {
+			t.Errorf("isBestEffort(%v:%v:%v:%v) = %v, expected %v", test.inst.Defn.Bucket,
+				test.inst.Defn.Scope, test.inst.Defn.Collection, test.inst.Defn.Name, got, test.bestEffort)
+		}
+	}
+}
+
+func TestFlushPrioritySkipFactor(t *testing.T) {
+
+	rules, err := parseFlushPriorityRules(`[{"bucket": "b1", "priority": "best_effort"}]`)
+	if err != nil {
+		t.Fatalf("parseFlushPriorityRules unexpected error %v", err)
+	}
+	fp := &flushPriorities{rules: rules, bestEffortInterval: 5 * time.Second}
+
+	indexInstMap := common.IndexInstMap{
+		1: flushPriorityInst("b1", "s1", "c1", "i1"),
+		2: flushPriorityInst("b1", "s1", "c2", "i2"),
+		3: flushPriorityInst("b2", "s1", "c1", "i3"),
+	}
+
+	if !fp.allBestEffort(indexInstMap, common.MAINT_STREAM, "b1") {
+		t.Errorf("allBestEffort expected true for b1")
+	}
+	if fp.allBestEffort(indexInstMap, common.MAINT_STREAM, "b2") {
+		t.Errorf("allBestEffort expected false for b2")
+	}
+	if fp.allBestEffort(indexInstMap, common.MAINT_STREAM, "b3") {
+		t.Errorf("allBestEffort expected false for a keyspace without indexes")
+	}
+
+	tests := []struct {
+		streamId     common.StreamId
+		keyspaceId   string
+		snapInterval time.Duration
+		skip         uint64
+	}{
+		{common.MAINT_STREAM, "b1", 200 * time.Millisecond, 24},
+		{common.MAINT_STREAM, "b1", 300 * time.Millisecond, 15},
+		{common.MAINT_STREAM, "b1", 5 * time.Second, 0},
+		{common.MAINT_STREAM, "b1", 10 * time.Second, 0},
+		{common.MAINT_STREAM, "b1", 0, 0},
+		// a latency-critical index in the keyspace
+		{common.MAINT_STREAM, "b2", 200 * time.Millisecond, 0},
+		// only MAINT_STREAM snapshots are skipped
+		{common.INIT_STREAM, "b1", 200 * time.Millisecond, 0},
+	}
+	for _, test := range tests {
+		skip := fp.skipFactor(indexInstMap, test.streamId, test.keyspaceId, test.snapInterval)
+		if skip != test.skip {
+			t.Errorf("skipFactor(%v, %v, %v) = %v, expected %v",
+				test.streamId, test.keyspaceId, test.snapInterval, skip, test.skip)
+		}
+	}
+
+	// adding a latency-critical index to the keyspace stops skipping
+	fp.rules = append(fp.rules, &flushPriorityRule{
+		indexMatcher: indexMatcher{Bucket: "b1", Index: "i4"},
+		Priority:     FLUSH_PRIORITY_LATENCY_CRITICAL,
+	})
+	indexInstMap[4] = flushPriorityInst("b1", "s1", "c1", "i4")
+	if skip := fp.skipFactor(indexInstMap, common.MAINT_STREAM, "b1", 200*time.Millisecond); skip != 0 {
+		t.Errorf("skipFactor expected 0 with a latency-critical index, got %v", skip)
+	}
+
+	var none *flushPriorities
+	if skip := none.skipFactor(indexInstMap, common.MAINT_STREAM, "b1", 200*time.Millisecond); skip != 0 {
+		t.Errorf("skipFactor expected 0 without rules, got %v", skip)
+	}
+}
+
+type pendingTestSlice struct {
+	Slice
+	pending bool
+}
+
+func (s *pendingTestSlice) checkAllWorkersDone() bool { return !s.pending }
+
+func TestDeferBestEffortSnapshot(t *testing.T) {
+
+	rules, err := parseFlushPriorityRules(`[{"bucket": "b1", "priority": "best_effort"}]`)
+	if err != nil {
+		t.Fatalf("parseFlushPriorityRules unexpected error %v", err)
+	}
+	fp := &flushPriorities{rules: rules, bestEffortInterval: time.Hour}
+	atomic.StorePointer(&flushPrioritiesPtr, unsafe.Pointer(fp))
+	defer atomic.StorePointer(&flushPrioritiesPtr, nil)
+
+	slice := &pendingTestSlice{pending: true}
+	sc := NewHashedSliceContainer()
+	sc.AddSlice(0, slice)
+	partnMap := PartitionInstMap{0: PartitionInst{Sc: sc}}
+
+	lastIndexSnap := &indexSnapshot{
+		partns: map[common.PartitionId]PartitionSnapshot{0: &partitionSnapshot{}},
+	}
+	idxStats := &IndexStats{}
+	idxStats.Init()
+
+	s := &storageMgr{}
+	inst := flushPriorityInst("b1", "s1", "c1", "i1")
+	now := time.Now().UnixNano()
+
+	// the snapshot is deferred while writes are pending, even past the interval
+	idxStats.lastTsTime.Set(now - int64(2*time.Hour))
+	if !s.deferSnapshot(common.MAINT_STREAM, &inst, partnMap, lastIndexSnap, idxStats, false) {
+		t.Fatalf("expected the snapshot to be deferred with pending writes")
+	}
+	since := idxStats.flushLagSince.Value()
+	if since < now {
+		t.Errorf("expected the flush lag to start, got %v", since)
+	}
+	if s.deferSnapshot(common.MAINT_STREAM, &inst, partnMap, lastIndexSnap, idxStats, true) {
+		t.Errorf("expected disk snapshots not to be deferred")
+	}
+	if idxStats.flushLagSince.Value() != 0 {
+		t.Errorf("expected no flush lag after a snapshot")
+	}
+
+	// the flush lag is since the first deferred flush
+	s.deferSnapshot(common.MAINT_STREAM, &inst, partnMap, lastIndexSnap, idxStats, false)
+	since = idxStats.flushLagSince.Value()
+	s.deferSnapshot(common.MAINT_STREAM, &inst, partnMap, lastIndexSnap, idxStats, false)
+	if idxStats.flushLagSince.Value() != since || idxStats.numSnapshotsDeferred.Value() != 3 {
+		t.Errorf("unexpected flush lag since %v, deferred %v", idxStats.flushLagSince.Value(),
+			idxStats.numSnapshotsDeferred.Value())
+	}
+
+	// once the writes are applied, the snapshot waits for the interval
+	slice.pending = false
+	if s.deferSnapshot(common.MAINT_STREAM, &inst, partnMap, lastIndexSnap, idxStats, false) {
+		t.Errorf("expected a snapshot once writes are applied past the interval")
+	}
+	idxStats.lastTsTime.Set(now)
+	if !s.deferSnapshot(common.MAINT_STREAM, &inst, partnMap, lastIndexSnap, idxStats, false) {
+		t.Errorf("expected the snapshot to be deferred within the interval")
+	}
+
+	// latency-critical indexes are never deferred
+	slice.pending = true
+	other := flushPriorityInst("b2", "s1", "c1", "i2")
+	if s.deferSnapshot(common.MAINT_STREAM, &other, partnMap, lastIndexSnap, idxStats, false) {
+		t.Errorf("expected the snapshot of a latency-critical index not to be deferred")
+	}
+}
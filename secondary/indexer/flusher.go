@@ -635,11 +635,7 @@ func (f *flusher) GetQueueHWT(q MutationQueue) Timestamp {
 	ts := NewTimestamp(int(q.GetNumVbuckets()))
 	var i uint16
 	for i = 0; i < q.GetNumVbuckets(); i++ {
-		if mut := q.PeekTail(Vbucket(i)); mut != nil {
-			ts[i] = mut.meta.seqno
-		} else {
-			ts[i] = 0
-		}
+		ts[i] = q.PeekTailSeqno(Vbucket(i))
 	}
 	return ts
 }
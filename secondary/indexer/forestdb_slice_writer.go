@@ -13,6 +13,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -21,11 +22,11 @@ import (
 	"sync/atomic"
 
 	"github.com/couchbase/indexing/secondary/common"
-	"github.com/couchbase/indexing/secondary/common/queryutil"
 	forestdb "github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/iowrap"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/natsort"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 )
 
 var (
@@ -85,6 +86,11 @@ func NewForestDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 	kvconfig := forestdb.DefaultKVStoreConfig()
 
 retry:
+	if err = fdb.initEncryption(path, filepath, config); err != nil {
+		logging.Errorf("NewForestDBSlice(): failed to setup encryption of %v: %v", filepath, err)
+		return nil, err
+	}
+
 	if fdb.dbfile, err = forestdb.Open(filepath, config); err != nil {
 		if err == forestdb.FDB_RESULT_NO_DB_HEADERS {
 			logging.Warnf("NewForestDBSlice(): Open failed with no_db_header error...Resetting the forestdb file")
@@ -154,7 +160,7 @@ retry:
 	fdb.id = sliceId
 
 	// Array related initialization
-	_, fdb.isArrayDistinct, fdb.isArrayFlattened, fdb.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+	_, fdb.isArrayDistinct, fdb.isArrayFlattened, fdb.arrayExprPosition, err = getArrayExpressionPosition(idxDefn)
 	if err != nil {
 		return nil, err
 	}
@@ -264,6 +270,9 @@ type fdbSlice struct {
 
 	keySzConf        keySizeConfig
 	keySzConfChanged int32 //0 or 1: indicates if key size config has changeed or not
+
+	// key the data file is encrypted with, nil if not encrypted
+	encryptionKey atomic.Value
 }
 
 func (fdb *fdbSlice) IncrRef() {
@@ -1487,8 +1496,16 @@ snaploop:
 
 	fdb.currfile = newpath
 
+	// re-encrypt the compacted file if the active key has changed
+	if err := fdb.rotateEncryptionKey(); err != nil {
+		logging.Errorf("ForestDBSlice::Compact failed to rotate encryption key. "+
+			"Slice Id %v, IndexInstId %v, IndexDefnId %v. Error %v", fdb.id,
+			fdb.idxInstId, fdb.idxDefnId, err)
+	}
+
 	config := forestdb.DefaultConfig()
 	config.SetOpenFlags(forestdb.OPEN_FLAG_RDONLY)
+	fdb.setEncryptionKey(config)
 
 	fdb.statFdLock.Lock()
 	fdb.statFd.Close()
@@ -1539,6 +1556,8 @@ func (fdb *fdbSlice) Statistics(consumerFilter uint64) (StorageStatistics, error
 	sts.NeedUpgrade = fdb.fileVersion < forestdb.FdbV2FileVersion
 	fdb.statFdLock.Unlock()
 
+	sts.EncryptionStatus = encryption.GetStatus(fdb.encryptionKeyId())
+
 	sts.DiskSize = sz
 	sts.LogSpace = sts.DiskSize
 	sts.ExtraSnapDataSize = extraSnapDataSize
@@ -1742,6 +1761,148 @@ func newFdbFile(dirpath string, newVersion bool) string {
 	return filepath.Join(dirpath, newFilename)
 }
 
+// The ids of the keys a data file may be encrypted with are recorded in a
+// file alongside the data file, most recent key first. There is more than
+// one id only while the data file is being re-encrypted with a new key.
+const fdbEncryptionKeyIdFile = "encryption_key_id"
+
+func readFdbEncryptionKeyIds(dirpath string) ([]string, error) {
+	data, err := iowrap.Ioutil_ReadFile(filepath.Join(dirpath, fdbEncryptionKeyIdFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(string(data)), nil
+}
+
+func writeFdbEncryptionKeyIds(dirpath string, keyIds []string) error {
+	path := filepath.Join(dirpath, fdbEncryptionKeyIdFile)
+	tmppath := path + ".tmp"
+	if err := iowrap.Ioutil_WriteFile(tmppath, []byte(strings.Join(keyIds, "\n")), 0644); err != nil {
+		return err
+	}
+	return iowrap.Os_Rename(tmppath, path)
+}
+
+//initEncryption sets the key the data file is encrypted with in config.
+//A new data file is encrypted with the active key if encryption is
+//enabled. An existing data file keeps its key until it is re-encrypted
+//on compaction.
+func (fdb *fdbSlice) initEncryption(dirpath, datafile string, config *forestdb.Config) error {
+
+	keyIds, err := readFdbEncryptionKeyIds(dirpath)
+	if err != nil {
+		return err
+	}
+
+	provider := encryption.GetKeyProvider()
+	if len(keyIds) == 0 {
+		if provider == nil {
+			return nil
+		}
+		if _, err := iowrap.Os_Stat(datafile); err == nil {
+			// existing plaintext data file
+			return nil
+		}
+		key, err := provider.ActiveKey()
+		if err != nil {
+			return err
+		}
+		if err := writeFdbEncryptionKeyIds(dirpath, []string{key.Id}); err != nil {
+			return err
+		}
+		keyIds = []string{key.Id}
+	}
+
+	if provider == nil {
+		return fmt.Errorf("%v: data file is encrypted with key %v", encryption.ErrProviderDisabled, keyIds[0])
+	}
+
+	// A crash during re-encryption leaves the data file encrypted with
+	// either key, find the one that opens the file.
+	for i, keyId := range keyIds {
+		key, kerr := provider.GetKey(keyId)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+
+		if len(keyIds) > 1 {
+			probe := forestdb.DefaultConfig()
+			probe.SetOpenFlags(forestdb.OPEN_FLAG_RDONLY)
+			probe.SetEncryptionKey(key.Bytes)
+			f, ferr := forestdb.Open(datafile, probe)
+			if ferr != nil {
+				err = ferr
+				continue
+			}
+			f.Close()
+			if err := writeFdbEncryptionKeyIds(dirpath, keyIds[i:i+1]); err != nil {
+				return err
+			}
+		}
+
+		config.SetEncryptionKey(key.Bytes)
+		fdb.encryptionKey.Store(key)
+		return nil
+	}
+	return err
+}
+
+//rotateEncryptionKey re-encrypts the data file with the active key, if the
+//file is not encrypted with it already
+func (fdb *fdbSlice) rotateEncryptionKey() error {
+
+	provider := encryption.GetKeyProvider()
+	if provider == nil {
+		return nil
+	}
+	key, err := provider.ActiveKey()
+	if err != nil {
+		return err
+	}
+
+	keyIds := []string{key.Id}
+	if currKeyId := fdb.encryptionKeyId(); currKeyId == key.Id {
+		return nil
+	} else if len(currKeyId) != 0 {
+		keyIds = append(keyIds, currKeyId)
+	}
+
+	if err := writeFdbEncryptionKeyIds(fdb.path, keyIds); err != nil {
+		return err
+	}
+	if err := fdb.compactFd.Rekey(key.Bytes); err != nil {
+		return err
+	}
+	fdb.encryptionKey.Store(key)
+
+	// rekey rewrites the data file to its next version
+	if info, err := fdb.compactFd.Info(); err == nil {
+		fdb.currfile = info.Filename()
+	}
+
+	logging.Infof("ForestDBSlice::rotateEncryptionKey Re-encrypted data file %v with key %v. "+
+		"Slice Id %v, IndexInstId %v", fdb.currfile, key.Id, fdb.id, fdb.idxInstId)
+
+	return writeFdbEncryptionKeyIds(fdb.path, keyIds[:1])
+}
+
+func (fdb *fdbSlice) setEncryptionKey(config *forestdb.Config) {
+	if key, ok := fdb.encryptionKey.Load().(*encryption.Key); ok && key != nil {
+		config.SetEncryptionKey(key.Bytes)
+	}
+}
+
+func (fdb *fdbSlice) encryptionKeyId() string {
+	if key, ok := fdb.encryptionKey.Load().(*encryption.Key); ok && key != nil {
+		return key.Id
+	}
+	return ""
+}
+
 func (fdb *fdbSlice) logWriterStat() {
 	count := atomic.AddUint64(&fdb.flushedCount, 1)
 	if (count%10000 == 0) || count == 1 {
@@ -1853,6 +2014,7 @@ func (fdb *fdbSlice) cancelCompact() {
 
 	//open a separate file handle for cancel compaction
 	config := forestdb.DefaultConfig()
+	fdb.setEncryptionKey(config)
 	if tempFd, err = forestdb.Open(fdb.currfile, config); err != nil {
 		logging.Errorf("ForestDBSlice::cancelCompact Error Opening DB %v %v", err,
 			fdb.idxInstId)
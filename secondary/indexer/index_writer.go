@@ -38,6 +38,9 @@ type StorageStatistics struct {
 
 	NeedUpgrade bool
 
+	// encryption status of the index data, see encryption.GetStatus
+	EncryptionStatus string
+
 	InternalData    []string
 	InternalDataMap map[string]interface{}
 
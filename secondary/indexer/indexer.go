@@ -42,6 +42,7 @@ import (
 	"github.com/couchbase/indexing/secondary/memdb/nodetable"
 	projClient "github.com/couchbase/indexing/secondary/projector/client"
 	"github.com/couchbase/indexing/secondary/security"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 	"github.com/couchbase/indexing/secondary/stubs/nitro/mm"
 	"github.com/couchbase/indexing/secondary/stubs/nitro/plasma"
 )
@@ -394,6 +395,24 @@ func NewIndexer(config common.Config) (Indexer, Message) {
 		return nil, &MsgError{err: idxErr}
 	}
 
+	//Initialize encryption at rest of index storage
+	keyProvider := config["encryption.keyProvider"].String()
+	err = encryption.Init(keyProvider, config["encryption.keyProviderConfig"].String())
+	if err != nil {
+		logging.Errorf("Indexer::NewIndexer failed to initialize key provider %v: %v", keyProvider, err)
+		idxErr := Error{
+			code:     ERROR_INDEXER_INTERNAL_ERROR,
+			severity: FATAL,
+			cause:    err,
+			category: INDEXER,
+		}
+		return nil, &MsgError{err: idxErr}
+	}
+
+	updateFaultInjection(nil, config)
+	updateAuditFilter(nil, config)
+	updateFlushPriorities(nil, config)
+
 	idx.stats = NewIndexerStats()
 	idx.initFromConfig()
 
@@ -819,6 +838,10 @@ func (idx *indexer) initHTTPMux() {
 	idx.settingsMgr.RegisterRestEndpoints()
 	idx.statsMgr.RegisterRestEndpoints()
 	idx.clustMgrAgent.RegisterRestEndpoints()
+	idx.compactMgr.RegisterRestEndpoints()
+
+	// Unit test REST APIs -- THESE MUST STILL DO AUTHENTICATION!!
+	httpMux.HandleFunc("/test/faultInjection", idx.testFaultInjection)
 }
 
 func (idx *indexer) initPeriodicProfile() {
@@ -1637,7 +1660,10 @@ func (idx *indexer) updateStorageMode(newConfig common.Config) {
 
 	if common.GetStorageMode() == common.NOT_SET {
 		if confStorageMode != "" {
-			if idx.canSetStorageMode(confStorageMode) {
+			if err := checkEncryptionSupport(s); err != nil {
+				logging.Errorf("Indexer::updateStorageMode Ignore New Storage Mode %v. %v", confStorageMode, err)
+				common.Console(idx.config["clusterAddr"].String(), "%v", err)
+			} else if idx.canSetStorageMode(confStorageMode) {
 				if common.SetStorageModeStr(confStorageMode) {
 					//restart is only required for ForestDB storage engine
 					//to initialize the buffer cache correctly
@@ -1663,6 +1689,9 @@ func (idx *indexer) updateStorageMode(newConfig common.Config) {
 			if idx.checkAnyValidIndex() {
 				logging.Warnf("Indexer::updateStorageMode Ignore New Storage Mode %v. Already Set %v. Valid Indexes Found.",
 					confStorageMode, common.GetStorageMode())
+			} else if err := checkEncryptionSupport(s); err != nil {
+				logging.Errorf("Indexer::updateStorageMode Ignore New Storage Mode %v. %v", confStorageMode, err)
+				common.Console(idx.config["clusterAddr"].String(), "%v", err)
 			} else {
 				if common.SetStorageModeStr(confStorageMode) {
 					logging.Infof("Indexer::updateStorageMode Storage Mode Set %v. Restarting indexer", common.GetStorageMode())
@@ -1684,6 +1713,9 @@ func (idx *indexer) handleConfigUpdate(msg Message) {
 	newConfig := cfgUpdate.GetConfig()
 
 	idx.updateStorageMode(newConfig)
+	updateFaultInjection(oldConfig, newConfig)
+	updateAuditFilter(oldConfig, newConfig)
+	updateFlushPriorities(oldConfig, newConfig)
 
 	if newConfig["settings.memory_quota"].Uint64() !=
 		oldConfig["settings.memory_quota"].Uint64() {
@@ -8521,12 +8553,29 @@ func (idx *indexer) genIndexerId() {
 
 }
 
+//checkEncryptionSupport returns an error if encryption at rest is enabled
+//and the storage mode does not support it. Plasma does not encrypt its files,
+//so the indexer refuses to run plasma indexes with encryption enabled rather
+//than storing them in plaintext.
+func checkEncryptionSupport(storageMode common.StorageMode) error {
+	if storageMode == common.PLASMA && encryption.Enabled() {
+		return fmt.Errorf("Encryption at rest is not supported with storage mode %v. "+
+			"Unset indexer.encryption.keyProvider or use another storage mode.", storageMode)
+	}
+	return nil
+}
+
 func (idx *indexer) initFromPersistedState() error {
 
 	// Set the storage mode specific to this indexer node
 	common.SetStorageMode(idx.getLocalStorageMode(idx.config))
 	initBufPools(idx.config)
 	logging.Infof("Indexer::local storage mode %v", common.GetStorageMode().String())
+	if err := checkEncryptionSupport(common.GetStorageMode()); err != nil {
+		logging.Fatalf("Indexer::initFromPersistedState %v", err)
+		common.Console(idx.config["clusterAddr"].String(), "%v", err)
+		return err
+	}
 
 	bootstrapStats := NewIndexerStats()
 
@@ -1610,6 +1610,7 @@ func convertIndexDefnToProtobuf(indexDefn c.IndexDefn) *protobuf.IndexDefn {
 		Collection:             proto.String(indexDefn.Collection),
 		CollectionID:           proto.String(indexDefn.CollectionId),
 		IndexMissingLeadingKey: proto.Bool(indexDefn.IndexMissingLeadingKey),
+		TokenAnalyzer:          proto.String(indexDefn.TokenAnalyzer.String()),
 	}
 
 	return defn
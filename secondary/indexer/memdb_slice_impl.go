@@ -27,12 +27,12 @@ import (
 	"unsafe"
 
 	"github.com/couchbase/indexing/secondary/common"
-	"github.com/couchbase/indexing/secondary/common/queryutil"
 	"github.com/couchbase/indexing/secondary/iowrap"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/memdb"
 	"github.com/couchbase/indexing/secondary/memdb/nodetable"
 	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 	statsMgmt "github.com/couchbase/indexing/secondary/stats"
 	"github.com/couchbase/indexing/secondary/stubs/nitro/mm"
 )
@@ -263,7 +263,7 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 	mdb.initStores()
 
 	// Array related initialization
-	_, mdb.isArrayDistinct, mdb.isArrayFlattened, mdb.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+	_, mdb.isArrayDistinct, mdb.isArrayFlattened, mdb.arrayExprPosition, err = getArrayExpressionPosition(idxDefn)
 	if err != nil {
 		return nil, err
 	}
@@ -332,6 +332,11 @@ func (mdb *memdbSlice) initStores() {
 	cfg.SetExposeItemCopy(mdb.exposeItemCopy)
 	cfg.SetIOConcurrency(ioConcurrency)
 
+	// snapshot files are encrypted if encryption is enabled
+	if provider := encryption.GetKeyProvider(); provider != nil {
+		cfg.UseEncryption(provider)
+	}
+
 	cfg.SetKeyComparator(byteItemCompare)
 	mdb.mainstore = memdb.NewWithConfig(cfg)
 	mdb.main = make([]*memdb.Writer, mdb.numWriters)
@@ -1754,6 +1759,7 @@ func (mdb *memdbSlice) Statistics(consumerFilter uint64) (StorageStatistics, err
 	sts.DataSize = mdb.mainstore.MemoryInUse()
 	sts.MemUsed = mdb.mainstore.MemoryInUse() + ntMemUsed
 	sts.DiskSize = mdb.diskSize()
+	sts.EncryptionStatus = encryption.GetStatus(mdb.mainstore.EncryptionKeyId())
 
 	mdb.idxStats.docidCount.Set(docidCount)
 	// Ideally, we should also count items in backstore. But numRecsInMem is mainly used for resident % computation
@@ -122,6 +122,9 @@ func NewMutationManager(supvCmdch MsgChannel, supvRespch MsgChannel,
 
 	m.setEnableAuth()
 
+	//mutation queues start empty, remove any spill logs of a previous run
+	cleanupSpillDir(config)
+
 	m.vbMap.Init()
 	m.indexInstMap.Init()
 	m.indexPartnMap.Init()
@@ -15,6 +15,7 @@ import (
 	"unsafe"
 
 	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
 	"github.com/couchbase/indexing/secondary/logging"
 )
 
@@ -38,6 +39,8 @@ type MutationQueue interface {
 
 	//return reference to a vbucket's mutation at Tail of queue without dequeue
 	PeekTail(vbucket Vbucket) *MutationKeys
+	//return seqno of a vbucket's mutation at Tail of queue without dequeue
+	PeekTailSeqno(vbucket Vbucket) uint64
 	//return reference to a vbucket's mutation at Head of queue without dequeue
 	PeekHead(vbucket Vbucket) *MutationKeys
 
@@ -83,6 +86,12 @@ type atomicMutationQueue struct {
 	isDestroyed bool
 
 	keyspaceId string
+
+	spillEnabled   bool                //spill mutations to disk above spillWatermark
+	spillWatermark uint64              //percentage of maxMemory above which to spill
+	spillDir       string              //directory of the spill logs of the queue
+	spillLogs      []*mutationSpillLog //spill log per vbucket queue
+	lastSpillErr   int64               //time of last logged spill error
 }
 
 //NewAtomicMutationQueue allocates a new Atomic Mutation Queue and initializes it
@@ -102,6 +111,12 @@ func NewAtomicMutationQueue(keyspaceId string, numVbuckets uint16, maxMemory *in
 		resultChanSize:      config["mutation_queue.resultChanSize"].Uint64(),
 		minQueueLen:         config["settings.minVbQueueLength"].Uint64(),
 		keyspaceId:          keyspaceId,
+		spillEnabled:        config["mutation_queue.spill.enabled"].Bool(),
+		spillWatermark:      config["mutation_queue.spill.watermark"].Uint64(),
+	}
+
+	if q.spillEnabled {
+		q.spillDir, q.spillLogs = newSpillLogs(keyspaceId, numVbuckets, config)
 	}
 
 	var x uint16
@@ -122,6 +137,24 @@ func NewAtomicMutationQueue(keyspaceId string, numVbuckets uint16, maxMemory *in
 type node struct {
 	mutation *MutationKeys
 	next     *node
+
+	//location of the mutation in the spill log, if spilled
+	spillOff int64
+	spillLen int
+	seqno    uint64
+}
+
+//isSpilled returns true if the node's mutation is in the spill log
+func (n *node) isSpilled() bool {
+	return n.spillLen != 0
+}
+
+//getSeqno returns the seqno of the node's mutation
+func (n *node) getSeqno() uint64 {
+	if n.isSpilled() {
+		return n.seqno
+	}
+	return n.mutation.meta.seqno
 }
 
 //Enqueue will enqueue the mutation reference for given vbucket.
@@ -142,17 +175,20 @@ func (q *atomicMutationQueue) Enqueue(mutation *MutationKeys,
 		return nil
 	}
 
-	//create a new node
-	n := q.allocNode(vbucket, appch)
+	//create a new node, spilling the mutation to disk if memory used
+	//is above the spill watermark
+	n := q.spillNode(mutation, vbucket)
 	if n == nil {
-		return nil
-	}
+		n = q.allocNode(vbucket, appch)
+		if n == nil {
+			return nil
+		}
 
-	n.mutation = mutation
+		n.mutation = mutation
+		atomic.AddInt64(q.memUsed, n.mutation.Size())
+	}
 	n.next = nil
 
-	atomic.AddInt64(q.memUsed, n.mutation.Size())
-
 	//point tail's next to new node
 	tail := (*node)(atomic.LoadPointer(&q.tail[vbucket]))
 	tail.next = n
@@ -204,22 +240,26 @@ func (q *atomicMutationQueue) dequeueUptoSeqno(vbucket Vbucket, seqno uint64,
 			atomic.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
 
 			head := (*node)(atomic.LoadPointer(&q.head[vbucket]))
-			//copy the mutation pointer
-			m := head.next.mutation
-			if seqno >= m.meta.seqno {
+			if seqno >= head.next.getSeqno() {
+				//copy the mutation pointer
+				m, spilled := q.readNode(vbucket, head.next)
 				//free mutation pointer
 				head.next.mutation = nil
 				//move head to next
 				atomic.StorePointer(&q.head[vbucket], unsafe.Pointer(head.next))
 				atomic.AddInt64(&q.size[vbucket], -1)
-				memReleased += m.size
+				if spilled {
+					memReleased += q.releaseSpilled(vbucket)
+				} else {
+					memReleased += m.size
+				}
 				//send mutation to caller
 				dequeueSeq = m.meta.seqno
 				datach <- m
 			} else {
 				logging.Warnf("Indexer::MutationQueue Dequeue Aborted For "+
 					"Seqno %v KeyspaceId %v Vbucket %v. Last Dequeue %v Head Seqno %v.", seqno,
-					q.keyspaceId, vbucket, dequeueSeq, m.meta.seqno)
+					q.keyspaceId, vbucket, dequeueSeq, head.next.getSeqno())
 				atomic.AddInt64(q.memUsed, -memReleased)
 				close(errch)
 				return
@@ -289,13 +329,17 @@ func (q *atomicMutationQueue) DequeueSingleElement(vbucket Vbucket) *MutationKey
 
 		head := (*node)(atomic.LoadPointer(&q.head[vbucket]))
 		//copy the mutation pointer
-		m := head.next.mutation
+		m, spilled := q.readNode(vbucket, head.next)
 		//free mutation pointer
 		head.next.mutation = nil
 		//move head to next
 		atomic.StorePointer(&q.head[vbucket], unsafe.Pointer(head.next))
 		atomic.AddInt64(&q.size[vbucket], -1)
-		atomic.AddInt64(q.memUsed, -m.Size())
+		if spilled {
+			atomic.AddInt64(q.memUsed, -q.releaseSpilled(vbucket))
+		} else {
+			atomic.AddInt64(q.memUsed, -m.Size())
+		}
 		return m
 	}
 	return nil
@@ -340,15 +384,19 @@ func (q *atomicMutationQueue) dequeueN(vbucket Vbucket, count uint64,
 			atomic.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
 
 			head := (*node)(atomic.LoadPointer(&q.head[vbucket]))
-			//copy the mutation pointer
-			m := head.next.mutation
 			if currCount < count {
+				//copy the mutation pointer
+				m, spilled := q.readNode(vbucket, head.next)
 				//free mutation pointer
 				head.next.mutation = nil
 				//move head to next
 				atomic.StorePointer(&q.head[vbucket], unsafe.Pointer(head.next))
 				atomic.AddInt64(&q.size[vbucket], -1)
-				memReleased += m.Size()
+				if spilled {
+					memReleased += q.releaseSpilled(vbucket)
+				} else {
+					memReleased += m.Size()
+				}
 				//send mutation to caller
 				dequeueSeq = m.meta.seqno
 				currCount++
@@ -367,7 +415,9 @@ func (q *atomicMutationQueue) dequeueN(vbucket Vbucket, count uint64,
 	}
 }
 
-//PeekTail returns reference to a vbucket's mutation at tail of queue without dequeue
+//PeekTail returns reference to a vbucket's mutation at tail of queue without dequeue.
+//A spilled mutation is not held in memory and can be dequeued and released
+//concurrently, so nil is returned for it. Use PeekTailSeqno to get its seqno.
 func (q *atomicMutationQueue) PeekTail(vbucket Vbucket) *MutationKeys {
 	if atomic.LoadPointer(&q.head[vbucket]) !=
 		atomic.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
@@ -377,6 +427,18 @@ func (q *atomicMutationQueue) PeekTail(vbucket Vbucket) *MutationKeys {
 	return nil
 }
 
+//PeekTailSeqno returns the seqno of a vbucket's mutation at tail of queue
+//without dequeue, or 0 if the queue is empty. The seqno of a spilled mutation
+//is kept on its node, so the spill log is not read.
+func (q *atomicMutationQueue) PeekTailSeqno(vbucket Vbucket) uint64 {
+	if atomic.LoadPointer(&q.head[vbucket]) !=
+		atomic.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
+		tail := (*node)(atomic.LoadPointer(&q.tail[vbucket]))
+		return tail.getSeqno()
+	}
+	return 0
+}
+
 //PeekHead returns reference to a vbucket's mutation at head of queue without dequeue
 func (q *atomicMutationQueue) PeekHead(vbucket Vbucket) *MutationKeys {
 	if atomic.LoadPointer(&q.head[vbucket]) !=
@@ -474,6 +536,9 @@ func (q *atomicMutationQueue) popFreeList(vbucket Vbucket) *node {
 		q.free[vbucket] = q.free[vbucket].next
 		n.mutation = nil
 		n.next = nil
+		n.spillOff = 0
+		n.spillLen = 0
+		n.seqno = 0
 		return n
 	} else {
 		return nil
@@ -509,6 +574,87 @@ func (q *atomicMutationQueue) Destroy() {
 		close(mutch)
 	}
 
+	//remove the spill logs
+	for _, spillLog := range q.spillLogs {
+		spillLog.close()
+	}
+	if q.spillDir != "" {
+		if err := iowrap.Os_RemoveAll(q.spillDir); err != nil {
+			logging.Errorf("Indexer::MutationQueue Error removing spill directory %v. Err %v",
+				q.spillDir, err)
+		}
+	}
+
+}
+
+//spillNode writes the mutation to the vbucket's spill log and returns a node
+//for it, if spill is enabled and memory used is above the spill watermark.
+//Returns nil if the mutation is not spilled.
+func (q *atomicMutationQueue) spillNode(mutation *MutationKeys, vbucket Vbucket) *node {
+
+	if !q.spillEnabled {
+		return nil
+	}
+
+	currMem := atomic.LoadInt64(q.memUsed)
+	maxMem := atomic.LoadInt64(q.maxMemory)
+	currLen := atomic.LoadInt64(&q.size[vbucket])
+
+	//spilled nodes still use memory, so allocation blocks above maxMemory
+	if currMem < maxMem*int64(q.spillWatermark)/100 || currMem >= maxMem ||
+		currLen < int64(q.minQueueLen) {
+		return nil
+	}
+
+	offset, length, err := q.spillLogs[vbucket].append(mutation)
+	if err != nil {
+		now := time.Now().UnixNano()
+		if now-atomic.LoadInt64(&q.lastSpillErr) > int64(time.Minute) {
+			atomic.StoreInt64(&q.lastSpillErr, now)
+			logging.Errorf("Indexer::MutationQueue Error spilling mutation KeyspaceId %v "+
+				"Vbucket %v. Err %v", q.keyspaceId, vbucket, err)
+		}
+		return nil
+	}
+
+	n := q.popFreeList(vbucket)
+	if n == nil {
+		n = &node{}
+	}
+	n.spillOff = offset
+	n.spillLen = length
+	n.seqno = mutation.meta.seqno
+
+	atomic.AddInt64(q.memUsed, SPILLED_NODE_SIZE)
+	mutation.Free()
+
+	return n
+}
+
+//readNode returns the mutation of a node, reading it from the spill log if it
+//was spilled, along with whether it was spilled. The mutation of a spilled
+//node cannot be lost, so failure to read it back is fatal.
+func (q *atomicMutationQueue) readNode(vbucket Vbucket, n *node) (*MutationKeys, bool) {
+
+	if !n.isSpilled() {
+		return n.mutation, false
+	}
+
+	m, err := q.spillLogs[vbucket].read(n.spillOff, n.spillLen)
+	if err != nil {
+		logging.Fatalf("Indexer::MutationQueue Error reading spilled mutation KeyspaceId %v "+
+			"Vbucket %v Seqno %v. Err %v", q.keyspaceId, vbucket, n.seqno, err)
+		common.CrashOnError(err)
+	}
+	m.meta.vbucket = vbucket
+	return m, true
+}
+
+//releaseSpilled releases a dequeued spilled mutation of the vbucket and
+//returns the memory released
+func (q *atomicMutationQueue) releaseSpilled(vbucket Vbucket) int64 {
+	q.spillLogs[vbucket].release()
+	return SPILLED_NODE_SIZE
 }
 
 func getAllocPollInterval(config common.Config) uint64 {
@@ -1,6 +1,8 @@
 package indexer
 
 import (
+	"fmt"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -542,6 +544,231 @@ func TestConcurrentEnqueueDequeueN1(t *testing.T) {
 	}
 }
 
+func TestSpillA(t *testing.T) {
+
+	var spillMemUsed int64
+	spillMaxMemory := int64(1024 * 1024)
+	q := NewAtomicMutationQueue("default", 1, &spillMaxMemory, &spillMemUsed,
+		newSpillTestConfig(t))
+
+	//first minVbQueueLength mutations are kept in memory, the rest are spilled
+	m := make([]*MutationKeys, 100)
+	for i := 0; i < 100; i++ {
+		m[i] = newSpillTestMutation(i)
+		q.Enqueue(m[i], 0, nil)
+	}
+	checkSizeA(t, q, 0, 100)
+
+	if q.spillLogs[0].pending != 90 {
+		t.Errorf("Unexpected spilled count %v, expected %v", q.spillLogs[0].pending, 90)
+	}
+
+	if seqno := q.PeekTailSeqno(0); seqno != 99 {
+		t.Errorf("Unexpected tail seqno %v, expected %v", seqno, 99)
+	}
+	if tail := q.PeekTail(0); tail != nil {
+		t.Errorf("Unexpected tail %v for spilled mutation, expected nil", tail)
+	}
+
+	retch, _, _ := q.DequeueUptoSeqno(0, 99)
+	j := 0
+	for d := range retch {
+		checkItemA(t, d, m[j])
+		j++
+	}
+	if j != 100 {
+		t.Errorf("Unexpected Dequeue Count %v, expected %v", j, 100)
+	}
+
+	if spillMemUsed != 0 {
+		t.Errorf("Unexpected memory used %v after dequeue", spillMemUsed)
+	}
+	if q.spillLogs[0].size != 0 {
+		t.Errorf("Spill log not truncated after dequeue, size %v", q.spillLogs[0].size)
+	}
+
+	q.Destroy()
+	if _, err := os.Stat(q.spillDir); !os.IsNotExist(err) {
+		t.Errorf("Spill directory %v not removed on destroy, err %v", q.spillDir, err)
+	}
+}
+
+func newSpillTestMutation(i int) *MutationKeys {
+	m := &MutationKeys{
+		meta:  &MutationMeta{keyspaceId: "default", vbucket: 0, vbuuid: 1234, seqno: uint64(i)},
+		docid: []byte(fmt.Sprintf("doc-%v", i)),
+		mut: []*Mutation{&Mutation{uuid: 1, command: common.Upsert,
+			key: []byte(fmt.Sprintf(`["key-%v"]`, i))}},
+	}
+	m.size = m.Size()
+	return m
+}
+
+func newSpillTestConfig(t *testing.T) common.Config {
+	conf := common.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("settings.minVbQueueLength", 10)
+	conf.SetValue("mutation_queue.spill.enabled", true)
+	conf.SetValue("mutation_queue.spill.watermark", 0)
+	conf.SetValue("storage_dir", t.TempDir())
+	return conf
+}
+
+func TestSpillLogEncodeDecode(t *testing.T) {
+
+	m := newSpillTestMutation(7)
+	m.meta.opaque = 42
+	m.meta.firstSnap = true
+	m.mut = append(m.mut, &Mutation{uuid: 2, command: common.Deletion,
+		oldkey: []byte(`["old"]`), partnkey: []byte("p")})
+
+	buf := encodeMutationKeys(nil, m)
+	d, err := decodeMutationKeys(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding record %v", err)
+	}
+	if !reflect.DeepEqual(d.meta, m.meta) || string(d.docid) != string(m.docid) ||
+		d.size != m.size || !reflect.DeepEqual(d.mut, m.mut) {
+		t.Errorf("Decoded mutation %v doesn't match encoded mutation %v", d, m)
+	}
+
+	//truncated and oversized records are rejected
+	if _, err := decodeMutationKeys(buf[:len(buf)-1]); err != errSpillCorrupted {
+		t.Errorf("Expected errSpillCorrupted for truncated record, got %v", err)
+	}
+	if _, err := decodeMutationKeys(append(buf, 0)); err != errSpillCorrupted {
+		t.Errorf("Expected errSpillCorrupted for oversized record, got %v", err)
+	}
+}
+
+func TestSpillLogReload(t *testing.T) {
+
+	_, logs := newSpillLogs("default", 1, newSpillTestConfig(t))
+	l := logs[0]
+	defer l.close()
+
+	type record struct {
+		offset int64
+		length int
+	}
+	records := make([]record, 10)
+	for i := range records {
+		offset, length, err := l.append(newSpillTestMutation(i))
+		if err != nil {
+			t.Fatalf("Unexpected error appending record %v. Err %v", i, err)
+		}
+		records[i] = record{offset, length}
+	}
+
+	//records are read back by offset, in any order
+	for i := len(records) - 1; i >= 0; i-- {
+		m, err := l.read(records[i].offset, records[i].length)
+		if err != nil {
+			t.Fatalf("Unexpected error reading record %v. Err %v", i, err)
+		}
+		if m.meta.seqno != uint64(i) || string(m.docid) != fmt.Sprintf("doc-%v", i) {
+			t.Errorf("Unexpected record %v at offset %v", m, records[i].offset)
+		}
+	}
+}
+
+func TestSpillLogTruncate(t *testing.T) {
+
+	_, logs := newSpillLogs("default", 1, newSpillTestConfig(t))
+	l := logs[0]
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := l.append(newSpillTestMutation(i)); err != nil {
+			t.Fatalf("Unexpected error appending record %v. Err %v", i, err)
+		}
+	}
+	size := l.size
+
+	//the log is kept while any of its mutations is pending
+	l.release()
+	l.release()
+	if l.size != size {
+		t.Errorf("Spill log truncated with pending mutations, size %v expected %v", l.size, size)
+	}
+
+	l.release()
+	if l.size != 0 {
+		t.Errorf("Spill log not truncated, size %v", l.size)
+	}
+	if fi, err := os.Stat(l.path); err != nil || fi.Size() != 0 {
+		t.Errorf("Spill log file not truncated, err %v", err)
+	}
+
+	//records are appended from the start of a truncated log
+	offset, length, err := l.append(newSpillTestMutation(3))
+	if err != nil || offset != 0 {
+		t.Fatalf("Unexpected offset %v after truncate. Err %v", offset, err)
+	}
+	if m, err := l.read(offset, length); err != nil || m.meta.seqno != 3 {
+		t.Errorf("Unexpected record %v after truncate. Err %v", m, err)
+	}
+
+	l.close()
+	if _, err := os.Stat(l.path); !os.IsNotExist(err) {
+		t.Errorf("Spill log %v not removed on close, err %v", l.path, err)
+	}
+	if _, err := l.read(offset, length); err != errSpillCorrupted {
+		t.Errorf("Expected errSpillCorrupted reading closed log, got %v", err)
+	}
+}
+
+func TestSpillConcurrentPeekTail(t *testing.T) {
+
+	var spillMemUsed int64
+	spillMaxMemory := int64(1024 * 1024)
+	q := NewAtomicMutationQueue("default", 1, &spillMaxMemory, &spillMemUsed,
+		newSpillTestConfig(t))
+	defer q.Destroy()
+
+	count := 1000
+	donech := make(chan bool)
+	go func() {
+		for i := 1; i <= count; i++ {
+			q.Enqueue(newSpillTestMutation(i), 0, nil)
+		}
+	}()
+
+	//the tail seqno of the queue never goes back, even as the spilled tail
+	//is dequeued and its log truncated and reused
+	go func() {
+		defer close(donech)
+		var last uint64
+		for last != uint64(count) {
+			seqno := q.PeekTailSeqno(0)
+			if seqno != 0 && seqno < last {
+				t.Errorf("Tail seqno %v went back from %v", seqno, last)
+				return
+			}
+			if seqno != 0 {
+				last = seqno
+			}
+		}
+	}()
+
+	dequeued := 0
+	for seqno := 10; seqno <= count; seqno += 10 {
+		retch, _, _ := q.DequeueUptoSeqno(0, uint64(seqno))
+		for d := range retch {
+			dequeued++
+			if d.meta.seqno != uint64(dequeued) {
+				t.Fatalf("Unexpected dequeued seqno %v, expected %v", d.meta.seqno, dequeued)
+			}
+		}
+	}
+	<-donech
+
+	if dequeued != count {
+		t.Errorf("Unexpected Dequeue Count %v, expected %v", dequeued, count)
+	}
+	if q.spillLogs[0].pending != 0 {
+		t.Errorf("Unexpected pending spilled mutations %v after dequeue", q.spillLogs[0].pending)
+	}
+}
+
 /*
 func BenchmarkEnqueueA(b *testing.B) {
 
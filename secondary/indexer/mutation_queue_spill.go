@@ -0,0 +1,284 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//Mutation queue spill. When spill is enabled and the memory used by mutation
+//queues is above the spill watermark, atomicMutationQueue writes new mutations
+//to an append-only log file per vbucket instead of holding them in memory. The
+//queue node of a spilled mutation only records where the mutation is in the
+//log, and the mutation is read back when it is dequeued. This keeps the order
+//of mutations in the vbucket queue and the lock-free queue unchanged, while
+//only the (small) queue nodes of spilled mutations are held in memory.
+//
+//A log is truncated once all the mutations spilled to it have been dequeued.
+
+const MUTATION_QUEUE_SPILL_DIR = "mutation_queue_spill"
+
+// memory accounted for the node of a spilled mutation
+const SPILLED_NODE_SIZE = 64
+
+var errSpillCorrupted = errors.New("mutation queue spill log corrupted")
+
+var spillQueueId uint64
+
+// mutationSpillLog is the spill log of a vbucket queue. Mutations are appended
+// by the single writer of the queue, and read back by the single reader.
+type mutationSpillLog struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	size    int64 //size of the log
+	pending int64 //spilled mutations not yet dequeued
+	buf     []byte
+}
+
+// getSpillDir returns the directory of the mutation queue spill logs
+func getSpillDir(config c.Config) string {
+	return filepath.Join(config["storage_dir"].String(), MUTATION_QUEUE_SPILL_DIR)
+}
+
+// cleanupSpillDir removes the spill logs left behind by a previous run of
+// the indexer. Mutation queues do not survive a restart.
+func cleanupSpillDir(config c.Config) {
+	dir := getSpillDir(config)
+	if err := iowrap.Os_RemoveAll(dir); err != nil {
+		logging.Errorf("MutationQueue::cleanupSpillDir Error removing %v. Err %v", dir, err)
+	}
+}
+
+// newSpillLogs returns the spill logs of the vbuckets of a queue, in a new
+// directory under the spill directory. Log files are created on first spill.
+func newSpillLogs(keyspaceId string, numVbuckets uint16, config c.Config) (string, []*mutationSpillLog) {
+
+	queueId := atomic.AddUint64(&spillQueueId, 1)
+	dir := filepath.Join(getSpillDir(config), fmt.Sprintf("%v_%v", keyspaceId, queueId))
+
+	logs := make([]*mutationSpillLog, numVbuckets)
+	for i := range logs {
+		logs[i] = &mutationSpillLog{path: filepath.Join(dir, fmt.Sprintf("vb_%v.log", i))}
+	}
+	return dir, logs
+}
+
+// append writes mk to the log and returns the offset and length of the record
+func (l *mutationSpillLog) append(mk *MutationKeys) (int64, int, error) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		if err := iowrap.Os_MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+			return 0, 0, err
+		}
+		file, err := iowrap.Os_OpenFile(l.path, os.O_CREATE|os.O_RDWR|os.O_APPEND|os.O_TRUNC, 0644)
+		if err != nil {
+			return 0, 0, err
+		}
+		l.file = file
+		l.size = 0
+	}
+
+	l.buf = encodeMutationKeys(l.buf[:0], mk)
+	n, err := iowrap.File_Write(l.file, l.buf)
+	if err != nil {
+		//a partial record is skipped, as records are read by offset
+		l.size += int64(n)
+		return 0, 0, err
+	}
+
+	offset := l.size
+	l.size += int64(n)
+	l.pending++
+	return offset, n, nil
+}
+
+// read returns the mutation of the record at offset. It does not consume it.
+func (l *mutationSpillLog) read(offset int64, length int) (*MutationKeys, error) {
+
+	l.mutex.Lock()
+	file := l.file
+	l.mutex.Unlock()
+
+	if file == nil {
+		return nil, errSpillCorrupted
+	}
+
+	buf := make([]byte, length)
+	if _, err := iowrap.File_ReadAt(file, buf, offset); err != nil {
+		return nil, err
+	}
+	return decodeMutationKeys(buf)
+}
+
+// release marks a spilled mutation as dequeued, truncating the log if all of
+// its mutations have been dequeued.
+func (l *mutationSpillLog) release() {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.pending--
+	if l.pending == 0 && l.file != nil && l.size != 0 {
+		if err := iowrap.File_Truncate(l.file, 0); err != nil {
+			logging.Errorf("MutationQueue::spill Error truncating %v. Err %v", l.path, err)
+			return
+		}
+		l.size = 0
+	}
+}
+
+// close closes the log and removes its file
+func (l *mutationSpillLog) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file != nil {
+		iowrap.File_Close(l.file)
+		iowrap.Os_Remove(l.path)
+		l.file = nil
+	}
+}
+
+// encodeMutationKeys appends the record of mk to buf. A record is the length
+// of the rest of the record, followed by the mutation meta, the docid, and the
+// mutations of each index.
+func encodeMutationKeys(buf []byte, mk *MutationKeys) []byte {
+
+	buf = append(buf, 0, 0, 0, 0)
+
+	meta := mk.meta
+	buf = appendBytes(buf, []byte(meta.keyspaceId))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(meta.vbuuid))
+	buf = binary.BigEndian.AppendUint64(buf, meta.seqno)
+	buf = binary.BigEndian.AppendUint64(buf, meta.opaque)
+	firstSnap := byte(0)
+	if meta.firstSnap {
+		firstSnap = 1
+	}
+	buf = append(buf, firstSnap, byte(meta.projVer))
+
+	buf = appendBytes(buf, mk.docid)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(mk.size))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(mk.mut)))
+	for _, m := range mk.mut {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(m.uuid))
+		buf = append(buf, m.command)
+		buf = appendBytes(buf, m.key)
+		buf = appendBytes(buf, m.oldkey)
+		buf = appendBytes(buf, m.partnkey)
+	}
+
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(buf)-4))
+	return buf
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
+
+// spillDecoder decodes a record, failing on the first out of bounds read
+type spillDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *spillDecoder) next(n int) []byte {
+	if d.err != nil || n > len(d.buf) {
+		d.err = errSpillCorrupted
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *spillDecoder) uint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *spillDecoder) uint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *spillDecoder) byte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// bytes returns a copy of a length prefixed byte slice, nil if empty
+func (d *spillDecoder) bytes() []byte {
+	if b := d.next(int(d.uint32())); len(b) != 0 {
+		return append([]byte(nil), b...)
+	}
+	return nil
+}
+
+// decodeMutationKeys decodes the record in buf, as encoded by encodeMutationKeys
+func decodeMutationKeys(buf []byte) (*MutationKeys, error) {
+
+	d := &spillDecoder{buf: buf}
+	if length := d.uint32(); d.err == nil && int(length) != len(d.buf) {
+		return nil, errSpillCorrupted
+	}
+
+	mk := NewMutationKeys()
+	meta := NewMutationMeta()
+	meta.keyspaceId = string(d.bytes())
+	meta.vbuuid = Vbuuid(d.uint64())
+	meta.seqno = d.uint64()
+	meta.opaque = d.uint64()
+	meta.firstSnap = d.byte() == 1
+	meta.projVer = c.ProjectorVersion(d.byte())
+	mk.meta = meta
+
+	mk.docid = d.bytes()
+	mk.size = int64(d.uint64())
+	numMut := d.uint32()
+	if d.err == nil && int(numMut) > len(d.buf) {
+		return nil, errSpillCorrupted
+	}
+	mk.mut = make([]*Mutation, 0, numMut)
+	for i := uint32(0); i < numMut && d.err == nil; i++ {
+		m := NewMutation()
+		m.uuid = c.IndexInstId(d.uint64())
+		m.command = d.byte()
+		m.key = d.bytes()
+		m.oldkey = d.bytes()
+		m.partnkey = d.bytes()
+		mk.mut = append(mk.mut, m)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return mk, nil
+}
@@ -27,9 +27,9 @@ import (
 	"time"
 
 	"github.com/couchbase/indexing/secondary/common"
-	"github.com/couchbase/indexing/secondary/common/queryutil"
 	"github.com/couchbase/indexing/secondary/iowrap"
 	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 	statsMgmt "github.com/couchbase/indexing/secondary/stats"
 	"github.com/couchbase/plasma"
 )
@@ -303,7 +303,7 @@ func newPlasmaSlice(storage_dir string, log_dir string, path string, sliceId Sli
 	}
 
 	// Array related initialization
-	_, slice.isArrayDistinct, slice.isArrayFlattened, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+	_, slice.isArrayDistinct, slice.isArrayFlattened, slice.arrayExprPosition, err = getArrayExpressionPosition(idxDefn)
 	if err != nil {
 		return nil, err
 	}
@@ -2706,6 +2706,13 @@ func (mdb *plasmaSlice) Statistics(consumerFilter uint64) (StorageStatistics, er
 		sts.DiskSize += checkpointFileSize
 	}
 
+	// plasma does not support encryption at rest, the indexer does not start
+	// plasma indexes with encryption enabled, see checkEncryptionSupport
+	sts.EncryptionStatus = encryption.StatusPlaintext
+	if encryption.Enabled() {
+		sts.EncryptionStatus = encryption.StatusUnsupported
+	}
+
 	mdb.updateUsageStats()
 
 	mdb.idxStats.docidCount.Set(docidCount)
@@ -3170,6 +3170,14 @@ func (m *RebalanceServiceManager) handleMoveIndex(w http.ResponseWriter, r *http
 		req = IndexRequest{IndexIds: idList, Plan: plan}
 
 		code, errStr := m.doHandleMoveIndex(&req)
+		audit.AuditWithFields(c.AUDIT_MOVE_INDEX, r, method, &audit.AuditFields{
+			User:       creds.Name(),
+			Message:    errStr,
+			Bucket:     bucket,
+			Scope:      scope,
+			Collection: collection,
+			Index:      index,
+		})
 		if errStr != "" {
 			sendIndexResponseWithError(code, w, errStr)
 		} else {
@@ -276,6 +276,7 @@ func RegisterRequestHandler(mgr *manager.IndexManager, mux *http.ServeMux, confi
 			"/getCachedIndexerNodeUUIDs", handlerContext.handleCachedIndexerNodeUUIDsRequest)
 		mux.HandleFunc("/restoreIndexMetadata", handlerContext.handleRestoreIndexMetadataRequest)
 		mux.HandleFunc("/planIndex", handlerContext.handleIndexPlanRequest)
+		mux.HandleFunc("/getIndexAdvice", handlerContext.handleIndexAdviceRequest)
 		mux.HandleFunc("/settings/storageMode", handlerContext.handleIndexStorageModeRequest)
 		mux.HandleFunc("/settings/planner", handlerContext.handlePlannerRequest)
 		mux.HandleFunc("/listReplicaCount", handlerContext.handleListLocalReplicaCountRequest)
@@ -374,7 +375,9 @@ func (m *requestHandlerContext) doCreateIndex(w http.ResponseWriter, r *http.Req
 			"%v: calling IndexManager to create index %v:%v:%v:%v",
 			method, indexDefn.Bucket, indexDefn.Scope, indexDefn.Collection, indexDefn.Name)
 	}
-	if err := m.mgr.HandleCreateIndexDDL(&indexDefn, isRebalReq); err == nil {
+	err := m.mgr.HandleCreateIndexDDL(&indexDefn, isRebalReq)
+	auditDDL(common.AUDIT_CREATE_INDEX, r, method, creds, &indexDefn, err)
+	if err == nil {
 		// No error, return success
 		rhSendIndexResponse(w)
 	} else {
@@ -472,7 +475,9 @@ func (m *requestHandlerContext) dropIndexRequest(w http.ResponseWriter, r *http.
 	indexDefn := request.Index
 
 	if indexDefn.RealInstId == 0 {
-		if err := m.mgr.HandleDeleteIndexDDL(indexDefn.DefnId); err == nil {
+		err := m.mgr.HandleDeleteIndexDDL(indexDefn.DefnId)
+		auditDDL(common.AUDIT_DROP_INDEX, r, method, creds, &indexDefn, err)
+		if err == nil {
 			// No error, return success
 			rhSendIndexResponse(w)
 		} else {
@@ -480,7 +485,9 @@ func (m *requestHandlerContext) dropIndexRequest(w http.ResponseWriter, r *http.
 			rhSendIndexResponseWithError(http.StatusInternalServerError, w, fmt.Sprintf("%v", err))
 		}
 	} else if indexDefn.InstId != 0 {
-		if err := m.mgr.DropOrPruneInstance(indexDefn, true); err == nil {
+		err := m.mgr.DropOrPruneInstance(indexDefn, true)
+		auditDDL(common.AUDIT_DROP_INDEX, r, method, creds, &indexDefn, err)
+		if err == nil {
 			// No error, return success
 			rhSendIndexResponse(w)
 		} else {
@@ -546,7 +553,9 @@ func (m *requestHandlerContext) buildIndexRequestRebalance(w http.ResponseWriter
 
 	// call the index manager to handle the DDL
 	indexIds := request.IndexIds
-	if err := m.mgr.HandleBuildIndexRebalDDL(indexIds); err == nil {
+	err := m.mgr.HandleBuildIndexRebalDDL(indexIds)
+	auditDDL(common.AUDIT_BUILD_INDEX, r, method, creds, &request.Index, err)
+	if err == nil {
 		// No error, return success
 		rhSendIndexResponse(w)
 	} else {
@@ -1736,121 +1745,16 @@ func getFilters(r *http.Request, bucket string) (map[string]bool, string, error)
 	collection := r.FormValue("collection")
 
 	if len(include) != 0 || len(exclude) != 0 {
-		if len(bucket) == 0 {
-			return nil, "", fmt.Errorf("Malformed input: include/exclude parameters are specified without bucket.")
-		}
-
 		if len(scope) != 0 || len(collection) != 0 {
 			return nil, "", fmt.Errorf("Malformed input: include/exclude parameters are specified with scope/collection.")
 		}
 	}
 
-	if len(include) != 0 && len(exclude) != 0 {
-		return nil, "", fmt.Errorf("Malformed input: include and exclude both parameters are specified.")
-	}
-
-	getFilter := func(s string) string {
-		comp := strings.Split(s, ".")
-		if len(comp) == 1 || len(comp) == 2 {
-			return s
-		}
-
-		return ""
-	}
-
-	filterType := ""
-	filters := make(map[string]bool)
-
-	if len(include) != 0 {
-		filterType = "include"
-		incl := strings.Split(include, ",")
-		for _, inc := range incl {
-			filter := getFilter(inc)
-			if filter == "" {
-				return nil, "", fmt.Errorf("Malformed input: include filter is malformed (%v) (%v)", incl, inc)
-			}
-
-			filters[filter] = true
-		}
-	}
-
-	if len(exclude) != 0 {
-		filterType = "exclude"
-		excl := strings.Split(exclude, ",")
-		for _, exc := range excl {
-			filter := getFilter(exc)
-			if filter == "" {
-				return nil, "", fmt.Errorf("Malformed input: exclude filter is malformed (%v) (%v)", excl, exc)
-			}
-
-			filters[filter] = true
-		}
-	}
-
-	// TODO: Do we need any more validations?
-	return filters, filterType, nil
+	return manager.ParseFilters(bucket, include, exclude)
 }
 
 func getRestoreRemapParam(r *http.Request) (map[string]string, error) {
-
-	remap := make(map[string]string)
-
-	remapStr := r.FormValue("remap")
-	if remapStr == "" {
-		return remap, nil
-	}
-
-	remaps := strings.Split(remapStr, ",")
-
-	// Cache the collection level remaps for verification
-	collRemap := make(map[string]string)
-
-	for _, rm := range remaps {
-
-		rmp := strings.Split(rm, ":")
-		if len(rmp) > 2 || len(rmp) < 2 {
-			return nil, fmt.Errorf("Malformed input. Missing source/target in remap %v", remapStr)
-		}
-
-		source := rmp[0]
-		target := rmp[1]
-
-		src := strings.Split(source, ".")
-		tgt := strings.Split(target, ".")
-
-		if len(src) != len(tgt) {
-			return nil, fmt.Errorf("Malformed input. source and target in remap should be at same level %v", remapStr)
-		}
-
-		switch len(src) {
-
-		case 2:
-			// This is collection level remap
-			// Search for overlapping scope level remap
-			// Allow overlapping at the target, but not source
-			if _, ok := remap[src[0]]; ok {
-				return nil, fmt.Errorf("Malformed input. Overlapping remaps %v", remapStr)
-			}
-
-			remap[source] = target
-			collRemap[src[0]] = src[1]
-
-		case 1:
-			// This is scope level remap.
-			// Search for overlapping collection level remap
-			// Allow overlapping at the target, but not source
-			if _, ok := collRemap[source]; ok {
-				return nil, fmt.Errorf("Malformed input. Overlapping remaps %v", remapStr)
-			}
-
-			remap[source] = target
-
-		default:
-			return nil, fmt.Errorf("Malformed input remap %v", remapStr)
-		}
-	}
-
-	return remap, nil
+	return manager.ParseRemap(r.FormValue("remap"))
 }
 
 ///////////////////////////////////////////////////////
@@ -2386,6 +2290,54 @@ func (m *requestHandlerContext) convertIndexPlanRequest(r *http.Request) ([]*pla
 	return specs, nil
 }
 
+//////////////////////////////////////////////////////
+// Index Advisor
+///////////////////////////////////////////////////////
+
+// handleIndexAdviceRequest runs the index advisor on the index layout of the cluster and
+// returns the indexes that are unused, duplicate or redundant. Results can be restricted
+// with the optional bucket, scope and collection parameters, and indexes the caller does
+// not have list permission for are filtered out.
+func (m *requestHandlerContext) handleIndexAdviceRequest(w http.ResponseWriter, r *http.Request) {
+	const method string = "RequestHandler::handleIndexAdviceRequest" // for logging
+
+	creds, ok := doAuth(r, w, method)
+	if !ok {
+		return
+	}
+
+	report, err := planner.ExecuteAdvisor(m.clusterUrl)
+	if err != nil {
+		logging.Errorf("%v: Fail to run index advisor. err: %v", method, err)
+		rhSendHttpError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bucket := r.FormValue("bucket")
+	scope := r.FormValue("scope")
+	collection := r.FormValue("collection")
+
+	permissionsCache := common.NewSessionPermissionsCache(creds)
+	result := &planner.AdvisorReport{Advices: make([]*planner.IndexAdvice, 0, len(report.Advices))}
+	for _, advice := range report.Advices {
+		if (bucket != "" && advice.Bucket != bucket) ||
+			(scope != "" && advice.Scope != scope) ||
+			(collection != "" && advice.Collection != collection) {
+			continue
+		}
+
+		if !permissionsCache.IsAllowed(advice.Bucket, advice.Scope, advice.Collection, "list") {
+			continue
+		}
+
+		result.Advices = append(result.Advices, advice)
+		result.TotalMemSaving += advice.MemSaving
+		result.TotalDataSaving += advice.DataSaving
+	}
+
+	rhSend(http.StatusOK, w, result)
+}
+
 //////////////////////////////////////////////////////
 // Storage Mode
 ///////////////////////////////////////////////////////
@@ -82,6 +82,20 @@ func (api *testServer) validateAuth(w http.ResponseWriter, r *http.Request) (cba
 	return creds, valid
 }
 
+// auditDDL audits a DDL request with the given fields. err is the outcome of
+// the request, nil if it succeeded.
+func (api *testServer) auditDDL(eventId uint32, r *http.Request, method string,
+	fields *audit.AuditFields, err error) {
+
+	if err != nil {
+		if len(fields.Message) != 0 {
+			fields.Message += ": "
+		}
+		fields.Message += err.Error()
+	}
+	audit.AuditWithFields(eventId, r, method, fields)
+}
+
 func (api *testServer) authorize(r *http.Request, w http.ResponseWriter, creds cbauth.Creds) bool {
 
 	indexes, _, _, _, err := api.client.Refresh()
@@ -419,6 +433,8 @@ func (api *testServer) doCreate(w http.ResponseWriter, request *http.Request) {
 	defnId, err := api.client.CreateIndex4(
 		indexname, bucket, scope, collection, using, exprtype, whereExpr, secExprs,
 		desc, false, isPrimary, partnScheme, partnExprs, with)
+	api.auditDDL(c.AUDIT_CREATE_INDEX, request, "testServer::doCreate",
+		&audit.AuditFields{Bucket: bucket, Scope: scope, Collection: collection, Index: indexname}, err)
 	if err != nil {
 		http.Error(w, jsonstr("%v", err), http.StatusInternalServerError)
 		return
@@ -454,6 +470,8 @@ func (api *testServer) doBuildMany(
 	}
 
 	err = api.client.BuildIndexes(defnIDs)
+	api.auditDDL(c.AUDIT_BUILD_INDEX, request, "testServer::doBuildMany",
+		&audit.AuditFields{Message: fmt.Sprintf("index ids %v", defnIDs)}, err)
 
 	// make response
 	if err != nil {
@@ -475,6 +493,8 @@ func (api *testServer) doBuildOne(w http.ResponseWriter, request *http.Request)
 	}
 
 	err = api.client.BuildIndexes([]uint64{defnId})
+	api.auditDDL(c.AUDIT_BUILD_INDEX, request, "testServer::doBuildOne",
+		&audit.AuditFields{Message: fmt.Sprintf("index id %v", defnId)}, err)
 
 	// make response
 	if err != nil {
@@ -536,6 +556,8 @@ func (api *testServer) doDrop(w http.ResponseWriter, request *http.Request) {
 	}
 
 	err = api.client.DropIndex(defnId, "")
+	api.auditDDL(c.AUDIT_DROP_INDEX, request, "testServer::doDrop",
+		&audit.AuditFields{Message: fmt.Sprintf("index id %v", defnId)}, err)
 
 	// make response
 	if err != nil {
@@ -0,0 +1,271 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//////////////////////////////////////////////////////////////////
+// Scan admission control
+//////////////////////////////////////////////////////////////////
+
+//
+// scanAdmission admits scans based on an estimate of the memory they hold
+// while in flight: pipeline buffers, scatter-gather queues of sorted scans
+// of partitioned indexes, and group by state. When the estimates of the scans
+// in flight would exceed indexer.scan.admission.memory_budget, a scan waits
+// in a FIFO queue of at most indexer.scan.admission.max_queue scans for up to
+// indexer.scan.admission.queue_timeout, and is rejected with
+// common.ErrScanMemoryBudgetExceeded if it is not admitted by then.
+//
+// Admission control is disabled if the memory budget is 0.
+//
+type scanAdmission struct {
+	mutex   sync.Mutex
+	memUsed int64
+	waiters *list.List // of *scanAdmissionWaiter
+
+	budget       int64
+	maxQueue     int
+	queueTimeout time.Duration
+
+	stats *IndexerStatsHolder
+}
+
+type scanAdmissionWaiter struct {
+	mem      int64
+	admitch  chan bool
+	admitted bool
+}
+
+// estimates are never below this, as a scan always holds some state
+const MIN_SCAN_MEMORY_ESTIMATE = 4 * 1024
+
+// entry size used if the index does not have an average item size yet
+const DEFAULT_SCAN_ENTRY_SIZE = 256
+
+func newScanAdmission(config common.Config, stats *IndexerStatsHolder) *scanAdmission {
+	sa := &scanAdmission{
+		waiters: list.New(),
+		stats:   stats,
+	}
+	sa.updateConfig(config)
+	return sa
+}
+
+func (sa *scanAdmission) updateConfig(config common.Config) {
+
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+
+	budget := int64(config["scan.admission.memory_budget"].Int()) * 1024 * 1024
+	if budget != sa.budget {
+		logging.Infof("ScanCoordinator::scanAdmission memory budget set to %v", budget)
+	}
+
+	sa.budget = budget
+	sa.maxQueue = config["scan.admission.max_queue"].Int()
+	sa.queueTimeout = time.Duration(config["scan.admission.queue_timeout"].Int()) * time.Millisecond
+
+	// admit the waiters that fit in the new budget
+	sa.admitWaiters()
+}
+
+//
+// acquire reserves mem bytes for a scan, waiting in the admission queue if
+// needed. It returns the bytes reserved, to be given back to release once
+// the scan is done.
+//
+func (sa *scanAdmission) acquire(req *ScanRequest, mem int64) (int64, error) {
+
+	sa.mutex.Lock()
+
+	if sa.budget <= 0 {
+		sa.mutex.Unlock()
+		return 0, nil
+	}
+
+	// a scan estimated above the budget is admitted when it runs alone
+	if mem > sa.budget {
+		mem = sa.budget
+	}
+
+	if sa.waiters.Len() == 0 && sa.memUsed+mem <= sa.budget {
+		sa.memUsed += mem
+		sa.updateStats()
+		sa.mutex.Unlock()
+		return mem, nil
+	}
+
+	if sa.waiters.Len() >= sa.maxQueue || sa.queueTimeout <= 0 {
+		sa.mutex.Unlock()
+		sa.reject(req, mem)
+		return 0, common.ErrScanMemoryBudgetExceeded
+	}
+
+	w := &scanAdmissionWaiter{mem: mem, admitch: make(chan bool, 1)}
+	elem := sa.waiters.PushBack(w)
+	sa.updateStats()
+	timer := time.NewTimer(sa.queueTimeout)
+	sa.mutex.Unlock()
+
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.admitch:
+		return mem, nil
+	case <-timer.C:
+		err = common.ErrScanMemoryBudgetExceeded
+	case <-req.getTimeoutCh():
+		err = common.ErrScanTimedOut
+	case <-req.CancelCh:
+		err = common.ErrClientCancel
+	}
+
+	sa.mutex.Lock()
+	if w.admitted {
+		// admitted while giving up, the scan can go ahead
+		sa.mutex.Unlock()
+		return mem, nil
+	}
+	sa.waiters.Remove(elem)
+	// the scan may have been holding up smaller scans behind it
+	sa.admitWaiters()
+	sa.mutex.Unlock()
+
+	if err == common.ErrScanMemoryBudgetExceeded {
+		sa.reject(req, mem)
+	}
+	return 0, err
+}
+
+// release gives back the memory reserved by acquire, admitting waiting scans.
+func (sa *scanAdmission) release(mem int64) {
+
+	if mem == 0 {
+		return
+	}
+
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+
+	sa.memUsed -= mem
+	sa.admitWaiters()
+}
+
+// admitWaiters admits waiting scans in FIFO order, as long as they fit in
+// the budget. Called with the mutex held.
+func (sa *scanAdmission) admitWaiters() {
+
+	for elem := sa.waiters.Front(); elem != nil; elem = sa.waiters.Front() {
+		w := elem.Value.(*scanAdmissionWaiter)
+		if sa.budget > 0 && sa.memUsed+w.mem > sa.budget {
+			break
+		}
+		sa.waiters.Remove(elem)
+		sa.memUsed += w.mem
+		w.admitted = true
+		w.admitch <- true
+	}
+	sa.updateStats()
+}
+
+func (sa *scanAdmission) reject(req *ScanRequest, mem int64) {
+
+	logging.Warnf("%v scan rejected by admission control, estimated memory %v, "+
+		"memory budget %v", req.LogPrefix, mem, sa.budget)
+
+	if stats := sa.stats.Get(); stats != nil {
+		stats.numScanAdmissionRejected.Add(1)
+	}
+}
+
+// updateStats is called with the mutex held
+func (sa *scanAdmission) updateStats() {
+	if stats := sa.stats.Get(); stats != nil {
+		stats.scanAdmissionQueued.Set(int64(sa.waiters.Len()))
+		stats.scanAdmissionMemUsed.Set(sa.memUsed)
+	}
+}
+
+//
+// estimateScanMemory estimates the memory held by a scan while in flight,
+// from the average entry size of the index, the projection, the limit, and
+// the group by and aggregates of the request.
+//
+func estimateScanMemory(req *ScanRequest, config common.Config) int64 {
+
+	numPartitions := int64(len(req.PartitionIds))
+	if numPartitions == 0 {
+		numPartitions = 1
+	}
+
+	entrySize := int64(DEFAULT_SCAN_ENTRY_SIZE)
+	if req.Stats != nil {
+		rawDataSize := req.Stats.partnInt64Stats(func(ss *IndexStats) int64 {
+			return ss.rawDataSize.Value()
+		})
+		itemsCount := req.Stats.partnInt64Stats(func(ss *IndexStats) int64 {
+			return ss.itemsCount.Value()
+		})
+		if avg := computeAvgItemSize(rawDataSize, itemsCount); avg > 0 {
+			entrySize = avg
+		}
+	}
+
+	// only the projected keys are held after the scan pipeline
+	if proj := req.Indexprojection; proj != nil && len(proj.projectionKeys) != 0 {
+		projected := int64(0)
+		for _, p := range proj.projectionKeys {
+			if p {
+				projected++
+			}
+		}
+		if !proj.projectSecKeys || proj.entryKeysEmpty {
+			projected = 0
+		}
+		entrySize = MAX_DOCID_LEN + entrySize*projected/int64(len(proj.projectionKeys))
+	}
+
+	// rows held in the result queues of the scan
+	var rows int64
+	if numPartitions > 1 && req.Sorted {
+		size, _ := queueSize(int(numPartitions), req.Sorted, config)
+		rows = int64(size) * numPartitions
+	} else {
+		rows = int64(config["scan.queue_size"].Int())
+	}
+
+	// groups held in the partial group buffer of each partition
+	if ga := req.GroupAggr; ga != nil && !ga.IsLeadingGroup {
+		groupSize := entrySize + int64(len(ga.Aggrs))*DEFAULT_SCAN_ENTRY_SIZE
+		rows += int64(config["scan.partial_group_buffer_size"].Int()) * numPartitions * groupSize / entrySize
+	}
+
+	if req.Limit > 0 && req.Limit < rows && req.Offset < rows-req.Limit {
+		rows = req.Limit + req.Offset
+	}
+
+	mem := rows * entrySize
+
+	// pipeline block of each partition
+	mem += numPartitions * int64(config["settings.bufferPoolBlockSize"].Int())
+
+	if mem < MIN_SCAN_MEMORY_ESTIMATE {
+		mem = MIN_SCAN_MEMORY_ESTIMATE
+	}
+	return mem
+}
@@ -0,0 +1,269 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+const testAdmissionKB = 1024
+
+func admissionConfig(budgetMB, maxQueue, queueTimeoutMs int) common.Config {
+	config := common.SystemConfig.SectionConfig("indexer.", true).Clone()
+	config.SetValue("scan.admission.memory_budget", budgetMB)
+	config.SetValue("scan.admission.max_queue", maxQueue)
+	config.SetValue("scan.admission.queue_timeout", queueTimeoutMs)
+	return config
+}
+
+type admissionResult struct {
+	mem int64
+	err error
+}
+
+// acquireAsync acquires mem for req in the background, and waits until the
+// scan is admitted or queued.
+func acquireAsync(t *testing.T, sa *scanAdmission, req *ScanRequest, mem int64) chan admissionResult {
+	t.Helper()
+
+	sa.mutex.Lock()
+	queued := sa.waiters.Len()
+	sa.mutex.Unlock()
+
+	donech := make(chan admissionResult, 1)
+	go func() {
+		mem, err := sa.acquire(req, mem)
+		donech <- admissionResult{mem, err}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sa.mutex.Lock()
+		n := sa.waiters.Len()
+		sa.mutex.Unlock()
+		if n > queued || len(donech) != 0 {
+			return donech
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("scan neither admitted nor queued")
+	return nil
+}
+
+func expectAdmission(t *testing.T, donech chan admissionResult, mem int64, err error) {
+	t.Helper()
+
+	select {
+	case res := <-donech:
+		if res.mem != mem || res.err != err {
+			t.Fatalf("expected %v, %v, got %v, %v", mem, err, res.mem, res.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for admission")
+	}
+}
+
+func expectQueued(t *testing.T, sa *scanAdmission, donech chan admissionResult, queued int) {
+	t.Helper()
+
+	time.Sleep(10 * time.Millisecond)
+	if len(donech) != 0 {
+		t.Fatalf("expected scan to be queued, got %v", <-donech)
+	}
+	sa.mutex.Lock()
+	defer sa.mutex.Unlock()
+	if sa.waiters.Len() != queued {
+		t.Fatalf("expected %v queued scans, got %v", queued, sa.waiters.Len())
+	}
+}
+
+func TestScanAdmissionDisabled(t *testing.T) {
+	sa := newScanAdmission(admissionConfig(0, 10, 1000), &IndexerStatsHolder{})
+
+	mem, err := sa.acquire(&ScanRequest{}, 1<<40)
+	if mem != 0 || err != nil {
+		t.Fatalf("expected scan to be admitted without reservation, got %v, %v", mem, err)
+	}
+	sa.release(mem)
+	if sa.memUsed != 0 {
+		t.Errorf("expected no memory used, got %v", sa.memUsed)
+	}
+}
+
+func TestScanAdmissionAcquireRelease(t *testing.T) {
+	sa := newScanAdmission(admissionConfig(1, 10, 1000), &IndexerStatsHolder{})
+
+	mem1, err := sa.acquire(&ScanRequest{}, 256*testAdmissionKB)
+	if mem1 != 256*testAdmissionKB || err != nil {
+		t.Fatalf("unexpected admission %v, %v", mem1, err)
+	}
+
+	// a scan above the budget is admitted when it runs alone
+	sa.release(mem1)
+	mem2, err := sa.acquire(&ScanRequest{}, 4*1024*testAdmissionKB)
+	if mem2 != sa.budget || err != nil {
+		t.Fatalf("expected the scan to be capped to the budget, got %v, %v", mem2, err)
+	}
+	sa.release(mem2)
+
+	if sa.memUsed != 0 || sa.waiters.Len() != 0 {
+		t.Errorf("expected nothing in flight, got %v used and %v queued", sa.memUsed, sa.waiters.Len())
+	}
+}
+
+func TestScanAdmissionFIFO(t *testing.T) {
+	sa := newScanAdmission(admissionConfig(1, 10, 5000), &IndexerStatsHolder{})
+
+	memA, _ := sa.acquire(&ScanRequest{}, 512*testAdmissionKB)
+	memB, _ := sa.acquire(&ScanRequest{}, 512*testAdmissionKB)
+
+	done1 := acquireAsync(t, sa, &ScanRequest{}, 800*testAdmissionKB)
+	done2 := acquireAsync(t, sa, &ScanRequest{}, 100*testAdmissionKB)
+	expectQueued(t, sa, done2, 2)
+
+	// the second scan fits, but waits behind the first one
+	sa.release(memB)
+	expectQueued(t, sa, done2, 2)
+
+	sa.release(memA)
+	expectAdmission(t, done1, 800*testAdmissionKB, nil)
+	expectAdmission(t, done2, 100*testAdmissionKB, nil)
+
+	if sa.memUsed != 900*testAdmissionKB {
+		t.Errorf("expected the admitted scans to be accounted, got %v", sa.memUsed)
+	}
+	sa.release(800 * testAdmissionKB)
+	sa.release(100 * testAdmissionKB)
+	if sa.memUsed != 0 {
+		t.Errorf("expected no memory used, got %v", sa.memUsed)
+	}
+}
+
+func TestScanAdmissionReject(t *testing.T) {
+
+	// no queueing
+	sa := newScanAdmission(admissionConfig(1, 10, 0), &IndexerStatsHolder{})
+	mem, _ := sa.acquire(&ScanRequest{}, 1024*testAdmissionKB)
+	if _, err := sa.acquire(&ScanRequest{}, testAdmissionKB); err != common.ErrScanMemoryBudgetExceeded {
+		t.Errorf("expected scan to be rejected without queue timeout, got %v", err)
+	}
+	sa.release(mem)
+
+	// queue full
+	sa = newScanAdmission(admissionConfig(1, 1, 5000), &IndexerStatsHolder{})
+	mem, _ = sa.acquire(&ScanRequest{}, 1024*testAdmissionKB)
+	done := acquireAsync(t, sa, &ScanRequest{}, testAdmissionKB)
+	if _, err := sa.acquire(&ScanRequest{}, testAdmissionKB); err != common.ErrScanMemoryBudgetExceeded {
+		t.Errorf("expected scan to be rejected on a full queue, got %v", err)
+	}
+	sa.release(mem)
+	expectAdmission(t, done, testAdmissionKB, nil)
+	sa.release(testAdmissionKB)
+
+	// queue timeout
+	sa = newScanAdmission(admissionConfig(1, 10, 20), &IndexerStatsHolder{})
+	mem, _ = sa.acquire(&ScanRequest{}, 1024*testAdmissionKB)
+	if _, err := sa.acquire(&ScanRequest{}, testAdmissionKB); err != common.ErrScanMemoryBudgetExceeded {
+		t.Errorf("expected scan to be rejected on queue timeout, got %v", err)
+	}
+	if sa.waiters.Len() != 0 || sa.memUsed != mem {
+		t.Errorf("expected the rejected scan to hold nothing, got %v used and %v queued",
+			sa.memUsed, sa.waiters.Len())
+	}
+}
+
+func TestScanAdmissionGiveUp(t *testing.T) {
+	sa := newScanAdmission(admissionConfig(1, 10, 5000), &IndexerStatsHolder{})
+	mem, _ := sa.acquire(&ScanRequest{}, 900*testAdmissionKB)
+
+	// a cancelled scan leaves the queue, and the scan behind it is admitted
+	cancelch := make(chan bool)
+	done1 := acquireAsync(t, sa, &ScanRequest{CancelCh: cancelch}, 800*testAdmissionKB)
+	done2 := acquireAsync(t, sa, &ScanRequest{}, 100*testAdmissionKB)
+	expectQueued(t, sa, done2, 2)
+
+	close(cancelch)
+	expectAdmission(t, done1, 0, common.ErrClientCancel)
+	expectAdmission(t, done2, 100*testAdmissionKB, nil)
+
+	// a scan timing out leaves the queue
+	timeout := time.NewTimer(20 * time.Millisecond)
+	done3 := acquireAsync(t, sa, &ScanRequest{Timeout: timeout}, 800*testAdmissionKB)
+	expectAdmission(t, done3, 0, common.ErrScanTimedOut)
+
+	sa.release(100 * testAdmissionKB)
+	sa.release(mem)
+	if sa.memUsed != 0 || sa.waiters.Len() != 0 {
+		t.Errorf("expected nothing in flight, got %v used and %v queued", sa.memUsed, sa.waiters.Len())
+	}
+}
+
+func TestScanAdmissionUpdateConfig(t *testing.T) {
+	sa := newScanAdmission(admissionConfig(1, 10, 5000), &IndexerStatsHolder{})
+	mem, _ := sa.acquire(&ScanRequest{}, 1024*testAdmissionKB)
+
+	done := acquireAsync(t, sa, &ScanRequest{}, 512*testAdmissionKB)
+	expectQueued(t, sa, done, 1)
+
+	// waiters that fit in a larger budget are admitted
+	sa.updateConfig(admissionConfig(2, 10, 5000))
+	expectAdmission(t, done, 512*testAdmissionKB, nil)
+
+	sa.release(mem)
+	sa.release(512 * testAdmissionKB)
+	if sa.memUsed != 0 {
+		t.Errorf("expected no memory used, got %v", sa.memUsed)
+	}
+}
+
+func TestEstimateScanMemory(t *testing.T) {
+	config := common.SystemConfig.SectionConfig("indexer.", true)
+	rows := int64(config["scan.queue_size"].Int())
+	block := int64(config["settings.bufferPoolBlockSize"].Int())
+
+	sortedRows, _ := queueSize(4, true, config)
+	partitions := []common.PartitionId{1, 2, 3, 4}
+
+	tests := []struct {
+		name string
+		req  *ScanRequest
+		mem  int64
+	}{
+		{"default", &ScanRequest{}, rows*DEFAULT_SCAN_ENTRY_SIZE + block},
+		{"limit", &ScanRequest{Limit: 5}, 5*DEFAULT_SCAN_ENTRY_SIZE + block},
+		{"limit beyond the queue", &ScanRequest{Limit: rows * 2}, rows*DEFAULT_SCAN_ENTRY_SIZE + block},
+		{"partitioned", &ScanRequest{PartitionIds: partitions},
+			rows*DEFAULT_SCAN_ENTRY_SIZE + 4*block},
+		{"sorted partitioned", &ScanRequest{PartitionIds: partitions, Sorted: true},
+			int64(sortedRows)*4*DEFAULT_SCAN_ENTRY_SIZE + 4*block},
+		{"projection", &ScanRequest{Indexprojection: &Projection{
+			projectSecKeys: true,
+			projectionKeys: []bool{true, false, false, false},
+		}}, rows*(MAX_DOCID_LEN+DEFAULT_SCAN_ENTRY_SIZE/4) + block},
+		{"group by", &ScanRequest{GroupAggr: &GroupAggr{Aggrs: []*Aggregate{{}, {}}}},
+			(rows+int64(config["scan.partial_group_buffer_size"].Int())*3)*DEFAULT_SCAN_ENTRY_SIZE + block},
+		{"leading group by", &ScanRequest{GroupAggr: &GroupAggr{IsLeadingGroup: true}},
+			rows*DEFAULT_SCAN_ENTRY_SIZE + block},
+	}
+
+	for _, test := range tests {
+		if mem := estimateScanMemory(test.req, config); mem != test.mem {
+			t.Errorf("%v: expected %v, got %v", test.name, test.mem, mem)
+		}
+	}
+
+	small := config.Clone()
+	small.SetValue("settings.bufferPoolBlockSize", 0)
+	if mem := estimateScanMemory(&ScanRequest{Limit: 1}, small); mem != MIN_SCAN_MEMORY_ESTIMATE {
+		t.Errorf("expected the minimum estimate, got %v", mem)
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/couchbase/indexing/secondary/audit"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
 	p "github.com/couchbase/indexing/secondary/pipeline"
@@ -71,6 +72,8 @@ type scanCoordinator struct {
 	numDecodeErrors uint32       // Number of errors in collatejson decode.
 	cpuThrottle     *CpuThrottle // for Autofailover CPU throttling
 	meteringMgr     *MeteringThrottlingMgr
+	admission       *scanAdmission // memory-aware scan admission control
+	rateLimiter     *scanRateLimiter
 
 	bucketNameNumVBucketsMapHolder common.BucketNameNumVBucketsMapHolder
 
@@ -128,6 +131,8 @@ func NewScanCoordinator(supvCmdch MsgChannel, supvMsgch MsgChannel,
 
 	s.setIndexerState(common.INDEXER_BOOTSTRAP)
 	s.stats.Set(stats)
+	s.admission = newScanAdmission(config, &s.stats)
+	s.rateLimiter = newScanRateLimiter(config, &s.stats)
 
 	for i := 0; i < len(s.snapshotNotifych); i++ {
 		go s.listenSnapshot(i)
@@ -354,6 +359,24 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, ctx interface{},
 		return
 	}
 
+	if err := s.rateLimiter.allow(req.User, req.IndexInst.Defn.Bucket, req.IndexInst.Defn.Scope); err != nil {
+		s.tryRespondWithError(w, req, err)
+		return
+	}
+
+	// scans are not audited by default, see indexer.settings.audit.disabled_events
+	if !audit.IsFiltered(common.AUDIT_INDEX_SCAN, req.User) {
+		audit.AuditNonHttp(common.AUDIT_INDEX_SCAN, conn.RemoteAddr(), conn.LocalAddr(),
+			"ScanCoordinator::serverCallback", &audit.AuditFields{
+				User:       req.User,
+				Message:    string(req.ScanType),
+				Bucket:     req.IndexInst.Defn.Bucket,
+				Scope:      req.IndexInst.Defn.Scope,
+				Collection: req.IndexInst.Defn.Collection,
+				Index:      req.IndexInst.Defn.Name,
+			})
+	}
+
 	if req.Stats != nil {
 		elapsed := time.Now().Sub(ttime).Nanoseconds()
 		req.Stats.scanReqInitDuration.Add(elapsed)
@@ -395,6 +418,15 @@ func (s *scanCoordinator) serverCallback(protoReq interface{}, ctx interface{},
 		}
 	}
 
+	// Admit the scan if its estimated memory fits in the scan memory budget
+	if req.ScanType == ScanReq || req.ScanType == ScanAllReq {
+		admitted, err := s.admission.acquire(req, estimateScanMemory(req, s.config.Load()))
+		if s.tryRespondWithError(w, req, err) {
+			return
+		}
+		defer s.admission.release(admitted)
+	}
+
 	// Pre-scan checks passed, so get a snapshot for the scan
 	t0 := time.Now()
 	is, err := s.getRequestedIndexSnapshot(req)
@@ -1093,6 +1125,10 @@ func (s *scanCoordinator) updateErrStats(req *ScanRequest, err error) {
 			req.Stats.numScanTimeouts.Add(1)
 		case common.ErrIndexNotReady:
 			req.Stats.notReadyError.Add(1)
+		case common.ErrScanMemoryBudgetExceeded:
+			req.Stats.numScanAdmissionRejected.Add(1)
+		case common.ErrScanThrottled:
+			req.Stats.numScansThrottled.Add(1)
 		default:
 			req.Stats.numScanErrors.Add(1)
 		}
@@ -1229,6 +1265,8 @@ func (s *scanCoordinator) handleUpdateIndexPartnMap(cmd Message) {
 func (s *scanCoordinator) handleConfigUpdate(cmd Message) {
 	cfgUpdate := cmd.(*MsgConfigUpdate)
 	s.config.Store(cfgUpdate.GetConfig())
+	s.admission.updateConfig(cfgUpdate.GetConfig())
+	s.rateLimiter.updateConfig(cfgUpdate.GetConfig())
 	s.supvCmdch <- &MsgSuccess{}
 }
 
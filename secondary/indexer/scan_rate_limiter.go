@@ -0,0 +1,295 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//////////////////////////////////////////////////////////////////
+// Scan rate limits
+//////////////////////////////////////////////////////////////////
+
+//
+// Scan requests can be rate limited per user and per bucket or scope, with a
+// token bucket per limited user, bucket and scope. Each scan request takes a
+// token from each of the token buckets that apply to it, and is rejected with
+// common.ErrScanThrottled if any of them is empty.
+//
+// Limits are set by rules, a JSON array in the setting
+// indexer.settings.scan.rate_limits, e.g.
+//
+//   [{"user": "*", "rate": 100},
+//    {"user": "reporting", "rate": 10, "burst": 50},
+//    {"bucket": "travel-sample", "scope": "inventory", "rate": 1000}]
+//
+// rate is in scans per second and burst, by default equal to rate, is the
+// number of scans that can be made at once after a quiet period. A rule for
+// user or bucket "*" applies separately to each user or bucket that does not
+// have a rule of its own. Scope rules apply in addition to bucket rules.
+//
+// Token buckets are kept by each indexer node, for the scans it serves. Rates
+// are hence per node: a scan of an index partitioned over N nodes takes a
+// token on each of the N nodes, and the scans of a user can add up to the rate
+// times the number of indexer nodes across the cluster. Clients detect
+// throttled scans by common.ScanThrottledCode, and do not retry them with a
+// replica, which would take a token from the replica's node as well.
+//
+
+const SCAN_RATE_LIMIT_ANY = "*"
+
+// token buckets that are full are dropped above this number of token buckets
+const MAX_SCAN_TOKEN_BUCKETS = 10000
+
+type scanRateLimitRule struct {
+	User   string  `json:"user,omitempty"`
+	Bucket string  `json:"bucket,omitempty"`
+	Scope  string  `json:"scope,omitempty"`
+	Rate   float64 `json:"rate"`
+	Burst  float64 `json:"burst,omitempty"`
+}
+
+func (r *scanRateLimitRule) validate() error {
+
+	if (r.User == "") == (r.Bucket == "") {
+		return fmt.Errorf("either user or bucket must be set")
+	}
+	if r.Scope != "" && r.Bucket == "" {
+		return fmt.Errorf("scope %v is set without a bucket", r.Scope)
+	}
+	if r.Scope == SCAN_RATE_LIMIT_ANY || (r.Bucket == SCAN_RATE_LIMIT_ANY && r.Scope != "") {
+		return fmt.Errorf("\"%v\" is only allowed for a user or a bucket", SCAN_RATE_LIMIT_ANY)
+	}
+	if r.Rate <= 0 {
+		return fmt.Errorf("rate %v must be greater than 0", r.Rate)
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("burst %v must not be negative", r.Burst)
+	}
+	return nil
+}
+
+// burst returns the capacity of the token buckets of the rule, at least 1
+func (r *scanRateLimitRule) burst() float64 {
+	burst := r.Burst
+	if burst == 0 {
+		burst = r.Rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
+
+func parseScanRateLimitRules(value string) ([]*scanRateLimitRule, error) {
+
+	if len(strings.TrimSpace(value)) == 0 {
+		return nil, nil
+	}
+
+	var rules []*scanRateLimitRule
+	if err := json.Unmarshal([]byte(value), &rules); err != nil {
+		return nil, fmt.Errorf("Scan rate limits must be a JSON array of rules: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	for i, rule := range rules {
+		if rule == nil {
+			return nil, fmt.Errorf("Scan rate limit rule #%v is null", i)
+		}
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("Scan rate limit rule #%v: %v", i, err)
+		}
+		key := scanRateLimitKey(rule.User, rule.Bucket, rule.Scope)
+		if seen[key] {
+			return nil, fmt.Errorf("Scan rate limit rule #%v: duplicate rule for %v", i, key)
+		}
+		seen[key] = true
+	}
+
+	return rules, nil
+}
+
+// scanRateLimitKey returns the key of the token bucket of a user, bucket or scope
+func scanRateLimitKey(user, bucket, scope string) string {
+	if user != "" {
+		return "user:" + user
+	}
+	if scope != "" {
+		return "scope:" + bucket + "." + scope
+	}
+	return "bucket:" + bucket
+}
+
+type scanTokenBucket struct {
+	rule   *scanRateLimitRule
+	tokens float64
+	last   time.Time
+}
+
+func (tb *scanTokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(tb.last).Seconds(); elapsed > 0 {
+		tb.tokens += elapsed * tb.rule.Rate
+		if burst := tb.rule.burst(); tb.tokens > burst {
+			tb.tokens = burst
+		}
+	}
+	tb.last = now
+}
+
+type scanRateLimiter struct {
+	mutex sync.Mutex
+
+	value string
+	rules map[string]*scanRateLimitRule // by token bucket key
+
+	buckets map[string]*scanTokenBucket
+
+	stats *IndexerStatsHolder
+}
+
+func newScanRateLimiter(config common.Config, stats *IndexerStatsHolder) *scanRateLimiter {
+	rl := &scanRateLimiter{
+		rules:   make(map[string]*scanRateLimitRule),
+		buckets: make(map[string]*scanTokenBucket),
+		stats:   stats,
+	}
+	rl.updateConfig(config)
+	return rl
+}
+
+func (rl *scanRateLimiter) updateConfig(config common.Config) {
+
+	value := config["settings.scan.rate_limits"].String()
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if value == rl.value {
+		return
+	}
+
+	rules, err := parseScanRateLimitRules(value)
+	if err != nil {
+		// settings are validated, only an invalid value from an older version can fail
+		logging.Errorf("ScanCoordinator::updateScanRateLimits %v. Scan rate limits ignored.", err)
+		rules = nil
+	}
+	logging.Infof("ScanCoordinator::updateScanRateLimits rules %v", value)
+
+	rl.value = value
+	rl.rules = make(map[string]*scanRateLimitRule)
+	for _, rule := range rules {
+		rl.rules[scanRateLimitKey(rule.User, rule.Bucket, rule.Scope)] = rule
+	}
+
+	// token buckets start full with the new rules
+	rl.buckets = make(map[string]*scanTokenBucket)
+}
+
+//
+// allow takes a token for a scan of user on bucket and scope from each token
+// bucket that applies to it. It returns common.ErrScanThrottled, and takes no
+// token, if any of them is empty.
+//
+func (rl *scanRateLimiter) allow(user, bucket, scope string) error {
+
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if len(rl.rules) == 0 {
+		return nil
+	}
+
+	var limits [3]*scanTokenBucket
+	var keys [3]string
+	n := 0
+
+	addLimit := func(key string, rule *scanRateLimitRule) {
+		if rule != nil {
+			keys[n] = key
+			limits[n] = rl.getTokenBucket(key, rule)
+			n++
+		}
+	}
+
+	if user != "" {
+		key := scanRateLimitKey(user, "", "")
+		rule := rl.rules[key]
+		if rule == nil {
+			rule = rl.rules[scanRateLimitKey(SCAN_RATE_LIMIT_ANY, "", "")]
+		}
+		addLimit(key, rule)
+	}
+
+	key := scanRateLimitKey("", bucket, "")
+	rule := rl.rules[key]
+	if rule == nil {
+		rule = rl.rules[scanRateLimitKey("", SCAN_RATE_LIMIT_ANY, "")]
+	}
+	addLimit(key, rule)
+
+	if scope != "" {
+		key = scanRateLimitKey("", bucket, scope)
+		addLimit(key, rl.rules[key])
+	}
+
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		limits[i].refill(now)
+		if limits[i].tokens < 1 {
+			logging.Verbosef("ScanCoordinator::scanRateLimiter scan throttled by the rate limit of %v", keys[i])
+			if stats := rl.stats.Get(); stats != nil {
+				stats.numScansThrottled.Add(1)
+			}
+			return common.ErrScanThrottled
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		limits[i].tokens--
+	}
+	return nil
+}
+
+// getTokenBucket is called with the mutex held
+func (rl *scanRateLimiter) getTokenBucket(key string, rule *scanRateLimitRule) *scanTokenBucket {
+
+	if tb, ok := rl.buckets[key]; ok {
+		return tb
+	}
+
+	if len(rl.buckets) >= MAX_SCAN_TOKEN_BUCKETS {
+		rl.pruneTokenBuckets()
+	}
+
+	tb := &scanTokenBucket{rule: rule, tokens: rule.burst(), last: time.Now()}
+	rl.buckets[key] = tb
+	return tb
+}
+
+// pruneTokenBuckets drops the token buckets that are full, as a new token
+// bucket starts full. Called with the mutex held.
+func (rl *scanRateLimiter) pruneTokenBuckets() {
+
+	now := time.Now()
+	for key, tb := range rl.buckets {
+		tb.refill(now)
+		if tb.tokens >= tb.rule.burst() {
+			delete(rl.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func rateLimitConfig(rules string) common.Config {
+	config := common.SystemConfig.SectionConfig("indexer.", true).Clone()
+	config.SetValue("settings.scan.rate_limits", rules)
+	return config
+}
+
+func TestParseScanRateLimitRules(t *testing.T) {
+
+	tests := []struct {
+		value string
+		rules int
+		err   bool
+	}{
+		{"", 0, false},
+		{"  ", 0, false},
+		{"[]", 0, false},
+		{`[{"user": "*", "rate": 100}, {"user": "u1", "rate": 10, "burst": 50},
+			{"bucket": "b1", "rate": 1000}, {"bucket": "b1", "scope": "s1", "rate": 10}]`, 4, false},
+		{`{"user": "u1", "rate": 10}`, 0, true},
+		{`[null]`, 0, true},
+		{`[{"rate": 10}]`, 0, true},
+		{`[{"user": "u1", "bucket": "b1", "rate": 10}]`, 0, true},
+		{`[{"user": "u1", "scope": "s1", "rate": 10}]`, 0, true},
+		{`[{"bucket": "b1", "scope": "*", "rate": 10}]`, 0, true},
+		{`[{"bucket": "*", "scope": "s1", "rate": 10}]`, 0, true},
+		{`[{"user": "u1", "rate": 0}]`, 0, true},
+		{`[{"user": "u1", "rate": 10, "burst": -1}]`, 0, true},
+		{`[{"user": "u1", "rate": 10}, {"user": "u1", "rate": 20}]`, 0, true},
+	}
+
+	for _, test := range tests {
+		rules, err := parseScanRateLimitRules(test.value)
+		if (err != nil) != test.err || len(rules) != test.rules {
+			t.Errorf("%v: expected %v rules and error %v, got %v, %v", test.value, test.rules,
+				test.err, len(rules), err)
+		}
+	}
+}
+
+func TestScanRateLimitBurst(t *testing.T) {
+
+	tests := []struct {
+		rate, burst, expected float64
+	}{
+		{10, 0, 10},
+		{10, 50, 50},
+		{0.5, 0, 1},
+		{10, 0.5, 1},
+	}
+
+	for _, test := range tests {
+		rule := &scanRateLimitRule{User: "u1", Rate: test.rate, Burst: test.burst}
+		if burst := rule.burst(); burst != test.expected {
+			t.Errorf("rate %v burst %v: expected %v, got %v", test.rate, test.burst, test.expected, burst)
+		}
+	}
+}
+
+func TestScanTokenBucketRefill(t *testing.T) {
+
+	now := time.Now()
+	tb := &scanTokenBucket{rule: &scanRateLimitRule{User: "u1", Rate: 10, Burst: 20}, last: now}
+
+	tb.refill(now.Add(500 * time.Millisecond))
+	if tb.tokens != 5 {
+		t.Errorf("expected 5 tokens, got %v", tb.tokens)
+	}
+
+	// time going backwards adds no token
+	tb.refill(now)
+	if tb.tokens != 5 {
+		t.Errorf("expected 5 tokens, got %v", tb.tokens)
+	}
+
+	tb.refill(now.Add(time.Hour))
+	if tb.tokens != 20 {
+		t.Errorf("expected tokens to be capped to the burst, got %v", tb.tokens)
+	}
+}
+
+// Rates are low enough for the token buckets not to refill during the tests.
+func TestScanRateLimiterAllow(t *testing.T) {
+
+	rl := newScanRateLimiter(rateLimitConfig(""), &IndexerStatsHolder{})
+	for i := 0; i < 100; i++ {
+		if err := rl.allow("u1", "b1", "s1"); err != nil {
+			t.Fatalf("expected scans to be allowed without rules, got %v", err)
+		}
+	}
+
+	rl.updateConfig(rateLimitConfig(`[{"user": "*", "rate": 0.001, "burst": 1},
+		{"user": "u1", "rate": 0.001, "burst": 2}]`))
+
+	// u1 has its own rule, u2 and u3 each have a token bucket of the "*" rule
+	for _, user := range []string{"u1", "u1", "u2", "u3", ""} {
+		if err := rl.allow(user, "b1", ""); err != nil {
+			t.Errorf("expected a scan of %v to be allowed, got %v", user, err)
+		}
+	}
+	for _, user := range []string{"u1", "u2", "u3"} {
+		if err := rl.allow(user, "b1", ""); err != common.ErrScanThrottled {
+			t.Errorf("expected a scan of %v to be throttled, got %v", user, err)
+		}
+	}
+
+	// same rules, token buckets are kept
+	rl.updateConfig(rateLimitConfig(rl.value))
+	if err := rl.allow("u1", "b1", ""); err != common.ErrScanThrottled {
+		t.Errorf("expected token buckets to be kept, got %v", err)
+	}
+
+	// new rules, token buckets start full
+	rl.updateConfig(rateLimitConfig(`[{"user": "u1", "rate": 0.001, "burst": 1}]`))
+	if err := rl.allow("u1", "b1", ""); err != nil {
+		t.Errorf("expected token buckets to be reset, got %v", err)
+	}
+}
+
+func TestScanRateLimiterBucketScope(t *testing.T) {
+
+	rl := newScanRateLimiter(rateLimitConfig(`[{"bucket": "*", "rate": 0.001, "burst": 1},
+		{"bucket": "b1", "rate": 0.001, "burst": 3},
+		{"bucket": "b1", "scope": "s1", "rate": 0.001, "burst": 1}]`), &IndexerStatsHolder{})
+
+	if err := rl.allow("u1", "b1", "s1"); err != nil {
+		t.Fatalf("expected a scan to be allowed, got %v", err)
+	}
+
+	// throttled by the scope, so it takes no token from the bucket
+	if err := rl.allow("u1", "b1", "s1"); err != common.ErrScanThrottled {
+		t.Fatalf("expected a scan to be throttled, got %v", err)
+	}
+	if tokens := rl.buckets[scanRateLimitKey("", "b1", "")].tokens; tokens < 2 || tokens >= 3 {
+		t.Fatalf("expected 2 tokens left in the bucket, got %v", tokens)
+	}
+
+	// scopes without a rule only count against the bucket
+	for _, scope := range []string{"s2", ""} {
+		if err := rl.allow("u1", "b1", scope); err != nil {
+			t.Errorf("expected a scan of scope %v to be allowed, got %v", scope, err)
+		}
+	}
+	if err := rl.allow("u1", "b1", "s2"); err != common.ErrScanThrottled {
+		t.Errorf("expected the bucket to be throttled, got %v", err)
+	}
+
+	// other buckets each have a token bucket of the "*" rule
+	for _, bucket := range []string{"b2", "b3"} {
+		if err := rl.allow("u1", bucket, "s1"); err != nil {
+			t.Errorf("expected a scan of %v to be allowed, got %v", bucket, err)
+		}
+		if err := rl.allow("u1", bucket, "s1"); err != common.ErrScanThrottled {
+			t.Errorf("expected a scan of %v to be throttled, got %v", bucket, err)
+		}
+	}
+}
+
+func TestScanRateLimiterPrune(t *testing.T) {
+
+	rl := newScanRateLimiter(rateLimitConfig(`[{"user": "*", "rate": 0.001, "burst": 1}]`),
+		&IndexerStatsHolder{})
+
+	for _, user := range []string{"u1", "u2"} {
+		rl.allow(user, "b1", "")
+	}
+	rl.getTokenBucket(scanRateLimitKey("u3", "", ""), rl.rules[scanRateLimitKey(SCAN_RATE_LIMIT_ANY, "", "")])
+
+	// only the full token bucket of u3 is dropped
+	rl.pruneTokenBuckets()
+	if len(rl.buckets) != 2 || rl.buckets[scanRateLimitKey("u3", "", "")] != nil {
+		t.Errorf("expected the full token bucket to be dropped, got %v", rl.buckets)
+	}
+}
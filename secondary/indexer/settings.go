@@ -10,6 +10,7 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
@@ -35,8 +36,11 @@ import (
 )
 
 const (
-	indexCompactonMetaPath = common.IndexingMetaDir + "triggerCompaction"
-	compactionDaysSetting  = "indexer.settings.compaction.days_of_week"
+	indexCompactonMetaPath  = common.IndexingMetaDir + "triggerCompaction"
+	compactionDaysSetting   = "indexer.settings.compaction.days_of_week"
+	compactionPolicySetting = "indexer.settings.compaction.policies"
+	flushPrioritySetting    = "indexer.settings.flush.priority_rules"
+	scanRateLimitsSetting   = "indexer.settings.scan.rate_limits"
 )
 
 // settingsManager implements dynamic settings management for indexer.
@@ -244,6 +248,17 @@ func (s *settingsManager) handleSettings(w http.ResponseWriter, r *http.Request,
 			s.writeError(w, err)
 			return
 		}
+
+		// the settings are already stored, audit the change without them
+		// rather than failing the request
+		changed := make(map[string]interface{})
+		if err := json.Unmarshal(bytes, &changed); err != nil {
+			logging.Errorf("SettingsManager::handleSettings Fail to unmarshal changed settings "+
+				"for audit.  Error: %v", err)
+			changed = nil
+		}
+		audit.AuditWithFields(common.AUDIT_SETTINGS_CHANGE, r, "SettingsManager::handleSettings",
+			&audit.AuditFields{User: creds.Name(), Settings: changed})
 		s.writeOk(w)
 
 	} else if r.Method == "GET" {
@@ -291,6 +306,8 @@ func (s *settingsManager) handleCompactionTrigger(w http.ResponseWriter, r *http
 		return
 	}
 
+	audit.AuditWithFields(common.AUDIT_TRIGGER_COMPACTION, r, "SettingsManager::handleCompactionTrigger",
+		&audit.AuditFields{User: creds.Name()})
 	s.writeOk(w)
 }
 
@@ -577,6 +594,24 @@ func validateSettings(value []byte, current common.Config, internal bool) error
 		}
 	}
 
+	if val, ok := newConfig[compactionPolicySetting]; ok {
+		if _, err := parseCompactionPolicies(val.String()); err != nil {
+			return err
+		}
+	}
+
+	if val, ok := newConfig[flushPrioritySetting]; ok {
+		if _, err := parseFlushPriorityRules(val.String()); err != nil {
+			return err
+		}
+	}
+
+	if val, ok := newConfig[scanRateLimitsSetting]; ok {
+		if _, err := parseScanRateLimitRules(val.String()); err != nil {
+			return err
+		}
+	}
+
 	if val, ok := newConfig["indexer.settings.max_seckey_size"]; ok {
 		if val.Int() <= 0 {
 			return errors.New("Setting should be an integer greater than 0")
@@ -633,6 +668,10 @@ func validateSettings(value []byte, current common.Config, internal bool) error
 						return errors.New("Memory optimized storage mode is not supported for community version")
 					}
 				}
+
+				if err := checkEncryptionSupport(common.IndexTypeToStorageMode(common.IndexType(storageMode))); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -0,0 +1,40 @@
+package indexer
+
+import (
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/security/encryption"
+)
+
+type testKeyProvider struct {
+	encryption.KeyProvider
+}
+
+func TestValidateStorageModeEncryption(t *testing.T) {
+
+	buildMode := common.GetBuildMode()
+	common.SetBuildMode(common.ENTERPRISE)
+	defer common.SetBuildMode(buildMode)
+
+	current := common.Config{"indexer.settings.storage_mode": common.ConfigValue{Value: ""}}
+	plasma := []byte(`{"indexer.settings.storage_mode": "plasma"}`)
+	moi := []byte(`{"indexer.settings.storage_mode": "memory_optimized"}`)
+
+	if err := validateSettings(plasma, current, false); err != nil {
+		t.Errorf("expected plasma to be accepted without encryption, got %v", err)
+	}
+
+	encryption.SetKeyProvider(&testKeyProvider{})
+	defer encryption.SetKeyProvider(nil)
+
+	if err := validateSettings(plasma, current, false); err == nil {
+		t.Errorf("expected plasma to be rejected with encryption enabled")
+	}
+	if err := validateSettings(moi, current, false); err != nil {
+		t.Errorf("expected memory optimized to be accepted with encryption enabled, got %v", err)
+	}
+	if err := checkEncryptionSupport(common.FORESTDB); err != nil {
+		t.Errorf("expected forestdb to support encryption, got %v", err)
+	}
+}
@@ -35,6 +35,7 @@ import (
 	commonjson "github.com/couchbase/indexing/secondary/common/json"
 	"github.com/couchbase/indexing/secondary/iowrap"
 	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 	"github.com/couchbase/indexing/secondary/stats"
 	"github.com/couchbase/indexing/secondary/stubs/nitro/mm"
 	"github.com/couchbase/logstats/logstats"
@@ -176,7 +177,8 @@ func (it *IndexTimingStats) Init() {
 type IndexStats struct {
 	name, scope, collection, bucket, dispName string
 
-	indexState stats.Uint64Val
+	indexState       stats.Uint64Val
+	encryptionStatus stats.StringVal
 
 	replicaId        int
 	isArrayIndex     bool
@@ -239,6 +241,8 @@ type IndexStats struct {
 	numDocsFlushQueued        stats.Int64Val
 	fragPercent               stats.Int64Val
 	sinceLastSnapshot         stats.Int64Val
+	numSnapshotsDeferred      stats.Int64Val // # in-memory snapshots deferred for best-effort flush priority
+	flushLagSince             stats.Int64Val // time the snapshot of a best-effort index started lagging behind its keyspace, 0 if up to date
 	numSnapshotWaiters        stats.Int64Val
 	numLastSnapshotReply      stats.Int64Val
 	numItemsRestored          stats.Int64Val
@@ -246,6 +250,8 @@ type IndexStats struct {
 	diskSnapLoadDuration      stats.Int64Val
 	notReadyError             stats.Int64Val
 	clientCancelError         stats.Int64Val
+	numScanAdmissionRejected  stats.Int64Val
+	numScansThrottled         stats.Int64Val
 	numScanTimeouts           stats.Int64Val
 	numScanErrors             stats.Int64Val
 	avgScanRate               stats.Int64Val
@@ -455,6 +461,7 @@ type ShardTransferStatistics struct {
 
 func (s *IndexStats) Init() {
 	s.indexState.Init()
+	s.encryptionStatus.Init()
 	s.scanDuration.Init()
 	s.scanReqDuration.Init()
 	s.scanReqInitDuration.Init()
@@ -509,6 +516,8 @@ func (s *IndexStats) Init() {
 	s.numItemsFlushed.Init()
 	s.numDocsFlushQueued.Init()
 	s.sinceLastSnapshot.Init()
+	s.numSnapshotsDeferred.Init()
+	s.flushLagSince.Init()
 	s.numSnapshotWaiters.Init()
 	s.numLastSnapshotReply.Init()
 	s.numItemsRestored.Init()
@@ -516,6 +525,8 @@ func (s *IndexStats) Init() {
 	s.diskSnapLoadDuration.Init()
 	s.notReadyError.Init()
 	s.clientCancelError.Init()
+	s.numScanAdmissionRejected.Init()
+	s.numScansThrottled.Init()
 	s.numScanTimeouts.Init()
 	s.numScanErrors.Init()
 	s.avgScanRate.Init()
@@ -712,6 +723,18 @@ func (s *IndexStats) partnInt64Stats(f func(*IndexStats) int64) int64 {
 	return f(s)
 }
 
+// partnEncryptionStatus returns the encryption status of the index. An index
+// is reported as encrypted only if all of its partitions are encrypted with
+// the active key.
+func (s *IndexStats) partnEncryptionStatus() string {
+
+	var status string
+	for _, ps := range s.partitions {
+		status = encryption.MergeStatus(status, ps.encryptionStatus.Get())
+	}
+	return status
+}
+
 func (s *IndexStats) partnAvgInt64Stats(f func(*IndexStats) int64) int64 {
 
 	return s.int64Stats(f)
@@ -798,6 +821,11 @@ type IndexerStats struct {
 	notFoundError      stats.Int64Val
 	numTenants         stats.Int64Val
 
+	scanAdmissionQueued      stats.Int64Val //scans waiting for admission
+	scanAdmissionMemUsed     stats.Int64Val //estimated memory of admitted scans
+	numScanAdmissionRejected stats.Int64Val
+	numScansThrottled        stats.Int64Val
+
 	unitsQuota      stats.Int64Val //RU/WU normalized units quota for serverless model
 	unitsUsedActual stats.Int64Val //RU/WU normalized units used for serverless model
 
@@ -852,6 +880,10 @@ func (s *IndexerStats) Init() {
 	s.statsResponse.Init()
 	s.indexerState.Init()
 	s.notFoundError.Init()
+	s.scanAdmissionQueued.Init()
+	s.scanAdmissionMemUsed.Init()
+	s.numScanAdmissionRejected.Init()
+	s.numScansThrottled.Init()
 	s.prjLatencyMap = &MapHolder{}
 	s.prjLatencyMap.Init()
 
@@ -1207,6 +1239,10 @@ func (s *IndexStats) getArrKeySizeStats() map[string]interface{} {
 func (is *IndexerStats) PopulateIndexerStats(statMap *StatsMap) {
 	statMap.AddStatValueFiltered("num_connections", &is.numConnections)
 	statMap.AddStatValueFiltered("index_not_found_errcount", &is.notFoundError)
+	statMap.AddStatValueFiltered("scan_admission_queued", &is.scanAdmissionQueued)
+	statMap.AddStatValueFiltered("scan_admission_mem_used", &is.scanAdmissionMemUsed)
+	statMap.AddStatValueFiltered("num_scan_admission_rejected", &is.numScanAdmissionRejected)
+	statMap.AddStatValueFiltered("num_scans_throttled", &is.numScansThrottled)
 	statMap.AddStatValueFiltered("memory_quota", &is.memoryQuota)
 	statMap.AddStatValueFiltered("memory_used", &is.memoryUsed)
 	statMap.AddStatValueFiltered("memory_used_storage", &is.memoryUsedStorage)
@@ -1719,6 +1755,12 @@ func (s *IndexStats) addIndexStatsToMap(statMap *StatsMap, spec *statsSpec) {
 
 	statMap.AddStatValueFiltered("index_state", &s.indexState)
 
+	if len(s.partitions) != 0 {
+		status := s.partnEncryptionStatus()
+		s.encryptionStatus.Set(&status)
+	}
+	statMap.AddStatValueFiltered("encryption_status", &s.encryptionStatus)
+
 	// ----------------------
 	// All int64Stats
 	// ----------------------
@@ -1825,6 +1867,21 @@ func (s *IndexStats) addIndexStatsToMap(statMap *StatsMap, spec *statsSpec) {
 		},
 		&s.sinceLastSnapshot, s.int64Stats)
 
+	statMap.AddAggrStatFiltered("num_snapshots_deferred",
+		func(ss *IndexStats) int64 {
+			return ss.numSnapshotsDeferred.Value()
+		},
+		&s.numSnapshotsDeferred, s.int64Stats)
+
+	statMap.AddAggrStatFiltered("flush_lag",
+		func(ss *IndexStats) int64 {
+			if since := ss.flushLagSince.Value(); since != 0 {
+				return time.Now().UnixNano() - since
+			}
+			return 0
+		},
+		&s.flushLagSince, s.int64Stats)
+
 	statMap.AddAggrStatFiltered("num_snapshot_waiters",
 		func(ss *IndexStats) int64 {
 			return ss.numSnapshotWaiters.Value()
@@ -1849,6 +1906,18 @@ func (s *IndexStats) addIndexStatsToMap(statMap *StatsMap, spec *statsSpec) {
 		},
 		&s.clientCancelError, s.int64Stats)
 
+	statMap.AddAggrStatFiltered("num_scan_admission_rejected",
+		func(ss *IndexStats) int64 {
+			return ss.numScanAdmissionRejected.Value()
+		},
+		&s.numScanAdmissionRejected, s.int64Stats)
+
+	statMap.AddAggrStatFiltered("num_scans_throttled",
+		func(ss *IndexStats) int64 {
+			return ss.numScansThrottled.Value()
+		},
+		&s.numScansThrottled, s.int64Stats)
+
 	statMap.AddAggrStatFiltered("num_scan_timeouts",
 		func(ss *IndexStats) int64 {
 			return ss.numScanTimeouts.Value()
@@ -2404,6 +2473,9 @@ func (s *IndexStats) populateMetrics(st []byte) []byte {
 	str = fmt.Sprintf(fmtStr, METRICS_PREFIX, "num_requests", s.bucket, collectionLabels, s.dispName, s.numRequests.Value())
 	st = append(st, []byte(str)...)
 
+	str = fmt.Sprintf(fmtStr, METRICS_PREFIX, "num_scans_throttled", s.bucket, collectionLabels, s.dispName, s.numScansThrottled.Value())
+	st = append(st, []byte(str)...)
+
 	numDocsQueued := s.int64Stats(func(ss *IndexStats) int64 { return ss.numDocsQueued.Value() })
 	str = fmt.Sprintf(fmtStr, METRICS_PREFIX, "num_docs_queued", s.bucket, collectionLabels, s.dispName, numDocsQueued)
 	st = append(st, []byte(str)...)
@@ -3208,6 +3280,9 @@ func (s *statsManager) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	out = append(out, []byte(fmt.Sprintf("# TYPE %vtotal_rows_scanned gauge\n", METRICS_PREFIX))...)
 	out = append(out, []byte(fmt.Sprintf("%vtotal_rows_scanned %v\n", METRICS_PREFIX, is.TotalRowsScanned.Value()))...)
 
+	out = append(out, []byte(fmt.Sprintf("# TYPE %vnum_scans_throttled gauge\n", METRICS_PREFIX))...)
+	out = append(out, []byte(fmt.Sprintf("%vnum_scans_throttled %v\n", METRICS_PREFIX, is.numScansThrottled.Value()))...)
+
 	is.memoryRss.Set(getRSS())
 	out = append(out, []byte(fmt.Sprintf("# TYPE %vmemory_rss gauge\n", METRICS_PREFIX))...)
 	out = append(out, []byte(fmt.Sprintf("%vmemory_rss %v\n", METRICS_PREFIX, is.memoryRss.Value()))...)
@@ -3543,6 +3618,11 @@ func (s *statsManager) handleStatsResetReq(w http.ResponseWriter, r *http.Reques
 
 		if common.IndexerState(stats.indexerState.Value()) != common.INDEXER_BOOTSTRAP {
 			s.supvMsgch <- &MsgResetStats{}
+			fields := &audit.AuditFields{}
+			if creds != nil {
+				fields.User = creds.Name()
+			}
+			audit.AuditWithFields(common.AUDIT_STATS_RESET, r, "StatsManager::handleStatsResetReq", fields)
 			w.WriteHeader(200)
 			w.Write([]byte("OK"))
 		} else {
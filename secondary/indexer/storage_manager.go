@@ -22,6 +22,7 @@ import (
 	"github.com/couchbase/indexing/secondary/common"
 	forestdb "github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 )
 
 var (
@@ -484,6 +485,11 @@ func (s *storageMgr) createSnapshotForIndex(streamId common.StreamId,
 	// snapshot generation code path
 	defer wg.Done()
 
+	if !flushWasAborted && s.deferSnapshot(streamId, &idxInst, indexPartnMap[idxInstId],
+		lastIndexSnap, idxStats, needsCommit || forceCommit) {
+		return
+	}
+
 	// List of snapshots for reading current timestamp
 	var isSnapCreated bool = true
 
@@ -643,6 +649,65 @@ func (s *storageMgr) createSnapshotForIndex(streamId common.StreamId,
 	s.updateSnapIntervalStat(idxStats, startTime)
 }
 
+// deferSnapshot returns true if no new snapshot is to be created for the
+// best-effort index idxInst at this flush. The index keeps its last snapshot,
+// along with its timestamp, so that its snapshot timestamp lags behind the
+// flush timestamp of its keyspace.
+//
+// A new snapshot is deferred as long as the index has writes of earlier
+// flushes still pending, so that the flush of the keyspace does not wait for
+// a best-effort index that is slow to apply its mutations, and otherwise till
+// its last snapshot is older than the best-effort snapshot interval. Only
+// in-memory snapshots of active indexes in MAINT_STREAM are deferred, disk
+// snapshots wait for all the writes of the index.
+func (s *storageMgr) deferSnapshot(streamId common.StreamId, idxInst *common.IndexInst,
+	partnMap PartitionInstMap, lastIndexSnap IndexSnapshot, idxStats *IndexStats,
+	commit bool) bool {
+
+	fp := getFlushPriorities()
+	if commit || streamId != common.MAINT_STREAM ||
+		idxInst.State != common.INDEX_STATE_ACTIVE ||
+		lastIndexSnap == nil || len(lastIndexSnap.Partitions()) == 0 ||
+		!fp.isBestEffort(idxInst) {
+		idxStats.flushLagSince.Set(0)
+		return false
+	}
+
+	now := time.Now().UnixNano()
+	if !hasPendingWrites(partnMap) && now-idxStats.lastTsTime.Value() >= int64(fp.bestEffortInterval) {
+		idxStats.flushLagSince.Set(0)
+		return false
+	}
+
+	//the snapshot of the index lags behind its keyspace since the first
+	//deferred flush
+	if idxStats.flushLagSince.Value() == 0 {
+		idxStats.flushLagSince.Set(now)
+	}
+	idxStats.numSnapshotsDeferred.Add(1)
+	return true
+}
+
+// pendingWriter is implemented by slices that apply their writes
+// asynchronously, see waitPersist.
+type pendingWriter interface {
+	checkAllWorkersDone() bool
+}
+
+// hasPendingWrites returns true if a slice of the partitions has writes
+// that are not applied yet. Unlike IsDirty, it does not wait for them.
+func hasPendingWrites(partnMap PartitionInstMap) bool {
+
+	for _, partnInst := range partnMap {
+		for _, slice := range partnInst.Sc.GetAllSlices() {
+			if w, ok := slice.(pendingWriter); ok && !w.checkAllWorkersDone() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (s *storageMgr) flushDone(streamId common.StreamId, keyspaceId string,
 	indexInstMap common.IndexInstMap, indexPartnMap IndexPartnMap,
 	instIdList []common.IndexInstId, tsVbuuid *common.TsVbuuid,
@@ -1583,6 +1648,8 @@ func (s *storageMgr) handleStats(cmd Message) {
 				idxStats.logSpaceOnDisk.Set(st.Stats.LogSpace)
 				idxStats.diskSize.Set(st.Stats.DiskSize)
 				idxStats.memUsed.Set(st.Stats.MemUsed)
+				encryptionStatus := st.Stats.EncryptionStatus
+				idxStats.encryptionStatus.Set(&encryptionStatus)
 				if common.GetStorageMode() != common.MOI {
 					if common.GetStorageMode() == common.PLASMA {
 						idxStats.fragPercent.Set(int64(st.getPlasmaFragmentation()))
@@ -1769,6 +1836,7 @@ func (s *storageMgr) getIndexStorageStats(spec *statsSpec) []IndexStorageStats {
 			var getBytes, insertBytes, deleteBytes int64
 			var nslices int64
 			var needUpgrade = false
+			var encryptionStatus string
 			var hasStats = false
 			var loggingDisabled = true
 
@@ -1811,6 +1879,7 @@ func (s *storageMgr) getIndexStorageStats(spec *statsSpec) []IndexStorageStats {
 				// Even if one slice has stats, loggingDisabled will be set to false
 				loggingDisabled = loggingDisabled && sts.LoggingDisabled
 				needUpgrade = needUpgrade || sts.NeedUpgrade
+				encryptionStatus = encryption.MergeStatus(encryptionStatus, sts.EncryptionStatus)
 
 				hasStats = true
 			}
@@ -1834,6 +1903,7 @@ func (s *storageMgr) getIndexStorageStats(spec *statsSpec) []IndexStorageStats {
 						DeleteBytes:       deleteBytes,
 						ExtraSnapDataSize: extraSnapDataSize,
 						NeedUpgrade:       needUpgrade,
+						EncryptionStatus:  encryptionStatus,
 						InternalData:      internalData,
 						InternalDataMap:   internalDataMap,
 						LoggingDisabled:   loggingDisabled,
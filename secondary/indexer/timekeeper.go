@@ -3274,19 +3274,25 @@ func (tk *timekeeper) setSnapshotType(streamId common.StreamId, keyspaceId strin
 			fastFlush := tk.config["settings.fast_flush_mode"].Bool()
 			hasInMemSnap := tk.ss.streamKeyspaceIdHasInMemSnap[streamId][keyspaceId]
 
-			if fastFlush && hasInMemSnap {
+			//skip in-mem snapshots only if there is atleast one in-mem snapshot
+			//merge of a partitioned index expects a storage snapshot to be available
+			var skipFactor uint64
+			if hasInMemSnap {
 				//if fast flush mode is enabled, skip in-mem snapshots based
 				//on number of pending ts to be processed.
-				//skip in-mem snapshots only if there is atleast one in-mem snapshot
-				//merge of a partitioned index expects a storage snapshot to be available
-				skipFactor := tk.calcSkipFactorForFastFlush(streamId, keyspaceId)
-				if skipFactor != 0 && (tk.ss.streamKeyspaceIdSkippedInMemTs[streamId][keyspaceId] < skipFactor) {
-					tk.ss.streamKeyspaceIdSkippedInMemTs[streamId][keyspaceId]++
-					flushTs.SetSnapType(common.NO_SNAP)
-				} else {
-					flushTs.SetSnapType(common.INMEM_SNAP)
-					tk.ss.streamKeyspaceIdSkippedInMemTs[streamId][keyspaceId] = 0
+				if fastFlush {
+					skipFactor = tk.calcSkipFactorForFastFlush(streamId, keyspaceId)
+				}
+				//if all indexes are best-effort, skip in-mem snapshots
+				//till the best-effort snapshot interval
+				if bestEffortSkip := tk.calcSkipFactorForBestEffort(streamId, keyspaceId); bestEffortSkip > skipFactor {
+					skipFactor = bestEffortSkip
 				}
+			}
+
+			if skipFactor != 0 && (tk.ss.streamKeyspaceIdSkippedInMemTs[streamId][keyspaceId] < skipFactor) {
+				tk.ss.streamKeyspaceIdSkippedInMemTs[streamId][keyspaceId]++
+				flushTs.SetSnapType(common.NO_SNAP)
 			} else {
 				flushTs.SetSnapType(common.INMEM_SNAP)
 				tk.ss.streamKeyspaceIdSkippedInMemTs[streamId][keyspaceId] = 0
@@ -4674,6 +4680,20 @@ func (tk *timekeeper) calcSkipFactorForFastFlush(streamId common.StreamId,
 	}
 }
 
+//calcSkipFactorForBestEffort returns the number of in-mem snapshots to skip
+//between in-mem snapshots of a MAINT_STREAM keyspace with only best-effort
+//indexes, so that they are taken about once every best-effort snapshot interval.
+func (tk *timekeeper) calcSkipFactorForBestEffort(streamId common.StreamId,
+	keyspaceId string) uint64 {
+
+	if streamId != common.MAINT_STREAM {
+		return 0
+	}
+
+	snapInterval := time.Duration(tk.getInMemSnapInterval()) * time.Millisecond
+	return getFlushPriorities().skipFactor(tk.indexInstMap.Get(), streamId, keyspaceId, snapInterval)
+}
+
 func (tk *timekeeper) handleIndexerPauseMOI(cmd Message) {
 
 	logging.Infof("Timekeeper::handleIndexerPauseMOI")
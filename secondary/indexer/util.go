@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/queryutil"
 	"github.com/couchbase/indexing/secondary/logging"
 )
 
@@ -265,3 +266,14 @@ func clusterVersion(clusterAddr string) uint64 {
 
 	return cinfo.GetClusterVersion()
 }
+
+// getArrayExpressionPosition returns whether index is an array index, whether
+// array is distinct, whether array is flattened and the position of the array
+// expression. The leading key of a token index is indexed as a distinct array
+// of tokens.
+func getArrayExpressionPosition(idxDefn common.IndexDefn) (bool, bool, bool, int, error) {
+	if idxDefn.TokenAnalyzer != nil {
+		return true, true, false, 0, nil
+	}
+	return queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+}
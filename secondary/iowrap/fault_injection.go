@@ -0,0 +1,164 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package iowrap
+
+import (
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Disk fault injection, for resilience testing ONLY. When a FaultConfig is set, the wrappers in
+// io_wrappers.go inject the configured faults into the I/O of files whose path contains the
+// config's PathFilter. Injected errors are counted as disk failures like real ones, so they are
+// also seen by Autofailover. Fault injection is disabled by default and costs a single atomic
+// load per wrapped call when disabled.
+
+// FaultConfig configures the faults to inject. Zero values disable the corresponding fault.
+type FaultConfig struct {
+	// Only inject faults into files whose path contains PathFilter. Empty matches all files.
+	PathFilter string `json:"pathFilter,omitempty"`
+
+	// Fail the Nth write (counting from 1) with EIO.
+	FailNthWrite int64 `json:"failNthWrite,omitempty"`
+
+	// Fail writes with ENOSPC once this many bytes have been written, as if the disk were full.
+	// The write crossing the limit is a short write.
+	EnospcAfterBytes int64 `json:"enospcAfterBytes,omitempty"`
+
+	// Delay each fsync by this many milliseconds.
+	SyncDelayMs int64 `json:"syncDelayMs,omitempty"`
+
+	// Corrupt the data returned by the Nth read (counting from 1).
+	CorruptNthRead int64 `json:"corruptNthRead,omitempty"`
+}
+
+// Enabled returns true if config injects any fault.
+func (config *FaultConfig) Enabled() bool {
+	return config != nil && (config.FailNthWrite > 0 || config.EnospcAfterBytes > 0 ||
+		config.SyncDelayMs > 0 || config.CorruptNthRead > 0)
+}
+
+// FaultStats counts the I/O seen and the faults injected since the FaultConfig was set. Only
+// I/O on files matching the PathFilter is counted.
+type FaultStats struct {
+	Writes         int64 `json:"writes"`
+	BytesWritten   int64 `json:"bytesWritten"`
+	Reads          int64 `json:"reads"`
+	Syncs          int64 `json:"syncs"`
+	FailedWrites   int64 `json:"failedWrites"`
+	EnospcWrites   int64 `json:"enospcWrites"`
+	DelayedSyncs   int64 `json:"delayedSyncs"`
+	CorruptedReads int64 `json:"corruptedReads"`
+}
+
+type faultInjector struct {
+	config FaultConfig
+	stats  FaultStats
+}
+
+// faultInjectorPtr is really a *faultInjector, nil if fault injection is disabled.
+var faultInjectorPtr unsafe.Pointer
+
+// SetFaultConfig sets the faults to inject and resets FaultStats. A nil or empty config disables
+// fault injection. Thread-safe.
+func SetFaultConfig(config *FaultConfig) {
+	var fi *faultInjector
+	if config.Enabled() {
+		fi = &faultInjector{config: *config}
+	}
+	atomic.StorePointer(&faultInjectorPtr, unsafe.Pointer(fi))
+}
+
+// GetFaultConfig returns the faults being injected, or nil if fault injection is disabled.
+func GetFaultConfig() *FaultConfig {
+	if fi := getFaultInjector(); fi != nil {
+		config := fi.config
+		return &config
+	}
+	return nil
+}
+
+// GetFaultStats returns the stats of the current FaultConfig.
+func GetFaultStats() FaultStats {
+	var stats FaultStats
+	if fi := getFaultInjector(); fi != nil {
+		stats.Writes = atomic.LoadInt64(&fi.stats.Writes)
+		stats.BytesWritten = atomic.LoadInt64(&fi.stats.BytesWritten)
+		stats.Reads = atomic.LoadInt64(&fi.stats.Reads)
+		stats.Syncs = atomic.LoadInt64(&fi.stats.Syncs)
+		stats.FailedWrites = atomic.LoadInt64(&fi.stats.FailedWrites)
+		stats.EnospcWrites = atomic.LoadInt64(&fi.stats.EnospcWrites)
+		stats.DelayedSyncs = atomic.LoadInt64(&fi.stats.DelayedSyncs)
+		stats.CorruptedReads = atomic.LoadInt64(&fi.stats.CorruptedReads)
+	}
+	return stats
+}
+
+func getFaultInjector() *faultInjector {
+	return (*faultInjector)(atomic.LoadPointer(&faultInjectorPtr))
+}
+
+func (fi *faultInjector) matches(path string) bool {
+	return len(fi.config.PathFilter) == 0 || strings.Contains(path, fi.config.PathFilter)
+}
+
+// checkWrite decides whether a write of size bytes to path fails. It returns the number of bytes
+// to write before failing, and the error to fail with, or nil if the write proceeds as usual.
+func (fi *faultInjector) checkWrite(path string, size int) (int, error) {
+	if !fi.matches(path) {
+		return size, nil
+	}
+
+	writes := atomic.AddInt64(&fi.stats.Writes, 1)
+	if fi.config.FailNthWrite > 0 && writes == fi.config.FailNthWrite {
+		atomic.AddInt64(&fi.stats.FailedWrites, 1)
+		return 0, &fs.PathError{Op: "write", Path: path, Err: syscall.EIO}
+	}
+
+	written := atomic.AddInt64(&fi.stats.BytesWritten, int64(size))
+	if limit := fi.config.EnospcAfterBytes; limit > 0 && written > limit {
+		allowed := int64(size) - (written - limit)
+		if allowed < 0 {
+			allowed = 0
+		}
+		atomic.AddInt64(&fi.stats.EnospcWrites, 1)
+		return int(allowed), &fs.PathError{Op: "write", Path: path, Err: syscall.ENOSPC}
+	}
+
+	return size, nil
+}
+
+func (fi *faultInjector) sync(path string) {
+	if !fi.matches(path) {
+		return
+	}
+
+	atomic.AddInt64(&fi.stats.Syncs, 1)
+	if fi.config.SyncDelayMs > 0 {
+		atomic.AddInt64(&fi.stats.DelayedSyncs, 1)
+		time.Sleep(time.Duration(fi.config.SyncDelayMs) * time.Millisecond)
+	}
+}
+
+// read corrupts b, the data returned by a read of path, if the read is due to be corrupted.
+func (fi *faultInjector) read(path string, b []byte) {
+	if !fi.matches(path) {
+		return
+	}
+
+	reads := atomic.AddInt64(&fi.stats.Reads, 1)
+	if fi.config.CorruptNthRead > 0 && reads == fi.config.CorruptNthRead && len(b) > 0 {
+		atomic.AddInt64(&fi.stats.CorruptedReads, 1)
+		b[len(b)/2] ^= 0xff
+	}
+}
@@ -0,0 +1,96 @@
+package iowrap
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectionWrite(t *testing.T) {
+	dir := t.TempDir()
+	SetFaultConfig(&FaultConfig{PathFilter: "shard", FailNthWrite: 2, EnospcAfterBytes: 10})
+	defer SetFaultConfig(nil)
+
+	// files not matching the filter are not affected
+	if err := Ioutil_WriteFile(filepath.Join(dir, "other"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Os_Create(filepath.Join(dir, "shard-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if n, err := File_Write(f, []byte("abcd")); n != 4 || err != nil {
+		t.Fatalf("unexpected write result %v %v", n, err)
+	}
+	failures := GetDiskFailures()
+	if _, err := File_Write(f, []byte("efgh")); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected EIO, got %v", err)
+	}
+	if GetDiskFailures() != failures+1 {
+		t.Fatalf("injected failure not counted")
+	}
+
+	// short write when crossing the limit, then disk full
+	if n, err := File_Write(f, []byte("ijklmnopq")); n != 6 || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected short write with ENOSPC, got %v %v", n, err)
+	}
+	if n, err := File_Write(f, []byte("r")); n != 0 || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("expected ENOSPC, got %v %v", n, err)
+	}
+
+	data, _ := os.ReadFile(f.Name())
+	if string(data) != "abcdijklmn" {
+		t.Fatalf("unexpected file content %q", data)
+	}
+
+	stats := GetFaultStats()
+	if stats.Writes != 4 || stats.FailedWrites != 1 || stats.EnospcWrites != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFaultInjectionReadSync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	data := bytes.Repeat([]byte{1}, 64)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	SetFaultConfig(&FaultConfig{CorruptNthRead: 2, SyncDelayMs: 20})
+	defer SetFaultConfig(nil)
+
+	for i := 1; i <= 3; i++ {
+		read, err := Ioutil_ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if corrupted := !bytes.Equal(read, data); corrupted != (i == 2) {
+			t.Fatalf("read %v: corrupted %v", i, corrupted)
+		}
+	}
+
+	f, err := Os_OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	t0 := time.Now()
+	if err := File_Sync(f); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(t0) < 20*time.Millisecond {
+		t.Fatalf("sync was not delayed")
+	}
+
+	SetFaultConfig(&FaultConfig{})
+	if GetFaultConfig() != nil {
+		t.Fatalf("empty config should disable fault injection")
+	}
+}
@@ -96,6 +96,21 @@ func File_Read(this *os.File, b []byte) (n int, err error) {
 	if err != nil {
 		countDiskFailures(err)
 	}
+	if fi := getFaultInjector(); fi != nil {
+		fi.read(this.Name(), b[:n])
+	}
+	return n, err
+}
+
+// File_ReadAt wraps Go-native METHOD os.File.ReadAt for disk failure tracking.
+func File_ReadAt(this *os.File, b []byte, off int64) (n int, err error) {
+	n, err = this.ReadAt(b, off)
+	if err != nil && err != io.EOF {
+		countDiskFailures(err)
+	}
+	if fi := getFaultInjector(); fi != nil {
+		fi.read(this.Name(), b[:n])
+	}
 	return n, err
 }
 
@@ -110,6 +125,9 @@ func File_Stat(this *os.File) (os.FileInfo, error) {
 
 // File_Sync wraps Go-native METHOD os.File.Sync for disk failure tracking.
 func File_Sync(this *os.File) error {
+	if fi := getFaultInjector(); fi != nil {
+		fi.sync(this.Name())
+	}
 	err := this.Sync()
 	if err != nil {
 		countDiskFailures(err)
@@ -117,8 +135,27 @@ func File_Sync(this *os.File) error {
 	return err
 }
 
+// File_Truncate wraps Go-native METHOD os.File.Truncate for disk failure tracking.
+func File_Truncate(this *os.File, size int64) error {
+	err := this.Truncate(size)
+	if err != nil {
+		countDiskFailures(err)
+	}
+	return err
+}
+
 // File_Write wraps Go-native METHOD os.File.Write for disk failure tracking.
 func File_Write(this *os.File, b []byte) (n int, err error) {
+	if fi := getFaultInjector(); fi != nil {
+		if allowed, ferr := fi.checkWrite(this.Name(), len(b)); ferr != nil {
+			n, err = this.Write(b[:allowed])
+			if err == nil {
+				err = ferr
+			}
+			countDiskFailures(err)
+			return n, err
+		}
+	}
 	n, err = this.Write(b)
 	if err != nil {
 		countDiskFailures(err)
@@ -126,6 +163,40 @@ func File_Write(this *os.File, b []byte) (n int, err error) {
 	return n, err
 }
 
+////////////////////////////////////////////////////////////////////////////////////////////////////
+// os.File io.Reader and io.Writer adapters
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// fileReader adapts an os.File to an io.Reader whose reads go through File_Read, so that reads by
+// a consumer of io.Reader, e.g. a bufio.Reader, are tracked.
+type fileReader struct {
+	file *os.File
+}
+
+func (r fileReader) Read(b []byte) (int, error) {
+	return File_Read(r.file, b)
+}
+
+// NewFileReader returns an io.Reader reading file through File_Read for disk failure tracking.
+func NewFileReader(file *os.File) io.Reader {
+	return fileReader{file: file}
+}
+
+// fileWriter adapts an os.File to an io.Writer whose writes go through File_Write, so that writes
+// by a producer of io.Writer, e.g. a bufio.Writer, are tracked.
+type fileWriter struct {
+	file *os.File
+}
+
+func (w fileWriter) Write(b []byte) (int, error) {
+	return File_Write(w.file, b)
+}
+
+// NewFileWriter returns an io.Writer writing file through File_Write for disk failure tracking.
+func NewFileWriter(file *os.File) io.Writer {
+	return fileWriter{file: file}
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 // io FUNCTION wrappers -- add more as needed
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -158,6 +229,11 @@ func Io_Read(this io.Reader, p []byte) (n int, err error) {
 	if err != nil {
 		countDiskFailures(err)
 	}
+	if fi := getFaultInjector(); fi != nil {
+		if file, ok := this.(*os.File); ok {
+			fi.read(file.Name(), p[:n])
+		}
+	}
 	return n, err
 }
 
@@ -189,6 +265,9 @@ func Ioutil_ReadFile(filename string) ([]byte, error) {
 	if err != nil {
 		countDiskFailures(err)
 	}
+	if fi := getFaultInjector(); fi != nil {
+		fi.read(filename, bytes)
+	}
 	return bytes, err
 }
 
@@ -212,6 +291,16 @@ func Ioutil_TempFile(dir, pattern string) (f *os.File, err error) {
 
 // Ioutil_WriteFile wraps Go-native FUNCTION ioutil.WriteFile for disk failure tracking.
 func Ioutil_WriteFile(filename string, data []byte, perm fs.FileMode) error {
+	if fi := getFaultInjector(); fi != nil {
+		if allowed, ferr := fi.checkWrite(filename, len(data)); ferr != nil {
+			err := ioutil.WriteFile(filename, data[:allowed], perm)
+			if err == nil {
+				err = ferr
+			}
+			countDiskFailures(err)
+			return err
+		}
+	}
 	err := ioutil.WriteFile(filename, data, perm)
 	if err != nil {
 		countDiskFailures(err)
@@ -283,6 +372,9 @@ func Os_ReadFile(name string) (data []byte, err error) {
 	if err != nil {
 		countDiskFailures(err)
 	}
+	if fi := getFaultInjector(); fi != nil {
+		fi.read(name, data)
+	}
 	return data, err
 }
 
@@ -208,7 +208,7 @@ type watcherCallback func(string, c.IndexerId, c.IndexerId)
 var REQUEST_CHANNEL_COUNT = 1000
 
 var VALID_PARAM_NAMES = []string{"nodes", "defer_build", "retain_deleted_xattr",
-	"num_partition", "num_replica", "docKeySize", "secKeySize", "arrSize", "numDoc", "residentRatio"}
+	"num_partition", "num_replica", "docKeySize", "secKeySize", "arrSize", "numDoc", "residentRatio", "tokenize"}
 
 var ErrWaitScheduleTimeout = fmt.Errorf("Timeout in checking for schedule create token.")
 
@@ -2123,6 +2123,7 @@ func (o *MetadataProvider) PrepareIndexDefn(
 	var docKeySize uint64 = 0
 	var arrSize uint64 = 0
 	var residentRatio float64 = 0
+	var tokenAnalyzer *c.TokenAnalyzer = nil
 
 	version := o.GetIndexerVersion()
 	clusterVersion := o.GetClusterVersion()
@@ -2196,7 +2197,7 @@ func (o *MetadataProvider) PrepareIndexDefn(
 			}
 		}
 
-		err = o.validatePartitionKeys(partitionScheme, partitionKeys, secExprs, isPrimary)
+		err = o.validatePartitionKeys(partitionScheme, partitionKeys, secExprs, isPrimary, exprType)
 		if err != nil {
 			return nil, err, false
 		}
@@ -2252,6 +2253,11 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		if err != nil {
 			return nil, err, retry
 		}
+
+		tokenAnalyzer, err, retry = o.getTokenizeParam(plan)
+		if err != nil {
+			return nil, err, retry
+		}
 	}
 
 	logging.Debugf("MetadataProvider:CreateIndex(): deferred_build %v nodes %v", deferred, nodes)
@@ -2265,6 +2271,11 @@ func (o *MetadataProvider) PrepareIndexDefn(
 	skipFlattenExprsTillPos := 0
 	isArrayDistinct := false
 	for pos, exp := range secExprs {
+		// array index is only supported for N1QL expressions
+		if strings.EqualFold(exprType, string(c.JavaScript)) {
+			break
+		}
+
 		// As `secExprs` in flattened array index are exploded,
 		// skip some `secExprs`
 		if isArrayIndex && isArrayFlattened && pos < skipFlattenExprsTillPos {
@@ -2294,6 +2305,34 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		return nil, errors.New("Fails to create index.  Multiple expressions with ALL are found. Only one array expression is supported per index."), false
 	}
 
+	//
+	// Token index
+	//
+
+	if tokenAnalyzer != nil {
+		if isPrimary || len(secExprs) == 0 {
+			return nil, errors.New("Fails to create index.  Parameter tokenize is not supported for primary index."), false
+		}
+
+		if isArrayIndex {
+			return nil, errors.New("Fails to create index.  Parameter tokenize cannot be used with array expressions."), false
+		}
+
+		if strings.EqualFold(exprType, string(c.JavaScript)) {
+			return nil, errors.New("Fails to create index.  Parameter tokenize is only supported for N1QL expressions."), false
+		}
+
+		if version < c.INDEXER_CUR_VERSION || clusterVersion < c.INDEXER_CUR_VERSION {
+			return nil,
+				errors.New("Fail to create index with tokenize. This option is enabled after cluster is fully upgraded and there is no failed node."),
+				false
+		}
+
+		// the leading key is indexed as a distinct array of tokens
+		isArrayIndex = true
+		isArrayDistinct = true
+	}
+
 	if isArrayIndex && isArrayFlattened && (version < c.INDEXER_71_VERSION || clusterVersion < c.INDEXER_71_VERSION) {
 		return nil,
 			errors.New("Fail to create index with flatten array. This option is available only after all nodes in the cluster are atleast running on server 7.1 version"),
@@ -2396,6 +2435,7 @@ func (o *MetadataProvider) PrepareIndexDefn(
 		Collection:             collection,
 		HasArrItemsCount:       hasArrItemsCount,
 		IndexMissingLeadingKey: indexMissingLeadingKey,
+		TokenAnalyzer:          tokenAnalyzer,
 	}
 
 	idxDefn.NumReplica2.InitializeCounter(idxDefn.NumReplica)
@@ -2419,6 +2459,7 @@ func (o *MetadataProvider) prepareIndexSpec(defn *c.IndexDefn) *planner.IndexSpe
 	spec.IsArrayIndex = defn.IsArrayIndex
 	spec.Desc = defn.Desc
 	spec.IndexMissingLeadingKey = defn.IndexMissingLeadingKey
+	spec.TokenAnalyzer = defn.TokenAnalyzer
 	spec.NumPartition = uint64(defn.NumPartitions)
 	spec.PartitionScheme = string(defn.PartitionScheme)
 	spec.HashScheme = uint64(defn.HashScheme)
@@ -2834,6 +2875,21 @@ func (o *MetadataProvider) getXATTRParam(plan map[string]interface{}) (bool, err
 	return xattr, nil, false
 }
 
+func (o *MetadataProvider) getTokenizeParam(plan map[string]interface{}) (*c.TokenAnalyzer, error, bool) {
+
+	param, ok := plan["tokenize"]
+	if !ok {
+		return nil, nil, false
+	}
+
+	analyzer, err := c.NewTokenAnalyzer(param)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Fails to create index.  %v", err)), false
+	}
+
+	return analyzer, nil, false
+}
+
 func (o *MetadataProvider) getDeferredParam(plan map[string]interface{}) (bool, error, bool) {
 
 	deferred := false
@@ -2859,7 +2915,8 @@ func (o *MetadataProvider) getDeferredParam(plan map[string]interface{}) (bool,
 	return deferred, nil, false
 }
 
-func (o *MetadataProvider) validatePartitionKeys(partitionScheme c.PartitionScheme, partitionKeys []string, secKeys []string, isPrimary bool) error {
+func (o *MetadataProvider) validatePartitionKeys(partitionScheme c.PartitionScheme, partitionKeys []string, secKeys []string, isPrimary bool,
+	exprType string) error {
 
 	if partitionScheme != c.SINGLE && partitionScheme != c.KEY {
 		return errors.New(fmt.Sprintf("Fails to create index.  Partition Scheme %v is not allowed.", partitionScheme))
@@ -2877,6 +2934,11 @@ func (o *MetadataProvider) validatePartitionKeys(partitionScheme c.PartitionSche
 		return errors.New(fmt.Sprintf("Fails to create index.  Must specify partition keys for partitioned index."))
 	}
 
+	// JavaScript expressions are compiled by projector
+	if strings.EqualFold(exprType, string(c.JavaScript)) {
+		return nil
+	}
+
 	secExprs := make(expression.Expressions, 0, len(secKeys))
 	for _, key := range secKeys {
 		expr, err := parser.Parse(key)
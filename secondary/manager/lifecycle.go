@@ -22,6 +22,7 @@ import (
 	c "github.com/couchbase/gometa/common"
 	"github.com/couchbase/gometa/message"
 	"github.com/couchbase/gometa/protocol"
+	"github.com/couchbase/indexing/secondary/audit"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/common/collections"
 	"github.com/couchbase/indexing/secondary/common/queryutil"
@@ -507,6 +508,7 @@ func (m *LifecycleMgr) dispatchRequest(request *requestHolder, factory *message.
 		err = m.handleDeleteIndex(key, common.NewUserRequestContext())
 	case client.OPCODE_BUILD_INDEX:
 		err = m.handleBuildIndexes(content, common.NewUserRequestContext())
+		m.auditBuildIndexes(content, err)
 	case client.OPCODE_SERVICE_MAP:
 		result, err = m.handleServiceMap(content)
 	case client.OPCODE_DELETE_BUCKET:
@@ -1320,7 +1322,58 @@ func (m *LifecycleMgr) handleUpdateReplicaCount(content []byte) error {
 	}
 	defn.SetCollectionDefaults()
 
-	return m.updateIndexReplicaCount(defn.DefnId, defn.NumReplica2)
+	err = m.updateIndexReplicaCount(defn.DefnId, defn.NumReplica2)
+
+	// The request comes over the metadata channel, which does not carry the user
+	numReplica, _ := defn.NumReplica2.Value()
+	fields := &audit.AuditFields{
+		Message:    fmt.Sprintf("replica count %v", numReplica),
+		Bucket:     defn.Bucket,
+		Scope:      defn.Scope,
+		Collection: defn.Collection,
+		Index:      defn.Name,
+	}
+	if err != nil {
+		fields.Message += ": " + err.Error()
+	}
+	audit.AuditNonHttp(common.AUDIT_ALTER_INDEX, nil, nil, "LifecycleMgr::handleUpdateReplicaCount", fields)
+
+	return err
+}
+
+// auditDDL audits a DDL request for the index defn. The request comes over the
+// metadata channel, which does not carry the user. Requests made through the
+// indexer REST API are also audited there, along with the user. err is the
+// outcome of the request, nil if it succeeded.
+func auditDDL(eventId uint32, method string, defn *common.IndexDefn, err error) {
+
+	fields := &audit.AuditFields{
+		Bucket:     defn.Bucket,
+		Scope:      defn.Scope,
+		Collection: defn.Collection,
+		Index:      defn.Name,
+	}
+	if err != nil {
+		fields.Message = err.Error()
+	}
+	audit.AuditNonHttp(eventId, nil, nil, method, fields)
+}
+
+// auditBuildIndexes audits a build index request for each of the indexes in
+// content. Builds retried in the background are not audited again, and
+// indexes that no longer exist are reported in err.
+func (m *LifecycleMgr) auditBuildIndexes(content []byte, err error) {
+
+	list, err1 := client.UnmarshallIndexIdList(content)
+	if err1 != nil {
+		return
+	}
+
+	for _, id := range list.DefnIds {
+		if defn, _ := m.repo.GetIndexDefnById(common.IndexDefnId(id)); defn != nil {
+			auditDDL(common.AUDIT_BUILD_INDEX, "LifecycleMgr::handleBuildIndexes", defn, err)
+		}
+	}
 }
 
 // Update replica Count. This function is idepmpotent.
@@ -1450,7 +1503,11 @@ func (m *LifecycleMgr) handleCreateIndexDeferBuild(key string, content []byte, r
 	}
 	defn.SetCollectionDefaults()
 
-	return m.CreateIndexOrInstance(defn, false, reqCtx, false)
+	err = m.CreateIndexOrInstance(defn, false, reqCtx, false)
+	if reqCtx.ReqSource == common.DDLRequestSourceUser {
+		auditDDL(common.AUDIT_CREATE_INDEX, "LifecycleMgr::handleCreateIndexDeferBuild", defn, err)
+	}
+	return err
 }
 
 // handleCreateIndexScheduledBuild handles both normal and rebalance create index requests
@@ -1466,7 +1523,11 @@ func (m *LifecycleMgr) handleCreateIndexScheduledBuild(key string, content []byt
 	defn.SetCollectionDefaults()
 
 	// Create index with the scheduled flag.
-	return m.CreateIndexOrInstance(defn, true, reqCtx, false)
+	err = m.CreateIndexOrInstance(defn, true, reqCtx, false)
+	if reqCtx.ReqSource == common.DDLRequestSourceUser {
+		auditDDL(common.AUDIT_CREATE_INDEX, "LifecycleMgr::handleCreateIndexScheduledBuild", defn, err)
+	}
+	return err
 }
 
 func (m *LifecycleMgr) CreateIndexOrInstance(defn *common.IndexDefn, scheduled bool,
@@ -2399,7 +2460,17 @@ func (m *LifecycleMgr) handleDeleteIndex(key string, reqCtx *common.MetadataRequ
 		return err
 	}
 
-	return m.DeleteIndex(id, true, false, reqCtx)
+	// look up the index before it is dropped, to audit its name
+	var defn *common.IndexDefn
+	if reqCtx.ReqSource == common.DDLRequestSourceUser {
+		defn, _ = m.repo.GetIndexDefnById(id)
+	}
+
+	err = m.DeleteIndex(id, true, false, reqCtx)
+	if defn != nil {
+		auditDDL(common.AUDIT_DROP_INDEX, "LifecycleMgr::handleDeleteIndex", defn, err)
+	}
+	return err
 }
 
 func (m *LifecycleMgr) DeleteIndex(id common.IndexDefnId, notify bool, updateStatusOnly bool,
@@ -45,6 +45,11 @@ type RestoreContext struct {
 	defnInImage  map[common.IndexDefnId]bool
 	origBucket   map[string]bool
 	instNameMap  map[string]*planner.IndexUsage
+
+	// offline restore runs against a saved plan rather than a live cluster
+	offline bool
+	// report records the outcome of a dry-run, nil if not a dry-run
+	report *RestoreReport
 }
 
 //////////////////////////////////////////////////////////////
@@ -99,20 +104,25 @@ func (m *RestoreContext) ComputeIndexLayout() (map[string][]*common.IndexDefn, e
 	// cleanse the image
 	m.cleanseBackupMetadata()
 
-	// Fetch the index layout from current cluster
-	current, err := planner.RetrievePlanFromCluster(m.clusterUrl, nil, false)
-	if err != nil {
-		return nil, err
-	}
-	m.current = current
+	if !m.offline {
+		// Fetch the index layout from current cluster
+		current, err := planner.RetrievePlanFromCluster(m.clusterUrl, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		m.current = current
 
-	// Get schedule create tokens from current cluster
-	var schedTokens map[common.IndexDefnId]*mc.ScheduleCreateToken
-	schedTokens, err = GetSchedCreateTokens(m.target, m.filters, m.filterType)
-	if err != nil {
-		return nil, err
+		// Get schedule create tokens from current cluster
+		var schedTokens map[common.IndexDefnId]*mc.ScheduleCreateToken
+		schedTokens, err = GetSchedCreateTokens(m.target, m.filters, m.filterType)
+		if err != nil {
+			return nil, err
+		}
+		m.schedTokens = schedTokens
+	} else {
+		// A saved plan has no schedule create tokens
+		m.schedTokens = make(map[common.IndexDefnId]*mc.ScheduleCreateToken)
 	}
-	m.schedTokens = schedTokens
 
 	m.prepareInstNameMap()
 
@@ -144,7 +154,7 @@ func (m *RestoreContext) ComputeIndexLayout() (map[string][]*common.IndexDefn, e
 
 	if serverless {
 		// post schdule create tokens for restore candidates(idxToRestore+tokToRestore)
-		err = m.convertIndexestoSchedTokens()
+		err := m.convertIndexestoSchedTokens()
 		if err != nil {
 			return nil, err
 		}
@@ -217,24 +227,36 @@ func (m *RestoreContext) convertStorageMode() error {
 //
 func (m *RestoreContext) convertImage() error {
 
-	config, err := common.GetSettingsConfig(common.SystemConfig)
-	if err != nil {
-		logging.Errorf("RestoreContext: Error from retrieving indexer settings. Error = %v", err)
-		return err
-	}
-
+	var config common.Config
 	var delTokens map[common.IndexDefnId]*mc.DeleteCommandToken
-	delTokens, err = mc.FetchIndexDefnToDeleteCommandTokensMap()
-	if err != nil {
-		logging.Errorf("RestoreContext: Error in FetchIndexDefnToDeleteCommandTokensMap %v", err)
-		return err
-	}
-
 	var buildTokens map[common.IndexDefnId]*mc.BuildCommandToken
-	buildTokens, err = mc.FetchIndexDefnToBuildCommandTokensMap()
-	if err != nil {
-		logging.Errorf("RestoreContext: Error in FetchIndexDefnToBuildCommandTokensMap %v", err)
-		return err
+
+	if m.offline {
+		// Without a cluster, use the default settings and assume no DDL is in flight.
+		// The token maps must be non-nil, otherwise ConvertToIndexUsage looks them
+		// up in metakv.
+		config = common.SystemConfig.Clone()
+		delTokens = make(map[common.IndexDefnId]*mc.DeleteCommandToken)
+		buildTokens = make(map[common.IndexDefnId]*mc.BuildCommandToken)
+	} else {
+		var err error
+		config, err = common.GetSettingsConfig(common.SystemConfig)
+		if err != nil {
+			logging.Errorf("RestoreContext: Error from retrieving indexer settings. Error = %v", err)
+			return err
+		}
+
+		delTokens, err = mc.FetchIndexDefnToDeleteCommandTokensMap()
+		if err != nil {
+			logging.Errorf("RestoreContext: Error in FetchIndexDefnToDeleteCommandTokensMap %v", err)
+			return err
+		}
+
+		buildTokens, err = mc.FetchIndexDefnToBuildCommandTokensMap()
+		if err != nil {
+			logging.Errorf("RestoreContext: Error in FetchIndexDefnToBuildCommandTokensMap %v", err)
+			return err
+		}
 	}
 
 	for _, metadata := range m.image.Metadata {
@@ -254,6 +276,7 @@ func (m *RestoreContext) convertImage() error {
 			if len(indexes) == 0 {
 				logging.Infof("RestoreContext:  Index could be in the process of being created or dropped.  Skip restoring index (%v, %v, %v, %v).",
 					defn.Bucket, defn.Scope, defn.Collection, defn.Name)
+				m.report.skip(defn.Bucket, defn.Scope, defn.Collection, defn.Name, "index is being created or dropped")
 				continue
 			}
 
@@ -294,6 +317,7 @@ func (m *RestoreContext) cleanseBackupMetadata() {
 			if index.Instance == nil {
 				logging.Infof("RestoreContext:  Skip restoring orphan index with no instance metadata (%v, %v, %v, %v, %v).",
 					index.Bucket, index.Scope, index.Collection, index.Name, index.PartnId)
+				m.report.skip(index.Bucket, index.Scope, index.Collection, index.Name, "no instance metadata")
 				continue
 			}
 
@@ -366,6 +390,7 @@ func (m *RestoreContext) findIndexToRestore() error {
 			if !ApplyFilters(filtBucket, index.Bucket, index.Scope, index.Collection, "", m.filters, m.filterType) {
 				logging.Debugf("RestoreContext:  Skip restoring index (%v, %v, %v, %v) due to filters.",
 					index.Bucket, index.Scope, index.Collection, index.Name)
+				m.report.skip(index.Bucket, index.Scope, index.Collection, index.Name, "excluded by filters")
 				continue
 			}
 
@@ -402,6 +427,7 @@ func (m *RestoreContext) findIndexToRestore() error {
 						logging.Infof("RestoreContext:  Find index in the target cluster with the same bucket, name and definition. "+
 							"Skip restoring index (%v, %v, %v, %v, %v, %v).", index.Bucket, index.Scope, index.Collection, index.Name,
 							index.PartnId, index.Instance.ReplicaId)
+						m.report.skip(index.Bucket, index.Scope, index.Collection, index.Name, "index already exists")
 						defnIdMap[index.DefnId] = true
 						continue
 					}
@@ -417,6 +443,7 @@ func (m *RestoreContext) findIndexToRestore() error {
 						logging.Infof("RestoreContext:  Find index in the target cluster with the same bucket, name, replicaId and definition. "+
 							"Skip restoring index (%v, %v, %v, %v, %v, %v).", index.Bucket, index.Scope, index.Collection, index.Name,
 							index.PartnId, index.Instance.ReplicaId)
+						m.report.skip(index.Bucket, index.Scope, index.Collection, index.Name, "index already exists")
 						continue
 					}
 
@@ -427,6 +454,7 @@ func (m *RestoreContext) findIndexToRestore() error {
 						if int(anyInst.Instance.Defn.GetNumReplica()+1) <= int(numReplica) {
 							logging.Infof("RestoreContext:  Find index in the target cluster with the same bucket, name and definition, but fewer replica. "+
 								"Skip restoring index (%v, %v, %v, %v, %v, %v).", index.Bucket, index.Scope, index.Collection, index.Name, index.PartnId, index.Instance.ReplicaId)
+							m.report.skip(index.Bucket, index.Scope, index.Collection, index.Name, "index already exists with all its replicas")
 							continue
 						}
 
@@ -434,6 +462,7 @@ func (m *RestoreContext) findIndexToRestore() error {
 						if numReplica >= len(m.current.Placement) {
 							logging.Infof("RestoreContext:  There aren't enough number of indexer nodes to place the replica. "+
 								"Skip restoring index (%v, %v,%v, %v, %v, %v).", index.Bucket, index.Scope, index.Collection, index.Name, index.PartnId, index.Instance.ReplicaId)
+							m.report.skip(index.Bucket, index.Scope, index.Collection, index.Name, "not enough indexer nodes for replica")
 							continue
 						}
 					}
@@ -445,6 +474,8 @@ func (m *RestoreContext) findIndexToRestore() error {
 					logging.Infof("RestoreContext:  Find index (with different defn) in the target cluster with the same bucket and index name .  "+
 						" Renaming index from (%v, %v, %v, %v, %v) to (%v, %v, %v).",
 						index.Bucket, index.Scope, index.Collection, index.Name, index.Instance.ReplicaId, index.Bucket, defnId2NameMap[index.DefnId], index.Instance.ReplicaId)
+					m.report.rename(index.Bucket, index.Scope, index.Collection, index.Name, newName,
+						"index with the same name and a different definition exists")
 
 					index.Name = newName
 					index.Instance.Defn.Name = newName
@@ -473,6 +504,7 @@ func (m *RestoreContext) findIndexToRestore() error {
 						logging.Infof("RestoreContext:  Find schedule create token in the target cluster with the same bucket, scope, collection, name. "+
 							"Skip restoring index (%v, %v, %v, %v, %v, %v).", index.Bucket, index.Scope, index.Collection, index.Name,
 							index.PartnId, index.Instance.ReplicaId)
+						m.report.skip(index.Bucket, index.Scope, index.Collection, index.Name, "index is scheduled for creation")
 						defnIdMap[index.DefnId] = true
 						continue
 					}
@@ -484,6 +516,8 @@ func (m *RestoreContext) findIndexToRestore() error {
 					logging.Infof("RestoreContext:  Find schedule create token (with different defn) in the target cluster with the same bucket and index name .  "+
 						" Renaming index from (%v, %v, %v, %v, %v) to (%v, %v, %v).",
 						index.Bucket, index.Scope, index.Collection, index.Name, index.Instance.ReplicaId, index.Bucket, defnId2NameMap[index.DefnId], index.Instance.ReplicaId)
+					m.report.rename(index.Bucket, index.Scope, index.Collection, index.Name, newName,
+						"index with the same name and a different definition is scheduled for creation")
 
 					index.Name = newName
 					index.Instance.Defn.Name = newName
@@ -592,6 +626,8 @@ func (m *RestoreContext) findSchedTokensToRestore() error {
 
 			logging.Debugf("RestoreContext:  Skip restoring index (%v, %v, %v, %v) due to filters.",
 				token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection, token.Definition.Name)
+			m.report.skip(token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection,
+				token.Definition.Name, "excluded by filters")
 			continue
 		}
 
@@ -623,6 +659,8 @@ func (m *RestoreContext) findSchedTokensToRestore() error {
 				logging.Infof("RestoreContext:  Find index in the target cluster with the same bucket, name and definition. "+
 					"Skip restoring schedule create token (%v, %v, %v, %v).", token.Definition.Bucket, token.Definition.Scope,
 					token.Definition.Collection, token.Definition.Name)
+				m.report.skip(token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection,
+					token.Definition.Name, "index already exists")
 				continue
 			}
 
@@ -633,6 +671,8 @@ func (m *RestoreContext) findSchedTokensToRestore() error {
 			logging.Infof("RestoreContext:  Find schedule create token (with different defn) in the target cluster with the same bucket and index name .  "+
 				" Renaming token from (%v, %v, %v, %v) to (%v, %v).",
 				token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection, token.Definition.Name, token.Definition.Bucket, newName)
+			m.report.rename(token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection,
+				token.Definition.Name, newName, "index with the same name and a different definition exists")
 
 			token.Definition.Name = newName
 			m.tokToRestore[defnId] = token
@@ -650,6 +690,8 @@ func (m *RestoreContext) findSchedTokensToRestore() error {
 					logging.Infof("RestoreContext:  Find schedule create token in the target cluster with the same bucket, scope, collection, name. "+
 						"Skip restoring schedule create token (%v, %v, %v, %v).", token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection,
 						token.Definition.Name)
+					m.report.skip(token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection,
+						token.Definition.Name, "index is scheduled for creation")
 					continue
 				}
 
@@ -660,6 +702,8 @@ func (m *RestoreContext) findSchedTokensToRestore() error {
 				logging.Infof("RestoreContext:  Find schedule create token (with different defn) in the target cluster with the same bucket and index name .  "+
 					" Renaming token from (%v, %v, %v, %v) to (%v, %v).",
 					token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection, token.Definition.Name, token.Definition.Bucket, newName)
+				m.report.rename(token.Definition.Bucket, token.Definition.Scope, token.Definition.Collection,
+					token.Definition.Name, newName, "index with the same name and a different definition is scheduled for creation")
 
 				token.Definition.Name = newName
 				m.tokToRestore[defnId] = token
@@ -726,6 +770,127 @@ func ApplyFilters(bucket, idxBucket, scope, collection, name string,
 	return true
 }
 
+// ParseFilters parses the comma separated include or exclude filters of a restore
+// into the filters and filterType for ApplyFilters.  A filter is a scope or a
+// scope.collection.  Filters require a bucket, and only one of include or exclude
+// can be specified.
+func ParseFilters(bucket, include, exclude string) (map[string]bool, string, error) {
+
+	if len(include) != 0 || len(exclude) != 0 {
+		if len(bucket) == 0 {
+			return nil, "", fmt.Errorf("Malformed input: include/exclude parameters are specified without bucket.")
+		}
+	}
+
+	if len(include) != 0 && len(exclude) != 0 {
+		return nil, "", fmt.Errorf("Malformed input: include and exclude both parameters are specified.")
+	}
+
+	getFilter := func(s string) string {
+		comp := strings.Split(s, ".")
+		if len(comp) == 1 || len(comp) == 2 {
+			return s
+		}
+
+		return ""
+	}
+
+	filterType := ""
+	filters := make(map[string]bool)
+
+	if len(include) != 0 {
+		filterType = "include"
+		incl := strings.Split(include, ",")
+		for _, inc := range incl {
+			filter := getFilter(inc)
+			if filter == "" {
+				return nil, "", fmt.Errorf("Malformed input: include filter is malformed (%v) (%v)", incl, inc)
+			}
+
+			filters[filter] = true
+		}
+	}
+
+	if len(exclude) != 0 {
+		filterType = "exclude"
+		excl := strings.Split(exclude, ",")
+		for _, exc := range excl {
+			filter := getFilter(exc)
+			if filter == "" {
+				return nil, "", fmt.Errorf("Malformed input: exclude filter is malformed (%v) (%v)", excl, exc)
+			}
+
+			filters[filter] = true
+		}
+	}
+
+	// TODO: Do we need any more validations?
+	return filters, filterType, nil
+}
+
+// ParseRemap parses the comma separated source:target remaps of a restore.  A remap
+// is either scope level (scope:scope) or collection level (scope.collection:scope.collection).
+func ParseRemap(remapStr string) (map[string]string, error) {
+
+	remap := make(map[string]string)
+
+	if remapStr == "" {
+		return remap, nil
+	}
+
+	remaps := strings.Split(remapStr, ",")
+
+	// Cache the collection level remaps for verification
+	collRemap := make(map[string]string)
+
+	for _, rm := range remaps {
+
+		rmp := strings.Split(rm, ":")
+		if len(rmp) > 2 || len(rmp) < 2 {
+			return nil, fmt.Errorf("Malformed input. Missing source/target in remap %v", remapStr)
+		}
+
+		source := rmp[0]
+		target := rmp[1]
+
+		src := strings.Split(source, ".")
+		tgt := strings.Split(target, ".")
+
+		if len(src) != len(tgt) {
+			return nil, fmt.Errorf("Malformed input. source and target in remap should be at same level %v", remapStr)
+		}
+
+		switch len(src) {
+
+		case 2:
+			// This is collection level remap
+			// Search for overlapping scope level remap
+			// Allow overlapping at the target, but not source
+			if _, ok := remap[src[0]]; ok {
+				return nil, fmt.Errorf("Malformed input. Overlapping remaps %v", remapStr)
+			}
+
+			remap[source] = target
+			collRemap[src[0]] = src[1]
+
+		case 1:
+			// This is scope level remap.
+			// Search for overlapping collection level remap
+			// Allow overlapping at the target, but not source
+			if _, ok := collRemap[source]; ok {
+				return nil, fmt.Errorf("Malformed input. Overlapping remaps %v", remapStr)
+			}
+
+			remap[source] = target
+
+		default:
+			return nil, fmt.Errorf("Malformed input remap %v", remapStr)
+		}
+	}
+
+	return remap, nil
+}
+
 //
 // For each indexer in the image, try to find a correpsonding indexer.
 //
@@ -1543,6 +1708,7 @@ func prepareIndexSpec(defn *common.IndexDefn) *planner.IndexSpec {
 	spec.IsArrayIndex = defn.IsArrayIndex
 	spec.Desc = defn.Desc
 	spec.IndexMissingLeadingKey = defn.IndexMissingLeadingKey
+	spec.TokenAnalyzer = defn.TokenAnalyzer
 	spec.NumPartition = uint64(defn.NumPartitions)
 	spec.PartitionScheme = string(defn.PartitionScheme)
 	spec.HashScheme = uint64(defn.HashScheme)
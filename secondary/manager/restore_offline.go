@@ -0,0 +1,401 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package manager
+
+import (
+	json "encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/planner"
+)
+
+//////////////////////////////////////////////////////////////
+// Offline restore
+//
+// Offline restore works on a backup image (ClusterIndexMetadata) without a
+// live cluster.  The index layout of the target cluster is taken from a saved
+// planner Plan file.  It is used to validate an image, to dry-run a restore,
+// to diff two images and to generate the DDL of an image.
+//////////////////////////////////////////////////////////////
+
+// RestoreReport is the outcome of a dry-run restore.
+type RestoreReport struct {
+	Create []*RestoreAction `json:"create,omitempty"`
+	Skip   []*RestoreAction `json:"skip,omitempty"`
+	Rename []*RestoreAction `json:"rename,omitempty"`
+}
+
+// RestoreAction is what a restore would do with one index in the image.
+type RestoreAction struct {
+	Bucket     string               `json:"bucket"`
+	Scope      string               `json:"scope"`
+	Collection string               `json:"collection"`
+	Name       string               `json:"name"`
+	NewName    string               `json:"newName,omitempty"`
+	Reason     string               `json:"reason,omitempty"`
+	Host       string               `json:"host,omitempty"`
+	ReplicaId  int                  `json:"replicaId,omitempty"`
+	Partitions []common.PartitionId `json:"partitions,omitempty"`
+}
+
+// ImageDiff is the difference between two backup images.  Indexes are
+// matched by bucket, scope, collection and name.
+type ImageDiff struct {
+	Added   []*common.IndexDefn `json:"added,omitempty"`
+	Dropped []*common.IndexDefn `json:"dropped,omitempty"`
+	Changed []*IndexDefnChange  `json:"changed,omitempty"`
+}
+
+// IndexDefnChange is an index whose definition differs between two images.
+type IndexDefnChange struct {
+	Source *common.IndexDefn `json:"source"`
+	Target *common.IndexDefn `json:"target"`
+}
+
+//
+// Initialize restore context for restoring the image onto the index layout of a saved plan.
+//
+func CreateOfflineRestoreContext(image *ClusterIndexMetadata, current *planner.Plan, bucket string,
+	filters map[string]bool, filterType string, remap map[string]string) *RestoreContext {
+
+	context := CreateRestoreContext(image, "", bucket, filters, filterType, remap)
+	context.offline = true
+	context.current = current
+
+	return context
+}
+
+//
+// Compute what a restore would create, skip and rename, without restoring any index.
+//
+func (m *RestoreContext) DryRun() (*RestoreReport, error) {
+
+	if common.GetDeploymentModel() == common.SERVERLESS_DEPLOYMENT {
+		return nil, errors.New("Dry-run restore is not supported in serverless deployment")
+	}
+
+	if m.offline && m.current == nil {
+		return nil, errors.New("Offline restore requires the index layout of the target cluster")
+	}
+
+	m.report = &RestoreReport{}
+	defer func() { m.report = nil }()
+
+	layout, err := m.ComputeIndexLayout()
+	if err != nil {
+		return nil, err
+	}
+
+	report := m.report
+	for host, defns := range layout {
+		for _, defn := range defns {
+			report.Create = append(report.Create, &RestoreAction{
+				Bucket:     defn.Bucket,
+				Scope:      defn.Scope,
+				Collection: defn.Collection,
+				Name:       defn.Name,
+				Host:       host,
+				ReplicaId:  defn.ReplicaId,
+				Partitions: defn.Partitions,
+			})
+		}
+	}
+
+	report.sort()
+	return report, nil
+}
+
+func (r *RestoreReport) skip(bucket, scope, collection, name, reason string) {
+	if r == nil {
+		return
+	}
+
+	for _, action := range r.Skip {
+		if action.Bucket == bucket && action.Scope == scope && action.Collection == collection &&
+			action.Name == name && action.Reason == reason {
+			return
+		}
+	}
+
+	r.Skip = append(r.Skip, &RestoreAction{Bucket: bucket, Scope: scope, Collection: collection,
+		Name: name, Reason: reason})
+}
+
+func (r *RestoreReport) rename(bucket, scope, collection, name, newName, reason string) {
+	if r == nil {
+		return
+	}
+
+	for _, action := range r.Rename {
+		if action.Bucket == bucket && action.Scope == scope && action.Collection == collection &&
+			action.Name == name {
+			return
+		}
+	}
+
+	r.Rename = append(r.Rename, &RestoreAction{Bucket: bucket, Scope: scope, Collection: collection,
+		Name: name, NewName: newName, Reason: reason})
+}
+
+func (r *RestoreReport) sort() {
+
+	less := func(actions []*RestoreAction) func(i, j int) bool {
+		return func(i, j int) bool {
+			a, b := actions[i], actions[j]
+			if key1, key2 := indexKey(a.Bucket, a.Scope, a.Collection, a.Name),
+				indexKey(b.Bucket, b.Scope, b.Collection, b.Name); key1 != key2 {
+				return key1 < key2
+			}
+			if a.ReplicaId != b.ReplicaId {
+				return a.ReplicaId < b.ReplicaId
+			}
+			return a.Host < b.Host
+		}
+	}
+
+	sort.Slice(r.Create, less(r.Create))
+	sort.Slice(r.Skip, less(r.Skip))
+	sort.Slice(r.Rename, less(r.Rename))
+}
+
+//////////////////////////////////////////////////////////////
+// Backup image
+//////////////////////////////////////////////////////////////
+
+//
+// Read a backup image from a file.  The file holds either the ClusterIndexMetadata
+// or the response of the /getIndexMetadata REST endpoint.
+//
+func ReadClusterIndexMetadata(imageFile string) (*ClusterIndexMetadata, error) {
+
+	buf, err := iowrap.Ioutil_ReadFile(imageFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read backup image from %v. err = %v", imageFile, err)
+	}
+
+	response := struct {
+		Result *ClusterIndexMetadata `json:"result,omitempty"`
+	}{}
+	if err := json.Unmarshal(buf, &response); err == nil && response.Result != nil {
+		return response.Result, nil
+	}
+
+	image := &ClusterIndexMetadata{}
+	if err := json.Unmarshal(buf, image); err != nil {
+		return nil, fmt.Errorf("Unable to parse backup image from %v. err = %v", imageFile, err)
+	}
+
+	return image, nil
+}
+
+//
+// Validate a backup image.  Return a list of problems found, empty if the image is valid.
+//
+func ValidateImage(image *ClusterIndexMetadata) []error {
+
+	var errs []error
+	defnsById := make(map[common.IndexDefnId]*common.IndexDefn)
+	defnsByName := make(map[string]*common.IndexDefn)
+
+	validateDefn := func(defn *common.IndexDefn, where string) bool {
+		valid := true
+		if defn.DefnId == 0 {
+			errs = append(errs, fmt.Errorf("%v: index %v has no definition id", where, defn.Name))
+			valid = false
+		}
+		if len(defn.Bucket) == 0 || len(defn.Name) == 0 {
+			errs = append(errs, fmt.Errorf("%v: index %v (%v) is missing bucket or name", where, defn.Name, defn.DefnId))
+			valid = false
+		}
+		if !defn.IsPrimary && len(defn.SecExprs) == 0 {
+			errs = append(errs, fmt.Errorf("%v: secondary index %v (%v) has no index keys", where, defn.Name, defn.DefnId))
+			valid = false
+		}
+		if common.IsPartitioned(defn.PartitionScheme) && len(defn.PartitionKeys) == 0 {
+			errs = append(errs, fmt.Errorf("%v: partitioned index %v (%v) has no partition keys", where, defn.Name, defn.DefnId))
+			valid = false
+		}
+		return valid
+	}
+
+	checkConflicts := func(defn *common.IndexDefn, where string) {
+		key := indexKey(defn.Bucket, defn.Scope, defn.Collection, defn.Name)
+
+		if other, ok := defnsById[defn.DefnId]; ok {
+			if indexKey(other.Bucket, other.Scope, other.Collection, other.Name) != key ||
+				!common.IsEquivalentIndex(other, defn) {
+				errs = append(errs, fmt.Errorf("%v: definition id %v is used by different indexes %v and %v",
+					where, defn.DefnId, indexKey(other.Bucket, other.Scope, other.Collection, other.Name), key))
+			}
+		} else {
+			defnsById[defn.DefnId] = defn
+		}
+
+		if other, ok := defnsByName[key]; ok {
+			if other.DefnId != defn.DefnId {
+				errs = append(errs, fmt.Errorf("%v: index %v has different definition ids %v and %v",
+					where, key, other.DefnId, defn.DefnId))
+			}
+		} else {
+			defnsByName[key] = defn
+		}
+	}
+
+	for i := range image.Metadata {
+		meta := &image.Metadata[i]
+		where := fmt.Sprintf("indexer %v", meta.IndexerId)
+
+		if len(meta.IndexerId) == 0 {
+			errs = append(errs, fmt.Errorf("metadata at position %v has no indexer id", i))
+		}
+
+		local := make(map[common.IndexDefnId]bool)
+		for j := range meta.IndexDefinitions {
+			defn := meta.IndexDefinitions[j]
+			defn.SetCollectionDefaults()
+
+			if validateDefn(&defn, where) {
+				checkConflicts(&defn, where)
+			}
+			local[defn.DefnId] = true
+		}
+
+		instances := make(map[common.IndexDefnId]bool)
+		for _, topology := range meta.IndexTopologies {
+			for _, defnRef := range topology.Definitions {
+				defnId := common.IndexDefnId(defnRef.DefnId)
+				if !local[defnId] {
+					errs = append(errs, fmt.Errorf("%v: topology refers to index %v (%v) with no definition",
+						where, defnRef.Name, defnRef.DefnId))
+				}
+				if len(defnRef.Instances) != 0 {
+					instances[defnId] = true
+				}
+			}
+		}
+
+		for _, defn := range meta.IndexDefinitions {
+			if !instances[defn.DefnId] {
+				errs = append(errs, fmt.Errorf("%v: index %v (%v) has no instance and will not be restored",
+					where, defn.Name, defn.DefnId))
+			}
+		}
+	}
+
+	for defnId, token := range image.SchedTokens {
+		where := "schedule create token"
+		defn := token.Definition
+		defn.SetCollectionDefaults()
+
+		if defn.DefnId != defnId {
+			errs = append(errs, fmt.Errorf("%v: token for %v holds index %v (%v)", where, defnId, defn.Name, defn.DefnId))
+		}
+		if validateDefn(&defn, where) {
+			checkConflicts(&defn, where)
+		}
+	}
+
+	return errs
+}
+
+//
+// Compare two backup images.
+//
+func DiffImages(source, target *ClusterIndexMetadata) *ImageDiff {
+
+	diff := &ImageDiff{}
+	sourceDefns := imageIndexDefns(source)
+	targetDefns := imageIndexDefns(target)
+
+	for _, key := range sortedKeys(sourceDefns) {
+		sourceDefn := sourceDefns[key]
+		targetDefn, ok := targetDefns[key]
+		if !ok {
+			diff.Dropped = append(diff.Dropped, sourceDefn)
+			continue
+		}
+
+		if !common.IsEquivalentIndex(sourceDefn, targetDefn) ||
+			sourceDefn.GetNumReplica() != targetDefn.GetNumReplica() ||
+			sourceDefn.NumPartitions != targetDefn.NumPartitions ||
+			sourceDefn.Deferred != targetDefn.Deferred {
+			diff.Changed = append(diff.Changed, &IndexDefnChange{Source: sourceDefn, Target: targetDefn})
+		}
+	}
+
+	for _, key := range sortedKeys(targetDefns) {
+		if _, ok := sourceDefns[key]; !ok {
+			diff.Added = append(diff.Added, targetDefns[key])
+		}
+	}
+
+	return diff
+}
+
+//
+// Generate the create index statements of all the indexes in a backup image.
+//
+func GenerateImageDDL(image *ClusterIndexMetadata) []string {
+
+	defns := imageIndexDefns(image)
+
+	stmts := make([]string, 0, len(defns))
+	for _, key := range sortedKeys(defns) {
+		defn := defns[key]
+		stmts = append(stmts, common.IndexStatement(*defn, int(defn.NumPartitions), -1, false)+";")
+	}
+
+	return stmts
+}
+
+//
+// Collect the index definitions in an image, including those of schedule create tokens,
+// keyed by bucket, scope, collection and name.
+//
+func imageIndexDefns(image *ClusterIndexMetadata) map[string]*common.IndexDefn {
+
+	defns := make(map[string]*common.IndexDefn)
+
+	add := func(defn common.IndexDefn) {
+		defn.SetCollectionDefaults()
+		key := indexKey(defn.Bucket, defn.Scope, defn.Collection, defn.Name)
+		if _, ok := defns[key]; !ok {
+			defns[key] = &defn
+		}
+	}
+
+	for _, meta := range image.Metadata {
+		for _, defn := range meta.IndexDefinitions {
+			add(defn)
+		}
+	}
+
+	for _, token := range image.SchedTokens {
+		add(token.Definition)
+	}
+
+	return defns
+}
+
+func indexKey(bucket, scope, collection, name string) string {
+	return fmt.Sprintf("%v:%v:%v:%v", bucket, scope, collection, name)
+}
+
+func sortedKeys(defns map[string]*common.IndexDefn) []string {
+	keys := make([]string, 0, len(defns))
+	for key := range defns {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,278 @@
+// Copyright 2022-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package manager
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+	mc "github.com/couchbase/indexing/secondary/manager/common"
+	"github.com/couchbase/indexing/secondary/planner"
+)
+
+func testDefn(defnId common.IndexDefnId, name string, exprs ...string) common.IndexDefn {
+	return common.IndexDefn{
+		DefnId:     defnId,
+		Name:       name,
+		Bucket:     "b1",
+		Scope:      "s1",
+		Collection: "c1",
+		SecExprs:   exprs,
+	}
+}
+
+// testImage returns the image of a single indexer holding an active,
+// non-partitioned instance of each index.
+func testImage(defns ...common.IndexDefn) *ClusterIndexMetadata {
+
+	meta := LocalIndexMetadata{IndexerId: "indexer1", IndexDefinitions: defns}
+
+	topologies := make(map[string]int)
+	for _, defn := range defns {
+		key := defn.Scope + "." + defn.Collection
+		if _, ok := topologies[key]; !ok {
+			topologies[key] = len(meta.IndexTopologies)
+			meta.IndexTopologies = append(meta.IndexTopologies, IndexTopology{
+				Bucket:     defn.Bucket,
+				Scope:      defn.Scope,
+				Collection: defn.Collection,
+			})
+		}
+
+		topology := &meta.IndexTopologies[topologies[key]]
+		topology.Definitions = append(topology.Definitions, IndexDefnDistribution{
+			Bucket:     defn.Bucket,
+			Scope:      defn.Scope,
+			Collection: defn.Collection,
+			Name:       defn.Name,
+			DefnId:     uint64(defn.DefnId),
+			Instances: []IndexInstDistribution{{
+				InstId:        uint64(defn.DefnId) + 1000,
+				State:         uint32(common.INDEX_STATE_ACTIVE),
+				NumPartitions: 1,
+				Partitions:    []IndexPartDistribution{{PartId: 0}},
+			}},
+		})
+	}
+
+	return &ClusterIndexMetadata{Metadata: []LocalIndexMetadata{meta}}
+}
+
+func TestValidateImage(t *testing.T) {
+
+	partitioned := testDefn(2, "i2", "`b`")
+	partitioned.PartitionScheme = common.KEY
+
+	noInst := testImage(testDefn(1, "i1", "`a`"))
+	noInst.Metadata[0].IndexTopologies[0].Definitions[0].Instances = nil
+
+	noDefn := testImage(testDefn(1, "i1", "`a`"))
+	noDefn.Metadata[0].IndexDefinitions = nil
+
+	tests := []struct {
+		name  string
+		image *ClusterIndexMetadata
+		errs  []string
+	}{
+		{"valid", testImage(testDefn(1, "i1", "`a`"), testDefn(2, "i2", "`b`")), nil},
+		{"no defn id", testImage(testDefn(0, "i1", "`a`")), []string{"no definition id"}},
+		{"no name", testImage(testDefn(1, "", "`a`")), []string{"missing bucket or name"}},
+		{"no index keys", testImage(testDefn(1, "i1")), []string{"has no index keys"}},
+		{"no partition keys", testImage(partitioned), []string{"has no partition keys"}},
+		{"no instance", noInst, []string{"has no instance"}},
+		{"no definition", noDefn, []string{"with no definition"}},
+		{"conflicting defn ids", testImage(testDefn(1, "i1", "`a`"), testDefn(2, "i1", "`a`")),
+			[]string{"different definition ids"}},
+		{"conflicting indexes", testImage(testDefn(1, "i1", "`a`"), testDefn(1, "i2", "`a`")),
+			[]string{"is used by different indexes"}},
+	}
+
+	for _, test := range tests {
+		errs := ValidateImage(test.image)
+		if len(errs) != len(test.errs) {
+			t.Errorf("%v: expected %v errors, got %v", test.name, len(test.errs), errs)
+			continue
+		}
+		for i, err := range errs {
+			if !strings.Contains(err.Error(), test.errs[i]) {
+				t.Errorf("%v: expected error %q, got %v", test.name, test.errs[i], err)
+			}
+		}
+	}
+}
+
+func TestValidateImageSchedTokens(t *testing.T) {
+
+	image := testImage(testDefn(1, "i1", "`a`"))
+	image.SchedTokens = map[common.IndexDefnId]*mc.ScheduleCreateToken{
+		2: {Definition: testDefn(2, "i2", "`b`")},
+	}
+	if errs := ValidateImage(image); len(errs) != 0 {
+		t.Fatalf("expected a valid image, got %v", errs)
+	}
+
+	image.SchedTokens[3] = &mc.ScheduleCreateToken{Definition: testDefn(4, "i1", "`a`")}
+	errs := ValidateImage(image)
+	if len(errs) != 2 ||
+		!strings.Contains(errs[0].Error(), "holds index") ||
+		!strings.Contains(errs[1].Error(), "different definition ids") {
+		t.Errorf("expected a token mismatch and a conflict, got %v", errs)
+	}
+}
+
+func TestDiffImages(t *testing.T) {
+
+	changed := testDefn(2, "i2", "`b`", "`c`")
+	source := testImage(testDefn(1, "i1", "`a`"), testDefn(2, "i2", "`b`"), testDefn(3, "i3", "`c`"))
+	target := testImage(testDefn(1, "i1", "`a`"), changed, testDefn(4, "i4", "`d`"))
+
+	diff := DiffImages(source, target)
+	if len(diff.Added) != 1 || diff.Added[0].Name != "i4" {
+		t.Errorf("expected i4 to be added, got %v", diff.Added)
+	}
+	if len(diff.Dropped) != 1 || diff.Dropped[0].Name != "i3" {
+		t.Errorf("expected i3 to be dropped, got %v", diff.Dropped)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Source.Name != "i2" ||
+		!reflect.DeepEqual(diff.Changed[0].Target.SecExprs, changed.SecExprs) {
+		t.Errorf("expected i2 to be changed, got %v", diff.Changed)
+	}
+
+	diff = DiffImages(source, source)
+	if len(diff.Added) != 0 || len(diff.Dropped) != 0 || len(diff.Changed) != 0 {
+		t.Errorf("expected no difference, got %+v", diff)
+	}
+}
+
+func TestGenerateImageDDL(t *testing.T) {
+
+	image := testImage(testDefn(2, "i2", "`b`"), testDefn(1, "i1", "`a`"))
+	image.SchedTokens = map[common.IndexDefnId]*mc.ScheduleCreateToken{
+		3: {Definition: testDefn(3, "i0", "`c`")},
+	}
+
+	stmts := GenerateImageDDL(image)
+	if len(stmts) != 3 {
+		t.Fatalf("expected 3 statements, got %v", stmts)
+	}
+	for i, name := range []string{"i0", "i1", "i2"} {
+		if !strings.HasPrefix(stmts[i], "CREATE INDEX `"+name+"` ON `b1`.`s1`.`c1`(") ||
+			!strings.HasSuffix(stmts[i], ";") {
+			t.Errorf("unexpected statement for %v: %v", name, stmts[i])
+		}
+	}
+}
+
+func TestParseFilters(t *testing.T) {
+
+	tests := []struct {
+		name, bucket, include, exclude string
+		filters                        map[string]bool
+		filterType                     string
+		err                            bool
+	}{
+		{"none", "", "", "", map[string]bool{}, "", false},
+		{"no bucket", "", "s1", "", nil, "", true},
+		{"include and exclude", "b1", "s1", "s2", nil, "", true},
+		{"malformed", "b1", "s1.c1.x", "", nil, "", true},
+		{"include", "b1", "s1,s2.c1", "", map[string]bool{"s1": true, "s2.c1": true}, "include", false},
+		{"exclude", "b1", "", "s1.c1", map[string]bool{"s1.c1": true}, "exclude", false},
+	}
+
+	for _, test := range tests {
+		filters, filterType, err := ParseFilters(test.bucket, test.include, test.exclude)
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(filters, test.filters) || filterType != test.filterType {
+			t.Errorf("%v: expected %v %v, got %v %v", test.name, test.filterType, test.filters,
+				filterType, filters)
+		}
+	}
+}
+
+func TestParseRemap(t *testing.T) {
+
+	tests := []struct {
+		name, remap string
+		result      map[string]string
+		err         bool
+	}{
+		{"none", "", map[string]string{}, false},
+		{"scope", "s1:s2", map[string]string{"s1": "s2"}, false},
+		{"collection", "s1.c1:s2.c2,s3:s4", map[string]string{"s1.c1": "s2.c2", "s3": "s4"}, false},
+		{"missing target", "s1", nil, true},
+		{"too many targets", "s1:s2:s3", nil, true},
+		{"level mismatch", "s1.c1:s2", nil, true},
+		{"overlapping scope", "s1:s2,s1.c1:s3.c1", nil, true},
+		{"overlapping collection", "s1.c1:s3.c1,s1:s2", nil, true},
+		{"too deep", "s1.c1.x:s2.c2.x", nil, true},
+	}
+
+	for _, test := range tests {
+		result, err := ParseRemap(test.remap)
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%v: expected %v, got %v", test.name, test.result, result)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+
+	context := CreateOfflineRestoreContext(testImage(testDefn(1, "i1", "`a`")), nil, "", nil, "", nil)
+	if _, err := context.DryRun(); err == nil {
+		t.Errorf("expected an error without a plan")
+	}
+
+	existing := testDefn(10, "i2", "`b`")
+	plan := &planner.Plan{
+		Placement: []*planner.IndexerNode{{
+			NodeId:    "127.0.0.1:9001",
+			IndexerId: "indexer1",
+			Indexes: []*planner.IndexUsage{{
+				DefnId:     existing.DefnId,
+				InstId:     1010,
+				Name:       existing.Name,
+				Bucket:     existing.Bucket,
+				Scope:      existing.Scope,
+				Collection: existing.Collection,
+				Instance:   &common.IndexInst{InstId: 1010, Defn: existing},
+			}},
+		}},
+	}
+
+	// i2 already exists, i4 is being created and i5 is excluded, so nothing
+	// is placed.  Build and delete tokens must not be looked up in metakv.
+	excluded := testDefn(5, "i5", "`e`")
+	excluded.Scope = "s2"
+	image := testImage(testDefn(2, "i2", "`b`"), testDefn(4, "i4", "`d`"), excluded)
+	image.Metadata[0].IndexTopologies[0].Definitions[1].Instances[0].State = uint32(common.INDEX_STATE_CREATED)
+
+	context = CreateOfflineRestoreContext(image, plan, "b1", map[string]bool{"s2": true}, "exclude", nil)
+	report, err := context.DryRun()
+	if err != nil {
+		t.Fatalf("DryRun unexpected error %v", err)
+	}
+
+	expected := []*RestoreAction{
+		{Bucket: "b1", Scope: "s1", Collection: "c1", Name: "i2", Reason: "index already exists"},
+		{Bucket: "b1", Scope: "s1", Collection: "c1", Name: "i4", Reason: "index is being created or dropped"},
+		{Bucket: "b1", Scope: "s2", Collection: "c1", Name: "i5", Reason: "excluded by filters"},
+	}
+	if len(report.Create) != 0 || len(report.Rename) != 0 || !reflect.DeepEqual(report.Skip, expected) {
+		t.Errorf("unexpected report create %v rename %v skip %v", report.Create, report.Rename, report.Skip)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 )
 
 const DiskBlockSize = 4 * 1024 // 4K is ok for page cache writes
@@ -60,10 +61,13 @@ func (m *MemDB) newFileReader(t FileType, ver int) FileReader {
 }
 
 // rawFileWriter implements the FileWriter interface defined above.
+// If encryption is enabled, items are encrypted before being written to
+// the file.
 type rawFileWriter struct {
 	db       *MemDB
 	fd       *os.File
 	w        *bufio.Writer
+	enc      *encryption.Writer
 	buf      []byte
 	path     string
 	checksum uint32
@@ -77,7 +81,22 @@ func (f *rawFileWriter) Open() error {
 			f.buf = make([]byte, encodeBufSize)
 		}
 
-		f.w = bufio.NewWriterSize(f.fd, DiskBlockSize)
+		if f.db.keyProvider == nil {
+			f.db.encryptionKeyId.Store("")
+			f.w = bufio.NewWriterSize(iowrap.NewFileWriter(f.fd), DiskBlockSize)
+			return nil
+		}
+
+		var key *encryption.Key
+		if key, err = f.db.keyProvider.ActiveKey(); err == nil {
+			if f.enc, err = encryption.NewWriter(iowrap.NewFileWriter(f.fd), key); err == nil {
+				f.db.encryptionKeyId.Store(key.Id)
+				f.w = bufio.NewWriterSize(f.enc, DiskBlockSize)
+				return nil
+			}
+		}
+		iowrap.File_Close(f.fd)
+		f.fd = nil
 	}
 	return err
 }
@@ -92,6 +111,14 @@ func (f *rawFileWriter) FlushAndClose(sync bool) (reterr error) {
 	}
 	f.w = nil
 
+	if f.enc != nil {
+		err := f.enc.Close()
+		if reterr == nil {
+			reterr = err
+		}
+	}
+	f.enc = nil
+
 	if f.fd != nil {
 		if sync {
 			err := iowrap.File_Sync(f.fd)
@@ -158,12 +185,29 @@ type rawFileReader struct {
 	checksum uint32
 }
 
+// rawFileReader.Open detects whether the file is encrypted, in which case it is
+// decrypted with the key it was written with.
 func (f *rawFileReader) Open(path string) error {
 	var err error
 	f.fd, err = iowrap.Os_Open(path)
 	if err == nil {
 		f.buf = make([]byte, encodeBufSize)
-		f.r = bufio.NewReaderSize(f.fd, DiskBlockSize)
+		f.r = bufio.NewReaderSize(iowrap.NewFileReader(f.fd), DiskBlockSize)
+
+		header, _ := f.r.Peek(encryption.HeaderPeekSize())
+		if !encryption.IsEncrypted(header) {
+			f.db.encryptionKeyId.Store("")
+			return nil
+		}
+
+		var dec *encryption.Reader
+		if dec, err = encryption.NewReader(f.r, f.db.keyProvider); err == nil {
+			f.db.encryptionKeyId.Store(dec.KeyId())
+			f.r = bufio.NewReaderSize(dec, DiskBlockSize)
+			return nil
+		}
+		iowrap.File_Close(f.fd)
+		f.fd = nil
 	}
 	return err
 }
@@ -21,6 +21,7 @@ import (
 	"github.com/couchbase/indexing/secondary/iowrap"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+	"github.com/couchbase/indexing/secondary/security/encryption"
 	"github.com/couchbase/indexing/secondary/stubs/nitro/mm"
 )
 
@@ -401,6 +402,8 @@ type Config struct {
 	exposeItemCopy bool
 
 	ioConcurrency float64
+
+	keyProvider encryption.KeyProvider
 }
 
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
@@ -425,6 +428,12 @@ func (cfg *Config) SetFileType(t FileType) error {
 	return nil
 }
 
+// UseEncryption encrypts snapshot files written by StoreToDisk with the
+// active key of provider. Only the raw file format supports encryption.
+func (cfg *Config) UseEncryption(provider encryption.KeyProvider) {
+	cfg.keyProvider = provider
+}
+
 func (cfg *Config) IgnoreItemSize() {
 	cfg.ignoreItemSize = true
 }
@@ -475,6 +484,9 @@ type MemDB struct {
 	deltaFiles   []string
 	persistSnap  Snapshot
 
+	// id of the key snapshot files were last written or read with
+	encryptionKeyId atomic.Value
+
 	Config
 	restoreStats
 }
@@ -564,6 +576,15 @@ func New() *MemDB {
 	return NewWithConfig(DefaultConfig())
 }
 
+// EncryptionKeyId returns the id of the key the last snapshot files were
+// written or read with, or an empty string if they are not encrypted.
+func (m *MemDB) EncryptionKeyId() string {
+	if id, ok := m.encryptionKeyId.Load().(string); ok {
+		return id
+	}
+	return ""
+}
+
 func (m *MemDB) MemoryInUse() int64 {
 	storeStats := m.aggrStoreStats()
 	return storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
@@ -0,0 +1,365 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package planner
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/queryutil"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//////////////////////////////////////////////////////////////
+// Constant
+//////////////////////////////////////////////////////////////
+
+// constant - advice type
+type AdviceType string
+
+const (
+	AdviceUnused    AdviceType = "unused"
+	AdviceRedundant            = "redundant"
+	AdviceDuplicate            = "duplicate"
+)
+
+//////////////////////////////////////////////////////////////
+// Concrete Type/Struct
+//////////////////////////////////////////////////////////////
+
+//
+// IndexAdvice is a recommendation to drop one index definition (including
+// all its replicas and partitions).
+//
+type IndexAdvice struct {
+	Type        AdviceType         `json:"type"`
+	Name        string             `json:"name"`
+	Bucket      string             `json:"bucket"`
+	Scope       string             `json:"scope"`
+	Collection  string             `json:"collection"`
+	DefnId      common.IndexDefnId `json:"defnId"`
+	NumRequests uint64             `json:"numRequests"`
+	CoveredBy   string             `json:"coveredBy,omitempty"`
+	Reason      string             `json:"reason"`
+	MemSaving   uint64             `json:"memSaving"`
+	DataSaving  uint64             `json:"dataSaving"`
+}
+
+//
+// AdvisorReport is the list of index advice and the total estimated savings.
+//
+type AdvisorReport struct {
+	Advices         []*IndexAdvice `json:"advices"`
+	TotalMemSaving  uint64         `json:"totalMemSaving"`
+	TotalDataSaving uint64         `json:"totalDataSaving"`
+}
+
+//
+// advisorDefn aggregates all instances, replicas and partitions of one index
+// definition found in a plan.
+//
+type advisorDefn struct {
+	defn        *common.IndexDefn
+	indexes     []*IndexUsage
+	numRequests uint64
+	memUsage    uint64
+	dataSize    uint64
+	active      bool
+}
+
+//////////////////////////////////////////////////////////////
+// Advisor
+//////////////////////////////////////////////////////////////
+
+//
+// Analyze the indexes in the plan and recommend indexes that can be dropped:
+// 1) unused index: index has been built but has not served any scan request.
+// 2) duplicate index: index is equivalent to another index.
+// 3) redundant index: index keys are a leading prefix of another index on the
+//    same collection, and the other index covers the same set of documents.
+//
+// An index kept in place of a duplicate or redundant index is never advised
+// to be dropped, even if it has not served any scan request.
+//
+// Savings are estimated using the sizing method from the sizing inputs of the
+// index.  If the index does not have sizing inputs, the usage from the plan is used.
+//
+func AdviseIndexes(plan *Plan, sizing SizingMethod) (*AdvisorReport, error) {
+
+	if plan == nil {
+		return nil, errors.New("Index layout is required for index advisor")
+	}
+
+	defns := groupIndexesByDefn(plan, sizing)
+
+	report := &AdvisorReport{}
+	advised := make(map[common.IndexDefnId]bool)
+	kept := make(map[common.IndexDefnId]bool)
+
+	addAdvice := func(t AdviceType, d *advisorDefn, coveredBy *advisorDefn, reason string) {
+		if advised[d.defn.DefnId] || kept[d.defn.DefnId] {
+			return
+		}
+		advised[d.defn.DefnId] = true
+		if coveredBy != nil {
+			kept[coveredBy.defn.DefnId] = true
+		}
+
+		advice := &IndexAdvice{
+			Type:        t,
+			Name:        d.defn.Name,
+			Bucket:      d.defn.Bucket,
+			Scope:       d.defn.Scope,
+			Collection:  d.defn.Collection,
+			DefnId:      d.defn.DefnId,
+			NumRequests: d.numRequests,
+			Reason:      reason,
+			MemSaving:   d.memUsage,
+			DataSaving:  d.dataSize,
+		}
+		if coveredBy != nil {
+			advice.CoveredBy = coveredBy.defn.Name
+		}
+
+		report.Advices = append(report.Advices, advice)
+		report.TotalMemSaving += advice.MemSaving
+		report.TotalDataSaving += advice.DataSaving
+	}
+
+	// duplicate index. Keep the index with the most scan requests.
+	for i, d1 := range defns {
+		for _, d2 := range defns[i+1:] {
+			if !common.IsEquivalentIndex(d1.defn, d2.defn) {
+				continue
+			}
+
+			drop, keep := d1, d2
+			if d1.numRequests > d2.numRequests || (d1.numRequests == d2.numRequests && d1.defn.DefnId < d2.defn.DefnId) {
+				drop, keep = d2, d1
+			}
+
+			if !advised[keep.defn.DefnId] && !kept[drop.defn.DefnId] {
+				addAdvice(AdviceDuplicate, drop, keep, fmt.Sprintf("index is equivalent to index %v", keep.defn.Name))
+			}
+		}
+	}
+
+	// redundant index
+	for _, d1 := range defns {
+		if advised[d1.defn.DefnId] || kept[d1.defn.DefnId] {
+			continue
+		}
+		for _, d2 := range defns {
+			if d1 == d2 || advised[d2.defn.DefnId] || !isRedundantIndex(d1.defn, d2.defn) {
+				continue
+			}
+
+			addAdvice(AdviceRedundant, d1, d2, fmt.Sprintf("index keys are a leading prefix of index %v", d2.defn.Name))
+			break
+		}
+	}
+
+	// unused index. An index kept in place of a dropped index serves its scans.
+	for _, d := range defns {
+		if d.active && d.numRequests == 0 && !kept[d.defn.DefnId] {
+			addAdvice(AdviceUnused, d, nil, "index has not served any scan request")
+		}
+	}
+
+	return report, nil
+}
+
+//
+// Group index usages by index definition, sorted by bucket, scope, collection and name.
+//
+func groupIndexesByDefn(plan *Plan, sizing SizingMethod) []*advisorDefn {
+
+	result := make(map[common.IndexDefnId]*advisorDefn)
+
+	for _, indexer := range plan.Placement {
+		for _, index := range indexer.Indexes {
+			if index.Instance == nil {
+				logging.Warnf("Planner::groupIndexesByDefn: skip index %v since index definition is not available", index.GetDisplayName())
+				continue
+			}
+
+			d, ok := result[index.DefnId]
+			if !ok {
+				d = &advisorDefn{
+					defn:   &index.Instance.Defn,
+					active: true,
+				}
+				result[index.DefnId] = d
+			}
+
+			memUsage, dataSize := estimateIndexSaving(index, sizing, plan.IsLive)
+
+			d.indexes = append(d.indexes, index)
+			d.numRequests += index.ActualNumRequests
+			d.memUsage += memUsage
+			d.dataSize += dataSize
+			d.active = d.active && index.Instance.State == common.INDEX_STATE_ACTIVE && !index.PendingDelete
+		}
+	}
+
+	defns := make([]*advisorDefn, 0, len(result))
+	for _, d := range result {
+		defns = append(defns, d)
+	}
+
+	sort.Slice(defns, func(i, j int) bool {
+		d1, d2 := defns[i].defn, defns[j].defn
+		if d1.Bucket != d2.Bucket {
+			return d1.Bucket < d2.Bucket
+		}
+		if d1.Scope != d2.Scope {
+			return d1.Scope < d2.Scope
+		}
+		if d1.Collection != d2.Collection {
+			return d1.Collection < d2.Collection
+		}
+		return d1.Name < d2.Name
+	})
+
+	return defns
+}
+
+//
+// Estimate memory and data size of an index using the sizing method.
+//
+func estimateIndexSaving(index *IndexUsage, sizing SizingMethod, useLive bool) (uint64, uint64) {
+
+	if index.HasSizingInputs() {
+		clone := index.clone()
+		sizing.ComputeIndexSize(clone)
+		return clone.MemUsage + clone.MemOverhead, clone.DataSize
+	}
+
+	return index.GetMemTotal(useLive), index.GetDataSize(useLive)
+}
+
+//
+// An index (d1) is redundant if another index (d2) on the same collection has
+// the index keys of d1 as a leading prefix, and d2 indexes at least the same
+// set of documents as d1, with one index entry for each entry of d1.
+//
+func isRedundantIndex(d1 *common.IndexDefn, d2 *common.IndexDefn) bool {
+
+	if d1.Bucket != d2.Bucket ||
+		d1.Scope != d2.Scope ||
+		d1.Collection != d2.Collection ||
+		d1.IsPrimary || d2.IsPrimary ||
+		d1.ExprType != d2.ExprType ||
+		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR {
+		return false
+	}
+
+	// d2 must not filter out documents indexed by d1
+	if d2.WhereExpr != "" && d2.WhereExpr != d1.WhereExpr {
+		return false
+	}
+
+	// Scans on the leading key of a token index are token lookups, and a
+	// partitioned index may be relied on for partition elimination.
+	if d1.TokenAnalyzer.String() != d2.TokenAnalyzer.String() ||
+		d1.PartitionScheme != d2.PartitionScheme ||
+		d1.HashScheme != d2.HashScheme ||
+		!equalStrings(d1.PartitionKeys, d2.PartitionKeys) {
+		return false
+	}
+
+	// Documents with missing leading key are indexed by only one of them
+	if d1.IndexMissingLeadingKey != d2.IndexMissingLeadingKey {
+		return false
+	}
+
+	if len(d1.SecExprs) == 0 || len(d1.SecExprs) >= len(d2.SecExprs) {
+		return false
+	}
+
+	// An array key of d2 beyond the keys of d1 gives d2 several entries for
+	// one entry of d1.  Flattened array keys are expanded to several index
+	// keys, so they are not compared key by key.
+	if d1.IsArrayFlattened || d2.IsArrayFlattened {
+		return false
+	}
+	isArray, _, isFlatten, pos, err := queryutil.GetArrayExpressionPosition(d2.SecExprs)
+	if err != nil {
+		logging.Warnf("Planner::isRedundantIndex: unable to parse keys of index %v: %v", d2.Name, err)
+		return false
+	}
+	if isFlatten || (isArray && pos >= len(d1.SecExprs)) {
+		return false
+	}
+
+	for i, expr := range d1.SecExprs {
+		if expr != d2.SecExprs[i] {
+			return false
+		}
+
+		if isDesc(d1, i) != isDesc(d2, i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isDesc(defn *common.IndexDefn, pos int) bool {
+	return pos < len(defn.Desc) && defn.Desc[pos]
+}
+
+func equalStrings(s1, s2 []string) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for i := range s1 {
+		if s1[i] != s2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//////////////////////////////////////////////////////////////
+// Output
+//////////////////////////////////////////////////////////////
+
+//
+// Print the advisor report in human readable form
+//
+func (r *AdvisorReport) Print() {
+
+	logging.Infof("--------------------------------------")
+	for _, a := range r.Advices {
+		logging.Infof("%v index name:%v, bucket:%v, scope:%v, collection:%v, defnId:%v, requests:%v, mem:%v (%s), data:%v (%s)",
+			a.Type, a.Name, a.Bucket, a.Scope, a.Collection, a.DefnId, a.NumRequests,
+			a.MemSaving, formatMemoryStr(a.MemSaving), a.DataSaving, formatMemoryStr(a.DataSaving))
+		logging.Infof("\t\t%v", a.Reason)
+	}
+	logging.Infof("--------------------------------------")
+	logging.Infof("Total memory saving:	%v", formatMemoryStr(r.TotalMemSaving))
+	logging.Infof("Total data saving:	%v", formatMemoryStr(r.TotalDataSaving))
+	logging.Infof("--------------------------------------")
+}
+
+//
+// Retrieve the index layout from the cluster and run index advisor.
+//
+func ExecuteAdvisor(clusterUrl string) (*AdvisorReport, error) {
+
+	plan, err := RetrievePlanFromCluster(clusterUrl, nil, false)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to read index layout from cluster %v. err = %s", clusterUrl, err))
+	}
+
+	return AdviseIndexes(plan, newGeneralSizingMethod())
+}
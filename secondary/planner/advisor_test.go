@@ -0,0 +1,180 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package planner
+
+import (
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func advisorDefnOf(id common.IndexDefnId, name string, secExprs ...string) common.IndexDefn {
+	return common.IndexDefn{
+		DefnId:     id,
+		Name:       name,
+		Bucket:     "b1",
+		Scope:      "s1",
+		Collection: "c1",
+		SecExprs:   secExprs,
+	}
+}
+
+func advisorPlan(numRequests map[common.IndexDefnId]uint64, defns ...common.IndexDefn) *Plan {
+
+	indexer := &IndexerNode{}
+	for _, defn := range defns {
+		inst := &common.IndexInst{
+			InstId: common.IndexInstId(defn.DefnId),
+			Defn:   defn,
+			State:  common.INDEX_STATE_ACTIVE,
+		}
+		indexer.Indexes = append(indexer.Indexes, &IndexUsage{
+			DefnId:            defn.DefnId,
+			InstId:            inst.InstId,
+			Name:              defn.Name,
+			Bucket:            defn.Bucket,
+			Scope:             defn.Scope,
+			Collection:        defn.Collection,
+			Instance:          inst,
+			ActualNumRequests: numRequests[defn.DefnId],
+		})
+	}
+	return &Plan{Placement: []*IndexerNode{indexer}}
+}
+
+func TestIsRedundantIndex(t *testing.T) {
+
+	ab := advisorDefnOf(2, "ab", "`a`", "`b`")
+
+	tests := []struct {
+		name      string
+		d1        common.IndexDefn
+		d2        common.IndexDefn
+		redundant bool
+	}{
+		{"prefix", advisorDefnOf(1, "a", "`a`"), ab, true},
+		{"same keys", advisorDefnOf(1, "a", "`a`", "`b`"), ab, false},
+		{"not a prefix", advisorDefnOf(1, "b", "`b`"), ab, false},
+		{"other collection", func() common.IndexDefn {
+			d := advisorDefnOf(1, "a", "`a`")
+			d.Collection = "c2"
+			return d
+		}(), ab, false},
+		{"where clause on d2", advisorDefnOf(1, "a", "`a`"), func() common.IndexDefn {
+			d := ab
+			d.WhereExpr = "(`a` > 10)"
+			return d
+		}(), false},
+		{"desc", func() common.IndexDefn {
+			d := advisorDefnOf(1, "a", "`a`")
+			d.Desc = []bool{true}
+			return d
+		}(), ab, false},
+		{"partitioned d2", advisorDefnOf(1, "a", "`a`"), func() common.IndexDefn {
+			d := ab
+			d.PartitionScheme = common.KEY
+			d.PartitionKeys = []string{"`a`"}
+			return d
+		}(), false},
+		{"partitioned on other keys", func() common.IndexDefn {
+			d := advisorDefnOf(1, "a", "`a`")
+			d.PartitionScheme = common.KEY
+			d.PartitionKeys = []string{"`b`"}
+			return d
+		}(), func() common.IndexDefn {
+			d := ab
+			d.PartitionScheme = common.KEY
+			d.PartitionKeys = []string{"`a`"}
+			return d
+		}(), false},
+		{"same partitioning", func() common.IndexDefn {
+			d := advisorDefnOf(1, "a", "`a`")
+			d.PartitionScheme = common.KEY
+			d.PartitionKeys = []string{"`a`"}
+			return d
+		}(), func() common.IndexDefn {
+			d := ab
+			d.PartitionScheme = common.KEY
+			d.PartitionKeys = []string{"`a`"}
+			return d
+		}(), true},
+		{"token index d2", advisorDefnOf(1, "a", "`a`"), func() common.IndexDefn {
+			d := ab
+			d.TokenAnalyzer = &common.TokenAnalyzer{Type: common.AnalyzerWhitespace}
+			return d
+		}(), false},
+		{"missing leading key d2", advisorDefnOf(1, "a", "`a`"), func() common.IndexDefn {
+			d := ab
+			d.IndexMissingLeadingKey = true
+			return d
+		}(), false},
+		{"missing leading key d1", func() common.IndexDefn {
+			d := advisorDefnOf(1, "a", "`a`")
+			d.IndexMissingLeadingKey = true
+			return d
+		}(), ab, false},
+		{"array key beyond prefix", advisorDefnOf(1, "a", "`a`"),
+			advisorDefnOf(2, "aarr", "`a`", "(distinct (array `v` for `v` in `arr` end))"), false},
+		{"array key in prefix", advisorDefnOf(1, "arr", "(distinct (array `v` for `v` in `arr` end))"),
+			advisorDefnOf(2, "arrb", "(distinct (array `v` for `v` in `arr` end))", "`b`"), true},
+		{"flattened array", advisorDefnOf(1, "a", "`a`"), func() common.IndexDefn {
+			d := advisorDefnOf(2, "aflat", "`a`", "(distinct (array flatten_keys(`v`.`x`, `v`.`y`) for `v` in `arr` end))")
+			d.IsArrayIndex = true
+			d.IsArrayFlattened = true
+			return d
+		}(), false},
+	}
+
+	for _, test := range tests {
+		d1, d2 := test.d1, test.d2
+		if got := isRedundantIndex(&d1, &d2); got != test.redundant {
+			t.Errorf("%v: isRedundantIndex = %v, expected %v", test.name, got, test.redundant)
+		}
+	}
+}
+
+func TestAdviseIndexesKeepsCoverIndex(t *testing.T) {
+
+	// idx_a is redundant with idx_ab, and idx_ab has not served any scan.
+	// idx_ab must be kept, as it serves the scans of idx_a.
+	plan := advisorPlan(map[common.IndexDefnId]uint64{1: 100},
+		advisorDefnOf(1, "idx_a", "`a`"),
+		advisorDefnOf(2, "idx_ab", "`a`", "`b`"),
+		advisorDefnOf(3, "idx_c", "`c`"),
+		advisorDefnOf(4, "idx_c2", "`c`"))
+
+	report, err := AdviseIndexes(plan, newGeneralSizingMethod())
+	if err != nil {
+		t.Fatalf("AdviseIndexes unexpected error %v", err)
+	}
+
+	advices := make(map[string]*IndexAdvice)
+	for _, a := range report.Advices {
+		advices[a.Name] = a
+	}
+
+	if a := advices["idx_a"]; a == nil || a.Type != AdviceRedundant || a.CoveredBy != "idx_ab" {
+		t.Errorf("expected idx_a to be redundant with idx_ab, got %+v", a)
+	}
+	if a := advices["idx_ab"]; a != nil {
+		t.Errorf("expected idx_ab to be kept, got %+v", a)
+	}
+
+	// of two unused duplicates, one is dropped and the other is kept
+	if a := advices["idx_c2"]; a == nil || a.Type != AdviceDuplicate || a.CoveredBy != "idx_c" {
+		t.Errorf("expected idx_c2 to be a duplicate of idx_c, got %+v", a)
+	}
+	if a := advices["idx_c"]; a != nil {
+		t.Errorf("expected idx_c to be kept, got %+v", a)
+	}
+
+	if len(report.Advices) != 2 {
+		t.Errorf("expected 2 advices, got %v", len(report.Advices))
+	}
+}
@@ -0,0 +1,360 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package planner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//////////////////////////////////////////////////////////////
+// Constant
+//////////////////////////////////////////////////////////////
+
+// constant - default rate (bytes per second) used to estimate the time
+// needed to move index data to a destination node during rebalance
+const DefaultDiffTransferRate uint64 = 50 * 1024 * 1024
+
+// constant - movement type
+type MovementType string
+
+const (
+	MovementMove   MovementType = "move"
+	MovementCreate              = "create"
+	MovementDrop                = "drop"
+)
+
+//////////////////////////////////////////////////////////////
+// Concrete Type/Struct
+//////////////////////////////////////////////////////////////
+
+//
+// PlanDiff describes every change required to go from one index layout (the
+// current plan) to another (the proposed plan).
+//
+type PlanDiff struct {
+	Movements    []*IndexMovement `json:"movements"`
+	Nodes        []*NodeDelta     `json:"nodes"`
+	NumMoved     uint64           `json:"numMoved"`
+	NumCreated   uint64           `json:"numCreated"`
+	NumDropped   uint64           `json:"numDropped"`
+	DataMoved    uint64           `json:"dataMoved"`
+	TransferRate uint64           `json:"transferRate"`
+	EstDuration  uint64           `json:"estimatedDurationSec"`
+}
+
+//
+// IndexMovement describes the change of a single index partition replica.
+//
+type IndexMovement struct {
+	Type       MovementType       `json:"type"`
+	Name       string             `json:"name"`
+	Bucket     string             `json:"bucket"`
+	Scope      string             `json:"scope"`
+	Collection string             `json:"collection"`
+	DefnId     common.IndexDefnId `json:"defnId"`
+	InstId     common.IndexInstId `json:"instId"`
+	PartnId    common.PartitionId `json:"partnId"`
+	SrcNode    string             `json:"srcNode,omitempty"`
+	DestNode   string             `json:"destNode,omitempty"`
+	DataSize   uint64             `json:"dataSize"`
+	MemUsage   uint64             `json:"memUsage"`
+}
+
+//
+// NodeDelta describes the change of resource consumption on one indexer node.
+//
+type NodeDelta struct {
+	NodeId      string  `json:"nodeId"`
+	NodeUUID    string  `json:"nodeUUID"`
+	ServerGroup string  `json:"serverGroup,omitempty"`
+	IsNew       bool    `json:"isNew,omitempty"`
+	IsRemoved   bool    `json:"isRemoved,omitempty"`
+	NumIndexIn  uint64  `json:"numIndexIn"`
+	NumIndexOut uint64  `json:"numIndexOut"`
+	DataIn      uint64  `json:"dataIn"`
+	DataOut     uint64  `json:"dataOut"`
+	MemDelta    int64   `json:"memDelta"`
+	DataDelta   int64   `json:"dataDelta"`
+	DiskDelta   int64   `json:"diskDelta"`
+	CpuDelta    float64 `json:"cpuDelta"`
+}
+
+type diffEntry struct {
+	index  *IndexUsage
+	node   *IndexerNode
+	isLive bool
+}
+
+//////////////////////////////////////////////////////////////
+// Diff
+//////////////////////////////////////////////////////////////
+
+//
+// Compute the difference between the current and the proposed plan.  Index
+// partitions are matched across plans by (defnId, instId, partnId).  Data moved
+// is estimated from the size of the index partition on the current plan, and
+// the duration assumes that destination nodes receive data in parallel at
+// transferRate bytes per second.
+//
+func DiffPlans(current *Plan, proposed *Plan, transferRate uint64) (*PlanDiff, error) {
+
+	if current == nil || proposed == nil {
+		return nil, errors.New("Both current plan and proposed plan are required for diff")
+	}
+
+	if transferRate == 0 {
+		transferRate = DefaultDiffTransferRate
+	}
+
+	from := diffEntries(current)
+	to := diffEntries(proposed)
+
+	diff := &PlanDiff{TransferRate: transferRate}
+	nodes := diffNodes(current, proposed)
+
+	for key, src := range from {
+		dest, ok := to[key]
+		if !ok {
+			diff.Movements = append(diff.Movements, newIndexMovement(MovementDrop, src, nil))
+			diff.NumDropped++
+			continue
+		}
+
+		if diffNodeKey(src.node) != diffNodeKey(dest.node) {
+			movement := newIndexMovement(MovementMove, src, dest)
+			diff.Movements = append(diff.Movements, movement)
+			diff.NumMoved++
+			diff.DataMoved += movement.DataSize
+
+			nodes[diffNodeKey(src.node)].NumIndexOut++
+			nodes[diffNodeKey(src.node)].DataOut += movement.DataSize
+			nodes[diffNodeKey(dest.node)].NumIndexIn++
+			nodes[diffNodeKey(dest.node)].DataIn += movement.DataSize
+		}
+	}
+
+	for key, dest := range to {
+		if _, ok := from[key]; !ok {
+			movement := newIndexMovement(MovementCreate, nil, dest)
+			diff.Movements = append(diff.Movements, movement)
+			diff.NumCreated++
+
+			nodes[diffNodeKey(dest.node)].NumIndexIn++
+		}
+	}
+
+	var maxDataIn uint64
+	for _, node := range nodes {
+		if node.DataIn > maxDataIn {
+			maxDataIn = node.DataIn
+		}
+		diff.Nodes = append(diff.Nodes, node)
+	}
+	diff.EstDuration = uint64(math.Ceil(float64(maxDataIn) / float64(transferRate)))
+
+	sort.Slice(diff.Movements, func(i, j int) bool {
+		if diff.Movements[i].Type != diff.Movements[j].Type {
+			return diff.Movements[i].Type < diff.Movements[j].Type
+		}
+		return diff.Movements[i].Name < diff.Movements[j].Name
+	})
+
+	sort.Slice(diff.Nodes, func(i, j int) bool {
+		return diff.Nodes[i].NodeId < diff.Nodes[j].NodeId
+	})
+
+	return diff, nil
+}
+
+func diffEntries(plan *Plan) map[string]*diffEntry {
+
+	result := make(map[string]*diffEntry)
+	for _, indexer := range plan.Placement {
+		for _, index := range indexer.Indexes {
+			key := fmt.Sprintf("%v:%v:%v", index.DefnId, index.InstId, index.PartnId)
+			result[key] = &diffEntry{index: index, node: indexer, isLive: plan.IsLive}
+		}
+	}
+	return result
+}
+
+func diffNodeKey(indexer *IndexerNode) string {
+
+	if len(indexer.NodeUUID) != 0 {
+		return indexer.NodeUUID
+	}
+	return indexer.NodeId
+}
+
+//
+// Compute per-node resource deltas.  Node resource is recomputed from the
+// indexes residing on the node so that plans with or without node level
+// sizing can be compared.
+//
+func diffNodes(current *Plan, proposed *Plan) map[string]*NodeDelta {
+
+	result := make(map[string]*NodeDelta)
+
+	getDelta := func(indexer *IndexerNode) *NodeDelta {
+		key := diffNodeKey(indexer)
+		if _, ok := result[key]; !ok {
+			result[key] = &NodeDelta{
+				NodeId:      indexer.NodeId,
+				NodeUUID:    indexer.NodeUUID,
+				ServerGroup: indexer.ServerGroup,
+			}
+		}
+		return result[key]
+	}
+
+	for _, indexer := range current.Placement {
+		delta := getDelta(indexer)
+		delta.IsRemoved = true
+		for _, index := range indexer.Indexes {
+			delta.MemDelta -= int64(index.GetMemTotal(current.IsLive))
+			delta.DataDelta -= int64(index.GetDataSize(current.IsLive))
+			delta.DiskDelta -= int64(index.GetDiskUsage(current.IsLive))
+			delta.CpuDelta -= index.GetCpuUsage(current.IsLive)
+		}
+	}
+
+	for _, indexer := range proposed.Placement {
+		_, found := result[diffNodeKey(indexer)]
+		delta := getDelta(indexer)
+		delta.IsRemoved = false
+		delta.IsNew = !found
+		for _, index := range indexer.Indexes {
+			delta.MemDelta += int64(index.GetMemTotal(proposed.IsLive))
+			delta.DataDelta += int64(index.GetDataSize(proposed.IsLive))
+			delta.DiskDelta += int64(index.GetDiskUsage(proposed.IsLive))
+			delta.CpuDelta += index.GetCpuUsage(proposed.IsLive)
+		}
+	}
+
+	return result
+}
+
+func newIndexMovement(t MovementType, src *diffEntry, dest *diffEntry) *IndexMovement {
+
+	entry := src
+	if entry == nil {
+		entry = dest
+	}
+
+	movement := &IndexMovement{
+		Type:       t,
+		Name:       entry.index.GetDisplayName(),
+		Bucket:     entry.index.Bucket,
+		Scope:      entry.index.Scope,
+		Collection: entry.index.Collection,
+		DefnId:     entry.index.DefnId,
+		InstId:     entry.index.InstId,
+		PartnId:    entry.index.PartnId,
+		DataSize:   entry.index.GetDataSize(entry.isLive),
+		MemUsage:   entry.index.GetMemTotal(entry.isLive),
+	}
+
+	if src != nil {
+		movement.SrcNode = src.node.NodeId
+	}
+
+	if dest != nil {
+		movement.DestNode = dest.node.NodeId
+	}
+
+	return movement
+}
+
+//////////////////////////////////////////////////////////////
+// Output
+//////////////////////////////////////////////////////////////
+
+//
+// Print the diff in human readable form
+//
+func (d *PlanDiff) Print() {
+
+	logging.Infof("--------------------------------------")
+	logging.Infof("Index moved:	%v", d.NumMoved)
+	logging.Infof("Index created:	%v", d.NumCreated)
+	logging.Infof("Index dropped:	%v", d.NumDropped)
+	logging.Infof("Data moved:	%v", formatMemoryStr(d.DataMoved))
+	logging.Infof("Transfer rate:	%v/s", formatMemoryStr(d.TransferRate))
+	logging.Infof("Estimated rebalance duration:	%v", time.Duration(d.EstDuration)*time.Second)
+	logging.Infof("--------------------------------------")
+
+	for _, m := range d.Movements {
+		logging.Infof("%v index name:%v, bucket:%v, scope:%v, collection:%v, defnId:%v, instId:%v, partition:%v, from:%v, to:%v, data:%v (%s), mem:%v (%s)",
+			m.Type, m.Name, m.Bucket, m.Scope, m.Collection, m.DefnId, m.InstId, m.PartnId, m.SrcNode, m.DestNode,
+			m.DataSize, formatMemoryStr(m.DataSize), m.MemUsage, formatMemoryStr(m.MemUsage))
+	}
+
+	logging.Infof("--------------------------------------")
+
+	for _, n := range d.Nodes {
+		logging.Infof("Indexer nodeId:%v, nodeUUID:%v, serverGroup:%v, isNew:%v, isRemoved:%v",
+			n.NodeId, n.NodeUUID, n.ServerGroup, n.IsNew, n.IsRemoved)
+		logging.Infof("\t\tindexIn:%v, indexOut:%v, dataIn:%v (%s), dataOut:%v (%s), mem:%+d, data:%+d, disk:%+d, cpu:%+.4f",
+			n.NumIndexIn, n.NumIndexOut, n.DataIn, formatMemoryStr(n.DataIn), n.DataOut, formatMemoryStr(n.DataOut),
+			n.MemDelta, n.DataDelta, n.DiskDelta, n.CpuDelta)
+	}
+
+	logging.Infof("--------------------------------------")
+}
+
+//
+// Save the diff into a file in JSON form
+//
+func (d *PlanDiff) Save(output string) error {
+
+	data, err := json.MarshalIndent(d, "", "	")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to save plan diff into %v. err = %s", output, err))
+	}
+
+	err = iowrap.Ioutil_WriteFile(output, data, os.ModePerm)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to save plan diff into %v. err = %s", output, err))
+	}
+
+	return nil
+}
+
+//
+// Compute the diff between two plans, print it and optionally save it in JSON form.
+//
+func ExecuteDiffWithOptions(current *Plan, proposed *Plan, detail bool, output string, transferRate uint64) (*PlanDiff, error) {
+
+	diff, err := DiffPlans(current, proposed, transferRate)
+	if err != nil {
+		return nil, err
+	}
+
+	if detail {
+		diff.Print()
+	}
+
+	if output != "" {
+		if err := diff.Save(output); err != nil {
+			return nil, err
+		}
+	}
+
+	return diff, nil
+}
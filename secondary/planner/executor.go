@@ -129,7 +129,8 @@ type IndexSpec struct {
 	Using              string             `json:"using,omitempty"`
 	ExprType           string             `json:"exprType,omitempty"`
 
-	IndexMissingLeadingKey bool `json:"indexMissingLeadingKey,omitempty"`
+	IndexMissingLeadingKey bool                  `json:"indexMissingLeadingKey,omitempty"`
+	TokenAnalyzer          *common.TokenAnalyzer `json:"tokenAnalyzer,omitempty"`
 
 	// usage
 	NumDoc        uint64  `json:"numDoc,omitempty"`
@@ -3404,6 +3405,7 @@ func indexUsageFromSpec(sizing SizingMethod, spec *IndexSpec) ([]*IndexUsage, er
 			index.Instance.Defn.Deferred = spec.Deferred
 			index.Instance.Defn.Desc = spec.Desc
 			index.Instance.Defn.IndexMissingLeadingKey = spec.IndexMissingLeadingKey
+			index.Instance.Defn.TokenAnalyzer = spec.TokenAnalyzer.Clone()
 			index.Instance.Defn.NumReplica = uint32(spec.Replica) - 1
 			index.Instance.Defn.PartitionScheme = common.PartitionScheme(spec.PartitionScheme)
 			index.Instance.Defn.PartitionKeys = spec.PartitionKeys
@@ -0,0 +1,559 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package planner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+//////////////////////////////////////////////////////////////
+// Constant
+//////////////////////////////////////////////////////////////
+
+// constant - forecast
+const (
+	DefaultForecastDays    int = 90
+	DefaultForecastStepSec int = 24 * 60 * 60
+)
+
+//////////////////////////////////////////////////////////////
+// Concrete Type/Struct
+//////////////////////////////////////////////////////////////
+
+//
+// StatsSnapshot is one periodic dump of indexer stats.  Stats are keyed by
+// indexer node id, and each node has the same stats as returned by the
+// indexer /stats endpoint.
+//
+type StatsSnapshot struct {
+	Timestamp time.Time
+	Stats     map[string]map[string]interface{}
+}
+
+//
+// IndexTrend is the growth trend of one index partition replica fitted from
+// a series of stats snapshots.  Rates are per second.
+//
+type IndexTrend struct {
+	Name           string             `json:"name"`
+	Bucket         string             `json:"bucket"`
+	Scope          string             `json:"scope"`
+	Collection     string             `json:"collection"`
+	DefnId         common.IndexDefnId `json:"defnId"`
+	InstId         common.IndexInstId `json:"instId"`
+	PartnId        common.PartitionId `json:"partnId"`
+	NodeId         string             `json:"nodeId"`
+	NumSamples     int                `json:"numSamples"`
+	ItemsCount     float64            `json:"itemsCount"`
+	ItemsGrowth    float64            `json:"itemsGrowth"`
+	DataSize       float64            `json:"dataSize"`
+	DataGrowth     float64            `json:"dataGrowth"`
+	DiskSize       float64            `json:"diskSize"`
+	DiskGrowth     float64            `json:"diskGrowth"`
+	MutationRate   float64            `json:"mutationRate"`
+	MutationGrowth float64            `json:"mutationGrowth"`
+
+	index *IndexUsage
+}
+
+//
+// NodeForecast is the projected usage of one indexer node at the end of the
+// forecast horizon, and the time at which the node is projected to exceed
+// its memory or disk quota.
+//
+type NodeForecast struct {
+	NodeId         string     `json:"nodeId"`
+	MemUsage       uint64     `json:"memUsage"`
+	DiskUsage      uint64     `json:"diskUsage"`
+	MemExceedTime  *time.Time `json:"memExceedTime,omitempty"`
+	DiskExceedTime *time.Time `json:"diskExceedTime,omitempty"`
+}
+
+//
+// Forecast is the result of capacity forecasting.  If any node exceeds its
+// quota within the horizon, Rebalance describes the rebalance required at
+// the earliest time of exceeding.
+//
+type Forecast struct {
+	Start     time.Time        `json:"start"`
+	End       time.Time        `json:"end"`
+	MemQuota  uint64           `json:"memQuota"`
+	DiskQuota uint64           `json:"diskQuota,omitempty"`
+	Indexes   []*IndexTrend    `json:"indexes"`
+	Nodes     []*NodeForecast  `json:"nodes"`
+	Rebalance *RebalanceAdvice `json:"rebalance,omitempty"`
+}
+
+//
+// RebalanceAdvice describes the rebalance needed to stay within quota.
+//
+type RebalanceAdvice struct {
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason"`
+	MemUsage uint64    `json:"memUsage"`
+	NumNode  int       `json:"numNode"`
+	AddNode  int       `json:"addNode"`
+}
+
+//////////////////////////////////////////////////////////////
+// Stats Snapshot
+//////////////////////////////////////////////////////////////
+
+//
+// Read all stats snapshots from a directory.   Each file is a JSON object of
+// indexer node id to indexer stats.  The time of the snapshot is taken from
+// the indexer "timestamp" stat, or the file modification time if the stat is
+// not available.  Snapshots are returned in time order.
+//
+func ReadStatsSnapshots(statsDir string) ([]*StatsSnapshot, error) {
+
+	if statsDir == "" {
+		return nil, nil
+	}
+
+	files, err := iowrap.Ioutil_ReadDir(statsDir)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to read stats directory %v. err = %s", statsDir, err))
+	}
+
+	var snapshots []*StatsSnapshot
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(statsDir, file.Name())
+
+		stats, err := ReadDefragUtilStats(path)
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot := &StatsSnapshot{
+			Timestamp: file.ModTime(),
+			Stats:     stats,
+		}
+
+		for _, nodeStats := range stats {
+			if ts, ok := nodeStats["timestamp"]; ok {
+				if str, ok := ts.(string); ok {
+					if nano, err := strconv.ParseInt(str, 10, 64); err == nil {
+						snapshot.Timestamp = time.Unix(0, nano)
+						break
+					}
+				}
+			}
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.Before(snapshots[j].Timestamp)
+	})
+
+	return snapshots, nil
+}
+
+//////////////////////////////////////////////////////////////
+// Trend
+//////////////////////////////////////////////////////////////
+
+//
+// Fit the growth trend of every index in the plan using linear regression
+// over the stats snapshots.
+//
+func ComputeIndexTrends(plan *Plan, snapshots []*StatsSnapshot) ([]*IndexTrend, error) {
+
+	if len(snapshots) < 2 {
+		return nil, errors.New("At least two stats snapshots are required for forecasting")
+	}
+
+	start := snapshots[0].Timestamp
+
+	var trends []*IndexTrend
+	for _, indexer := range plan.Placement {
+		for _, index := range indexer.Indexes {
+
+			var times, items, data, disk, mutation []float64
+			for _, snapshot := range snapshots {
+				statsMap, ok := snapshot.Stats[indexer.NodeId]
+				if !ok {
+					continue
+				}
+
+				itemsCount, ok := GetIndexStat(index, "items_count", statsMap, true, common.INDEXER_CUR_VERSION)
+				if !ok {
+					continue
+				}
+
+				times = append(times, snapshot.Timestamp.Sub(start).Seconds())
+				items = append(items, statToFloat(itemsCount))
+
+				dataSize, _ := GetIndexStat(index, "data_size", statsMap, true, common.INDEXER_CUR_VERSION)
+				data = append(data, statToFloat(dataSize))
+
+				diskSize, _ := GetIndexStat(index, "disk_size", statsMap, true, common.INDEXER_CUR_VERSION)
+				disk = append(disk, statToFloat(diskSize))
+
+				mutationRate, _ := GetIndexStat(index, "avg_mutation_rate", statsMap, true, common.INDEXER_CUR_VERSION)
+				mutation = append(mutation, statToFloat(mutationRate))
+			}
+
+			if len(times) == 0 {
+				logging.Warnf("Planner::ComputeIndexTrends: no stats found for index %v on node %v", index.GetDisplayName(), indexer.NodeId)
+				continue
+			}
+
+			trend := &IndexTrend{
+				Name:       index.GetDisplayName(),
+				Bucket:     index.Bucket,
+				Scope:      index.Scope,
+				Collection: index.Collection,
+				DefnId:     index.DefnId,
+				InstId:     index.InstId,
+				PartnId:    index.PartnId,
+				NodeId:     indexer.NodeId,
+				NumSamples: len(times),
+				index:      index,
+			}
+
+			// the fitted value is anchored at the time of the last snapshot
+			last := snapshots[len(snapshots)-1].Timestamp.Sub(start).Seconds()
+			trend.ItemsCount, trend.ItemsGrowth = fitLinear(times, items, last)
+			trend.DataSize, trend.DataGrowth = fitLinear(times, data, last)
+			trend.DiskSize, trend.DiskGrowth = fitLinear(times, disk, last)
+			trend.MutationRate, trend.MutationGrowth = fitLinear(times, mutation, last)
+
+			trends = append(trends, trend)
+		}
+	}
+
+	return trends, nil
+}
+
+//
+// Least square fit of y = a + b*x.  Return the fitted value at x = at,
+// and the slope b.
+//
+func fitLinear(x []float64, y []float64, at float64) (float64, float64) {
+
+	n := float64(len(x))
+	if len(x) == 0 {
+		return 0, 0
+	}
+
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+		sumXY += x[i] * y[i]
+		sumXX += x[i] * x[i]
+	}
+
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return y[len(y)-1], 0
+	}
+
+	slope := (n*sumXY - sumX*sumY) / denom
+	intercept := (sumY - slope*sumX) / n
+
+	return math.Max(0, intercept+slope*at), slope
+}
+
+func statToFloat(v interface{}) float64 {
+
+	switch val := v.(type) {
+	case float64:
+		return val
+	case string:
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	}
+	return 0
+}
+
+//
+// Update the index sizing inputs based on the trend projected by elapsed seconds,
+// and recompute the index size using the sizing method.
+//
+func (t *IndexTrend) project(sizing SizingMethod, elapsed float64) {
+
+	index := t.index
+
+	items := math.Max(0, t.ItemsCount+t.ItemsGrowth*elapsed)
+	data := math.Max(0, t.DataSize+t.DataGrowth*elapsed)
+
+	index.NumOfDocs = uint64(items)
+	index.ActualNumDocs = uint64(items)
+	index.MutationRate = uint64(math.Max(0, t.MutationRate+t.MutationGrowth*elapsed))
+	if items > 0 && index.AvgSecKeySize == 0 && index.AvgArrKeySize == 0 && index.AvgDocKeySize == 0 {
+		index.ActualKeySize = uint64(data / items)
+	}
+
+	sizing.ComputeIndexSize(index)
+}
+
+func (t *IndexTrend) projectDisk(elapsed float64) uint64 {
+	return uint64(math.Max(0, t.DiskSize+t.DiskGrowth*elapsed))
+}
+
+//////////////////////////////////////////////////////////////
+// Forecast
+//////////////////////////////////////////////////////////////
+
+//
+// Project index growth from the last snapshot up to the number of days given,
+// and find when each node would exceed its memory or disk quota.   Memory usage
+// is computed using the sizing method.  If diskQuota is 0, disk usage is not
+// checked against quota.  Growth is projected on a copy of the plan, the plan
+// given is not modified.
+//
+func ForecastCapacity(plan *Plan, snapshots []*StatsSnapshot, sizing SizingMethod,
+	days int, diskQuota uint64) (*Forecast, error) {
+
+	if plan == nil {
+		return nil, errors.New("Index layout is required for forecasting")
+	}
+
+	if plan.MemQuota == 0 {
+		return nil, errors.New("Memory quota is required for forecasting")
+	}
+
+	if days <= 0 {
+		days = DefaultForecastDays
+	}
+
+	plan = clonePlanPlacement(plan)
+	trends, err := ComputeIndexTrends(plan, snapshots)
+	if err != nil {
+		return nil, err
+	}
+
+	start := snapshots[len(snapshots)-1].Timestamp
+	forecast := &Forecast{
+		Start:     start,
+		End:       start.Add(time.Duration(days) * 24 * time.Hour),
+		MemQuota:  plan.MemQuota,
+		DiskQuota: diskQuota,
+		Indexes:   trends,
+	}
+
+	nodes := make(map[string]*NodeForecast)
+	for _, indexer := range plan.Placement {
+		nodes[indexer.NodeId] = &NodeForecast{NodeId: indexer.NodeId}
+		forecast.Nodes = append(forecast.Nodes, nodes[indexer.NodeId])
+	}
+
+	horizon := float64(days * 24 * 60 * 60)
+	for elapsed := float64(0); elapsed <= horizon; elapsed += float64(DefaultForecastStepSec) {
+
+		now := start.Add(time.Duration(elapsed) * time.Second)
+
+		for _, trend := range trends {
+			trend.project(sizing, elapsed)
+		}
+
+		var totalMem uint64
+		for _, indexer := range plan.Placement {
+			sizing.ComputeIndexerSize(indexer)
+
+			var diskUsage uint64
+			for _, trend := range trends {
+				if trend.NodeId == indexer.NodeId {
+					diskUsage += trend.projectDisk(elapsed)
+				}
+			}
+
+			node := nodes[indexer.NodeId]
+			node.MemUsage = indexer.MemUsage + indexer.MemOverhead
+			node.DiskUsage = diskUsage
+			totalMem += node.MemUsage
+
+			if node.MemExceedTime == nil && node.MemUsage > plan.MemQuota {
+				exceed := now
+				node.MemExceedTime = &exceed
+			}
+
+			if node.DiskExceedTime == nil && diskQuota != 0 && node.DiskUsage > diskQuota {
+				exceed := now
+				node.DiskExceedTime = &exceed
+			}
+
+			if forecast.Rebalance == nil && (node.MemExceedTime != nil || node.DiskExceedTime != nil) {
+				reason := fmt.Sprintf("node %v exceeds memory quota", indexer.NodeId)
+				if node.MemExceedTime == nil {
+					reason = fmt.Sprintf("node %v exceeds disk quota", indexer.NodeId)
+				}
+				forecast.Rebalance = &RebalanceAdvice{Time: now, Reason: reason}
+			}
+		}
+
+		if forecast.Rebalance != nil && forecast.Rebalance.NumNode == 0 {
+			numNode := int(math.Ceil(float64(totalMem) / float64(plan.MemQuota)))
+			if numNode < len(plan.Placement) {
+				numNode = len(plan.Placement)
+			}
+			forecast.Rebalance.MemUsage = totalMem
+			forecast.Rebalance.NumNode = numNode
+			forecast.Rebalance.AddNode = numNode - len(plan.Placement)
+		}
+	}
+
+	sort.Slice(forecast.Indexes, func(i, j int) bool {
+		return forecast.Indexes[i].Name < forecast.Indexes[j].Name
+	})
+
+	return forecast, nil
+}
+
+//
+// Copy the plan along with its indexer nodes and indexes, so that the sizing
+// of the copy can be changed.
+//
+func clonePlanPlacement(plan *Plan) *Plan {
+
+	r := *plan
+	r.Placement = make([]*IndexerNode, 0, len(plan.Placement))
+	for _, indexer := range plan.Placement {
+		node := indexer.clone()
+		for i, index := range node.Indexes {
+			node.Indexes[i] = index.clone()
+		}
+		r.Placement = append(r.Placement, node)
+	}
+
+	return &r
+}
+
+//////////////////////////////////////////////////////////////
+// Output
+//////////////////////////////////////////////////////////////
+
+//
+// Print the forecast in human readable form
+//
+func (f *Forecast) Print() {
+
+	logging.Infof("--------------------------------------")
+	logging.Infof("Forecast from:	%v", f.Start)
+	logging.Infof("Forecast to:	%v", f.End)
+	logging.Infof("Mem Quota:	%v", formatMemoryStr(f.MemQuota))
+	if f.DiskQuota != 0 {
+		logging.Infof("Disk Quota:	%v", formatMemoryStr(f.DiskQuota))
+	}
+	logging.Infof("--------------------------------------")
+
+	for _, t := range f.Indexes {
+		logging.Infof("Index name:%v, bucket:%v, scope:%v, collection:%v, node:%v, samples:%v",
+			t.Name, t.Bucket, t.Scope, t.Collection, t.NodeId, t.NumSamples)
+		logging.Infof("\t\titems:%.0f (%+.4f/s), data:%v (%+.4f/s), disk:%v (%+.4f/s), mutation rate:%.0f (%+.6f/s)",
+			t.ItemsCount, t.ItemsGrowth, formatMemoryStr(uint64(t.DataSize)), t.DataGrowth,
+			formatMemoryStr(uint64(t.DiskSize)), t.DiskGrowth, t.MutationRate, t.MutationGrowth)
+	}
+
+	logging.Infof("--------------------------------------")
+
+	for _, n := range f.Nodes {
+		logging.Infof("Indexer nodeId:%v, projected mem:%v (%s), disk:%v (%s), memExceed:%v, diskExceed:%v",
+			n.NodeId, n.MemUsage, formatMemoryStr(n.MemUsage), n.DiskUsage, formatMemoryStr(n.DiskUsage),
+			formatExceedTime(n.MemExceedTime), formatExceedTime(n.DiskExceedTime))
+	}
+
+	logging.Infof("--------------------------------------")
+
+	if f.Rebalance == nil {
+		logging.Infof("No rebalance needed before %v", f.End)
+	} else {
+		logging.Infof("Rebalance needed by %v: %v", f.Rebalance.Time, f.Rebalance.Reason)
+		logging.Infof("Projected total mem:%v (%s), indexer nodes needed:%v, nodes to add:%v",
+			f.Rebalance.MemUsage, formatMemoryStr(f.Rebalance.MemUsage), f.Rebalance.NumNode, f.Rebalance.AddNode)
+	}
+
+	logging.Infof("--------------------------------------")
+}
+
+func formatExceedTime(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.String()
+}
+
+//
+// Save the forecast into a file in JSON form
+//
+func (f *Forecast) Save(output string) error {
+
+	data, err := json.MarshalIndent(f, "", "	")
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to save forecast into %v. err = %s", output, err))
+	}
+
+	err = iowrap.Ioutil_WriteFile(output, data, os.ModePerm)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to save forecast into %v. err = %s", output, err))
+	}
+
+	return nil
+}
+
+//
+// Read stats snapshots from a directory, forecast capacity for the index layout,
+// print it and optionally save it in JSON form.
+//
+func ExecuteForecastWithOptions(plan *Plan, statsDir string, memQuota int64, diskQuota int64,
+	days int, detail bool, output string) (*Forecast, error) {
+
+	snapshots, err := ReadStatsSnapshots(statsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if memQuota > 0 {
+		p := *plan
+		p.MemQuota = uint64(memQuota)
+		plan = &p
+	}
+
+	if diskQuota < 0 {
+		diskQuota = 0
+	}
+
+	forecast, err := ForecastCapacity(plan, snapshots, newGeneralSizingMethod(), days, uint64(diskQuota))
+	if err != nil {
+		return nil, err
+	}
+
+	if detail {
+		forecast.Print()
+	}
+
+	if output != "" {
+		if err := forecast.Save(output); err != nil {
+			return nil, err
+		}
+	}
+
+	return forecast, nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package planner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func TestForecastCapacityKeepsPlan(t *testing.T) {
+
+	index := &IndexUsage{
+		DefnId:        1,
+		InstId:        1,
+		PartnId:       0,
+		Name:          "idx1",
+		Bucket:        "b1",
+		Scope:         "_default",
+		Collection:    "_default",
+		StorageMode:   common.PlasmaDB,
+		NumOfDocs:     1000,
+		AvgSecKeySize: 20,
+		AvgDocKeySize: 10,
+		ResidentRatio: 100,
+	}
+	sizing := newGeneralSizingMethod()
+	sizing.ComputeIndexSize(index)
+
+	indexer := &IndexerNode{NodeId: "n1", StorageMode: common.PlasmaDB}
+	indexer.Indexes = []*IndexUsage{index}
+	sizing.ComputeIndexerSize(indexer)
+
+	plan := &Plan{
+		Placement: []*IndexerNode{indexer},
+		MemQuota:  indexer.MemUsage + indexer.MemOverhead + 1024,
+	}
+
+	// items grow by 1000 a day
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := common.GetIndexStatKey(index.GetPartnStatsPrefix(), "items_count")
+	var snapshots []*StatsSnapshot
+	for day := 0; day < 3; day++ {
+		snapshots = append(snapshots, &StatsSnapshot{
+			Timestamp: start.Add(time.Duration(day) * 24 * time.Hour),
+			Stats: map[string]map[string]interface{}{
+				"n1": {key: float64(1000 * (day + 1))},
+			},
+		})
+	}
+
+	numOfDocs, memUsage := index.NumOfDocs, index.MemUsage
+	nodeMemUsage, nodeMemOverhead := indexer.MemUsage, indexer.MemOverhead
+
+	forecast, err := ForecastCapacity(plan, snapshots, sizing, 30, 0)
+	if err != nil {
+		t.Fatalf("ForecastCapacity unexpected error %v", err)
+	}
+
+	if len(forecast.Nodes) != 1 || forecast.Nodes[0].MemUsage <= nodeMemUsage+nodeMemOverhead {
+		t.Errorf("expected memory usage of n1 to grow, got %+v", forecast.Nodes)
+	}
+	if forecast.Rebalance == nil || forecast.Nodes[0].MemExceedTime == nil {
+		t.Errorf("expected n1 to exceed its memory quota")
+	}
+
+	if len(plan.Placement) != 1 || plan.Placement[0] != indexer || indexer.Indexes[0] != index {
+		t.Fatalf("ForecastCapacity changed the placement of the plan")
+	}
+	if index.NumOfDocs != numOfDocs || index.MemUsage != memUsage {
+		t.Errorf("ForecastCapacity changed index sizing from (%v, %v) to (%v, %v)",
+			numOfDocs, memUsage, index.NumOfDocs, index.MemUsage)
+	}
+	if indexer.MemUsage != nodeMemUsage || indexer.MemOverhead != nodeMemOverhead {
+		t.Errorf("ForecastCapacity changed indexer sizing from (%v, %v) to (%v, %v)",
+			nodeMemUsage, nodeMemOverhead, indexer.MemUsage, indexer.MemOverhead)
+	}
+
+	// forecasting twice gives the same result
+	again, err := ForecastCapacity(plan, snapshots, sizing, 30, 0)
+	if err != nil {
+		t.Fatalf("ForecastCapacity unexpected error %v", err)
+	}
+	if again.Nodes[0].MemUsage != forecast.Nodes[0].MemUsage {
+		t.Errorf("expected the same forecast, got %v and %v",
+			forecast.Nodes[0].MemUsage, again.Nodes[0].MemUsage)
+	}
+}
@@ -64,6 +64,8 @@ const (
 	CommandRepair                = "repair"
 	CommandDrop                  = "drop"
 	CommandRetrieve              = "retrieve"
+	CommandDiff                  = "diff"
+	CommandForecast              = "forecast"
 )
 
 // constant - violation code
@@ -273,6 +275,11 @@ type IndexUsage struct {
 	ActualMemMin          uint64 `json:"actualMemMin"`
 	ActualUnitsUsage      uint64 `json:"actualUnitsUsage"`
 
+	// input: scan statistics (from live cluster)
+	ActualNumRequests    uint64 `json:"actualNumRequests"`
+	ActualLastScanTime   uint64 `json:"actualLastScanTime"`
+	ActualAvgScanLatency uint64 `json:"actualAvgScanLatency"`
+
 	// input: resource consumption (estimated sizing)
 	NoUsageInfo       bool   `json:"NoUsageInfo"`
 	EstimatedMemUsage uint64 `json:"estimatedMemUsage"`
@@ -720,6 +720,19 @@ func SetStatsInIndexer(indexer *IndexerNode, statsMap map[string]interface{}, cl
 			totalMutation += index.MutationRate
 		}
 
+		// scan statistics used by index advisor
+		if numRequests, ok := GetIndexStat(index, "num_requests", statsMap, true, clusterVersion); ok {
+			index.ActualNumRequests = uint64(numRequests.(float64))
+		}
+
+		if lastScanTime, ok := GetIndexStat(index, "last_known_scan_time", statsMap, true, clusterVersion); ok {
+			index.ActualLastScanTime = uint64(lastScanTime.(float64))
+		}
+
+		if avgScanLatency, ok := GetIndexStat(index, "avg_scan_latency", statsMap, true, clusterVersion); ok {
+			index.ActualAvgScanLatency = uint64(avgScanLatency.(float64))
+		}
+
 		// These stats are currently unavailable in 4.5.
 		if avgScanRate, ok := GetIndexStat(index, "avg_scan_rate", statsMap, true, clusterVersion); ok {
 			index.ScanRate = uint64(avgScanRate.(float64))
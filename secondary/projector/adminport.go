@@ -45,6 +45,9 @@ func (p *Projector) mainAdminPort(reqch chan apcommon.Request) {
 	p.admind.RegisterHTTPHandler("/stats/cinfolite", c.HandleCICLStats)
 	p.admind.RegisterHTTPHandler("/settings", p.handleSettings)
 	p.admind.RegisterHTTPHandler("/getInternalVersion", p.handleInternalVersion)
+	p.admind.RegisterHTTPHandler("/sampleIndex", p.handleSampleIndex)
+	p.admind.RegisterHTTPHandler("/topics", p.handleTopics)
+	p.admind.RegisterHTTPHandler("/topics/", p.handleTopic)
 
 	// debug pprof hanlders.
 	p.admind.RegisterHTTPHandler("/debug/pprof", c.PProfHandler)
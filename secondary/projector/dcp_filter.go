@@ -0,0 +1,477 @@
+// Collection filtered streams.
+//
+// Streams of bucket level keyspaces, like the maintenance stream, carry the
+// mutations of all the collections in the bucket. When
+// projector.dcp.collectionFilter is enabled they are requested with a
+// filter for the collections of the keyspace's index instances.
+//
+// When instances are added or deleted and the collections change, the
+// stream of each active vbucket is closed and re-opened, from where it was,
+// with the new filter. KVData does not pass the StreamEnd and StreamRequest
+// response of a refiltered stream to its worker, hence downstream does not
+// see the vbucket restart. If the stream cannot be re-opened a StreamEnd is
+// published, for downstream to restart the vbucket.
+//
+// Streams are refiltered synchronously when instances are added, so that
+// the current timestamp returned to the indexer is after the refilter.
+// Otherwise the keyspace is marked pending and genServer refilters its
+// streams, refilterBatchSize vbuckets at a time, when it has no request
+// or back-channel message to handle.
+
+package projector
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/collections"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	"github.com/couchbase/indexing/secondary/logging"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+// refilterBatchSize is the maximum number of vbucket streams refiltered
+// in one go by refilterPendingStreams().
+const refilterBatchSize = 64
+
+// refilterReady is always ready to receive from, genServer selects on it
+// when streams are pending refilter.
+var refilterReady = func() chan bool {
+	ch := make(chan bool)
+	close(ch)
+	return ch
+}()
+
+// filterStreams returns the timestamp to start the streams of keyspace
+// with, filtered by the collections of its instances.
+func (feed *Feed) filterStreams(
+	keyspaceId string, ts *protobuf.TsVbuuid) *protobuf.TsVbuuid {
+
+	if !feed.config["dcp.collectionFilter"].Bool() || !feed.collectionsAware {
+		return ts
+	} else if ts.GetScopeID() != "" || len(ts.GetCollectionIDs()) > 0 {
+		return ts // keyspace is already a scope or a collection.
+	}
+
+	cids := feed.collectionFilter(keyspaceId)
+	filters, ok := feed.filters[keyspaceId]
+	if !ok {
+		filters = make(map[uint16]string)
+		feed.filters[keyspaceId] = filters // :SideEffect:
+	}
+	filter := strings.Join(cids, ",")
+	for _, vbno := range c.Vbno32to16(ts.GetVbnos()) {
+		filters[vbno] = filter // :SideEffect:
+	}
+	if len(cids) == 0 {
+		return ts
+	}
+	ts = ts.Clone()
+	ts.CollectionIDs = cids
+	return ts
+}
+
+// collectionFilter returns the sorted list of collections of the
+// keyspace's instances, nil if streams should not be filtered.
+func (feed *Feed) collectionFilter(keyspaceId string) []string {
+	m := make(map[string]bool)
+	for _, engine := range feed.engines[keyspaceId] {
+		cid := engine.GetCollectionID()
+		if cid == "" {
+			return nil
+		}
+		m[cid] = true
+	}
+	if len(m) == 0 {
+		return nil
+	}
+	cids := make([]string, 0, len(m))
+	for cid := range m {
+		cids = append(cids, cid)
+	}
+	sort.Strings(cids)
+	return cids
+}
+
+// refilterPendingStreams refilters a batch of the streams of the first
+// keyspace pending refilter.
+func (feed *Feed) refilterPendingStreams() {
+	keyspaceIds := make([]string, 0, len(feed.refilterPending))
+	for keyspaceId := range feed.refilterPending {
+		keyspaceIds = append(keyspaceIds, keyspaceId)
+	}
+	if len(keyspaceIds) == 0 {
+		return
+	}
+	sort.Strings(keyspaceIds)
+
+	keyspaceId := keyspaceIds[0]
+	opaque := feed.refilterPending[keyspaceId]
+	_, more := feed.refilterStreams(opaque, keyspaceId, refilterBatchSize)
+	if !more {
+		delete(feed.refilterPending, keyspaceId)
+	}
+}
+
+// refilterStreams re-opens the active streams of keyspace whose filter
+// does not match the collections of its instances, at most maxVbs of them
+// if maxVbs is > 0. Returns the seqnos streams are re-opened from, and
+// whether more streams are to be refiltered.
+func (feed *Feed) refilterStreams(
+	opaque uint16, keyspaceId string,
+	maxVbs int) (seqnos map[uint16]uint64, more bool) {
+
+	filters, ok1 := feed.filters[keyspaceId]
+	kvdata, ok2 := feed.kvdata[keyspaceId]
+	feeder, ok3 := feed.feeders[keyspaceId]
+	actTs, ok4 := feed.actTss[keyspaceId]
+	if !ok1 || !ok2 || !ok3 || !ok4 || len(feed.engines[keyspaceId]) == 0 {
+		return nil, false
+	}
+
+	cids := feed.collectionFilter(keyspaceId)
+	filter := strings.Join(cids, ",")
+	vbnos := make([]uint16, 0)
+	for _, vbno := range c.Vbno32to16(actTs.GetVbnos()) {
+		if f, ok := filters[vbno]; ok && f != filter {
+			vbnos = append(vbnos, vbno)
+		}
+	}
+	if maxVbs > 0 && len(vbnos) > maxVbs {
+		vbnos, more = vbnos[:maxVbs], true
+	}
+	// skip vbuckets whose previous refilter is still outstanding.
+	if vbnos = kvdata.BeginRefilter(vbnos); len(vbnos) == 0 {
+		return nil, more
+	}
+
+	prefix := feed.logPrefix
+	fmsg := "%v ##%x refilter %q streams with collections %v, vbnos: %v\n"
+	logging.Infof(fmsg, prefix, opaque, keyspaceId, cids, vbnos)
+
+	endTs := actTs.SelectByVbuckets(vbnos)
+	if err, _ := feeder.EndVbStreams(opaque, endTs); err != nil {
+		fmsg := "%v ##%x refilter EndVbStreams(%q): %v\n"
+		logging.Errorf(fmsg, prefix, opaque, keyspaceId, err)
+	}
+	feed.waitRefilter(opaque, kvdata, vbnos, true /*end*/)
+
+	// streams are re-opened with the opaque they were requested with.
+	seqnos = make(map[uint16]uint64)
+	started := make([]uint16, 0, len(vbnos))
+	for vbopaque, ts := range kvdata.EndRefilter(vbnos) {
+		ts.CollectionIDs = cids
+		if err := feeder.StartVbStreams(vbopaque, ts); err != nil {
+			fmsg := "%v ##%x refilter StartVbStreams(%q): %v\n"
+			logging.Errorf(fmsg, prefix, opaque, keyspaceId, err)
+			feed.cleanupKeyspace(keyspaceId, false)
+			return nil, false
+		}
+		for i, vbno := range c.Vbno32to16(ts.GetVbnos()) {
+			filters[vbno] = filter // :SideEffect:
+			seqnos[vbno] = ts.GetSeqnos()[i]
+			started = append(started, vbno)
+		}
+	}
+	feed.waitRefilter(opaque, kvdata, started, false /*end*/)
+	return seqnos, more
+}
+
+// waitRefilter waits for kvdata to post StreamEnd, or StreamRequest,
+// for the refiltered streams of vbnos. Other messages, and a StreamEnd
+// for a stream that has ended instead of being closed for refilter, are
+// kept in feed.refilterBacklog, in order, for genServer to handle them.
+// They are not posted back to the back-channel, genServer is its only
+// reader.
+func (feed *Feed) waitRefilter(
+	opaque uint16, kvdata *KVData, vbnos []uint16, end bool) {
+
+	if len(vbnos) == 0 {
+		return
+	}
+	pending := make([]uint16, len(vbnos))
+	copy(pending, vbnos)
+
+	isPending := func(keyspaceId string, uuid uint64, vbno uint16) bool {
+		if keyspaceId != kvdata.keyspaceId || uuid != kvdata.uuid {
+			return false
+		}
+		for _, x := range pending {
+			if x == vbno {
+				return true
+			}
+		}
+		return false
+	}
+
+	tmo := feed.reqTimeout
+	if end {
+		tmo = feed.endTimeout
+	}
+	timeout := time.After(tmo * time.Millisecond)
+	for len(pending) > 0 {
+		var msg []interface{}
+		select {
+		case msg = <-feed.backch:
+		case <-timeout:
+			fmsg := "%v ##%x refilter %q (end: %v) timeout, vbnos: %v\n"
+			logging.Errorf(fmsg, feed.logPrefix, opaque, kvdata.keyspaceId, end, pending)
+			return
+		case <-feed.finch:
+			return
+		}
+
+		if val, ok := msg[0].(*controlStreamEnd); ok && end &&
+			isPending(val.keyspaceId, val.uuid, val.vbno) {
+
+			if !val.refilter {
+				feed.refilterBacklog = append(feed.refilterBacklog, msg)
+			}
+			pending = c.RemoveUint16(val.vbno, pending)
+
+		} else if val, ok := msg[0].(*controlStreamRequest); ok && !end &&
+			val.refilter && isPending(val.keyspaceId, val.uuid, val.vbno) {
+
+			pending = c.RemoveUint16(val.vbno, pending)
+
+		} else {
+			feed.refilterBacklog = append(feed.refilterBacklog, msg)
+		}
+	}
+}
+
+// postRefilter posts the StreamEnd or StreamRequest of a refiltered
+// stream to the back-channel.
+func (feed *Feed) postRefilter(cmd interface{}, opaque uint16, repr string) {
+	var respch chan []interface{}
+	fmsg := "%v ##%x backch %T %v\n"
+	logging.Infof(fmsg, feed.logPrefix, opaque, cmd, repr)
+	err := c.FailsafeOpNoblock(feed.backch, []interface{}{cmd}, feed.finch)
+	if err == c.ErrorChannelFull {
+		fmsg := "%v ##%x backch blocked on postRefilter\n"
+		logging.Errorf(fmsg, feed.logPrefix, opaque)
+		// block now !!
+		c.FailsafeOp(feed.backch, respch, []interface{}{cmd}, feed.finch)
+	}
+}
+
+// vbPosition of a vbucket stream, as scattered to its worker.
+type vbPosition struct {
+	opaque    uint16
+	vbuuid    uint64
+	seqno     uint64
+	snapStart uint64
+	snapEnd   uint64
+	manifest  string
+	oso       bool // in the middle of an oso snapshot
+}
+
+const (
+	refilterEnding   byte = iota + 1 // stream is being closed
+	refilterEnded                    // stream is closed at pos
+	refilterStarting                 // stream is being re-opened
+)
+
+type refilterVb struct {
+	state byte
+	pos   vbPosition
+}
+
+// BeginRefilter marks the streams of vbnos as being closed for refilter,
+// returns the vbuckets that were not being refiltered already.
+func (kvdata *KVData) BeginRefilter(vbnos []uint16) []uint16 {
+	kvdata.refilterMu.Lock()
+	defer kvdata.refilterMu.Unlock()
+
+	marked := make([]uint16, 0, len(vbnos))
+	for _, vbno := range vbnos {
+		if _, ok := kvdata.refilter[vbno]; !ok {
+			kvdata.refilter[vbno] = &refilterVb{state: refilterEnding}
+			marked = append(marked, vbno)
+		}
+	}
+	return marked
+}
+
+// EndRefilter returns the timestamps, by opaque, to re-open the closed
+// streams of vbnos from. Streams that are not closed yet are no more
+// refiltered, and their StreamEnd is published downstream.
+func (kvdata *KVData) EndRefilter(vbnos []uint16) map[uint16]*protobuf.TsVbuuid {
+	kvdata.refilterMu.Lock()
+	defer kvdata.refilterMu.Unlock()
+
+	tss := make(map[uint16]*protobuf.TsVbuuid)
+	for _, vbno := range vbnos {
+		rv, ok := kvdata.refilter[vbno]
+		if !ok {
+			continue
+		} else if rv.state != refilterEnded {
+			delete(kvdata.refilter, vbno)
+			continue
+		}
+		rv.state = refilterStarting
+
+		pos := rv.pos
+		snapStart, snapEnd := pos.snapStart, pos.snapEnd
+		if pos.seqno < snapStart || pos.seqno >= snapEnd { // snapshot is complete
+			snapStart, snapEnd = pos.seqno, pos.seqno
+		}
+		manifest := pos.manifest
+		if manifest == "" {
+			manifest = collections.MANIFEST_UID_EPOCH
+		}
+		ts, ok := tss[pos.opaque]
+		if !ok {
+			ts = protobuf.NewTsVbuuid(kvdata.feed.pooln, kvdata.bucket, len(vbnos))
+			tss[pos.opaque] = ts
+		}
+		ts.Append(vbno, pos.seqno, pos.vbuuid, snapStart, snapEnd, manifest)
+	}
+	return tss
+}
+
+// refiltered handles the StreamEnd and the StreamRequest response of a
+// stream being refiltered, returns false if `m` is not one of them.
+func (kvdata *KVData) refiltered(
+	m *mc.DcpEvent, worker *VbucketWorker) (seqno uint64, ok bool, err error) {
+
+	if m.Opcode != mcd.DCP_STREAMEND && m.Opcode != mcd.DCP_STREAMREQ {
+		return 0, false, nil
+	}
+
+	vbno := m.VBucket
+	kvdata.refilterMu.Lock()
+	rv, ok := kvdata.refilter[vbno]
+	if !ok {
+		kvdata.refilterMu.Unlock()
+		return 0, false, nil
+	}
+
+	if m.Opcode == mcd.DCP_STREAMEND && rv.state == refilterEnding {
+		pos, ok := kvdata.vbpos[vbno]
+		if m.Status != mcd.SUCCESS || !ok || pos.oso {
+			// stream has ended, or cannot be resumed in the middle of an
+			// oso snapshot, publish its StreamEnd.
+			delete(kvdata.refilter, vbno)
+			kvdata.refilterMu.Unlock()
+			return 0, false, nil
+		}
+		rv.state, rv.pos = refilterEnded, *pos
+		kvdata.refilterMu.Unlock()
+
+		cmd := &controlStreamEnd{
+			keyspaceId: kvdata.keyspaceId,
+			opaque:     m.Opaque,
+			status:     m.Status,
+			vbno:       vbno,
+			uuid:       kvdata.uuid,
+			refilter:   true,
+		}
+		kvdata.feed.postRefilter(cmd, m.Opaque, cmd.Repr())
+		return 0, true, nil
+
+	} else if m.Opcode == mcd.DCP_STREAMREQ && rv.state == refilterStarting {
+		delete(kvdata.refilter, vbno)
+		kvdata.refilterMu.Unlock()
+
+		pos := kvdata.vbpos[vbno]
+		if m.Status == mcd.SUCCESS {
+			if m.VBuuid, _, err = m.FailoverLog.Latest(); err != nil {
+				return 0, true, err
+			}
+			pos.vbuuid, m.Seqno = m.VBuuid, pos.seqno
+			fmsg := "%v ##%x refilter StreamRequest: %v\n"
+			logging.Infof(fmsg, kvdata.logPrefix, m.Opaque, logging.TagUD(m))
+		} else {
+			fmsg := "%v ##%x refilter StreamRequest %s: %v\n"
+			logging.Errorf(fmsg, kvdata.logPrefix, m.Opaque, m.Status, logging.TagUD(m))
+		}
+
+		cmd := &controlStreamRequest{
+			keyspaceId: kvdata.keyspaceId,
+			opaque:     m.Opaque,
+			status:     m.Status,
+			vbno:       vbno,
+			vbuuid:     m.VBuuid,
+			seqno:      m.Seqno,
+			uuid:       kvdata.uuid,
+			refilter:   true,
+		}
+		kvdata.feed.postRefilter(cmd, m.Opaque, cmd.Repr())
+		if m.Status == mcd.SUCCESS {
+			return m.Seqno, true, nil
+		}
+
+		// stream is lost, end it downstream to get it restarted.
+		delete(kvdata.vbpos, vbno)
+		end := &mc.DcpEvent{
+			Opcode:  mcd.DCP_STREAMEND,
+			Status:  mcd.SUCCESS,
+			VBucket: vbno,
+			Opaque:  m.Opaque,
+		}
+		if err = worker.Event(end); err != nil {
+			return 0, true, err
+		}
+		kvdata.stats.endCount.Add(1)
+		kvdata.feed.PostStreamEnd(kvdata.keyspaceId, end, kvdata.uuid)
+		return 0, true, nil
+	}
+	kvdata.refilterMu.Unlock()
+	return 0, false, nil
+}
+
+// trackPosition of the vbucket stream, to re-open it from.
+func (kvdata *KVData) trackPosition(m *mc.DcpEvent) {
+	vbno := m.VBucket
+	if m.Opcode == mcd.DCP_STREAMREQ {
+		if m.Status == mcd.SUCCESS {
+			kvdata.reqTsMutex.RLock()
+			_, _, sStart, sEnd, manifest, _ := kvdata.reqTs.Get(vbno)
+			kvdata.reqTsMutex.RUnlock()
+			kvdata.vbpos[vbno] = &vbPosition{
+				opaque:    m.Opaque,
+				vbuuid:    m.VBuuid,
+				seqno:     m.Seqno,
+				snapStart: sStart,
+				snapEnd:   sEnd,
+				manifest:  manifest,
+			}
+		}
+		return
+	}
+
+	pos, ok := kvdata.vbpos[vbno]
+	if !ok {
+		return
+	}
+	switch m.Opcode {
+	case mcd.DCP_STREAMEND:
+		delete(kvdata.vbpos, vbno)
+	case mcd.DCP_SNAPSHOT:
+		pos.snapStart, pos.snapEnd = m.SnapstartSeq, m.SnapendSeq
+	case mcd.DCP_MUTATION, mcd.DCP_DELETION, mcd.DCP_EXPIRATION,
+		mcd.DCP_SEQNO_ADVANCED:
+		pos.seqno = m.Seqno
+	case mcd.DCP_SYSTEM_EVENT:
+		pos.seqno, pos.manifest = m.Seqno, string(m.ManifestUID)
+	case mcd.DCP_OSO_SNAPSHOT:
+		pos.oso = m.EventType == mcd.OSO_SNAPSHOT_START
+	}
+}
+
+// refilteringVbuckets return the vbuckets whose streams are being refiltered.
+func (kvdata *KVData) refilteringVbuckets() []uint16 {
+	kvdata.refilterMu.Lock()
+	defer kvdata.refilterMu.Unlock()
+
+	vbnos := make([]uint16, 0, len(kvdata.refilter))
+	for vbno := range kvdata.refilter {
+		vbnos = append(vbnos, vbno)
+	}
+	sort.Slice(vbnos, func(i, j int) bool { return vbnos[i] < vbnos[j] })
+	return vbnos
+}
@@ -0,0 +1,283 @@
+package projector
+
+import (
+	"sync"
+	"testing"
+
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+func newRefilterTestKVData() (*KVData, *VbucketWorker) {
+	feed := &Feed{
+		pooln:      "default",
+		backch:     make(chan []interface{}, 64),
+		finch:      make(chan bool),
+		endTimeout: 100,
+		reqTimeout: 100,
+		logPrefix:  "FEED[<=>test]",
+	}
+	kvdata := &KVData{
+		feed:       feed,
+		bucket:     "b1",
+		keyspaceId: "b1",
+		uuid:       1,
+		reqTs:      protobuf.NewTsVbuuid("default", "b1", 4),
+		reqTsMutex: &sync.RWMutex{},
+		vbpos:      make(map[uint16]*vbPosition),
+		refilter:   make(map[uint16]*refilterVb),
+		logPrefix:  "KVDT[<-b1<-test]",
+		stats:      &KvdataStats{},
+	}
+	kvdata.stats.endCount.Init()
+	worker := &VbucketWorker{
+		datach:   make(chan []interface{}, 16),
+		runFinCh: make(chan bool),
+	}
+	return kvdata, worker
+}
+
+// scatter drives kvdata with m the way scatterMutation() does.
+func scatterRefilter(t *testing.T, kvdata *KVData, worker *VbucketWorker, m *mc.DcpEvent) bool {
+	_, ok, err := kvdata.refiltered(m, worker)
+	if err != nil {
+		t.Fatalf("refiltered(%v) unexpected error %v", m.Opcode, err)
+	}
+	if !ok {
+		kvdata.trackPosition(m)
+	}
+	return ok
+}
+
+func streamRequest(vbno uint16, status mcd.Status, vbuuid, seqno uint64) *mc.DcpEvent {
+	flog := mc.FailoverLog{{vbuuid, seqno}}
+	return &mc.DcpEvent{
+		Opcode:      mcd.DCP_STREAMREQ,
+		Status:      status,
+		VBucket:     vbno,
+		Opaque:      0xab,
+		VBuuid:      vbuuid,
+		Seqno:       seqno,
+		FailoverLog: &flog,
+	}
+}
+
+func backchMsgs(feed *Feed) []interface{} {
+	msgs := make([]interface{}, 0)
+	for len(feed.backch) > 0 {
+		msgs = append(msgs, (<-feed.backch)[0])
+	}
+	return msgs
+}
+
+func TestTrackPosition(t *testing.T) {
+	kvdata, worker := newRefilterTestKVData()
+	kvdata.reqTs.Append(0, 10, 1111, 5, 20, "0")
+
+	scatterRefilter(t, kvdata, worker, streamRequest(0, mcd.SUCCESS, 1111, 10))
+	pos, ok := kvdata.vbpos[0]
+	if !ok || pos.opaque != 0xab || pos.vbuuid != 1111 || pos.seqno != 10 ||
+		pos.snapStart != 5 || pos.snapEnd != 20 || pos.manifest != "0" {
+		t.Fatalf("unexpected position after StreamRequest %+v", pos)
+	}
+
+	events := []*mc.DcpEvent{
+		{Opcode: mcd.DCP_SNAPSHOT, VBucket: 0, SnapstartSeq: 21, SnapendSeq: 30},
+		{Opcode: mcd.DCP_MUTATION, VBucket: 0, Seqno: 21},
+		{Opcode: mcd.DCP_DELETION, VBucket: 0, Seqno: 22},
+		{Opcode: mcd.DCP_SYSTEM_EVENT, VBucket: 0, Seqno: 23, ManifestUID: []byte("a")},
+		{Opcode: mcd.DCP_SEQNO_ADVANCED, VBucket: 0, Seqno: 25},
+	}
+	for _, m := range events {
+		scatterRefilter(t, kvdata, worker, m)
+	}
+	if pos.snapStart != 21 || pos.snapEnd != 30 || pos.seqno != 25 || pos.manifest != "a" {
+		t.Fatalf("unexpected position after mutations %+v", pos)
+	}
+
+	scatterRefilter(t, kvdata, worker, &mc.DcpEvent{
+		Opcode: mcd.DCP_OSO_SNAPSHOT, VBucket: 0, EventType: mcd.OSO_SNAPSHOT_START})
+	if !pos.oso {
+		t.Fatalf("expected position in oso snapshot")
+	}
+	scatterRefilter(t, kvdata, worker, &mc.DcpEvent{
+		Opcode: mcd.DCP_OSO_SNAPSHOT, VBucket: 0, EventType: mcd.OSO_SNAPSHOT_END})
+	if pos.oso {
+		t.Fatalf("expected position out of oso snapshot")
+	}
+
+	scatterRefilter(t, kvdata, worker, &mc.DcpEvent{Opcode: mcd.DCP_STREAMEND, VBucket: 0})
+	if _, ok := kvdata.vbpos[0]; ok {
+		t.Fatalf("expected no position after StreamEnd")
+	}
+
+	// a rolled back stream has no position
+	scatterRefilter(t, kvdata, worker, streamRequest(1, mcd.ROLLBACK, 2222, 0))
+	if _, ok := kvdata.vbpos[1]; ok {
+		t.Fatalf("expected no position after rollback")
+	}
+}
+
+func TestRefilterStream(t *testing.T) {
+	kvdata, worker := newRefilterTestKVData()
+	feed := kvdata.feed
+
+	scatterRefilter(t, kvdata, worker, streamRequest(0, mcd.SUCCESS, 1111, 10))
+	scatterRefilter(t, kvdata, worker, &mc.DcpEvent{
+		Opcode: mcd.DCP_SNAPSHOT, VBucket: 0, SnapstartSeq: 11, SnapendSeq: 20})
+	scatterRefilter(t, kvdata, worker, &mc.DcpEvent{
+		Opcode: mcd.DCP_MUTATION, VBucket: 0, Seqno: 15})
+
+	if vbnos := kvdata.BeginRefilter([]uint16{0}); len(vbnos) != 1 {
+		t.Fatalf("BeginRefilter expected vbucket 0, got %v", vbnos)
+	}
+	if vbnos := kvdata.BeginRefilter([]uint16{0}); len(vbnos) != 0 {
+		t.Fatalf("BeginRefilter expected no vbucket while refiltering, got %v", vbnos)
+	}
+	if vbnos := kvdata.refilteringVbuckets(); len(vbnos) != 1 || vbnos[0] != 0 {
+		t.Fatalf("refilteringVbuckets unexpected %v", vbnos)
+	}
+
+	// mutations before the StreamEnd are passed on.
+	if scatterRefilter(t, kvdata, worker, &mc.DcpEvent{
+		Opcode: mcd.DCP_MUTATION, VBucket: 0, Seqno: 16}) {
+		t.Fatalf("mutation of a refiltered stream must be passed on")
+	}
+
+	// StreamEnd is held back, and posted as a refilter StreamEnd.
+	end := &mc.DcpEvent{Opcode: mcd.DCP_STREAMEND, Status: mcd.SUCCESS, VBucket: 0, Opaque: 0xab}
+	if !scatterRefilter(t, kvdata, worker, end) {
+		t.Fatalf("StreamEnd of a refiltered stream must be held back")
+	}
+	msgs := backchMsgs(feed)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one back-channel message, got %v", msgs)
+	} else if cmd, ok := msgs[0].(*controlStreamEnd); !ok || !cmd.refilter || cmd.vbno != 0 {
+		t.Fatalf("expected refilter StreamEnd, got %v", msgs[0])
+	}
+
+	// the stream is re-opened from the middle of its snapshot.
+	tss := kvdata.EndRefilter([]uint16{0})
+	ts, ok := tss[0xab]
+	if !ok || len(tss) != 1 {
+		t.Fatalf("EndRefilter expected a timestamp for opaque 0xab, got %v", tss)
+	}
+	seqno, vbuuid, sStart, sEnd, manifest, err := ts.Get(0)
+	if err != nil || seqno != 16 || vbuuid != 1111 || sStart != 11 || sEnd != 20 || manifest != "0" {
+		t.Fatalf("EndRefilter unexpected timestamp %v %v %v %v %v %v",
+			seqno, vbuuid, sStart, sEnd, manifest, err)
+	}
+
+	// StreamRequest response is held back, the stream continues.
+	if !scatterRefilter(t, kvdata, worker, streamRequest(0, mcd.SUCCESS, 3333, 0)) {
+		t.Fatalf("StreamRequest of a refiltered stream must be held back")
+	}
+	msgs = backchMsgs(feed)
+	if len(msgs) != 1 {
+		t.Fatalf("expected one back-channel message, got %v", msgs)
+	} else if cmd, ok := msgs[0].(*controlStreamRequest); !ok || !cmd.refilter ||
+		cmd.status != mcd.SUCCESS || cmd.seqno != 16 || cmd.vbuuid != 3333 {
+		t.Fatalf("expected refilter StreamRequest, got %v", msgs[0])
+	}
+	if pos := kvdata.vbpos[0]; pos == nil || pos.vbuuid != 3333 || pos.seqno != 16 {
+		t.Fatalf("unexpected position after refilter %+v", pos)
+	}
+	if len(worker.datach) != 0 {
+		t.Fatalf("worker must not see the refilter, got %v events", len(worker.datach))
+	}
+	if vbnos := kvdata.refilteringVbuckets(); len(vbnos) != 0 {
+		t.Fatalf("refilteringVbuckets expected none, got %v", vbnos)
+	}
+}
+
+func TestRefilterStreamOSO(t *testing.T) {
+	kvdata, worker := newRefilterTestKVData()
+
+	scatterRefilter(t, kvdata, worker, streamRequest(0, mcd.SUCCESS, 1111, 0))
+	scatterRefilter(t, kvdata, worker, &mc.DcpEvent{
+		Opcode: mcd.DCP_OSO_SNAPSHOT, VBucket: 0, EventType: mcd.OSO_SNAPSHOT_START})
+	kvdata.BeginRefilter([]uint16{0})
+
+	// stream cannot be resumed in the middle of an oso snapshot, its
+	// StreamEnd is passed on.
+	end := &mc.DcpEvent{Opcode: mcd.DCP_STREAMEND, Status: mcd.SUCCESS, VBucket: 0, Opaque: 0xab}
+	if scatterRefilter(t, kvdata, worker, end) {
+		t.Fatalf("StreamEnd in an oso snapshot must be passed on")
+	}
+	if tss := kvdata.EndRefilter([]uint16{0}); len(tss) != 0 {
+		t.Fatalf("EndRefilter expected no timestamp, got %v", tss)
+	}
+	if vbnos := kvdata.refilteringVbuckets(); len(vbnos) != 0 {
+		t.Fatalf("refilteringVbuckets expected none, got %v", vbnos)
+	}
+}
+
+func TestRefilterStreamRollback(t *testing.T) {
+	kvdata, worker := newRefilterTestKVData()
+	feed := kvdata.feed
+
+	scatterRefilter(t, kvdata, worker, streamRequest(0, mcd.SUCCESS, 1111, 10))
+	kvdata.BeginRefilter([]uint16{0})
+	end := &mc.DcpEvent{Opcode: mcd.DCP_STREAMEND, Status: mcd.SUCCESS, VBucket: 0, Opaque: 0xab}
+	scatterRefilter(t, kvdata, worker, end)
+	kvdata.EndRefilter([]uint16{0})
+	backchMsgs(feed)
+
+	// the re-opened stream is rolled back, it is ended downstream.
+	if !scatterRefilter(t, kvdata, worker, streamRequest(0, mcd.ROLLBACK, 1111, 5)) {
+		t.Fatalf("StreamRequest of a refiltered stream must be held back")
+	}
+	msgs := backchMsgs(feed)
+	if len(msgs) != 2 {
+		t.Fatalf("expected two back-channel messages, got %v", msgs)
+	}
+	if cmd, ok := msgs[0].(*controlStreamRequest); !ok || !cmd.refilter || cmd.status != mcd.ROLLBACK {
+		t.Fatalf("expected refilter StreamRequest, got %v", msgs[0])
+	}
+	if cmd, ok := msgs[1].(*controlStreamEnd); !ok || cmd.refilter || cmd.vbno != 0 {
+		t.Fatalf("expected StreamEnd, got %v", msgs[1])
+	}
+	if len(worker.datach) != 1 {
+		t.Fatalf("expected StreamEnd to worker, got %v events", len(worker.datach))
+	} else if m := (<-worker.datach)[1].(*mc.DcpEvent); m.Opcode != mcd.DCP_STREAMEND {
+		t.Fatalf("expected StreamEnd to worker, got %v", m.Opcode)
+	}
+	if _, ok := kvdata.vbpos[0]; ok {
+		t.Fatalf("expected no position after rollback")
+	}
+	if kvdata.stats.endCount.Value() != 1 {
+		t.Fatalf("expected endCount 1, got %v", kvdata.stats.endCount.Value())
+	}
+}
+
+func TestWaitRefilterBacklog(t *testing.T) {
+	kvdata, _ := newRefilterTestKVData()
+	feed := kvdata.feed
+
+	other := &controlStreamRequest{keyspaceId: "b2", vbno: 0, uuid: 2}
+	ended := &controlStreamEnd{keyspaceId: "b1", vbno: 1, uuid: 1}
+	closed := &controlStreamEnd{keyspaceId: "b1", vbno: 0, uuid: 1, refilter: true}
+	feed.backch <- []interface{}{other}
+	feed.backch <- []interface{}{ended}
+	feed.backch <- []interface{}{closed}
+
+	feed.waitRefilter(0xab, kvdata, []uint16{0, 1}, true /*end*/)
+
+	// messages are not posted back to the back-channel, genServer is its
+	// only reader.
+	if len(feed.backch) != 0 {
+		t.Fatalf("expected empty back-channel, got %v messages", len(feed.backch))
+	}
+	if len(feed.refilterBacklog) != 2 ||
+		feed.refilterBacklog[0][0] != other || feed.refilterBacklog[1][0] != ended {
+		t.Fatalf("unexpected backlog %v", feed.refilterBacklog)
+	}
+
+	// times out on streams that do not end.
+	feed.refilterBacklog = nil
+	feed.waitRefilter(0xab, kvdata, []uint16{2}, true /*end*/)
+	if len(feed.refilterBacklog) != 0 {
+		t.Fatalf("unexpected backlog %v", feed.refilterBacklog)
+	}
+}
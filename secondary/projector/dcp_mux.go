@@ -0,0 +1,574 @@
+package projector
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/projector/memThrottler"
+	"github.com/couchbase/indexing/secondary/stats"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	couchbase "github.com/couchbase/indexing/secondary/dcp"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+var errStreamIdsExhausted = errors.New("All dcp stream ids of the shared feed are in use")
+var errSharedFeedClosed = errors.New("Shared dcp feed is closed")
+
+// dcpStreamMuxes book-keeps the shared DCP feeds of a projector, one per
+// bucket and kv node, when projector.dcp.streamId is enabled.
+type dcpStreamMuxes struct {
+	mu    sync.Mutex
+	muxes map[string]*dcpStreamMux // bucket/kvaddr -> mux
+}
+
+func newDcpStreamMuxes() *dcpStreamMuxes {
+	return &dcpStreamMuxes{muxes: make(map[string]*dcpStreamMux)}
+}
+
+// dcpStreamMux shares a single DCP feed, with stream ids enabled, between
+// the feeders of all the topics (MAINT, INIT, CATCHUP ...) on a bucket.
+// Every feeder gets its own stream id, so that its vbucket streams can have
+// their own collection filters and start seqnos, and the events of the
+// shared feed are routed back to the feeders by stream id.
+//
+// Events are routed in order by a single routine into a buffer per feeder,
+// from where they are forwarded to the feeder's channel, so that a feeder
+// that does not drain its channel (INIT) does not block the feeders of the
+// other topics (MAINT) on the mux. The buffer of a feeder is bounded by
+// projector.dcp.feederQueueBytes, a feeder that falls that much behind is
+// failed: its streams are closed and ended, and its channel closed, as if
+// it had a connection of its own that failed, so that its topic restarts
+// them. Buffered events count towards the memory budget of the feeder's
+// topic, and the feeder is throttled while its topic is over budget.
+type dcpStreamMux struct {
+	key     string
+	muxes   *dcpStreamMuxes
+	bucket  *couchbase.Bucket
+	dcpFeed *couchbase.DcpFeed
+
+	mu      sync.Mutex // protects the following fields.
+	feeders map[uint16]*dcpStreamFeeder
+	nextSid uint16
+	closed  bool // shared feed is gone, no more feeders can be added.
+
+	closeOnce sync.Once
+	logPrefix string
+}
+
+// openFeeder returns a feeder on the shared feed for `bucket` on `kvaddr`,
+// opening the feed if this is its first feeder. The mux owns the bucket it
+// was opened with, so that `bucket` is closed if the feed is already open.
+// The feeder buffers upto `queueBytes` of events, 0 for no limit.
+func (muxes *dcpStreamMuxes) openFeeder(
+	keyspaceId string, b *couchbase.Bucket, opaque uint16, kvaddr string,
+	config map[string]interface{}, chsize int,
+	queueBytes int64) (*dcpStreamFeeder, error) {
+
+	muxes.mu.Lock()
+	defer muxes.mu.Unlock()
+
+	budgetKey := ""
+	if val, ok := config["memBudgetKey"]; ok && val != nil {
+		budgetKey = val.(string)
+	}
+
+	key := b.Name + "/" + kvaddr
+	mux, ok := muxes.muxes[key]
+	if ok {
+		b.Close()
+	} else {
+		uuid, err := c.NewUUID()
+		if err != nil {
+			return nil, err
+		}
+		name := newDCPConnectionName(b.Name, "streams", uuid.Uint64())
+		config = copyDcpConfig(config)
+		config["streamId"] = true
+		// shared by feeds of all topics, their feeders are held to the
+		// budget of their topic instead.
+		delete(config, "memBudgetKey")
+
+		mux = &dcpStreamMux{
+			key:       key,
+			muxes:     muxes,
+			bucket:    b,
+			feeders:   make(map[uint16]*dcpStreamFeeder),
+			logPrefix: fmt.Sprintf("DCPMUX[%v]", key),
+		}
+		flags := uint32(0x0)
+		mux.dcpFeed, err = b.StartDcpFeedOver(
+			name, uint32(0), flags, []string{kvaddr}, opaque, config)
+		if err != nil {
+			return nil, err
+		}
+		muxes.muxes[key] = mux
+		go mux.run()
+		logging.Infof("%v ##%x opened shared feed %v", mux.logPrefix, opaque, name)
+	}
+	return mux.addFeeder(keyspaceId, budgetKey, chsize, queueBytes)
+}
+
+func (mux *dcpStreamMux) addFeeder(
+	keyspaceId, budgetKey string, chsize int,
+	queueBytes int64) (*dcpStreamFeeder, error) {
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.closed {
+		return nil, errSharedFeedClosed
+	}
+
+	// stream id 0 is reserved for streams without an id.
+	for i := 0; i < 0xFFFF; i++ {
+		mux.nextSid++
+		if mux.nextSid == 0 {
+			mux.nextSid++
+		}
+		if _, ok := mux.feeders[mux.nextSid]; ok {
+			continue
+		}
+		feeder := &dcpStreamFeeder{
+			mux:        mux,
+			sid:        mux.nextSid,
+			keyspaceId: keyspaceId,
+			budgetKey:  budgetKey,
+			queueBytes: queueBytes,
+			vbnos:      make(map[uint16]uint16),
+			ch:         make(chan *mc.DcpEvent, chsize),
+			finch:      make(chan bool),
+			qch:        make(chan bool, 1),
+		}
+		feeder.stats.Init(feeder)
+		mux.feeders[feeder.sid] = feeder
+		go feeder.forward()
+		return feeder, nil
+	}
+	return nil, errStreamIdsExhausted
+}
+
+// delFeeder closes the shared feed along with its last feeder.
+func (mux *dcpStreamMux) delFeeder(feeder *dcpStreamFeeder) {
+	mux.muxes.mu.Lock()
+	defer mux.muxes.mu.Unlock()
+
+	mux.mu.Lock()
+	delete(mux.feeders, feeder.sid)
+	last := len(mux.feeders) == 0
+	mux.mu.Unlock()
+
+	if last {
+		if mux.muxes.muxes[mux.key] == mux {
+			delete(mux.muxes.muxes, mux.key)
+		}
+		mux.close()
+	}
+}
+
+// reportsFeed tells whether `feeder` reports the stats of the shared feed,
+// the feeder with the least stream id does, so that they are reported once.
+func (mux *dcpStreamMux) reportsFeed(feeder *dcpStreamFeeder) bool {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	for sid := range mux.feeders {
+		if sid < feeder.sid {
+			return false
+		}
+	}
+	_, ok := mux.feeders[feeder.sid]
+	return ok
+}
+
+// close closes the shared feed and the bucket it was opened with.
+func (mux *dcpStreamMux) close() {
+	mux.closeOnce.Do(func() {
+		mux.dcpFeed.Close()
+		mux.bucket.Close()
+		logging.Infof("%v closed shared feed", mux.logPrefix)
+	})
+}
+
+// run routes the events of the shared feed to feeders by stream id.
+func (mux *dcpStreamMux) run() {
+	for event := range mux.dcpFeed.C {
+		mux.mu.Lock()
+		feeder, ok := mux.feeders[event.StreamID]
+		mux.mu.Unlock()
+		if !ok {
+			fmsg := "%v dropping %v for vb %v of closed stream %v"
+			logging.Debugf(fmsg, mux.logPrefix, event.Opcode, event.VBucket, event.StreamID)
+			continue
+		}
+		feeder.send(event)
+	}
+
+	// the shared feed is gone, remove it so that feeders opened from now
+	// on start a fresh one, and end the channels of all its feeders.
+	mux.muxes.mu.Lock()
+	if mux.muxes.muxes[mux.key] == mux {
+		delete(mux.muxes.muxes, mux.key)
+	}
+	mux.mu.Lock()
+	mux.closed = true
+	feeders := make([]*dcpStreamFeeder, 0, len(mux.feeders))
+	for _, feeder := range mux.feeders {
+		feeders = append(feeders, feeder)
+	}
+	mux.mu.Unlock()
+	mux.muxes.mu.Unlock()
+
+	for _, feeder := range feeders {
+		feeder.endQueue()
+	}
+	if len(feeders) == 0 {
+		mux.close()
+	}
+	logging.Infof("%v routing stopped", mux.logPrefix)
+}
+
+// dcpStreamFeeder implements BucketFeeder over a stream id of a shared feed.
+type dcpStreamFeeder struct {
+	mux        *dcpStreamMux
+	sid        uint16
+	keyspaceId string
+	budgetKey  string // projector feed whose memory budget applies
+	queueBytes int64  // limit on queued events, 0 for no limit
+	stats      dcpFeederStats
+
+	vbmu  sync.Mutex        // protects vbnos.
+	vbnos map[uint16]uint16 // vbno -> opaque, of open streams
+
+	ch        chan *mc.DcpEvent
+	finch     chan bool
+	closeOnce sync.Once
+
+	// events routed to the feeder, yet to be forwarded to ch.
+	qmu    sync.Mutex // protects the following fields.
+	queue  []*mc.DcpEvent
+	eof    bool      // shared feed is gone, close ch once queue is drained.
+	failed bool      // queue overflowed, events are dropped.
+	qch    chan bool // signals forward() that queue or eof has changed.
+}
+
+// send queues an event for the feeder without blocking the router, and
+// fails the feeder if its queue overflows.
+func (feeder *dcpStreamFeeder) send(event *mc.DcpEvent) {
+	size := dcpEventSize(event)
+
+	feeder.qmu.Lock()
+	if feeder.failed {
+		feeder.qmu.Unlock()
+		feeder.stats.droppedCount.Add(1)
+		return
+	}
+	// an event larger than the limit is let into an empty queue.
+	queued := feeder.stats.queuedBytes.Value()
+	if feeder.queueBytes > 0 && queued > 0 && queued+size > feeder.queueBytes {
+		feeder.qmu.Unlock()
+		feeder.fail(event)
+		return
+	}
+
+	switch event.Opcode {
+	case mcd.DCP_STREAMEND:
+		feeder.delVbno(event.VBucket)
+	case mcd.DCP_STREAMREQ:
+		if event.Status != mcd.SUCCESS {
+			feeder.delVbno(event.VBucket)
+		}
+	}
+	feeder.queue = append(feeder.queue, event)
+	feeder.stats.queuedBytes.Add(size)
+	feeder.qmu.Unlock()
+
+	feeder.stats.eventCount.Add(1)
+	feeder.signal()
+}
+
+// fail the feeder, from the router, as its queue is full with `event`.
+// Queued events are dropped in favour of stream ends for its open streams,
+// after which its channel is closed, and its streams on the shared feed are
+// closed.
+func (feeder *dcpStreamFeeder) fail(event *mc.DcpEvent) {
+	feeder.vbmu.Lock()
+	vbnos := feeder.vbnos
+	feeder.vbnos = make(map[uint16]uint16)
+	feeder.vbmu.Unlock()
+
+	now := time.Now().UnixNano()
+	ends := make([]*mc.DcpEvent, 0, len(vbnos))
+	for vbno, opaque := range vbnos {
+		ends = append(ends, &mc.DcpEvent{
+			VBucket:  vbno,
+			StreamID: feeder.sid,
+			Opcode:   mcd.DCP_STREAMEND,
+			Opaque:   opaque,
+			Ctime:    now,
+		})
+	}
+
+	feeder.qmu.Lock()
+	dropped := len(feeder.queue) + 1
+	for _, qevent := range feeder.queue {
+		feeder.stats.queuedBytes.Add(-dcpEventSize(qevent))
+	}
+	feeder.queue, feeder.eof, feeder.failed = ends, true, true
+	feeder.qmu.Unlock()
+	feeder.stats.droppedCount.Add(uint64(dropped))
+	feeder.stats.failed.Set(true)
+	feeder.signal()
+
+	fmsg := "%v feeder %v of %q failed, dropped %v events queued over %v " +
+		"bytes, ending %v streams"
+	logging.Errorf(fmsg, feeder.mux.logPrefix, feeder.sid, feeder.budgetKey,
+		dropped, feeder.queueBytes, len(vbnos))
+
+	// the router cannot wait on the shared feed, that it has to drain.
+	go func() {
+		for vbno, opaque := range vbnos {
+			feeder.mux.dcpFeed.DcpCloseStreamWithID(vbno, opaque, feeder.sid)
+		}
+	}()
+}
+
+func isDcpMutation(event *mc.DcpEvent) bool {
+	switch event.Opcode {
+	case mcd.DCP_MUTATION, mcd.DCP_DELETION, mcd.DCP_EXPIRATION:
+		return true
+	}
+	return false
+}
+
+// dcpEventSize is the memory held by an event, for queue limits and
+// memory budgets.
+func dcpEventSize(event *mc.DcpEvent) int64 {
+	return int64(len(event.Key) + len(event.Value) + len(event.OldValue))
+}
+
+// endQueue closes the feeder's channel once the queued events are forwarded.
+func (feeder *dcpStreamFeeder) endQueue() {
+	feeder.qmu.Lock()
+	feeder.eof = true
+	feeder.qmu.Unlock()
+	feeder.signal()
+}
+
+func (feeder *dcpStreamFeeder) signal() {
+	select {
+	case feeder.qch <- true:
+	default:
+	}
+}
+
+// forward forwards queued events, in order, to the feeder's channel until
+// the shared feed is gone or the feeder is closed, then closes the channel.
+func (feeder *dcpStreamFeeder) forward() {
+	defer close(feeder.ch)
+
+	// mutations of maintenance topics count as maintenance streaming for
+	// projector.backfill.maintPriority, as on connections of their own.
+	maint := feeder.budgetKey != "" && !memThrottler.IsBackfillTopic(feeder.budgetKey)
+	var maintNoted time.Time
+
+	for {
+		select {
+		case <-feeder.qch:
+		case <-feeder.finch:
+			return
+		}
+
+		feeder.qmu.Lock()
+		events, eof := feeder.queue, feeder.eof
+		feeder.queue = nil
+		feeder.qmu.Unlock()
+
+		for _, event := range events {
+			memThrottler.DoThrottleBudget(feeder.budgetKey)
+			select {
+			case feeder.ch <- event:
+				feeder.stats.queuedBytes.Add(-dcpEventSize(event))
+			case <-feeder.finch:
+				return
+			}
+			if maint && isDcpMutation(event) {
+				now := time.Now()
+				if now.Sub(maintNoted) >= memThrottler.MaintNoteInterval {
+					memThrottler.NoteMaintMutation(now)
+					maintNoted = now
+				}
+			}
+		}
+		if eof {
+			return
+		}
+	}
+}
+
+func (feeder *dcpStreamFeeder) delVbno(vbno uint16) {
+	feeder.vbmu.Lock()
+	delete(feeder.vbnos, vbno)
+	feeder.vbmu.Unlock()
+}
+
+// GetChannel implements Feeder{} interface.
+func (feeder *dcpStreamFeeder) GetChannel() (mutch <-chan *mc.DcpEvent) {
+	return feeder.ch
+}
+
+// StartVbStreams implements Feeder{} interface.
+func (feeder *dcpStreamFeeder) StartVbStreams(
+	opaque uint16, reqTs *protobuf.TsVbuuid) error {
+
+	bucket, dcpFeed := feeder.mux.bucket, feeder.mux.dcpFeed
+	if err := bucket.Refresh(); err != nil {
+		logging.Errorf("Error during bucket.Refresh() while starting vbstreams for bucket: %v, err: %v", bucket.Name, err)
+		return err
+	}
+	scopeId := reqTs.GetScopeID()
+	collectionIds := reqTs.GetCollectionIDs()
+	manifestUIDs := reqTs.GetManifestUIDs()
+
+	vbnos := c.Vbno32to16(reqTs.GetVbnos())
+	vbuuids, seqnos := reqTs.GetVbuuids(), reqTs.GetSeqnos()
+	snapshots := reqTs.GetSnapshots()
+	for i, vbno := range vbnos {
+		flags, vbuuid := uint32(0), vbuuids[i]
+		start, end := seqnos[i], uint64(0xFFFFFFFFFFFFFFFF)
+		snapStart, snapEnd := snapshots[i].GetStart(), snapshots[i].GetEnd()
+
+		mid := ""
+		if len(manifestUIDs) > 0 {
+			mid = manifestUIDs[i]
+		}
+
+		feeder.vbmu.Lock()
+		feeder.vbnos[vbno] = opaque
+		feeder.vbmu.Unlock()
+
+		err := dcpFeed.DcpRequestStreamWithID(
+			vbno, opaque, feeder.sid, flags, vbuuid, start, end,
+			snapStart, snapEnd, mid, scopeId, collectionIds)
+		if err != nil {
+			feeder.delVbno(vbno)
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// EndVbStreams implements Feeder{} interface.
+func (feeder *dcpStreamFeeder) EndVbStreams(
+	opaque uint16, ts *protobuf.TsVbuuid) (err error, cleanup bool) {
+
+	bucket, dcpFeed := feeder.mux.bucket, feeder.mux.dcpFeed
+	if err := bucket.Refresh(); err != nil {
+		logging.Errorf("Error during bucket.Refresh() while stopping vbstreams for bucket: %v, err: %v", bucket.Name, err)
+		return err, true
+	}
+	vbnos := c.Vbno32to16(ts.GetVbnos())
+	for _, vbno := range vbnos {
+		if e := dcpFeed.DcpCloseStreamWithID(vbno, opaque, feeder.sid); e != nil {
+			err = e
+		}
+	}
+	return err, false
+}
+
+// CloseFeed implements Feeder{} interface. Streams still open for the
+// feeder are closed, the shared feed is closed with its last feeder.
+func (feeder *dcpStreamFeeder) CloseFeed() error {
+	feeder.closeOnce.Do(func() {
+		close(feeder.finch) // stop forwarding, which closes the channel
+		feeder.stats.closed.Set(true)
+
+		feeder.vbmu.Lock()
+		vbnos := make(map[uint16]uint16, len(feeder.vbnos))
+		for vbno, opaque := range feeder.vbnos {
+			vbnos[vbno] = opaque
+		}
+		feeder.vbmu.Unlock()
+
+		for vbno, opaque := range vbnos {
+			feeder.mux.dcpFeed.DcpCloseStreamWithID(vbno, opaque, feeder.sid)
+		}
+
+		feeder.mux.delFeeder(feeder)
+	})
+	return nil
+}
+
+// GetStats() implements Feeder{} interface. Along with the stats of the
+// feeder, one of the feeders reports the stats of the shared feed.
+func (feeder *dcpStreamFeeder) GetStats() map[string]interface{} {
+	dcpStats := make(map[string]interface{})
+	if feeder.mux.reportsFeed(feeder) {
+		for key, value := range feeder.mux.dcpFeed.GetStats() {
+			dcpStats[key] = value
+		}
+	}
+	key := fmt.Sprintf("%v/%v", feeder.mux.logPrefix, feeder.sid)
+	dcpStats[key] = &feeder.stats
+	return dcpStats
+}
+
+// dcpFeederStats of a feeder on a shared feed.
+type dcpFeederStats struct {
+	closed       stats.BoolVal
+	failed       stats.BoolVal   // queue overflowed
+	eventCount   stats.Uint64Val // events routed to the feeder
+	droppedCount stats.Uint64Val // events dropped by a failed feeder
+	queuedBytes  stats.Int64Val  // events yet to be forwarded
+	feeder       *dcpStreamFeeder
+}
+
+func (fstats *dcpFeederStats) Init(feeder *dcpStreamFeeder) {
+	fstats.closed.Init()
+	fstats.failed.Init()
+	fstats.eventCount.Init()
+	fstats.droppedCount.Init()
+	fstats.queuedBytes.Init()
+	fstats.feeder = feeder
+}
+
+func (fstats *dcpFeederStats) IsClosed() bool {
+	return fstats.closed.Value()
+}
+
+// BudgetKey return the projector feed whose memory budget applies to the
+// feeder.
+func (fstats *dcpFeederStats) BudgetKey() string {
+	return fstats.feeder.budgetKey
+}
+
+func (fstats *dcpFeederStats) String() string {
+	fstats.feeder.qmu.Lock()
+	queueLen := len(fstats.feeder.queue)
+	fstats.feeder.qmu.Unlock()
+
+	var stitems [6]string
+	stitems[0] = `"keyspaceId":"` + fstats.feeder.keyspaceId + `"`
+	stitems[1] = `"events":` + strconv.FormatUint(fstats.eventCount.Value(), 10)
+	stitems[2] = `"dropped":` + strconv.FormatUint(fstats.droppedCount.Value(), 10)
+	stitems[3] = `"queueLen":` + strconv.Itoa(queueLen)
+	stitems[4] = `"queuedBytes":` + strconv.FormatInt(fstats.queuedBytes.Value(), 10)
+	stitems[5] = `"failed":` + strconv.FormatBool(fstats.failed.Value())
+	return `{` + strings.Join(stitems[:], ",") + `}`
+}
+
+func copyDcpConfig(config map[string]interface{}) map[string]interface{} {
+	nconfig := make(map[string]interface{}, len(config)+1)
+	for k, v := range config {
+		nconfig[k] = v
+	}
+	return nconfig
+}
@@ -0,0 +1,418 @@
+package projector
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/couchbase/indexing/secondary/logging"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+// A recording of the upstream DCP traffic of a KVData is a directory of
+// files named dcp-<n>.rec, in the order they were written. Each file is a
+// gob stream of DcpRecords that starts with the header of the recording,
+// so that files can be replayed after older ones are rotated out. Events of
+// all vbuckets are recorded in the order KVData received them, and a new
+// header is recorded whenever the indexes or request timestamps of the
+// KVData change.
+//
+// Recorded events hold the raw key, value and xattrs of documents, as
+// received from KV, in plaintext. Recordings are created readable by the
+// projector's user alone.
+
+const dcpRecordFilePrefix = "dcp-"
+const dcpRecordFileSuffix = ".rec"
+
+// DcpRecord is either a header or an event of a recording.
+type DcpRecord struct {
+	Header *DcpRecordHeader
+	Event  *DcpRecordEvent
+}
+
+// DcpRecordHeader holds the request parameters of the recorded feed.
+type DcpRecordHeader struct {
+	Topic            string
+	Bucket           string
+	KeyspaceId       string
+	CollectionId     string
+	Version          int32
+	Opaque2          uint64
+	Async            bool
+	CollectionsAware bool
+	OsoSnapshot      bool
+	ReqTs            []byte            // protobuf encoded TsVbuuid
+	Instances        map[uint64][]byte // uuid -> protobuf encoded IndexInst
+}
+
+// DcpRecordEvent is a recorded mc.DcpEvent.
+type DcpRecordEvent struct {
+	Opcode       mcd.CommandCode
+	Status       mcd.Status
+	Datatype     uint8
+	VBucket      uint16
+	Opaque       uint16
+	StreamID     uint16
+	VBuuid       uint64
+	Key, Value   []byte
+	Cas          uint64
+	Seqno        uint64
+	RevSeqno     uint64
+	Flags        uint32
+	Expiry       uint32
+	LockTime     uint32
+	Nru          byte
+	SnapstartSeq uint64
+	SnapendSeq   uint64
+	SnapshotType uint32
+	ManifestUID  []byte
+	ScopeID      []byte
+	CollectionID uint32
+	EventType    mcd.CollectionEvent
+	MaxTTL       uint32
+	FailoverLog  mc.FailoverLog
+	Error        string
+	Ctime        int64
+	RawXATTR     map[string][]byte
+}
+
+func newDcpRecordEvent(m *mc.DcpEvent) *DcpRecordEvent {
+	ev := &DcpRecordEvent{
+		Opcode:       m.Opcode,
+		Status:       m.Status,
+		Datatype:     m.Datatype,
+		VBucket:      m.VBucket,
+		Opaque:       m.Opaque,
+		StreamID:     m.StreamID,
+		VBuuid:       m.VBuuid,
+		Key:          m.Key,
+		Value:        m.Value,
+		Cas:          m.Cas,
+		Seqno:        m.Seqno,
+		RevSeqno:     m.RevSeqno,
+		Flags:        m.Flags,
+		Expiry:       m.Expiry,
+		LockTime:     m.LockTime,
+		Nru:          m.Nru,
+		SnapstartSeq: m.SnapstartSeq,
+		SnapendSeq:   m.SnapendSeq,
+		SnapshotType: m.SnapshotType,
+		ManifestUID:  m.ManifestUID,
+		ScopeID:      m.ScopeID,
+		CollectionID: m.CollectionID,
+		EventType:    m.EventType,
+		MaxTTL:       m.MaxTTL,
+		Ctime:        m.Ctime,
+		RawXATTR:     m.RawXATTR,
+	}
+	if m.FailoverLog != nil {
+		ev.FailoverLog = *m.FailoverLog
+	}
+	if m.Error != nil {
+		ev.Error = m.Error.Error()
+	}
+	return ev
+}
+
+// DcpEvent returns the recorded event.
+func (ev *DcpRecordEvent) DcpEvent() *mc.DcpEvent {
+	m := &mc.DcpEvent{
+		Opcode:       ev.Opcode,
+		Status:       ev.Status,
+		Datatype:     ev.Datatype,
+		VBucket:      ev.VBucket,
+		Opaque:       ev.Opaque,
+		StreamID:     ev.StreamID,
+		VBuuid:       ev.VBuuid,
+		Key:          ev.Key,
+		Value:        ev.Value,
+		Cas:          ev.Cas,
+		Seqno:        ev.Seqno,
+		RevSeqno:     ev.RevSeqno,
+		Flags:        ev.Flags,
+		Expiry:       ev.Expiry,
+		LockTime:     ev.LockTime,
+		Nru:          ev.Nru,
+		SnapstartSeq: ev.SnapstartSeq,
+		SnapendSeq:   ev.SnapendSeq,
+		SnapshotType: ev.SnapshotType,
+		ManifestUID:  ev.ManifestUID,
+		ScopeID:      ev.ScopeID,
+		CollectionID: ev.CollectionID,
+		EventType:    ev.EventType,
+		MaxTTL:       ev.MaxTTL,
+		Ctime:        ev.Ctime,
+		RawXATTR:     ev.RawXATTR,
+	}
+	if ev.FailoverLog != nil {
+		flog := ev.FailoverLog
+		m.FailoverLog = &flog
+	}
+	if ev.Error != "" {
+		m.Error = fmt.Errorf("%v", ev.Error)
+	}
+	return m
+}
+
+// GetReqTs returns the request timestamp of the recorded feed.
+func (h *DcpRecordHeader) GetReqTs() (*protobuf.TsVbuuid, error) {
+	ts := &protobuf.TsVbuuid{}
+	if err := proto.Unmarshal(h.ReqTs, ts); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// GetInstances returns the index instances of the recorded feed.
+func (h *DcpRecordHeader) GetInstances() (map[uint64]*protobuf.IndexInst, error) {
+	instances := make(map[uint64]*protobuf.IndexInst, len(h.Instances))
+	for uuid, data := range h.Instances {
+		instance := &protobuf.IndexInst{}
+		if err := proto.Unmarshal(data, instance); err != nil {
+			return nil, err
+		}
+		instances[uuid] = instance
+	}
+	return instances, nil
+}
+
+// dcpRecorder writes a recording into rotating files.
+type dcpRecorder struct {
+	mu          sync.Mutex
+	dir         string
+	maxFileSize int64
+	maxFiles    int
+	header      *DcpRecordHeader
+	fileno      int
+	files       []string
+	file        *os.File
+	w           *countWriter
+	enc         *gob.Encoder
+	closed      bool
+	logPrefix   string
+}
+
+type countWriter struct {
+	w *bufio.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// newDcpRecorder returns a recorder for the feed of `header` if recording
+// is enabled for its keyspace by config, otherwise nil. Recording starts
+// with the first setHeader.
+func newDcpRecorder(
+	config c.Config, header *DcpRecordHeader, uuid uint64,
+	logPrefix string) (*dcpRecorder, error) {
+
+	dir := config["dcp.record.dir"].String()
+	if dir == "" {
+		return nil, nil
+	}
+	if keyspaces := config["dcp.record.keyspaces"].String(); keyspaces != "" {
+		found := false
+		for _, keyspace := range strings.Split(keyspaces, ",") {
+			found = found || strings.TrimSpace(keyspace) == header.KeyspaceId
+		}
+		if !found {
+			return nil, nil
+		}
+	}
+
+	name := fmt.Sprintf("%v_%v_%v", header.Topic, header.KeyspaceId, uuid)
+	r := &dcpRecorder{
+		dir:         filepath.Join(dir, name),
+		header:      header,
+		maxFileSize: int64(config["dcp.record.maxFileSize"].Int()),
+		maxFiles:    config["dcp.record.maxFiles"].Int(),
+		logPrefix:   logPrefix,
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return nil, err
+	}
+	logging.Infof("%v recording dcp events in %v", r.logPrefix, r.dir)
+	return r, nil
+}
+
+// setHeader records a new header with the request timestamp and indexes
+// of the feed. The file is rotated if it is the first header or the file
+// is full.
+func (r *dcpRecorder) setHeader(reqTs []byte, instances map[uint64][]byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	header := *r.header
+	header.ReqTs, header.Instances = reqTs, instances
+	r.header = &header
+	if r.file == nil || r.w.n >= r.maxFileSize {
+		r.rotate()
+	} else {
+		r.write(&DcpRecord{Header: r.header})
+	}
+}
+
+// record an event, synchronously, before it is handed to the workers.
+func (r *dcpRecorder) record(m *mc.DcpEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+	if r.w.n >= r.maxFileSize {
+		r.rotate()
+	}
+	r.write(&DcpRecord{Event: newDcpRecordEvent(m)})
+}
+
+func (r *dcpRecorder) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closeFile()
+	r.closed = true
+}
+
+func (r *dcpRecorder) rotate() {
+	if r.closed {
+		return
+	}
+	r.closeFile()
+
+	r.fileno++
+	name := fmt.Sprintf("%v%06d%v", dcpRecordFilePrefix, r.fileno, dcpRecordFileSuffix)
+	path := filepath.Join(r.dir, name)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		logging.Errorf("%v stopped recording, %v", r.logPrefix, err)
+		r.closed = true
+		return
+	}
+	r.file, r.files = file, append(r.files, path)
+	r.w = &countWriter{w: bufio.NewWriter(file)}
+	r.enc = gob.NewEncoder(r.w)
+
+	for r.maxFiles > 0 && len(r.files) > r.maxFiles {
+		if err := os.Remove(r.files[0]); err != nil {
+			logging.Warnf("%v removing %v: %v", r.logPrefix, r.files[0], err)
+		}
+		r.files = r.files[1:]
+	}
+	r.write(&DcpRecord{Header: r.header})
+}
+
+func (r *dcpRecorder) write(record *DcpRecord) {
+	if err := r.enc.Encode(record); err != nil {
+		logging.Errorf("%v stopped recording, %v", r.logPrefix, err)
+		r.closeFile()
+		r.closed = true
+	}
+}
+
+func (r *dcpRecorder) closeFile() {
+	if r.file == nil {
+		return
+	}
+	if err := r.w.w.Flush(); err != nil {
+		logging.Errorf("%v flushing %v: %v", r.logPrefix, r.file.Name(), err)
+	}
+	r.file.Close()
+	r.file, r.w, r.enc = nil, nil, nil
+}
+
+// recordHeader records the current request timestamp and indexes of
+// kvdata, if it is recording.
+func (kvdata *KVData) recordHeader() {
+	if kvdata.recorder == nil {
+		return
+	}
+
+	kvdata.reqTsMutex.RLock()
+	reqTs, err := proto.Marshal(kvdata.reqTs)
+	kvdata.reqTsMutex.RUnlock()
+
+	instances := make(map[uint64][]byte)
+	for uuid, engine := range kvdata.engines {
+		if err != nil {
+			break
+		}
+		if instance, ok := engine.router.(*protobuf.IndexInst); ok {
+			instances[uuid], err = proto.Marshal(instance)
+		}
+	}
+	if err != nil {
+		fmsg := "%v ##%x recording header: %v"
+		logging.Errorf(fmsg, kvdata.logPrefix, kvdata.opaque, err)
+		return
+	}
+	kvdata.recorder.setHeader(reqTs, instances)
+}
+
+// DcpRecordFiles returns the files of a recording in `path`, which can also
+// be a single file of a recording.
+func DcpRecordFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return []string{path}, nil
+	}
+	files, err := filepath.Glob(
+		filepath.Join(path, dcpRecordFilePrefix+"*"+dcpRecordFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadDcpRecords calls `fn` for every record in `files`, in order.
+func ReadDcpRecords(files []string, fn func(*DcpRecord) error) error {
+	for _, path := range files {
+		err := func() error {
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			dec := gob.NewDecoder(bufio.NewReader(file))
+			for {
+				record := &DcpRecord{}
+				if err := dec.Decode(record); err == io.EOF {
+					return nil
+				} else if err == io.ErrUnexpectedEOF {
+					// the last file of a recording that did not close.
+					logging.Warnf("ReadDcpRecords: %v is truncated", path)
+					return nil
+				} else if err != nil {
+					return fmt.Errorf("%v: %v", path, err)
+				}
+				if err := fn(record); err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package projector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+)
+
+func TestDcpRecordEventRoundTrip(t *testing.T) {
+	flog := mc.FailoverLog{{1111, 10}, {2222, 0}}
+	events := []*mc.DcpEvent{
+		{
+			Opcode: mcd.DCP_STREAMREQ, Status: mcd.SUCCESS, VBucket: 3,
+			Opaque: 0xab, StreamID: 2, VBuuid: 1111, Seqno: 10,
+			FailoverLog: &flog, Ctime: 42,
+		},
+		{
+			Opcode: mcd.DCP_MUTATION, Datatype: 0x05, VBucket: 3, Opaque: 0xab,
+			Key: []byte("doc1"), Value: []byte(`{"a":1}`), Cas: 7, Seqno: 11,
+			RevSeqno: 2, Flags: 3, Expiry: 4, LockTime: 5, Nru: 1,
+			CollectionID: 8, RawXATTR: map[string][]byte{"_sync": []byte(`{}`)},
+		},
+		{
+			Opcode: mcd.DCP_SNAPSHOT, VBucket: 3, SnapstartSeq: 12,
+			SnapendSeq: 20, SnapshotType: 1,
+		},
+		{
+			Opcode: mcd.DCP_SYSTEM_EVENT, VBucket: 3, Seqno: 13,
+			ManifestUID: []byte("a"), ScopeID: []byte("8"), CollectionID: 9,
+			EventType: mcd.COLLECTION_CREATE, MaxTTL: 60,
+		},
+		{
+			Opcode: mcd.DCP_STREAMEND, Status: mcd.ROLLBACK, VBucket: 3,
+			Error: fmt.Errorf("stream error"),
+		},
+	}
+
+	for _, m := range events {
+		got := newDcpRecordEvent(m).DcpEvent()
+		if m.Error != nil {
+			if got.Error == nil || got.Error.Error() != m.Error.Error() {
+				t.Fatalf("%v: expected error %v, got %v", m.Opcode, m.Error, got.Error)
+			}
+			got.Error = m.Error
+		}
+		if !reflect.DeepEqual(m, got) {
+			t.Fatalf("%v: round trip mismatch\nexpected %v\ngot      %v", m.Opcode, m, got)
+		}
+	}
+}
+
+func TestDcpRecorderRotation(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dcp_record_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &dcpRecorder{
+		dir:         dir,
+		header:      &DcpRecordHeader{Topic: "t1", Bucket: "b1", KeyspaceId: "b1"},
+		maxFileSize: 512,
+		maxFiles:    2,
+		logPrefix:   "test",
+	}
+	// events before the first header are not recorded.
+	r.record(&mc.DcpEvent{Opcode: mcd.DCP_MUTATION, Seqno: 0})
+	r.setHeader([]byte("ts1"), map[uint64][]byte{1: []byte("inst1")})
+
+	const n = 100
+	value := make([]byte, 64)
+	for i := 1; i <= n; i++ {
+		r.record(&mc.DcpEvent{
+			Opcode: mcd.DCP_MUTATION, VBucket: 1, Key: []byte(fmt.Sprintf("doc%v", i)),
+			Value: value, Seqno: uint64(i),
+		})
+		if i == n/2 {
+			r.setHeader([]byte("ts2"), map[uint64][]byte{1: []byte("inst1"), 2: []byte("inst2")})
+		}
+	}
+	r.close()
+	// recording is stopped once closed.
+	r.record(&mc.DcpEvent{Opcode: mcd.DCP_MUTATION, Seqno: n + 1})
+
+	files, err := DcpRecordFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(files) != 2 {
+		t.Fatalf("expected 2 files after rotation, got %v", files)
+	}
+	if r.fileno <= 2 {
+		t.Fatalf("expected recording to rotate more than twice, got %v files", r.fileno)
+	}
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		} else if fi.Mode().Perm() != 0600 {
+			t.Fatalf("%v: expected mode 0600, got %v", filepath.Base(file), fi.Mode().Perm())
+		}
+	}
+
+	// every file starts with a header, and events follow each other.
+	lastSeqno := uint64(0)
+	for _, file := range files {
+		first := true
+		err := ReadDcpRecords([]string{file}, func(record *DcpRecord) error {
+			if first && record.Header == nil {
+				return fmt.Errorf("%v does not start with a header", file)
+			}
+			first = false
+			if record.Event == nil {
+				return nil
+			}
+			m := record.Event.DcpEvent()
+			if lastSeqno != 0 && m.Seqno != lastSeqno+1 {
+				return fmt.Errorf("%v: expected seqno %v, got %v", file, lastSeqno+1, m.Seqno)
+			}
+			if string(m.Key) != fmt.Sprintf("doc%v", m.Seqno) {
+				return fmt.Errorf("%v: unexpected key %s for seqno %v", file, m.Key, m.Seqno)
+			}
+			lastSeqno = m.Seqno
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lastSeqno != n {
+		t.Fatalf("expected last seqno %v, got %v", n, lastSeqno)
+	}
+
+	// the last header has the latest indexes.
+	var header *DcpRecordHeader
+	ReadDcpRecords(files, func(record *DcpRecord) error {
+		if record.Header != nil {
+			header = record.Header
+		}
+		return nil
+	})
+	if header == nil || string(header.ReqTs) != "ts2" || len(header.Instances) != 2 {
+		t.Fatalf("unexpected last header %+v", header)
+	}
+}
+
+func TestReadDcpRecordsTruncated(t *testing.T) {
+	dir, err := os.MkdirTemp("", "dcp_record_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := &dcpRecorder{
+		dir:         dir,
+		header:      &DcpRecordHeader{Topic: "t1", Bucket: "b1", KeyspaceId: "b1"},
+		maxFileSize: 1 << 20,
+		logPrefix:   "test",
+	}
+	r.setHeader(nil, nil)
+	for i := 1; i <= 10; i++ {
+		r.record(&mc.DcpEvent{Opcode: mcd.DCP_MUTATION, Seqno: uint64(i)})
+	}
+	r.close()
+
+	files, err := DcpRecordFiles(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one file, got %v, %v", files, err)
+	}
+	fi, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a recording that did not close is read up to its last full record.
+	if err := os.Truncate(files[0], fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	events := 0
+	err = ReadDcpRecords(files, func(record *DcpRecord) error {
+		if record.Event != nil {
+			events++
+		}
+		return nil
+	})
+	if err != nil || events != 9 {
+		t.Fatalf("expected 9 events from truncated file, got %v, %v", events, err)
+	}
+}
@@ -0,0 +1,234 @@
+package projector
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/logging"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+// DcpReplayStats of a ReplayDcpRecording.
+type DcpReplayStats struct {
+	Headers   uint64
+	Events    uint64
+	Mutations uint64
+	Skipped   uint64 // events of vbuckets that are not replayed
+	Duration  time.Duration
+}
+
+// ReplayDcpRecording feeds a recording, made with projector.dcp.record.dir,
+// through a VbucketWorker with the index evaluators of the recording and
+// routes their key versions to `endpoint`, in place of every endpoint of
+// the recorded feed. Events are posted to the worker in the order they
+// were recorded, and all of them are evaluated before the indexes of the
+// worker change, so that replays of a recording are deterministic.
+//
+// `path` is the directory of the recording or one of its files, `vbnos`
+// if not empty restricts the replay to those vbuckets and `config` is the
+// projector config with its "projector." prefix trimmed.
+func ReplayDcpRecording(
+	path string, config c.Config, endpoint c.RouterEndpoint,
+	vbnos []uint16) (*DcpReplayStats, error) {
+
+	files, err := DcpRecordFiles(path)
+	if err != nil {
+		return nil, err
+	} else if len(files) == 0 {
+		return nil, fmt.Errorf("no dcp recording in %v", path)
+	}
+
+	r := &dcpReplay{
+		config:   config,
+		endpoint: endpoint,
+		engines:  make(map[uint64]*Engine),
+		started:  make(map[uint16]bool),
+	}
+	if len(vbnos) > 0 {
+		r.vbnos = make(map[uint16]bool)
+		for _, vbno := range vbnos {
+			r.vbnos[vbno] = true
+		}
+	}
+
+	start := time.Now()
+	err = ReadDcpRecords(files, func(record *DcpRecord) error {
+		if record.Header != nil {
+			return r.applyHeader(record.Header)
+		} else if record.Event != nil {
+			return r.replayEvent(record.Event.DcpEvent())
+		}
+		return nil
+	})
+	if r.worker != nil {
+		if err1 := r.drain(); err == nil {
+			err = err1
+		}
+		r.worker.Close() // publishes StreamEnd for vbuckets still active
+	}
+	r.stats.Duration = time.Since(start)
+	return &r.stats, err
+}
+
+type dcpReplay struct {
+	config   c.Config
+	endpoint c.RouterEndpoint
+	vbnos    map[uint16]bool // vbuckets to replay, nil for all
+	header   *DcpRecordHeader
+	reqTs    *protobuf.TsVbuuid
+	worker   *VbucketWorker
+	engines  map[uint64]*Engine
+	started  map[uint16]bool // vbuckets with an active stream
+	posted   uint64          // events posted to the worker
+	stats    DcpReplayStats
+}
+
+func (r *dcpReplay) applyHeader(header *DcpRecordHeader) error {
+	reqTs, err := header.GetReqTs()
+	if err != nil {
+		return err
+	}
+	instances, err := header.GetInstances()
+	if err != nil {
+		return err
+	}
+	r.header, r.reqTs = header, reqTs
+	r.stats.Headers++
+
+	if r.worker == nil {
+		feed := &Feed{
+			cluster:     "replay",
+			topic:       header.Topic,
+			osoSnapshot: map[string]bool{header.KeyspaceId: header.OsoSnapshot},
+		}
+		r.worker = NewVbucketWorker(
+			0, feed, header.Bucket, header.KeyspaceId, 0 /*opaque*/, r.config,
+			header.Opaque2, header.CollectionsAware)
+	}
+
+	// evaluators of indexes already replayed are kept, with their stats.
+	engines := make(map[uint64]*Engine, len(instances))
+	endpoints := make(map[string]c.RouterEndpoint)
+	version := protobuf.FeedVersion(header.Version)
+	for uuid, instance := range instances {
+		engine, ok := r.engines[uuid]
+		if !ok {
+			ie, err := protobuf.NewIndexEvaluator(instance, version, header.KeyspaceId)
+			if err != nil {
+				return err
+			}
+			engine = NewEngine(uuid, ie, instance)
+		}
+		engines[uuid] = engine
+		for _, raddr := range instance.Endpoints() {
+			endpoints[raddr] = r.endpoint
+		}
+	}
+	r.engines = engines
+	// events of the previous header are evaluated with its indexes.
+	if err := r.drain(); err != nil {
+		return err
+	}
+	_, err = r.worker.AddEngines(0 /*opaque*/, engines, endpoints)
+	return err
+}
+
+// post an event to the worker, the way KVData does.
+func (r *dcpReplay) post(m *mc.DcpEvent) error {
+	if err := r.worker.Event(m); err != nil {
+		return err
+	}
+	r.posted++
+	return nil
+}
+
+// drain waits for the worker to take every event posted to it. An event
+// taken by the worker is evaluated before it handles a Close.
+func (r *dcpReplay) drain() error {
+	for r.worker.stats.outgoingMut.Value() < r.posted {
+		select {
+		case <-r.worker.runDoneCh:
+			return fmt.Errorf("dcp replay worker stopped")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// replayEvent hands an event to the worker the way KVData does.
+func (r *dcpReplay) replayEvent(m *mc.DcpEvent) error {
+	if r.worker == nil {
+		return fmt.Errorf("dcp recording without a header")
+	}
+	vbno := m.VBucket
+	if r.vbnos != nil && !r.vbnos[vbno] {
+		r.stats.Skipped++
+		return nil
+	}
+
+	switch m.Opcode {
+	case mcd.DCP_STREAMREQ:
+		if m.Status == mcd.SUCCESS {
+			var err error
+			if m.VBuuid, _, err = m.FailoverLog.Latest(); err != nil {
+				return err
+			}
+			m.Seqno, _ = r.reqTs.SeqnoFor(vbno)
+			r.started[vbno] = true
+
+		} else if !r.header.Async ||
+			(m.Status != mcd.ROLLBACK && m.Status != mcd.UNKNOWN_COLLECTION &&
+				m.Status != mcd.UNKNOWN_SCOPE) {
+			return nil
+		}
+
+	case mcd.DCP_STREAMEND:
+		if m.Status != mcd.SUCCESS {
+			return nil
+		}
+		defer delete(r.started, vbno)
+
+	default:
+		// the stream request of the vbucket was in a file rotated out of
+		// the recording, start its stream from the request timestamp.
+		if !r.started[vbno] {
+			if err := r.post(r.streamBegin(m)); err != nil {
+				return err
+			}
+			r.started[vbno] = true
+		}
+	}
+
+	logging.Tracef("dcpReplay: %v vb %v seqno %v", m.Opcode, vbno, m.Seqno)
+	if err := r.post(m); err != nil {
+		return err
+	}
+	r.stats.Events++
+	switch m.Opcode {
+	case mcd.DCP_MUTATION, mcd.DCP_DELETION, mcd.DCP_EXPIRATION:
+		r.stats.Mutations++
+	}
+	return nil
+}
+
+func (r *dcpReplay) streamBegin(m *mc.DcpEvent) *mc.DcpEvent {
+	begin := &mc.DcpEvent{
+		Opcode:   mcd.DCP_STREAMREQ,
+		Status:   mcd.SUCCESS,
+		VBucket:  m.VBucket,
+		Opaque:   m.Opaque,
+		StreamID: m.StreamID,
+		Ctime:    m.Ctime,
+	}
+	vbuuids, seqnos := r.reqTs.GetVbuuids(), r.reqTs.GetSeqnos()
+	for i, vbno := range r.reqTs.GetVbnos() {
+		if uint16(vbno) == m.VBucket {
+			begin.VBuuid, begin.Seqno = vbuuids[i], seqnos[i]
+		}
+	}
+	return begin
+}
@@ -81,6 +81,14 @@ type Feed struct {
 	// Collections
 	collectionsAware bool
 	osoSnapshot      map[string]bool //keyspaceId -> osoSnapshot
+	// collections, of the index instances, streams are filtered with.
+	filters map[string]map[uint16]string // keyspaceId -> vbno -> filter
+	// keyspaces whose streams are to be refiltered, once the back-channel
+	// is flushed.
+	refilterPending map[string]uint16 // keyspaceId -> opaque
+	// back-channel messages received while waiting on refiltered streams,
+	// handled by genServer before the back-channel.
+	refilterBacklog [][]interface{}
 
 	// config params
 	reqTimeout time.Duration
@@ -117,6 +125,9 @@ func NewFeed(
 		async:     async,
 
 		osoSnapshot: make(map[string]bool),
+		filters:     make(map[string]map[uint16]string),
+
+		refilterPending: make(map[string]uint16),
 
 		// upstream
 		reqTss:  make(map[string]*protobuf.TsVbuuid),
@@ -166,6 +177,7 @@ const (
 	fCmdResetConfig
 	fCmdDeleteEndpoint
 	fCmdPing
+	fCmdInspect
 )
 
 // ResetConfig for this feed.
@@ -386,6 +398,25 @@ func (feed *Feed) Ping() error {
 	return err
 }
 
+// Inspect the state of this feed, its keyspaces, engines, vbuckets and
+// endpoints. Synchronous call, that gives up after `timeout` as feed can
+// be busy with a long running request.
+func (feed *Feed) Inspect(timeout time.Duration) (*feedState, error) {
+	respch := make(chan []interface{}, 1)
+	cmd := []interface{}{fCmdInspect, respch}
+	if err := c.FailsafeOpNoblock(feed.reqch, cmd, feed.finch); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-respch:
+		return resp[0].(*feedState), nil
+	case <-feed.finch:
+		return nil, c.ErrorClosed
+	case <-time.After(timeout):
+		return nil, projC.ErrorResponseTimeout
+	}
+}
+
 type controlStreamRequest struct {
 	keyspaceId string
 	opaque     uint16
@@ -394,6 +425,7 @@ type controlStreamRequest struct {
 	vbuuid     uint64
 	seqno      uint64 // also doubles as rollback-seqno
 	uuid       uint64 // UUID of the kvdata that initiated this mesasge transfer
+	refilter   bool   // stream re-opened with a new collection filter
 }
 
 func (v *controlStreamRequest) Repr() string {
@@ -431,6 +463,7 @@ type controlStreamEnd struct {
 	status     mcd.Status
 	vbno       uint16
 	uuid       uint64 // UUID of the kvdata that initiated this mesasge transfer
+	refilter   bool   // stream closed to re-open it with a new collection filter
 }
 
 func (v *controlStreamEnd) Repr() string {
@@ -505,7 +538,17 @@ func (feed *Feed) genServer() {
 	}()
 
 	handleBackChMsgs := func(msg []interface{}) {
-		if cmd, ok := msg[0].(*controlStreamRequest); ok {
+		if cmd, ok := msg[0].(*controlStreamRequest); ok && cmd.refilter {
+			// response for a stream re-opened by refilterStreams(), that
+			// is not waited upon anymore.
+			fmsg := "%v ##%x ignoring backch message %T: %v\n"
+			logging.Warnf(fmsg, prefix, cmd.opaque, cmd, cmd.Repr())
+
+		} else if cmd, ok := msg[0].(*controlStreamEnd); ok && cmd.refilter {
+			fmsg := "%v ##%x ignoring backch message %T: %v\n"
+			logging.Warnf(fmsg, prefix, cmd.opaque, cmd, cmd.Repr())
+
+		} else if cmd, ok := msg[0].(*controlStreamRequest); ok {
 			// This check is required to avoid race in the following scenario:
 			//
 			// 1. Indexer sends fCmdStart, feed opens connections with DCP upstream
@@ -572,6 +615,10 @@ func (feed *Feed) genServer() {
 						cmd.vbno, seqno, cmd.vbuuid, sStart, sEnd, "")
 					feed.actTss[cmd.keyspaceId] = actTs
 				}
+				// instances could have been added or deleted while the
+				// stream was requested, refilter once all the responses
+				// are flushed.
+				feed.refilterPending[cmd.keyspaceId] = cmd.opaque
 
 			} else {
 				fmsg := "%v ##%x backch flush error %T: %v\n"
@@ -677,13 +724,23 @@ loop:
 		// KVData instance with that of the UUID in the message. If there is a
 		// mismatch, we ignore the message in backCh. This makes it safer to
 		// flush the backCh messages before processing a request
-		for len(feed.backch) > 0 {
+		for len(feed.backch) > 0 || len(feed.refilterBacklog) > 0 {
+			if len(feed.refilterBacklog) > 0 {
+				msg, feed.refilterBacklog = feed.refilterBacklog[0], feed.refilterBacklog[1:]
+				handleBackChMsgs(msg)
+				continue
+			}
 			select {
 			case msg = <-feed.backch:
 				handleBackChMsgs(msg)
 			default:
 			}
 		}
+		// refilter pending streams when no request or message is waiting.
+		var refilterch chan bool
+		if len(feed.refilterPending) > 0 {
+			refilterch = refilterReady
+		}
 
 		select {
 		case msg = <-feed.reqch:
@@ -696,6 +753,8 @@ loop:
 
 		case msg = <-feed.backch:
 			handleBackChMsgs(msg)
+		case <-refilterch:
+			feed.refilterPendingStreams()
 		case <-timeout.C:
 			if len(feed.backch) > 0 { // can happend during rebalance.
 				logging.Warnf(ctrlMsg, prefix, feed.opaque, len(feed.backch))
@@ -884,6 +943,10 @@ func (feed *Feed) handleCommand(msg []interface{}) (status string) {
 	case fCmdPing:
 		respch := msg[1].(chan []interface{})
 		respch <- []interface{}{true}
+
+	case fCmdInspect:
+		respch := msg[1].(chan []interface{})
+		respch <- []interface{}{feed.inspect()}
 	}
 	return status
 }
@@ -969,7 +1032,7 @@ func (feed *Feed) start(
 		kvdata.AddEngines(opaque, engines, feed.endpoints)
 		feed.kvdata[keyspaceId] = kvdata // :SideEffect:
 		// start upstream, after filtering out vbuckets.
-		e, _ = feed.bucketFeed(opaque, false, true, ts, feeder)
+		e, _ = feed.bucketFeed(opaque, false, true, feed.filterStreams(keyspaceId, ts), feeder)
 		if e != nil { // all feed errors are fatal, skip this bucket.
 			err = e
 			feed.cleanupKeyspace(keyspaceId, false)
@@ -1095,7 +1158,7 @@ func (feed *Feed) restartVbuckets(
 
 		feed.kvdata[keyspaceId] = kvdata // :SideEffect:
 		// (re)start the upstream, after filtering out remote vbuckets.
-		e, _ = feed.bucketFeed(opaque, false, true, ts, feeder)
+		e, _ = feed.bucketFeed(opaque, false, true, feed.filterStreams(keyspaceId, ts), feeder)
 		if e != nil { // all feed errors are fatal, skip this bucket.
 			err = e
 			feed.cleanupKeyspace(keyspaceId, false)
@@ -1297,7 +1360,7 @@ func (feed *Feed) addBuckets(
 		kvdata.AddEngines(opaque, engines, feed.endpoints)
 		feed.kvdata[keyspaceId] = kvdata // :SideEffect:
 		// start upstream
-		e, _ = feed.bucketFeed(opaque, false, true, ts, feeder)
+		e, _ = feed.bucketFeed(opaque, false, true, feed.filterStreams(keyspaceId, ts), feeder)
 		if e != nil { // all feed errors are fatal, skip this bucket.
 			err = e
 			feed.cleanupKeyspace(keyspaceId, false)
@@ -1386,10 +1449,19 @@ func (feed *Feed) addInstances(
 		engines := feed.engines[keyspaceId]
 
 		if kvdata, ok := feed.kvdata[keyspaceId]; ok {
+			// refilter streams before engines are added, so that mutations
+			// of a new collection missed by the old filter are all before
+			// curSeqnos.
+			seqnos, _ := feed.refilterStreams(opaque, keyspaceId, 0 /*maxVbs*/)
 			curSeqnos, err := kvdata.AddEngines(opaque, engines, feed.endpoints)
 			if err != nil {
 				return errResp, err
 			}
+			for vbno, seqno := range seqnos {
+				if seqno > curSeqnos[vbno] {
+					curSeqnos[vbno] = seqno
+				}
+			}
 			tsResp = tsResp.AddCurrentTimestamp(feed.pooln, bucketn, curSeqnos)
 			tsResp.AddKeyspaceId(keyspaceId)
 
@@ -1458,6 +1530,9 @@ func (feed *Feed) delInstances(
 	} else { // Update filtered engines only for the keyspace specified in request
 		feed.engines[reqKeyspaceId] = fengines[reqKeyspaceId] // :SideEffect:
 	}
+	for keyspaceId := range keyspaceInsts {
+		feed.refilterPending[keyspaceId] = opaque // :SideEffect:
+	}
 	return err
 }
 
@@ -1666,6 +1741,8 @@ func (feed *Feed) cleanupKeyspace(keyspaceId string, enginesOk bool) {
 	}
 	delete(feed.kvdata, keyspaceId) // :SideEffect:
 	delete(feed.osoSnapshot, keyspaceId)
+	delete(feed.filters, keyspaceId)
+	delete(feed.refilterPending, keyspaceId)
 
 	fmsg := "%v ##%x keyspace %v removed ..."
 	logging.Infof(fmsg, feed.logPrefix, feed.opaque, keyspaceId)
@@ -1698,6 +1775,12 @@ func (feed *Feed) openFeeder(
 		"activeVbOnly":     feed.config["dcp.activeVbOnly"].Bool(),
 		"collectionsAware": feed.collectionsAware,
 		"osoSnapshot":      feed.osoSnapshot[keyspaceId],
+
+		"snappy":                feed.config["dcp.snappy"].Bool(),
+		"forceValueCompression": feed.config["dcp.forceValueCompression"].Bool(),
+
+		"memBudgetKey": feed.topic,
+		"bucket":       bucketn,
 	}
 
 	kvaddr, err := feed.getLocalKVAddrs(pooln, bucketn, opaque)
@@ -1707,6 +1790,25 @@ func (feed *Feed) openFeeder(
 		feed.kvaddr = kvaddr
 	}
 
+	// feeds of all topics share a connection, multiplexed by dcp stream
+	// ids, which need collections and do not go with oso snapshots.
+	if feed.useStreamIds(keyspaceId) {
+		chsize := feed.config["dcp.dataChanSize"].Int()
+		queueBytes := int64(feed.config["dcp.feederQueueBytes"].Int())
+		feeder, err = feed.projector.dcpMuxes.openFeeder(
+			keyspaceId, bucket, opaque, kvaddr, dcpConfig, chsize, queueBytes)
+		if err != nil {
+			fmsg := "%v ##%x openFeeder(%q) on shared feed: %v"
+			logging.Errorf(fmsg, feed.logPrefix, opaque, keyspaceId, err)
+			return nil, projC.ErrorFeeder
+		}
+		// the shared feed is not shaped by projector.backfill settings.
+		fmsg := "%v ##%x openFeeder(%q) on shared feed, backfill " +
+			"shaping does not apply\n"
+		logging.Infof(fmsg, feed.logPrefix, opaque, keyspaceId)
+		return feeder, nil
+	}
+
 	kvaddrs := []string{kvaddr}
 	feeder, err = OpenBucketFeed(name, bucket, opaque, kvaddrs, dcpConfig)
 	if err != nil {
@@ -1717,6 +1819,11 @@ func (feed *Feed) openFeeder(
 	return feeder, nil
 }
 
+func (feed *Feed) useStreamIds(keyspaceId string) bool {
+	return feed.projector != nil && feed.config["dcp.streamId"].Bool() &&
+		feed.collectionsAware && !feed.osoSnapshot[keyspaceId]
+}
+
 // start a feed for a bucket with a set of kvfeeder,
 // based on vbmap and failover-logs.
 func (feed *Feed) bucketFeed(
@@ -2368,6 +2475,7 @@ func FeedConfigParams() []string {
 		"mutationChanSize",
 		"encodeBufSize",
 		"encodeBufResizeInterval",
+		"sharedExprs",
 		"routerEndpointFactory",
 		"syncTimeout",
 		// dcp configuration
@@ -2376,6 +2484,15 @@ func FeedConfigParams() []string {
 		"dcp.numConnections",
 		"dcp.latencyTick",
 		"dcp.activeVbOnly",
+		"dcp.snappy",
+		"dcp.forceValueCompression",
+		"dcp.streamId",
+		"dcp.feederQueueBytes",
+		"dcp.collectionFilter",
+		"dcp.record.dir",
+		"dcp.record.keyspaces",
+		"dcp.record.maxFileSize",
+		"dcp.record.maxFiles",
 		// dataport
 		"dataport.remoteBlock",
 		"dataport.keyChanSize",
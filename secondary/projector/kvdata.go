@@ -53,6 +53,9 @@ type KVData struct {
 	config       c.Config
 	async        bool
 
+	// upstream recording, if enabled by projector.dcp.record.dir
+	recorder *dcpRecorder
+
 	// evaluators and subscribers
 	engines   map[uint64]*Engine
 	endpoints map[string]c.RouterEndpoint
@@ -64,6 +67,12 @@ type KVData struct {
 	reqTs      *protobuf.TsVbuuid
 	reqTsMutex *sync.RWMutex // Mutex protecting updates to reqTs
 
+	// position of vbucket streams, updated by runScatter() alone.
+	vbpos map[uint16]*vbPosition
+	// vbucket streams being re-opened with a new collection filter.
+	refilter   map[uint16]*refilterVb
+	refilterMu sync.Mutex // Mutex protecting refilter
+
 	// Closing genServerStopCh will stop all incoming requests to the control path
 	genServerStopCh       chan bool
 	genServerFinCh        chan bool
@@ -240,6 +249,8 @@ func NewKVData(
 		sbch: make(chan []interface{}, 16),
 
 		reqTsMutex:       &sync.RWMutex{},
+		vbpos:            make(map[uint16]*vbPosition),
+		refilter:         make(map[uint16]*refilterVb),
 		genServerStopCh:  make(chan bool),
 		genServerFinCh:   make(chan bool),
 		runScatterFinCh:  make(chan bool),
@@ -285,6 +296,25 @@ func NewKVData(
 	kvdata.updateWorkerStats()
 
 	kvdata.reqTs = reqTs
+
+	header := &DcpRecordHeader{
+		Topic:            feed.topic,
+		Bucket:           bucket,
+		KeyspaceId:       keyspaceId,
+		CollectionId:     collectionId,
+		Version:          int32(feed.version),
+		Opaque2:          opaque2,
+		Async:            async,
+		CollectionsAware: collectionsAware,
+		OsoSnapshot:      feed.osoSnapshot[keyspaceId],
+	}
+	kvdata.recorder, err = newDcpRecorder(config, header, kvdata.uuid, kvdata.logPrefix)
+	if err != nil {
+		fmsg := "%v ##%x not recording dcp events: %v"
+		logging.Errorf(fmsg, kvdata.logPrefix, opaque, err)
+	}
+	kvdata.recordHeader()
+
 	go kvdata.genServer()
 	go kvdata.runScatter(mutch)
 	logging.Infof("%v ##%x started, uuid: %v ...\n", kvdata.logPrefix, opaque, kvdata.uuid)
@@ -431,6 +461,9 @@ loop:
 					break loop
 				}
 				kvdata.stats.eventCount.Add(1)
+				if kvdata.recorder != nil {
+					kvdata.recorder.record(m)
+				}
 				seqno, err := kvdata.scatterMutation(m)
 				if err != nil {
 					fmsg := "%v ##%x Error during scatter mutation while posting: %v, err: %v"
@@ -473,6 +506,10 @@ func (kvdata *KVData) genServer() {
 
 		kvdata.publishStreamEnd()
 
+		if kvdata.recorder != nil {
+			kvdata.recorder.close()
+		}
+
 		kvdata.feed.PostFinKVdata(kvdata.keyspaceId, kvdata.uuid)
 
 		//Update closed in stats object and log the stats before exiting
@@ -534,6 +571,7 @@ func (kvdata *KVData) handleCommand(msg []interface{}) bool {
 			}
 		}
 		kvdata.stats.ainstCount.Add(1)
+		kvdata.recordHeader()
 		respch <- []interface{}{curSeqnos, nil}
 
 	case kvCmdDelEngines:
@@ -553,6 +591,7 @@ func (kvdata *KVData) handleCommand(msg []interface{}) bool {
 			logging.Infof(fmsg, kvdata.logPrefix, opaque, engineKey)
 		}
 		kvdata.stats.dinstCount.Add(1)
+		kvdata.recordHeader()
 		respch <- []interface{}{nil}
 
 	case kvCmdTs:
@@ -562,6 +601,7 @@ func (kvdata *KVData) handleCommand(msg []interface{}) bool {
 		kvdata.reqTsMutex.Unlock()
 		respch := msg[3].(chan []interface{})
 		kvdata.stats.tsCount.Add(1)
+		kvdata.recordHeader()
 		respch <- []interface{}{nil}
 
 	case kvCmdGetStats:
@@ -616,6 +656,15 @@ func (kvdata *KVData) scatterMutation(m *mc.DcpEvent) (seqno uint64, err error)
 	vbno := m.VBucket
 	worker := kvdata.workers[int(vbno)%len(kvdata.workers)]
 
+	if seqno, ok, err := kvdata.refiltered(m, worker); ok {
+		return seqno, err
+	}
+	defer func() {
+		if err == nil {
+			kvdata.trackPosition(m)
+		}
+	}()
+
 	switch m.Opcode {
 	case mcd.DCP_STREAMREQ:
 		if m.Status == mcd.ROLLBACK {
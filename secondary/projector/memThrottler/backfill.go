@@ -0,0 +1,242 @@
+// Backfill shaping:
+//
+// Projector feeds of INIT_STREAM topics backfill index builds, and several
+// of them running together can take all of projector's bandwidth away from
+// the MAINT_STREAM feeds that keep built indexes up to date. Their DCP
+// connections are shaped by acknowledging DCP buffers no faster than
+// "projector.backfill.rateLimit" bytes per second, the producer does not
+// send more than its flow control buffer ahead of the acknowledgements. The
+// rate is shared by the buckets that are backfilling, in proportion to their
+// weights in "projector.backfill.bucketWeights".
+//
+// With "projector.backfill.maintPriority", backfill is shaped only while
+// MAINT_STREAM or CATCHUP_STREAM feeds are streaming mutations, so that
+// builds run at full speed on an otherwise idle node.
+//
+// Connections shared by feeds of several topics, with
+// "projector.dcp.streamId", are not shaped, as delaying their
+// acknowledgements would hold back every topic on them, and projector warns
+// when both settings are on. Mutations routed to maintenance topics on them
+// still count as maintenance streaming for "projector.backfill.maintPriority".
+
+package memThrottler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// topics of index builds, named by indexer.
+const initTopicPrefix = "INIT_STREAM_TOPIC"
+
+// maintenance feeds are streaming if they had a mutation in this window.
+const maintActiveWindow = 5 * time.Second
+
+// buckets share the backfill rate with those that acknowledged in this
+// window, feeds of large flow control buffers acknowledge only so often.
+const backfillActiveWindow = 10 * time.Second
+
+// buckets can burst up to this worth of their share.
+const backfillBurst = time.Second
+
+// MaintNoteInterval is how often a maintenance feed notes its mutations,
+// well within maintActiveWindow.
+const MaintNoteInterval = 500 * time.Millisecond
+
+type backfillBucket struct {
+	tokens   float64 // bytes that can be acknowledged, negative if in debt
+	refilled time.Time
+	lastAck  time.Time
+
+	ackedBytes   uint64
+	deferredAcks uint64
+}
+
+type backfillShaper struct {
+	mu            sync.Mutex
+	rateLimit     int64          // in bytes per second, 0 disables shaping
+	maintPriority bool           // shape only while maintenance is streaming
+	weights       map[string]int // bucket -> weight, defaults to 1
+	buckets       map[string]*backfillBucket
+
+	lastMaint int64 // time of last maintenance mutation, in unix nano
+}
+
+var backfill = &backfillShaper{
+	maintPriority: true,
+	weights:       make(map[string]int),
+	buckets:       make(map[string]*backfillBucket),
+}
+
+// IsBackfillTopic tells whether the feeds of projector topic `key` are
+// backfilling index builds. An empty key is for connections shared by
+// topics, which are neither backfill nor maintenance.
+func IsBackfillTopic(key string) bool {
+	return strings.HasPrefix(key, initTopicPrefix)
+}
+
+// NoteMaintMutation is called by maintenance feeds for a mutation at `now`,
+// at most once every MaintNoteInterval.
+func NoteMaintMutation(now time.Time) {
+	atomic.StoreInt64(&backfill.lastMaint, now.UnixNano())
+}
+
+// ReserveBufferAck for a backfill feed to acknowledge `bytes` of `bucket`.
+// Return zero if the acknowledgement can be sent now, else the duration to
+// wait before asking again.
+func ReserveBufferAck(bucket string, bytes uint32) time.Duration {
+	return backfill.reserve(bucket, bytes, time.Now())
+}
+
+func (s *backfillShaper) reserve(
+	bucket string, bytes uint32, now time.Time) time.Duration {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.rateLimit <= 0 || (s.maintPriority && !s.maintStreaming(now)) {
+		return 0
+	}
+
+	b, ok := s.buckets[bucket]
+	if !ok {
+		b = &backfillBucket{refilled: now}
+		s.buckets[bucket] = b
+	}
+	b.lastAck = now
+
+	rate := s.bucketRate(bucket, now)
+	b.tokens += now.Sub(b.refilled).Seconds() * rate
+	b.refilled = now
+	if burst := rate * backfillBurst.Seconds(); b.tokens > burst {
+		b.tokens = burst
+	}
+
+	if b.tokens < 0 {
+		b.deferredAcks++
+		return time.Duration(-b.tokens / rate * float64(time.Second))
+	}
+	b.tokens -= float64(bytes)
+	b.ackedBytes += uint64(bytes)
+	return 0
+}
+
+func (s *backfillShaper) maintStreaming(now time.Time) bool {
+	lastMaint := atomic.LoadInt64(&s.lastMaint)
+	return now.UnixNano()-lastMaint < int64(maintActiveWindow)
+}
+
+// bucketRate is the share of rateLimit for `bucket`, among the buckets
+// that are backfilling.
+func (s *backfillShaper) bucketRate(bucket string, now time.Time) float64 {
+	total := 0
+	for name, b := range s.buckets {
+		if name == bucket || now.Sub(b.lastAck) < backfillActiveWindow {
+			total += s.weight(name)
+		}
+	}
+	return float64(s.rateLimit) * float64(s.weight(bucket)) / float64(total)
+}
+
+func (s *backfillShaper) weight(bucket string) int {
+	if weight, ok := s.weights[bucket]; ok {
+		return weight
+	}
+	return 1
+}
+
+// SetBackfillRateLimit in bytes per second, 0 disables backfill shaping.
+func SetBackfillRateLimit(rateLimit int) {
+	backfill.mu.Lock()
+	defer backfill.mu.Unlock()
+
+	if int64(rateLimit) != backfill.rateLimit {
+		backfill.rateLimit = int64(rateLimit)
+		logging.Infof("MemThrottler::SetBackfillRateLimit Backfill rate limit set to: %v bytes/sec", rateLimit)
+	}
+}
+
+// SetBackfillMaintPriority when true, shapes backfill only while
+// maintenance feeds are streaming.
+func SetBackfillMaintPriority(val bool) {
+	backfill.mu.Lock()
+	defer backfill.mu.Unlock()
+
+	if val != backfill.maintPriority {
+		backfill.maintPriority = val
+		logging.Infof("MemThrottler::SetBackfillMaintPriority Backfill maintenance priority set to: %v", val)
+	}
+}
+
+// SetBackfillBucketWeights from a comma separated list of bucket:weight,
+// buckets not in the list weigh 1.
+func SetBackfillBucketWeights(spec string) error {
+	weights, err := parseBucketWeights(spec)
+	if err != nil {
+		logging.Errorf("MemThrottler::SetBackfillBucketWeights %v", err)
+		return err
+	}
+
+	backfill.mu.Lock()
+	defer backfill.mu.Unlock()
+
+	backfill.weights = weights
+	logging.Infof("MemThrottler::SetBackfillBucketWeights Backfill bucket weights set to: %v", weights)
+	return nil
+}
+
+func parseBucketWeights(spec string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid bucket weight %q", item)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(item[i+1:]))
+		if err != nil || weight <= 0 {
+			return nil, fmt.Errorf("invalid bucket weight %q", item)
+		}
+		weights[strings.TrimSpace(item[:i])] = weight
+	}
+	return weights, nil
+}
+
+// GetBackfillStats return the rate limit, and the share of it for every
+// bucket that backfilled.
+func GetBackfillStats() map[string]interface{} {
+	backfill.mu.Lock()
+	defer backfill.mu.Unlock()
+
+	now := time.Now()
+	buckets := make(map[string]interface{})
+	for name, b := range backfill.buckets {
+		active := now.Sub(b.lastAck) < backfillActiveWindow
+		bytesPerSec := int64(0)
+		if active && backfill.rateLimit > 0 {
+			bytesPerSec = int64(backfill.bucketRate(name, now))
+		}
+		buckets[name] = map[string]interface{}{
+			"weight":       backfill.weight(name),
+			"active":       active,
+			"bytesPerSec":  bytesPerSec,
+			"ackedBytes":   b.ackedBytes,
+			"deferredAcks": b.deferredAcks,
+		}
+	}
+	return map[string]interface{}{
+		"rateLimit":      backfill.rateLimit,
+		"maintPriority":  backfill.maintPriority,
+		"maintStreaming": backfill.maintStreaming(now),
+		"buckets":        buckets,
+	}
+}
@@ -0,0 +1,132 @@
+package memThrottler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestShaper(rateLimit int64, maintPriority bool, weights map[string]int) *backfillShaper {
+	if weights == nil {
+		weights = make(map[string]int)
+	}
+	return &backfillShaper{
+		rateLimit:     rateLimit,
+		maintPriority: maintPriority,
+		weights:       weights,
+		buckets:       make(map[string]*backfillBucket),
+	}
+}
+
+func TestParseBucketWeights(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		expected map[string]int
+		err      bool
+	}{
+		{"", map[string]int{}, false},
+		{"b1:2, b2 : 3,,", map[string]int{"b1": 2, "b2": 3}, false},
+		{"b:1:4", map[string]int{"b:1": 4}, false},
+		{"b1", nil, true},
+		{":2", nil, true},
+		{"b1:0", nil, true},
+		{"b1:-1", nil, true},
+		{"b1:x", nil, true},
+	}
+
+	for _, tc := range testCases {
+		weights, err := parseBucketWeights(tc.spec)
+		if (err != nil) != tc.err || !reflect.DeepEqual(weights, tc.expected) {
+			t.Errorf("%q: expected %v, error %v, got %v, %v", tc.spec, tc.expected, tc.err, weights, err)
+		}
+	}
+}
+
+func TestBackfillReserve(t *testing.T) {
+	s := newTestShaper(1000, false, nil)
+	now := time.Now()
+
+	// a bucket starts with no tokens, and can go in debt by one ack
+	if wait := s.reserve("b1", 1500, now); wait != 0 {
+		t.Fatalf("expected the first ack to be sent, got wait %v", wait)
+	}
+	if wait := s.reserve("b1", 100, now); wait != 1500*time.Millisecond {
+		t.Fatalf("expected to wait for the debt to be paid, got %v", wait)
+	}
+	if wait := s.reserve("b1", 100, now.Add(1500*time.Millisecond)); wait != 0 {
+		t.Fatalf("expected the ack to be sent once the debt is paid, got wait %v", wait)
+	}
+
+	// tokens are capped to the burst after idling
+	if wait := s.reserve("b1", 100, now.Add(time.Hour)); wait != 0 {
+		t.Fatalf("expected the ack to be sent, got wait %v", wait)
+	}
+	b := s.buckets["b1"]
+	if b.tokens != 900 || b.ackedBytes != 1700 || b.deferredAcks != 1 {
+		t.Errorf("unexpected bucket %+v", *b)
+	}
+
+	// no shaping without a rate limit
+	s = newTestShaper(0, false, nil)
+	if wait := s.reserve("b1", 1<<30, now); wait != 0 || len(s.buckets) != 0 {
+		t.Errorf("expected no shaping, got wait %v and buckets %v", wait, s.buckets)
+	}
+}
+
+func TestBackfillReserveMaintPriority(t *testing.T) {
+	s := newTestShaper(1000, true, nil)
+	now := time.Now()
+
+	// idle maintenance, no shaping
+	for i := 0; i < 2; i++ {
+		if wait := s.reserve("b1", 1500, now); wait != 0 {
+			t.Fatalf("expected no shaping while maintenance is idle, got wait %v", wait)
+		}
+	}
+
+	s.lastMaint = now.UnixNano()
+	s.reserve("b1", 1500, now)
+	if wait := s.reserve("b1", 1500, now); wait == 0 {
+		t.Errorf("expected shaping while maintenance is streaming")
+	}
+
+	later := now.Add(maintActiveWindow)
+	if wait := s.reserve("b1", 1500, later); wait != 0 {
+		t.Errorf("expected no shaping once maintenance is idle, got wait %v", wait)
+	}
+}
+
+func TestBackfillBucketRate(t *testing.T) {
+	s := newTestShaper(4000, false, map[string]int{"b1": 3})
+	now := time.Now()
+
+	s.reserve("b1", 1, now)
+	if rate := s.bucketRate("b1", now); rate != 4000 {
+		t.Errorf("expected a single bucket to get the rate limit, got %v", rate)
+	}
+
+	s.reserve("b2", 1, now)
+	if rate := s.bucketRate("b1", now); rate != 3000 {
+		t.Errorf("expected b1 to get 3/4 of the rate limit, got %v", rate)
+	}
+	if rate := s.bucketRate("b2", now); rate != 1000 {
+		t.Errorf("expected b2 to get 1/4 of the rate limit, got %v", rate)
+	}
+
+	// b1 stopped backfilling
+	later := now.Add(backfillActiveWindow)
+	if rate := s.bucketRate("b2", later); rate != 4000 {
+		t.Errorf("expected b2 to get the rate limit, got %v", rate)
+	}
+}
+
+func TestNoteMaintMutation(t *testing.T) {
+	now := time.Now()
+	NoteMaintMutation(now)
+	if !backfill.maintStreaming(now.Add(MaintNoteInterval)) {
+		t.Errorf("expected maintenance to be streaming")
+	}
+	if backfill.maintStreaming(now.Add(maintActiveWindow)) {
+		t.Errorf("expected maintenance to be idle")
+	}
+}
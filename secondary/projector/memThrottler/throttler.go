@@ -1,6 +1,7 @@
 package memThrottler
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -43,6 +44,11 @@ type MemThrottler struct {
 
 	initBuildThrottleStartLevel int32
 	incrBuildThrottleStartLevel int32
+
+	// Throttle levels of feeds that are over their memory budget, computed
+	// by projector's memory budget monitor. Copy on write, map[string]int32
+	feedLevels atomic.Value
+	feedMu     sync.Mutex // serializes updates to feedLevels
 }
 
 var memThrottler *MemThrottler
@@ -55,6 +61,7 @@ func Init() {
 		initBuildThrottleStartLevel:       THROTTLE_NONE,
 		incrBuildThrottleStartLevel:       THROTTLE_NONE,
 	}
+	memThrottler.feedLevels.Store(map[string]int32{})
 }
 
 func DoThrottle(isIncrBuild bool) {
@@ -67,7 +74,67 @@ func DoThrottle(isIncrBuild bool) {
 	throttle(isIncrBuild)
 }
 
+// Throttle level due to process memory at which every feed is throttled,
+// even while only some feeds are over their memory budget.
+const CRITICAL_THROTTLE_LEVEL = THROTTLE_LEVEL_5
+
+// DoThrottleFeed throttles the DCP feed of projector feed `key`. Feeds that
+// are over their memory budget are throttled at their budget level. When
+// some feeds are over budget, throttling due to process memory applies only
+// to them, so that one feed stuck behind a slow endpoint does not slow down
+// all the others, until process memory reaches CRITICAL_THROTTLE_LEVEL.
+// Otherwise it behaves like DoThrottle. An empty key, used by connections
+// shared across feeds, always behaves like DoThrottle.
+func DoThrottleFeed(key string, isIncrBuild bool) {
+	if memThrottler == nil {
+		return
+	} else if key == "" {
+		DoThrottle(isIncrBuild)
+		return
+	}
+
+	sleep(feedThrottleLevel(key, isIncrBuild))
+}
+
+// DoThrottleBudget throttles a consumer of projector feed `key` only for
+// the feed's memory budget, for feeders of connections shared across feeds,
+// which are throttled for process memory on the connection.
+func DoThrottleBudget(key string) {
+	if memThrottler == nil {
+		return
+	}
+	sleep(getFeedThrottleLevels()[key])
+}
+
+// feedThrottleLevel return the throttle level of projector feed `key`.
+func feedThrottleLevel(key string, isIncrBuild bool) int32 {
+	levels := getFeedThrottleLevels()
+	finalThrottleLevel, overBudget := levels[key]
+
+	if IsMemThrottlingEnabled() == 0 ||
+		(isIncrBuild && IsMaintStreamMemThrottlingEnabled() == 0) {
+		return finalThrottleLevel
+	}
+
+	// many feeds within budget may together hold the process memory, so
+	// they are spared only below the critical level.
+	if len(levels) > 0 && !overBudget && GetThrottleLevel() < CRITICAL_THROTTLE_LEVEL {
+		return finalThrottleLevel
+	}
+
+	if level := memThrottleLevel(isIncrBuild); level > finalThrottleLevel {
+		finalThrottleLevel = level
+	}
+	return finalThrottleLevel
+}
+
 func throttle(isIncrBuild bool) {
+	sleep(memThrottleLevel(isIncrBuild))
+}
+
+// memThrottleLevel return the throttle level due to process memory, for
+// initial or incremental builds.
+func memThrottleLevel(isIncrBuild bool) int32 {
 	var throttleStartLevel int32
 	if isIncrBuild {
 		throttleStartLevel = GetIncrBuildThrottleStartLevel()
@@ -84,7 +151,10 @@ func throttle(isIncrBuild bool) {
 	} else if finalThrottleLevel > THROTTLE_LEVEL_10 {
 		finalThrottleLevel = THROTTLE_LEVEL_10
 	}
+	return finalThrottleLevel
+}
 
+func sleep(finalThrottleLevel int32) {
 	switch finalThrottleLevel {
 	case THROTTLE_NONE:
 		return
@@ -125,6 +195,49 @@ func SetThrottleLevel(tl int) {
 	}
 }
 
+func getFeedThrottleLevels() map[string]int32 {
+	return memThrottler.feedLevels.Load().(map[string]int32)
+}
+
+// GetFeedThrottleLevels return the throttle level of every feed that is
+// over its memory budget.
+func GetFeedThrottleLevels() map[string]int32 {
+	levels := make(map[string]int32)
+	if memThrottler == nil {
+		return levels
+	}
+	for key, level := range getFeedThrottleLevels() {
+		levels[key] = level
+	}
+	return levels
+}
+
+// SetFeedThrottleLevels replace the throttle levels of feeds that are over
+// their memory budget. Feeds missing in `levels` are within their budget.
+func SetFeedThrottleLevels(levels map[string]int32) {
+	memThrottler.feedMu.Lock()
+	defer memThrottler.feedMu.Unlock()
+
+	currLevels := getFeedThrottleLevels()
+	newLevels := make(map[string]int32, len(levels))
+	changed := len(levels) != len(currLevels)
+	for key, level := range levels {
+		if level > THROTTLE_LEVEL_10 {
+			level = THROTTLE_LEVEL_10
+		} else if level < THROTTLE_LEVEL_1 {
+			level = THROTTLE_LEVEL_1
+		}
+		if currLevel, ok := currLevels[key]; !ok || currLevel != level {
+			changed = true
+		}
+		newLevels[key] = level
+	}
+	if changed {
+		memThrottler.feedLevels.Store(newLevels)
+		logging.Infof("MemThrottler::SetFeedThrottleLevels Feed throttling levels set to: %v", newLevels)
+	}
+}
+
 func IsMemThrottlingEnabled() int32 {
 	return atomic.LoadInt32(&memThrottler.isMemThrottlingEnabled)
 }
@@ -0,0 +1,81 @@
+package memThrottler
+
+import (
+	"testing"
+)
+
+func TestFeedThrottleLevel(t *testing.T) {
+	Init()
+
+	testCases := []struct {
+		name       string
+		rssLevel   int
+		feedLevels map[string]int32
+		key        string
+		expected   int32
+	}{
+		{"no pressure", THROTTLE_NONE, nil, "feed1", THROTTLE_NONE},
+		{"rss only", THROTTLE_LEVEL_3, nil, "feed1", THROTTLE_LEVEL_3},
+		{"over budget", THROTTLE_NONE, map[string]int32{"feed1": 4}, "feed1", THROTTLE_LEVEL_4},
+		{"over budget and rss", THROTTLE_LEVEL_6, map[string]int32{"feed1": 4}, "feed1", THROTTLE_LEVEL_6},
+		{"within budget spared", THROTTLE_LEVEL_3, map[string]int32{"feed2": 4}, "feed1", THROTTLE_NONE},
+		{"within budget critical", CRITICAL_THROTTLE_LEVEL, map[string]int32{"feed2": 4}, "feed1", CRITICAL_THROTTLE_LEVEL},
+		{"within budget above critical", THROTTLE_LEVEL_8, map[string]int32{"feed2": 4}, "feed1", THROTTLE_LEVEL_8},
+	}
+
+	for _, tc := range testCases {
+		SetThrottleLevel(tc.rssLevel)
+		SetFeedThrottleLevels(tc.feedLevels)
+		if level := feedThrottleLevel(tc.key, false); level != tc.expected {
+			t.Errorf("%v: expected throttle level %v, got %v", tc.name, tc.expected, level)
+		}
+	}
+}
+
+func TestFeedThrottleLevelStartLevel(t *testing.T) {
+	Init()
+	defer Init()
+
+	SetThrottleLevel(THROTTLE_LEVEL_8)
+	SetFeedThrottleLevels(map[string]int32{"feed1": 2})
+	SetInitBuildThrottleStartLevel(THROTTLE_LEVEL_3)
+
+	// throttling due to rss is offset by the start level of the stream
+	if level := feedThrottleLevel("feed1", false); level != THROTTLE_LEVEL_5 {
+		t.Errorf("expected throttle level %v, got %v", THROTTLE_LEVEL_5, level)
+	}
+	if level := feedThrottleLevel("feed2", false); level != THROTTLE_LEVEL_5 {
+		t.Errorf("expected throttle level %v, got %v", THROTTLE_LEVEL_5, level)
+	}
+
+	// feeds over budget are throttled at their budget level without rss throttling
+	SetMemThrottle(false)
+	if level := feedThrottleLevel("feed1", false); level != THROTTLE_LEVEL_2 {
+		t.Errorf("expected throttle level %v, got %v", THROTTLE_LEVEL_2, level)
+	}
+	if level := feedThrottleLevel("feed2", false); level != THROTTLE_NONE {
+		t.Errorf("expected throttle level %v, got %v", THROTTLE_NONE, level)
+	}
+}
+
+func TestSetFeedThrottleLevels(t *testing.T) {
+	Init()
+
+	SetFeedThrottleLevels(map[string]int32{"feed1": 0, "feed2": 20, "feed3": 3})
+	levels := GetFeedThrottleLevels()
+	expected := map[string]int32{"feed1": THROTTLE_LEVEL_1, "feed2": THROTTLE_LEVEL_10, "feed3": THROTTLE_LEVEL_3}
+	if len(levels) != len(expected) {
+		t.Fatalf("expected levels %v, got %v", expected, levels)
+	}
+	for key, level := range expected {
+		if levels[key] != level {
+			t.Errorf("expected level %v for %v, got %v", level, key, levels[key])
+		}
+	}
+
+	// the returned levels are a copy
+	levels["feed4"] = 1
+	if _, ok := GetFeedThrottleLevels()["feed4"]; ok {
+		t.Errorf("feed throttle levels modified through a copy")
+	}
+}
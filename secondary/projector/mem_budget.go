@@ -0,0 +1,217 @@
+// Memory budget of feeds:
+//
+// statsManager periodically adds up the memory held on behalf of each feed
+// (topic), from the stats objects of its components,
+//   - key-versions queued up for the feed's endpoints, not yet flushed
+//     downstream.
+//   - encode buffers of the feed's workers.
+//   - DCP buffers consumed by the feed's dcp connections, not yet
+//     acknowledged to the producer, and events queued for the feed on dcp
+//     connections shared with other feeds.
+//
+// Feeds using more than projector.memBudget.feedBytes get a throttle level
+// in proportion to their overage, which their dcp connections apply while
+// receiving from KV. This backpressures only the offending feed, typically
+// one stuck behind a slow indexer endpoint, instead of every feed on the
+// node. The outcome is published under "memBudget" in /stats.
+
+package projector
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/dataport"
+	memcached "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/projector/memThrottler"
+)
+
+const defaultMemBudget = 256 * 1024 * 1024
+const defaultMemBudgetInterval = 1000 // in milliseconds
+
+// memory held on behalf of a feed.
+type feedMemUsage struct {
+	queued    int64            // key-versions queued for endpoints
+	encodeBuf int64            // encode buffers of workers
+	dcpBuffer int64            // unacknowledged dcp buffers
+	endpoints map[string]int64 // endpoint -> queued key-versions
+}
+
+func newFeedMemUsage(topic string, fs *FeedStats) *feedMemUsage {
+	usage := &feedMemUsage{endpoints: make(map[string]int64)}
+	for _, ks := range fs.keyspaceIdStats {
+		for _, value := range ks.dcpStats {
+			switch val := value.(type) {
+			case *memcached.DcpStats:
+				// connections shared by feeds are held to their budget
+				// by their feeders.
+				if !val.IsClosed() && val.BudgetKey() == topic {
+					usage.dcpBuffer += int64(val.ToAckBytes.Value())
+				}
+			case *dcpFeederStats:
+				if !val.IsClosed() && val.BudgetKey() == topic {
+					usage.dcpBuffer += val.queuedBytes.Value()
+				}
+			}
+		}
+		for _, value := range ks.wrkrStats {
+			for _, stat := range value {
+				val, ok := stat.(*WorkerStats)
+				if !ok || val.IsClosed() {
+					continue
+				}
+				usage.encodeBuf += val.encodeBuf.Value()
+			}
+		}
+	}
+	for key, value := range fs.endpStats {
+		val, ok := value.(*dataport.EndpointStats)
+		if !ok || val.IsClosed() {
+			continue
+		}
+		usage.endpoints[key] = val.QueuedBytes()
+		usage.queued += val.QueuedBytes()
+	}
+	return usage
+}
+
+func (usage *feedMemUsage) total() int64 {
+	return usage.queued + usage.encodeBuf + usage.dcpBuffer
+}
+
+// culprit describe the component holding most of the feed's memory.
+func (usage *feedMemUsage) culprit() string {
+	endpoint, endpBytes := "", int64(0)
+	for key, bytes := range usage.endpoints {
+		if endpoint == "" || bytes > endpBytes {
+			endpoint, endpBytes = key, bytes
+		}
+	}
+	switch {
+	case endpBytes >= usage.encodeBuf && endpBytes >= usage.dcpBuffer:
+		return fmt.Sprintf("%v bytes queued for slow endpoint %v", endpBytes, endpoint)
+	case usage.encodeBuf >= usage.dcpBuffer:
+		return fmt.Sprintf("%v bytes in encode buffers", usage.encodeBuf)
+	}
+	return fmt.Sprintf("%v bytes in unacknowledged dcp buffers", usage.dcpBuffer)
+}
+
+func (usage *feedMemUsage) stats() map[string]interface{} {
+	endpoints := make(map[string]interface{})
+	for key, bytes := range usage.endpoints {
+		endpoints[key] = bytes
+	}
+	return map[string]interface{}{
+		"queuedBytes":    usage.queued,
+		"encodeBufBytes": usage.encodeBuf,
+		"dcpBufferBytes": usage.dcpBuffer,
+		"totalBytes":     usage.total(),
+		"endpoints":      endpoints,
+	}
+}
+
+// budgetMonitor checks the memory usage of feeds against their budget
+// every "projector.memBudget.checkInterval".
+func (sm *statsManager) budgetMonitor() {
+	for {
+		sm.checkBudgets()
+		if atomic.LoadInt32(&sm.stopLogger) == 1 {
+			return
+		}
+		interval := atomic.LoadInt64(&sm.memBudgetInterval)
+		time.Sleep(time.Duration(interval) * time.Millisecond)
+	}
+}
+
+// budgetLevels return the throttle level of every feed that is over
+// `budget`, given the levels of feeds currently throttled.
+func budgetLevels(usages map[string]*feedMemUsage, budget int64,
+	currLevels map[string]int32) map[string]int32 {
+
+	levels := make(map[string]int32)
+	if budget <= 0 {
+		return levels
+	}
+	for topic, usage := range usages {
+		total := usage.total()
+		_, throttled := currLevels[topic]
+		if total > budget {
+			level := 1 + 10*(total-budget)/budget
+			if level > memThrottler.THROTTLE_LEVEL_10 {
+				level = memThrottler.THROTTLE_LEVEL_10
+			}
+			levels[topic] = int32(level)
+		} else if throttled && total > budget*9/10 {
+			// keep throttling till the feed is well within its budget,
+			// so that it does not flap around the budget.
+			levels[topic] = memThrottler.THROTTLE_LEVEL_1
+		}
+	}
+	return levels
+}
+
+func (sm *statsManager) checkBudgets() {
+	budget := atomic.LoadInt64(&sm.memBudget)
+	currLevels := memThrottler.GetFeedThrottleLevels()
+	rssLevel := memThrottler.GetThrottleLevel()
+
+	usages := make(map[string]*feedMemUsage)
+	if ps := sm.stats.Get(); ps != nil {
+		for topic, fs := range ps.feedStats {
+			usages[topic] = newFeedMemUsage(topic, fs)
+		}
+	}
+	levels := budgetLevels(usages, budget, currLevels)
+	memThrottler.SetFeedThrottleLevels(levels)
+
+	feeds := make(map[string]interface{})
+	for topic, usage := range usages {
+		level, overBudget := levels[topic]
+		reason := ""
+		switch {
+		case overBudget && usage.total() > budget:
+			reason = fmt.Sprintf("using %v bytes over budget of %v bytes, "+
+				"%v", usage.total(), budget, usage.culprit())
+		case overBudget:
+			reason = fmt.Sprintf("using %v bytes, throttled till within 90%% "+
+				"of budget of %v bytes", usage.total(), budget)
+		case len(levels) > 0 && rssLevel < memThrottler.CRITICAL_THROTTLE_LEVEL:
+			reason = "within budget, not throttled for projector RSS as " +
+				"other feeds are over budget"
+		case rssLevel > memThrottler.THROTTLE_NONE &&
+			memThrottler.IsMemThrottlingEnabled() == 1:
+			reason = fmt.Sprintf("within budget, throttled at level %v for "+
+				"projector RSS", rssLevel)
+		}
+		if overBudget {
+			if _, ok := currLevels[topic]; !ok {
+				logging.Warnf("StatsManager: feed %v throttled at level %v: %v",
+					topic, level, reason)
+			}
+		} else if _, ok := currLevels[topic]; ok {
+			logging.Infof("StatsManager: feed %v no more throttled, using %v bytes",
+				topic, usage.total())
+		}
+
+		feed := usage.stats()
+		feed["throttleLevel"] = level
+		feed["reason"] = reason
+		feeds[topic] = feed
+	}
+
+	sm.budgetStats.Store(map[string]interface{}{
+		"feedBudgetBytes":  budget,
+		"rssThrottleLevel": rssLevel,
+		"feeds":            feeds,
+	})
+}
+
+// getBudgetStats return the outcome of the last budget check.
+func (sm *statsManager) getBudgetStats() map[string]interface{} {
+	if stats, ok := sm.budgetStats.Load().(map[string]interface{}); ok {
+		return stats
+	}
+	return map[string]interface{}{}
+}
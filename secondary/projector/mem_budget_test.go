@@ -0,0 +1,90 @@
+package projector
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/projector/memThrottler"
+)
+
+func TestBudgetLevels(t *testing.T) {
+	budget := int64(1000)
+	usages := map[string]*feedMemUsage{
+		"within":     &feedMemUsage{queued: 500},
+		"over":       &feedMemUsage{queued: 800, encodeBuf: 300, dcpBuffer: 100},
+		"way-over":   &feedMemUsage{queued: 50000},
+		"recovering": &feedMemUsage{dcpBuffer: 950},
+		"recovered":  &feedMemUsage{dcpBuffer: 850},
+	}
+	currLevels := map[string]int32{"recovering": 3, "recovered": 3}
+
+	levels := budgetLevels(usages, budget, currLevels)
+	expected := map[string]int32{
+		"over":       3, // 20% over budget
+		"way-over":   memThrottler.THROTTLE_LEVEL_10,
+		"recovering": memThrottler.THROTTLE_LEVEL_1,
+	}
+	if len(levels) != len(expected) {
+		t.Fatalf("expected levels %v, got %v", expected, levels)
+	}
+	for topic, level := range expected {
+		if levels[topic] != level {
+			t.Errorf("expected level %v for %v, got %v", level, topic, levels[topic])
+		}
+	}
+
+	// no feed is throttled without a budget
+	if levels := budgetLevels(usages, 0, currLevels); len(levels) != 0 {
+		t.Errorf("expected no levels without budget, got %v", levels)
+	}
+}
+
+func TestFeedMemUsageCulprit(t *testing.T) {
+	usage := &feedMemUsage{
+		queued:    700,
+		encodeBuf: 100,
+		dcpBuffer: 200,
+		endpoints: map[string]int64{"node1:9104": 600, "node2:9104": 100},
+	}
+	if usage.total() != 1000 {
+		t.Errorf("expected total 1000, got %v", usage.total())
+	}
+	if culprit := usage.culprit(); !strings.Contains(culprit, "node1:9104") {
+		t.Errorf("expected slowest endpoint as culprit, got %q", culprit)
+	}
+
+	usage = &feedMemUsage{encodeBuf: 300, dcpBuffer: 200}
+	if culprit := usage.culprit(); !strings.Contains(culprit, "encode buffers") {
+		t.Errorf("expected encode buffers as culprit, got %q", culprit)
+	}
+
+	usage = &feedMemUsage{encodeBuf: 100, dcpBuffer: 200}
+	if culprit := usage.culprit(); !strings.Contains(culprit, "dcp buffers") {
+		t.Errorf("expected dcp buffers as culprit, got %q", culprit)
+	}
+}
+
+func TestFeedMemUsageSharedFeed(t *testing.T) {
+	feeder := &dcpStreamFeeder{budgetKey: "t1"}
+	feeder.stats.Init(feeder)
+	feeder.stats.queuedBytes.Set(500)
+
+	ks := &KeyspaceIdStats{}
+	ks.Init()
+	ks.dcpStats["DCPMUX[b1/kv1]/1"] = &feeder.stats
+	fs := &FeedStats{}
+	fs.Init()
+	fs.keyspaceIdStats["b1"] = ks
+
+	if usage := newFeedMemUsage("t1", fs); usage.dcpBuffer != 500 {
+		t.Errorf("expected events queued on the shared feed to count, got %v", usage.dcpBuffer)
+	}
+	if usage := newFeedMemUsage("t2", fs); usage.dcpBuffer != 0 {
+		t.Errorf("expected events queued for other topics not to count, got %v", usage.dcpBuffer)
+	}
+
+	feeder.stats.closed.Set(true)
+	if usage := newFeedMemUsage("t1", fs); usage.dcpBuffer != 0 {
+		t.Errorf("expected closed feeders not to count, got %v", usage.dcpBuffer)
+	}
+}
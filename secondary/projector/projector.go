@@ -49,7 +49,8 @@ type Projector struct {
 	rw             sync.RWMutex
 	topics         map[string]*Feed // active topics
 	topicSerialize map[string]*sync.Mutex
-	config         c.Config // full configuration information.
+	dcpMuxes       *dcpStreamMuxes // shared dcp feeds, with stream ids
+	config         c.Config        // full configuration information.
 	// immutable config params
 	name        string // human readable name of the projector
 	clusterAddr string // kv cluster's address to connect
@@ -79,6 +80,8 @@ type Projector struct {
 	// this cpuLimit, projector would ignore the settings change
 	// and log an error (on console and in logs)
 	cpuLimit int32
+
+	samples int32 // running /sampleIndex requests
 }
 
 // NewProjector creates a news projector instance and
@@ -87,6 +90,7 @@ func NewProjector(config c.Config, certFile, keyFile, caFile string) *Projector
 	p := &Projector{
 		topics:               make(map[string]*Feed),
 		topicSerialize:       make(map[string]*sync.Mutex),
+		dcpMuxes:             newDcpStreamMuxes(),
 		pooln:                "default", // TODO: should this be configurable ?
 		certFile:             certFile,
 		keyFile:              keyFile,
@@ -302,6 +306,30 @@ func (p *Projector) ResetConfig(config c.Config) {
 		value := cv.Int()
 		p.statsCmdCh <- []interface{}{EVAL_STAT_LOGGING_THRESHOLD, value}
 	}
+	if cv, ok := config["projector.memBudget.feedBytes"]; ok {
+		value := cv.Int()
+		p.statsCmdCh <- []interface{}{MEM_BUDGET_UPDATE, value}
+	}
+	if cv, ok := config["projector.memBudget.checkInterval"]; ok {
+		value := cv.Int()
+		p.statsCmdCh <- []interface{}{MEM_BUDGET_INTERVAL_UPDATE, value}
+	}
+
+	if cv, ok := config["projector.jsEvaluator.timeout"]; ok {
+		protobuf.SetJSEvalTimeout(cv.Int())
+	}
+
+	if cv, ok := config["projector.jsEvaluator.maxStackSize"]; ok {
+		protobuf.SetJSMaxStackSize(cv.Int())
+	}
+
+	if cv, ok := config["projector.jsEvaluator.maxValueSize"]; ok {
+		protobuf.SetJSMaxValueSize(cv.Int())
+	}
+
+	if cv, ok := config["projector.jsEvaluator.maxMemory"]; ok {
+		protobuf.SetJSMaxMemory(cv.Int())
+	}
 
 	if cv, ok := config["projector.systemStatsCollectionInterval"]; ok {
 		memmanager.SetStatsCollectionInterval(int64(cv.Int()))
@@ -339,8 +367,32 @@ func (p *Projector) ResetConfig(config c.Config) {
 		memThrottler.SetMaintStreamMemThrottle(cv.Bool())
 	}
 
+	if cv, ok := config["projector.backfill.rateLimit"]; ok {
+		memThrottler.SetBackfillRateLimit(cv.Int())
+	}
+
+	if cv, ok := config["projector.backfill.maintPriority"]; ok {
+		memThrottler.SetBackfillMaintPriority(cv.Bool())
+	}
+
+	if cv, ok := config["projector.backfill.bucketWeights"]; ok {
+		memThrottler.SetBackfillBucketWeights(cv.String())
+	}
+
 	p.config = p.config.Override(config)
 
+	// backfill is not shaped on shared dcp connections, see memThrottler.
+	_, streamIdOk := config["projector.dcp.streamId"]
+	_, rateLimitOk := config["projector.backfill.rateLimit"]
+	streamId, sok := p.config["projector.dcp.streamId"]
+	rateLimit, rok := p.config["projector.backfill.rateLimit"]
+	if (streamIdOk || rateLimitOk) && sok && rok &&
+		streamId.Bool() && rateLimit.Int() > 0 {
+		fmsg := "%v projector.backfill.rateLimit does not shape index builds " +
+			"on dcp connections shared with projector.dcp.streamId\n"
+		logging.Warnf(fmsg, p.logPrefix)
+	}
+
 	// CPU-profiling
 	cpuProfile, ok := config["projector.cpuProfile"]
 	if ok && cpuProfile.Bool() && p.cpuProfFd == nil {
@@ -911,6 +963,8 @@ func (p *Projector) doStatistics() interface{} {
 		feeds.Set(topic, feed.GetStatistics())
 	}
 	stats.Set("feeds", feeds)
+	stats.Set("memBudget", p.statsMgr.getBudgetStats())
+	stats.Set("backfill", memThrottler.GetBackfillStats())
 	return map[string]interface{}(stats)
 }
 
@@ -0,0 +1,352 @@
+// REST endpoints to introspect topics, and to repair their feeds without an
+// indexer driving the repair:
+//
+//   GET  /topics                           summary of all topics.
+//   GET  /topics/<topic>                   keyspaces, engines, vbuckets and
+//                                          endpoints of the topic's feed.
+//   POST /topics/<topic>/restartVbuckets   JSON encoded RestartVbucketsRequest
+//   POST /topics/<topic>/repairEndpoints   JSON encoded RepairEndpointsRequest
+//
+// Repair requests go through the same path as the ones posted by indexer on
+// the adminport, hence are serialized with them. Restart timestamps and
+// opaque2 for a RestartVbucketsRequest are to be picked from the vbucket
+// state of the topic. A failed repair responds with a non-2xx status, along
+// with the error in the response.
+
+package projector
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	apcommon "github.com/couchbase/indexing/secondary/adminport/common"
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/dataport"
+	"github.com/couchbase/indexing/secondary/logging"
+	projC "github.com/couchbase/indexing/secondary/projector/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+	"github.com/golang/protobuf/proto"
+)
+
+// opaque for repair requests posted on REST, angioToken never reaches it.
+const restOpaque = uint16(0xFFFE)
+
+// a feed busy with a long running request is reported as such.
+const inspectTimeout = 5 * time.Second
+
+// feedState as inspected from feed's genServer.
+type feedState struct {
+	Topic     string                    `json:"topic"`
+	Opaque    uint16                    `json:"opaque"`
+	Async     bool                      `json:"async"`
+	Keyspaces map[string]*keyspaceState `json:"keyspaces"`
+	Endpoints map[string]*endpointState `json:"endpoints"`
+	ReqchLen  int                       `json:"reqchLen"`  // pending requests
+	BackchLen int                       `json:"backchLen"` // pending feedback
+}
+
+type keyspaceState struct {
+	Bucket      string                   `json:"bucket"`
+	Opaque2     uint64                   `json:"opaque2"`
+	NumEngines  int                      `json:"numEngines"`
+	Active      int                      `json:"active"`   // vbuckets streaming
+	Pending     int                      `json:"pending"`  // vbuckets requested
+	Rollback    int                      `json:"rollback"` // vbuckets to rollback
+	Refiltering []uint16                 `json:"refiltering,omitempty"`
+	Engines     map[uint64]*engineState  `json:"engines,omitempty"`
+	Vbuckets    map[uint16]*vbucketState `json:"vbuckets,omitempty"`
+}
+
+type engineState struct {
+	Index        string `json:"index"`
+	CollectionID string `json:"collectionId"`
+}
+
+type vbucketState struct {
+	State     string    `json:"state"` // active, pending or rollback
+	Vbuuid    uint64    `json:"vbuuid"`
+	Seqno     uint64    `json:"seqno"` // requested seqno, or rollback seqno
+	Snapshot  [2]uint64 `json:"snapshot"`
+	Manifest  string    `json:"manifest,omitempty"`
+	LastSeqno uint64    `json:"lastSeqno"` // last seqno sent to workers
+	Filter    string    `json:"filter,omitempty"`
+}
+
+type endpointState struct {
+	Active      bool  `json:"active"`
+	QueuedBytes int64 `json:"queuedBytes"`
+}
+
+// inspect the state of feed, called from genServer.
+func (feed *Feed) inspect() *feedState {
+	state := &feedState{
+		Topic:     feed.topic,
+		Opaque:    feed.opaque,
+		Async:     feed.async,
+		Keyspaces: make(map[string]*keyspaceState),
+		Endpoints: make(map[string]*endpointState),
+		ReqchLen:  len(feed.reqch),
+		BackchLen: len(feed.backch),
+	}
+
+	for keyspaceId, kvdata := range feed.kvdata {
+		ks := &keyspaceState{
+			Bucket:      kvdata.bucket,
+			Opaque2:     kvdata.opaque2,
+			Refiltering: kvdata.refilteringVbuckets(),
+			Engines:     make(map[uint64]*engineState),
+			Vbuckets:    make(map[uint16]*vbucketState),
+		}
+		for uuid, engine := range feed.engines[keyspaceId] {
+			ks.Engines[uuid] = &engineState{
+				Index:        engine.GetIndexName(),
+				CollectionID: engine.GetCollectionID(),
+			}
+		}
+		ks.NumEngines = len(ks.Engines)
+
+		addVbuckets := func(vbstate string, ts *protobuf.TsVbuuid) int {
+			for _, vbno := range c.Vbno32to16(ts.GetVbnos()) {
+				seqno, vbuuid, sStart, sEnd, manifest, _ := ts.Get(vbno)
+				vb := &vbucketState{
+					State:    vbstate,
+					Vbuuid:   vbuuid,
+					Seqno:    seqno,
+					Snapshot: [2]uint64{sStart, sEnd},
+					Manifest: manifest,
+					Filter:   feed.filters[keyspaceId][vbno],
+				}
+				if int(vbno) < len(kvdata.stats.vbseqnos) {
+					vb.LastSeqno = kvdata.stats.vbseqnos[vbno].Value()
+				}
+				ks.Vbuckets[vbno] = vb
+			}
+			return len(ts.GetVbnos())
+		}
+		ks.Rollback = addVbuckets("rollback", feed.rollTss[keyspaceId])
+		ks.Pending = addVbuckets("pending", feed.reqTss[keyspaceId])
+		ks.Active = addVbuckets("active", feed.actTss[keyspaceId])
+		state.Keyspaces[keyspaceId] = ks
+	}
+
+	for raddr, endpoint := range feed.endpoints {
+		endp := &endpointState{Active: endpoint.Ping()}
+		for _, value := range endpoint.GetStats() {
+			if val, ok := value.(*dataport.EndpointStats); ok {
+				endp.QueuedBytes = val.QueuedBytes()
+			}
+		}
+		state.Endpoints[raddr] = endp
+	}
+	return state
+}
+
+// summary of feed's state, without its engines and vbuckets.
+func (state *feedState) summary() *feedState {
+	summary := *state
+	summary.Keyspaces = make(map[string]*keyspaceState)
+	for keyspaceId, ks := range state.Keyspaces {
+		kssummary := *ks
+		kssummary.Engines, kssummary.Vbuckets = nil, nil
+		summary.Keyspaces[keyspaceId] = &kssummary
+	}
+	return &summary
+}
+
+// handle GET /topics
+func (p *Projector) handleTopics(w http.ResponseWriter, r *http.Request) {
+	if !p.validatePermission(w, r, "cluster.admin.internal.index!read") {
+		return
+	}
+	p.serveTopics(w, r)
+}
+
+func (p *Projector) serveTopics(w http.ResponseWriter, r *http.Request) {
+	logging.Infof("%s Request %q %q\n", p.logPrefix, r.Method, r.URL.Path)
+	if r.Method != "GET" {
+		http.Error(w, "only GET supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := make(map[string]interface{})
+	for _, feed := range p.GetFeeds() {
+		state, err := feed.Inspect(inspectTimeout)
+		if err != nil {
+			resp[feed.topic] = map[string]interface{}{"error": err.Error()}
+			continue
+		}
+		resp[feed.topic] = state.summary()
+	}
+	writeRESTResponse(w, http.StatusOK, map[string]interface{}{"topics": resp})
+}
+
+// handle GET /topics/<topic> and POST /topics/<topic>/<repair>
+func (p *Projector) handleTopic(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/topics/")
+	topic, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		topic, action = path[:i], path[i+1:]
+	}
+
+	switch action {
+	case "":
+		if !p.validatePermission(w, r, "cluster.admin.internal.index!read") {
+			return
+		}
+	case "restartVbuckets", "repairEndpoints":
+		if !p.validatePermission(w, r, "cluster.admin.internal.index!write") {
+			return
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown path %q", r.URL.Path), http.StatusNotFound)
+		return
+	}
+	p.serveTopic(w, r, topic, action)
+}
+
+func (p *Projector) serveTopic(
+	w http.ResponseWriter, r *http.Request, topic, action string) {
+
+	logging.Infof("%s Request %q %q\n", p.logPrefix, r.Method, r.URL.Path)
+	if topic == "" {
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+
+	if action == "" {
+		if r.Method != "GET" {
+			http.Error(w, "only GET supported", http.StatusMethodNotAllowed)
+			return
+		}
+		// not GetFeed(), that can block on a busy feed.
+		p.rw.RLock()
+		feed, ok := p.topics[topic]
+		p.rw.RUnlock()
+		if !ok {
+			http.Error(w, projC.ErrorTopicMissing.Error(), http.StatusNotFound)
+			return
+		}
+		state, err := feed.Inspect(inspectTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeRESTResponse(w, http.StatusOK, state)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "only POST supported", http.StatusMethodNotAllowed)
+		return
+	}
+	dataIn := make([]byte, r.ContentLength)
+	if err := requestRead(r.Body, dataIn); err != nil {
+		logging.Errorf("%v handleTopic() POST: %v\n", p.logPrefix, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp apcommon.MessageMarshaller
+	switch action {
+	case "restartVbuckets":
+		req := &protobuf.RestartVbucketsRequest{}
+		if !decodeRepairRequest(w, dataIn, req, &req.Topic, topic) {
+			return
+		} else if !req.Validate() {
+			http.Error(w, "invalid keyspaceIds for restartTimestamps", http.StatusBadRequest)
+			return
+		}
+		logging.Infof("%v ##%x handleTopic() restartVbuckets %v\n",
+			p.logPrefix, restOpaque, logging.TagUD(req))
+		resp = p.doRestartVbuckets(req, restOpaque)
+
+	case "repairEndpoints":
+		req := &protobuf.RepairEndpointsRequest{}
+		if !decodeRepairRequest(w, dataIn, req, &req.Topic, topic) {
+			return
+		}
+		logging.Infof("%v ##%x handleTopic() repairEndpoints %v\n",
+			p.logPrefix, restOpaque, req.GetEndpoints())
+		resp = p.doRepairEndpoints(req, restOpaque)
+	}
+	writeRESTResponse(w, repairStatus(resp), resp)
+}
+
+// repairStatus maps the error carried by the response of a repair request
+// to the HTTP status code of the response.
+func repairStatus(resp apcommon.MessageMarshaller) int {
+	var errstr string
+	switch val := resp.(type) {
+	case *protobuf.TopicResponse:
+		errstr = val.GetErr().GetError()
+	case *protobuf.Error:
+		errstr = val.GetError()
+	}
+
+	switch errstr {
+	case "":
+		return http.StatusOK
+	case projC.ErrorTopicMissing.Error():
+		return http.StatusNotFound
+	case projC.ErrorInvalidBucket.Error(), projC.ErrorInvalidVbucketBranch.Error(),
+		projC.ErrorInvalidVbucket.Error():
+		return http.StatusBadRequest
+	case projC.ErrorResponseTimeout.Error():
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// decodeRepairRequest from JSON, for `topic` in the request path.
+func decodeRepairRequest(
+	w http.ResponseWriter, data []byte, req interface{},
+	reqTopic **string, topic string) bool {
+
+	if err := json.Unmarshal(data, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	} else if *reqTopic != nil && **reqTopic != topic {
+		fmsg := "topic %q in request does not match %q"
+		http.Error(w, fmt.Sprintf(fmsg, **reqTopic, topic), http.StatusBadRequest)
+		return false
+	}
+	*reqTopic = proto.String(topic)
+	return true
+}
+
+func (p *Projector) validatePermission(
+	w http.ResponseWriter, r *http.Request, permission string) bool {
+
+	creds, valid := validateAuth(w, r)
+	if !valid {
+		return false
+	} else if creds != nil {
+		allowed, err := creds.IsAllowed(permission)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return false
+		} else if !allowed {
+			logging.Verbosef("projector::%v not enough permissions", r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(c.HTTP_STATUS_FORBIDDEN)
+			return false
+		}
+	}
+	return true
+}
+
+func writeRESTResponse(w http.ResponseWriter, status int, resp interface{}) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,211 @@
+package projector
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	projC "github.com/couchbase/indexing/secondary/projector/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+type testEvaluator struct {
+	c.Evaluator
+	index, collectionId string
+}
+
+func (ev *testEvaluator) GetIndexName() string    { return ev.index }
+func (ev *testEvaluator) GetCollectionID() string { return ev.collectionId }
+
+type testEndpoint struct {
+	c.RouterEndpoint
+	active bool
+}
+
+func (endp *testEndpoint) Ping() bool                       { return endp.active }
+func (endp *testEndpoint) GetStats() map[string]interface{} { return nil }
+
+func newRESTTestProjector() *Projector {
+	return &Projector{
+		topics:         make(map[string]*Feed),
+		topicSerialize: make(map[string]*sync.Mutex),
+		logPrefix:      "PROJ[test]",
+	}
+}
+
+func serveTopicRequest(
+	p *Projector, method, topic, action, body string) *httptest.ResponseRecorder {
+
+	path := "/topics/" + topic
+	if action != "" {
+		path += "/" + action
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	p.serveTopic(w, r, topic, action)
+	return w
+}
+
+func TestServeTopic(t *testing.T) {
+	p := newRESTTestProjector()
+
+	tests := []struct {
+		name, method, topic, action, body string
+		status                            int
+		errmsg                            string
+	}{
+		{"missing topic", "GET", "", "", "", http.StatusBadRequest, "missing topic"},
+		{"unknown topic", "GET", "t1", "", "", http.StatusNotFound, "projector.topicMissing"},
+		{"inspect with POST", "POST", "t1", "", "", http.StatusMethodNotAllowed, ""},
+		{"repair with GET", "GET", "t1", "repairEndpoints", "", http.StatusMethodNotAllowed, ""},
+		{"bad request", "POST", "t1", "repairEndpoints", "{", http.StatusBadRequest, ""},
+		{"topic mismatch", "POST", "t1", "repairEndpoints", `{"topic": "t2"}`,
+			http.StatusBadRequest, "does not match"},
+		{"repair unknown topic", "POST", "t1", "repairEndpoints", `{"endpoints": ["e1"]}`,
+			http.StatusNotFound, "projector.topicMissing"},
+		{"restart unknown topic", "POST", "t1", "restartVbuckets", `{}`,
+			http.StatusNotFound, "projector.topicMissing"},
+	}
+
+	for _, test := range tests {
+		w := serveTopicRequest(p, test.method, test.topic, test.action, test.body)
+		if w.Code != test.status || !strings.Contains(w.Body.String(), test.errmsg) {
+			t.Errorf("%v: expected %v %q, got %v %q", test.name, test.status, test.errmsg,
+				w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHandleTopicUnknownPath(t *testing.T) {
+	r := httptest.NewRequest("POST", "/topics/t1/shutdown", nil)
+	w := httptest.NewRecorder()
+	newRESTTestProjector().handleTopic(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestServeTopics(t *testing.T) {
+	p := newRESTTestProjector()
+
+	w := httptest.NewRecorder()
+	p.serveTopics(w, httptest.NewRequest("GET", "/topics", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"topics":{}}` ||
+		w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected response %v %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	p.serveTopics(w, httptest.NewRequest("POST", "/topics", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %v, got %v", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestRepairStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{nil, http.StatusOK},
+		{projC.ErrorTopicMissing, http.StatusNotFound},
+		{projC.ErrorInvalidBucket, http.StatusBadRequest},
+		{projC.ErrorInvalidVbucketBranch, http.StatusBadRequest},
+		{projC.ErrorInvalidVbucket, http.StatusBadRequest},
+		{projC.ErrorResponseTimeout, http.StatusServiceUnavailable},
+		{errors.New("feed.closed"), http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		if status := repairStatus(protobuf.NewError(test.err)); status != test.status {
+			t.Errorf("%v: expected %v, got %v", test.err, test.status, status)
+		}
+		resp := (&protobuf.TopicResponse{}).SetErr(test.err)
+		if status := repairStatus(resp); status != test.status {
+			t.Errorf("%v: expected %v, got %v", test.err, test.status, status)
+		}
+	}
+
+	if status := repairStatus(&protobuf.TopicResponse{}); status != http.StatusOK {
+		t.Errorf("expected a response without error to be ok, got %v", status)
+	}
+}
+
+func TestFeedInspect(t *testing.T) {
+	kvdata := &KVData{
+		bucket:   "b1",
+		opaque2:  7,
+		refilter: map[uint16]*refilterVb{3: {}},
+		stats:    &KvdataStats{},
+	}
+	kvdata.stats.Init(4, kvdata)
+	kvdata.stats.vbseqnos[1].Set(15)
+
+	engine := NewEngine(10, &testEvaluator{index: "idx1", collectionId: "8"}, nil)
+	feed := &Feed{
+		topic:     "t1",
+		opaque:    0x10,
+		reqch:     make(chan []interface{}, 4),
+		backch:    make(chan []interface{}, 4),
+		kvdata:    map[string]*KVData{"b1": kvdata},
+		engines:   map[string]map[uint64]*Engine{"b1": {10: engine}},
+		endpoints: map[string]c.RouterEndpoint{"e1": &testEndpoint{active: true}},
+		filters:   map[string]map[uint16]string{"b1": {1: "8"}},
+		rollTss: map[string]*protobuf.TsVbuuid{
+			"b1": protobuf.NewTsVbuuid("default", "b1", 4).Append(0, 5, 100, 0, 0, ""),
+		},
+		reqTss: map[string]*protobuf.TsVbuuid{
+			"b1": protobuf.NewTsVbuuid("default", "b1", 4).Append(2, 0, 300, 0, 0, ""),
+		},
+		actTss: map[string]*protobuf.TsVbuuid{
+			"b1": protobuf.NewTsVbuuid("default", "b1", 4).Append(1, 10, 200, 10, 20, "1"),
+		},
+	}
+	feed.reqch <- []interface{}{}
+
+	state := feed.inspect()
+	ks := state.Keyspaces["b1"]
+	if state.Topic != "t1" || state.Opaque != 0x10 || state.ReqchLen != 1 || ks == nil {
+		t.Fatalf("unexpected state %+v", state)
+	}
+	if ks.Bucket != "b1" || ks.Opaque2 != 7 || ks.NumEngines != 1 ||
+		ks.Active != 1 || ks.Pending != 1 || ks.Rollback != 1 ||
+		!reflect.DeepEqual(ks.Refiltering, []uint16{3}) {
+		t.Errorf("unexpected keyspace state %+v", *ks)
+	}
+	if engine := ks.Engines[10]; engine == nil || engine.Index != "idx1" || engine.CollectionID != "8" {
+		t.Errorf("unexpected engines %v", ks.Engines)
+	}
+
+	expected := map[uint16]vbucketState{
+		0: {State: "rollback", Vbuuid: 100, Seqno: 5},
+		1: {State: "active", Vbuuid: 200, Seqno: 10, Snapshot: [2]uint64{10, 20},
+			Manifest: "1", LastSeqno: 15, Filter: "8"},
+		2: {State: "pending", Vbuuid: 300},
+	}
+	if len(ks.Vbuckets) != len(expected) {
+		t.Fatalf("expected %v vbuckets, got %v", len(expected), len(ks.Vbuckets))
+	}
+	for vbno, vb := range expected {
+		if got := ks.Vbuckets[vbno]; got == nil || *got != vb {
+			t.Errorf("vbucket %v: expected %+v, got %+v", vbno, vb, got)
+		}
+	}
+	if endp := state.Endpoints["e1"]; endp == nil || !endp.Active {
+		t.Errorf("unexpected endpoints %v", state.Endpoints)
+	}
+
+	summary := state.summary()
+	if summary.Keyspaces["b1"].Engines != nil || summary.Keyspaces["b1"].Vbuckets != nil ||
+		summary.Keyspaces["b1"].Active != 1 {
+		t.Errorf("unexpected summary %+v", *summary.Keyspaces["b1"])
+	}
+	if ks.Engines == nil || ks.Vbuckets == nil {
+		t.Errorf("expected summary to leave the state alone")
+	}
+}
@@ -0,0 +1,548 @@
+package projector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/logging"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/collections"
+	couchbase "github.com/couchbase/indexing/secondary/dcp"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+	qexpr "github.com/couchbase/query/expression"
+	qvalue "github.com/couchbase/query/value"
+)
+
+var errSampleNoVbuckets = errors.New("sample: no vbuckets with documents on this node")
+var errSampleTooMany = errors.New("sample: too many sample requests, retry later")
+
+// SampleRequest for /sampleIndex, evaluates a candidate index definition
+// over a sample of documents backfilled from the local kv node.
+type SampleRequest struct {
+	Bucket        string   `json:"bucket"`
+	Scope         string   `json:"scope,omitempty"`
+	Collection    string   `json:"collection,omitempty"`
+	SecExprs      []string `json:"secExprs"`
+	WhereExpr     string   `json:"whereExpr,omitempty"`
+	PartnExprs    []string `json:"partnExprs,omitempty"`
+	NumPartitions int      `json:"numPartitions,omitempty"`
+	SampleSize    int      `json:"sampleSize,omitempty"`
+
+	IndexMissingLeadingKey bool `json:"indexMissingLeadingKey,omitempty"`
+}
+
+// SampleKey is the evaluated key of a sampled document.
+type SampleKey struct {
+	DocId    string          `json:"docid"`
+	Key      json.RawMessage `json:"key"`
+	PartnKey json.RawMessage `json:"partnKey,omitempty"`
+}
+
+// SampleKeySizes is the distribution of collated key sizes, Histogram
+// counts the keys of size upto each power of 2.
+type SampleKeySizes struct {
+	Min       int            `json:"min"`
+	Max       int            `json:"max"`
+	Avg       float64        `json:"avg"`
+	Histogram map[string]int `json:"histogram"`
+}
+
+// SampleResponse for /sampleIndex. Docs that fail the where predicate are
+// counted as Filtered, docs that do not produce a key, like those with a
+// missing leading key, as Skipped, and failed evaluations as Errors.
+//
+// EstimatedItems is the number of items in the collection extrapolated from
+// the seqnos covered by the sample, EstimatedSize is the size of the
+// index's keys and docids over those items, counting one entry per document
+// for array indexes.
+type SampleResponse struct {
+	Sampled     int            `json:"sampled"`
+	Indexed     int            `json:"indexed"`
+	Filtered    int            `json:"filtered"`
+	Skipped     int            `json:"skipped"`
+	Errors      int            `json:"errors"`
+	FirstErrors []string       `json:"firstErrors,omitempty"`
+	Keys        []SampleKey    `json:"keys"`
+	KeySizes    SampleKeySizes `json:"keySizes"`
+	Partitions  map[int]int    `json:"partitions,omitempty"`
+	AvgEvalTime int64          `json:"avgEvalTime"` // in nanoseconds
+
+	EstimatedItems uint64 `json:"estimatedItems"`
+	EstimatedSize  uint64 `json:"estimatedSize"`
+	Duration       int64  `json:"duration"` // in milliseconds
+}
+
+// handle index design requests to sample documents.
+func (p *Projector) handleSampleIndex(w http.ResponseWriter, r *http.Request) {
+	creds, valid := validateAuth(w, r)
+	if !valid {
+		return
+	}
+
+	logging.Infof("%s Request %q %q\n", p.logPrefix, r.Method, r.URL.Path)
+	if r.Method != "POST" {
+		http.Error(w, "only POST supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	dataIn := make([]byte, r.ContentLength)
+	if err := requestRead(r.Body, dataIn); err != nil {
+		logging.Errorf("%v handleSampleIndex() POST: %v\n", p.logPrefix, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &SampleRequest{}
+	if err := json.Unmarshal(dataIn, req); err != nil {
+		fmsg := "%v handleSampleIndex() json decoding: %v\n"
+		logging.Errorf(fmsg, p.logPrefix, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = c.DEFAULT_SCOPE
+	}
+	if req.Collection == "" {
+		req.Collection = c.DEFAULT_COLLECTION
+	}
+
+	// sampled keys are made of document values.
+	if creds != nil {
+		permission := fmt.Sprintf("cluster.collection[%s:%s:%s].data.docs!read",
+			req.Bucket, req.Scope, req.Collection)
+		allowed, err := creds.IsAllowed(permission)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		} else if !allowed {
+			logging.Verbosef("projector::handleSampleIndex not enough permissions")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write(c.HTTP_STATUS_FORBIDDEN)
+			return
+		}
+	}
+
+	config := p.GetConfig().SectionConfig("projector.", true /*trim*/)
+	sampler, err := newIndexSampler(req, config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// every sample backfills from kv with its own dcp feed.
+	if !p.acquireSample(config["sample.maxConcurrent"].Int()) {
+		fmsg := "%v handleSampleIndex(%v:%v:%v): too many sample requests\n"
+		logging.Warnf(fmsg, p.logPrefix, req.Bucket, req.Scope, req.Collection)
+		http.Error(w, errSampleTooMany.Error(), http.StatusTooManyRequests)
+		return
+	}
+	defer p.releaseSample()
+
+	kvaddr, err := p.getLocalKVAddr()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := sampler.run(p.clusterAddr, p.pooln, kvaddr)
+	if err != nil {
+		fmsg := "%v handleSampleIndex(%v:%v:%v): %v\n"
+		logging.Errorf(fmsg, p.logPrefix, req.Bucket, req.Scope, req.Collection, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json"}
+	w.Write(data)
+}
+
+// acquireSample admits a sample request if less than max are running.
+func (p *Projector) acquireSample(max int) bool {
+	if n := atomic.AddInt32(&p.samples, 1); int(n) > max {
+		atomic.AddInt32(&p.samples, -1)
+		return false
+	}
+	return true
+}
+
+func (p *Projector) releaseSample() {
+	atomic.AddInt32(&p.samples, -1)
+}
+
+func (p *Projector) getLocalKVAddr() (string, error) {
+	p.cinfoProviderLock.RLock()
+	defer p.cinfoProviderLock.RUnlock()
+
+	ninfo, err := p.cinfoProvider.GetNodesInfoProvider()
+	if err != nil {
+		return "", err
+	}
+	ninfo.RLock()
+	defer ninfo.RUnlock()
+	return ninfo.GetLocalServiceAddress("kv", false)
+}
+
+type indexSampler struct {
+	req       *SampleRequest
+	config    c.Config
+	logPrefix string
+
+	skExprs []interface{}
+	whExpr  interface{}
+	pkExprs []interface{}
+
+	numFlattenKeys int
+	sampleSize     int
+	maxKeys        int
+	encodeBuf      []byte
+	stats          *protobuf.IndexEvaluatorStats
+
+	resp     *SampleResponse
+	keySum   uint64 // of collated keys
+	docidSum uint64
+}
+
+func newIndexSampler(req *SampleRequest, config c.Config) (*indexSampler, error) {
+	if req.Bucket == "" {
+		return nil, fmt.Errorf("sample: missing bucket")
+	} else if len(req.SecExprs) == 0 {
+		return nil, fmt.Errorf("sample: missing secExprs")
+	}
+
+	s := &indexSampler{
+		req:        req,
+		config:     config,
+		logPrefix:  fmt.Sprintf("SAMPLE[%v:%v:%v]", req.Bucket, req.Scope, req.Collection),
+		sampleSize: config["sample.defaultSize"].Int(),
+		maxKeys:    config["sample.maxKeys"].Int(),
+		encodeBuf:  make([]byte, 0, config["encodeBufSize"].Int()),
+		stats:      &protobuf.IndexEvaluatorStats{},
+		resp: &SampleResponse{
+			Keys:     make([]SampleKey, 0),
+			KeySizes: SampleKeySizes{Histogram: make(map[string]int)},
+		},
+	}
+	s.stats.Init()
+	if req.SampleSize > 0 {
+		s.sampleSize = req.SampleSize
+	}
+	if max := config["sample.maxSize"].Int(); s.sampleSize > max {
+		s.sampleSize = max
+	}
+
+	var err error
+	if s.skExprs, err = protobuf.CompileN1QLExpression(req.SecExprs); err != nil {
+		return nil, err
+	}
+	for _, cExpr := range s.skExprs {
+		expr := cExpr.(qexpr.Expression)
+		if isArray, _, isFlattened := expr.IsArrayIndexKey(); isArray && isFlattened {
+			s.numFlattenKeys = expr.(*qexpr.All).FlattenSize()
+			break
+		}
+	}
+	if req.WhereExpr != "" {
+		cExprs, err := protobuf.CompileN1QLExpression([]string{req.WhereExpr})
+		if err != nil {
+			return nil, err
+		}
+		s.whExpr = cExprs[0]
+	}
+	if len(req.PartnExprs) > 0 {
+		if s.pkExprs, err = protobuf.CompileN1QLExpression(req.PartnExprs); err != nil {
+			return nil, err
+		}
+		if req.NumPartitions > 0 {
+			s.resp.Partitions = make(map[int]int)
+		}
+	}
+	return s, nil
+}
+
+// run backfills the collection on all local vbuckets, upto their current
+// seqnos, and evaluates the mutations until sampleSize documents are read.
+func (s *indexSampler) run(cluster, pooln, kvaddr string) (*SampleResponse, error) {
+	req := s.req
+	start := time.Now()
+
+	ah := &c.CbAuthHandler{Hostport: cluster, Bucket: req.Bucket}
+	couch, err := couchbase.ConnectWithAuth("http://"+cluster, ah)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := couch.GetPoolWithBucket(pooln, req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := pool.GetBucket(req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer bucket.Close()
+
+	cid := pool.GetCollectionID(req.Bucket, req.Scope, req.Collection)
+	if cid == collections.COLLECTION_ID_NIL {
+		return nil, fmt.Errorf("sample: unknown collection %v.%v", req.Scope, req.Collection)
+	}
+
+	binfo, err := c.NewBucketInfo(cluster, pooln, req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	vbnos, err := binfo.GetLocalVBuckets(req.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	seqnos, err := SeqnosLocal(cluster, pooln, req.Bucket, cid, kvaddr)
+	if err != nil {
+		return nil, err
+	}
+
+	uuid, err := c.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	name := newDCPConnectionName(req.Bucket, "sample", uuid.Uint64())
+	dcpConfig := map[string]interface{}{
+		"genChanSize":      s.config["dcp.genChanSize"].Int(),
+		"dataChanSize":     s.config["dcp.dataChanSize"].Int(),
+		"numConnections":   1,
+		"latencyTick":      s.config["dcp.latencyTick"].Int(),
+		"activeVbOnly":     true,
+		"collectionsAware": true,
+		"osoSnapshot":      false,
+		"snappy":           s.config["dcp.snappy"].Bool(),
+	}
+	opaque := uint16(0xFFFF)
+	dcpFeed, err := bucket.StartDcpFeedOver(
+		name, uint32(0), uint32(0), []string{kvaddr}, opaque, dcpConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer dcpFeed.Close()
+
+	// seqnos of the collection's documents to be read, and read so far.
+	highSeqnos, readSeqnos := make(map[uint16]uint64), make(map[uint16]uint64)
+	for _, vbno := range vbnos {
+		if int(vbno) >= len(seqnos) || seqnos[vbno] == 0 {
+			continue
+		}
+		highSeqnos[vbno] = seqnos[vbno]
+		err := dcpFeed.DcpRequestStream(
+			vbno, opaque, 0 /*flags*/, 0 /*vbuuid*/, 0, seqnos[vbno], 0, 0,
+			"" /*manifestUID*/, "" /*scopeId*/, []string{cid})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(highSeqnos) == 0 {
+		return nil, errSampleNoVbuckets
+	}
+	logging.Infof("%v sampling %v docs from %v vbuckets\n",
+		s.logPrefix, s.sampleSize, len(highSeqnos))
+
+	timeout := time.After(time.Duration(s.config["sample.timeout"].Int()) * time.Millisecond)
+	pending := len(highSeqnos)
+
+loop:
+	for pending > 0 && s.resp.Sampled < s.sampleSize {
+		select {
+		case m, ok := <-dcpFeed.C:
+			if !ok {
+				return nil, fmt.Errorf("sample: dcp feed closed")
+			}
+			switch m.Opcode {
+			case mcd.DCP_STREAMREQ:
+				if m.Status != mcd.SUCCESS {
+					fmsg := "%v stream request for vb %v: %v\n"
+					logging.Warnf(fmsg, s.logPrefix, m.VBucket, m.Status)
+					delete(highSeqnos, m.VBucket)
+					pending--
+				}
+			case mcd.DCP_MUTATION:
+				readSeqnos[m.VBucket] = m.Seqno
+				s.sample(m)
+			case mcd.DCP_DELETION, mcd.DCP_EXPIRATION:
+				readSeqnos[m.VBucket] = m.Seqno
+			case mcd.DCP_STREAMEND:
+				readSeqnos[m.VBucket] = highSeqnos[m.VBucket]
+				pending--
+			}
+
+		case <-timeout:
+			logging.Warnf("%v timeout after %v docs\n", s.logPrefix, s.resp.Sampled)
+			break loop
+		}
+	}
+
+	s.finish(highSeqnos, readSeqnos, bucket.NumVBuckets, len(vbnos))
+	s.resp.Duration = int64(time.Since(start) / time.Millisecond)
+	return s.resp, nil
+}
+
+// sample evaluates a mutation the way IndexEvaluator does.
+func (s *indexSampler) sample(m *mc.DcpEvent) {
+	resp := s.resp
+	resp.Sampled++
+
+	key, pkey, where, err := s.evaluate(m, true /*collate*/)
+	if err != nil {
+		resp.Errors++
+		if len(resp.FirstErrors) < 10 {
+			msg := fmt.Sprintf("%s: %v", logging.TagUD(string(m.Key)), err)
+			resp.FirstErrors = append(resp.FirstErrors, msg)
+		}
+		return
+	} else if !where {
+		resp.Filtered++
+		return
+	} else if key == nil {
+		resp.Skipped++
+		return
+	}
+
+	resp.Indexed++
+	size := len(key)
+	if resp.Indexed == 1 || size < resp.KeySizes.Min {
+		resp.KeySizes.Min = size
+	}
+	if size > resp.KeySizes.Max {
+		resp.KeySizes.Max = size
+	}
+	upto := 16
+	for upto < size {
+		upto *= 2
+	}
+	resp.KeySizes.Histogram[fmt.Sprintf("%d", upto)]++
+	s.keySum += uint64(size)
+	s.docidSum += uint64(len(m.Key))
+
+	if resp.Partitions != nil && pkey != nil {
+		partnId := c.HashKeyPartition(pkey, s.req.NumPartitions, c.CRC32)
+		resp.Partitions[int(partnId)]++
+	}
+
+	if len(resp.Keys) < s.maxKeys {
+		// return the key as JSON, the collated key is only sized.
+		key, _, _, err := s.evaluate(m, false /*collate*/)
+		if err == nil && key != nil {
+			resp.Keys = append(resp.Keys, SampleKey{
+				DocId:    string(m.Key),
+				Key:      json.RawMessage(key),
+				PartnKey: json.RawMessage(pkey),
+			})
+		}
+	}
+}
+
+func (s *indexSampler) evaluate(
+	m *mc.DcpEvent, collate bool) (key, pkey []byte, where bool, err error) {
+
+	defer func() { // panic safe
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	var nvalue qvalue.Value
+	if m.IsJSON() {
+		nvalue = qvalue.NewParsedValueWithOptions(m.Value, true, true)
+	} else {
+		nvalue = qvalue.NewBinaryValue(m.Value)
+	}
+	context := qexpr.NewIndexContext()
+	docval := qvalue.NewAnnotatedValue(nvalue)
+	s.event2Meta(m, docval)
+
+	if s.whExpr != nil {
+		out, _, err := protobuf.N1QLTransform(nil, docval, context,
+			[]interface{}{s.whExpr}, 0, nil, s.stats, false)
+		if err != nil || out == nil || string(out) != "true" {
+			return nil, nil, false, err // missing is treated as false
+		}
+	}
+	if s.pkExprs != nil {
+		pkey, _, err = protobuf.N1QLTransform(m.Key, docval, context,
+			s.pkExprs, 0, nil, s.stats, s.req.IndexMissingLeadingKey)
+		if err != nil {
+			return nil, nil, true, err
+		}
+	}
+
+	var encodeBuf []byte
+	if collate {
+		encodeBuf = s.encodeBuf
+	}
+	key, newBuf, err := protobuf.N1QLTransform(m.Key, docval, context,
+		s.skExprs, s.numFlattenKeys, encodeBuf, s.stats,
+		s.req.IndexMissingLeadingKey)
+	if newBuf != nil {
+		s.encodeBuf = newBuf
+	}
+	return key, pkey, true, err
+}
+
+func (s *indexSampler) event2Meta(m *mc.DcpEvent, docval qvalue.AnnotatedValue) {
+	if len(m.RawXATTR) > 0 && m.ParsedXATTR == nil {
+		m.ParsedXATTR = make(map[string]interface{})
+		for xattr, raw := range m.RawXATTR {
+			if len(raw) != 0 {
+				m.ParsedXATTR[xattr] = qvalue.NewParsedValueWithOptions(raw, true, true)
+			}
+		}
+	}
+
+	meta := docval.NewMeta()
+	meta["byseqno"] = m.Seqno
+	meta["revseqno"] = m.RevSeqno
+	meta["flags"] = m.Flags
+	meta["expiration"] = m.Expiry
+	meta["locktime"] = m.LockTime
+	meta["nru"] = m.Nru
+	meta["cas"] = m.Cas
+	meta["xattrs"] = m.ParsedXATTR
+	docval.SetId(string(m.Key))
+}
+
+// finish extrapolates the sample to the collection, assuming documents
+// are evenly spread across seqnos and vbuckets.
+func (s *indexSampler) finish(
+	highSeqnos, readSeqnos map[uint16]uint64, numVBuckets, numLocal int) {
+
+	resp := s.resp
+	if resp.Indexed > 0 {
+		resp.KeySizes.Avg = float64(s.keySum) / float64(resp.Indexed)
+	}
+	if count := s.stats.Count.Value(); count > 0 {
+		resp.AvgEvalTime = s.stats.TotalDur.Value() / count
+	}
+
+	var high, read uint64
+	for vbno, seqno := range highSeqnos {
+		high += seqno
+		read += readSeqnos[vbno]
+	}
+	if read == 0 || numLocal == 0 {
+		return
+	}
+	items := float64(resp.Sampled) * float64(high) / float64(read)
+	items = items * float64(numVBuckets) / float64(numLocal)
+	resp.EstimatedItems = uint64(items)
+	if resp.Indexed > 0 {
+		entrySize := float64(s.keySum+s.docidSum) / float64(resp.Indexed)
+		indexed := items * float64(resp.Indexed) / float64(resp.Sampled)
+		resp.EstimatedSize = uint64(indexed * entrySize)
+	}
+}
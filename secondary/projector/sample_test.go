@@ -0,0 +1,204 @@
+package projector
+
+import (
+	"testing"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+)
+
+func sampleConfig() c.Config {
+	return c.SystemConfig.SectionConfig("projector.", true /*trim*/)
+}
+
+func sampleDoc(key, value string) *mc.DcpEvent {
+	return &mc.DcpEvent{
+		Opcode:   mcd.DCP_MUTATION,
+		Key:      []byte(key),
+		Value:    []byte(value),
+		Datatype: 0x01, // JSON
+		Seqno:    1,
+	}
+}
+
+func TestNewIndexSampler(t *testing.T) {
+	config := sampleConfig()
+
+	if _, err := newIndexSampler(&SampleRequest{SecExprs: []string{"`age`"}}, config); err == nil {
+		t.Errorf("expected an error without bucket")
+	}
+	if _, err := newIndexSampler(&SampleRequest{Bucket: "b1"}, config); err == nil {
+		t.Errorf("expected an error without secExprs")
+	}
+	if _, err := newIndexSampler(&SampleRequest{Bucket: "b1", SecExprs: []string{"`age` +"}}, config); err == nil {
+		t.Errorf("expected an error for an invalid expression")
+	}
+
+	req := &SampleRequest{Bucket: "b1", SecExprs: []string{"`age`"}}
+	s, err := newIndexSampler(req, config)
+	if err != nil {
+		t.Fatalf("newIndexSampler unexpected error %v", err)
+	} else if s.sampleSize != config["sample.defaultSize"].Int() {
+		t.Errorf("expected default sample size, got %v", s.sampleSize)
+	}
+
+	req.SampleSize = config["sample.maxSize"].Int() + 1
+	if s, err = newIndexSampler(req, config); err != nil {
+		t.Fatalf("newIndexSampler unexpected error %v", err)
+	} else if s.sampleSize != config["sample.maxSize"].Int() {
+		t.Errorf("expected sample size to be capped, got %v", s.sampleSize)
+	}
+}
+
+func TestIndexSamplerEvaluate(t *testing.T) {
+	req := &SampleRequest{
+		Bucket:        "b1",
+		SecExprs:      []string{"`age`"},
+		WhereExpr:     "(`age` > 10)",
+		PartnExprs:    []string{"`name`"},
+		NumPartitions: 4,
+	}
+	s, err := newIndexSampler(req, sampleConfig())
+	if err != nil {
+		t.Fatalf("newIndexSampler unexpected error %v", err)
+	}
+
+	m := sampleDoc("doc1", `{"age": 20, "name": "a"}`)
+	key, pkey, where, err := s.evaluate(m, false /*collate*/)
+	if err != nil || !where {
+		t.Fatalf("evaluate unexpected result %v, %v", where, err)
+	}
+	if string(key) != "[20]" || string(pkey) != `["a"]` {
+		t.Errorf("evaluate unexpected keys %s, %s", key, pkey)
+	}
+	collated, _, _, err := s.evaluate(m, true /*collate*/)
+	if err != nil || collated == nil || string(collated) == string(key) {
+		t.Errorf("evaluate expected a collated key, got %s, %v", collated, err)
+	}
+
+	// documents that do not match, or miss, the where predicate
+	for _, value := range []string{`{"age": 5}`, `{"name": "b"}`} {
+		key, _, where, err := s.evaluate(sampleDoc("doc2", value), false)
+		if err != nil || where || key != nil {
+			t.Errorf("evaluate(%v) expected to filter, got %s, %v, %v", value, key, where, err)
+		}
+	}
+
+	// binary documents have no fields.
+	bin := sampleDoc("doc3", "abc")
+	bin.Datatype = 0
+	if key, _, where, err := s.evaluate(bin, false); err != nil || where || key != nil {
+		t.Errorf("evaluate expected to filter binary document, got %s, %v, %v", key, where, err)
+	}
+}
+
+func TestIndexSamplerSample(t *testing.T) {
+	req := &SampleRequest{
+		Bucket:        "b1",
+		SecExprs:      []string{"`age`"},
+		PartnExprs:    []string{"meta().id"},
+		NumPartitions: 4,
+	}
+	s, err := newIndexSampler(req, sampleConfig())
+	if err != nil {
+		t.Fatalf("newIndexSampler unexpected error %v", err)
+	}
+	s.maxKeys = 2
+
+	docs := []*mc.DcpEvent{
+		sampleDoc("doc1", `{"age": 1}`),
+		sampleDoc("doc2", `{"age": "a long string value of the age"}`),
+		sampleDoc("doc3", `{"name": "missing leading key"}`),
+		sampleDoc("doc4", `{"age": 4}`),
+	}
+	for _, m := range docs {
+		s.sample(m)
+	}
+
+	resp := s.resp
+	if resp.Sampled != 4 || resp.Indexed != 3 || resp.Skipped != 1 ||
+		resp.Filtered != 0 || resp.Errors != 0 {
+		t.Fatalf("unexpected counts %+v", resp)
+	}
+	if len(resp.Keys) != 2 || resp.Keys[0].DocId != "doc1" || string(resp.Keys[0].Key) != "[1]" {
+		t.Errorf("expected the first 2 keys, got %+v", resp.Keys)
+	}
+
+	partitioned := 0
+	for partnId, count := range resp.Partitions {
+		if partnId < 0 || partnId >= req.NumPartitions {
+			t.Errorf("unexpected partition %v", partnId)
+		}
+		partitioned += count
+	}
+	if partitioned != resp.Indexed {
+		t.Errorf("expected %v partitioned keys, got %v", resp.Indexed, resp.Partitions)
+	}
+
+	sized := 0
+	for _, count := range resp.KeySizes.Histogram {
+		sized += count
+	}
+	if sized != resp.Indexed || resp.KeySizes.Min == 0 ||
+		resp.KeySizes.Min >= resp.KeySizes.Max {
+		t.Errorf("unexpected key sizes %+v", resp.KeySizes)
+	}
+	if s.docidSum != 12 {
+		t.Errorf("expected docid sizes of 12, got %v", s.docidSum)
+	}
+}
+
+func TestIndexSamplerFinish(t *testing.T) {
+	req := &SampleRequest{Bucket: "b1", SecExprs: []string{"`age`"}}
+	s, err := newIndexSampler(req, sampleConfig())
+	if err != nil {
+		t.Fatalf("newIndexSampler unexpected error %v", err)
+	}
+
+	// nothing read, nothing to extrapolate.
+	s.finish(map[uint16]uint64{0: 1000}, map[uint16]uint64{}, 1024, 2)
+	if s.resp.EstimatedItems != 0 || s.resp.EstimatedSize != 0 {
+		t.Errorf("expected no estimates, got %+v", s.resp)
+	}
+
+	// 100 docs sampled over 200 of 2000 seqnos, on 2 of 1024 vbuckets.
+	s.resp.Sampled, s.resp.Indexed = 100, 50
+	s.keySum, s.docidSum = 50*20, 50*10
+	high := map[uint16]uint64{0: 1000, 1: 1000}
+	read := map[uint16]uint64{0: 100, 1: 100}
+	s.finish(high, read, 1024, 2)
+
+	if s.resp.KeySizes.Avg != 20 {
+		t.Errorf("expected average key size 20, got %v", s.resp.KeySizes.Avg)
+	}
+	if s.resp.EstimatedItems != 512000 {
+		t.Errorf("expected 512000 items, got %v", s.resp.EstimatedItems)
+	}
+	// half the items are indexed, with 30 bytes per entry.
+	if s.resp.EstimatedSize != 256000*30 {
+		t.Errorf("expected size %v, got %v", 256000*30, s.resp.EstimatedSize)
+	}
+}
+
+func TestAcquireSample(t *testing.T) {
+	p := &Projector{}
+	if !p.acquireSample(2) || !p.acquireSample(2) {
+		t.Fatalf("expected 2 samples to be admitted")
+	}
+	if p.acquireSample(2) {
+		t.Fatalf("expected a third sample to be rejected")
+	}
+	p.releaseSample()
+	if !p.acquireSample(2) {
+		t.Fatalf("expected a sample to be admitted after release")
+	}
+	p.releaseSample()
+	p.releaseSample()
+	if p.acquireSample(0) {
+		t.Errorf("expected no sample to be admitted with a limit of 0")
+	}
+	if p.samples != 0 {
+		t.Errorf("expected no running samples, got %v", p.samples)
+	}
+}
@@ -1,6 +1,7 @@
 package projector
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync/atomic"
 	"time"
@@ -25,6 +26,8 @@ const (
 	STATS_LOG_INTERVAL_UPDATE
 	VBSEQNOS_LOG_INTERVAL_UPDATE
 	EVAL_STAT_LOGGING_THRESHOLD
+	MEM_BUDGET_UPDATE
+	MEM_BUDGET_INTERVAL_UPDATE
 )
 
 type KeyspaceIdStats struct {
@@ -181,6 +184,10 @@ type statsManager struct {
 	evalStatLoggingThreshold int64
 	lastStatTime             time.Time
 	config                   common.ConfigHolder
+
+	memBudget         int64        // memory budget of each feed, in bytes
+	memBudgetInterval int64        // in milliseconds
+	budgetStats       atomic.Value // outcome of last budget check
 }
 
 func NewStatsManager(cmdCh chan []interface{}, stopCh chan bool, config common.Config) *statsManager {
@@ -215,14 +222,28 @@ func NewStatsManager(cmdCh chan []interface{}, stopCh chan bool, config common.C
 	// Use default value of 300 seconds
 	atomic.StoreInt64(&sm.evalStatsLogInterval, int64(defaultEvalStatsLogInterval))
 
+	if val, ok := config["projector.memBudget.feedBytes"]; ok {
+		atomic.StoreInt64(&sm.memBudget, int64(val.Int()))
+	} else {
+		atomic.StoreInt64(&sm.memBudget, int64(defaultMemBudget))
+	}
+
+	if val, ok := config["projector.memBudget.checkInterval"]; ok {
+		atomic.StoreInt64(&sm.memBudgetInterval, int64(val.Int()))
+	} else {
+		atomic.StoreInt64(&sm.memBudgetInterval, int64(defaultMemBudgetInterval))
+	}
+
 	logging.Infof("StatsManager: Stats logging interval set to: %v seconds", atomic.LoadInt64(&sm.statsLogDumpInterval))
 	logging.Infof("StatsManager: vbseqnos logging interval set to: %v seconds", atomic.LoadInt64(&sm.vbseqnosLogInterval))
 	logging.Infof("StatsManager: eval stats logging interval set to: %v seconds", atomic.LoadInt64(&sm.evalStatsLogInterval))
 	logging.Infof("StatsManager: eval stats logging threshold set to: %v microseconds", atomic.LoadInt64(&sm.evalStatLoggingThreshold))
+	logging.Infof("StatsManager: memory budget of feeds set to: %v bytes", atomic.LoadInt64(&sm.memBudget))
 
 	sm.config.Store(config)
 	go sm.run()
 	go sm.logger()
+	go sm.budgetMonitor()
 	return sm
 }
 
@@ -243,6 +264,13 @@ func (sm *statsManager) run() {
 			case EVAL_STAT_LOGGING_THRESHOLD:
 				val := msg[1].(int)
 				atomic.StoreInt64(&sm.evalStatLoggingThreshold, int64(val))
+			case MEM_BUDGET_UPDATE:
+				val := msg[1].(int)
+				atomic.StoreInt64(&sm.memBudget, int64(val))
+				logging.Infof("StatsManager: memory budget of feeds set to: %v bytes", val)
+			case MEM_BUDGET_INTERVAL_UPDATE:
+				val := msg[1].(int)
+				atomic.StoreInt64(&sm.memBudgetInterval, int64(val))
 			}
 		case <-sm.stopCh:
 			atomic.StoreInt32(&sm.stopLogger, 1)
@@ -294,6 +322,13 @@ func (sm *statsManager) logger() {
 								} else {
 									logging.Tracef("%v closed", key)
 								}
+							case *dcpFeederStats:
+								val := value.(*dcpFeederStats)
+								if !val.IsClosed() {
+									logging.Infof("%v stats: %v", key, val.String())
+								} else {
+									logging.Tracef("%v closed", key)
+								}
 							default:
 								logging.Errorf("Unknown Dcp stats type for %v", key)
 								continue
@@ -433,15 +468,69 @@ func (sm *statsManager) logger() {
 	}
 }
 
+// sharedExprStats is the logged stats of an expression shared by the
+// indexes of a collection, accumulated across workers.
+type sharedExprStats struct {
+	Count      int64 `json:"count"`
+	AvgLatency int64 `json:"avgLatency"`
+	Hits       int64 `json:"hits"`
+	Refs       int64 `json:"refs"`
+}
+
+// sharedExprsJSON returns the stats of shared expressions as a JSON
+// object keyed by the expression.
+func sharedExprsJSON(exprStats map[string]*[4]int64) string {
+	stats := make(map[string]sharedExprStats, len(exprStats))
+	for expr, acc := range exprStats {
+		avg := int64(0)
+		if acc[0] > 0 {
+			avg = acc[1] / acc[0]
+		}
+		stats[fmt.Sprint(logging.TagUD(expr))] = sharedExprStats{
+			Count: acc[0], AvgLatency: avg, Hits: acc[2], Refs: acc[3],
+		}
+	}
+	buf, err := json.Marshal(stats)
+	if err != nil {
+		return "{}"
+	}
+	return string(buf)
+}
+
 func Accmulate(wrkr []interface{}) string {
 	var dataChLen, outgoingMut, updateSeqno, txnSystemMut uint64
+	var encodeBuf int64
+	exprStats := make(map[string]*[4]int64) // expr -> count, totalDur, hits, refs
 	for _, stats := range wrkr {
 		wrkrStat := stats.(*WorkerStats)
 		dataChLen += (uint64)(len(wrkrStat.datach))
 		outgoingMut += wrkrStat.outgoingMut.Value()
 		updateSeqno += wrkrStat.updateSeqno.Value()
 		txnSystemMut += wrkrStat.txnSystemMut.Value()
+		encodeBuf += wrkrStat.encodeBuf.Value()
+		if wrkrStat.exprs == nil {
+			continue
+		}
+		for _, shared := range wrkrStat.exprs.Get() {
+			for expr, st := range shared.Stats() {
+				acc, ok := exprStats[expr]
+				if !ok {
+					acc = &[4]int64{}
+					exprStats[expr] = acc
+				}
+				acc[0] += st.Count.Value()
+				acc[1] += st.TotalDur.Value()
+				acc[2] += st.Hits.Value()
+				if refs := st.Refs.Value(); refs > acc[3] {
+					acc[3] = refs
+				}
+			}
+		}
+	}
+	sharedExprs := ""
+	if len(exprStats) > 0 {
+		sharedExprs = ",\"sharedExprs\":" + sharedExprsJSON(exprStats)
 	}
 	return fmt.Sprintf(
-		"{\"datachLen\":%v,\"outgoingMut\":%v,\"updateSeqno\":%v,\"txnSystemMut\":%v}", dataChLen, outgoingMut, updateSeqno, txnSystemMut)
+		"{\"datachLen\":%v,\"outgoingMut\":%v,\"updateSeqno\":%v,\"txnSystemMut\":%v,\"encodeBuf\":%v%v}", dataChLen, outgoingMut, updateSeqno, txnSystemMut, encodeBuf, sharedExprs)
 }
@@ -0,0 +1,39 @@
+package projector
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+func TestSharedExprsJSON(t *testing.T) {
+	exprStats := map[string]*[4]int64{
+		"`city`":                 {4, 400, 2, 3},
+		`(type = "user\\admin")`: {0, 0, 0, 2},
+		"`name`\té <tag>":        {2, 10, 1, 2},
+	}
+
+	var stats map[string]sharedExprStats
+	if err := json.Unmarshal([]byte(sharedExprsJSON(exprStats)), &stats); err != nil {
+		t.Fatalf("expected valid JSON, got %v", err)
+	}
+	if len(stats) != len(exprStats) {
+		t.Fatalf("expected %v expressions, got %v", len(exprStats), stats)
+	}
+	for expr, acc := range exprStats {
+		st, ok := stats[fmt.Sprint(logging.TagUD(expr))]
+		if !ok {
+			t.Errorf("missing expression %v in %v", expr, stats)
+			continue
+		}
+		avg := int64(0)
+		if acc[0] > 0 {
+			avg = acc[1] / acc[0]
+		}
+		if st.Count != acc[0] || st.AvgLatency != avg || st.Hits != acc[2] || st.Refs != acc[3] {
+			t.Errorf("unexpected stats of %v: %+v", expr, st)
+		}
+	}
+}
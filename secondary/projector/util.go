@@ -5,6 +5,7 @@ import (
 	"unsafe"
 
 	c "github.com/couchbase/indexing/secondary/common"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 )
 
 type EngineMap map[uint64]*Engine //Index instanceId -> Engine mapping
@@ -38,6 +39,22 @@ func CloneEngines(engines map[uint32]EngineMap) map[uint32]EngineMap {
 	return clone
 }
 
+type SharedExprsMapHolder struct {
+	ptr unsafe.Pointer
+}
+
+func (e *SharedExprsMapHolder) Get() map[uint32]*protobuf.SharedExprs {
+	if ptr := atomic.LoadPointer(&e.ptr); ptr != nil {
+		return *(*map[uint32]*protobuf.SharedExprs)(ptr)
+	} else {
+		return make(map[uint32]*protobuf.SharedExprs) // return empty map
+	}
+}
+
+func (e *SharedExprsMapHolder) Set(exprs map[uint32]*protobuf.SharedExprs) {
+	atomic.StorePointer(&e.ptr, unsafe.Pointer(&exprs))
+}
+
 type EndpointMapHolder struct {
 	ptr unsafe.Pointer
 }
@@ -36,6 +36,7 @@ import (
 
 	c "github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 	"github.com/couchbase/indexing/secondary/stats"
 )
 
@@ -54,6 +55,7 @@ type VbucketWorker struct {
 	vbuckets   *VbucketMapHolder
 	// evaluators and subscribers
 	engines   *CollectionsEngineMapHolder // CollectionId -> instanceId -> engine
+	exprs     *SharedExprsMapHolder       // CollectionId -> shared expressions
 	endpoints *EndpointMapHolder          // Endpoint address -> RouterEndpoint
 
 	mutex sync.Mutex // Mutex protecting the endpoint updates from genServer() and run() routines
@@ -88,6 +90,8 @@ type WorkerStats struct {
 	outgoingMut  stats.Uint64Val // Number of mutations consumed from this worker
 	updateSeqno  stats.Uint64Val // Number of updateSeqno messages sent by this worker
 	txnSystemMut stats.Uint64Val // Number of mutations skipped for transactions
+	encodeBuf    stats.Int64Val  // Capacity of this worker's encode buffer
+	exprs        *SharedExprsMapHolder
 }
 
 func (stats *WorkerStats) Init() {
@@ -95,6 +99,7 @@ func (stats *WorkerStats) Init() {
 	stats.outgoingMut.Init()
 	stats.updateSeqno.Init()
 	stats.txnSystemMut.Init()
+	stats.encodeBuf.Init()
 }
 
 func (stats *WorkerStats) IsClosed() bool {
@@ -121,6 +126,7 @@ func NewVbucketWorker(
 		config:                  config,
 		vbuckets:                &VbucketMapHolder{},
 		engines:                 &CollectionsEngineMapHolder{},
+		exprs:                   &SharedExprsMapHolder{},
 		endpoints:               &EndpointMapHolder{},
 		sbch:                    make(chan []interface{}, mutChanSize),
 		datach:                  make(chan []interface{}, mutChanSize),
@@ -136,6 +142,8 @@ func NewVbucketWorker(
 	}
 	worker.stats.Init()
 	worker.stats.datach = worker.datach
+	worker.stats.encodeBuf.Set(int64(encodeBufSize))
+	worker.stats.exprs = worker.exprs
 	worker.osoSnapshot = feed.osoSnapshot[keyspaceId]
 	fmsg := "WRKR[%v<-%v<-%v #%v]"
 	worker.logPrefix = fmt.Sprintf(fmsg, id, keyspaceId, feed.cluster, feed.topic)
@@ -313,6 +321,7 @@ loop:
 
 		case <-ticker.C:
 			worker.resizeEncodeBuf()
+			worker.stats.encodeBuf.Set(int64(cap(worker.encodeBuf)))
 
 		case <-worker.runFinCh:
 			break loop
@@ -380,6 +389,7 @@ func (worker *VbucketWorker) handleCommand(msg []interface{}) bool {
 				logging.Tracef(fmsg, worker.logPrefix, opaque, uuid)
 			}
 			worker.engines.Set(engines)
+			worker.exprs.Set(worker.shareExprs(engines))
 			worker.printCtrl(worker.engines.Get())
 		}
 		if msg[3] != nil {
@@ -418,6 +428,7 @@ func (worker *VbucketWorker) handleCommand(msg []interface{}) bool {
 			logging.Tracef(fmsg, worker.logPrefix, opaque, uuid)
 		}
 		worker.engines.Set(engines)
+		worker.exprs.Set(worker.shareExprs(engines))
 
 		fmsg = "%v ##%x deleted engines %v\n"
 		logging.Tracef(fmsg, worker.logPrefix, opaque, engineKeys)
@@ -441,8 +452,13 @@ func (worker *VbucketWorker) handleCommand(msg []interface{}) bool {
 	case vwCmdResetConfig:
 		config, respch := msg[1].(c.Config), msg[2].(chan []interface{})
 		worker.mutex.Lock()
+		shared := worker.config["sharedExprs"].Value
 		worker.config = config
 		worker.mutex.Unlock()
+		// share, or stop sharing, the expressions of the current engines.
+		if cv, ok := config["sharedExprs"]; ok && cv.Value != shared {
+			worker.exprs.Set(worker.shareExprs(worker.engines.Get()))
+		}
 		respch <- []interface{}{nil}
 
 	case vwCmdClose:
@@ -459,6 +475,30 @@ func (worker *VbucketWorker) handleCommand(msg []interface{}) bool {
 	return false
 }
 
+// expressions shared by the engines of each collection, evaluated once
+// per document.
+func (worker *VbucketWorker) shareExprs(
+	engines map[uint32]EngineMap) map[uint32]*protobuf.SharedExprs {
+
+	exprs := make(map[uint32]*protobuf.SharedExprs)
+	if !worker.config["sharedExprs"].Bool() {
+		return exprs
+	}
+	prev := worker.exprs.Get()
+	for cid, enginesPerColl := range engines {
+		evaluators := make([]*protobuf.IndexEvaluator, 0, len(enginesPerColl))
+		for _, engine := range enginesPerColl {
+			if ie, ok := engine.evaluator.(*protobuf.IndexEvaluator); ok {
+				evaluators = append(evaluators, ie)
+			}
+		}
+		if shared := protobuf.NewSharedExprs(evaluators, prev[cid]); shared != nil {
+			exprs[cid] = shared
+		}
+	}
+	return exprs
+}
+
 // only endpoints that host engines defined on this vbucket.
 func (worker *VbucketWorker) updateEndpoints(
 	opaque uint16,
@@ -499,6 +539,7 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 	v, vbok := vbuckets[vbno]
 	logPrefix := worker.logPrefix
 	allEngines := worker.engines.Get()
+	allExprs := worker.exprs.Get()
 
 	logging.LazyTrace(func() string {
 		return fmt.Sprintf(traceMutFormat, logPrefix, m.Opaque, m.Seqno, m.Opcode, logging.TagUD(m.Key))
@@ -574,6 +615,9 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 			}
 
 			context := qexpr.NewIndexContext()
+			if shared, ok := allExprs[m.CollectionID]; ok {
+				context = shared.DocContext(context)
+			}
 			docval := qvalue.NewAnnotatedValue(nvalue)
 			for _, engine := range collEngines {
 				// Slices in KeyVersions struct are updated for all the indexes
@@ -592,6 +636,7 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 				}
 				if cap(newBuf) > cap(worker.encodeBuf) {
 					worker.encodeBuf = newBuf[:0]
+					worker.stats.encodeBuf.Set(int64(cap(newBuf)))
 				}
 				if newKeyLen > worker.maxEncodedKeyLenInLastInterval {
 					worker.maxEncodedKeyLenInLastInterval = newKeyLen
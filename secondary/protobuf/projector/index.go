@@ -160,6 +160,15 @@ func NewIndexEvaluator(
 			}
 		}
 
+		// token index, leading key is evaluated as an array of tokens
+		analyzer, err := c.ParseTokenAnalyzer(defn.GetTokenAnalyzer())
+		if err != nil {
+			return nil, err
+		} else if analyzer != nil && len(ie.skExprs) > 0 {
+			expr := ie.skExprs[0].(qexpr.Expression)
+			ie.skExprs[0] = NewTokenExpression(expr, analyzer)
+		}
+
 		// expression to evaluate partition key
 		exprs = defn.GetPartnExpressions()
 		xattrExprs = append(xattrExprs, exprs...)
@@ -185,6 +194,41 @@ func NewIndexEvaluator(
 		_, xattrNames, _ := qu.GetXATTRNames(xattrExprs)
 		ie.xattrs = xattrNames
 
+		// expressions and sub-expressions identical across indexes of a
+		// collection are evaluated once per document, see SharedExprs.
+		ie.skExprs = shareN1QLExprs(ie.skExprs)
+		if ie.pkExprs != nil {
+			ie.pkExprs = shareN1QLExprs(ie.pkExprs)
+		}
+		if ie.whExpr != nil {
+			ie.whExpr = shareN1QLExpr(ie.whExpr)
+		}
+
+	case ExprType_JAVASCRIPT:
+		// expressions to evaluate secondary-key
+		ie.skExprs, err = CompileJSExpression(defn.GetSecExpressions())
+		if err != nil {
+			return nil, err
+		}
+		// expression to evaluate partition key
+		if exprs := defn.GetPartnExpressions(); len(exprs) > 0 {
+			cExprs, err := CompileJSExpression(exprs)
+			if err != nil {
+				return nil, err
+			} else if len(cExprs) > 0 {
+				ie.pkExprs = cExprs
+			}
+		}
+		// expression to evaluate where clause
+		if expr := defn.GetWhereExpression(); len(expr) > 0 {
+			cExprs, err := CompileJSExpression([]string{expr})
+			if err != nil {
+				return nil, err
+			} else if len(cExprs) > 0 {
+				ie.whExpr = cExprs[0]
+			}
+		}
+
 	default:
 		logging.Errorf("invalid expression type %v\n", exprtype)
 		return nil, fmt.Errorf("invalid expression type %v", exprtype)
@@ -330,18 +374,28 @@ func (ie *IndexEvaluator) processEvent(m *mc.DcpEvent, encodeBuf []byte,
 	}
 
 	ie.dcpEvent2Meta(m, docval)
-	where, err = ie.wherePredicate(m, docval, context, encodeBuf)
+
+	// JavaScript expressions evaluate the document decoded once.
+	var jsdoc *JSDocument
+	isJS := defn.GetExprType() == ExprType_JAVASCRIPT
+	if isJS && (retainDelete || !m.IsJSON()) {
+		jsdoc = NewJSDocument(nil, m)
+	} else if isJS {
+		jsdoc = NewJSDocument(m.Value, m)
+	}
+
+	where, err = ie.wherePredicate(jsdoc, docval, context, encodeBuf)
 	if err != nil {
 		return npkey, opkey, nkey, okey, newBuf, where, opcode, err
 	}
 
-	npkey, err = ie.partitionKey(m, m.Key, docval, context, encodeBuf)
+	npkey, err = ie.partitionKey(jsdoc, m.Key, docval, context, encodeBuf)
 	if err != nil {
 		return npkey, opkey, nkey, okey, newBuf, where, opcode, err
 	}
 
 	if where && (len(m.Value) > 0 || retainDelete) { // project new secondary key
-		nkey, newBuf, err = ie.evaluate(m, m.Key, docval, context, encodeBuf)
+		nkey, newBuf, err = ie.evaluate(jsdoc, m.Key, docval, context, encodeBuf)
 		if err != nil {
 			return npkey, opkey, nkey, okey, newBuf, where, opcode, err
 		}
@@ -350,11 +404,15 @@ func (ie *IndexEvaluator) processEvent(m *mc.DcpEvent, encodeBuf []byte,
 		nvalue := qvalue.NewParsedValueWithOptions(m.OldValue, true, true)
 		oldval := qvalue.NewAnnotatedValue(nvalue)
 		oldval.ShareAnnotations(docval)
-		opkey, err = ie.partitionKey(m, m.Key, oldval, context, encodeBuf)
+		var oldjsdoc *JSDocument
+		if isJS {
+			oldjsdoc = NewJSDocument(m.OldValue, m)
+		}
+		opkey, err = ie.partitionKey(oldjsdoc, m.Key, oldval, context, encodeBuf)
 		if err != nil {
 			return npkey, opkey, nkey, okey, newBuf, where, opcode, err
 		}
-		okey, newBuf, err = ie.evaluate(m, m.Key, oldval, context, encodeBuf)
+		okey, newBuf, err = ie.evaluate(oldjsdoc, m.Key, oldval, context, encodeBuf)
 		if err != nil {
 			return npkey, opkey, nkey, okey, newBuf, where, opcode, err
 		}
@@ -507,7 +565,7 @@ func (ie *IndexEvaluator) Stats() interface{} {
 }
 
 func (ie *IndexEvaluator) evaluate(
-	m *mc.DcpEvent, docid []byte, docval qvalue.AnnotatedValue,
+	jsdoc *JSDocument, docid []byte, docval qvalue.AnnotatedValue,
 	context qexpr.Context, encodeBuf []byte) ([]byte, []byte, error) {
 
 	defn := ie.instance.GetDefinition()
@@ -521,12 +579,16 @@ func (ie *IndexEvaluator) evaluate(
 		return N1QLTransform(docid, docval, context, ie.skExprs,
 			ie.numFlattenKeys, encodeBuf, ie.stats,
 			ie.indexMissingLeadingKey)
+
+	case ExprType_JAVASCRIPT:
+		return JSTransform(docid, jsdoc, ie.skExprs, encodeBuf, ie.stats,
+			ie.indexMissingLeadingKey)
 	}
 	return nil, nil, nil
 }
 
 func (ie *IndexEvaluator) partitionKey(
-	m *mc.DcpEvent, docid []byte, docval qvalue.AnnotatedValue,
+	jsdoc *JSDocument, docid []byte, docval qvalue.AnnotatedValue,
 	context qexpr.Context, encodeBuf []byte) ([]byte, error) {
 
 	defn := ie.instance.GetDefinition()
@@ -540,12 +602,17 @@ func (ie *IndexEvaluator) partitionKey(
 		out, _, err := N1QLTransform(docid, docval, context, ie.pkExprs,
 			0, nil, ie.stats, ie.indexMissingLeadingKey)
 		return out, err
+
+	case ExprType_JAVASCRIPT:
+		out, _, err := JSTransform(docid, jsdoc, ie.pkExprs, nil, ie.stats,
+			ie.indexMissingLeadingKey)
+		return out, err
 	}
 	return nil, nil
 }
 
 func (ie *IndexEvaluator) wherePredicate(
-	m *mc.DcpEvent, docval qvalue.AnnotatedValue,
+	jsdoc *JSDocument, docval qvalue.AnnotatedValue,
 	context qexpr.Context, encodeBuf []byte) (bool, error) {
 
 	// if where predicate is not supplied - always evaluate to `true`
@@ -568,6 +635,16 @@ func (ie *IndexEvaluator) wherePredicate(
 			return true, nil
 		}
 		return false, nil // predicate is false
+
+	case ExprType_JAVASCRIPT:
+		out, _, err := JSTransform(nil, jsdoc, []interface{}{ie.whExpr},
+			encodeBuf, ie.stats, false)
+		if out == nil || err != nil { // undefined and errors are treated as false
+			return false, err
+		} else if string(out) == "true" {
+			return true, nil
+		}
+		return false, nil // predicate is false
 	}
 	return true, nil
 }
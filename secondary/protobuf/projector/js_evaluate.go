@@ -0,0 +1,411 @@
+package protoProjector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/dop251/goja"
+
+	qvalue "github.com/couchbase/query/value"
+)
+
+// ErrJSTimeout is returned when evaluation of a JavaScript expression
+// exceeds the configured per-evaluation timeout.
+var ErrJSTimeout = errors.New("javascript evaluation timed out")
+
+// ErrJSStackOverflow is returned when evaluation of a JavaScript
+// expression exceeds the configured call stack depth.
+var ErrJSStackOverflow = errors.New("javascript evaluation exceeded maximum call stack size")
+
+// ErrJSValueSize is returned when the document or the evaluated value of
+// a JavaScript expression exceeds the configured maximum size.
+var ErrJSValueSize = errors.New("javascript document or value exceeded maximum size")
+
+// ErrJSMemory is returned when evaluation of a JavaScript expression
+// allocates more than the configured maximum memory.
+var ErrJSMemory = errors.New("javascript evaluation exceeded maximum memory")
+
+const (
+	defaultJSEvalTimeout  = 10 * time.Millisecond
+	defaultJSMaxStackSize = 256
+	defaultJSMaxValueSize = 20 * 1024 * 1024
+	defaultJSMaxMemory    = 64 * 1024 * 1024
+)
+
+// memory allocated by an evaluation is checked this often.
+const jsMemoryCheckInterval = time.Millisecond
+
+// limits applied to every evaluation of a JavaScript expression, set
+// from projector.jsEvaluator.* settings.
+var jsEvalTimeout = int64(defaultJSEvalTimeout)
+var jsMaxStackSize = int64(defaultJSMaxStackSize)
+var jsMaxValueSize = int64(defaultJSMaxValueSize)
+var jsMaxMemory = int64(defaultJSMaxMemory)
+
+// SetJSEvalTimeout sets the maximum cpu time, in milliseconds, allowed
+// for evaluating a single JavaScript expression on a document.
+func SetJSEvalTimeout(timeoutMs int) {
+	if timeoutMs <= 0 {
+		timeoutMs = int(defaultJSEvalTimeout / time.Millisecond)
+	}
+	atomic.StoreInt64(&jsEvalTimeout, int64(timeoutMs)*int64(time.Millisecond))
+}
+
+// SetJSMaxStackSize sets the maximum call stack depth of a JavaScript
+// expression.
+func SetJSMaxStackSize(size int) {
+	if size <= 0 {
+		size = defaultJSMaxStackSize
+	}
+	atomic.StoreInt64(&jsMaxStackSize, int64(size))
+}
+
+// SetJSMaxValueSize sets the maximum size, in bytes, of the document
+// handed to a JavaScript expression and of the value it evaluates to.
+func SetJSMaxValueSize(size int) {
+	if size <= 0 {
+		size = defaultJSMaxValueSize
+	}
+	atomic.StoreInt64(&jsMaxValueSize, int64(size))
+}
+
+// SetJSMaxMemory sets the maximum memory, in bytes, an evaluation of a
+// JavaScript expression can allocate.
+func SetJSMaxMemory(size int) {
+	if size <= 0 {
+		size = defaultJSMaxMemory
+	}
+	atomic.StoreInt64(&jsMaxMemory, int64(size))
+}
+
+// jsExpr is a compiled JavaScript expression. goja runtimes are not
+// safe for concurrent use, hence each expression keeps a pool of
+// sandboxed runtimes to be shared by vbucket workers.
+type jsExpr struct {
+	expr string
+	prog *goja.Program
+	pool sync.Pool
+}
+
+// jsRuntime is a goja runtime with the expression function loaded.
+type jsRuntime struct {
+	vm        *goja.Runtime
+	fn        goja.Callable
+	stackSize int64
+}
+
+// CompileJSExpression will take JavaScript expressions defined in the
+// index DDL and compile them for evaluation. An expression can either
+// be a plain expression referring to `doc` and `meta`, like
+// `doc.age * 2`, or a function taking (doc, meta) as arguments.
+func CompileJSExpression(expressions []string) ([]interface{}, error) {
+	cExprs := make([]interface{}, 0, len(expressions))
+	for _, expr := range expressions {
+		src := strings.TrimSpace(expr)
+		if strings.HasPrefix(src, "function") {
+			src = "(" + src + ")"
+		} else {
+			src = "(function(doc, meta) { return (" + src + "); })"
+		}
+		prog, err := goja.Compile("", src, true /*strict*/)
+		if err != nil {
+			arg1 := logging.TagUD(expr)
+			logging.Errorf("CompileJSExpression() %v: %v\n", arg1, err)
+			return nil, err
+		}
+		cExprs = append(cExprs, &jsExpr{expr: expr, prog: prog})
+	}
+	return cExprs, nil
+}
+
+func (e *jsExpr) getRuntime() (*jsRuntime, error) {
+	stackSize := atomic.LoadInt64(&jsMaxStackSize)
+	if rt, ok := e.pool.Get().(*jsRuntime); ok && rt.stackSize == stackSize {
+		return rt, nil
+	}
+
+	vm := goja.New()
+	vm.SetMaxCallStackSize(int(stackSize))
+	if err := guardJSAllocations(vm); err != nil {
+		return nil, err
+	}
+	val, err := vm.RunProgram(e.prog)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := goja.AssertFunction(val)
+	if !ok {
+		return nil, fmt.Errorf("expression %q is not a function", e.expr)
+	}
+	return &jsRuntime{vm: vm, fn: fn, stackSize: stackSize}, nil
+}
+
+// guardJSAllocations replaces the builtins that build a string of a
+// requested length in a single call, which cannot be interrupted, by ones
+// that interrupt the evaluation if the string is larger than the maximum
+// memory.
+func guardJSAllocations(vm *goja.Runtime) error {
+	proto := vm.Get("String").ToObject(vm).Get("prototype").ToObject(vm)
+	guard := func(name string, length func(call goja.FunctionCall) int64) error {
+		fn, ok := goja.AssertFunction(proto.Get(name))
+		if !ok {
+			return fmt.Errorf("String.prototype.%v is not a function", name)
+		}
+		return proto.Set(name, func(call goja.FunctionCall) goja.Value {
+			if length(call) > atomic.LoadInt64(&jsMaxMemory) {
+				vm.Interrupt(ErrJSMemory)
+				return goja.Undefined()
+			}
+			val, err := fn(call.This, call.Arguments...)
+			if ex, ok := err.(*goja.Exception); ok {
+				panic(ex) // thrown back to the expression
+			} else if err != nil {
+				vm.Interrupt(err)
+			}
+			return val
+		})
+	}
+	repeat := func(call goja.FunctionCall) int64 {
+		return int64(len(call.This.String())) * call.Argument(0).ToInteger()
+	}
+	pad := func(call goja.FunctionCall) int64 {
+		return call.Argument(0).ToInteger()
+	}
+	for name, length := range map[string]func(goja.FunctionCall) int64{
+		"repeat": repeat, "padStart": pad, "padEnd": pad} {
+
+		if err := guard(name, length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsHeapAllocs returns the bytes allocated by the process so far.
+func jsHeapAllocs() int64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/allocs:bytes"}}
+	metrics.Read(sample)
+	if sample[0].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return int64(sample[0].Value.Uint64())
+}
+
+// jsWatchdog interrupts an evaluation that runs past the timeout, or that
+// allocates more than the maximum memory. Allocations are sampled for the
+// whole process, hence also count those of other goroutines while the
+// expression runs, which are bounded by the timeout.
+type jsWatchdog struct {
+	mu       sync.Mutex
+	rt       *jsRuntime
+	timer    *time.Timer
+	deadline time.Time
+	allocs   int64 // allocated bytes when the evaluation started
+	stopped  bool
+}
+
+func startJSWatchdog(rt *jsRuntime) *jsWatchdog {
+	wd := &jsWatchdog{
+		rt:       rt,
+		deadline: time.Now().Add(time.Duration(atomic.LoadInt64(&jsEvalTimeout))),
+		allocs:   jsHeapAllocs(),
+	}
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.timer = time.AfterFunc(wd.nextCheck(), wd.check)
+	return wd
+}
+
+func (wd *jsWatchdog) nextCheck() time.Duration {
+	if d := time.Until(wd.deadline); d < jsMemoryCheckInterval {
+		return d
+	}
+	return jsMemoryCheckInterval
+}
+
+func (wd *jsWatchdog) check() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+
+	if wd.stopped {
+		return
+	}
+	if jsHeapAllocs()-wd.allocs > atomic.LoadInt64(&jsMaxMemory) {
+		wd.rt.vm.Interrupt(ErrJSMemory)
+	} else if !time.Now().Before(wd.deadline) {
+		wd.rt.vm.Interrupt(ErrJSTimeout)
+	} else {
+		wd.timer.Reset(wd.nextCheck())
+	}
+}
+
+// stop the watchdog, it does not interrupt the runtime once stopped.
+func (wd *jsWatchdog) stop() {
+	wd.mu.Lock()
+	wd.stopped = true
+	wd.mu.Unlock()
+	wd.timer.Stop()
+}
+
+// evaluate runs the expression against a document within the
+// configured time, memory and stack limits. Returns nil if expression
+// evaluates to `undefined`.
+func (e *jsExpr) evaluate(doc interface{}, meta map[string]interface{}) (interface{}, bool, error) {
+	rt, err := e.getRuntime()
+	if err != nil {
+		return nil, false, err
+	}
+
+	wd := startJSWatchdog(rt)
+	val, err := rt.fn(goja.Undefined(), rt.vm.ToValue(doc), rt.vm.ToValue(meta))
+	wd.stop()
+	rt.vm.ClearInterrupt()
+
+	if err != nil {
+		var ierr *goja.InterruptedError
+		var serr *goja.StackOverflowError
+		if errors.As(err, &ierr) && ierr.Value() == ErrJSTimeout {
+			err = ErrJSTimeout
+		} else if errors.As(err, &ierr) && ierr.Value() == ErrJSMemory {
+			err = ErrJSMemory
+		} else if errors.As(err, &serr) {
+			err = ErrJSStackOverflow
+		}
+		// runtime may be left in an inconsistent state, do not reuse.
+		return nil, false, err
+	}
+	e.pool.Put(rt)
+
+	if goja.IsUndefined(val) {
+		return nil, true, nil
+	}
+	return val.Export(), false, nil
+}
+
+// JSDocument is a document and its metadata as exposed to JavaScript
+// expressions, decoded once per mutation for the where, partition and
+// secondary key expressions of an index.
+type JSDocument struct {
+	doc  interface{}
+	meta map[string]interface{}
+	err  error
+}
+
+// NewJSDocument decodes the JSON document `value` of mutation `m`.
+func NewJSDocument(value []byte, m *mc.DcpEvent) *JSDocument {
+	jsdoc := &JSDocument{meta: jsMeta(m)}
+	if len(value) > int(atomic.LoadInt64(&jsMaxValueSize)) {
+		jsdoc.err = ErrJSValueSize
+	} else if len(value) > 0 {
+		if err := json.Unmarshal(value, &jsdoc.doc); err != nil {
+			// non-JSON documents are exposed as `null`
+			jsdoc.doc = nil
+		}
+	}
+	return jsdoc
+}
+
+// JSTransform will use compiled list of JavaScript expressions and
+// evaluate a document using them to return a secondary key as JSON
+// object. Unlike N1QLTransform, evaluation errors are returned to the
+// caller so that the document is skipped and accounted in errorSkip
+// stats.
+func JSTransform(
+	docid []byte, jsdoc *JSDocument, cExprs []interface{},
+	encodeBuf []byte, stats *IndexEvaluatorStats,
+	indexMissingLeadingKey bool) ([]byte, []byte, error) {
+
+	if jsdoc.err != nil {
+		return nil, nil, jsdoc.err
+	}
+	maxValueSize := int(atomic.LoadInt64(&jsMaxValueSize))
+
+	arrValue := make([]interface{}, 0, len(cExprs))
+	isLeadingKey := !indexMissingLeadingKey
+	for _, cExpr := range cExprs {
+		expr := cExpr.(*jsExpr)
+		start := time.Now()
+		val, undefined, err := expr.evaluate(jsdoc.doc, jsdoc.meta)
+		elapsed := time.Since(start)
+		if stats != nil {
+			stats.add(elapsed)
+		}
+		if err != nil {
+			fmsg := "JSTransform(%q) for docid %v, err: %v skip document"
+			arg1 := logging.TagUD(expr.expr)
+			arg2 := logging.TagUD(string(docid))
+			logging.Errorf(fmsg, arg1, arg2, err)
+			return nil, nil, err
+		}
+
+		if undefined && isLeadingKey {
+			return nil, nil, nil
+		} else if undefined {
+			arrValue = append(arrValue, qvalue.MISSING_VALUE)
+			continue
+		}
+		isLeadingKey = false
+		arrValue = append(arrValue, qvalue.NewValue(val))
+	}
+
+	var out, newBuf []byte
+	var err error
+
+	if len(cExprs) == 1 && len(arrValue) == 1 && docid == nil {
+		// used for partition-key evaluation and where predicate.
+		out, err = qvalue.NewValue(arrValue[0]).MarshalJSON()
+
+	} else if len(arrValue) > 0 && encodeBuf != nil {
+		out, newBuf, err = CollateJSONEncode(qvalue.NewValue(arrValue), encodeBuf)
+
+	} else if len(arrValue) > 0 {
+		secKey := qvalue.NewValue(make([]interface{}, len(arrValue)))
+		for i, key := range arrValue {
+			secKey.SetIndex(i, key)
+		}
+		out, err = secKey.MarshalJSON()
+	}
+
+	if err != nil {
+		fmsg := "JSTransform[%v<-%v] encode: index field for docid: %s (err: %v), instId: %v skip document"
+		arg := logging.TagUD(docid)
+		logging.Errorf(fmsg, stats.KeyspaceId, stats.Topic, arg, err, stats.InstId)
+		return nil, newBuf, err
+	}
+	if len(out) > maxValueSize {
+		return nil, newBuf, ErrJSValueSize
+	}
+	return out, newBuf, nil
+}
+
+// jsMeta returns document metadata exposed to JavaScript expressions
+// as `meta`.
+func jsMeta(m *mc.DcpEvent) map[string]interface{} {
+	meta := map[string]interface{}{
+		"id":         string(m.Key),
+		"byseqno":    m.Seqno,
+		"revseqno":   m.RevSeqno,
+		"flags":      m.Flags,
+		"expiration": m.Expiry,
+		"cas":        m.Cas,
+	}
+	if len(m.RawXATTR) > 0 {
+		xattrs := make(map[string]interface{})
+		for name, raw := range m.RawXATTR {
+			var val interface{}
+			if err := json.Unmarshal(raw, &val); err == nil {
+				xattrs[name] = val
+			}
+		}
+		meta["xattrs"] = xattrs
+	}
+	return meta
+}
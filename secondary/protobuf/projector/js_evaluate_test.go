@@ -0,0 +1,138 @@
+package protoProjector
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+)
+
+func TestJSTransform150(t *testing.T) {
+	cExprs, err := CompileJSExpression([]string{`doc.city`, `function(doc, meta) { return doc.age + 1 }`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mc.DcpEvent{Key: []byte("docid")}
+	secKey, _, err := JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(secKey, encodeJSON(`["Kathmandu",33]`)) {
+		t.Fatalf("evaluation failed %v", decodeCollateJSON(secKey))
+	}
+}
+
+func TestJSTransformMissing(t *testing.T) {
+	cExprs, err := CompileJSExpression([]string{`doc.country`, `doc.age`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mc.DcpEvent{Key: []byte("docid")}
+	secKey, _, err := JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if secKey != nil {
+		t.Fatalf("expected document to be skipped, got %v", decodeCollateJSON(secKey))
+	}
+}
+
+func TestJSTransformLimits(t *testing.T) {
+	cExprs, err := CompileJSExpression([]string{`(function() { while (true) {} })()`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mc.DcpEvent{Key: []byte("docid")}
+	if _, _, err := JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false); err != ErrJSTimeout {
+		t.Fatalf("expected %v, got %v", ErrJSTimeout, err)
+	}
+
+	cExprs, err = CompileJSExpression([]string{`(function f(n) { return f(n + 1) })(0)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false); err != ErrJSStackOverflow {
+		t.Fatalf("expected %v, got %v", ErrJSStackOverflow, err)
+	}
+
+	SetJSMaxValueSize(len(doc150) - 1)
+	defer SetJSMaxValueSize(defaultJSMaxValueSize)
+	cExprs, err = CompileJSExpression([]string{`doc.age`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false); err != ErrJSValueSize {
+		t.Fatalf("expected %v, got %v", ErrJSValueSize, err)
+	}
+}
+
+func TestJSTransformMaxMemory(t *testing.T) {
+	SetJSMaxMemory(1024 * 1024)
+	defer SetJSMaxMemory(defaultJSMaxMemory)
+	SetJSEvalTimeout(10000)
+	defer SetJSEvalTimeout(int(defaultJSEvalTimeout / time.Millisecond))
+
+	m := &mc.DcpEvent{Key: []byte("docid")}
+	for _, expr := range []string{
+		`"x".repeat(1024 * 1024 * 1024)`,
+		`"x".padStart(1024 * 1024 * 1024)`,
+		`(function() { var a = []; while (true) { a.push("value " + a.length) } })()`,
+	} {
+		cExprs, err := CompileJSExpression([]string{expr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false)
+		if err != ErrJSMemory {
+			t.Errorf("%v: expected %v, got %v", expr, ErrJSMemory, err)
+		}
+	}
+
+	// guarded builtins work within the limit, and the runtime is reusable
+	cExprs, err := CompileJSExpression([]string{`doc.city.padEnd(12, "-").repeat(2)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		secKey, _, err := JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(secKey, encodeJSON(`["Kathmandu---Kathmandu---"]`)) {
+			t.Fatalf("evaluation failed %v", decodeCollateJSON(secKey))
+		}
+	}
+}
+
+func TestJSTimeoutPooledRuntime(t *testing.T) {
+	SetJSEvalTimeout(5)
+	defer SetJSEvalTimeout(int(defaultJSEvalTimeout / time.Millisecond))
+
+	// evaluations that end about when the timer fires must not leave an
+	// interrupt behind on the pooled runtime.
+	cExprs, err := CompileJSExpression([]string{`function(doc, meta) {
+		if (doc.spin) { var t = Date.now(); while (Date.now() - t < 5) {} }
+		return 1
+	}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expr := cExprs[0].(*jsExpr)
+	for i := 0; i < 100; i++ {
+		_, _, err := expr.evaluate(map[string]interface{}{"spin": true}, nil)
+		if err != nil && err != ErrJSTimeout {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if _, _, err := expr.evaluate(map[string]interface{}{}, nil); err != nil {
+			t.Fatalf("evaluation #%v after a near timeout failed: %v", i, err)
+		}
+	}
+}
+
+func BenchmarkJSTransform150(b *testing.B) {
+	cExprs, _ := CompileJSExpression([]string{`doc.age`})
+	m := &mc.DcpEvent{Key: []byte("docid")}
+	for i := 0; i < b.N; i++ {
+		JSTransform([]byte("docid"), NewJSDocument(doc150, m), cExprs, buf, &stats, false)
+	}
+}
@@ -0,0 +1,250 @@
+package protoProjector
+
+import (
+	"time"
+
+	"github.com/couchbase/indexing/secondary/stats"
+
+	qexpr "github.com/couchbase/query/expression"
+	qvalue "github.com/couchbase/query/value"
+)
+
+// sharedExpr wraps a compiled secondary-key, partition-key or where
+// expression of an index, and its sub-expressions. When evaluated with a
+// context from SharedExprs.DocContext(), an expression or sub-expression
+// that is identical across the indexes of a collection is evaluated once
+// per document and its result is reused by all the indexes, like LOWER(name)
+// in the keys LOWER(name) and LOWER(name) || city.
+//
+// Array expressions are not shared, N1QLTransform can modify the
+// evaluated vector in place. Nor are the sub-expressions of expressions
+// with bindings, like ARRAY and ANY, they are evaluated per element.
+type sharedExpr struct {
+	qexpr.Expression
+	key  string        // expression text, empty if the expression is not shared
+	subs []*sharedExpr // wrapped sub-expressions, at any depth
+}
+
+// shareN1QLExprs wraps the N1QL expressions in cExprs. All of them are
+// wrapped, so that expressions that are not shared are never evaluated
+// with a docContext.
+func shareN1QLExprs(cExprs []interface{}) []interface{} {
+	for i, cExpr := range cExprs {
+		cExprs[i] = shareN1QLExpr(cExpr)
+	}
+	return cExprs
+}
+
+func shareN1QLExpr(cExpr interface{}) interface{} {
+	expr, ok := cExpr.(qexpr.Expression)
+	if !ok {
+		return cExpr
+	}
+	e := &sharedExpr{Expression: expr}
+	if _, ok := expr.(*tokenExpr); ok {
+		return e
+	} else if isArray, _, _ := expr.IsArrayIndexKey(); isArray {
+		return e
+	}
+	e.key = qexpr.NewStringer().Visit(expr)
+	if _, ok := expr.(bindingsExpr); !ok {
+		// sub-expressions already wrapped are evaluated as is, if their
+		// mapping fails.
+		mapper := &subExprMapper{}
+		if err := expr.MapChildren(mapper); err == nil {
+			e.subs = mapper.subs
+		}
+	}
+	return e
+}
+
+// bindingsExpr is an expression with variables bound per element, like
+// ARRAY and ANY.
+type bindingsExpr interface {
+	Bindings() qexpr.Bindings
+}
+
+// subExprMapper wraps the sub-expressions of an expression in place, so
+// that they can be shared. Identifiers, field names, constants and field
+// accesses are cheap to evaluate, and are left alone.
+type subExprMapper struct {
+	qexpr.Mapper // only Map() and MapBindings() are used by MapChildren()
+	subs         []*sharedExpr
+}
+
+// Map implements qexpr.Mapper{} interface.
+func (m *subExprMapper) Map(expr qexpr.Expression) (qexpr.Expression, error) {
+	switch expr.(type) {
+	case *qexpr.Identifier, *qexpr.FieldName, *qexpr.Constant, *sharedExpr:
+		return expr, nil
+	}
+	if _, ok := expr.(bindingsExpr); !ok {
+		if err := expr.MapChildren(m); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := expr.(*qexpr.Field); ok {
+		return expr, nil
+	}
+	e := &sharedExpr{Expression: expr, key: qexpr.NewStringer().Visit(expr)}
+	m.subs = append(m.subs, e)
+	return e, nil
+}
+
+// MapBindings implements qexpr.Mapper{} interface.
+func (m *subExprMapper) MapBindings() bool {
+	return false
+}
+
+// EvaluateForIndex implements qexpr.Expression{} interface. Sub-expressions
+// are evaluated with the docContext, so that they are shared as well.
+func (e *sharedExpr) EvaluateForIndex(
+	item qvalue.Value, context qexpr.Context) (qvalue.Value, qvalue.Values, error) {
+
+	if dc, ok := context.(*docContext); ok {
+		if node, ok := dc.shared.nodes[e.key]; ok {
+			return dc.shared.evaluate(node, e.Expression, item, dc)
+		}
+	}
+	return e.Expression.EvaluateForIndex(item, context)
+}
+
+// Evaluate implements qexpr.Expression{} interface, for sub-expressions
+// evaluated by their parent expression.
+func (e *sharedExpr) Evaluate(
+	item qvalue.Value, context qexpr.Context) (qvalue.Value, error) {
+
+	if dc, ok := context.(*docContext); ok {
+		if node, ok := dc.shared.nodes[e.key]; ok {
+			scalar, _, err := dc.shared.evaluate(node, e.Expression, item, dc)
+			return scalar, err
+		}
+	}
+	return e.Expression.Evaluate(item, context)
+}
+
+// SharedExprStats of an expression shared by the indexes of a collection.
+type SharedExprStats struct {
+	Count    stats.Int64Val // number of evaluations
+	TotalDur stats.Int64Val // time spent in evaluations, in nanoseconds
+	Hits     stats.Int64Val // number of evaluations reused by an index
+	Refs     stats.Int64Val // number of uses by indexes, as key or sub-expression
+}
+
+func (s *SharedExprStats) Init() {
+	s.Count.Init()
+	s.TotalDur.Init()
+	s.Hits.Init()
+	s.Refs.Init()
+}
+
+type sharedExprNode struct {
+	stats *SharedExprStats
+
+	// result of the expression for the document being evaluated.
+	gen    uint64
+	scalar qvalue.Value
+	vector qvalue.Values
+	err    error
+}
+
+// SharedExprs is the set of expressions and sub-expressions used by more
+// than one index of a collection, evaluated once per document and reused by
+// all of them.
+//
+// IMPORTANT: SharedExprs{} is not thread safe, results are cached in it
+// for the document being evaluated. Its stats can be read concurrently.
+type SharedExprs struct {
+	nodes map[string]*sharedExprNode // expression text -> node
+	gen   uint64                     // document being evaluated
+}
+
+// NewSharedExprs builds the shared expressions for the index evaluators of
+// a collection, nil if none of their expressions is shared. Stats of
+// expressions that were shared in `prev` are carried over.
+func NewSharedExprs(evaluators []*IndexEvaluator, prev *SharedExprs) *SharedExprs {
+	refs := make(map[string]int)
+	for _, ie := range evaluators {
+		// an expression used more than once by the same index is shared
+		// as well, like a where predicate that is also a key.
+		for _, e := range ie.sharedExprs() {
+			refs[e.key]++
+		}
+	}
+
+	s := &SharedExprs{nodes: make(map[string]*sharedExprNode)}
+	for key, n := range refs {
+		if n < 2 {
+			continue
+		}
+		node := &sharedExprNode{}
+		if prev != nil && prev.nodes[key] != nil {
+			node.stats = prev.nodes[key].stats
+		} else {
+			node.stats = &SharedExprStats{}
+			node.stats.Init()
+		}
+		node.stats.Refs.Set(int64(n))
+		s.nodes[key] = node
+	}
+	if len(s.nodes) == 0 {
+		return nil
+	}
+	return s
+}
+
+// DocContext returns the context to evaluate a new document with, for
+// all the indexes of the collection.
+func (s *SharedExprs) DocContext(context qexpr.Context) qexpr.Context {
+	s.gen++
+	return &docContext{Context: context, shared: s}
+}
+
+// Stats of the shared expressions, by expression text.
+func (s *SharedExprs) Stats() map[string]*SharedExprStats {
+	stats := make(map[string]*SharedExprStats, len(s.nodes))
+	for key, node := range s.nodes {
+		stats[key] = node.stats
+	}
+	return stats
+}
+
+func (s *SharedExprs) evaluate(
+	node *sharedExprNode, expr qexpr.Expression,
+	item qvalue.Value, context qexpr.Context) (qvalue.Value, qvalue.Values, error) {
+
+	if node.gen == s.gen {
+		node.stats.Hits.Add(1)
+		return node.scalar, node.vector, node.err
+	}
+
+	start := time.Now()
+	node.scalar, node.vector, node.err = expr.EvaluateForIndex(item, context)
+	node.stats.TotalDur.Add(time.Since(start).Nanoseconds())
+	node.stats.Count.Add(1)
+	node.gen = s.gen
+	return node.scalar, node.vector, node.err
+}
+
+// sharedExprs of the index that can be shared with other indexes.
+func (ie *IndexEvaluator) sharedExprs() []*sharedExpr {
+	cExprs := make([]interface{}, 0, len(ie.skExprs)+len(ie.pkExprs)+1)
+	cExprs = append(cExprs, ie.skExprs...)
+	cExprs = append(cExprs, ie.pkExprs...)
+	cExprs = append(cExprs, ie.whExpr)
+
+	exprs := make([]*sharedExpr, 0, len(cExprs))
+	for _, cExpr := range cExprs {
+		if e, ok := cExpr.(*sharedExpr); ok && e.key != "" {
+			exprs = append(exprs, e)
+			exprs = append(exprs, e.subs...)
+		}
+	}
+	return exprs
+}
+
+// docContext identifies the document being evaluated for SharedExprs.
+type docContext struct {
+	qexpr.Context
+	shared *SharedExprs
+}
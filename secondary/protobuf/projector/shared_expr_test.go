@@ -0,0 +1,128 @@
+package protoProjector
+
+import (
+	"bytes"
+	"testing"
+
+	qexpr "github.com/couchbase/query/expression"
+	qvalue "github.com/couchbase/query/value"
+)
+
+func TestSharedExprs(t *testing.T) {
+	newEvaluator := func(secExprs []string, where string) *IndexEvaluator {
+		cExprs, err := CompileN1QLExpression(secExprs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ie := &IndexEvaluator{skExprs: shareN1QLExprs(cExprs)}
+		if where != "" {
+			cExprs, err := CompileN1QLExpression([]string{where})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ie.whExpr = shareN1QLExpr(cExprs[0])
+		}
+		return ie
+	}
+	ie1 := newEvaluator([]string{`city`, `age`}, `type = "user"`)
+	ie2 := newEvaluator([]string{`city`, `gender`}, `type = "user"`)
+	ie3 := newEvaluator([]string{`DISTINCT ARRAY v FOR v IN friends END`}, "")
+
+	shared := NewSharedExprs([]*IndexEvaluator{ie1, ie2, ie3}, nil)
+	if shared == nil {
+		t.Fatalf("expected shared expressions")
+	}
+	// city and the where predicate are shared, the array is not.
+	if n := len(shared.Stats()); n != 2 {
+		t.Fatalf("expected 2 shared expressions, got %v", n)
+	}
+
+	docval := qvalue.NewAnnotatedValue(qvalue.NewParsedValue(doc150, true))
+	context := shared.DocContext(qexpr.NewIndexContext())
+	for _, ie := range []*IndexEvaluator{ie1, ie2} {
+		out, _, err := N1QLTransform(nil, docval, context,
+			[]interface{}{ie.whExpr}, 0, nil, &stats, false)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(out) != "true" {
+			t.Fatalf("expected where to be true, got %s", out)
+		}
+	}
+	secKey, _, err := N1QLTransform([]byte("docid"), docval, context,
+		ie1.skExprs, 0, buf, &stats, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(secKey, encodeJSON(`["Kathmandu",32]`)) {
+		t.Fatalf("evaluation failed %v", decodeCollateJSON(secKey))
+	}
+
+	count, hits := sharedExprCounts(shared)
+	if count != 2 || hits != 1 {
+		t.Fatalf("expected 2 evaluations and 1 hit, got %v %v", count, hits)
+	}
+
+	// a new document is evaluated again.
+	context = shared.DocContext(qexpr.NewIndexContext())
+	N1QLTransform([]byte("docid"), docval, context, ie2.skExprs, 0, buf, &stats, false)
+	if count, hits = sharedExprCounts(shared); count != 3 || hits != 1 {
+		t.Fatalf("expected 3 evaluations and 1 hit, got %v %v", count, hits)
+	}
+}
+
+func sharedExprCounts(shared *SharedExprs) (count, hits int64) {
+	for _, st := range shared.Stats() {
+		count += st.Count.Value()
+		hits += st.Hits.Value()
+	}
+	return count, hits
+}
+
+func TestSharedSubExprs(t *testing.T) {
+	newEvaluator := func(secExprs []string) *IndexEvaluator {
+		cExprs, err := CompileN1QLExpression(secExprs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &IndexEvaluator{skExprs: shareN1QLExprs(cExprs)}
+	}
+	ie1 := newEvaluator([]string{`LOWER(city)`})
+	ie2 := newEvaluator([]string{`LOWER(city) || "-" || gender`})
+	ie3 := newEvaluator([]string{`ARRAY_COUNT(ARRAY LOWER(city) FOR v IN friends END)`})
+
+	// LOWER(city) is shared by ie1 and ie2, not by the comprehension of ie3
+	// which is evaluated per element.
+	shared := NewSharedExprs([]*IndexEvaluator{ie1, ie2, ie3}, nil)
+	if shared == nil {
+		t.Fatalf("expected shared expressions")
+	}
+	exprStats := shared.Stats()
+	if len(exprStats) != 1 {
+		t.Fatalf("expected 1 shared expression, got %v", len(exprStats))
+	}
+	for _, st := range exprStats {
+		if st.Refs.Value() != 2 {
+			t.Errorf("expected 2 references, got %v", st.Refs.Value())
+		}
+	}
+
+	docval := qvalue.NewAnnotatedValue(qvalue.NewParsedValue(doc150, true))
+	context := shared.DocContext(qexpr.NewIndexContext())
+	secKey, _, err := N1QLTransform([]byte("docid"), docval, context,
+		ie1.skExprs, 0, buf, &stats, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(secKey, encodeJSON(`["kathmandu"]`)) {
+		t.Fatalf("evaluation failed %v", decodeCollateJSON(secKey))
+	}
+	secKey, _, err = N1QLTransform([]byte("docid"), docval, context,
+		ie2.skExprs, 0, buf, &stats, false)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(secKey, encodeJSON(`["kathmandu-female"]`)) {
+		t.Fatalf("evaluation failed %v", decodeCollateJSON(secKey))
+	}
+
+	if count, hits := sharedExprCounts(shared); count != 1 || hits != 1 {
+		t.Fatalf("expected 1 evaluation and 1 hit, got %v %v", count, hits)
+	}
+}
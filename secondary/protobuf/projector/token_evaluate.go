@@ -0,0 +1,50 @@
+package protoProjector
+
+import (
+	c "github.com/couchbase/indexing/secondary/common"
+	qexpr "github.com/couchbase/query/expression"
+	qvalue "github.com/couchbase/query/value"
+)
+
+// tokenExpr wraps the leading key expression of a token index. The
+// string value of the expression is split into tokens by the index
+// analyzer, and each token is emitted as an entry of a distinct array
+// index.
+type tokenExpr struct {
+	qexpr.Expression
+	analyzer *c.TokenAnalyzer
+}
+
+// NewTokenExpression returns a compiled N1QL expression that evaluates
+// to the distinct array of tokens of expr.
+func NewTokenExpression(expr qexpr.Expression, analyzer *c.TokenAnalyzer) qexpr.Expression {
+	return &tokenExpr{Expression: expr, analyzer: analyzer}
+}
+
+// EvaluateForIndex returns the tokens as vector. Non-string values
+// evaluate to an empty vector, which is treated as missing.
+func (e *tokenExpr) EvaluateForIndex(
+	item qvalue.Value, context qexpr.Context) (qvalue.Value, qvalue.Values, error) {
+
+	scalar, _, err := e.Expression.EvaluateForIndex(item, context)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if scalar == nil || scalar.Type() != qvalue.STRING {
+		return nil, qvalue.Values{}, nil
+	}
+
+	tokens := e.analyzer.Analyze(scalar.Actual().(string))
+	vector := make(qvalue.Values, 0, len(tokens))
+	for _, token := range tokens {
+		vector = append(vector, qvalue.NewValue(token))
+	}
+	return nil, vector, nil
+}
+
+// IsArrayIndexKey implements qexpr.Expression{} interface, token index
+// is a distinct, non-flattened, array index.
+func (e *tokenExpr) IsArrayIndexKey() (bool, bool, bool) {
+	return true, true, false
+}
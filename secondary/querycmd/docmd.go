@@ -11,6 +11,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -64,6 +65,9 @@ type Command struct {
 	Limit       int64
 	Distinct    bool
 	Consistency c.Consistency
+	// options for token scan
+	Text       string
+	TokenMatch string
 	// Configuration
 	ConfigKey string
 	ConfigVal string
@@ -83,6 +87,11 @@ type Command struct {
 
 	NumBuilds int64
 
+	// Projector introspection and repair
+	Projector string
+	Topic     string
+	Repair    string
+
 	CACert      string
 	UseTLS      bool
 	UseTools    bool
@@ -104,7 +113,7 @@ func ParseArgs(arguments []string) (*Command, []string, *flag.FlagSet, error) {
 	fset.StringVar(&cmdOptions.Server, "server", "127.0.0.1:8091", "Cluster server address")
 	fset.StringVar(&cmdOptions.Auth, "auth", "", "Auth user and password")
 	fset.StringVar(&cmdOptions.Bucket, "bucket", "", "Bucket name")
-	fset.StringVar(&cmdOptions.OpType, "type", "", "Command: scan|stats|scanAll|count|nodes|create|build|move|drop|alter|list|config|batch_process|batch_build")
+	fset.StringVar(&cmdOptions.OpType, "type", "", "Command: scan|stats|scanAll|tokenscan|count|nodes|create|build|move|drop|alter|list|config|advise|batch_process|batch_build|projector")
 	fset.StringVar(&cmdOptions.IndexName, "index", "", "Index name")
 	// options for create-index
 	fset.StringVar(&cmdOptions.WhereStr, "where", "", "where clause for create index")
@@ -122,6 +131,9 @@ func ParseArgs(arguments []string) (*Command, []string, *flag.FlagSet, error) {
 	fset.BoolVar(&cmdOptions.Distinct, "distinct", false, "Only distinct entries")
 	fset.BoolVar(&cmdOptions.Help, "h", false, "print help")
 	fset.BoolVar(&useSessionCons, "consistency", false, "Use session consistency")
+	// options for token scan
+	fset.StringVar(&cmdOptions.Text, "text", "", "TokenScan: text to search")
+	fset.StringVar(&cmdOptions.TokenMatch, "match", "all", "TokenScan: all|prefix")
 	// options for setting configuration
 	fset.StringVar(&cmdOptions.ConfigKey, "ckey", "", "Config key")
 	fset.StringVar(&cmdOptions.ConfigVal, "cval", "", "Config value")
@@ -139,8 +151,13 @@ func ParseArgs(arguments []string) (*Command, []string, *flag.FlagSet, error) {
 	fset.Int64Var(&cmdOptions.WaitForClientBootstrap, "bootstrap_wait", 60, "Time (in seconds) cbindex will wait for client bootstrap")
 	fset.Int64Var(&cmdOptions.NumBuilds, "num_builds", 10, "Number of builds that can happen simultaneously across multiple collections")
 
+	fset.StringVar(&cmdOptions.Projector, "projector", "", "Projector adminport address")
+	fset.StringVar(&cmdOptions.Topic, "topic", "", "Projector topic to inspect or repair")
+	fset.StringVar(&cmdOptions.Repair, "repair", "", "Repair projector topic: restartVbuckets|repairEndpoints, request in -with")
+
 	fset.StringVar(&scheme, "scheme", string(c.SINGLE), "Partition scheme for partitioned index.")
 	fset.StringVar(&partitionKeys, "partitionKeys", "", "Comma separated fields for partition key for partitioned index.")
+	fset.StringVar(&cmdOptions.ExprType, "exprType", "N1QL", "Expression type of index keys, where clause and partition keys: N1QL or JavaScript")
 
 	// TLS Options
 	fset.BoolVar(&cmdOptions.UseTLS, "use_tls", false, "Enable TLS connections")
@@ -149,7 +166,6 @@ func ParseArgs(arguments []string) (*Command, []string, *flag.FlagSet, error) {
 	fset.StringVar(&cmdOptions.UseLogLevel, "log_level", "Warn", "Select log level from options: Silent, Fatal, Error, Warn, Info, Verbose, Timing, Debug & Trace (default Warn)")
 
 	// not useful to expose in sherlock
-	cmdOptions.ExprType = "N1QL"
 	cmdOptions.PartnStr = ""
 
 	if err := fset.Parse(arguments); err != nil {
@@ -536,6 +552,44 @@ func HandleCommand(
 			fmt.Fprintln(w, "Total number of entries: ", entries)
 		}
 
+	case "tokenscan":
+		var state c.IndexState
+		var match qclient.TokenMatch
+
+		switch cmd.TokenMatch {
+		case "all":
+			match = qclient.TokenMatchAll
+		case "prefix":
+			match = qclient.TokenMatchPrefix
+		default:
+			return fmt.Errorf("Invalid token match %v. Valid values are all, prefix", cmd.TokenMatch)
+		}
+
+		index, found := GetIndex(client, bucket, scope, collection, iname)
+		if !found {
+			return fmt.Errorf("Index %v/%v/%v/%v unknown", bucket, scope, collection, iname)
+		}
+
+		defnID := uint64(index.Definition.DefnId)
+		fmt.Fprintln(w, "TokenScan index:")
+		_, err = WaitUntilIndexState(
+			client, []uint64{defnID}, c.INDEX_STATE_ACTIVE,
+			100 /*period*/, 20000 /*timeout*/)
+		if err != nil {
+			state, err = client.IndexState(defnID)
+			fmt.Fprintf(w, "Index state: {%v, %v} \n", state, err)
+		} else {
+			var docids [][]byte
+			docids, err = client.TokenScan(
+				defnID, "", cmd.Text, match, limit, cons, nil, scanParams)
+			for _, docid := range docids {
+				fmt.Fprintln(w, string(docid))
+			}
+			if err == nil {
+				fmt.Fprintln(w, "Total number of documents: ", len(docids))
+			}
+		}
+
 	case "stats":
 		var state c.IndexState
 		var statsResp c.IndexStatistics
@@ -596,25 +650,7 @@ func HandleCommand(
 		}
 
 	case "config":
-		nodes, err := client.Nodes()
-		if err != nil {
-			return err
-		}
-		var adminurl string
-		for _, indexer := range nodes {
-			adminurl = indexer.Adminport
-			break
-		}
-		host, sport, _ := net.SplitHostPort(adminurl)
-		iport, _ := strconv.Atoi(sport)
-
-		//
-		// hack, fix this
-		//
-		ihttp := iport + 2
-		url := "http://" + host + ":" + strconv.Itoa(ihttp) + "/settings"
-
-		surl, err := security.GetURL(url)
+		surl, err := getIndexerHttpURL(client, "/settings")
 		if err != nil {
 			return err
 		}
@@ -682,6 +718,85 @@ func HandleCommand(
 			fmt.Printf("New Settings:\n%s\n", string(pretty))
 		}
 
+	case "advise":
+		surl, err := getIndexerHttpURL(client, "/getIndexAdvice")
+		if err != nil {
+			return err
+		}
+
+		params := surl.Query()
+		if cmd.Bucket != "" {
+			params.Set("bucket", cmd.Bucket)
+		}
+		if cmd.Scope != "" {
+			params.Set("scope", cmd.Scope)
+		}
+		if cmd.Collection != "" {
+			params.Set("collection", cmd.Collection)
+		}
+		surl.RawQuery = params.Encode()
+
+		client, err := security.MakeClient(surl.String())
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequest("GET", surl.String(), nil)
+		if err != nil {
+			return err
+		}
+		if cmd.Auth != "" {
+			up := strings.Split(cmd.Auth, ":")
+			req.SetBasicAuth(up[0], up[1])
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("Index advisor failed with status %v: %s", resp.Status, string(body))
+		}
+
+		var report struct {
+			Advices []struct {
+				Type        string `json:"type"`
+				Name        string `json:"name"`
+				Bucket      string `json:"bucket"`
+				Scope       string `json:"scope"`
+				Collection  string `json:"collection"`
+				NumRequests uint64 `json:"numRequests"`
+				Reason      string `json:"reason"`
+				MemSaving   uint64 `json:"memSaving"`
+				DataSaving  uint64 `json:"dataSaving"`
+			} `json:"advices"`
+			TotalMemSaving  uint64 `json:"totalMemSaving"`
+			TotalDataSaving uint64 `json:"totalDataSaving"`
+		}
+		if err = json.Unmarshal(body, &report); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, "Index advice:")
+		for _, advice := range report.Advices {
+			fmt.Fprintf(w, "    %s: %s/%s/%s/%s, requests:%v, memSaving:%v, dataSaving:%v\n",
+				advice.Type, advice.Bucket, advice.Scope, advice.Collection, advice.Name,
+				advice.NumRequests, advice.MemSaving, advice.DataSaving)
+			fmt.Fprintf(w, "        %s\n", advice.Reason)
+		}
+		fmt.Fprintf(w, "Total memSaving:%v, dataSaving:%v\n", report.TotalMemSaving, report.TotalDataSaving)
+
+	case "projector":
+		if err := projectorRequest(cmd, w); err != nil {
+			return err
+		}
+
 	case "batch_process", "batch_build":
 
 		fd, err := validateBatchFile(cmd)
@@ -815,6 +930,80 @@ func HandleCommand(
 	return err
 }
 
+// getIndexerHttpURL returns the URL of the given path on the http port
+// of one of the indexer nodes.
+func getIndexerHttpURL(client *qclient.GsiClient, path string) (*url.URL, error) {
+	nodes, err := client.Nodes()
+	if err != nil {
+		return nil, err
+	}
+	var adminurl string
+	for _, indexer := range nodes {
+		adminurl = indexer.Adminport
+		break
+	}
+	host, sport, _ := net.SplitHostPort(adminurl)
+	iport, _ := strconv.Atoi(sport)
+
+	//
+	// hack, fix this
+	//
+	ihttp := iport + 2
+	return security.GetURL("http://" + host + ":" + strconv.Itoa(ihttp) + path)
+}
+
+// projectorRequest for the topics of projector at cmd.Projector, prints the
+// JSON response to w.
+func projectorRequest(cmd *Command, w io.Writer) error {
+	path := "/topics"
+	if cmd.Topic != "" {
+		path += "/" + url.PathEscape(cmd.Topic)
+	}
+	method, body := "GET", io.Reader(nil)
+	if cmd.Repair != "" {
+		path += "/" + cmd.Repair
+		method, body = "POST", strings.NewReader(cmd.With)
+	}
+
+	surl := cmd.Projector + path
+	if !strings.HasPrefix(surl, "http") {
+		surl = "http://" + surl
+	}
+	client, err := security.MakeClient(surl)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, surl, body)
+	if err != nil {
+		return err
+	}
+	if cmd.Auth != "" {
+		up := strings.Split(cmd.Auth, ":")
+		req.SetBasicAuth(up[0], up[1])
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	} else if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %s", resp.Status, strings.TrimSpace(string(rbody)))
+	}
+
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, rbody, "", "  "); err != nil {
+		pretty.Reset()
+		pretty.Write(rbody)
+	}
+	fmt.Fprintln(w, pretty.String())
+	return nil
+}
+
 func printIndexInfo(w io.Writer, index *mclient.IndexMetadata) {
 	defn := index.Definition
 	fmt.Fprintf(w, "Index:%s/%s/%s/%s, Id:%v, Using:%s, Exprs:%v, isPrimary:%v\n",
@@ -950,6 +1139,10 @@ func validate(cmd *Command, fset *flag.FlagSet) error {
 		have = []string{"type", "server", "auth", "index", "bucket"}
 		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "ckey", "cval"}
 
+	case "tokenscan":
+		have = []string{"type", "server", "auth", "index", "bucket", "text"}
+		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "distinct", "ckey", "cval"}
+
 	case "stats":
 		have = []string{"type", "server", "auth", "index", "bucket"}
 		dont = []string{"h", "where", "fields", "primary", "with", "indexes", "limit", "distinct", "ckey", "cval"}
@@ -962,6 +1155,10 @@ func validate(cmd *Command, fset *flag.FlagSet) error {
 		have = []string{"type", "server", "auth"}
 		dont = []string{"h", "index", "bucket", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct"}
 
+	case "advise":
+		have = []string{"type", "server", "auth"}
+		dont = []string{"h", "index", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
+
 	case "batch_process":
 		have = []string{"type", "auth", "input"}
 		dont = []string{"index", "bucket", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
@@ -970,6 +1167,13 @@ func validate(cmd *Command, fset *flag.FlagSet) error {
 		have = []string{"type", "auth", "input"}
 		dont = []string{"index", "bucket", "where", "fields", "primary", "with", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
 
+	case "projector":
+		have = []string{"type", "server", "auth", "projector"}
+		dont = []string{"h", "index", "bucket", "where", "fields", "primary", "indexes", "low", "high", "equal", "incl", "limit", "distinct", "ckey", "cval"}
+		if cmd.Repair != "" && (cmd.Topic == "" || cmd.With == "") {
+			return fmt.Errorf("-repair needs -topic and the request in -with")
+		}
+
 	default:
 		return fmt.Errorf("Specified operation type '%s' has no validation rule. Please add one to use.", cmd.OpType)
 	}
@@ -0,0 +1,81 @@
+package querycmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProjectorRequest(t *testing.T) {
+	var method, path, user, passwd, body string
+	status, resp := http.StatusOK, `{"topics":{"t1":{"opaque":1}}}`
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		method, path, body = r.Method, r.URL.EscapedPath(), string(data)
+		user, passwd, _ = r.BasicAuth()
+		w.WriteHeader(status)
+		w.Write([]byte(resp))
+	}))
+	defer ts.Close()
+
+	// inspect all topics, without the scheme in the address
+	var out bytes.Buffer
+	cmd := &Command{Projector: strings.TrimPrefix(ts.URL, "http://"), Auth: "u1:p1"}
+	if err := projectorRequest(cmd, &out); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if method != "GET" || path != "/topics" || user != "u1" || passwd != "p1" {
+		t.Errorf("unexpected request %v %v %v:%v", method, path, user, passwd)
+	}
+	expected := "{\n  \"topics\": {\n    \"t1\": {\n      \"opaque\": 1\n    }\n  }\n}\n"
+	if out.String() != expected {
+		t.Errorf("expected indented response %q, got %q", expected, out.String())
+	}
+
+	// inspect a topic
+	cmd = &Command{Projector: ts.URL, Topic: "MAINT_STREAM_TOPIC/1"}
+	if err := projectorRequest(cmd, ioutil.Discard); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if method != "GET" || path != "/topics/MAINT_STREAM_TOPIC%2F1" || user != "" {
+		t.Errorf("unexpected request %v %v %v", method, path, user)
+	}
+
+	// repair a topic, failed repairs are errors
+	with := `{"endpoints":["127.0.0.1:9105"]}`
+	status, resp = http.StatusNotFound, `{"error":"projector.topicMissing"}`
+	cmd = &Command{Projector: ts.URL, Topic: "t1", Repair: "repairEndpoints", With: with}
+	err := projectorRequest(cmd, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "404") ||
+		!strings.Contains(err.Error(), "projector.topicMissing") {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+	if method != "POST" || path != "/topics/t1/repairEndpoints" || body != with {
+		t.Errorf("unexpected request %v %v %v", method, path, body)
+	}
+}
+
+func TestValidateProjector(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  bool
+	}{
+		{[]string{"-type", "projector"}, true},
+		{[]string{"-type", "projector", "-auth", "u1:p1", "-repair", "restartVbuckets",
+			"-projector", "127.0.0.1:9999", "-with", "{}"}, true},
+		{[]string{"-type", "projector", "-auth", "u1:p1", "-repair", "restartVbuckets",
+			"-projector", "127.0.0.1:9999", "-topic", "t1"}, true},
+		{[]string{"-type", "projector", "-auth", "u1:p1", "-projector", "127.0.0.1:9999",
+			"-index", "idx1"}, true},
+	}
+
+	for _, test := range tests {
+		if _, _, _, err := ParseArgs(test.args); (err != nil) != test.err {
+			t.Errorf("%v: expected error %v, got %v", test.args, test.err, err)
+		}
+	}
+}
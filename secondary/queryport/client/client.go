@@ -1618,6 +1618,12 @@ func (c *GsiClient) doScan(defnID uint64, requestId string, broker *RequestBroke
 					return count, getScanError(scan_errs)
 				}
 
+				// a throttled scan is not retried with a replica, which would take
+				// another token of the scan rate limits of the replica's indexer
+				if isThrottled(scan_errs) {
+					return 0, getScanError(scan_errs)
+				}
+
 				excludes = c.updateExcludes(defnID, excludes, scan_errs)
 				if len(scan_errs) != 0 && partial {
 					// partially succeeded scans, we don't reset-hash and we don't retry
@@ -1932,6 +1938,19 @@ func curePrimaryKey(key interface{}) ([]byte, string) {
 	return nil, "before"
 }
 
+func isThrottled(scan_err map[common.PartitionId]map[uint64]error) bool {
+
+	for _, instErrs := range scan_err {
+		for _, err := range instErrs {
+			if IsScanThrottled(err) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func isAnyGone(scan_err map[common.PartitionId]map[uint64]error) bool {
 
 	if len(scan_err) == 0 {
@@ -2,6 +2,9 @@ package client
 
 import "errors"
 import "fmt"
+import "strings"
+
+import "github.com/couchbase/indexing/secondary/common"
 
 // ErrorProtocol
 var ErrorProtocol = errors.New("queryport.client.protocol")
@@ -27,11 +30,20 @@ var ErrorInvalidConsistency = errors.New("queryport.invalidConsistency")
 // ErrorExpectedTimestamp
 var ErrorExpectedTimestamp = errors.New("queryport.expectedTimestamp")
 
+// ErrorNotTokenIndex
+var ErrorNotTokenIndex = errors.New("queryport.notTokenIndex")
+
 // These error strings need to be in sync with common.ErrIndexNotFound
 // and common.ErrIndexNotReady.
 var ErrIndexNotFound = fmt.Errorf("Index not found")
 var ErrIndexNotReady = fmt.Errorf("Index not ready for serving queries")
 
+// IsScanThrottled returns true if err, as returned by the indexer, is
+// common.ErrScanThrottled.
+func IsScanThrottled(err error) bool {
+	return err != nil && strings.Contains(err.Error(), common.ScanThrottledCode)
+}
+
 var errorDescriptions = map[string]string{
 	ErrorProtocol.Error():            "fatal protocol error with server",
 	ErrorNoHost.Error():              "All indexer replica is down or unavailable or unable to process request",
@@ -41,6 +53,8 @@ var errorDescriptions = map[string]string{
 	ErrorNotImplemented.Error():      "client API not implemented",
 	ErrorInvalidConsistency.Error():  "supplied consistency is invalid",
 	ErrorExpectedTimestamp.Error():   "consistency timestamp is expected",
+	ErrorNotTokenIndex.Error():       "index is not a token index",
 	ErrIndexNotFound.Error():         "index is deleted or node hosting index is down",
 	ErrIndexNotReady.Error():         ErrIndexNotReady.Error(),
+	common.ErrScanThrottled.Error():  "index scan exceeds a scan rate limit of the indexer, retry later",
 }
@@ -0,0 +1,32 @@
+package client
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+func TestIsScanThrottled(t *testing.T) {
+
+	// errors received from the indexer are rebuilt from their message
+	remote := errors.New(common.ErrScanThrottled.Error())
+	if !IsScanThrottled(remote) {
+		t.Errorf("expected a throttled scan error")
+	}
+	if IsScanThrottled(nil) || IsScanThrottled(common.ErrScanTimedOut) {
+		t.Errorf("expected errors other than throttling not to be throttled scan errors")
+	}
+
+	errs := map[common.PartitionId]map[uint64]error{
+		1: {10: common.ErrScanTimedOut},
+		2: {20: remote},
+	}
+	if !isThrottled(errs) || !IsScanThrottled(getScanError(errs)) {
+		t.Errorf("expected a scan with a throttled partition to be throttled")
+	}
+	delete(errs, 2)
+	if isThrottled(errs) {
+		t.Errorf("expected a scan without throttled partitions not to be throttled")
+	}
+}
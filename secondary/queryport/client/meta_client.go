@@ -685,7 +685,8 @@ func (b *metadataClient) equivalentIndex(
 		d1.PartitionScheme != d2.PartitionScheme ||
 		d1.HashScheme != d2.HashScheme ||
 		d1.WhereExpr != d2.WhereExpr ||
-		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR {
+		d1.RetainDeletedXATTR != d2.RetainDeletedXATTR ||
+		d1.TokenAnalyzer.String() != d2.TokenAnalyzer.String() {
 
 		return false
 	}
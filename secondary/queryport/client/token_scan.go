@@ -0,0 +1,153 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// TokenMatch specifies how the tokens of a token search are matched
+// against the tokens of a token index.
+type TokenMatch int
+
+const (
+	// TokenMatchAll matches documents containing all tokens of the text.
+	TokenMatchAll TokenMatch = iota
+	// TokenMatchPrefix matches documents containing a token starting
+	// with the text.
+	TokenMatchPrefix
+)
+
+// TokenScan searches a token index and returns the sorted list of
+// document ids matching the text. The text is analyzed with the
+// analyzer of the index. A limit of zero or less returns all matching
+// documents.
+func (c *GsiClient) TokenScan(
+	defnID uint64, requestId string, text string, match TokenMatch,
+	limit int64, cons common.Consistency, vector *TsConsistency,
+	scanParams map[string]interface{}) ([][]byte, error) {
+
+	if c.bridge == nil {
+		return nil, ErrorClientUninitialized
+	}
+
+	defn := c.bridge.GetIndexDefn(defnID)
+	if defn == nil {
+		return nil, ErrorIndexNotFound
+	}
+	if defn.TokenAnalyzer == nil {
+		return nil, ErrorNotTokenIndex
+	}
+
+	var docids map[string]bool
+
+	switch match {
+	case TokenMatchAll:
+		tokens := defn.TokenAnalyzer.Analyze(text)
+		if len(tokens) == 0 {
+			return nil, nil
+		}
+		for _, token := range tokens {
+			matched, err := c.tokenRangeScan(defnID, requestId, token, token, cons, vector, scanParams)
+			if err != nil {
+				return nil, err
+			}
+			if docids == nil {
+				docids = matched
+			} else {
+				for docid := range docids {
+					if !matched[docid] {
+						delete(docids, docid)
+					}
+				}
+			}
+			if len(docids) == 0 {
+				break
+			}
+		}
+
+	case TokenMatchPrefix:
+		prefix := defn.TokenAnalyzer.AnalyzeTerm(text)
+		if len(prefix) == 0 {
+			return nil, nil
+		}
+		high := prefix + string(utf8.MaxRune)
+		matched, err := c.tokenRangeScan(defnID, requestId, prefix, high, cons, vector, scanParams)
+		if err != nil {
+			return nil, err
+		}
+		docids = matched
+
+	default:
+		return nil, fmt.Errorf("invalid token match %v", match)
+	}
+
+	result := make([][]byte, 0, len(docids))
+	for docid := range docids {
+		result = append(result, []byte(docid))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return string(result[i]) < string(result[j])
+	})
+	if limit > 0 && int64(len(result)) > limit {
+		result = result[:limit]
+	}
+
+	logging.Verbosef("TokenScan {%v,%v} - matched %v documents", defnID, requestId, len(result))
+	return result, nil
+}
+
+// tokenRangeScan returns the set of document ids having a token
+// between low and high (both inclusive).
+func (c *GsiClient) tokenRangeScan(
+	defnID uint64, requestId string, low, high string,
+	cons common.Consistency, vector *TsConsistency,
+	scanParams map[string]interface{}) (map[string]bool, error) {
+
+	docids := make(map[string]bool)
+	var scanErr error
+	var mutex sync.Mutex
+
+	callb := func(resp ResponseReader) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if err := resp.Error(); err != nil {
+			scanErr = err
+			return false
+		}
+		_, pkeys, err := resp.GetEntries(c.GetDataEncodingFormat())
+		if err != nil {
+			scanErr = err
+			return false
+		}
+		for _, pkey := range pkeys {
+			docids[string(pkey)] = true
+		}
+		return true
+	}
+
+	scans := Scans{
+		&Scan{
+			Filter: []*CompositeElementFilter{
+				&CompositeElementFilter{Low: low, High: high, Inclusion: Both},
+			},
+		},
+	}
+
+	err := c.MultiScan(defnID, requestId, scans, false /*reverse*/, false, /*distinct*/
+		nil /*projection*/, 0 /*offset*/, math.MaxInt64 /*limit*/, cons, vector, callb, scanParams)
+	if err != nil {
+		return nil, err
+	}
+	if scanErr != nil {
+		return nil, scanErr
+	}
+
+	return docids, nil
+}
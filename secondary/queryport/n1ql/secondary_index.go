@@ -381,6 +381,10 @@ func (gsi *gsiKeyspace) CreatePrimaryIndex3(
 		}
 	}()
 
+	if err := rejectJavaScriptIndex(with); err != nil {
+		return nil, err
+	}
+
 	var withJSON []byte
 	var err error
 	if with != nil {
@@ -469,6 +473,13 @@ func (gsi *gsiKeyspace) CreateIndex(
 		secStrs[i] = s
 	}
 
+	if err := rejectTokenIndex(with); err != nil {
+		return nil, err
+	}
+	if err := rejectJavaScriptIndex(with); err != nil {
+		return nil, err
+	}
+
 	var withJSON []byte
 	var err error
 	if with != nil {
@@ -572,6 +583,13 @@ func (gsi *gsiKeyspace) CreateIndex3(
 		}
 	}
 
+	if err := rejectTokenIndex(with); err != nil {
+		return nil, err
+	}
+	if err := rejectJavaScriptIndex(with); err != nil {
+		return nil, err
+	}
+
 	// with
 	var withJSON []byte
 	var err error
@@ -768,6 +786,15 @@ func (gsi *gsiKeyspace) Refresh() errors.Error {
 				index.Definition.Collection != gsi.keyspace {
 				continue
 			}
+			// the leading key of a token index is the array of tokens of the
+			// key, not the key itself, so N1QL cannot plan with it.
+			if index.Definition.TokenAnalyzer != nil {
+				continue
+			}
+			// keys of a JavaScript index are not N1QL expressions.
+			if strings.EqualFold(string(index.Definition.ExprType), string(c.JavaScript)) {
+				continue
+			}
 			si, err := newSecondaryIndexFromMetaData(gsi, clusterVersion, index)
 			if err != nil {
 				return err
@@ -849,6 +876,36 @@ func (gsi *gsiKeyspace) setIndexes(si []*secondaryIndex,
 	return nil
 }
 
+// rejectTokenIndex returns an error if the WITH clause asks for a token
+// index. Token indexes are hidden from N1QL, which cannot plan with them,
+// and are created and scanned with the GSI client (cbindex).
+func rejectTokenIndex(with value.Value) errors.Error {
+	if with == nil {
+		return nil
+	}
+	if _, ok := with.Field("tokenize"); ok {
+		return errors.NewError(nil,
+			"GSI CreateIndex() - tokenize is not supported by N1QL, create token indexes with cbindex")
+	}
+	return nil
+}
+
+// rejectJavaScriptIndex returns an error if the WITH clause asks for an
+// expression type other than N1QL. Index keys created from N1QL are N1QL
+// expressions, JavaScript indexes are created with the GSI client (cbindex).
+func rejectJavaScriptIndex(with value.Value) errors.Error {
+	if with == nil {
+		return nil
+	}
+	if exprType, ok := with.Field("exprType"); ok {
+		if s, ok := exprType.Actual().(string); !ok || !strings.EqualFold(s, "N1QL") {
+			return errors.NewError(nil, fmt.Sprintf("GSI CreateIndex() - exprType %v is not "+
+				"supported by N1QL, create JavaScript indexes with cbindex", exprType))
+		}
+	}
+	return nil
+}
+
 // for getIndex() use IndexById()
 
 func (gsi *gsiKeyspace) delIndex(id string) {
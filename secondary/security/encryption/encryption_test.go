@@ -0,0 +1,220 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func newTestKeyStore(t *testing.T, ids ...string) (string, KeyProvider) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	for _, id := range ids {
+		key, err := GenerateKey(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := AddKeyToFileKeyStore(path, key, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	provider, err := NewKeyProvider(FileKeyProviderName, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, provider
+}
+
+func encrypt(t *testing.T, provider KeyProvider, data []byte) []byte {
+	key, err := provider.ActiveKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	w, err := NewWriter(&out, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write in odd sized pieces to cross chunk boundaries
+	for len(data) > 0 {
+		n := 7777
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	_, provider := newTestKeyStore(t, "key-1")
+
+	for _, size := range []int{0, 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 100} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 31)
+		}
+
+		enc := encrypt(t, provider, data)
+		if !IsEncrypted(enc) {
+			t.Fatalf("size %v: missing header", size)
+		}
+		if size > 16 && bytes.Contains(enc, data[:16]) {
+			t.Fatalf("size %v: plaintext found in encrypted stream", size)
+		}
+
+		r, err := NewReader(bytes.NewReader(enc), provider)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.KeyId() != "key-1" {
+			t.Fatalf("unexpected key id %v", r.KeyId())
+		}
+		dec, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %v: %v", size, err)
+		}
+		if !bytes.Equal(dec, data) {
+			t.Fatalf("size %v: decrypted data mismatch", size)
+		}
+	}
+}
+
+func TestStreamKeyPerStream(t *testing.T) {
+	_, provider := newTestKeyStore(t, "key-1")
+
+	// streams encrypted with the same key have their own salt and stream
+	// key, so the same data never encrypts to the same chunks
+	data := bytes.Repeat([]byte("index data "), 100)
+	enc1 := encrypt(t, provider, data)
+	enc2 := encrypt(t, provider, data)
+
+	headerSize := len(streamMagic) + 2 + len("key-1") + saltSize
+	salt1 := enc1[headerSize-saltSize : headerSize]
+	salt2 := enc2[headerSize-saltSize : headerSize]
+	if bytes.Equal(salt1, salt2) {
+		t.Fatalf("streams have the same salt")
+	}
+	if bytes.Equal(enc1[headerSize:], enc2[headerSize:]) {
+		t.Fatalf("streams have the same ciphertext")
+	}
+
+	key, _ := provider.ActiveKey()
+	if bytes.Equal(deriveStreamKey(key.Bytes, salt1), deriveStreamKey(key.Bytes, salt2)) ||
+		bytes.Equal(deriveStreamKey(key.Bytes, salt1), key.Bytes) {
+		t.Fatalf("stream keys are not derived per stream")
+	}
+
+	// a stream does not decrypt with the salt of another
+	swapped := append(append([]byte(nil), enc1[:headerSize-saltSize]...), salt2...)
+	swapped = append(swapped, enc1[headerSize:]...)
+	r, _ := NewReader(bytes.NewReader(swapped), provider)
+	if _, err := ioutil.ReadAll(r); err != ErrCorruptedStream {
+		t.Fatalf("expected %v, got %v", ErrCorruptedStream, err)
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	_, provider := newTestKeyStore(t, "key-1")
+
+	data := bytes.Repeat([]byte("index data "), ChunkSize/4)
+	enc := encrypt(t, provider, data)
+
+	// truncated within a chunk, and at a chunk boundary
+	headerSize := len(streamMagic) + 2 + len("key-1") + saltSize
+	for _, size := range []int{len(enc) - 100, headerSize + 4 + ChunkSize + 16} {
+		r, _ := NewReader(bytes.NewReader(enc[:size]), provider)
+		if _, err := ioutil.ReadAll(r); err != ErrTruncatedStream {
+			t.Fatalf("expected %v, got %v", ErrTruncatedStream, err)
+		}
+	}
+
+	corrupted := append([]byte(nil), enc...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	r, _ := NewReader(bytes.NewReader(corrupted), provider)
+	if _, err := ioutil.ReadAll(r); err != ErrCorruptedStream {
+		t.Fatalf("expected %v, got %v", ErrCorruptedStream, err)
+	}
+
+	if _, err := NewReader(bytes.NewReader(data), provider); err != ErrNotEncrypted {
+		t.Fatalf("expected %v, got %v", ErrNotEncrypted, err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	path, provider := newTestKeyStore(t, "key-1")
+	SetKeyProvider(provider)
+	defer SetKeyProvider(nil)
+
+	data := []byte("encrypted with the first key")
+	enc := encrypt(t, provider, data)
+	if status := GetStatus("key-1"); status != StatusEncrypted {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	key, _ := GenerateKey("key-2")
+	if err := AddKeyToFileKeyStore(path, key, true); err != nil {
+		t.Fatal(err)
+	}
+	if id := ActiveKeyId(); id != "key-2" {
+		t.Fatalf("expected active key key-2, got %v", id)
+	}
+	if status := GetStatus("key-1"); status != StatusRotationPending {
+		t.Fatalf("unexpected status %v", status)
+	}
+
+	// files encrypted with the old key remain readable
+	r, err := NewReader(bytes.NewReader(enc), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec, err := io.ReadAll(r); err != nil || !bytes.Equal(dec, data) {
+		t.Fatalf("failed to decrypt with old key: %v", err)
+	}
+
+	SetKeyProvider(nil)
+	if status := GetStatus(""); status != StatusPlaintext {
+		t.Fatalf("unexpected status %v", status)
+	}
+	if _, err := NewReader(bytes.NewReader(enc), nil); err == nil {
+		t.Fatalf("expected error decrypting without key provider")
+	}
+}
+
+func TestAppendedStreams(t *testing.T) {
+	path, provider := newTestKeyStore(t, "key-1")
+
+	first := bytes.Repeat([]byte("first "), ChunkSize/3)
+	enc := encrypt(t, provider, first)
+
+	// the file is appended to after the key is rotated
+	key, _ := GenerateKey("key-2")
+	if err := AddKeyToFileKeyStore(path, key, true); err != nil {
+		t.Fatal(err)
+	}
+	second := []byte("second")
+	enc = append(enc, encrypt(t, provider, second)...)
+
+	r, err := NewReader(bytes.NewReader(enc), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, append(first, second...)) {
+		t.Fatalf("decrypted data mismatch")
+	}
+	if r.KeyId() != "key-2" {
+		t.Fatalf("unexpected key id %v", r.KeyId())
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/couchbase/indexing/secondary/iowrap"
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+const FileKeyProviderName = "file"
+
+// FileKeyStore is a key provider reading keys from a local JSON file, meant
+// for local testing. The file has the format
+//
+//	{
+//	  "activeKey": "key-2",
+//	  "keys": [
+//	    {"id": "key-1", "cipher": "AES-256-GCM", "key": "<base64 encoded key>"},
+//	    {"id": "key-2", "cipher": "AES-256-GCM", "key": "<base64 encoded key>"}
+//	  ]
+//	}
+//
+// The file is reloaded when it changes, so a key can be rotated by adding a
+// new key and making it active. Keys of existing files must be kept in the
+// keystore until all files are re-encrypted.
+type FileKeyStore struct {
+	path string
+
+	mutex   sync.Mutex
+	modTime time.Time
+	size    int64
+	active  string
+	keys    map[string]*Key
+}
+
+type keyStoreFile struct {
+	ActiveKey string         `json:"activeKey"`
+	Keys      []keyStoreItem `json:"keys"`
+}
+
+type keyStoreItem struct {
+	Id     string `json:"id"`
+	Cipher string `json:"cipher,omitempty"`
+	Key    []byte `json:"key"`
+}
+
+// NewFileKeyStore opens the keystore at path.
+func NewFileKeyStore(path string) (KeyProvider, error) {
+
+	if len(path) == 0 {
+		return nil, fmt.Errorf("file key provider requires the path of the keystore")
+	}
+
+	ks := &FileKeyStore{path: path}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *FileKeyStore) Name() string {
+	return FileKeyProviderName
+}
+
+func (ks *FileKeyStore) ActiveKey() (*Key, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	if err := ks.reloadNoLock(); err != nil {
+		return nil, err
+	}
+	if len(ks.active) == 0 {
+		return nil, ErrNoActiveKey
+	}
+	key, ok := ks.keys[ks.active]
+	if !ok {
+		return nil, fmt.Errorf("%v: active key %v", ErrKeyNotFound, ks.active)
+	}
+	return key, nil
+}
+
+func (ks *FileKeyStore) GetKey(id string) (*Key, error) {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	if err := ks.reloadNoLock(); err != nil {
+		return nil, err
+	}
+	key, ok := ks.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%v: %v", ErrKeyNotFound, id)
+	}
+	return key, nil
+}
+
+func (ks *FileKeyStore) reload() error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	return ks.reloadNoLock()
+}
+
+// reloadNoLock reads the keystore if it changed since it was last read. If
+// the keystore cannot be read, previously loaded keys remain in use.
+func (ks *FileKeyStore) reloadNoLock() error {
+
+	info, err := iowrap.Os_Stat(ks.path)
+	if err != nil {
+		if ks.keys != nil {
+			logging.Warnf("FileKeyStore: failed to stat keystore %v, using cached keys: %v", ks.path, err)
+			return nil
+		}
+		return err
+	}
+	if ks.keys != nil && info.ModTime().Equal(ks.modTime) && info.Size() == ks.size {
+		return nil
+	}
+
+	data, err := iowrap.Ioutil_ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+
+	var content keyStoreFile
+	if err := json.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("failed to parse keystore %v: %v", ks.path, err)
+	}
+
+	keys := make(map[string]*Key, len(content.Keys))
+	for _, item := range content.Keys {
+		key := &Key{Id: item.Id, Cipher: item.Cipher, Bytes: item.Key}
+		if len(key.Cipher) == 0 {
+			key.Cipher = CipherAES256GCM
+		}
+		if err := key.validate(); err != nil {
+			return fmt.Errorf("keystore %v: %v", ks.path, err)
+		}
+		if _, ok := keys[key.Id]; ok {
+			return fmt.Errorf("keystore %v: duplicate key %v", ks.path, key.Id)
+		}
+		keys[key.Id] = key
+	}
+	if _, ok := keys[content.ActiveKey]; len(content.ActiveKey) != 0 && !ok {
+		return fmt.Errorf("keystore %v: active key %v not found", ks.path, content.ActiveKey)
+	}
+
+	if ks.keys != nil && ks.active != content.ActiveKey {
+		logging.Infof("FileKeyStore: active key changed from %v to %v", ks.active, content.ActiveKey)
+	}
+
+	ks.keys = keys
+	ks.active = content.ActiveKey
+	ks.modTime = info.ModTime()
+	ks.size = info.Size()
+	return nil
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey(id string) (*Key, error) {
+
+	key := &Key{Id: id, Cipher: CipherAES256GCM, Bytes: make([]byte, KeySize)}
+	if _, err := rand.Read(key.Bytes); err != nil {
+		return nil, err
+	}
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AddKeyToFileKeyStore adds a key to the keystore at path, creating the
+// keystore if it does not exist. If activate is true, the key becomes the
+// active key, which rotates the key of index storage files.
+func AddKeyToFileKeyStore(path string, key *Key, activate bool) error {
+
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	var content keyStoreFile
+	data, err := iowrap.Ioutil_ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &content); err != nil {
+			return fmt.Errorf("failed to parse keystore %v: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, item := range content.Keys {
+		if item.Id == key.Id {
+			return fmt.Errorf("keystore %v: duplicate key %v", path, key.Id)
+		}
+	}
+	content.Keys = append(content.Keys, keyStoreItem{Id: key.Id, Cipher: key.Cipher, Key: key.Bytes})
+	if activate {
+		content.ActiveKey = key.Id
+	}
+
+	data, err = json.MarshalIndent(&content, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that readers never see a
+	// partially written keystore
+	tmpfile := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := iowrap.Ioutil_WriteFile(tmpfile, data, 0600); err != nil {
+		return err
+	}
+	return iowrap.Os_Rename(tmpfile, path)
+}
@@ -0,0 +1,208 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+// Package encryption implements encryption at rest of index storage files.
+//
+// Data encryption keys are supplied by a KeyProvider. Each encrypted file
+// records the id of the key it is encrypted with, so that keys can be
+// rotated: new files are encrypted with the active key, and existing files
+// remain readable as long as their key is known to the provider.
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/couchbase/indexing/secondary/logging"
+)
+
+// KeySize is the size of a data encryption key. Files are encrypted with
+// AES-256-GCM.
+const KeySize = 32
+
+const CipherAES256GCM = "AES-256-GCM"
+
+var (
+	ErrKeyNotFound      = errors.New("encryption key not found")
+	ErrNoActiveKey      = errors.New("key provider has no active encryption key")
+	ErrInvalidKey       = errors.New("invalid encryption key")
+	ErrUnknownProvider  = errors.New("unknown encryption key provider")
+	ErrProviderDisabled = errors.New("encryption key provider is not configured")
+)
+
+// Key is a data encryption key.
+type Key struct {
+	Id     string
+	Cipher string
+	Bytes  []byte
+}
+
+func (k *Key) validate() error {
+	if len(k.Id) == 0 || len(k.Id) > maxKeyIdLen {
+		return fmt.Errorf("%v: key id must be between 1 and %v characters", ErrInvalidKey, maxKeyIdLen)
+	}
+	if k.Cipher != CipherAES256GCM {
+		return fmt.Errorf("%v: unsupported cipher %v for key %v", ErrInvalidKey, k.Cipher, k.Id)
+	}
+	if len(k.Bytes) != KeySize {
+		return fmt.Errorf("%v: key %v must be %v bytes", ErrInvalidKey, k.Id, KeySize)
+	}
+	return nil
+}
+
+// KeyProvider supplies data encryption keys.
+type KeyProvider interface {
+	// Name of the key provider
+	Name() string
+
+	// ActiveKey returns the key new files are encrypted with.
+	ActiveKey() (*Key, error)
+
+	// GetKey returns a key by its id, to decrypt existing files.
+	GetKey(id string) (*Key, error)
+}
+
+// KeyProviderFactory creates a key provider from its configuration
+// string, e.g. the path of the keystore for the file key provider.
+type KeyProviderFactory func(config string) (KeyProvider, error)
+
+var factoryLock sync.Mutex
+var factories = map[string]KeyProviderFactory{
+	FileKeyProviderName: NewFileKeyStore,
+}
+
+// RegisterKeyProvider registers a key provider factory, to be selected
+// with the indexer.encryption.keyProvider setting.
+func RegisterKeyProvider(name string, factory KeyProviderFactory) {
+	factoryLock.Lock()
+	defer factoryLock.Unlock()
+
+	factories[name] = factory
+}
+
+// NewKeyProvider creates a key provider registered under name.
+func NewKeyProvider(name, config string) (KeyProvider, error) {
+	factoryLock.Lock()
+	factory, ok := factories[name]
+	factoryLock.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%v: %v", ErrUnknownProvider, name)
+	}
+	return factory(config)
+}
+
+// key provider used by index storage, nil if encryption is disabled.
+var keyProvider unsafe.Pointer
+
+type providerHolder struct {
+	provider KeyProvider
+}
+
+// Init sets the key provider used by index storage. Encryption is disabled
+// when name is empty.
+func Init(name, config string) error {
+
+	if len(name) == 0 {
+		SetKeyProvider(nil)
+		return nil
+	}
+
+	provider, err := NewKeyProvider(name, config)
+	if err != nil {
+		return err
+	}
+	if _, err := provider.ActiveKey(); err != nil {
+		return err
+	}
+
+	SetKeyProvider(provider)
+	logging.Infof("encryption: index storage encryption enabled with key provider %v", name)
+	return nil
+}
+
+// SetKeyProvider sets the key provider used by index storage.
+func SetKeyProvider(provider KeyProvider) {
+	atomic.StorePointer(&keyProvider, unsafe.Pointer(&providerHolder{provider: provider}))
+}
+
+// GetKeyProvider returns the key provider used by index storage, or nil
+// if encryption is disabled.
+func GetKeyProvider() KeyProvider {
+	if holder := (*providerHolder)(atomic.LoadPointer(&keyProvider)); holder != nil {
+		return holder.provider
+	}
+	return nil
+}
+
+// Enabled returns true if index storage is encrypted.
+func Enabled() bool {
+	return GetKeyProvider() != nil
+}
+
+// ActiveKeyId returns the id of the active key, or an empty string if
+// encryption is disabled or the provider fails to supply the key.
+func ActiveKeyId() string {
+	provider := GetKeyProvider()
+	if provider == nil {
+		return ""
+	}
+	key, err := provider.ActiveKey()
+	if err != nil {
+		return ""
+	}
+	return key.Id
+}
+
+// Encryption status of an index, reported by the encryption_status stat.
+const (
+	// index data is encrypted with the active key
+	StatusEncrypted = "encrypted"
+	// index data is encrypted with a key other than the active key, or is
+	// not encrypted yet while encryption is enabled. The data will be
+	// re-encrypted with the active key on next compaction or snapshot.
+	StatusRotationPending = "rotation_pending"
+	// index data is not encrypted
+	StatusPlaintext = "plaintext"
+	// the storage engine does not support encryption
+	StatusUnsupported = "unsupported"
+)
+
+// GetStatus returns the encryption status of data encrypted with the key
+// keyId. An empty keyId denotes unencrypted data.
+func GetStatus(keyId string) string {
+	activeKeyId := ActiveKeyId()
+	switch {
+	case len(keyId) == 0 && len(activeKeyId) == 0:
+		return StatusPlaintext
+	case keyId == activeKeyId:
+		return StatusEncrypted
+	default:
+		return StatusRotationPending
+	}
+}
+
+// MergeStatus returns the status of index data made up of parts with status
+// a and b, e.g. the partitions of an index. An empty status is ignored.
+func MergeStatus(a, b string) string {
+	switch {
+	case len(a) == 0 || a == b:
+		return b
+	case len(b) == 0:
+		return a
+	case a == StatusUnsupported || b == StatusUnsupported:
+		return StatusUnsupported
+	default:
+		// some parts are encrypted while others are not, or are
+		// encrypted with a different key
+		return StatusRotationPending
+	}
+}
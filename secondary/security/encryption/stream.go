@@ -0,0 +1,346 @@
+// Copyright 2014-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included
+// in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+// in that file, in accordance with the Business Source License, use of this
+// software will be governed by the Apache License, Version 2.0, included in
+// the file licenses/APL2.txt.
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// An encrypted stream starts with a header
+//
+//	magic (8 bytes) | key id length (2 bytes) | key id | salt (32 bytes)
+//
+// followed by chunks of at most ChunkSize bytes of data, each sealed with
+// AES-256-GCM
+//
+//	flags and length (4 bytes) | ciphertext and tag
+//
+// Chunks are not sealed with the key itself but with a stream key derived
+// from it and the random salt of the stream (HKDF-SHA256), so that nonces
+// are never reused across the many files encrypted with the same key. The
+// nonce of a chunk is its sequence number, and the 4 bytes preceding the
+// ciphertext are authenticated along with it. The last chunk is flagged so
+// that a truncated stream is detected.
+
+var streamMagic = []byte("\x00GSIENC\x01")
+
+const (
+	ChunkSize = 64 * 1024
+
+	maxKeyIdLen   = 256
+	saltSize      = 32
+	finalChunkBit = uint32(1 << 31)
+)
+
+var (
+	ErrNotEncrypted    = errors.New("stream is not encrypted")
+	ErrTruncatedStream = errors.New("encrypted stream is truncated")
+	ErrCorruptedStream = errors.New("encrypted stream is corrupted")
+)
+
+// IsEncrypted returns true if header, the first bytes of a stream, is the
+// header of an encrypted stream.
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, streamMagic)
+}
+
+// HeaderPeekSize is the number of bytes to peek to detect an encrypted
+// stream with IsEncrypted.
+func HeaderPeekSize() int {
+	return len(streamMagic)
+}
+
+var streamKeyInfo = []byte("gsi encryption stream key")
+
+// deriveStreamKey returns the key of a stream with salt, derived from key
+// with HKDF-SHA256 (RFC 5869). A single block of output is enough for an
+// AES-256 key.
+func deriveStreamKey(key, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(streamKeyInfo)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
+
+// newAEAD returns the cipher sealing the chunks of a stream with salt
+func newAEAD(key *Key, salt []byte) (cipher.AEAD, error) {
+	if err := key.validate(); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(deriveStreamKey(key.Bytes, salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Writer encrypts data written to an underlying writer. Close must be
+// called to write the last chunk; it does not close the underlying writer.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	seq    uint64
+	buf    []byte
+	out    []byte
+	err    error
+	closed bool
+}
+
+// NewWriter returns a writer encrypting data with key.
+func NewWriter(w io.Writer, key *Key) (*Writer, error) {
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	ew := &Writer{
+		w:     w,
+		aead:  aead,
+		nonce: make([]byte, aead.NonceSize()),
+		buf:   make([]byte, 0, ChunkSize),
+		out:   make([]byte, 4, 4+ChunkSize+aead.Overhead()),
+	}
+
+	header := make([]byte, 0, len(streamMagic)+2+len(key.Id)+saltSize)
+	header = append(header, streamMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(key.Id)))
+	header = append(header, key.Id...)
+	header = append(header, salt...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return ew, nil
+}
+
+func (ew *Writer) Write(p []byte) (int, error) {
+
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	if ew.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		m := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+m]
+		p = p[m:]
+		n += m
+
+		// a full chunk is only sealed when more data follows, so that
+		// the last chunk written on Close is never empty unless the
+		// stream is.
+		if len(ew.buf) == cap(ew.buf) && len(p) > 0 {
+			if err := ew.sealChunk(false); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last chunk.
+func (ew *Writer) Close() error {
+	if ew.closed {
+		return ew.err
+	}
+	ew.closed = true
+	if ew.err != nil {
+		return ew.err
+	}
+	return ew.sealChunk(true)
+}
+
+func (ew *Writer) sealChunk(final bool) error {
+
+	length := uint32(len(ew.buf) + ew.aead.Overhead())
+	if final {
+		length |= finalChunkBit
+	}
+
+	binary.BigEndian.PutUint64(ew.nonce[len(ew.nonce)-8:], ew.seq)
+	ew.seq++
+
+	out := ew.out[:4]
+	binary.BigEndian.PutUint32(out, length)
+	out = ew.aead.Seal(out, ew.nonce, ew.buf, out[:4])
+
+	if _, err := ew.w.Write(out); err != nil {
+		ew.err = err
+		return err
+	}
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Reader decrypts data read from an underlying reader. A file that was
+// appended to by several writers holds a sequence of encrypted streams,
+// which are read as one.
+type Reader struct {
+	r        io.Reader
+	provider KeyProvider
+	key      *Key
+	aead     cipher.AEAD
+	nonce    []byte
+	seq      uint64
+	buf      []byte
+	plain    []byte
+	final    bool
+}
+
+// NewReader reads the header of an encrypted stream and returns a reader
+// decrypting the stream with the key, supplied by provider, that the stream
+// was encrypted with.
+func NewReader(r io.Reader, provider KeyProvider) (*Reader, error) {
+
+	er := &Reader{r: r, provider: provider}
+	if err := er.readHeader(); err != nil {
+		if err == io.EOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	return er, nil
+}
+
+// readHeader reads the header of the next stream. It returns io.EOF if
+// the underlying reader has no more data.
+func (er *Reader) readHeader() error {
+
+	header := make([]byte, len(streamMagic)+2)
+	if n, err := io.ReadFull(er.r, header); err != nil {
+		if err == io.EOF || (err == io.ErrUnexpectedEOF && er.key == nil) {
+			return io.EOF
+		} else if err == io.ErrUnexpectedEOF || n > 0 {
+			return ErrTruncatedStream
+		}
+		return err
+	}
+	if !IsEncrypted(header) {
+		if er.key == nil {
+			return ErrNotEncrypted
+		}
+		return ErrCorruptedStream
+	}
+
+	idLen := int(binary.BigEndian.Uint16(header[len(streamMagic):]))
+	if idLen == 0 || idLen > maxKeyIdLen {
+		return ErrCorruptedStream
+	}
+	rest := make([]byte, idLen+saltSize)
+	if _, err := io.ReadFull(er.r, rest); err != nil {
+		return ErrTruncatedStream
+	}
+	keyId := string(rest[:idLen])
+
+	key := er.key
+	if key == nil || key.Id != keyId {
+		if er.provider == nil {
+			return fmt.Errorf("%v: cannot decrypt stream encrypted with key %v", ErrProviderDisabled, keyId)
+		}
+		var err error
+		if key, err = er.provider.GetKey(keyId); err != nil {
+			return err
+		}
+	}
+
+	// every stream has its own salt, and so its own stream key
+	aead, err := newAEAD(key, rest[idLen:])
+	if err != nil {
+		return err
+	}
+	if er.buf == nil {
+		er.nonce = make([]byte, aead.NonceSize())
+		er.buf = make([]byte, 4+ChunkSize+aead.Overhead())
+	}
+	er.key = key
+	er.aead = aead
+	er.seq = 0
+	er.final = false
+	return nil
+}
+
+// KeyId returns the id of the key the stream is encrypted with.
+func (er *Reader) KeyId() string {
+	return er.key.Id
+}
+
+func (er *Reader) Read(p []byte) (int, error) {
+
+	for len(er.plain) == 0 {
+		if er.final {
+			if err := er.readHeader(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := er.openChunk(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, er.plain)
+	er.plain = er.plain[n:]
+	return n, nil
+}
+
+func (er *Reader) openChunk() error {
+
+	if _, err := io.ReadFull(er.r, er.buf[:4]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncatedStream
+		}
+		return err
+	}
+
+	length := binary.BigEndian.Uint32(er.buf[:4])
+	final := length&finalChunkBit != 0
+	length &^= finalChunkBit
+	if length < uint32(er.aead.Overhead()) || int(length) > len(er.buf)-4 {
+		return ErrCorruptedStream
+	}
+
+	chunk := er.buf[4 : 4+length]
+	if _, err := io.ReadFull(er.r, chunk); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncatedStream
+		}
+		return err
+	}
+
+	binary.BigEndian.PutUint64(er.nonce[len(er.nonce)-8:], er.seq)
+	er.seq++
+
+	plain, err := er.aead.Open(chunk[:0], er.nonce, chunk, er.buf[:4])
+	if err != nil {
+		return ErrCorruptedStream
+	}
+	er.plain = plain
+	er.final = final
+	return nil
+}
@@ -362,6 +362,9 @@ func TestPlanner(t *testing.T) {
 	rebalanceTest(t)
 	minMemoryTest(t)
 	iterationTest(t)
+	diffTest(t)
+	forecastTest(t)
+	advisorTest(t)
 }
 
 func TestGreedyPlanner(t *testing.T) {
@@ -512,6 +515,224 @@ func rebalanceTest(t *testing.T) {
 	}
 }
 
+//
+// This test computes the diff between an initial index layout and the layout
+// produced by rebalance.  Every moved index must be accounted for on both the
+// source and destination node, and no index should be created or dropped.
+//
+func diffTest(t *testing.T) {
+
+	log.Printf("-------------------------------------------")
+	log.Printf("diff - 8 identical index, delete 2, 2x")
+
+	plan, err := planner.ReadPlan("../testdata/planner/plan/identical-8-0.json")
+	FailTestIfError(err, "Fail to read plan", t)
+
+	diff, err := planner.DiffPlans(plan, plan, 0)
+	FailTestIfError(err, "Error in diff", t)
+
+	if len(diff.Movements) != 0 || diff.DataMoved != 0 || diff.EstDuration != 0 {
+		t.Fatalf("Diff of identical plans has movements %v", diff.Movements)
+	}
+
+	config := planner.DefaultRunConfig()
+	config.MemQuotaFactor = 2
+	config.CpuQuotaFactor = 2
+	config.DeleteNode = 2
+	config.Resize = false
+
+	// rebalance may modify the layout in place, so keep a separate copy of the initial layout
+	initial, err := planner.ReadPlan("../testdata/planner/plan/identical-8-0.json")
+	FailTestIfError(err, "Fail to read plan", t)
+
+	s := planner.NewSimulator()
+
+	p, _, err := s.RunSingleTestRebal(config, planner.CommandRebalance, nil, initial, nil)
+	FailTestIfError(err, "Error in planner test", t)
+
+	proposed := &planner.Plan{
+		Placement: p.GetResult().Placement,
+		IsLive:    plan.IsLive,
+	}
+
+	diff, err = planner.DiffPlans(plan, proposed, 1024)
+	FailTestIfError(err, "Error in diff", t)
+	diff.Print()
+
+	if diff.NumCreated != 0 || diff.NumDropped != 0 {
+		t.Fatalf("Rebalance diff has created %v dropped %v index", diff.NumCreated, diff.NumDropped)
+	}
+
+	if diff.NumMoved == 0 {
+		t.Fatalf("Rebalance diff does not have moved index")
+	}
+
+	var numIn, numOut, dataIn, dataOut uint64
+	for _, node := range diff.Nodes {
+		numIn += node.NumIndexIn
+		numOut += node.NumIndexOut
+		dataIn += node.DataIn
+		dataOut += node.DataOut
+	}
+
+	if numIn != diff.NumMoved || numOut != diff.NumMoved || dataIn != diff.DataMoved || dataOut != diff.DataMoved {
+		t.Fatalf("Node deltas do not match moved index: moved %v (%v) in %v (%v) out %v (%v)",
+			diff.NumMoved, diff.DataMoved, numIn, dataIn, numOut, dataOut)
+	}
+}
+
+//
+// This test forecasts capacity from a series of stats snapshots generated for
+// an index layout.  Without growth, no rebalance is needed.  With steady growth
+// of items count, the nodes will exceed memory quota and more nodes are needed.
+//
+func forecastTest(t *testing.T) {
+
+	genSnapshots := func(plan *planner.Plan, growth float64) []*planner.StatsSnapshot {
+		var snapshots []*planner.StatsSnapshot
+		start := time.Now()
+		for i := 0; i < 10; i++ {
+			snapshot := &planner.StatsSnapshot{
+				Timestamp: start.Add(time.Duration(i) * time.Hour),
+				Stats:     make(map[string]map[string]interface{}),
+			}
+			for _, indexer := range plan.Placement {
+				stats := make(map[string]interface{})
+				for _, index := range indexer.Indexes {
+					items := float64(index.NumOfDocs) + growth*float64(i*3600)
+					prefix := common.GetStatsPrefix(index.Bucket, index.Scope, index.Collection, index.Name, 0, 0, false)
+					stats[common.GetIndexStatKey(prefix, "items_count")] = items
+					stats[common.GetIndexStatKey(prefix, "data_size")] = items * 400
+					stats[common.GetIndexStatKey(prefix, "disk_size")] = items * 400
+				}
+				snapshot.Stats[indexer.NodeId] = stats
+			}
+			snapshots = append(snapshots, snapshot)
+		}
+		return snapshots
+	}
+
+	func() {
+		log.Printf("-------------------------------------------")
+		log.Printf("forecast - 8 identical index, no growth")
+
+		plan, err := planner.ReadPlan("../testdata/planner/plan/identical-8-0.json")
+		FailTestIfError(err, "Fail to read plan", t)
+		plan.MemQuota = 1024 * 1024 * 1024 * 1024
+
+		forecast, err := planner.ForecastCapacity(plan, genSnapshots(plan, 0), planner.GetNewGeneralSizingMethod(), 30, 0)
+		FailTestIfError(err, "Error in forecast", t)
+		forecast.Print()
+
+		if forecast.Rebalance != nil {
+			t.Fatalf("Forecast without growth requires rebalance %v", forecast.Rebalance)
+		}
+	}()
+
+	func() {
+		log.Printf("-------------------------------------------")
+		log.Printf("forecast - 8 identical index, 1000 items/sec growth")
+
+		plan, err := planner.ReadPlan("../testdata/planner/plan/identical-8-0.json")
+		FailTestIfError(err, "Fail to read plan", t)
+		plan.MemQuota = 1024 * 1024 * 1024 * 1024
+
+		forecast, err := planner.ForecastCapacity(plan, genSnapshots(plan, 1000), planner.GetNewGeneralSizingMethod(), 3650, 0)
+		FailTestIfError(err, "Error in forecast", t)
+		forecast.Print()
+
+		if forecast.Rebalance == nil || forecast.Rebalance.AddNode == 0 {
+			t.Fatalf("Forecast with growth does not require adding node")
+		}
+
+		for _, node := range forecast.Nodes {
+			if node.MemExceedTime == nil || node.MemExceedTime.After(forecast.End) {
+				t.Fatalf("Node %v is not projected to exceed memory quota", node.NodeId)
+			}
+		}
+	}()
+}
+
+//
+// This test runs index advisor on a layout with an unused index, a duplicate
+// index and an index whose keys are a prefix of another index.
+//
+func advisorTest(t *testing.T) {
+
+	log.Printf("-------------------------------------------")
+	log.Printf("advisor - unused, duplicate and redundant index")
+
+	newIndex := func(defnId common.IndexDefnId, name string, secExprs []string, where string, numRequests uint64) *planner.IndexUsage {
+		defn := common.IndexDefn{
+			DefnId:     defnId,
+			Name:       name,
+			Bucket:     "bucket1",
+			Scope:      common.DEFAULT_SCOPE,
+			Collection: common.DEFAULT_COLLECTION,
+			SecExprs:   secExprs,
+			WhereExpr:  where,
+			ExprType:   common.N1QL,
+		}
+		return &planner.IndexUsage{
+			DefnId:            defnId,
+			InstId:            common.IndexInstId(defnId),
+			Name:              name,
+			Bucket:            defn.Bucket,
+			Scope:             defn.Scope,
+			Collection:        defn.Collection,
+			NumOfDocs:         1000,
+			AvgSecKeySize:     20,
+			AvgDocKeySize:     20,
+			ActualNumRequests: numRequests,
+			Instance: &common.IndexInst{
+				InstId: common.IndexInstId(defnId),
+				Defn:   defn,
+				State:  common.INDEX_STATE_ACTIVE,
+			},
+		}
+	}
+
+	plan := &planner.Plan{
+		Placement: []*planner.IndexerNode{
+			{
+				NodeId: "node1",
+				Indexes: []*planner.IndexUsage{
+					newIndex(1, "idx_a", []string{"a"}, "", 10),
+					newIndex(2, "idx_ab", []string{"a", "b"}, "", 10),
+					newIndex(3, "idx_c", []string{"c"}, "", 10),
+					newIndex(4, "idx_c_dup", []string{"c"}, "", 0),
+					newIndex(5, "idx_d", []string{"d"}, "", 0),
+					newIndex(6, "idx_e", []string{"e"}, "", 10),
+					newIndex(7, "idx_ef", []string{"e", "f"}, "type = \"x\"", 10),
+				},
+			},
+		},
+	}
+
+	report, err := planner.AdviseIndexes(plan, planner.GetNewGeneralSizingMethod())
+	FailTestIfError(err, "Error in advisor", t)
+	report.Print()
+
+	expected := map[string]planner.AdviceType{
+		"idx_a":     planner.AdviceRedundant,
+		"idx_c_dup": planner.AdviceDuplicate,
+		"idx_d":     planner.AdviceUnused,
+	}
+
+	if len(report.Advices) != len(expected) {
+		t.Fatalf("Expected %v advices, got %v", len(expected), len(report.Advices))
+	}
+
+	for _, advice := range report.Advices {
+		if advice.Type != expected[advice.Name] {
+			t.Fatalf("Unexpected advice %v for index %v", advice.Type, advice.Name)
+		}
+		if advice.MemSaving == 0 || advice.DataSaving == 0 {
+			t.Fatalf("Advice for index %v has no estimated saving", advice.Name)
+		}
+	}
+}
+
 func minMemoryTest(t *testing.T) {
 
 	func() {
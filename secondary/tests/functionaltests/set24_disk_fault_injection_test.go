@@ -0,0 +1,214 @@
+package functionaltests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/iowrap"
+	tc "github.com/couchbase/indexing/secondary/tests/framework/common"
+	"github.com/couchbase/indexing/secondary/tests/framework/datautility"
+	"github.com/couchbase/indexing/secondary/tests/framework/secondaryindex"
+	tv "github.com/couchbase/indexing/secondary/tests/framework/validation"
+)
+
+// =====================================================
+// Disk fault injection tests. Faults are injected into the
+// I/O of MOI disk snapshots, so these tests only run with
+// memory_optimized storage.
+// =====================================================
+
+type faultInjectionResponse struct {
+	Code         string              `json:"code"`
+	Error        string              `json:"error,omitempty"`
+	Config       *iowrap.FaultConfig `json:"config,omitempty"`
+	Stats        *iowrap.FaultStats  `json:"stats,omitempty"`
+	DiskFailures uint64              `json:"diskFailures"`
+}
+
+// MOI snapshot data files are named shard-N
+const faultInjectionPathFilter = "shard-"
+
+func faultInjectionRequest(method string, config *iowrap.FaultConfig) (*faultInjectionResponse, error) {
+	url, err := makeurl("/test/faultInjection")
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if config != nil {
+		if body, err = json.Marshal(config); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%v /test/faultInjection status %v: %s", method, resp.Status, respBody)
+	}
+
+	var result faultInjectionResponse
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func skipIfNotMOI(t *testing.T) bool {
+	if clusterconfig.IndexUsing != "memory_optimized" {
+		log.Printf("Skipping %v as storage mode is not memory_optimized", t.Name())
+		return true
+	}
+	return false
+}
+
+func setMOIPersistedSnapshotInterval(interval float64, t *testing.T) {
+	err := secondaryindex.ChangeIndexerSettings("indexer.settings.persisted_snapshot.moi.interval",
+		interval, clusterconfig.Username, clusterconfig.Password, kvaddress)
+	FailTestIfError(err, "Error in ChangeIndexerSettings", t)
+}
+
+func validateAgeScan(indexName string, t *testing.T) {
+	docScanResults := datautility.ExpectedScanResponse_int64(docs, "age", 0, 90, 1)
+	scanResults, err := secondaryindex.Range(indexName, "default", indexScanAddress, []interface{}{0}, []interface{}{90}, 1, false, defaultlimit, c.SessionConsistency, nil)
+	FailTestIfError(err, "Error in scan", t)
+	err = tv.Validate(docScanResults, scanResults)
+	FailTestIfError(err, "Error in scan result validation", t)
+}
+
+// Disk snapshot writes fail with ENOSPC and fsyncs are delayed. The index
+// must keep serving scans from memory, and persist a snapshot it recovers
+// from once the disk has space again.
+func TestDiskFaultInjection_WriteFailures(t *testing.T) {
+	log.Printf("In TestDiskFaultInjection_WriteFailures()")
+	if skipIfNotMOI(t) {
+		return
+	}
+
+	var indexName = "idx_fault_age"
+
+	secondaryindex.DropAllSecondaryIndexes(indexManagementAddress)
+	err := secondaryindex.CreateSecondaryIndex(indexName, "default", indexManagementAddress, "", []string{"age"}, false, nil, true, defaultIndexActiveTimeout, nil)
+	FailTestIfError(err, "Error in creating the index", t)
+
+	setMOIPersistedSnapshotInterval(5000, t)
+	defer setMOIPersistedSnapshotInterval(600000, t)
+
+	resp, err := faultInjectionRequest("POST", &iowrap.FaultConfig{
+		PathFilter:       faultInjectionPathFilter,
+		EnospcAfterBytes: 1,
+		SyncDelayMs:      100,
+	})
+	FailTestIfError(err, "Error in setting fault injection", t)
+	diskFailures := resp.DiskFailures
+
+	CreateDocs(100)
+	time.Sleep(20 * time.Second)
+
+	resp, err = faultInjectionRequest("GET", nil)
+	FailTestIfError(err, "Error in getting fault injection stats", t)
+	log.Printf("Fault injection stats %+v, disk failures %v", *resp.Stats, resp.DiskFailures)
+	if resp.Stats.EnospcWrites == 0 {
+		t.Fatalf("No ENOSPC injected into disk snapshot writes")
+	}
+	if resp.DiskFailures <= diskFailures {
+		t.Fatalf("Injected disk failures were not counted")
+	}
+
+	// scans are served from memory while snapshots fail
+	validateAgeScan(indexName, t)
+
+	_, err = faultInjectionRequest("DELETE", nil)
+	FailTestIfError(err, "Error in disabling fault injection", t)
+
+	// wait for a good disk snapshot, then recover from it
+	time.Sleep(20 * time.Second)
+	forceKillIndexer()
+	waitForIndexActive("default", indexName, t)
+	validateAgeScan(indexName, t)
+}
+
+// A disk snapshot is corrupted when read during recovery. The indexer must
+// detect the corruption, clean up the index, and keep serving. Only one disk
+// snapshot is kept, so that there is no older snapshot to recover from.
+func TestDiskFaultInjection_CorruptedSnapshot(t *testing.T) {
+	log.Printf("In TestDiskFaultInjection_CorruptedSnapshot()")
+	if skipIfNotMOI(t) {
+		return
+	}
+
+	var indexName = "idx_fault_age"
+
+	changeSetting := func(key string, value interface{}) {
+		err := secondaryindex.ChangeIndexerSettings(key, value,
+			clusterconfig.Username, clusterconfig.Password, kvaddress)
+		FailTestIfError(err, "Error in ChangeIndexerSettings", t)
+	}
+	changeSetting("indexer.settings.moi.recovery.max_rollbacks", float64(1))
+	changeSetting("indexer.recovery.max_disksnaps", float64(1))
+	defer changeSetting("indexer.settings.moi.recovery.max_rollbacks", float64(2))
+	defer changeSetting("indexer.recovery.max_disksnaps", float64(4))
+
+	secondaryindex.DropAllSecondaryIndexes(indexManagementAddress)
+	err := secondaryindex.CreateSecondaryIndex(indexName, "default", indexManagementAddress, "", []string{"age"}, false, nil, true, defaultIndexActiveTimeout, nil)
+	FailTestIfError(err, "Error in creating the index", t)
+
+	setMOIPersistedSnapshotInterval(5000, t)
+	defer setMOIPersistedSnapshotInterval(600000, t)
+
+	CreateDocs(100)
+	time.Sleep(20 * time.Second)
+
+	// The fault is set by a setting, so that it applies as soon as the
+	// indexer restarts and reads the snapshot
+	changeFaultSetting := func(key string, value interface{}) {
+		changeSetting("indexer.iowrap.fault_injection."+key, value)
+	}
+	changeFaultSetting("path_filter", faultInjectionPathFilter)
+	changeFaultSetting("corrupt_nth_read", float64(1))
+	defer changeFaultSetting("path_filter", "")
+	defer changeFaultSetting("corrupt_nth_read", float64(0))
+
+	tc.KillIndexer()
+	time.Sleep(60 * time.Second)
+
+	changeFaultSetting("corrupt_nth_read", float64(0))
+
+	// The corrupted snapshot is removed and the indexer restarts, to clean
+	// up the index on its next bootstrap. Its data is never served.
+	dropped := false
+	for i := 0; i < 24 && !dropped; i++ {
+		exists, err := secondaryindex.IndexExists(indexName, "default", indexManagementAddress)
+		if err != nil {
+			log.Printf("Error in checking index %v: %v", indexName, err)
+		}
+		dropped = err == nil && !exists
+		if !dropped {
+			time.Sleep(5 * time.Second)
+		}
+	}
+	if !dropped {
+		t.Fatalf("Index %v with a corrupted snapshot was not cleaned up after recovery", indexName)
+	}
+
+	// The indexer keeps serving, and the index can be recreated
+	err = secondaryindex.CreateSecondaryIndex(indexName, "default", indexManagementAddress, "", []string{"age"}, false, nil, true, defaultIndexActiveTimeout, nil)
+	FailTestIfError(err, "Error in creating the index", t)
+	validateAgeScan(indexName, t)
+}
@@ -0,0 +1,187 @@
+// Tool replays the dcp events recorded by projector, with
+// projector.dcp.record.dir, through projector's vbucket worker and index
+// evaluators, to reproduce issues and to benchmark evaluators offline.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/couchbase/cbauth"
+	c "github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/dataport"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/projector"
+)
+
+var options struct {
+	vbnos    []uint16 // vbuckets to replay, all if empty
+	repeat   int      // number of times to replay the recording
+	endpoint string   // indexer dataport to replay to
+	cluster  string   // cluster of the indexer
+	auth     string
+	debug    bool
+	trace    bool
+}
+
+func argParse() string {
+	var vbnos string
+
+	flag.StringVar(&vbnos, "vbuckets", "",
+		"comma separated vbuckets to replay, all vbuckets if empty")
+	flag.IntVar(&options.repeat, "repeat", 1,
+		"number of times to replay the recording")
+	flag.StringVar(&options.endpoint, "endpoint", "",
+		"indexer dataport to send key versions to, counted and dropped if empty")
+	flag.StringVar(&options.cluster, "cluster", "localhost:9000",
+		"cluster of the indexer, with -endpoint")
+	flag.StringVar(&options.auth, "auth", "",
+		"Auth user and password, with -endpoint")
+	flag.BoolVar(&options.debug, "debug", false,
+		"display debug logs")
+	flag.BoolVar(&options.trace, "trace", false,
+		"display trace logs")
+
+	flag.Parse()
+
+	if options.debug {
+		logging.SetLogLevel(logging.Debug)
+	} else if options.trace {
+		logging.SetLogLevel(logging.Trace)
+	} else {
+		logging.SetLogLevel(logging.Warn)
+	}
+	if vbnos != "" {
+		for _, s := range strings.Split(vbnos, ",") {
+			vbno, err := strconv.ParseUint(strings.TrimSpace(s), 10, 16)
+			if err != nil {
+				logging.Fatalf("invalid vbucket %q", s)
+				os.Exit(1)
+			}
+			options.vbnos = append(options.vbnos, uint16(vbno))
+		}
+	}
+
+	args := flag.Args()
+	if len(args) < 1 {
+		usage()
+		os.Exit(1)
+	}
+	return args[0]
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage : %s [OPTIONS] <recording-dir|recording-file>\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	path := argParse()
+
+	config := c.SystemConfig.SectionConfig("projector.", true /*trim*/)
+	for i := 0; i < options.repeat; i++ {
+		endpoint := newEndpoint(config)
+		stats, err := projector.ReplayDcpRecording(path, config, endpoint, options.vbnos)
+		if err != nil {
+			logging.Fatalf("replay %v: %v", path, err)
+			os.Exit(1)
+		}
+		endpoint.Close()
+
+		fmt.Printf("replay %v: %v events, %v mutations, %v skipped, %v headers in %v\n",
+			i+1, stats.Events, stats.Mutations, stats.Skipped, stats.Headers, stats.Duration)
+		if counter, ok := endpoint.(*countEndpoint); ok {
+			counter.print()
+		}
+	}
+}
+
+func newEndpoint(config c.Config) c.RouterEndpoint {
+	if options.endpoint == "" {
+		return &countEndpoint{keys: make(map[uint64]int), finch: make(chan bool)}
+	}
+
+	if options.auth != "" {
+		up := strings.Split(options.auth, ":")
+		if _, err := cbauth.InternalRetryDefaultInit(options.cluster, up[0], up[1]); err != nil {
+			logging.Fatalf("Failed to initialize cbauth: %s", err)
+			os.Exit(1)
+		}
+	}
+	epConfig := config.SectionConfig("dataport.", true /*trim*/)
+	epConfig.Set("syncTimeout", config["syncTimeout"])
+	endpoint, err := dataport.NewRouterEndpoint(
+		options.cluster, "dcpreplay", options.endpoint, epConfig, options.auth != "")
+	if err != nil {
+		logging.Fatalf("endpoint %v: %v", options.endpoint, err)
+		os.Exit(1)
+	}
+	return endpoint
+}
+
+// countEndpoint counts the key versions of each index.
+type countEndpoint struct {
+	mu       sync.Mutex
+	keys     map[uint64]int // index uuid -> #key versions
+	controls int
+	finch    chan bool
+	once     sync.Once
+}
+
+func (ep *countEndpoint) Ping() bool                            { return true }
+func (ep *countEndpoint) ResetConfig(config c.Config) error     { return nil }
+func (ep *countEndpoint) GetStatistics() map[string]interface{} { return nil }
+func (ep *countEndpoint) GetStats() map[string]interface{}      { return nil }
+
+func (ep *countEndpoint) Send(data interface{}) error {
+	return ep.Send2(data, nil)
+}
+
+func (ep *countEndpoint) Send2(data interface{}, abortCh chan bool) error {
+	kv, ok := data.(*c.DataportKeyVersions)
+	if !ok || kv.Kv == nil {
+		return nil
+	}
+
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	for i, uuid := range kv.Kv.Uuids {
+		switch kv.Kv.Commands[i] {
+		case c.Upsert, c.Deletion, c.UpsertDeletion:
+			ep.keys[uuid]++
+		default:
+			ep.controls++
+		}
+	}
+	return nil
+}
+
+func (ep *countEndpoint) Close() error {
+	ep.once.Do(func() { close(ep.finch) })
+	return nil
+}
+
+func (ep *countEndpoint) WaitForExit() error {
+	<-ep.finch
+	return nil
+}
+
+func (ep *countEndpoint) print() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+
+	uuids := make([]uint64, 0, len(ep.keys))
+	for uuid := range ep.keys {
+		uuids = append(uuids, uuid)
+	}
+	sort.Slice(uuids, func(i, j int) bool { return uuids[i] < uuids[j] })
+	for _, uuid := range uuids {
+		fmt.Printf("    index %v: %v key versions\n", uuid, ep.keys[uuid])
+	}
+	fmt.Printf("    %v control messages\n", ep.controls)
+}